@@ -1,23 +1,18 @@
 package cheaptime
 
 import (
+	"sync"
 	"time"
-
-	"github.com/glycerine/qlease/rdtsc"
 )
 
-var baseNano int64 = 0
-var baseTsc uint64
-var scale float64
+var baseNano int64 // wall clock time at the zero of the default time source
+var baseOnce sync.Once
 
+// Now returns the wall clock time in ns, as read from the default time
+// source (see Default).
 func Now() int64 {
-	if baseNano == 0 {
-		baseNano = time.Now().UnixNano()
-		baseTsc = rdtsc.Cputicks()
-		time.Sleep(1e7)
-		rn := time.Now().UnixNano()
-		ct := rdtsc.Cputicks()
-		scale = float64(rn-baseNano) / float64(ct-baseTsc)
-	}
-	return baseNano + int64(float64(rdtsc.Cputicks()-baseTsc)*scale)
+	baseOnce.Do(func() {
+		baseNano = time.Now().UnixNano() - Default().Nanos()
+	})
+	return baseNano + Default().Nanos()
 }
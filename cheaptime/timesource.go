@@ -0,0 +1,74 @@
+package cheaptime
+
+import (
+	"sync"
+	"time"
+
+	"github.com/glycerine/qlease/rdtsc"
+)
+
+// A TimeSource reads a clock in nanoseconds. Only the differences between
+// readings of the same source are meaningful: sources start at arbitrary
+// points, and do not follow changes to the wall clock.
+type TimeSource interface {
+	Nanos() int64
+}
+
+// Monotonic reads Go's monotonic clock.
+type Monotonic struct {
+	start time.Time
+}
+
+func NewMonotonic() *Monotonic {
+	return &Monotonic{start: time.Now()}
+}
+
+func (m *Monotonic) Nanos() int64 {
+	return int64(time.Since(m.start))
+}
+
+// Calibrated reads the CPU's cycle counter (see rdtsc.Cputicks), which is
+// cheaper than the monotonic clock, scaled to nanoseconds by timing it
+// against that clock. Readings from machines with different tick rates are
+// thus comparable.
+type Calibrated struct {
+	baseTsc uint64
+	scale   float64 // ns per tick
+}
+
+// how long NewCalibrated times the counter for
+const CALIBRATION_NS = 1e7
+
+// NewCalibrated calibrates a cycle counter source, which takes
+// CALIBRATION_NS. The counter must tick at a constant rate (an "invariant
+// TSC", which every x86 CPU of the last decade has; the arm64 virtual
+// counter always does).
+func NewCalibrated() *Calibrated {
+	start := time.Now()
+	baseTsc := rdtsc.Cputicks()
+	time.Sleep(CALIBRATION_NS)
+	ticks := rdtsc.Cputicks() - baseTsc
+	elapsed := time.Since(start)
+	return &Calibrated{baseTsc: baseTsc, scale: float64(elapsed) / float64(ticks)}
+}
+
+func (c *Calibrated) Nanos() int64 {
+	return int64(float64(rdtsc.Cputicks()-c.baseTsc) * c.scale)
+}
+
+var defaultSource TimeSource
+var defaultOnce sync.Once
+
+// Default returns a Calibrated source where there is a hardware cycle counter
+// (amd64 and arm64) and a Monotonic one elsewhere, created on the first call
+// and shared afterwards.
+func Default() TimeSource {
+	defaultOnce.Do(func() {
+		if rdtsc.Hardware {
+			defaultSource = NewCalibrated()
+		} else {
+			defaultSource = NewMonotonic()
+		}
+	})
+	return defaultSource
+}
@@ -155,7 +155,7 @@ func main() {
 
 	var id int32 = 0
 	done := make(chan bool, N)
-	args := genericsmrproto.Propose{id, state.Command{state.PUT, 0, 0}, 0}
+	args := genericsmrproto.Propose{id, state.Command{state.PUT, 0, 0, 0}, 0}
 
 	before_total := time.Now()
 
@@ -317,7 +317,7 @@ func waitReplies(readers []*bufio.Reader, leader int, n int, done chan bool, rea
 		}
 		if reply.OK != 0 {
 			successful[leader]++
-			if reply.Value == 1000772 { //hack: special value means read was local
+			if reply.Fence != 0 { // only local reads carry a fencing token
 				local[leader]++
 			}
 		}
@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/rpc"
 	"runtime"
+	"strconv"
 	"time"
 
 	"github.com/glycerine/qlease/dlog"
@@ -34,6 +35,17 @@ var s = flag.Float64("s", 2, "Zipfian s parameter")
 var v = flag.Float64("v", 1, "Zipfian v parameter")
 var forcedN = flag.Int("N", -1, "Connect only to the first N replicas. Disabled by default")
 var forceLeader = flag.Int("l", -1, "Force client to talk to a certain replica.")
+var group = flag.Int("group", 0, "SMR group to send requests to, for servers hosting several groups. Defaults to 0.")
+var status = flag.Bool("status", false, "Print the status of every replica and exit.")
+var drain = flag.Int("drain", -1, "Drain this replica before a planned stop: wait until it has handed off its leases, then exit.")
+var drainTimeout = flag.Duration("draintimeout", 30*time.Second, "How long to wait for -drain.")
+var readOnly = flag.Int("readonly", -1, "Put this replica in read-only mode (it serves reads and answers writes ERR_NOT_WRITABLE), and exit.")
+var writable = flag.Int("writable", -1, "Take this replica out of read-only mode, and exit.")
+var audit = flag.Int("audit", -1, "Print the audit log of this replica and exit.")
+var follow = flag.Bool("follow", false, "With -audit, keep printing new audit events as they happen.")
+var export = flag.Int("export", -1, "Export the state of this replica (of -group) to a file on its host, and exit.")
+var backup = flag.Int("backup", -1, "Have this replica (of -group) take a backup at once, where its -backupto says, and exit.")
+var exportTo = flag.String("exportto", "state.export", "File, on the replica's host, that -export writes.")
 
 var N int
 
@@ -72,6 +84,45 @@ func main() {
 	}
 
 	N = len(rlReply.ReplicaList)
+	if *drain >= 0 {
+		if *drain >= N {
+			log.Fatalf("There is no replica %d\n", *drain)
+		}
+		drainReplica(rlReply.ReplicaList[*drain])
+		return
+	}
+	if *readOnly >= 0 || *writable >= 0 {
+		q := *readOnly
+		if q < 0 {
+			q = *writable
+		}
+		if q >= N {
+			log.Fatalf("There is no replica %d\n", q)
+		}
+		setReadOnly(rlReply.ReplicaList[q], q, *readOnly >= 0)
+		return
+	}
+	if *audit >= 0 {
+		if *audit >= N {
+			log.Fatalf("There is no replica %d\n", *audit)
+		}
+		tailAudit(rlReply.ReplicaList[*audit])
+		return
+	}
+	if *backup >= 0 {
+		if *backup >= N {
+			log.Fatalf("There is no replica %d\n", *backup)
+		}
+		backupState(rlReply.ReplicaList[*backup])
+		return
+	}
+	if *export >= 0 {
+		if *export >= N {
+			log.Fatalf("There is no replica %d\n", *export)
+		}
+		exportState(rlReply.ReplicaList[*export])
+		return
+	}
 	if *forcedN > N {
 		log.Fatalf("Cannot connect to more than the total number of replicas. -N parameter too high.\n")
 	}
@@ -139,6 +190,16 @@ func main() {
 		}
 		readers[i] = bufio.NewReader(servers[i])
 		writers[i] = bufio.NewWriter(servers[i])
+		if *group != 0 {
+			selectGroup(readers[i], writers[i], uint16(*group))
+		}
+	}
+
+	if *status {
+		for i := 0; i < N; i++ {
+			printStatus(readers[i], writers[i])
+		}
+		return
 	}
 
 	successful = make([]int, N)
@@ -159,7 +220,7 @@ func main() {
 
 	var id int32 = 0
 	done := make(chan bool, N)
-	args := genericsmrproto.Propose{id, state.Command{state.PUT, 0, 0}, 0}
+	args := genericsmrproto.Propose{id, state.Command{state.PUT, 0, 0, 0}, 0}
 
 	before_total := time.Now()
 
@@ -279,6 +340,159 @@ func main() {
 	master.Close()
 }
 
+func selectGroup(reader *bufio.Reader, writer *bufio.Writer, g uint16) {
+	writer.WriteByte(genericsmrproto.SELECT_GROUP)
+	(&genericsmrproto.SelectGroup{Group: g}).Marshal(writer)
+	writer.Flush()
+	reply := new(genericsmrproto.SelectGroupReply)
+	if err := reply.Unmarshal(reader); err != nil || reply.OK == 0 {
+		log.Fatalf("Could not select group %d\n", g)
+	}
+}
+
+func printStatus(reader *bufio.Reader, writer *bufio.Writer) {
+	writer.WriteByte(genericsmrproto.STATUS)
+	new(genericsmrproto.Status).Marshal(writer)
+	writer.Flush()
+	st := new(genericsmrproto.StatusReply)
+	if err := st.Unmarshal(reader); err != nil {
+		log.Println("Error reading status:", err)
+		return
+	}
+	fmt.Printf("Replica %d (group %d, leader %d): lease instance %d, local reads until %d, quorum writes until %d\n",
+		st.ReplicaId, st.GroupId, st.Leader, st.LeaseInst, st.ReadLocallyUntil, st.WriteInQuorumUntil)
+	if st.Zone != "" || st.Region != "" {
+		fmt.Printf("  zone %q, region %q\n", st.Zone, st.Region)
+	}
+	for _, p := range st.Peers {
+		fmt.Printf("  peer %d: alive %d, ewma %.0f, last reply %d, last heard %d, clock offset %d ± %d\n",
+			p.ReplicaId, p.Alive, p.EwmaLatency, p.LastReplyNs, p.LastHeardNs, p.ClockOffset, p.ClockError)
+	}
+	for _, c := range st.Chans {
+		fmt.Printf("  %s: %d/%d, %d dropped\n", c.Name, c.Len, c.Cap, c.Dropped)
+	}
+	fmt.Printf("  commit backlog: %d instances; %d proposals rejected, %d connection pauses\n",
+		st.CommitBacklog, st.BacklogRejected, st.BacklogPaused)
+	fmt.Printf("  %d proposals dropped or replies not sent past their deadlines\n", st.DeadlineDropped)
+	printReads := func(what string, rc *genericsmrproto.ReadCounts) {
+		fmt.Printf("  reads %s: %d local, %d quorum, %d forwarded, %d rejected\n",
+			what, rc.Local, rc.Quorum, rc.Forwarded, rc.Rejected)
+	}
+	printReads("in total", &st.Reads)
+	for i := range st.ReadsByPrefix {
+		rc := &st.ReadsByPrefix[i]
+		printReads(fmt.Sprintf("of keys [%d, %d]", rc.Prefix<<st.ReadPrefixShift, (rc.Prefix+1)<<st.ReadPrefixShift-1), rc)
+	}
+	fmt.Printf("  state: %d keys, about %d bytes", st.StateKeys, st.StateBytes)
+	if st.MaxStateBytes > 0 {
+		fmt.Printf(" of at most %d; %d writes rejected", st.MaxStateBytes, st.StateRejected)
+	}
+	fmt.Println()
+	for _, l := range st.Latencies {
+		if l.Count > 0 {
+			fmt.Printf("  %s latency of %d proposals: mean %v, p50 %v, p90 %v, p99 %v, p99.9 %v, max %v\n",
+				l.Stage, l.Count, time.Duration(l.MeanNs), time.Duration(l.P50Ns), time.Duration(l.P90Ns),
+				time.Duration(l.P99Ns), time.Duration(l.P999Ns), time.Duration(l.MaxNs))
+		}
+	}
+	for _, t := range st.Traffic {
+		conn := fmt.Sprintf("peer %d", t.ReplicaId)
+		if t.ReplicaId < 0 {
+			conn = fmt.Sprintf("client %d", t.ClientId)
+		}
+		fmt.Printf("  %s (%s): sent %d msgs, %d bytes in %d writes; received %d msgs, %d bytes; %d reconnects; last sent %d, last received %d\n",
+			conn, t.RemoteAddr, t.MsgsSent, t.BytesSent, t.Flushes, t.MsgsReceived, t.BytesReceived, t.Reconnects, t.LastSentNs, t.LastReceivedNs)
+	}
+}
+
+// connect to the admin RPCs of the replica at addr, served on its port + 1000
+func dialAdmin(addr string) *rpc.Client {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		log.Fatal(err)
+	}
+	admin, err := rpc.DialHTTP("tcp", net.JoinHostPort(host, strconv.Itoa(p+1000)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return admin
+}
+
+// drain the replica at addr
+func drainReplica(addr string) {
+	admin := dialAdmin(addr)
+	args := &genericsmrproto.PrepareStopArgs{TimeoutNs: int64(*drainTimeout)}
+	if err := admin.Call("Replica.PrepareStop", args, new(genericsmrproto.PrepareStopReply)); err != nil {
+		log.Fatalf("Draining %s: %v\n", addr, err)
+	}
+	fmt.Printf("Replica %d (%s) is drained, safe to stop\n", *drain, addr)
+}
+
+// put replica q, at addr, in read-only mode or back out of it
+func setReadOnly(addr string, q int, readOnly bool) {
+	admin := dialAdmin(addr)
+	args := &genericsmrproto.ReadOnlyArgs{}
+	mode := "writable"
+	if readOnly {
+		args.ReadOnly, mode = 1, "read-only"
+	}
+	if err := admin.Call("Replica.ReadOnlyMode", args, new(genericsmrproto.ReadOnlyReply)); err != nil {
+		log.Fatalf("Making %s %s: %v\n", addr, mode, err)
+	}
+	fmt.Printf("Replica %d (%s) is %s\n", q, addr, mode)
+}
+
+// print the audit log of the replica at addr, and with -follow, its new
+// events as they happen
+func tailAudit(addr string) {
+	admin := dialAdmin(addr)
+	args := &genericsmrproto.AuditTailArgs{}
+	for {
+		reply := new(genericsmrproto.AuditTailReply)
+		if err := admin.Call("Replica.AuditTail", args, reply); err != nil {
+			log.Fatalf("Reading the audit log of %s: %v\n", addr, err)
+		}
+		if reply.First > args.After+1 {
+			fmt.Printf("(events %d to %d are no longer remembered)\n", args.After+1, reply.First-1)
+		}
+		for _, ev := range reply.Events {
+			fmt.Printf("%d %s replica %d group %d %s: %s\n", ev.Seq, time.Unix(0, ev.TimeNs).Format(time.RFC3339Nano),
+				ev.ReplicaId, ev.GroupId, ev.Kind, ev.Detail)
+			args.After = ev.Seq
+		}
+		if !*follow {
+			return
+		}
+		args.WaitNs = int64(10 * time.Second)
+	}
+}
+
+// export the state of the replica at addr
+func exportState(addr string) {
+	admin := dialAdmin(addr)
+	args := &genericsmrproto.ExportStateArgs{Path: *exportTo, Group: uint16(*group)}
+	reply := new(genericsmrproto.ExportStateReply)
+	if err := admin.Call("Replica.ExportState", args, reply); err != nil {
+		log.Fatalf("Exporting the state of %s: %v\n", addr, err)
+	}
+	fmt.Printf("Replica %d (%s) exported %d keys, as of instance %d, to %s\n", *export, addr, reply.Keys, reply.Inst, *exportTo)
+}
+
+// have the replica at addr take a backup
+func backupState(addr string) {
+	admin := dialAdmin(addr)
+	args := &genericsmrproto.BackupArgs{Group: uint16(*group)}
+	reply := new(genericsmrproto.BackupReply)
+	if err := admin.Call("Replica.Backup", args, reply); err != nil {
+		log.Fatalf("Backing up %s: %v\n", addr, err)
+	}
+	fmt.Printf("Replica %d (%s) backed up %d keys, as of instance %d, to %s\n", *backup, addr, reply.Keys, reply.Inst, reply.Name)
+}
+
 func waitReplies(readers []*bufio.Reader, leader int, n int, done chan bool) {
 	e := false
 
@@ -298,9 +512,11 @@ func waitReplies(readers []*bufio.Reader, leader int, n int, done chan bool) {
 		}
 		if reply.OK != 0 {
 			successful[leader]++
-			if reply.Value == 1000772 { //hack: special value means read was local
+			if reply.Fence != 0 { // only local reads carry a fencing token
 				local[leader]++
 			}
+		} else if reply.ErrCode != genericsmrproto.ERR_NONE {
+			dlog.Println(reply.Err())
 		}
 	}
 	done <- e
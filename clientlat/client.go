@@ -158,7 +158,7 @@ func simulatedClient(rlReply *masterproto.GetReplicaListReply, leaderId int, rea
 	}
 
 	var id int32 = 0
-	args := genericsmrproto.Propose{id, state.Command{state.PUT, 0, 0}, 0}
+	args := genericsmrproto.Propose{id, state.Command{state.PUT, 0, 0, 0}, 0}
 	var reply genericsmrproto.ProposeReplyTS
 
 	n := *reqsNb
@@ -0,0 +1,285 @@
+package clientlib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/state"
+)
+
+var ErrNoReplica = errors.New("no replica to send the command to")
+
+// how long a replica may take to answer a status request
+const STATUS_TIMEOUT = time.Second
+
+// A Balancer picks the replica that Send sends a command to, from the
+// client's latest view of the cluster (see Balance); -1 if none will do.
+type Balancer interface {
+	Pick(cmd state.Command, view *View) int
+}
+
+// ReplicaView is what the client learned of a replica from its latest status
+// request.
+type ReplicaView struct {
+	Status  *genericsmrproto.StatusReply // nil if the replica did not answer
+	RTT     time.Duration                // round trip of the status request
+	Fetched time.Time                    // when the answer arrived
+}
+
+func (rv *ReplicaView) Up() bool {
+	return rv.Status != nil
+}
+
+// CanReadLocally reports whether the replica held a lease, when it answered,
+// that lets it serve reads locally until at least now.
+func (rv *ReplicaView) CanReadLocally(now time.Time) bool {
+	st := rv.Status
+	if st == nil || st.LeaseInst < 0 {
+		return false
+	}
+	return now.Sub(rv.Fetched) < time.Duration(st.ReadLocallyUntil-st.NowNs)
+}
+
+// View is the client's view of the cluster, by replica ID.
+type View struct {
+	Replicas []ReplicaView
+	Leader   int // -1 if unknown
+}
+
+// Nearest returns the replica with the lowest RTT among those that are up
+// and that accept (nil to accept all), or -1.
+func (v *View) Nearest(accept func(replica int) bool) int {
+	best := -1
+	for i := range v.Replicas {
+		rv := &v.Replicas[i]
+		if !rv.Up() || (accept != nil && !accept(i)) {
+			continue
+		}
+		if best < 0 || rv.RTT < v.Replicas[best].RTT {
+			best = i
+		}
+	}
+	return best
+}
+
+// Nearest sends every command to the closest replica, by RTT.
+type Nearest struct{}
+
+func (Nearest) Pick(cmd state.Command, view *View) int {
+	return view.Nearest(nil)
+}
+
+// LeaderLeases sends writes to the leader, and reads to the closest replica
+// holding a lease that lets it read locally (e.g., the client's local lease
+// holder, in a geo-distributed cluster), or to the leader if none does.
+type LeaderLeases struct{}
+
+func (LeaderLeases) Pick(cmd state.Command, view *View) int {
+	if state.IsRead(&cmd) {
+		now := time.Now()
+		if q := view.Nearest(func(i int) bool { return view.Replicas[i].CanReadLocally(now) }); q >= 0 {
+			return q
+		}
+	}
+	if view.Leader >= 0 {
+		return view.Leader
+	}
+	return view.Nearest(nil)
+}
+
+// RoundRobin spreads the commands over the replicas that are up.
+type RoundRobin struct {
+	next uint32
+}
+
+func (rr *RoundRobin) Pick(cmd state.Command, view *View) int {
+	n := len(view.Replicas)
+	start := int(atomic.AddUint32(&rr.next, 1) % uint32(n))
+	for i := 0; i < n; i++ {
+		if q := (start + i) % n; view.Replicas[q].Up() {
+			return q
+		}
+	}
+	return -1
+}
+
+// ParseBalancer returns the balancer called name: nearest, leader-leases or
+// round-robin.
+func ParseBalancer(name string) (Balancer, error) {
+	switch name {
+	case "nearest":
+		return Nearest{}, nil
+	case "leader-leases":
+		return LeaderLeases{}, nil
+	case "round-robin":
+		return new(RoundRobin), nil
+	}
+	return nil, fmt.Errorf("unknown balancer %q (want nearest, leader-leases or round-robin)", name)
+}
+
+// Balance makes Send pick replicas with b, from a view of the cluster built
+// from the replicas' status, which is fetched before Balance returns, then
+// every interval until the client is closed.
+func (c *Client) Balance(b Balancer, interval time.Duration) {
+	c.refreshView()
+	c.lock.Lock()
+	c.balancer = b
+	start := !c.balancing
+	c.balancing = true
+	c.lock.Unlock()
+	if !start {
+		return
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				c.refreshView()
+			case <-c.closed:
+				return
+			}
+		}
+	}()
+}
+
+// View returns the client's latest view of the cluster (nil before Balance).
+func (c *Client) View() *View {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.view
+}
+
+// Pick returns the replica the balancer picks for cmd, or -1. Replicas
+// whose breakers are open are left out, as if they were down.
+func (c *Client) Pick(cmd state.Command) int {
+	c.lock.Lock()
+	b, view := c.balancer, c.view
+	c.lock.Unlock()
+	if b == nil || view == nil {
+		return -1
+	}
+	q := b.Pick(cmd, view)
+	if q < 0 || !c.CircuitOpen(q) {
+		return q
+	}
+	view = &View{Replicas: append([]ReplicaView(nil), view.Replicas...), Leader: view.Leader}
+	for i := range view.Replicas {
+		if c.CircuitOpen(i) {
+			view.Replicas[i].Status = nil
+		}
+	}
+	if view.Leader >= 0 && !view.Replicas[view.Leader].Up() {
+		view.Leader = -1
+	}
+	return b.Pick(cmd, view)
+}
+
+// Send sends cmd to the replica the balancer picks (see Balance), and
+// returns without waiting for the reply.
+func (c *Client) Send(cmd state.Command, done chan *Call) *Call {
+	replica := c.Pick(cmd)
+	if replica < 0 {
+		if done == nil {
+			done = make(chan *Call, 1)
+		}
+		call := &Call{Replica: replica, Command: cmd, Done: done, Err: ErrNoReplica}
+		call.done()
+		return call
+	}
+	return c.Go(replica, cmd, done)
+}
+
+// take in a configuration update a replica pushed: if it changes the view,
+// the view changes at once to its leader and live replicas, and is refreshed
+// from the replicas' status in the background
+func (c *Client) configUpdated(update *genericsmrproto.ProposeReplyTS) {
+	c.lock.Lock()
+	if c.view == nil {
+		c.lock.Unlock()
+		return
+	}
+	view := &View{Replicas: append([]ReplicaView(nil), c.view.Replicas...), Leader: c.view.Leader}
+	changed := false
+	if leader := int(update.Value); leader >= 0 && leader != view.Leader {
+		view.Leader = leader
+		changed = true
+	}
+	for i := range view.Replicas {
+		alive := i >= 64 || update.Fence&(1<<uint(i)) != 0
+		if alive != (view.Replicas[i].Status != nil) {
+			view.Replicas[i].Status = nil
+			changed = true
+		}
+	}
+	if changed {
+		c.view = view
+	}
+	c.lock.Unlock()
+	if changed {
+		go c.refreshView()
+	}
+}
+
+// ask every replica for its status, at once
+func (c *Client) refreshView() {
+	view := &View{Replicas: make([]ReplicaView, len(c.Replicas)), Leader: -1}
+	done := make(chan bool, len(c.Replicas))
+	for i, addr := range c.Replicas {
+		go func(rv *ReplicaView, addr string) {
+			start := time.Now()
+			if st, err := fetchStatus(addr, c.Group); err == nil {
+				rv.Fetched = time.Now()
+				rv.RTT = rv.Fetched.Sub(start)
+				rv.Status = st
+			}
+			done <- true
+		}(&view.Replicas[i], addr)
+	}
+	for range c.Replicas {
+		<-done
+	}
+	// believe a replica that says it leads over the others
+	for i := range view.Replicas {
+		if st := view.Replicas[i].Status; st != nil && st.Leader >= 0 {
+			if view.Leader < 0 || int(st.Leader) == i {
+				view.Leader = int(st.Leader)
+			}
+		}
+	}
+	c.lock.Lock()
+	c.view = view
+	c.lock.Unlock()
+}
+
+// ask a replica for its status, over a connection of its own
+func fetchStatus(addr string, group uint16) (*genericsmrproto.StatusReply, error) {
+	conn, err := net.DialTimeout("tcp", addr, STATUS_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(STATUS_TIMEOUT))
+	reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+	if group != 0 {
+		if err := selectGroup(reader, writer, group); err != nil {
+			return nil, err
+		}
+	}
+	writer.WriteByte(genericsmrproto.STATUS)
+	new(genericsmrproto.Status).Marshal(writer)
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	st := new(genericsmrproto.StatusReply)
+	if err := st.Unmarshal(reader); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
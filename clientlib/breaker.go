@@ -0,0 +1,245 @@
+package clientlib
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// During a partial outage, clients that keep sending to a failing replica,
+// and retrying what failed there, add load where it hurts most, and retries
+// that fire together come back in waves. A Client can guard against both.
+//
+// With Breakers set, each replica has a circuit breaker: once Failures calls
+// in a row to the replica have failed (their connection failed, their
+// deadline passed, or the replica answered ERR_OVERLOADED or ERR_TIMEOUT),
+// the breaker opens, and calls to the replica fail at once with
+// ErrCircuitOpen, without being sent, for a cooldown; Send's balancer picks
+// among the other replicas meanwhile. After the cooldown, one trial call is
+// let through: if it succeeds the breaker closes, and if it fails the breaker
+// opens again for twice as long, up to MAX_BREAKER_COOLDOWN.
+//
+// With RetryBudget set, Retry draws from a budget shared by the whole
+// client: every first attempt adds Ratio to it, and MinPerSec are added every
+// second, up to MAX_RETRY_TOKENS; a retry takes one, or fails at once with
+// ErrRetryBudget if there is none, so that retries stay a bounded fraction
+// of the load however many calls fail.
+
+var ErrCircuitOpen = errors.New("the replica's circuit breaker is open")
+var ErrRetryBudget = errors.New("retry budget exhausted")
+
+// how long a breaker stays open the first time (unless configured)
+const DEFAULT_BREAKER_COOLDOWN = time.Second
+
+// the longest a breaker stays open
+const MAX_BREAKER_COOLDOWN = 30 * time.Second
+
+// the most retries the budget can save up
+const MAX_RETRY_TOKENS = 100
+
+// BreakerConfig configures the circuit breakers of the replicas. The zero
+// value has none.
+type BreakerConfig struct {
+	Failures int           // failed calls in a row that open a replica's breaker (0 for no breakers)
+	Cooldown time.Duration // how long it stays open the first time (0 for DEFAULT_BREAKER_COOLDOWN)
+}
+
+// RetryBudgetConfig configures the budget of Retry. The zero value has no
+// budget.
+type RetryBudgetConfig struct {
+	Ratio     float64 // retries earned by every first attempt, e.g. 0.1 for a retry per 10 calls
+	MinPerSec float64 // retries earned every second regardless
+}
+
+func (cfg *RetryBudgetConfig) enabled() bool {
+	return cfg.Ratio > 0 || cfg.MinPerSec > 0
+}
+
+type breaker struct {
+	lock      sync.Mutex
+	cfg       BreakerConfig
+	failures  int           // failed calls in a row
+	openUntil time.Time     // zero while closed
+	cooldown  time.Duration // of the latest opening
+	trialSent time.Time     // when the trial call went, while it is out
+	opened    uint64        // times the breaker opened
+}
+
+func newBreaker(cfg BreakerConfig) *breaker {
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = DEFAULT_BREAKER_COOLDOWN
+	}
+	return &breaker{cfg: cfg}
+}
+
+// whether a call may go, and if so whether it is the trial call; a trial
+// call that has not come back within the cooldown is given up on
+func (b *breaker) allow(now time.Time) (ok bool, trial bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.openUntil.IsZero() {
+		return true, false
+	}
+	if now.Before(b.openUntil) || (!b.trialSent.IsZero() && now.Sub(b.trialSent) < b.cooldown) {
+		return false, false
+	}
+	b.trialSent = now
+	return true, true
+}
+
+// whether calls fail fast now, without taking the trial slot
+func (b *breaker) isOpen(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return !b.openUntil.IsZero() && (now.Before(b.openUntil) || (!b.trialSent.IsZero() && now.Sub(b.trialSent) < b.cooldown))
+}
+
+// count the outcome of a call that went through
+func (b *breaker) record(failed bool, trial bool, now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !failed {
+		b.failures = 0
+		if trial || b.openUntil.IsZero() {
+			b.openUntil, b.trialSent, b.cooldown = time.Time{}, time.Time{}, 0
+		}
+		return
+	}
+	b.failures++
+	switch {
+	case trial:
+		b.cooldown *= 2
+		if b.cooldown > MAX_BREAKER_COOLDOWN {
+			b.cooldown = MAX_BREAKER_COOLDOWN
+		}
+	case b.openUntil.IsZero() && b.failures >= b.cfg.Failures:
+		b.cooldown = b.cfg.Cooldown
+	default:
+		return
+	}
+	b.openUntil = now.Add(b.cooldown)
+	b.trialSent = time.Time{}
+	b.opened++
+}
+
+// whether a call counts against its replica's breaker
+func callFailed(call *Call) bool {
+	if call.Err != nil {
+		return call.Err != ErrClosed
+	}
+	if r := call.Reply; r != nil && r.OK == 0 {
+		return r.ErrCode == genericsmrproto.ERR_OVERLOADED || r.ErrCode == genericsmrproto.ERR_TIMEOUT
+	}
+	return false
+}
+
+type retryBudget struct {
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time // when MinPerSec was last added
+	denied uint64    // retries that found the budget empty (accessed atomically)
+}
+
+func (rb *retryBudget) add(tokens float64) {
+	if rb.tokens += tokens; rb.tokens > MAX_RETRY_TOKENS {
+		rb.tokens = MAX_RETRY_TOKENS
+	}
+}
+
+// a first attempt earns its share of a retry
+func (rb *retryBudget) deposit(cfg *RetryBudgetConfig) {
+	if cfg.Ratio <= 0 {
+		return
+	}
+	rb.lock.Lock()
+	rb.add(cfg.Ratio)
+	rb.lock.Unlock()
+}
+
+// take a retry from the budget, if there is one
+func (rb *retryBudget) withdraw(cfg *RetryBudgetConfig, now time.Time) bool {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	if rb.last.IsZero() {
+		rb.last = now
+		rb.add(cfg.MinPerSec)
+	} else if cfg.MinPerSec > 0 {
+		rb.add(cfg.MinPerSec * now.Sub(rb.last).Seconds())
+		rb.last = now
+	}
+	if rb.tokens < 1 {
+		atomic.AddUint64(&rb.denied, 1)
+		return false
+	}
+	rb.tokens--
+	return true
+}
+
+// the breaker of a replica (nil without breakers)
+func (c *Client) breaker(replica int) *breaker {
+	if c.Breakers.Failures <= 0 {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.breakers == nil {
+		c.breakers = make([]*breaker, len(c.Replicas))
+	}
+	if c.breakers[replica] == nil {
+		c.breakers[replica] = newBreaker(c.Breakers)
+	}
+	return c.breakers[replica]
+}
+
+// let call through its replica's breaker, or fail it
+func (c *Client) admit(call *Call) bool {
+	if call.Replica < 0 || call.Replica >= len(c.Replicas) {
+		return true
+	}
+	b := c.breaker(call.Replica)
+	if b == nil {
+		return true
+	}
+	ok, trial := b.allow(time.Now())
+	if !ok {
+		call.Err = ErrCircuitOpen
+		call.done()
+		return false
+	}
+	call.breaker, call.trial = b, trial
+	return true
+}
+
+// CircuitOpen reports whether calls to a replica fail fast now, its breaker
+// being open.
+func (c *Client) CircuitOpen(replica int) bool {
+	if replica < 0 || replica >= len(c.Replicas) {
+		return false
+	}
+	b := c.breaker(replica)
+	return b != nil && b.isOpen(time.Now())
+}
+
+// BreakerOpenings returns the number of times the breaker of a replica has
+// opened.
+func (c *Client) BreakerOpenings(replica int) uint64 {
+	if replica < 0 || replica >= len(c.Replicas) {
+		return 0
+	}
+	b := c.breaker(replica)
+	if b == nil {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.opened
+}
+
+// RetriesDenied returns the number of retries that failed with
+// ErrRetryBudget.
+func (c *Client) RetriesDenied() uint64 {
+	return atomic.LoadUint64(&c.budget.denied)
+}
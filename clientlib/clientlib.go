@@ -0,0 +1,742 @@
+// Package clientlib is a client for qlease replicas. It finds the replicas
+// through the master and sends them proposals over a pool of connections per
+// replica (one, unless PoolSize says otherwise), each matching its replies to
+// its proposals by command ID, so that any number of goroutines can have
+// proposals outstanding at once.
+package clientlib
+
+import (
+	"bufio"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/masterproto"
+	"github.com/glycerine/qlease/sockopt"
+	"github.com/glycerine/qlease/state"
+)
+
+var ErrClosed = errors.New("connection closed")
+var ErrPingTimeout = errors.New("replica did not answer a ping")
+var ErrDeadline = errors.New("deadline exceeded")
+
+// A Call is a proposal in flight; Done receives the Call when the reply
+// arrives or the connection fails (Err is set then).
+type Call struct {
+	Replica  int
+	Id       int32 // command ID, which Retry sends again
+	Command  state.Command
+	Sent     time.Time
+	Deadline time.Time // zero for none (see GoDeadline)
+	Reply    *genericsmrproto.ProposeReplyTS
+	Err      error
+	Done     chan *Call
+
+	breaker *breaker // the breaker it went through, to tell its outcome (nil for none)
+	trial   bool     // it is the breaker's trial call
+}
+
+func (call *Call) done() {
+	if b := call.breaker; b != nil {
+		call.breaker = nil
+		b.record(callFailed(call), call.trial, time.Now())
+	}
+	select {
+	case call.Done <- call:
+	default:
+		// the caller's channel is full; it must have enough room, as with net/rpc
+	}
+}
+
+type Client struct {
+	Replicas []string // addresses of the replicas, indexed by replica ID
+	Group    uint16   // SMR group to select on every new connection (0 for the default)
+
+	// Session names the client's session to the replicas on every new
+	// connection, so that they answer a command sent again by Retry with
+	// its original result instead of executing it twice. Dial picks a
+	// random one; 0 names none.
+	Session uint64
+
+	// KeepAlive is how often new connections ping the replica when nothing
+	// has arrived from it; a ping unanswered for as long fails the
+	// connection (0 to not ping).
+	KeepAlive time.Duration
+
+	// Codec is the codec that new connections switch to (see
+	// fastrpc.Codec); replicas that do not have it refuse the connection.
+	Codec uint8
+
+	// Identity and Token authenticate new connections to replicas that
+	// check per-key ACLs (see genericsmr.ACL); a connection whose token the
+	// replica refuses fails. An empty Identity authenticates none.
+	Identity string
+	Token    []byte
+
+	// Priority is the priority class of the proposals on new connections
+	// (genericsmrproto.PRIORITY_*), which replicas that schedule proposals
+	// by priority go by.
+	Priority uint8
+
+	// Socket holds the socket options of new connections (see sockopt), to
+	// turn Nagle's algorithm back on, size the kernel's buffers or mark the
+	// packets for QoS.
+	Socket sockopt.Options
+
+	// PoolSize is the number of connections to open to each replica (0 for
+	// one). Each proposal goes on the connection of the pool with the fewest
+	// replies pending, and each connection matches its own replies, so that
+	// replies slow to write or read (e.g., queued behind large ones) hold up
+	// only the proposals on their connection. Set it before the first
+	// proposal.
+	PoolSize int
+
+	// Breakers configures the circuit breakers that fail calls to a failing
+	// replica fast, and RetryBudget the budget that bounds Retry (see
+	// breaker.go). Set them before the first proposal.
+	Breakers    BreakerConfig
+	RetryBudget RetryBudgetConfig
+
+	master   *rpc.Client
+	lock     *sync.Mutex
+	pools    []*pool    // by replica (nil until used)
+	breakers []*breaker // by replica (nil until used)
+	budget   retryBudget
+	nextId   int32
+	causal   *uint64 // the latest HLC timestamp seen in replies, accessed atomically
+	closed   chan struct{}
+
+	balancer  Balancer // picks the replicas for Send (see Balance)
+	view      *View
+	balancing bool // refreshing the view
+}
+
+// Dial connects to the master and fetches the replica list; connections to
+// the replicas are opened when first used.
+func Dial(masterAddr string, masterPort int) (*Client, error) {
+	master, err := rpc.DialHTTP("tcp", net.JoinHostPort(masterAddr, strconv.Itoa(masterPort)))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to master: %v", err)
+	}
+	rl := new(masterproto.GetReplicaListReply)
+	if err = master.Call("Master.GetReplicaList", new(masterproto.GetReplicaListArgs), rl); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("GetReplicaList: %v", err)
+	}
+	return &Client{
+		Replicas: rl.ReplicaList,
+		master:   master,
+		lock:     new(sync.Mutex),
+		pools:    make([]*pool, len(rl.ReplicaList)),
+		causal:   new(uint64),
+		closed:   make(chan struct{}),
+		Session:  newSessionId(),
+	}, nil
+}
+
+func newSessionId() uint64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return uint64(time.Now().UnixNano())
+	}
+	return binary.LittleEndian.Uint64(b[:]) | 1 // never 0
+}
+
+// ParsePriority returns the priority class called name: high, normal or
+// bulk.
+func ParsePriority(name string) (uint8, error) {
+	switch name {
+	case "high":
+		return genericsmrproto.PRIORITY_HIGH, nil
+	case "normal":
+		return genericsmrproto.PRIORITY_NORMAL, nil
+	case "bulk":
+		return genericsmrproto.PRIORITY_BULK, nil
+	}
+	return 0, fmt.Errorf("unknown priority %q (want high, normal or bulk)", name)
+}
+
+func (c *Client) N() int {
+	return len(c.Replicas)
+}
+
+// Leader asks the master which replica is the leader.
+func (c *Client) Leader() (int, error) {
+	reply := new(masterproto.GetLeaderReply)
+	if err := c.master.Call("Master.GetLeader", new(masterproto.GetLeaderArgs), reply); err != nil {
+		return -1, fmt.Errorf("GetLeader: %v", err)
+	}
+	return reply.LeaderId, nil
+}
+
+// the connections to a replica (under the client's lock)
+type pool struct {
+	conns   []*Conn       // nil until opened
+	dialing []bool        // the connections being (re)opened
+	dialed  chan struct{} // closed, and replaced, whenever one has been
+	err     error         // why the latest one failed to open
+}
+
+// Conn returns the healthy connection of a replica's pool with the fewest
+// replies pending. The connections of the pool that are not open yet, or
+// that failed, are (re)opened in the background; Conn only waits for them
+// when none is healthy, and fails if none of them opens.
+func (c *Client) Conn(replica int) (*Conn, error) {
+	if replica < 0 || replica >= len(c.Replicas) {
+		return nil, fmt.Errorf("no replica %d", replica)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	p := c.pools[replica]
+	if p == nil {
+		p = &pool{dialed: make(chan struct{})}
+		c.pools[replica] = p
+	}
+	size := c.PoolSize
+	if size < 1 {
+		size = 1
+	}
+	if len(p.conns) < size {
+		p.conns = append(p.conns, make([]*Conn, size-len(p.conns))...)
+		p.dialing = append(p.dialing, make([]bool, size-len(p.dialing))...)
+	}
+	for i, cn := range p.conns {
+		if (cn == nil || cn.Err() != nil) && !p.dialing[i] {
+			p.dialing[i] = true
+			go c.redial(replica, i)
+		}
+	}
+	for {
+		if best := p.best(); best != nil {
+			return best, nil
+		}
+		dialing := false
+		for _, d := range p.dialing {
+			dialing = dialing || d
+		}
+		if !dialing {
+			if p.err == nil {
+				// opened, but failed since
+				return nil, fmt.Errorf("no open connection to replica %d", replica)
+			}
+			return nil, p.err
+		}
+		dialed := p.dialed
+		c.lock.Unlock()
+		<-dialed
+		c.lock.Lock()
+	}
+}
+
+// the healthy connection with the fewest replies pending (nil if none)
+func (p *pool) best() *Conn {
+	var best *Conn
+	bestPending := 0
+	for _, cn := range p.conns {
+		if cn == nil || cn.Err() != nil {
+			continue
+		}
+		if pending := cn.Pending(); best == nil || pending < bestPending {
+			best, bestPending = cn, pending
+		}
+	}
+	return best
+}
+
+// (re)open connection i of a replica's pool
+func (c *Client) redial(replica int, i int) {
+	cn, err := c.dial(replica, i == 0)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	p := c.pools[replica]
+	select {
+	case <-c.closed:
+		if cn != nil {
+			cn.Close()
+		}
+		cn, err = nil, ErrClosed
+	default:
+	}
+	if err != nil {
+		p.err = err
+	} else {
+		p.conns[i] = cn
+	}
+	p.dialing[i] = false
+	close(p.dialed)
+	p.dialed = make(chan struct{})
+}
+
+// open a connection to a replica; the configuration updates it pushes are
+// only heeded on the first connection of the pool
+func (c *Client) dial(replica int, updates bool) (*Conn, error) {
+	var auth *genericsmrproto.Authenticate
+	if c.Identity != "" {
+		auth = &genericsmrproto.Authenticate{Identity: c.Identity, Token: c.Token}
+	}
+	cn, err := dialReplica(c.Replicas[replica], c.Group, c.Session, c.Codec, auth, c.Priority, &c.Socket, c.causal)
+	if err != nil {
+		return nil, err
+	}
+	cn.replica = replica
+	if updates {
+		cn.lock.Lock()
+		cn.onConfig = c.configUpdated
+		cn.lock.Unlock()
+	}
+	if c.KeepAlive > 0 {
+		go cn.keepAlive(c.KeepAlive)
+	}
+	return cn, nil
+}
+
+// Go sends cmd to a replica and returns without waiting for the reply. If
+// done is nil, a channel with room for one Call is allocated.
+func (c *Client) Go(replica int, cmd state.Command, done chan *Call) *Call {
+	return c.GoDeadline(replica, cmd, time.Time{}, done)
+}
+
+// GoDeadline is Go with a deadline: the call fails with ErrDeadline once it
+// passes, and the replicas then drop cmd if they have not proposed it yet,
+// and do not reply to it.
+func (c *Client) GoDeadline(replica int, cmd state.Command, deadline time.Time, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 1)
+	}
+	call := &Call{Replica: replica, Command: cmd, Deadline: deadline, Done: done}
+	if !c.admit(call) {
+		return call
+	}
+	c.budget.deposit(&c.RetryBudget)
+	cn, err := c.Conn(replica)
+	if err != nil {
+		call.Err = err
+		call.done()
+		return call
+	}
+	c.lock.Lock()
+	call.Id = c.nextId
+	c.nextId++
+	c.lock.Unlock()
+	cn.send(call.Id, call)
+	return call
+}
+
+// Retry sends the command of a completed call again, with the same command
+// ID, to replica (e.g., after the call failed with its connection); a replica
+// that has executed the command already answers with the original result.
+// The retry fails at once if the replica's breaker is open, or if the retry
+// budget is spent (see breaker.go).
+func (c *Client) Retry(call *Call, replica int, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 1)
+	}
+	retry := &Call{Replica: replica, Id: call.Id, Command: call.Command, Deadline: call.Deadline, Done: done}
+	if c.CircuitOpen(replica) {
+		retry.Err = ErrCircuitOpen
+		retry.done()
+		return retry
+	}
+	if c.RetryBudget.enabled() && !c.budget.withdraw(&c.RetryBudget, time.Now()) {
+		retry.Err = ErrRetryBudget
+		retry.done()
+		return retry
+	}
+	if !c.admit(retry) {
+		return retry
+	}
+	cn, err := c.Conn(replica)
+	if err != nil {
+		retry.Err = err
+		retry.done()
+		return retry
+	}
+	cn.send(retry.Id, retry)
+	return retry
+}
+
+// CausalToken returns the latest HLC timestamp in the replies the client has
+// received. Passing it to Observe on another Client (e.g., of another
+// cluster) orders that client's later commands after everything this one has
+// seen.
+func (c *Client) CausalToken() uint64 {
+	return atomic.LoadUint64(c.causal)
+}
+
+// Observe makes the client's later commands follow a causal token from
+// elsewhere: the replicas they go to first move their HLC past it.
+func (c *Client) Observe(token uint64) {
+	advanceToken(c.causal, token)
+}
+
+func advanceToken(token *uint64, ts uint64) {
+	for {
+		old := atomic.LoadUint64(token)
+		if ts <= old || atomic.CompareAndSwapUint64(token, old, ts) {
+			return
+		}
+	}
+}
+
+// Propose sends cmd to a replica and waits for the reply.
+func (c *Client) Propose(replica int, cmd state.Command) (*genericsmrproto.ProposeReplyTS, error) {
+	call := <-c.Go(replica, cmd, nil).Done
+	return call.Reply, call.Err
+}
+
+// ProposeDeadline sends cmd to a replica and waits for the reply until the
+// deadline (see GoDeadline).
+func (c *Client) ProposeDeadline(replica int, cmd state.Command, deadline time.Time) (*genericsmrproto.ProposeReplyTS, error) {
+	call := <-c.GoDeadline(replica, cmd, deadline, nil).Done
+	return call.Reply, call.Err
+}
+
+// ProposeConditional puts v under k only if k is still at version, the
+// Version of the reply that read it, when the replicas execute the write;
+// otherwise the reply fails with ERR_CONFLICT and carries the value and
+// version k is at. The replicas must reply after execution (-dreply).
+func (c *Client) ProposeConditional(replica int, k state.Key, version uint64, v state.Value) (*genericsmrproto.ProposeReplyTS, error) {
+	return c.Propose(replica, state.Command{Op: state.CPUT, K: k, V: v, Version: version})
+}
+
+func (c *Client) Close() {
+	c.lock.Lock()
+	for _, p := range c.pools {
+		if p == nil {
+			continue
+		}
+		for _, cn := range p.conns {
+			if cn != nil {
+				cn.Close()
+			}
+		}
+	}
+	close(c.closed)
+	c.lock.Unlock()
+	c.master.Close()
+}
+
+// A Conn is a client connection to one replica.
+type Conn struct {
+	replica int
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	wlock   *sync.Mutex
+	codec   fastrpc.Codec
+
+	lock      *sync.Mutex
+	pending   map[int32]*Call
+	err       error     // set once the connection has failed
+	lastHeard time.Time // when the latest reply arrived
+	pingId    int32     // pings have negative IDs, so as not to collide with proposals
+
+	causal *uint64 // the client's causal token
+	seen   uint64  // the latest HLC timestamp from this replica, accessed atomically
+	sent   uint64  // the latest causal token sent to it (under wlock)
+
+	onConfig func(update *genericsmrproto.ProposeReplyTS) // called with the configuration updates the replica pushes
+}
+
+func dialReplica(addr string, group uint16, session uint64, codec uint8, auth *genericsmrproto.Authenticate, priority uint8, socket *sockopt.Options, causal *uint64) (*Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := socket.Apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	cn := &Conn{
+		conn:      conn,
+		reader:    bufio.NewReader(conn),
+		writer:    bufio.NewWriter(conn),
+		wlock:     new(sync.Mutex),
+		codec:     fastrpc.Binary,
+		lock:      new(sync.Mutex),
+		pending:   make(map[int32]*Call),
+		lastHeard: time.Now(),
+		causal:    causal,
+	}
+	if session != 0 {
+		cn.writer.WriteByte(genericsmrproto.SESSION)
+		(&genericsmrproto.Session{ClientId: session}).Marshal(cn.writer)
+	}
+	if priority != genericsmrproto.PRIORITY_NORMAL {
+		cn.writer.WriteByte(genericsmrproto.PRIORITY)
+		(&genericsmrproto.Priority{Class: priority}).Marshal(cn.writer)
+	}
+	if group != 0 {
+		if err := selectGroup(cn.reader, cn.writer, group); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%v at %s", err, addr)
+		}
+	} else if err := cn.writer.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if codec != fastrpc.CODEC_BINARY {
+		if err := cn.switchCodec(codec); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%v at %s", err, addr)
+		}
+	}
+	if auth != nil {
+		if err := cn.authenticate(auth); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%v at %s", err, addr)
+		}
+	}
+	// subscribe last, so that no update comes ahead of the replies above;
+	// replicas that predate configuration updates ignore the subscription
+	cn.writer.WriteByte(genericsmrproto.CONFIG_UPDATE)
+	cn.codec.Encode(cn.writer, new(genericsmrproto.ConfigUpdate))
+	if err := cn.writer.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go cn.readReplies()
+	return cn, nil
+}
+
+func selectGroup(reader *bufio.Reader, writer *bufio.Writer, group uint16) error {
+	writer.WriteByte(genericsmrproto.SELECT_GROUP)
+	(&genericsmrproto.SelectGroup{Group: group}).Marshal(writer)
+	writer.Flush()
+	reply := new(genericsmrproto.SelectGroupReply)
+	if err := reply.Unmarshal(reader); err != nil || reply.OK == 0 {
+		return fmt.Errorf("could not select group %d", group)
+	}
+	return nil
+}
+
+// switch the connection to another codec, before any proposal
+func (cn *Conn) switchCodec(id uint8) error {
+	codec := fastrpc.LookupCodec(id)
+	if codec == nil {
+		return fmt.Errorf("unknown codec %d", id)
+	}
+	cn.writer.WriteByte(genericsmrproto.CODEC)
+	(&genericsmrproto.Codec{Codec: id}).Marshal(cn.writer)
+	if err := cn.writer.Flush(); err != nil {
+		return err
+	}
+	reply := new(genericsmrproto.CodecReply)
+	if err := reply.Unmarshal(cn.reader); err != nil || reply.OK == 0 {
+		return fmt.Errorf("could not switch to codec %d", id)
+	}
+	cn.codec = codec
+	return nil
+}
+
+// claim an identity on the connection, before any proposal
+func (cn *Conn) authenticate(auth *genericsmrproto.Authenticate) error {
+	cn.writer.WriteByte(genericsmrproto.AUTHENTICATE)
+	cn.codec.Encode(cn.writer, auth)
+	if err := cn.writer.Flush(); err != nil {
+		return err
+	}
+	reply := new(genericsmrproto.AuthenticateReply)
+	if err := cn.codec.Decode(cn.reader, reply); err != nil || reply.OK == 0 {
+		return fmt.Errorf("could not authenticate as %q", auth.Identity)
+	}
+	return nil
+}
+
+func (cn *Conn) send(id int32, call *Call) {
+	var timeout time.Duration
+	if !call.Deadline.IsZero() {
+		if timeout = time.Until(call.Deadline); timeout <= 0 {
+			call.Err = ErrDeadline
+			call.done()
+			return
+		}
+	}
+	cn.lock.Lock()
+	if cn.err != nil {
+		cn.lock.Unlock()
+		call.Err = cn.err
+		call.done()
+		return
+	}
+	cn.pending[id] = call
+	cn.lock.Unlock()
+	if timeout > 0 {
+		time.AfterFunc(timeout, func() { cn.expire(id, call) })
+	}
+
+	cn.wlock.Lock()
+	if token := atomic.LoadUint64(cn.causal); token > cn.sent && token > atomic.LoadUint64(&cn.seen) {
+		// the token came from another replica
+		cn.writer.WriteByte(genericsmrproto.CAUSAL)
+		cn.codec.Encode(cn.writer, &genericsmrproto.Causal{HLC: token})
+		cn.sent = token
+	}
+	call.Sent = time.Now()
+	if timeout > 0 {
+		cn.writer.WriteByte(genericsmrproto.DEADLINE)
+		cn.codec.Encode(cn.writer, &genericsmrproto.Deadline{TimeoutNs: int64(timeout)})
+	}
+	cn.writer.WriteByte(genericsmrproto.PROPOSE)
+	cn.codec.Encode(cn.writer, &genericsmrproto.Propose{CommandId: id, Command: call.Command, Timestamp: call.Sent.UnixNano()})
+	err := cn.writer.Flush()
+	cn.wlock.Unlock()
+	if err != nil {
+		cn.fail(err)
+	}
+}
+
+// fail a call still awaiting its reply at its deadline
+func (cn *Conn) expire(id int32, call *Call) {
+	cn.lock.Lock()
+	if cn.pending[id] != call {
+		cn.lock.Unlock()
+		return
+	}
+	delete(cn.pending, id)
+	cn.lock.Unlock()
+	call.Err = ErrDeadline
+	call.done()
+}
+
+// Ping sends a ping to the replica and waits for the reply, returning the
+// round-trip time.
+func (cn *Conn) Ping() (time.Duration, error) {
+	call := <-cn.goPing().Done
+	if call.Err != nil {
+		return 0, call.Err
+	}
+	return time.Since(call.Sent), nil
+}
+
+func (cn *Conn) goPing() *Call {
+	call := &Call{Replica: cn.replica, Done: make(chan *Call, 1)}
+	cn.lock.Lock()
+	if cn.err != nil {
+		cn.lock.Unlock()
+		call.Err = cn.err
+		call.done()
+		return call
+	}
+	cn.pingId--
+	id := cn.pingId
+	cn.pending[id] = call
+	cn.lock.Unlock()
+
+	cn.wlock.Lock()
+	call.Sent = time.Now()
+	cn.writer.WriteByte(genericsmrproto.PING)
+	cn.codec.Encode(cn.writer, &genericsmrproto.Ping{CommandId: id, Timestamp: call.Sent.UnixNano()})
+	err := cn.writer.Flush()
+	cn.wlock.Unlock()
+	if err != nil {
+		cn.fail(err)
+	}
+	return call
+}
+
+// ping the replica whenever it has been silent for interval, until the
+// connection fails
+func (cn *Conn) keepAlive(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var ping *Call
+	for range t.C {
+		if cn.Err() != nil {
+			return
+		}
+		if ping != nil {
+			select {
+			case <-ping.Done:
+				ping = nil
+			default:
+				cn.fail(ErrPingTimeout)
+				return
+			}
+		}
+		cn.lock.Lock()
+		silent := time.Since(cn.lastHeard) >= interval
+		cn.lock.Unlock()
+		if silent {
+			ping = cn.goPing()
+		}
+	}
+}
+
+func (cn *Conn) readReplies() {
+	for {
+		reply := new(genericsmrproto.ProposeReplyTS)
+		if err := cn.codec.Decode(cn.reader, reply); err != nil {
+			cn.fail(err)
+			return
+		}
+		if reply.HLC > 0 {
+			advanceToken(&cn.seen, reply.HLC)
+			advanceToken(cn.causal, reply.HLC)
+		}
+		cn.lock.Lock()
+		cn.lastHeard = time.Now()
+		onConfig := cn.onConfig
+		if reply.CommandId == genericsmrproto.CONFIG_UPDATE_ID {
+			cn.lock.Unlock()
+			if onConfig != nil {
+				onConfig(reply)
+			}
+			continue
+		}
+		call := cn.pending[reply.CommandId]
+		delete(cn.pending, reply.CommandId)
+		cn.lock.Unlock()
+		if call == nil {
+			// a duplicate reply
+			continue
+		}
+		call.Reply = reply
+		call.done()
+	}
+}
+
+// fails every pending call; later calls fail right away
+func (cn *Conn) fail(err error) {
+	cn.lock.Lock()
+	if cn.err != nil {
+		cn.lock.Unlock()
+		return
+	}
+	cn.err = err
+	pending := cn.pending
+	cn.pending = make(map[int32]*Call)
+	cn.lock.Unlock()
+	cn.conn.Close()
+	for _, call := range pending {
+		call.Err = err
+		call.done()
+	}
+}
+
+// Err returns the error the connection failed with, or nil.
+func (cn *Conn) Err() error {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	return cn.err
+}
+
+// Pending returns the number of proposals awaiting their reply.
+func (cn *Conn) Pending() int {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	return len(cn.pending)
+}
+
+func (cn *Conn) Close() {
+	cn.fail(ErrClosed)
+}
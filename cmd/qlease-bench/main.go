@@ -0,0 +1,288 @@
+// qlease-bench drives a cluster with a synthetic workload and reports the
+// throughput and latency percentiles of reads and writes.
+//
+// In closed-loop mode (the default), -c workers each keep one request
+// outstanding. In open-loop mode, requests are issued at -rate per second
+// regardless of the replies, and latencies are measured from the time each
+// request was due, so that a stalled cluster shows up in the tail instead of
+// slowing down the load. Keys are drawn from [0, -keys), uniformly or with
+// the YCSB Zipfian distribution; values are the 8-byte state.Value of the
+// wire protocol, so their size is not configurable.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/glycerine/qlease/clientlib"
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/sockopt"
+	"github.com/glycerine/qlease/state"
+	"github.com/glycerine/qlease/ycsbzipf"
+)
+
+var masterAddr = flag.String("maddr", "", "Master address. Defaults to localhost")
+var masterPort = flag.Int("mport", 7077, "Master port. Defaults to 7077.")
+var group = flag.Int("group", 0, "SMR group to send requests to. Defaults to 0.")
+var duration = flag.Duration("d", 10*time.Second, "How long to run, warmup included.")
+var warmup = flag.Duration("warmup", time.Second, "Initial period left out of the results.")
+var total = flag.Int("q", 0, "Stop after this many requests (0 to run for -d).")
+var writes = flag.Int("w", 50, "Percentage of writes. Defaults to 50%.")
+var dist = flag.String("dist", "zipf", "Key distribution: zipf or uniform.")
+var keys = flag.Int("keys", 100000, "Number of distinct keys.")
+var mode = flag.String("mode", "closed", "Load: closed (-c outstanding requests) or open (-rate requests per second).")
+var concurrency = flag.Int("c", 16, "Closed loop: number of outstanding requests.")
+var rate = flag.Float64("rate", 1000, "Open loop: requests per second.")
+var forceReplica = flag.Int("l", -1, "Send every request to this replica (defaults to the leader).")
+var spread = flag.Bool("spread", false, "Send every request to a random replica, for leaderless protocols.")
+var balance = flag.String("balance", "", "Pick the replica of every request with a clientlib balancer: nearest, leader-leases or round-robin (refreshed from the replicas' status every -balanceinterval).")
+var balanceInterval = flag.Duration("balanceinterval", time.Second, "How often the balancer refreshes its view of the cluster.")
+var codecName = flag.String("codec", "binary", "Codec of the connections to the replicas: binary, json or protobuf.")
+var sockOpt = flag.String("sockopt", "", "Socket options of the connections to the replicas, e.g. nagle=on,dscp=af41 (see qlease-server -peersockopt).")
+var poolSize = flag.Int("conns", 1, "Connections to open to each replica, the requests going on the one with the fewest pending.")
+var breaker = flag.Int("breaker", 0, "Fail the requests to a replica at once, for a cooldown, after this many in a row failed there (0 for no circuit breakers).")
+var priority = flag.String("priority", "normal", "Priority class of the requests: high, normal or bulk (for replicas run with -priorities).")
+var seed = flag.Int64("seed", 42, "Random seed.")
+var timeout = flag.Duration("timeout", 0, "Give every request a deadline this long after it is issued, past which the replicas drop it (0 for none).")
+
+type workload struct {
+	r    *rand.Rand
+	zipf *ycsbzipf.Zipf
+}
+
+func newWorkload(seed int64) *workload {
+	w := &workload{r: rand.New(rand.NewSource(seed))}
+	if *dist == "zipf" {
+		w.zipf = ycsbzipf.NewZipf(*keys, w.r)
+	}
+	return w
+}
+
+func (w *workload) next() state.Command {
+	var k int64
+	if w.zipf != nil {
+		k = w.zipf.NextInt64() % int64(*keys)
+	} else {
+		k = w.r.Int63n(int64(*keys))
+	}
+	if w.r.Intn(100) < *writes {
+		return state.Command{Op: state.PUT, K: state.Key(k), V: state.Value(w.r.Int63())}
+	}
+	return state.Command{Op: state.GET, K: state.Key(k), V: state.NIL}
+}
+
+func (w *workload) replica(c *clientlib.Client, cmd state.Command, leader int) int {
+	if *balance != "" {
+		return c.Pick(cmd)
+	}
+	if *spread {
+		return w.r.Intn(c.N())
+	}
+	return leader
+}
+
+// results of the requests completed after the warmup
+type results struct {
+	lock     *sync.Mutex
+	reads    []time.Duration
+	writes   []time.Duration
+	failed   map[uint8]int // by error code
+	errors   int           // requests whose connection failed
+	measured time.Time     // the end of the warmup
+}
+
+func (res *results) record(cmd state.Command, start time.Time, call *clientlib.Call) {
+	now := time.Now()
+	if start.Before(res.measured) {
+		return
+	}
+	res.lock.Lock()
+	defer res.lock.Unlock()
+	switch {
+	case call.Err != nil:
+		res.errors++
+	case call.Reply.OK == 0:
+		res.failed[call.Reply.ErrCode]++
+	case cmd.Op == state.PUT:
+		res.writes = append(res.writes, now.Sub(start))
+	default:
+		res.reads = append(res.reads, now.Sub(start))
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	if *writes < 0 || *writes > 100 {
+		log.Fatalf("Write percentage must be between 0 and 100.\n")
+	}
+	if *dist != "zipf" && *dist != "uniform" {
+		log.Fatalf("Unknown key distribution %q.\n", *dist)
+	}
+	if *mode != "closed" && *mode != "open" {
+		log.Fatalf("Unknown mode %q.\n", *mode)
+	}
+	if *keys <= 0 || *concurrency <= 0 || *rate <= 0 {
+		log.Fatalf("-keys, -c and -rate must be positive.\n")
+	}
+
+	c, err := clientlib.Dial(*masterAddr, *masterPort)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+	c.Group = uint16(*group)
+	if c.Codec, err = fastrpc.CodecByName(*codecName); err != nil {
+		log.Fatal(err)
+	}
+	if c.Priority, err = clientlib.ParsePriority(*priority); err != nil {
+		log.Fatal(err)
+	}
+	if c.Socket, err = sockopt.Parse(*sockOpt); err != nil {
+		log.Fatal(err)
+	}
+	c.PoolSize = *poolSize
+	c.Breakers.Failures = *breaker
+
+	if *balance != "" {
+		b, err := clientlib.ParseBalancer(*balance)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.Balance(b, *balanceInterval)
+	}
+
+	leader := *forceReplica
+	if leader < 0 {
+		if leader, err = c.Leader(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if leader >= c.N() {
+		log.Fatalf("There are only %d replicas.\n", c.N())
+	}
+
+	start := time.Now()
+	res := &results{lock: new(sync.Mutex), failed: make(map[uint8]int), measured: start.Add(*warmup)}
+	deadline := start.Add(*duration)
+	var issued issueCounter
+	if *mode == "closed" {
+		runClosed(c, leader, res, deadline, &issued)
+	} else {
+		runOpen(c, leader, res, deadline, &issued)
+	}
+	elapsed := time.Since(res.measured)
+	if elapsed <= 0 {
+		log.Fatalf("The run ended during the warmup.\n")
+	}
+
+	report(os.Stdout, res, elapsed)
+}
+
+// counts the requests issued, to stop after -q
+type issueCounter struct {
+	lock sync.Mutex
+	n    int
+}
+
+func (ic *issueCounter) take() bool {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	if *total > 0 && ic.n >= *total {
+		return false
+	}
+	ic.n++
+	return true
+}
+
+func runClosed(c *clientlib.Client, leader int, res *results, deadline time.Time, issued *issueCounter) {
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(w *workload) {
+			defer wg.Done()
+			done := make(chan *clientlib.Call, 1)
+			for time.Now().Before(deadline) && issued.take() {
+				cmd := w.next()
+				start := time.Now()
+				call := <-c.GoDeadline(w.replica(c, cmd, leader), cmd, callDeadline(start), done).Done
+				res.record(cmd, start, call)
+			}
+		}(newWorkload(*seed + int64(i)))
+	}
+	wg.Wait()
+}
+
+// the deadline of a request issued at start (zero for none)
+func callDeadline(start time.Time) time.Time {
+	if *timeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(*timeout)
+}
+
+func runOpen(c *clientlib.Client, leader int, res *results, deadline time.Time, issued *issueCounter) {
+	var wg sync.WaitGroup
+	w := newWorkload(*seed)
+	interval := time.Duration(float64(time.Second) / *rate)
+	for due := time.Now(); due.Before(deadline) && issued.take(); due = due.Add(interval) {
+		if d := time.Until(due); d > 0 {
+			time.Sleep(d)
+		}
+		cmd := w.next()
+		call := c.GoDeadline(w.replica(c, cmd, leader), cmd, callDeadline(due), nil)
+		wg.Add(1)
+		go func(due time.Time) {
+			defer wg.Done()
+			res.record(cmd, due, <-call.Done)
+		}(due)
+	}
+	wg.Wait()
+}
+
+func report(out io.Writer, res *results, elapsed time.Duration) {
+	res.lock.Lock()
+	defer res.lock.Unlock()
+
+	ok := len(res.reads) + len(res.writes)
+	failed := 0
+	for _, n := range res.failed {
+		failed += n
+	}
+	fmt.Fprintf(out, "Measured %v: %d ok, %d failed, %d errors; %.1f ops/s\n",
+		elapsed.Round(time.Millisecond), ok, failed, res.errors, float64(ok)/elapsed.Seconds())
+	for code, n := range res.failed {
+		fmt.Fprintf(out, "  %d failed with error code %d\n", n, code)
+	}
+
+	fmt.Fprintf(out, "%-7s %8s %10s %10s %10s %10s %10s %10s\n", "", "count", "mean", "p50", "p90", "p99", "p99.9", "max")
+	all := append(append([]time.Duration(nil), res.reads...), res.writes...)
+	printLatencies(out, "reads", res.reads)
+	printLatencies(out, "writes", res.writes)
+	printLatencies(out, "all", all)
+}
+
+func printLatencies(out io.Writer, name string, lat []time.Duration) {
+	if len(lat) == 0 {
+		fmt.Fprintf(out, "%-7s %8d\n", name, 0)
+		return
+	}
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	var sum time.Duration
+	for _, d := range lat {
+		sum += d
+	}
+	pct := func(p float64) time.Duration {
+		return lat[int(p*float64(len(lat)-1))]
+	}
+	r := func(d time.Duration) time.Duration { return d.Round(time.Microsecond) }
+	fmt.Fprintf(out, "%-7s %8d %10v %10v %10v %10v %10v %10v\n", name, len(lat),
+		r(sum/time.Duration(len(lat))), r(pct(0.5)), r(pct(0.9)), r(pct(0.99)), r(pct(0.999)), r(lat[len(lat)-1]))
+}
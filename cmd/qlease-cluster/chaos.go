@@ -0,0 +1,390 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glycerine/qlease/clientlib"
+	"github.com/glycerine/qlease/state"
+)
+
+// In chaos mode (-chaos <duration>), the launcher injects a fault every
+// -chaosinterval, on one replica at a time so that a majority stays up, and
+// heals it -chaosfault later: it kills and restarts the replica, pauses and
+// resumes it, partitions it from the other replicas, or delays the messages
+// between them by -chaoslatency (the last two through the servers' /faults
+// endpoints, see genericsmr.Faults). Meanwhile, -chaosclients writers each
+// write increasing values to a key through the leader, and as many readers
+// read those keys from random replicas. At the end, it checks that every
+// read returned a value no older than the last write acknowledged before
+// the read was sent, nor newer than the last write sent before it was
+// answered, nor older than a read answered before it was sent; and reports
+// the violations, how many operations succeeded, and how long the cluster
+// went without any succeeding. A writer whose write fails moves on to a new
+// key, as the failed write may still take effect at any time.
+
+var chaos = flag.Duration("chaos", 0, "Inject faults for this long while checking reads and writes, then print a report and exit, instead of reading commands.")
+var chaosInterval = flag.Duration("chaosinterval", 5*time.Second, "Chaos mode: time between faults.")
+var chaosFault = flag.Duration("chaosfault", 3*time.Second, "Chaos mode: how long each fault lasts.")
+var chaosLatency = flag.Duration("chaoslatency", 200*time.Millisecond, "Chaos mode: latency injected between replicas.")
+var chaosClients = flag.Int("chaosclients", 4, "Chaos mode: number of writers, and of readers.")
+var chaosSeed = flag.Int64("chaosseed", 1, "Chaos mode: random seed of the fault schedule.")
+
+// how long a chaos client waits for a reply
+const CHAOS_OP_TIMEOUT = 2 * time.Second
+
+// the keys written in chaos mode start from there, away from the usual ones
+const CHAOS_KEY_BASE = 1 << 40
+
+type faultKind int
+
+const (
+	FAULT_KILL faultKind = iota
+	FAULT_PAUSE
+	FAULT_PARTITION
+	FAULT_LATENCY
+	NUM_FAULT_KINDS
+)
+
+var faultNames = [NUM_FAULT_KINDS]string{"kill", "pause", "partition", "latency"}
+
+// runChaos runs chaos mode on a cluster of subprocesses, and returns whether
+// no violation was found.
+func (c *cluster) runChaos(out io.Writer) (bool, error) {
+	cli, err := clientlib.Dial(host, c.masterPort)
+	if err != nil {
+		return false, err
+	}
+	defer cli.Close()
+
+	h := newHistory(*chaosClients)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < *chaosClients; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			h.write(cli, i, done)
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			h.read(cli, rand.New(rand.NewSource(*chaosSeed+int64(i))), done)
+		}(i)
+	}
+
+	r := rand.New(rand.NewSource(*chaosSeed))
+	injected := make([]int, NUM_FAULT_KINDS)
+	end := time.Now().Add(*chaos)
+	for time.Now().Add(*chaosInterval).Before(end) {
+		time.Sleep(*chaosInterval - *chaosFault)
+		rep := c.replicas[r.Intn(len(c.replicas))]
+		kind := faultKind(r.Intn(int(NUM_FAULT_KINDS)))
+		fmt.Fprintf(out, "%8.1fs  %s replica %d\n", h.since(time.Now()), faultNames[kind], rep.id)
+		if err := c.inject(rep, kind); err != nil {
+			fmt.Fprintf(out, "          could not inject the fault: %v\n", err)
+		} else {
+			injected[kind]++
+		}
+		time.Sleep(*chaosFault)
+		fmt.Fprintf(out, "%8.1fs  heal replica %d\n", h.since(time.Now()), rep.id)
+		if err := c.heal(rep, kind); err != nil {
+			fmt.Fprintf(out, "          could not heal the fault: %v\n", err)
+		}
+	}
+	time.Sleep(time.Until(end))
+	close(done)
+	wg.Wait()
+
+	var counts []string
+	for k, n := range injected {
+		counts = append(counts, fmt.Sprintf("%d %s", n, faultNames[k]))
+	}
+	fmt.Fprintf(out, "\nChaos run of %v: faults injected: %s\n", *chaos, strings.Join(counts, ", "))
+	return h.report(out), nil
+}
+
+func (c *cluster) inject(rep *replica, kind faultKind) error {
+	switch kind {
+	case FAULT_KILL:
+		rep.proc.kill()
+	case FAULT_PAUSE:
+		return rep.proc.pause()
+	case FAULT_PARTITION:
+		var others []string
+		for _, o := range c.replicas {
+			if o != rep {
+				others = append(others, strconv.Itoa(o.id))
+				if err := setFaults(o, "drop="+strconv.Itoa(rep.id)); err != nil {
+					return err
+				}
+			}
+		}
+		return setFaults(rep, "drop="+strings.Join(others, ","))
+	case FAULT_LATENCY:
+		for _, o := range c.replicas {
+			if o != rep {
+				if err := setFaults(o, fmt.Sprintf("delay=%v&peers=%d", *chaosLatency, rep.id)); err != nil {
+					return err
+				}
+			}
+		}
+		return setFaults(rep, fmt.Sprintf("delay=%v", *chaosLatency))
+	}
+	return nil
+}
+
+func (c *cluster) heal(rep *replica, kind faultKind) error {
+	switch kind {
+	case FAULT_KILL:
+		return rep.proc.start()
+	case FAULT_PAUSE:
+		return rep.proc.resume()
+	default:
+		var firstErr error
+		for _, o := range c.replicas {
+			if err := setFaults(o, "heal"); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+}
+
+// set the faults of a server through /faults on its RPC port
+func setFaults(rep *replica, query string) error {
+	client := http.Client{Timeout: time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://%s:%d/faults?%s", host, rep.port+1000, query))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("replica %d: %s (are the servers run with -faults?)", rep.id, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// the writes to a key, by a single writer, of the values 1, 2, ...
+type keyHistory struct {
+	invoked []time.Time // of value v at v-1
+	acked   []time.Time // of value v at v-1 (zero if never acknowledged)
+}
+
+type readOp struct {
+	key      state.Key
+	replica  int
+	value    state.Value
+	invoked  time.Time
+	answered time.Time
+}
+
+type opCounts struct {
+	ok, failed, errors int
+}
+
+type history struct {
+	lock              sync.Mutex
+	start             time.Time
+	keys              map[state.Key]*keyHistory
+	current           []state.Key // per writer, the key it writes
+	reads             []readOp
+	writeOps, readOps opCounts
+	okSeconds         map[int]bool // seconds since start in which an operation succeeded
+}
+
+func newHistory(writers int) *history {
+	h := &history{start: time.Now(), keys: make(map[state.Key]*keyHistory), current: make([]state.Key, writers), okSeconds: make(map[int]bool)}
+	for i := range h.current {
+		h.current[i] = state.Key(CHAOS_KEY_BASE) + state.Key(i)
+		h.keys[h.current[i]] = new(keyHistory)
+	}
+	return h
+}
+
+func (h *history) since(t time.Time) float64 {
+	return t.Sub(h.start).Seconds()
+}
+
+// send cmd to replica, and wait for the reply for at most CHAOS_OP_TIMEOUT
+func propose(cli *clientlib.Client, replica int, cmd state.Command) (*clientlib.Call, bool) {
+	call := cli.Go(replica, cmd, nil)
+	select {
+	case <-call.Done:
+		return call, call.Err == nil
+	case <-time.After(CHAOS_OP_TIMEOUT):
+		return call, false
+	}
+}
+
+func (h *history) record(counts *opCounts, call *clientlib.Call, answered bool, t time.Time) {
+	switch {
+	case !answered:
+		counts.errors++
+	case call.Reply.OK == 0:
+		counts.failed++
+	default:
+		counts.ok++
+		h.okSeconds[int(h.since(t))] = true
+	}
+}
+
+func (h *history) write(cli *clientlib.Client, writer int, done chan struct{}) {
+	leader, _ := cli.Leader()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		h.lock.Lock()
+		k := h.current[writer]
+		kh := h.keys[k]
+		v := state.Value(len(kh.invoked) + 1)
+		kh.invoked = append(kh.invoked, time.Now())
+		kh.acked = append(kh.acked, time.Time{})
+		h.lock.Unlock()
+
+		call, answered := propose(cli, leader, state.Command{Op: state.PUT, K: k, V: v})
+		now := time.Now()
+		h.lock.Lock()
+		h.record(&h.writeOps, call, answered, now)
+		if answered && call.Reply.OK != 0 {
+			kh.acked[v-1] = now
+		} else {
+			// the write may still take effect: go on with a new key
+			next := k + state.Key(len(h.current))
+			h.current[writer] = next
+			h.keys[next] = new(keyHistory)
+		}
+		h.lock.Unlock()
+		if !answered || call.Reply.OK == 0 {
+			if l, err := cli.Leader(); err == nil {
+				leader = l
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+func (h *history) read(cli *clientlib.Client, r *rand.Rand, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		h.lock.Lock()
+		k := h.current[r.Intn(len(h.current))]
+		h.lock.Unlock()
+		replica := r.Intn(cli.N())
+
+		invoked := time.Now()
+		call, answered := propose(cli, replica, state.Command{Op: state.GET, K: k, V: state.NIL})
+		now := time.Now()
+		h.lock.Lock()
+		h.record(&h.readOps, call, answered, now)
+		if answered && call.Reply.OK != 0 {
+			h.reads = append(h.reads, readOp{k, replica, call.Reply.Value, invoked, now})
+		}
+		h.lock.Unlock()
+		if !answered || call.Reply.OK == 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+// check the reads, print the report, and return whether no violation was found
+func (h *history) report(out io.Writer) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var violations []string
+	violate := func(rd readOp, format string, args ...interface{}) {
+		violations = append(violations, fmt.Sprintf("read of key %d from replica %d sent at %.3fs, answered at %.3fs, returned %d: ",
+			rd.key, rd.replica, h.since(rd.invoked), h.since(rd.answered), rd.value)+fmt.Sprintf(format, args...))
+	}
+
+	// against the writes
+	for _, rd := range h.reads {
+		kh := h.keys[rd.key]
+		// the latest value acknowledged before the read was sent
+		lo := sort.Search(len(kh.acked), func(i int) bool {
+			return kh.acked[i].IsZero() || !kh.acked[i].Before(rd.invoked)
+		})
+		// the latest value sent before the read was answered
+		hi := sort.Search(len(kh.invoked), func(i int) bool { return !kh.invoked[i].Before(rd.answered) })
+		if int(rd.value) < lo {
+			violate(rd, "stale, as %d had been acknowledged", lo)
+		} else if int(rd.value) > hi {
+			violate(rd, "from the future, as only %d had been written", hi)
+		}
+	}
+
+	// against the reads of the same key answered before each read was sent
+	byKey := make(map[state.Key][]readOp)
+	for _, rd := range h.reads {
+		byKey[rd.key] = append(byKey[rd.key], rd)
+	}
+	for _, reads := range byKey {
+		sort.Slice(reads, func(i, j int) bool { return reads[i].answered.Before(reads[j].answered) })
+		maxSeen := make([]state.Value, len(reads)) // the highest value of reads[:i+1]
+		for i, rd := range reads {
+			maxSeen[i] = rd.value
+			if i > 0 && maxSeen[i-1] > maxSeen[i] {
+				maxSeen[i] = maxSeen[i-1]
+			}
+		}
+		for _, rd := range reads {
+			before := sort.Search(len(reads), func(i int) bool { return !reads[i].answered.Before(rd.invoked) })
+			if before > 0 && rd.value < maxSeen[before-1] {
+				violate(rd, "older than %d, read before it was sent", maxSeen[before-1])
+			}
+		}
+	}
+
+	if len(violations) == 0 {
+		fmt.Fprintf(out, "Safety: OK, no violations in %d reads of %d keys\n", len(h.reads), len(h.keys))
+	} else {
+		fmt.Fprintf(out, "Safety: VIOLATED, %d of %d reads\n", len(violations), len(h.reads))
+		for i, v := range violations {
+			if i == 10 {
+				fmt.Fprintf(out, "  ...\n")
+				break
+			}
+			fmt.Fprintf(out, "  %s\n", v)
+		}
+	}
+
+	seconds := int(*chaos / time.Second)
+	up, outage, longest, longestFrom := 0, 0, 0, 0
+	for s := 0; s < seconds; s++ {
+		if h.okSeconds[s] {
+			up++
+			outage = 0
+			continue
+		}
+		if outage++; outage > longest {
+			longest, longestFrom = outage, s-outage+1
+		}
+	}
+	fmt.Fprintf(out, "Availability: writes %d ok, %d failed, %d errors or timeouts; reads %d ok, %d failed, %d errors or timeouts\n",
+		h.writeOps.ok, h.writeOps.failed, h.writeOps.errors, h.readOps.ok, h.readOps.failed, h.readOps.errors)
+	if seconds > 0 {
+		fmt.Fprintf(out, "  an operation succeeded in %d of %d seconds (%.0f%%)", up, seconds, 100*float64(up)/float64(seconds))
+		if longest > 0 {
+			fmt.Fprintf(out, "; longest outage %ds, from %ds", longest, longestFrom)
+		}
+		fmt.Fprintln(out)
+	}
+	return len(violations) == 0
+}
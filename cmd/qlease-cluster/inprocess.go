@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+
+	"github.com/glycerine/qlease/epaxos"
+	"github.com/glycerine/qlease/genericsmr"
+	"github.com/glycerine/qlease/lpaxos"
+	"github.com/glycerine/qlease/masterproto"
+	"github.com/glycerine/qlease/mencius"
+	"github.com/glycerine/qlease/paxos"
+)
+
+// localMaster answers the clients' master RPCs for a cluster in this process
+type localMaster struct {
+	nodeList []string
+}
+
+func (m *localMaster) GetReplicaList(args *masterproto.GetReplicaListArgs, reply *masterproto.GetReplicaListReply) error {
+	reply.ReplicaList = m.nodeList
+	reply.Ready = true
+	return nil
+}
+
+// replica 0 starts out as the leader, as with the master
+func (m *localMaster) GetLeader(args *masterproto.GetLeaderArgs, reply *masterproto.GetLeaderReply) error {
+	reply.LeaderId = 0
+	return nil
+}
+
+func startInProcess(n int) (*cluster, error) {
+	if *protocol != "paxos" && *protocol != "epaxos" && *protocol != "mencius" {
+		return nil, fmt.Errorf("unknown protocol %q", *protocol)
+	}
+	// the replicas keep their stable stores in the working directory
+	if err := os.Chdir(*dir); err != nil {
+		return nil, err
+	}
+
+	c := &cluster{}
+	listeners := make([]net.Listener, n)
+	leaseListeners := make([]net.Listener, n)
+	nodeList := make([]string, n)
+	leaseNodeList := make([]string, n)
+	for i := 0; i < n; i++ {
+		var err error
+		if listeners[i], err = net.Listen("tcp", host+":0"); err != nil {
+			return nil, err
+		}
+		if leaseListeners[i], err = net.Listen("tcp", host+":0"); err != nil {
+			return nil, err
+		}
+		nodeList[i] = listeners[i].Addr().String()
+		leaseNodeList[i] = leaseListeners[i].Addr().String()
+		c.replicas = append(c.replicas, &replica{
+			id:    i,
+			port:  listeners[i].Addr().(*net.TCPAddr).Port,
+			lport: leaseListeners[i].Addr().(*net.TCPAddr).Port})
+	}
+
+	for i := 0; i < n; i++ {
+		opts := []genericsmr.Option{genericsmr.WithExec(true), genericsmr.WithListener(listeners[i])}
+		switch *protocol {
+		case "paxos":
+			leaseRep := lpaxos.NewReplicaWithOptions(i, leaseNodeList, genericsmr.WithExec(true), genericsmr.WithListener(leaseListeners[i]))
+			paxos.NewReplicaWithOptions(i, nodeList, leaseRep, false, opts...)
+		case "epaxos":
+			leaseListeners[i].Close()
+			epaxos.NewReplicaWithOptions(i, nodeList, opts...)
+		case "mencius":
+			leaseListeners[i].Close()
+			mencius.NewReplicaWithOptions(i, nodeList, append(opts, genericsmr.WithBeacon(true))...)
+		}
+	}
+
+	l, err := net.Listen("tcp", host+":0")
+	if err != nil {
+		return nil, err
+	}
+	c.masterPort = l.Addr().(*net.TCPAddr).Port
+	server := rpc.NewServer()
+	if err := server.RegisterName("Master", &localMaster{nodeList}); err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+	go http.Serve(l, mux)
+	return c, nil
+}
@@ -0,0 +1,401 @@
+// qlease-cluster brings up a local cluster for development: a master and N
+// replicas on automatically assigned ports, either as subprocesses running
+// the server binary (the default) or as replicas inside this process
+// (-inprocess). It then reads commands from standard input, to inspect the
+// cluster and to kill, pause and restart replicas:
+//
+//	status           list the replicas and their state
+//	kill <id>        kill a replica (SIGKILL)
+//	stop <id>        pause a replica (SIGSTOP; not on Windows), e.g. to let its leases lapse
+//	cont <id>        resume a paused replica
+//	restart <id>     kill a replica if needed and start it again, on the same ports
+//	quit             kill every process and exit
+//
+// Arguments after -- are passed to every server subprocess, e.g.
+//
+//	qlease-cluster -N 5 -- -exec -beacon -mencius
+//
+// Each server subprocess runs in its own directory under -dir (server<i>, in
+// the order they were started, which need not be the order of the replica IDs
+// the master assigns), so that stable stores do not collide, and logs to
+// server.log there. Only subprocesses can be killed and restarted: replicas in
+// this process cannot be torn down.
+//
+// With -chaos <duration>, the launcher instead injects faults into a cluster
+// of subprocesses (run with -faults) while checking that reads and writes
+// stay correct, then prints a safety and availability report and exits,
+// with status 1 if any read was incorrect (see chaos.go), e.g.
+//
+//	qlease-cluster -chaos 2m -- -exec -reads readindex
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/glycerine/qlease/masterproto"
+)
+
+var numReplicas = flag.Int("N", 3, "Number of replicas. Defaults to 3.")
+var inProcess = flag.Bool("inprocess", false, "Run the replicas in this process instead of as subprocesses.")
+var protocol = flag.String("protocol", "paxos", "Protocol of in-process replicas: paxos, epaxos or mencius.")
+var serverBin = flag.String("server", "qlease-server", "Server binary for subprocesses (looked up in PATH).")
+var masterBin = flag.String("master", "qlease-master", "Master binary for subprocesses (looked up in PATH).")
+var dir = flag.String("dir", "", "Directory for logs and stable stores. Defaults to a new temporary directory.")
+var readyTimeout = flag.Duration("timeout", 30*time.Second, "How long to wait for the replicas to register with the master.")
+
+const host = "127.0.0.1"
+
+type process struct {
+	name   string
+	bin    string
+	args   []string
+	dir    string
+	cmd    *exec.Cmd
+	exited chan bool // closed when cmd exits
+	paused bool
+}
+
+func (p *process) start() error {
+	logf, err := os.OpenFile(filepath.Join(p.dir, p.name+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(p.bin, p.args...)
+	cmd.Dir = p.dir
+	cmd.Stdout = logf
+	cmd.Stderr = logf
+	if err := cmd.Start(); err != nil {
+		logf.Close()
+		return err
+	}
+	p.cmd = cmd
+	p.paused = false
+	p.exited = make(chan bool)
+	go func(exited chan bool) {
+		cmd.Wait()
+		logf.Close()
+		close(exited)
+	}(p.exited)
+	return nil
+}
+
+func (p *process) running() bool {
+	if p.cmd == nil {
+		return false
+	}
+	select {
+	case <-p.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+func (p *process) kill() {
+	if !p.running() {
+		return
+	}
+	p.cmd.Process.Kill()
+	<-p.exited
+}
+
+func (p *process) state() string {
+	switch {
+	case !p.running():
+		return "exited"
+	case p.paused:
+		return "paused"
+	}
+	return "running"
+}
+
+// a replica's ports; the server also listens on port+1000 for the master's RPCs
+type replica struct {
+	id    int
+	port  int
+	lport int
+	proc  *process // nil in process
+}
+
+func main() {
+	flag.Parse()
+
+	if *numReplicas <= 0 {
+		log.Fatalf("-N must be positive.\n")
+	}
+	if *chaos > 0 && (*inProcess || *chaosFault >= *chaosInterval || *chaosClients <= 0) {
+		log.Fatalf("-chaos needs subprocesses, a -chaosfault shorter than -chaosinterval, and -chaosclients.\n")
+	}
+	if *dir == "" {
+		d, err := ioutil.TempDir("", "qlease-cluster")
+		if err != nil {
+			log.Fatal(err)
+		}
+		*dir = d
+	}
+
+	var c *cluster
+	var err error
+	if *inProcess {
+		c, err = startInProcess(*numReplicas)
+	} else {
+		extra := flag.Args()
+		if *chaos > 0 {
+			extra = append(extra, "-faults")
+		}
+		c, err = startSubprocesses(*numReplicas, extra)
+	}
+	if err != nil {
+		if c != nil {
+			c.shutdown()
+		}
+		log.Fatal(err)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		c.shutdown()
+		os.Exit(0)
+	}()
+
+	fmt.Printf("Cluster of %d replicas is up, working in %s\n", len(c.replicas), *dir)
+	fmt.Printf("Connect clients with -maddr %s -mport %d\n", host, c.masterPort)
+	c.printStatus()
+	if *chaos > 0 {
+		ok, err := c.runChaos(os.Stdout)
+		c.shutdown()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+	c.interact(os.Stdin)
+	c.shutdown()
+}
+
+type cluster struct {
+	masterPort int
+	master     *process // nil in process
+	replicas   []*replica
+}
+
+func startSubprocesses(n int, extra []string) (*cluster, error) {
+	server, err := exec.LookPath(*serverBin)
+	if err != nil {
+		return nil, fmt.Errorf("server binary: %v (build it with `go build -o qlease-server ./server`)", err)
+	}
+	master, err := exec.LookPath(*masterBin)
+	if err != nil {
+		return nil, fmt.Errorf("master binary: %v (build it with `go build -o qlease-master ./master`)", err)
+	}
+
+	c := &cluster{}
+	if c.masterPort, err = freePort(0); err != nil {
+		return nil, err
+	}
+	c.master = &process{
+		name: "master",
+		bin:  master,
+		args: []string{"-N", strconv.Itoa(n), "-port", strconv.Itoa(c.masterPort)},
+		dir:  *dir,
+	}
+	if err := c.master.start(); err != nil {
+		return c, err
+	}
+
+	for i := 0; i < n; i++ {
+		rep := &replica{id: -1}
+		if rep.port, err = freePort(1000); err != nil {
+			return c, err
+		}
+		if rep.lport, err = freePort(0); err != nil {
+			return c, err
+		}
+		rdir := filepath.Join(*dir, fmt.Sprintf("server%d", i))
+		if err := os.MkdirAll(rdir, 0755); err != nil {
+			return c, err
+		}
+		args := []string{
+			"-maddr", host, "-mport", strconv.Itoa(c.masterPort),
+			"-addr", host, "-port", strconv.Itoa(rep.port), "-lport", strconv.Itoa(rep.lport)}
+		rep.proc = &process{name: "server", bin: server, args: append(args, extra...), dir: rdir}
+		if err := rep.proc.start(); err != nil {
+			return c, err
+		}
+		c.replicas = append(c.replicas, rep)
+	}
+
+	// the master numbers the replicas in the order they register
+	list, err := waitForReplicaList(c.masterPort, *readyTimeout)
+	if err != nil {
+		return c, err
+	}
+	for id, addr := range list {
+		for _, rep := range c.replicas {
+			if addr == fmt.Sprintf("%s:%d", host, rep.port) {
+				rep.id = id
+			}
+		}
+	}
+	sort.Slice(c.replicas, func(i, j int) bool { return c.replicas[i].id < c.replicas[j].id })
+	return c, nil
+}
+
+// returns a port that is free, and such that port+offset is free too
+func freePort(offset int) (int, error) {
+	for tries := 0; tries < 100; tries++ {
+		l, err := net.Listen("tcp", host+":0")
+		if err != nil {
+			return 0, err
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		if offset == 0 {
+			l.Close()
+			return port, nil
+		}
+		l2, err := net.Listen("tcp", fmt.Sprintf("%s:%d", host, port+offset))
+		l.Close()
+		if err == nil {
+			l2.Close()
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("could not find a free port")
+}
+
+func waitForReplicaList(masterPort int, timeout time.Duration) ([]string, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(200 * time.Millisecond)
+		mcli, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", host, masterPort))
+		if err != nil {
+			continue
+		}
+		reply := new(masterproto.GetReplicaListReply)
+		err = mcli.Call("Master.GetReplicaList", new(masterproto.GetReplicaListArgs), reply)
+		mcli.Close()
+		if err == nil && reply.Ready {
+			return reply.ReplicaList, nil
+		}
+	}
+	return nil, fmt.Errorf("the replicas did not register with the master within %v", timeout)
+}
+
+func (c *cluster) replica(arg string) (*replica, error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil || id < 0 || id >= len(c.replicas) {
+		return nil, fmt.Errorf("no replica %q", arg)
+	}
+	rep := c.replicas[id]
+	if rep.proc == nil {
+		return nil, fmt.Errorf("replica %d runs in this process and cannot be controlled", id)
+	}
+	return rep, nil
+}
+
+func (c *cluster) printStatus() {
+	for _, rep := range c.replicas {
+		st, pid := "running", 0
+		if rep.proc != nil {
+			st = rep.proc.state()
+			if rep.proc.running() {
+				pid = rep.proc.cmd.Process.Pid
+			}
+		}
+		fmt.Printf("  replica %d: %s:%d (lease port %d) %s", rep.id, host, rep.port, rep.lport, st)
+		if rep.proc != nil {
+			fmt.Printf(" in %s", rep.proc.dir)
+		}
+		if pid != 0 {
+			fmt.Printf(", pid %d", pid)
+		}
+		fmt.Println()
+	}
+}
+
+func (c *cluster) interact(in *os.File) {
+	scanner := bufio.NewScanner(in)
+	fmt.Print("> ")
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 {
+			if fields[0] == "quit" || fields[0] == "exit" {
+				return
+			}
+			if err := c.command(fields[0], fields[1:]); err != nil {
+				fmt.Println("Error:", err)
+			}
+		}
+		fmt.Print("> ")
+	}
+}
+
+func (c *cluster) command(cmd string, args []string) error {
+	if cmd == "status" {
+		c.printStatus()
+		return nil
+	}
+	if cmd != "kill" && cmd != "stop" && cmd != "cont" && cmd != "restart" {
+		return fmt.Errorf("unknown command %q (status, kill, stop, cont, restart or quit)", cmd)
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s <replica id>", cmd)
+	}
+	rep, err := c.replica(args[0])
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case "kill":
+		rep.proc.kill()
+	case "stop":
+		if err := rep.proc.pause(); err != nil {
+			return err
+		}
+	case "cont":
+		if err := rep.proc.resume(); err != nil {
+			return err
+		}
+	case "restart":
+		rep.proc.kill()
+		if err := rep.proc.start(); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Replica %d is %s\n", rep.id, rep.proc.state())
+	return nil
+}
+
+func (c *cluster) shutdown() {
+	for _, rep := range c.replicas {
+		if rep.proc != nil {
+			if rep.proc.paused {
+				rep.proc.resume()
+			}
+			rep.proc.kill()
+		}
+	}
+	if c.master != nil {
+		c.master.kill()
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "errors"
+
+// Windows has no SIGSTOP: processes cannot be paused, and so none is ever resumed
+
+var errNoPause = errors.New("pausing a process is not supported on Windows")
+
+func (p *process) pause() error {
+	return errNoPause
+}
+
+func (p *process) resume() error {
+	return errNoPause
+}
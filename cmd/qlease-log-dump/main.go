@@ -0,0 +1,310 @@
+// qlease-log-dump prints the records of replica stable stores: replica
+// identities, instance metadata and commands, lease instance counters and
+// parameter changes, in order, as text or as JSON (one object per line).
+//
+// Instance metadata records do not carry the instance number; a protocol
+// writes an instance's metadata just before its commands, so the records
+// are best read as a sequence. Instance statuses are named after the
+// protocol that wrote the store: lpaxos for lease stores
+// (stable-store-lease-*), paxos otherwise, unless -proto says otherwise.
+//
+// With -verify, only the problems are printed: records whose checksum does
+// not match, and a torn or oversized trailing record (which a restarting
+// replica discards). The exit status is 1 if any file has a problem.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/glycerine/qlease/genericsmr"
+	"github.com/glycerine/qlease/lpaxos"
+	"github.com/glycerine/qlease/paxos"
+	"github.com/glycerine/qlease/state"
+)
+
+var asJSON = flag.Bool("json", false, "Print one JSON object per record.")
+var verify = flag.Bool("verify", false, "Only check the records' framing and checksums.")
+var proto = flag.String("proto", "auto", "Protocol that wrote the store, to name instance statuses: paxos, lpaxos or auto.")
+
+// Record is what gets printed about a stable store record.
+type Record struct {
+	Offset  int64  `json:"offset"`
+	Kind    string `json:"kind"`
+	Size    int    `json:"size"`
+	Problem string `json:"problem,omitempty"`
+
+	// RECORD_IDENTITY
+	ReplicaId   *int32 `json:"replica_id,omitempty"`
+	N           *int32 `json:"n,omitempty"`
+	Incarnation *int64 `json:"incarnation,omitempty"`
+
+	// RECORD_INSTANCE_METADATA
+	Ballot *int32 `json:"ballot,omitempty"`
+	Status string `json:"status,omitempty"`
+
+	// RECORD_COMMANDS
+	Commands []Command `json:"commands,omitempty"`
+
+	// RECORD_LEASE_INSTANCES
+	PromisedByMe *int32 `json:"promised_by_me,omitempty"`
+	PromisedToMe *int32 `json:"promised_to_me,omitempty"`
+
+	// RECORD_PARAM
+	Param *string `json:"param,omitempty"`
+	Value *int64  `json:"value,omitempty"`
+}
+
+type Command struct {
+	Op      string      `json:"op"`
+	K       state.Key   `json:"key"`
+	V       state.Value `json:"value"`
+	Version *uint64     `json:"version,omitempty"`
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] stable-store-file...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *proto != "auto" && *proto != "paxos" && *proto != "lpaxos" {
+		fmt.Fprintf(os.Stderr, "Unknown protocol %q\n", *proto)
+		os.Exit(2)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	ok := true
+	for _, path := range flag.Args() {
+		if !dump(out, path) {
+			ok = false
+		}
+	}
+	if !ok {
+		out.Flush()
+		os.Exit(1)
+	}
+}
+
+// prints the records of one file; returns false if it has a problem
+func dump(out *bufio.Writer, path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	defer f.Close()
+
+	p := *proto
+	if p == "auto" {
+		p = "paxos"
+		if strings.HasPrefix(filepath.Base(path), "stable-store-lease") {
+			p = "lpaxos"
+		}
+	}
+	if !*asJSON && !*verify && flag.NArg() > 1 {
+		fmt.Fprintf(out, "%s:\n", path)
+	}
+
+	rd := bufio.NewReader(f)
+	var offset int64
+	records, bad := 0, 0
+	for {
+		kind, payload, err := genericsmr.ReadRecord(rd)
+		if err == io.EOF {
+			break
+		}
+		rec := decode(p, kind, payload)
+		rec.Offset = offset
+		if err != nil {
+			rec.Problem = err.Error()
+			bad++
+		}
+		if err == nil || err == genericsmr.ErrBadChecksum {
+			records++
+		}
+		if !*verify || rec.Problem != "" {
+			printRecord(out, path, rec)
+		}
+		if err != nil && err != genericsmr.ErrBadChecksum {
+			// the framing is lost; nothing after this can be read
+			break
+		}
+		offset += int64(genericsmr.RECORD_HEADER_SIZE + len(payload))
+	}
+	if *verify && !*asJSON {
+		fmt.Fprintf(out, "%s: %d records, %d problems\n", path, records, bad)
+	}
+	return bad == 0
+}
+
+func decode(p string, kind uint8, payload []byte) *Record {
+	rec := &Record{Kind: kindName(kind), Size: len(payload)}
+	short := func(n int) bool {
+		if len(payload) < n {
+			if rec.Problem == "" {
+				rec.Problem = fmt.Sprintf("payload too short (%d bytes, want %d)", len(payload), n)
+			}
+			return true
+		}
+		return false
+	}
+	i32 := func(b []byte) *int32 { v := int32(binary.LittleEndian.Uint32(b)); return &v }
+	i64 := func(b []byte) *int64 { v := int64(binary.LittleEndian.Uint64(b)); return &v }
+
+	switch kind {
+	case genericsmr.RECORD_IDENTITY:
+		if !short(16) {
+			rec.ReplicaId, rec.N, rec.Incarnation = i32(payload[0:4]), i32(payload[4:8]), i64(payload[8:16])
+		}
+	case genericsmr.RECORD_INSTANCE_METADATA:
+		if !short(5) {
+			rec.Ballot = i32(payload[0:4])
+			rec.Status = statusName(p, int8(payload[4]))
+		}
+	case genericsmr.RECORD_COMMANDS:
+		rd := bytes.NewReader(payload)
+		for rd.Len() > 0 {
+			var c state.Command
+			if err := c.Unmarshal(rd); err != nil {
+				rec.Problem = fmt.Sprintf("payload is not a whole number of commands (%d bytes)", len(payload))
+				break
+			}
+			cmd := Command{Op: opName(c.Op), K: c.K, V: c.V}
+			if c.Op == state.CPUT {
+				cmd.Version = &c.Version
+			}
+			rec.Commands = append(rec.Commands, cmd)
+		}
+	case genericsmr.RECORD_LEASE_INSTANCES:
+		if !short(8) {
+			rec.PromisedByMe, rec.PromisedToMe = i32(payload[0:4]), i32(payload[4:8])
+		}
+	case genericsmr.RECORD_PARAM:
+		if !short(9) {
+			name := genericsmr.ParamName(payload[0])
+			rec.Param, rec.Value = &name, i64(payload[1:9])
+		}
+	}
+	return rec
+}
+
+func kindName(kind uint8) string {
+	switch kind {
+	case genericsmr.RECORD_INSTANCE_METADATA:
+		return "INSTANCE_METADATA"
+	case genericsmr.RECORD_COMMANDS:
+		return "COMMANDS"
+	case genericsmr.RECORD_PARAM:
+		return "PARAM"
+	case genericsmr.RECORD_IDENTITY:
+		return "IDENTITY"
+	case genericsmr.RECORD_LEASE_INSTANCES:
+		return "LEASE_INSTANCES"
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", kind)
+}
+
+func statusName(p string, s int8) string {
+	if p == "lpaxos" {
+		switch lpaxos.InstanceStatus(s) {
+		case lpaxos.PREPARING:
+			return "PREPARING"
+		case lpaxos.PREPARED:
+			return "PREPARED"
+		case lpaxos.ACCEPTED:
+			return "ACCEPTED"
+		case lpaxos.COMMITTED:
+			return "COMMITTED"
+		}
+	} else {
+		switch paxos.InstanceStatus(s) {
+		case paxos.NONE:
+			return "NONE"
+		case paxos.PREPARING:
+			return "PREPARING"
+		case paxos.PREPARED:
+			return "PREPARED"
+		case paxos.ACCEPTED:
+			return "ACCEPTED"
+		case paxos.COMMITTED:
+			return "COMMITTED"
+		}
+	}
+	return fmt.Sprintf("%d", s)
+}
+
+func opName(op state.Operation) string {
+	switch op {
+	case state.NONE:
+		return "NONE"
+	case state.PUT:
+		return "PUT"
+	case state.GET:
+		return "GET"
+	case state.DELETE:
+		return "DELETE"
+	case state.RLOCK:
+		return "RLOCK"
+	case state.WLOCK:
+		return "WLOCK"
+	case state.CPUT:
+		return "CPUT"
+	}
+	return fmt.Sprintf("op-%d", op)
+}
+
+func printRecord(out *bufio.Writer, path string, rec *Record) {
+	if *asJSON {
+		b, _ := json.Marshal(struct {
+			File string `json:"file"`
+			*Record
+		}{path, rec})
+		out.Write(b)
+		out.WriteByte('\n')
+		return
+	}
+
+	fmt.Fprintf(out, "%8d %-17s", rec.Offset, rec.Kind)
+	switch {
+	case rec.ReplicaId != nil:
+		fmt.Fprintf(out, " replica %d of %d, incarnation %d", *rec.ReplicaId, *rec.N, *rec.Incarnation)
+	case rec.Ballot != nil:
+		fmt.Fprintf(out, " ballot %d, %s", *rec.Ballot, rec.Status)
+	case rec.PromisedByMe != nil:
+		fmt.Fprintf(out, " promised by me %d, promised to me %d", *rec.PromisedByMe, *rec.PromisedToMe)
+	case rec.Param != nil:
+		fmt.Fprintf(out, " %s = %d", *rec.Param, *rec.Value)
+	case rec.Kind == "COMMANDS":
+		fmt.Fprintf(out, " %d", len(rec.Commands))
+	default:
+		fmt.Fprintf(out, " %d bytes", rec.Size)
+	}
+	if rec.Problem != "" {
+		fmt.Fprintf(out, "  !! %s", rec.Problem)
+	}
+	out.WriteByte('\n')
+	for _, c := range rec.Commands {
+		fmt.Fprintf(out, "%26s %d", c.Op, c.K)
+		if c.Op == "PUT" {
+			fmt.Fprintf(out, " = %d", c.V)
+		}
+		if c.Version != nil {
+			fmt.Fprintf(out, " = %d if at version %d", c.V, *c.Version)
+		}
+		out.WriteByte('\n')
+	}
+}
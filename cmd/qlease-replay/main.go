@@ -0,0 +1,99 @@
+// qlease-replay re-drives a replica from a trace recorded with the server's
+// -trace flag, to reproduce an incident offline. The replica is rebuilt with
+// the same ID, cluster size and protocol as the one that recorded the trace
+// (and, for the protocol's behavior to match, the same flags, e.g. -exec),
+// and is fed the recorded messages one at a time, with its lease clock set
+// to the time each one arrived; what it sends is dropped. Its stable stores
+// go to a temporary directory. Once the trace is exhausted, and -settle has
+// passed, the replica's state is printed.
+//
+// Run with the dlog package's debug output enabled to follow the protocol's
+// decisions message by message.
+//
+//	qlease-replay -trace replica0.trace -id 0 -N 3 -exec
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/glycerine/qlease/epaxos"
+	"github.com/glycerine/qlease/genericsmr"
+	"github.com/glycerine/qlease/lpaxos"
+	"github.com/glycerine/qlease/mencius"
+	"github.com/glycerine/qlease/paxos"
+)
+
+var tracePath = flag.String("trace", "", "Trace file recorded with the server's -trace flag.")
+var replicaId = flag.Int("id", 0, "ID of the replica that recorded the trace.")
+var n = flag.Int("N", 3, "Number of replicas of the cluster.")
+var protocol = flag.String("proto", "paxos", "Protocol of the replica: paxos, epaxos or mencius.")
+var exec = flag.Bool("exec", false, "Execute commands, as the server's -exec.")
+var dreply = flag.Bool("dreply", false, "Reply after executing commands, as the server's -dreply.")
+var beacon = flag.Bool("beacon", false, "Send beacons, as the server's -beacon.")
+var settle = flag.Duration("settle", time.Second, "How long to let the replica run after the last message.")
+
+func main() {
+	flag.Parse()
+	if *tracePath == "" || *replicaId < 0 || *replicaId >= *n {
+		flag.Usage()
+		os.Exit(2)
+	}
+	f, err := os.Open(*tracePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "qlease-replay")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the replica never connects to them, but the addresses must be distinct
+	nodeList := make([]string, *n)
+	leaseNodeList := make([]string, *n)
+	for i := range nodeList {
+		nodeList[i] = fmt.Sprintf("127.0.0.1:%d", 1+i)
+		leaseNodeList[i] = fmt.Sprintf("127.0.0.1:%d", 1+*n+i)
+	}
+	clock := genericsmr.NewVirtualClock(0)
+	opts := []genericsmr.Option{genericsmr.WithReplay(clock), genericsmr.WithExec(*exec), genericsmr.WithDreply(*dreply),
+		genericsmr.WithBeacon(*beacon), genericsmr.WithStableStorePath(filepath.Join(dir, "stable-store"))}
+
+	var r *genericsmr.Replica
+	switch *protocol {
+	case "paxos":
+		leaseRep := lpaxos.NewReplicaWithOptions(*replicaId, leaseNodeList, genericsmr.WithReplay(clock),
+			genericsmr.WithExec(*exec), genericsmr.WithStableStorePath(filepath.Join(dir, "stable-store-lease")))
+		r = paxos.NewReplicaWithOptions(*replicaId, nodeList, leaseRep, false, opts...).Replica
+	case "epaxos":
+		r = epaxos.NewReplicaWithOptions(*replicaId, nodeList, opts...).Replica
+	case "mencius":
+		r = mencius.NewReplicaWithOptions(*replicaId, nodeList, opts...).Replica
+	default:
+		log.Fatalf("unknown protocol %q", *protocol)
+	}
+
+	start := time.Now()
+	count, err := r.Replay(f)
+	log.Printf("Replayed %d messages in %v\n", count, time.Since(start))
+	if err != nil {
+		log.Fatal(err)
+	}
+	time.Sleep(*settle)
+
+	st := r.Status()
+	fmt.Printf("Replica %d at %d: lease instance %d, local reads until %d, quorum writes until %d\n",
+		st.ReplicaId, clock.Now(), st.LeaseInst, st.ReadLocallyUntil, st.WriteInQuorumUntil)
+	for _, c := range st.Chans {
+		if c.Len > 0 || c.Dropped > 0 {
+			fmt.Printf("  %s: %d/%d, %d dropped\n", c.Name, c.Len, c.Cap, c.Dropped)
+		}
+	}
+}
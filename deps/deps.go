@@ -0,0 +1,276 @@
+// Package deps tracks the interference among commands for EPaxos-style
+// protocols, in which every replica proposes commands in its own sequence of
+// instances and commands that conflict (i.e., access the same key, at least
+// one of them writing it) must be ordered through their dependencies.
+//
+// A Tracker also knows which instances are still in flight (not yet
+// executed), so protocols that use it do not need the replica's Updating keys.
+package deps
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/glycerine/qlease/state"
+)
+
+// NONE means no dependency on a replica's instances.
+const NONE int32 = -1
+
+// An Instance identifies a slot in the log of one replica.
+type Instance struct {
+	Replica int32
+	Slot    int32
+}
+
+// Attributes order a command with respect to the commands it interferes with:
+// Deps[q] is the latest instance of replica q it depends on (or NONE), and
+// Seq breaks the ties among commands that end up depending on each other.
+type Attributes struct {
+	Seq  int32
+	Deps []int32
+}
+
+func NewAttributes(n int) Attributes {
+	deps := make([]int32, n)
+	for i := range deps {
+		deps[i] = NONE
+	}
+	return Attributes{0, deps}
+}
+
+// Merge folds b into a (the highest Seq, and per replica the latest
+// dependency), and reports whether a changed.
+func (a *Attributes) Merge(b Attributes) bool {
+	changed := false
+	if b.Seq > a.Seq {
+		a.Seq = b.Seq
+		changed = true
+	}
+	for q := range a.Deps {
+		if q < len(b.Deps) && b.Deps[q] > a.Deps[q] {
+			a.Deps[q] = b.Deps[q]
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (a Attributes) Equal(b Attributes) bool {
+	if a.Seq != b.Seq || len(a.Deps) != len(b.Deps) {
+		return false
+	}
+	for q := range a.Deps {
+		if a.Deps[q] != b.Deps[q] {
+			return false
+		}
+	}
+	return true
+}
+
+// Interferes reports whether two batches of commands must be ordered.
+func Interferes(a []state.Command, b []state.Command) bool {
+	return state.ConflictBatch(a, b)
+}
+
+type keyInfo struct {
+	lastAccess []int32            // per replica, latest instance reading or writing the key
+	lastWrite  []int32            // per replica, latest instance writing the key
+	maxSeq     int32              // highest Seq of the instances accessing the key
+	maxSeqW    int32              // highest Seq of the instances writing the key
+	inflight   map[Instance]bool  // instances accessing the key, not executed yet -> do they write it?
+	marks      map[Instance]int32 // number of commands of each in-flight instance on the key
+}
+
+// Tracker keeps, for every key, the latest instances of every replica that
+// accessed it, and the instances accessing it that are still in flight.
+// It is safe for concurrent use.
+type Tracker struct {
+	n    int
+	lock *sync.Mutex
+	keys map[state.Key]*keyInfo
+}
+
+func NewTracker(n int) *Tracker {
+	return &Tracker{n, new(sync.Mutex), make(map[state.Key]*keyInfo)}
+}
+
+func (t *Tracker) info(k state.Key) *keyInfo {
+	ki, present := t.keys[k]
+	if !present {
+		ki = &keyInfo{
+			lastAccess: make([]int32, t.n),
+			lastWrite:  make([]int32, t.n),
+			inflight:   make(map[Instance]bool),
+			marks:      make(map[Instance]int32),
+		}
+		for q := 0; q < t.n; q++ {
+			ki.lastAccess[q] = NONE
+			ki.lastWrite[q] = NONE
+		}
+		t.keys[k] = ki
+	}
+	return ki
+}
+
+// Attributes computes the attributes of cmds, proposed as instance inst, from
+// the instances recorded so far: writes depend on every access to their keys,
+// reads only on writes. The instance itself is never a dependency.
+func (t *Tracker) Attributes(inst Instance, cmds []state.Command) Attributes {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.attributes(inst, cmds)
+}
+
+func (t *Tracker) attributes(inst Instance, cmds []state.Command) Attributes {
+	attr := NewAttributes(t.n)
+	for i := range cmds {
+		ki, present := t.keys[cmds[i].K]
+		if !present {
+			continue
+		}
+		last, seq := ki.lastWrite, ki.maxSeqW
+		if state.IsWrite(&cmds[i]) {
+			last, seq = ki.lastAccess, ki.maxSeq
+		}
+		for q := range last {
+			d := last[q]
+			if int32(q) == inst.Replica && d >= inst.Slot {
+				// ignore the instance itself (and later ones, when recovering)
+				continue
+			}
+			if d > attr.Deps[q] {
+				attr.Deps[q] = d
+			}
+		}
+		if seq >= attr.Seq {
+			attr.Seq = seq + 1
+		}
+	}
+	return attr
+}
+
+// Record notes that instance inst, with the given Seq, accesses the keys of
+// cmds; the instance is in flight until Executed is called for it.
+func (t *Tracker) Record(inst Instance, seq int32, cmds []state.Command) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.record(inst, seq, cmds)
+}
+
+func (t *Tracker) record(inst Instance, seq int32, cmds []state.Command) {
+	for i := range cmds {
+		ki := t.info(cmds[i].K)
+		if inst.Slot > ki.lastAccess[inst.Replica] {
+			ki.lastAccess[inst.Replica] = inst.Slot
+		}
+		write := state.IsWrite(&cmds[i])
+		if write && inst.Slot > ki.lastWrite[inst.Replica] {
+			ki.lastWrite[inst.Replica] = inst.Slot
+		}
+		if seq > ki.maxSeq {
+			ki.maxSeq = seq
+		}
+		if write && seq > ki.maxSeqW {
+			ki.maxSeqW = seq
+		}
+		ki.inflight[inst] = ki.inflight[inst] || write
+		ki.marks[inst]++
+	}
+}
+
+// Propose computes the attributes of a new instance and records it.
+func (t *Tracker) Propose(inst Instance, cmds []state.Command) Attributes {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	attr := t.attributes(inst, cmds)
+	t.record(inst, attr.Seq, cmds)
+	return attr
+}
+
+// Update merges the attributes an instance was proposed with (e.g., those
+// carried by a PreAccept) with the ones computed locally, records the
+// instance, and reports whether the attributes changed.
+func (t *Tracker) Update(inst Instance, attr Attributes, cmds []state.Command) (Attributes, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	merged := NewAttributes(t.n)
+	merged.Merge(attr)
+	changed := merged.Merge(t.attributes(inst, cmds))
+	t.record(inst, merged.Seq, cmds)
+	return merged, changed
+}
+
+// Executed notes that instance inst, accessing the keys of cmds, is no
+// longer in flight. Its accesses still count as dependencies of later instances.
+func (t *Tracker) Executed(inst Instance, cmds []state.Command) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i := range cmds {
+		ki, present := t.keys[cmds[i].K]
+		if !present || ki.marks[inst] == 0 {
+			continue
+		}
+		if ki.marks[inst]--; ki.marks[inst] == 0 {
+			delete(ki.marks, inst)
+			delete(ki.inflight, inst)
+		}
+	}
+}
+
+// IsUpdating reports whether some in-flight instance writes k.
+func (t *Tracker) IsUpdating(k state.Key) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if ki, present := t.keys[k]; present {
+		for _, write := range ki.inflight {
+			if write {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Conflicts returns the in-flight instances that interfere with cmds, ordered
+// by replica and slot.
+func (t *Tracker) Conflicts(cmds []state.Command) []Instance {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	found := make(map[Instance]bool)
+	for i := range cmds {
+		ki, present := t.keys[cmds[i].K]
+		if !present {
+			continue
+		}
+		for inst, write := range ki.inflight {
+			if write || state.IsWrite(&cmds[i]) {
+				found[inst] = true
+			}
+		}
+	}
+	conflicts := make([]Instance, 0, len(found))
+	for inst := range found {
+		conflicts = append(conflicts, inst)
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Replica != conflicts[j].Replica {
+			return conflicts[i].Replica < conflicts[j].Replica
+		}
+		return conflicts[i].Slot < conflicts[j].Slot
+	})
+	return conflicts
+}
+
+// InFlight returns the number of keys accessed by in-flight instances.
+func (t *Tracker) InFlight() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	n := 0
+	for _, ki := range t.keys {
+		if len(ki.inflight) > 0 {
+			n++
+		}
+	}
+	return n
+}
@@ -1,19 +1,35 @@
 package dlog
 
 
-import "log"
+import (
+    "log"
+    "sync/atomic"
+)
 
 const DLOG = false
 
+var level int32 = 0
+
+func init() {
+    if DLOG {
+        level = 1
+    }
+}
+
+// SetLevel turns debug logging off (0) or on (> 0) at runtime.
+func SetLevel(l int) {
+    atomic.StoreInt32(&level, int32(l))
+}
+
 func Printf(format string, v ...interface{}) {
-    if !DLOG {
+    if atomic.LoadInt32(&level) == 0 {
         return
     }
     log.Printf(format, v...)
 }
 
 func Println(v ...interface{}) {
-    if !DLOG {
+    if atomic.LoadInt32(&level) == 0 {
         return
     }
     log.Println(v...)
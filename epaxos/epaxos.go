@@ -0,0 +1,616 @@
+// Package epaxos is an Egalitarian Paxos replica built on genericsmr, with
+// quorum read leases: every replica proposes commands in its own log, orders
+// them after the interfering commands it knows of (tracked with package
+// deps), and commits them after one round trip to a fast quorum that agrees
+// with that order, or two round trips to a majority otherwise. Replicas read
+// locally while they hold a read lease and no write to the key is in flight;
+// in exchange, writes under lease reach every replica that may hold a lease
+// before they commit (see genericsmr.LeaseAcks).
+//
+// Instances are not logged to the stable store, and the instances of a
+// replica that fails before committing them are not recovered.
+package epaxos
+
+import (
+	"log"
+	"time"
+
+	"github.com/glycerine/qlease/deps"
+	"github.com/glycerine/qlease/dlog"
+	"github.com/glycerine/qlease/epaxosproto"
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/genericsmr"
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/qleaseproto"
+	"github.com/glycerine/qlease/state"
+)
+
+const TRUE = uint8(1)
+const FALSE = uint8(0)
+
+const MAX_BATCH = 1
+
+const CLOCK_TICK_NS = 10 * 1e6 // 10 ms
+
+// number of ticks after which an instance still waiting for replies is sent
+// again to the replicas that have not acknowledged it
+const TICKS_TO_RESEND = 50
+
+// the lease instance every replica promises; unlike paxos, which agrees on
+// lease configurations through lpaxos, every replica grants read leases on
+// every key to every other replica
+const LEASE_INSTANCE = 0
+
+const MAX_REPLICAS = genericsmr.MAX_LEASE_ACK_REPLICAS
+
+type InstanceStatus int8
+
+const (
+	NONE InstanceStatus = iota
+	PREACCEPTED
+	ACCEPTED
+	COMMITTED
+	EXECUTED
+)
+
+type Instance struct {
+	replica int32 // the replica that owns the instance
+	slot    int32
+	cmds    []state.Command
+	ballot  int32
+	status  InstanceStatus
+	attr    deps.Attributes
+	lb      *LeaderBookkeeping
+	// for finding the strongly connected components of the dependency graph
+	index   int
+	lowlink int
+	onStack bool
+}
+
+type LeaderBookkeeping struct {
+	proposals    []*genericsmr.Propose
+	original     deps.Attributes // the attributes the instance was proposed with
+	allEqual     bool            // did every PreAcceptReply agree with them?
+	preAcceptOKs int
+	acceptOKs    int
+	nacks        int
+	writes       bool                  // does the instance update a key under lease?
+	acks         *genericsmr.LeaseAcks // acknowledgments, in any phase
+	ticks        int                   // ticks spent waiting
+}
+
+type Replica struct {
+	*genericsmr.Replica // extends a generic replica
+	preAcceptChan       chan fastrpc.Serializable
+	preAcceptReplyChan  chan fastrpc.Serializable
+	acceptChan          chan fastrpc.Serializable
+	acceptReplyChan     chan fastrpc.Serializable
+	commitChan          chan fastrpc.Serializable
+	preAcceptRPC        uint16
+	preAcceptReplyRPC   uint16
+	acceptRPC           uint16
+	acceptReplyRPC      uint16
+	commitRPC           uint16
+	instanceSpace       [][]*Instance  // the log of every replica
+	crtInstance         []int32        // per replica, the next instance not seen yet
+	executedUpTo        []int32        // per replica, every instance up to this one has been executed
+	pending             map[int32]bool // own instances that are not committed yet
+	tracker             *deps.Tracker
+	clockChan           chan bool
+	leaseClockChan      chan bool
+	// for the strongly connected components search
+	execIndex   int
+	execStack   []*Instance
+	execVisited []*Instance
+}
+
+// NewReplicaWithOptions creates an EPaxos replica configured through
+// genericsmr options. Every replica leads the instances of its own log, so
+// there is no leader to elect, and reads are served locally while the
+// replica holds a read lease and no write to the key is in flight.
+func NewReplicaWithOptions(id int, peerAddrList []string, opts ...genericsmr.Option) *Replica {
+	r := newReplica(id, peerAddrList, opts...)
+	go r.run()
+	return r
+}
+
+// creates the replica without running it (nor connecting to its peers)
+func newReplica(id int, peerAddrList []string, opts ...genericsmr.Option) *Replica {
+	n := len(peerAddrList)
+	if n > MAX_REPLICAS {
+		log.Fatalf("EPaxos supports at most %d replicas, not %d\n", MAX_REPLICAS, n)
+	}
+	r := &Replica{
+		Replica:            genericsmr.NewReplicaWithOptions(id, peerAddrList, opts...),
+		preAcceptChan:      make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		preAcceptReplyChan: make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		acceptChan:         make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		acceptReplyChan:    make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		commitChan:         make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		instanceSpace:      make([][]*Instance, n),
+		crtInstance:        make([]int32, n),
+		executedUpTo:       make([]int32, n),
+		pending:            make(map[int32]bool),
+		tracker:            deps.NewTracker(n),
+	}
+	for q := range r.executedUpTo {
+		r.executedUpTo[q] = -1
+	}
+
+	r.InitParam(genericsmr.PARAM_MAX_BATCH, MAX_BATCH)
+
+	r.preAcceptRPC = r.RegisterRPC(new(epaxosproto.PreAccept), r.preAcceptChan)
+	r.preAcceptReplyRPC = r.RegisterRPC(new(epaxosproto.PreAcceptReply), r.preAcceptReplyChan)
+	r.acceptRPC = r.RegisterRPC(new(epaxosproto.Accept), r.acceptChan)
+	r.acceptReplyRPC = r.RegisterRPC(new(epaxosproto.AcceptReply), r.acceptReplyChan)
+	r.commitRPC = r.RegisterRPC(new(epaxosproto.Commit), r.commitChan)
+
+	return r
+}
+
+func (r *Replica) instance(q int32, i int32) *Instance {
+	if int(i) >= len(r.instanceSpace[q]) {
+		return nil
+	}
+	return r.instanceSpace[q][i]
+}
+
+func (r *Replica) setInstance(q int32, i int32, inst *Instance) {
+	for int(i) >= len(r.instanceSpace[q]) {
+		r.instanceSpace[q] = append(r.instanceSpace[q], nil)
+	}
+	inst.replica, inst.slot = q, i
+	r.instanceSpace[q][i] = inst
+	if i >= r.crtInstance[q] {
+		r.crtInstance[q] = i + 1
+	}
+}
+
+func (r *Replica) clock() {
+	for !r.Shutdown {
+		time.Sleep(CLOCK_TICK_NS)
+		r.clockChan <- true
+	}
+}
+
+func (r *Replica) leaseClock() {
+	for !r.Shutdown {
+		time.Sleep(r.NextLeaseRenewal())
+		r.leaseClockChan <- true
+	}
+}
+
+/* Main event processing loop */
+
+func (r *Replica) run() {
+	r.ConnectToPeers()
+
+	dlog.Println("Waiting for client connections")
+
+	go r.WaitForClientConnections()
+
+	var err error
+	if r.QLease, err = r.NewQLease(); err != nil {
+		log.Fatal(err)
+	}
+	r.QLease.PromisedByMeInst = LEASE_INSTANCE
+	r.RecordLeaseInstances(r.QLease)
+
+	if r.Beacon {
+		r.Beacons.Start()
+	}
+
+	r.clockChan = make(chan bool, 1)
+	go r.clock()
+	r.leaseClockChan = make(chan bool, 1)
+	go r.leaseClock()
+
+	for !r.Shutdown {
+
+		select {
+
+		case propose := <-r.ProposeChan:
+			dlog.Printf("Proposal with op %d\n", propose.Command.Op)
+			r.handlePropose(propose)
+			break
+
+		case paS := <-r.preAcceptChan:
+			pa := paS.(*epaxosproto.PreAccept)
+			dlog.Printf("Received PreAccept from replica %d, for instance %d.%d\n", pa.LeaderId, pa.Replica, pa.Instance)
+			r.handlePreAccept(pa)
+			break
+
+		case prS := <-r.preAcceptReplyChan:
+			pr := prS.(*epaxosproto.PreAcceptReply)
+			dlog.Printf("Received PreAcceptReply from replica %d, for instance %d\n", pr.AcceptorId, pr.Instance)
+			r.handlePreAcceptReply(pr)
+			break
+
+		case aS := <-r.acceptChan:
+			a := aS.(*epaxosproto.Accept)
+			dlog.Printf("Received Accept from replica %d, for instance %d.%d\n", a.LeaderId, a.Replica, a.Instance)
+			r.handleAccept(a)
+			break
+
+		case arS := <-r.acceptReplyChan:
+			ar := arS.(*epaxosproto.AcceptReply)
+			dlog.Printf("Received AcceptReply from replica %d, for instance %d\n", ar.AcceptorId, ar.Instance)
+			r.handleAcceptReply(ar)
+			break
+
+		case cS := <-r.commitChan:
+			c := cS.(*epaxosproto.Commit)
+			dlog.Printf("Received Commit from replica %d, for instance %d.%d\n", c.LeaderId, c.Replica, c.Instance)
+			r.handleCommit(c)
+			break
+
+		case <-r.clockChan:
+			r.checkPending()
+			break
+
+		case <-r.leaseClockChan:
+			// takes effect with the next guard or promise, which carry their own durations
+			r.RefreshLeaseTiming(r.QLease)
+			if r.WriteQuorumSafe() {
+				r.EstablishQLease(r.QLease)
+			} else {
+				r.RenewQLease(r.QLease, r.crtInstance[r.Id]-1)
+			}
+			break
+
+		case guardS := <-r.QLGuardChan:
+			r.HandleQLeaseGuard(r.QLease, guardS.(*qleaseproto.Guard))
+			break
+
+		case guardReplyS := <-r.QLGuardReplyChan:
+			r.HandleQLeaseGuardReply(r.QLease, guardReplyS.(*qleaseproto.GuardReply), r.crtInstance[r.Id]-1)
+			break
+
+		case promiseS := <-r.QLPromiseChan:
+			r.HandleQLeasePromise(r.QLease, promiseS.(*qleaseproto.Promise))
+			break
+
+		case preplyS := <-r.QLPromiseReplyChan:
+			r.HandleQLeaseReply(r.QLease, preplyS.(*qleaseproto.PromiseReply))
+			break
+
+		case grantS := <-r.QLRegionLeaseChan:
+			r.HandleRegionLease(r.QLease, grantS.(*genericsmrproto.RegionLease))
+			break
+
+		case beacon := <-r.BeaconChan:
+			dlog.Printf("Received Beacon from replica %d with timestamp %d\n", beacon.Rid, beacon.Timestamp)
+			r.ReplyBeacon(beacon)
+			break
+
+		case clr := <-r.ClientLeaseChan:
+			// client sub-leases would have to hold back the writes of every replica
+			r.DenyClientLease(clr, genericsmrproto.ERR_CONFLICT)
+			break
+		}
+	}
+
+	r.Beacons.Stop()
+}
+
+/* Lease checks */
+
+// can k be read locally, without going through the protocol?
+func (r *Replica) canReadLocally(k state.Key) bool {
+	ql := r.QLease
+	return ql.CanRead() && ql.Covers(k) && !r.tracker.IsUpdating(k)
+}
+
+func (r *Replica) writesUnderLease(cmds []state.Command) bool {
+	for i := range cmds {
+		if state.IsWrite(&cmds[i]) && r.QLease.Covers(cmds[i].K) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Replica) leaseAllowsCommit(lb *LeaderBookkeeping) bool {
+	return !lb.writes || lb.acks.Allows()
+}
+
+/* Leader side */
+
+func (r *Replica) fastQuorumReplies() int {
+	f := r.N / 2
+	return f + (f+1)/2 - 1
+}
+
+func (r *Replica) handlePropose(propose *genericsmr.Propose) {
+	batchSize := len(r.ProposeChan) + 1
+	if maxBatch := int(r.Param(genericsmr.PARAM_MAX_BATCH)); batchSize > maxBatch {
+		batchSize = maxBatch
+	}
+
+	cmds := make([]state.Command, 0, batchSize)
+	proposals := make([]*genericsmr.Propose, 0, batchSize)
+	for i := 0; i < batchSize; i++ {
+		if i > 0 {
+			propose = <-r.ProposeChan
+		}
+		if r.DropExpired(propose) {
+			continue
+		}
+		if state.IsRead(&propose.Command) && r.canReadLocally(propose.Command.K) {
+			fence, _ := r.FencingToken()
+			e := propose.Command.Apply(r.State)
+			r.ReplyLocalRead(
+				&genericsmrproto.ProposeReplyTS{
+					OK:        TRUE,
+					CommandId: propose.CommandId,
+					Value:     e.Value,
+					Timestamp: propose.Timestamp,
+					ErrCode:   genericsmrproto.ERR_NONE,
+					Fence:     fence,
+					Version:   e.Version},
+				propose)
+			continue
+		}
+		cmds = append(cmds, propose.Command)
+		proposals = append(proposals, propose)
+	}
+	if len(cmds) == 0 {
+		return
+	}
+
+	instNo := r.crtInstance[r.Id]
+	attr := r.tracker.Propose(deps.Instance{Replica: r.Id, Slot: instNo}, cmds)
+	lb := &LeaderBookkeeping{
+		proposals: proposals,
+		original:  deps.NewAttributes(r.N),
+		allEqual:  true,
+		writes:    r.writesUnderLease(cmds),
+		acks:      genericsmr.NewLeaseAcks(r.N),
+	}
+	lb.original.Merge(attr)
+	until, reachable := r.LeaseObligations()
+	lb.acks.Note(r.Id, until, reachable)
+	inst := &Instance{cmds: cmds, status: PREACCEPTED, attr: attr, lb: lb}
+	r.setInstance(r.Id, instNo, inst)
+	r.pending[instNo] = true
+
+	r.bcastPreAccept(instNo, inst, false)
+	r.tryCommit(instNo, inst)
+}
+
+func (r *Replica) bcastPreAccept(instNo int32, inst *Instance, missingOnly bool) {
+	pa := &epaxosproto.PreAccept{
+		LeaderId: r.Id,
+		Replica:  r.Id,
+		Instance: instNo,
+		Ballot:   inst.ballot,
+		Command:  inst.cmds,
+		Seq:      inst.lb.original.Seq,
+		Deps:     inst.lb.original.Deps}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !r.PeerAlive(q) || (missingOnly && inst.lb.acks.Acked(q)) {
+			continue
+		}
+		r.SendMsg(q, r.preAcceptRPC, pa)
+	}
+}
+
+func (r *Replica) bcastAccept(instNo int32, inst *Instance, missingOnly bool) {
+	a := &epaxosproto.Accept{
+		LeaderId: r.Id,
+		Replica:  r.Id,
+		Instance: instNo,
+		Ballot:   inst.ballot,
+		Command:  inst.cmds,
+		Seq:      inst.attr.Seq,
+		Deps:     inst.attr.Deps}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !r.PeerAlive(q) || (missingOnly && inst.lb.acks.Acked(q)) {
+			continue
+		}
+		r.SendMsg(q, r.acceptRPC, a)
+	}
+}
+
+func (r *Replica) handlePreAcceptReply(pr *epaxosproto.PreAcceptReply) {
+	inst := r.instance(r.Id, pr.Instance)
+	if inst == nil || inst.lb == nil || inst.status != PREACCEPTED {
+		// a late reply
+		return
+	}
+	lb := inst.lb
+	if pr.OK == FALSE {
+		lb.nacks++
+		return
+	}
+	if lb.acks.Acked(pr.AcceptorId) {
+		return
+	}
+	lb.preAcceptOKs++
+	lb.acks.Note(pr.AcceptorId, pr.WriteInQuorumUntil, pr.Reachable)
+	replyAttr := deps.Attributes{Seq: pr.Seq, Deps: pr.Deps}
+	if !replyAttr.Equal(lb.original) {
+		lb.allEqual = false
+	}
+	inst.attr.Merge(replyAttr)
+	r.tryCommit(pr.Instance, inst)
+}
+
+func (r *Replica) handleAcceptReply(ar *epaxosproto.AcceptReply) {
+	inst := r.instance(r.Id, ar.Instance)
+	if inst == nil || inst.lb == nil || inst.status != ACCEPTED {
+		return
+	}
+	lb := inst.lb
+	if ar.OK == FALSE {
+		lb.nacks++
+		return
+	}
+	lb.acceptOKs++
+	lb.acks.Note(ar.AcceptorId, ar.WriteInQuorumUntil, ar.Reachable)
+	r.tryCommit(ar.Instance, inst)
+}
+
+// moves an own instance along: commits it on the fast path if a fast quorum
+// agreed with the attributes it was proposed with, starts the Accept phase
+// once a majority replied otherwise, and commits it after a majority
+// accepted; commits wait for the lease checks to pass
+func (r *Replica) tryCommit(instNo int32, inst *Instance) {
+	lb := inst.lb
+	switch inst.status {
+	case PREACCEPTED:
+		if lb.preAcceptOKs < r.N/2 {
+			return
+		}
+		if lb.allEqual && lb.preAcceptOKs >= r.fastQuorumReplies() {
+			if r.leaseAllowsCommit(lb) {
+				r.commit(instNo, inst)
+			}
+			return
+		}
+		if !lb.allEqual {
+			inst.status = ACCEPTED
+			r.bcastAccept(instNo, inst, false)
+			r.tryCommit(instNo, inst)
+		}
+	case ACCEPTED:
+		if lb.acceptOKs >= r.N/2 && r.leaseAllowsCommit(lb) {
+			r.commit(instNo, inst)
+		}
+	}
+}
+
+func (r *Replica) commit(instNo int32, inst *Instance) {
+	inst.status = COMMITTED
+	delete(r.pending, instNo)
+	r.ProposalsCommitted(inst.lb.proposals)
+	c := &epaxosproto.Commit{
+		LeaderId: r.Id,
+		Replica:  r.Id,
+		Instance: instNo,
+		Command:  inst.cmds,
+		Seq:      inst.attr.Seq,
+		Deps:     inst.attr.Deps}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id && r.PeerAlive(q) {
+			r.SendMsg(q, r.commitRPC, c)
+		}
+	}
+	if !r.Dreply {
+		for _, p := range inst.lb.proposals {
+			r.ReplyProposeTS(
+				&genericsmrproto.ProposeReplyTS{
+					OK:        TRUE,
+					CommandId: p.CommandId,
+					Value:     state.NIL,
+					Timestamp: p.Timestamp,
+					ErrCode:   genericsmrproto.ERR_NONE},
+				p)
+		}
+	}
+	r.committed(r.Id, instNo, inst)
+}
+
+// retries the instances waiting for replies or for the lease checks
+func (r *Replica) checkPending() {
+	for instNo := range r.pending {
+		inst := r.instance(r.Id, instNo)
+		r.tryCommit(instNo, inst)
+		if inst.status == COMMITTED {
+			continue
+		}
+		inst.lb.ticks++
+		if inst.lb.ticks%TICKS_TO_RESEND != 0 {
+			continue
+		}
+		if inst.status == PREACCEPTED && inst.lb.preAcceptOKs >= r.N/2 {
+			// a fast quorum is not coming
+			inst.status = ACCEPTED
+			r.bcastAccept(instNo, inst, false)
+			continue
+		}
+		if inst.status == PREACCEPTED {
+			r.bcastPreAccept(instNo, inst, true)
+		} else {
+			r.bcastAccept(instNo, inst, true)
+		}
+	}
+}
+
+/* Acceptor side */
+
+func (r *Replica) handlePreAccept(pa *epaxosproto.PreAccept) {
+	inst := r.instance(pa.Replica, pa.Instance)
+	until, reachable := r.LeaseObligations()
+	reply := &epaxosproto.PreAcceptReply{
+		AcceptorId:         r.Id,
+		Replica:            pa.Replica,
+		Instance:           pa.Instance,
+		OK:                 TRUE,
+		Ballot:             pa.Ballot,
+		WriteInQuorumUntil: until,
+		Reachable:          reachable}
+	switch {
+	case inst == nil:
+		attr, _ := r.tracker.Update(deps.Instance{Replica: pa.Replica, Slot: pa.Instance},
+			deps.Attributes{Seq: pa.Seq, Deps: pa.Deps}, pa.Command)
+		inst = &Instance{cmds: pa.Command, ballot: pa.Ballot, status: PREACCEPTED, attr: attr}
+		r.setInstance(pa.Replica, pa.Instance, inst)
+	case inst.ballot > pa.Ballot:
+		reply.OK = FALSE
+		reply.Ballot = inst.ballot
+	}
+	// a resent PreAccept gets the attributes computed the first time
+	reply.Seq = inst.attr.Seq
+	reply.Deps = inst.attr.Deps
+	r.SendMsg(pa.LeaderId, r.preAcceptReplyRPC, reply)
+}
+
+func (r *Replica) handleAccept(a *epaxosproto.Accept) {
+	inst := r.instance(a.Replica, a.Instance)
+	until, reachable := r.LeaseObligations()
+	reply := &epaxosproto.AcceptReply{
+		AcceptorId:         r.Id,
+		Replica:            a.Replica,
+		Instance:           a.Instance,
+		OK:                 TRUE,
+		Ballot:             a.Ballot,
+		WriteInQuorumUntil: until,
+		Reachable:          reachable}
+	switch {
+	case inst == nil:
+		r.tracker.Record(deps.Instance{Replica: a.Replica, Slot: a.Instance}, a.Seq, a.Command)
+		inst = &Instance{cmds: a.Command, ballot: a.Ballot, status: ACCEPTED, attr: deps.Attributes{Seq: a.Seq, Deps: a.Deps}}
+		r.setInstance(a.Replica, a.Instance, inst)
+	case inst.ballot > a.Ballot:
+		reply.OK = FALSE
+		reply.Ballot = inst.ballot
+	case inst.status < ACCEPTED:
+		inst.status = ACCEPTED
+		inst.attr = deps.Attributes{Seq: a.Seq, Deps: a.Deps}
+	}
+	r.SendMsg(a.LeaderId, r.acceptReplyRPC, reply)
+}
+
+func (r *Replica) handleCommit(c *epaxosproto.Commit) {
+	inst := r.instance(c.Replica, c.Instance)
+	if inst == nil {
+		r.tracker.Record(deps.Instance{Replica: c.Replica, Slot: c.Instance}, c.Seq, c.Command)
+		inst = &Instance{cmds: c.Command}
+		r.setInstance(c.Replica, c.Instance, inst)
+	} else if inst.status >= COMMITTED {
+		return
+	}
+	inst.status = COMMITTED
+	inst.attr = deps.Attributes{Seq: c.Seq, Deps: c.Deps}
+	r.committed(c.Replica, c.Instance, inst)
+}
+
+func (r *Replica) committed(q int32, instNo int32, inst *Instance) {
+	if !r.Exec {
+		// nothing will be executed, so nothing will be read locally either
+		r.tracker.Executed(deps.Instance{Replica: q, Slot: instNo}, inst.cmds)
+		return
+	}
+	r.executeCommands()
+}
@@ -0,0 +1,370 @@
+package epaxos
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glycerine/qlease/clientlib"
+	"github.com/glycerine/qlease/deps"
+	"github.com/glycerine/qlease/epaxosproto"
+	"github.com/glycerine/qlease/genericsmr"
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/masterproto"
+	"github.com/glycerine/qlease/state"
+)
+
+// Most tests drive a single replica that is never run: they call its
+// handlers with the messages its peers would send, and look at its
+// instances. As it is not connected to its peers, what it sends them is
+// dropped. The last test runs a cluster of three replicas on loopback ports.
+
+// a replica of n, not running, with its lease (on every key)
+func newTestReplica(t *testing.T, id int, n int) *Replica {
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("127.0.0.1:%d", 7070+i) // never dialed
+	}
+	r := newReplica(id, addrs, genericsmr.WithExec(true),
+		genericsmr.WithStableStorePath(filepath.Join(t.TempDir(), "store")))
+	var err error
+	if r.QLease, err = r.NewQLease(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// take k out of the lease, so that writes to it do not wait for lease acks
+func (r *Replica) unlease(k state.Key) {
+	r.QLease.Keys = []state.Key{k + 1}
+}
+
+func (r *Replica) propose(cmd state.Command) int32 {
+	instNo := r.crtInstance[r.Id]
+	r.handlePropose(&genericsmr.Propose{
+		Propose:    &genericsmrproto.Propose{CommandId: instNo, Command: cmd},
+		FwdReplica: -1})
+	return instNo
+}
+
+// replicas 0..n-1
+func everyone(n int) uint64 {
+	return 1<<uint(n) - 1
+}
+
+func preAcceptOK(from int32, instNo int32, attr deps.Attributes, until int64, reachable uint64) *epaxosproto.PreAcceptReply {
+	return &epaxosproto.PreAcceptReply{
+		AcceptorId:         from,
+		Instance:           instNo,
+		OK:                 TRUE,
+		Seq:                attr.Seq,
+		Deps:               attr.Deps,
+		WriteInQuorumUntil: until,
+		Reachable:          reachable}
+}
+
+func acceptOK(from int32, instNo int32, reachable uint64) *epaxosproto.AcceptReply {
+	return &epaxosproto.AcceptReply{AcceptorId: from, Instance: instNo, OK: TRUE, Reachable: reachable}
+}
+
+func (r *Replica) checkStatus(t *testing.T, instNo int32, status InstanceStatus, after string) {
+	t.Helper()
+	if inst := r.instance(r.Id, instNo); inst.status != status {
+		t.Fatalf("instance %d is in status %d after %s, not %d", instNo, inst.status, after, status)
+	}
+}
+
+func TestFastQuorumReplies(t *testing.T) {
+	// replies, besides the command leader's own: a fast quorum is F + (F+1)/2
+	// replicas of 2F+1
+	for _, c := range []struct{ n, replies int }{{3, 1}, {5, 2}, {7, 4}, {9, 5}} {
+		r := &Replica{Replica: &genericsmr.Replica{N: c.n}}
+		if got := r.fastQuorumReplies(); got != c.replies {
+			t.Errorf("%d replicas: fast quorum of %d replies, not %d", c.n, got, c.replies)
+		}
+	}
+}
+
+func TestFastPath(t *testing.T) {
+	r := newTestReplica(t, 0, 7)
+	r.unlease(1)
+	instNo := r.propose(state.Command{Op: state.PUT, K: 1, V: 1})
+	attr := r.instance(0, instNo).attr
+
+	// a majority that agrees is not enough
+	for q := int32(1); q <= 3; q++ {
+		r.handlePreAcceptReply(preAcceptOK(q, instNo, attr, 0, everyone(7)))
+	}
+	r.checkStatus(t, instNo, PREACCEPTED, "3 replies")
+
+	r.handlePreAcceptReply(preAcceptOK(4, instNo, attr, 0, everyone(7)))
+	r.checkStatus(t, instNo, EXECUTED, "a fast quorum of replies")
+	if len(r.pending) != 0 {
+		t.Errorf("instance still pending after commit: %v", r.pending)
+	}
+	if v := (&state.Command{Op: state.GET, K: 1}).Execute(r.State); v != 1 {
+		t.Errorf("executed 1 = %d, not 1", v)
+	}
+}
+
+func TestSlowPathOnDisagreement(t *testing.T) {
+	r := newTestReplica(t, 0, 5)
+	r.unlease(1)
+	instNo := r.propose(state.Command{Op: state.PUT, K: 1, V: 1})
+	attr := r.instance(0, instNo).attr
+
+	// replica 2 knows of an interfering instance of replica 3
+	other := deps.NewAttributes(5)
+	other.Seq, other.Deps[3] = 2, 4
+	r.handlePreAcceptReply(preAcceptOK(1, instNo, attr, 0, everyone(5)))
+	r.handlePreAcceptReply(preAcceptOK(2, instNo, other, 0, everyone(5)))
+	r.checkStatus(t, instNo, ACCEPTED, "disagreeing replies")
+	if got := r.instance(0, instNo).attr; got.Seq != 2 || got.Deps[3] != 4 {
+		t.Fatalf("accepted attributes %+v do not include those of replica 2", got)
+	}
+
+	r.handleAcceptReply(acceptOK(1, instNo, everyone(5)))
+	r.checkStatus(t, instNo, ACCEPTED, "1 AcceptReply")
+	r.handleAcceptReply(acceptOK(2, instNo, everyone(5)))
+	// instance 4 of replica 3 is not committed here, so it cannot execute
+	r.checkStatus(t, instNo, COMMITTED, "a majority of AcceptReplies")
+}
+
+func TestSlowPathWithoutFastQuorum(t *testing.T) {
+	r := newTestReplica(t, 0, 7)
+	r.unlease(1)
+	instNo := r.propose(state.Command{Op: state.PUT, K: 1, V: 1})
+	attr := r.instance(0, instNo).attr
+	for q := int32(1); q <= 3; q++ {
+		r.handlePreAcceptReply(preAcceptOK(q, instNo, attr, 0, everyone(7)))
+	}
+
+	// a majority agreed, but the rest of a fast quorum does not reply
+	for i := 0; i < TICKS_TO_RESEND-1; i++ {
+		r.checkPending()
+	}
+	r.checkStatus(t, instNo, PREACCEPTED, "waiting for a fast quorum")
+	r.checkPending()
+	r.checkStatus(t, instNo, ACCEPTED, "giving up on a fast quorum")
+	for q := int32(1); q <= 3; q++ {
+		r.handleAcceptReply(acceptOK(q, instNo, everyone(7)))
+	}
+	r.checkStatus(t, instNo, EXECUTED, "a majority of AcceptReplies")
+}
+
+func TestLeasedWriteWaitsForReachableReplicas(t *testing.T) {
+	r := newTestReplica(t, 0, 3)
+	instNo := r.propose(state.Command{Op: state.PUT, K: 1, V: 1})
+	attr := r.instance(0, instNo).attr
+
+	// a fast quorum, but replica 2, which may hold a lease on 1, is
+	// reachable from replica 1 and has not seen the write
+	r.handlePreAcceptReply(preAcceptOK(1, instNo, attr, 0, everyone(3)))
+	r.checkStatus(t, instNo, PREACCEPTED, "a fast quorum without replica 2")
+	r.checkPending()
+	r.checkStatus(t, instNo, PREACCEPTED, "a fast quorum without replica 2")
+
+	r.handlePreAcceptReply(preAcceptOK(2, instNo, attr, 0, everyone(3)))
+	r.checkStatus(t, instNo, EXECUTED, "every replica's reply")
+}
+
+// wait for the lease promises that expire at until, checking pending
+// instances as the replica's clock does
+func (r *Replica) tickUntil(until int64) {
+	for time.Now().UnixNano() <= until {
+		r.checkPending()
+		time.Sleep(CLOCK_TICK_NS)
+	}
+	r.checkPending()
+}
+
+func TestLeasedWriteWaitsForWriteInQuorumUntil(t *testing.T) {
+	r := newTestReplica(t, 0, 3)
+	instNo := r.propose(state.Command{Op: state.PUT, K: 1, V: 1})
+	attr := r.instance(0, instNo).attr
+
+	// replica 2 is cut off, but replica 1 promised it a lease that is still
+	// in effect
+	until := time.Now().Add(300 * time.Millisecond).UnixNano()
+	r.handlePreAcceptReply(preAcceptOK(1, instNo, attr, until, everyone(2)))
+	r.checkPending()
+	r.checkStatus(t, instNo, PREACCEPTED, "a reply with a promise in effect")
+
+	r.tickUntil(until)
+	r.checkStatus(t, instNo, EXECUTED, "the promise expired")
+}
+
+func TestLeasedWriteWaitsForOwnPromises(t *testing.T) {
+	r := newTestReplica(t, 0, 3)
+	// this replica promised replica 2 a lease, which is still in effect
+	until := time.Now().Add(300 * time.Millisecond).UnixNano()
+	r.QLease.LatestRepliesReceived[2] = until
+	instNo := r.propose(state.Command{Op: state.PUT, K: 1, V: 1})
+	attr := r.instance(0, instNo).attr
+
+	r.handlePreAcceptReply(preAcceptOK(1, instNo, attr, 0, everyone(2)))
+	r.checkPending()
+	r.checkStatus(t, instNo, PREACCEPTED, "a fast quorum, with an own promise in effect")
+
+	r.tickUntil(until)
+	r.checkStatus(t, instNo, EXECUTED, "the promise expired")
+}
+
+func (r *Replica) get(k state.Key) state.Value {
+	return (&state.Command{Op: state.GET, K: k}).Execute(r.State)
+}
+
+func TestInterferingCommands(t *testing.T) {
+	put := func(k state.Key, v state.Value) []state.Command {
+		return []state.Command{{Op: state.PUT, K: k, V: v}}
+	}
+	none := deps.NewAttributes(3)
+
+	// instance 0 of replica 2 writes the key instance 0 of replica 1 wrote,
+	// so it depends on it; instance 1 of replica 1 does not
+	r := newTestReplica(t, 0, 3)
+	r.handlePreAccept(&epaxosproto.PreAccept{LeaderId: 1, Replica: 1, Instance: 0, Command: put(5, 1), Seq: none.Seq, Deps: none.Deps})
+	r.handlePreAccept(&epaxosproto.PreAccept{LeaderId: 2, Replica: 2, Instance: 0, Command: put(5, 2), Seq: none.Seq, Deps: none.Deps})
+	r.handlePreAccept(&epaxosproto.PreAccept{LeaderId: 1, Replica: 1, Instance: 1, Command: put(6, 3), Seq: none.Seq, Deps: none.Deps})
+	if attr := r.instance(2, 0).attr; attr.Deps[1] != 0 || attr.Seq != 1 {
+		t.Errorf("PUT 5 of replica 2 after that of replica 1 has attributes %+v", attr)
+	}
+	if attr := r.instance(1, 1).attr; !attr.Equal(none) {
+		t.Errorf("PUT 6 depends on PUT 5: %+v", attr)
+	}
+	if !r.tracker.IsUpdating(5) {
+		t.Errorf("key 5 is not in flight")
+	}
+
+	// the two writes, committed depending on each other (each leader heard
+	// of the other write at some acceptor), execute in the same order
+	// whatever the order of the commits
+	cyclic := func(q int32) deps.Attributes {
+		attr := deps.NewAttributes(3)
+		attr.Seq, attr.Deps[3-q] = 1, 0
+		return attr
+	}
+	commit := func(r *Replica, q int32) {
+		attr := cyclic(q)
+		r.handleCommit(&epaxosproto.Commit{LeaderId: q, Replica: q, Instance: 0, Command: put(5, state.Value(q)), Seq: attr.Seq, Deps: attr.Deps})
+	}
+	commit(r, 2)
+	if v := r.get(5); v != state.NIL {
+		t.Errorf("executed 5 = %d before its dependency committed", v)
+	}
+	commit(r, 1)
+	other := newTestReplica(t, 0, 3)
+	commit(other, 1)
+	commit(other, 2)
+	for _, r := range []*Replica{r, other} {
+		if v := r.get(5); v != 2 {
+			t.Errorf("executed 5 = %d, not 2 (the write of replica 2, after that of replica 1)", v)
+		}
+		if r.tracker.IsUpdating(5) {
+			t.Errorf("key 5 still in flight after execution")
+		}
+	}
+}
+
+// serves the replica list, as the master does
+type testMaster struct {
+	replicas []string
+}
+
+func (m *testMaster) GetReplicaList(args *masterproto.GetReplicaListArgs, reply *masterproto.GetReplicaListReply) error {
+	reply.ReplicaList, reply.Ready = m.replicas, true
+	return nil
+}
+
+func (m *testMaster) GetLeader(args *masterproto.GetLeaderArgs, reply *masterproto.GetLeaderReply) error {
+	reply.LeaderId = 0
+	return nil
+}
+
+func TestConflictingWrites(t *testing.T) {
+	const n = 3
+	dir := t.TempDir()
+	ls := make([]net.Listener, n)
+	addrs := make([]string, n)
+	for i := range ls {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ls[i], addrs[i] = l, l.Addr().String()
+	}
+	for i := 0; i < n; i++ {
+		NewReplicaWithOptions(i, addrs, genericsmr.WithExec(true), genericsmr.WithDreply(true),
+			genericsmr.WithListener(ls[i]), genericsmr.WithStableStorePath(filepath.Join(dir, fmt.Sprintf("epaxos-%d", i))))
+	}
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Master", &testMaster{addrs}); err != nil {
+		t.Fatal(err)
+	}
+	ml, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ml.Close()
+	go http.Serve(ml, srv)
+	client, err := clientlib.Dial("127.0.0.1", ml.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	propose := func(replica int, cmd state.Command) (*genericsmrproto.ProposeReplyTS, error) {
+		reply, err := client.ProposeDeadline(replica, cmd, time.Now().Add(30*time.Second))
+		if err == nil && reply.OK == FALSE {
+			err = fmt.Errorf("error %d %s", reply.ErrCode, reply.ErrMsg)
+		}
+		return reply, err
+	}
+
+	// every replica writes the same keys at once
+	const writes = 20
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for q := 0; q < n; q++ {
+		wg.Add(1)
+		go func(q int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if _, err := propose(q, state.Command{Op: state.PUT, K: state.Key(i % 2), V: state.Value(100*q + i)}); err != nil {
+					errs <- fmt.Errorf("PUT at replica %d: %v", q, err)
+					return
+				}
+			}
+		}(q)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// and all of them then read the same values, whichever write was last
+	for k := state.Key(0); k < 2; k++ {
+		var values [n]state.Value
+		for q := 0; q < n; q++ {
+			reply, err := propose(q, state.Command{Op: state.GET, K: k})
+			if err != nil {
+				t.Fatalf("GET at replica %d: %v", q, err)
+			}
+			values[q] = reply.Value
+		}
+		for q := 1; q < n; q++ {
+			if values[q] != values[0] {
+				t.Errorf("replicas read different values of %d: %v", k, values)
+			}
+		}
+		if v := values[0]; v%100 < writes-2 {
+			t.Errorf("replicas read %d = %d, not the last write of a replica", k, v)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package epaxos
+
+import (
+	"sort"
+
+	"github.com/glycerine/qlease/deps"
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// Committed instances are executed in dependency order: the dependency graph
+// is split into strongly connected components (Tarjan's algorithm), which are
+// executed in reverse topological order, and the instances within a component
+// in order of Seq (ties broken by replica ID). An instance is executed only
+// once all of its dependencies are committed.
+
+func (r *Replica) executeCommands() {
+	for progress := true; progress; {
+		progress = false
+		for q := int32(0); q < int32(r.N); q++ {
+			for i := r.executedUpTo[q] + 1; i < r.crtInstance[q]; i++ {
+				inst := r.instance(q, i)
+				if inst == nil || inst.status < COMMITTED {
+					break
+				}
+				if inst.status == COMMITTED && !r.executeFrom(inst) {
+					break
+				}
+				r.executedUpTo[q] = i
+				progress = true
+			}
+		}
+	}
+}
+
+// executes the component of inst and every component it depends on;
+// returns false if some dependency is not committed yet
+func (r *Replica) executeFrom(inst *Instance) bool {
+	r.execIndex = 1
+	r.execStack = r.execStack[:0]
+	r.execVisited = r.execVisited[:0]
+	ok := r.strongConnect(inst)
+	for _, v := range r.execVisited {
+		v.index, v.lowlink, v.onStack = 0, 0, false
+	}
+	return ok
+}
+
+func (r *Replica) strongConnect(v *Instance) bool {
+	v.index = r.execIndex
+	v.lowlink = r.execIndex
+	r.execIndex++
+	r.execStack = append(r.execStack, v)
+	v.onStack = true
+	r.execVisited = append(r.execVisited, v)
+
+	// depend on every instance of every replica up to the dependency
+	for q := int32(0); q < int32(r.N); q++ {
+		for i := r.executedUpTo[q] + 1; i <= v.attr.Deps[q]; i++ {
+			w := r.instance(q, i)
+			if w == nil || w.status < COMMITTED {
+				return false
+			}
+			if w.status == EXECUTED {
+				continue
+			}
+			if w.index == 0 {
+				if !r.strongConnect(w) {
+					return false
+				}
+				if w.lowlink < v.lowlink {
+					v.lowlink = w.lowlink
+				}
+			} else if w.onStack && w.index < v.lowlink {
+				v.lowlink = w.index
+			}
+		}
+	}
+
+	if v.lowlink == v.index {
+		// v is the root of a component
+		j := len(r.execStack) - 1
+		for r.execStack[j] != v {
+			j--
+		}
+		component := make([]*Instance, len(r.execStack)-j)
+		copy(component, r.execStack[j:])
+		r.execStack = r.execStack[:j]
+		sort.Slice(component, func(a, b int) bool {
+			if component[a].attr.Seq != component[b].attr.Seq {
+				return component[a].attr.Seq < component[b].attr.Seq
+			}
+			return component[a].replica < component[b].replica
+		})
+		for _, w := range component {
+			w.onStack = false
+			r.execute(w)
+		}
+	}
+	return true
+}
+
+func (r *Replica) execute(inst *Instance) {
+	for j := range inst.cmds {
+		e := inst.cmds[j].Apply(r.State)
+		if r.Dreply && inst.lb != nil && j < len(inst.lb.proposals) {
+			p := inst.lb.proposals[j]
+			r.ReplyProposeTS(
+				&genericsmrproto.ProposeReplyTS{
+					OK:        TRUE,
+					CommandId: p.CommandId,
+					Value:     e.Value,
+					Timestamp: p.Timestamp,
+					ErrCode:   genericsmrproto.ERR_NONE,
+					Version:   e.Version},
+				p)
+		}
+	}
+	inst.status = EXECUTED
+	r.tracker.Executed(deps.Instance{Replica: inst.replica, Slot: inst.slot}, inst.cmds)
+}
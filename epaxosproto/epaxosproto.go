@@ -0,0 +1,61 @@
+package epaxosproto
+
+import (
+	"github.com/glycerine/qlease/state"
+)
+
+// Every message names the instance it is about by the replica that owns it
+// (i.e., that proposed its commands) and its position in that replica's log.
+
+type PreAccept struct {
+	LeaderId int32
+	Replica  int32
+	Instance int32
+	Ballot   int32
+	Command  []state.Command
+	Seq      int32
+	Deps     []int32
+}
+
+type PreAcceptReply struct {
+	AcceptorId int32
+	Replica    int32
+	Instance   int32
+	OK         uint8
+	Ballot     int32
+	Seq        int32
+	Deps       []int32
+	// the acceptor's lease obligations: its WriteInQuorumUntil, and the
+	// replicas it can still reach (bit i for replica i), i.e., renew leases to
+	WriteInQuorumUntil int64
+	Reachable          uint64
+}
+
+type Accept struct {
+	LeaderId int32
+	Replica  int32
+	Instance int32
+	Ballot   int32
+	Command  []state.Command
+	Seq      int32
+	Deps     []int32
+}
+
+type AcceptReply struct {
+	AcceptorId         int32
+	Replica            int32
+	Instance           int32
+	OK                 uint8
+	Ballot             int32
+	WriteInQuorumUntil int64
+	Reachable          uint64
+}
+
+type Commit struct {
+	LeaderId int32
+	Replica  int32
+	Instance int32
+	Command  []state.Command
+	Seq      int32
+	Deps     []int32
+}
@@ -0,0 +1,257 @@
+package epaxosproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/state"
+)
+
+type byteReader interface {
+	io.Reader
+	ReadByte() (c byte, err error)
+}
+
+func asByteReader(rr io.Reader) byteReader {
+	if wire, ok := rr.(byteReader); ok {
+		return wire
+	}
+	return bufio.NewReader(rr)
+}
+
+func marshalInt32s(wire io.Writer, vs ...int32) {
+	var b [16]byte
+	bs := b[:4*len(vs)]
+	for i, v := range vs {
+		binary.LittleEndian.PutUint32(bs[4*i:4*i+4], uint32(v))
+	}
+	wire.Write(bs)
+}
+
+func unmarshalInt32s(wire io.Reader, vs ...*int32) error {
+	var b [16]byte
+	bs := b[:4*len(vs)]
+	if _, err := io.ReadFull(wire, bs); err != nil {
+		return err
+	}
+	for i, v := range vs {
+		*v = int32(binary.LittleEndian.Uint32(bs[4*i : 4*i+4]))
+	}
+	return nil
+}
+
+func marshalCommands(wire io.Writer, cmds []state.Command) {
+	var b [10]byte
+	wlen := binary.PutVarint(b[:], int64(len(cmds)))
+	wire.Write(b[:wlen])
+	for i := range cmds {
+		cmds[i].Marshal(wire)
+	}
+}
+
+func unmarshalCommands(wire byteReader) ([]state.Command, error) {
+	n, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([]state.Command, n)
+	for i := range cmds {
+		if err := cmds[i].Unmarshal(wire); err != nil {
+			return nil, err
+		}
+	}
+	return cmds, nil
+}
+
+// marshal the attributes (Seq, Deps) of an instance
+func marshalAttributes(wire io.Writer, seq int32, deps []int32) {
+	var b [10]byte
+	marshalInt32s(wire, seq)
+	wlen := binary.PutVarint(b[:], int64(len(deps)))
+	wire.Write(b[:wlen])
+	for _, d := range deps {
+		marshalInt32s(wire, d)
+	}
+}
+
+func unmarshalAttributes(wire byteReader, seq *int32) ([]int32, error) {
+	if err := unmarshalInt32s(wire, seq); err != nil {
+		return nil, err
+	}
+	n, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
+	if err != nil {
+		return nil, err
+	}
+	deps := make([]int32, n)
+	for i := range deps {
+		if err := unmarshalInt32s(wire, &deps[i]); err != nil {
+			return nil, err
+		}
+	}
+	return deps, nil
+}
+
+// the lease obligations carried by replies
+func marshalObligations(wire io.Writer, until int64, reachable uint64) {
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[0:8], uint64(until))
+	binary.LittleEndian.PutUint64(b[8:16], reachable)
+	wire.Write(b[:])
+}
+
+func unmarshalObligations(wire io.Reader, until *int64, reachable *uint64) error {
+	var b [16]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	*until = int64(binary.LittleEndian.Uint64(b[0:8]))
+	*reachable = binary.LittleEndian.Uint64(b[8:16])
+	return nil
+}
+
+func (t *PreAccept) New() fastrpc.Serializable {
+	return new(PreAccept)
+}
+
+func (t *PreAccept) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *PreAccept) Marshal(wire io.Writer) {
+	marshalInt32s(wire, t.LeaderId, t.Replica, t.Instance, t.Ballot)
+	marshalCommands(wire, t.Command)
+	marshalAttributes(wire, t.Seq, t.Deps)
+}
+
+func (t *PreAccept) Unmarshal(rr io.Reader) error {
+	wire := asByteReader(rr)
+	var err error
+	if err = unmarshalInt32s(wire, &t.LeaderId, &t.Replica, &t.Instance, &t.Ballot); err != nil {
+		return err
+	}
+	if t.Command, err = unmarshalCommands(wire); err != nil {
+		return err
+	}
+	t.Deps, err = unmarshalAttributes(wire, &t.Seq)
+	return err
+}
+
+func (t *PreAcceptReply) New() fastrpc.Serializable {
+	return new(PreAcceptReply)
+}
+
+func (t *PreAcceptReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *PreAcceptReply) Marshal(wire io.Writer) {
+	marshalInt32s(wire, t.AcceptorId, t.Replica, t.Instance)
+	wire.Write([]byte{t.OK})
+	marshalInt32s(wire, t.Ballot)
+	marshalAttributes(wire, t.Seq, t.Deps)
+	marshalObligations(wire, t.WriteInQuorumUntil, t.Reachable)
+}
+
+func (t *PreAcceptReply) Unmarshal(rr io.Reader) error {
+	wire := asByteReader(rr)
+	var err error
+	if err = unmarshalInt32s(wire, &t.AcceptorId, &t.Replica, &t.Instance); err != nil {
+		return err
+	}
+	if t.OK, err = wire.ReadByte(); err != nil {
+		return err
+	}
+	if err = unmarshalInt32s(wire, &t.Ballot); err != nil {
+		return err
+	}
+	if t.Deps, err = unmarshalAttributes(wire, &t.Seq); err != nil {
+		return err
+	}
+	return unmarshalObligations(wire, &t.WriteInQuorumUntil, &t.Reachable)
+}
+
+func (t *Accept) New() fastrpc.Serializable {
+	return new(Accept)
+}
+
+func (t *Accept) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *Accept) Marshal(wire io.Writer) {
+	marshalInt32s(wire, t.LeaderId, t.Replica, t.Instance, t.Ballot)
+	marshalCommands(wire, t.Command)
+	marshalAttributes(wire, t.Seq, t.Deps)
+}
+
+func (t *Accept) Unmarshal(rr io.Reader) error {
+	wire := asByteReader(rr)
+	var err error
+	if err = unmarshalInt32s(wire, &t.LeaderId, &t.Replica, &t.Instance, &t.Ballot); err != nil {
+		return err
+	}
+	if t.Command, err = unmarshalCommands(wire); err != nil {
+		return err
+	}
+	t.Deps, err = unmarshalAttributes(wire, &t.Seq)
+	return err
+}
+
+func (t *AcceptReply) New() fastrpc.Serializable {
+	return new(AcceptReply)
+}
+
+func (t *AcceptReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 33, true
+}
+
+func (t *AcceptReply) Marshal(wire io.Writer) {
+	marshalInt32s(wire, t.AcceptorId, t.Replica, t.Instance)
+	wire.Write([]byte{t.OK})
+	marshalInt32s(wire, t.Ballot)
+	marshalObligations(wire, t.WriteInQuorumUntil, t.Reachable)
+}
+
+func (t *AcceptReply) Unmarshal(rr io.Reader) error {
+	wire := asByteReader(rr)
+	var err error
+	if err = unmarshalInt32s(wire, &t.AcceptorId, &t.Replica, &t.Instance); err != nil {
+		return err
+	}
+	if t.OK, err = wire.ReadByte(); err != nil {
+		return err
+	}
+	if err = unmarshalInt32s(wire, &t.Ballot); err != nil {
+		return err
+	}
+	return unmarshalObligations(wire, &t.WriteInQuorumUntil, &t.Reachable)
+}
+
+func (t *Commit) New() fastrpc.Serializable {
+	return new(Commit)
+}
+
+func (t *Commit) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *Commit) Marshal(wire io.Writer) {
+	marshalInt32s(wire, t.LeaderId, t.Replica, t.Instance)
+	marshalCommands(wire, t.Command)
+	marshalAttributes(wire, t.Seq, t.Deps)
+}
+
+func (t *Commit) Unmarshal(rr io.Reader) error {
+	wire := asByteReader(rr)
+	var err error
+	if err = unmarshalInt32s(wire, &t.LeaderId, &t.Replica, &t.Instance); err != nil {
+		return err
+	}
+	if t.Command, err = unmarshalCommands(wire); err != nil {
+		return err
+	}
+	t.Deps, err = unmarshalAttributes(wire, &t.Seq)
+	return err
+}
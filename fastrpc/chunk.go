@@ -0,0 +1,101 @@
+package fastrpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Messages larger than CHUNK_SIZE are marshaled up front and sent as a
+// stream of chunks, so that the sender holds the connection only while
+// writing each chunk and other messages can be interleaved between them.
+const CHUNK_SIZE = 64 * 1024
+
+// the largest message a Reassembler accepts
+const MAX_STREAMED_MSG_SIZE = 256 * 1024 * 1024
+
+var ErrStreamTooLarge = errors.New("streamed message too large")
+
+// Chunk is a piece of the marshaled form of a message with the given code.
+type Chunk struct {
+	Stream uint32 // identifies the message among those in flight on a connection
+	Code   uint16 // the code of the message being streamed
+	Last   uint8  // 1 for the last chunk of the message
+	Data   []byte
+}
+
+func (t *Chunk) New() Serializable {
+	return new(Chunk)
+}
+
+func (t *Chunk) Marshal(wire io.Writer) {
+	var b [11]byte
+	binary.LittleEndian.PutUint32(b[0:4], t.Stream)
+	binary.LittleEndian.PutUint16(b[4:6], t.Code)
+	b[6] = t.Last
+	binary.LittleEndian.PutUint32(b[7:11], uint32(len(t.Data)))
+	wire.Write(b[:])
+	wire.Write(t.Data)
+}
+
+func (t *Chunk) Unmarshal(wire io.Reader) error {
+	var b [11]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.Stream = binary.LittleEndian.Uint32(b[0:4])
+	t.Code = binary.LittleEndian.Uint16(b[4:6])
+	t.Last = b[6]
+	size := binary.LittleEndian.Uint32(b[7:11])
+	if size > CHUNK_SIZE {
+		return ErrStreamTooLarge
+	}
+	t.Data = make([]byte, size)
+	_, err := io.ReadFull(wire, t.Data)
+	return err
+}
+
+// SplitChunks cuts the marshaled form of a message into chunks of at most
+// CHUNK_SIZE bytes.
+func SplitChunks(stream uint32, code uint16, data []byte) []Chunk {
+	chunks := make([]Chunk, 0, len(data)/CHUNK_SIZE+1)
+	for {
+		n := len(data)
+		if n > CHUNK_SIZE {
+			n = CHUNK_SIZE
+		}
+		c := Chunk{Stream: stream, Code: code, Data: data[:n]}
+		data = data[n:]
+		if len(data) == 0 {
+			c.Last = 1
+			return append(chunks, c)
+		}
+		chunks = append(chunks, c)
+	}
+}
+
+// A Reassembler collects the chunks received on one connection. It is not
+// safe for concurrent use.
+type Reassembler struct {
+	partial map[uint32][]byte
+}
+
+func NewReassembler() *Reassembler {
+	return &Reassembler{make(map[uint32][]byte)}
+}
+
+// Add adds a chunk, and returns the whole marshaled message once its last
+// chunk has arrived (nil until then).
+func (ra *Reassembler) Add(c *Chunk) ([]byte, error) {
+	data := append(ra.partial[c.Stream], c.Data...)
+	if len(data) > MAX_STREAMED_MSG_SIZE {
+		delete(ra.partial, c.Stream)
+		return nil, ErrStreamTooLarge
+	}
+	if c.Last == 0 {
+		ra.partial[c.Stream] = data
+		return nil, nil
+	}
+	delete(ra.partial, c.Stream)
+	return data, nil
+}
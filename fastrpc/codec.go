@@ -0,0 +1,125 @@
+package fastrpc
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A Codec encodes messages on the wire. Every message has a binary encoding,
+// that of its own Marshal and Unmarshal methods (CODEC_BINARY); other codecs
+// (CODEC_PROTOBUF, for clients and replicas written in other languages, and
+// any registered under a codec byte with RegisterCodec) are for connections
+// to agree on when they are established. A codec that does not support a
+// message (e.g., because it only has schemas for some of the message
+// families) returns an error for it.
+type Codec interface {
+	Encode(w io.Writer, msg Message) error
+	Decode(r Reader, msg Message) error
+}
+
+// Message is what codecs encode: every Serializable, and the messages of
+// clients, which are not registered as RPCs.
+type Message interface {
+	Marshal(io.Writer)
+	Unmarshal(io.Reader) error
+}
+
+type Reader interface {
+	io.Reader
+	io.ByteReader
+}
+
+const (
+	CODEC_BINARY   uint8 = iota // the messages' own encoding
+	CODEC_JSON                  // length-prefixed JSON, for debugging
+	CODEC_PROTOBUF              // length-prefixed protocol buffers, for clients in other languages (see protocodec.go)
+)
+
+// the largest message that CODEC_JSON and CODEC_PROTOBUF decode
+const MAX_JSON_MSG_SIZE = 64 * 1024 * 1024
+
+type codecEntry struct {
+	name  string
+	codec Codec
+}
+
+var codecLock = new(sync.Mutex)
+
+var codecs = map[uint8]codecEntry{
+	CODEC_BINARY:   {"binary", binaryCodec{}},
+	CODEC_JSON:     {"json", jsonCodec{}},
+	CODEC_PROTOBUF: {"protobuf", protoCodec{}},
+}
+
+// RegisterCodec makes a codec available under id and name, replacing any
+// codec registered with that ID before.
+func RegisterCodec(id uint8, name string, c Codec) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	codecs[id] = codecEntry{name, c}
+}
+
+// LookupCodec returns the codec registered under id, or nil.
+func LookupCodec(id uint8) Codec {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	return codecs[id].codec
+}
+
+// CodecByName returns the ID of the codec registered under name.
+func CodecByName(name string) (uint8, error) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	for id, e := range codecs {
+		if e.name == name {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown codec %q", name)
+}
+
+// Binary is the codec of the messages' own encoding.
+var Binary Codec = binaryCodec{}
+
+type binaryCodec struct{}
+
+func (binaryCodec) Encode(w io.Writer, msg Message) error {
+	msg.Marshal(w)
+	return nil
+}
+
+func (binaryCodec) Decode(r Reader, msg Message) error {
+	return msg.Unmarshal(r)
+}
+
+// each message is a JSON document preceded by its length, as a uvarint
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(w io.Writer, msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutUvarint(b[:], uint64(len(data)))])
+	_, err = w.Write(data)
+	return err
+}
+
+func (jsonCodec) Decode(r Reader, msg Message) error {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	if n > MAX_JSON_MSG_SIZE {
+		return fmt.Errorf("JSON message of %d bytes", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, msg)
+}
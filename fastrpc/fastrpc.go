@@ -10,3 +10,25 @@ type Serializable interface {
     New() Serializable
 }
 
+// Serializables that also implement SizedMarshaler can be marshaled straight
+// into a caller-provided buffer, so that senders can frame them and hand them
+// to the connection without copying them through a bufio.Writer.
+type SizedMarshaler interface {
+    Serializable
+    Size() int                  // the exact number of bytes MarshalTo writes
+    MarshalTo(b []byte) int     // marshals into b, which holds at least Size() bytes
+}
+
+// VarintSize returns the number of bytes binary.PutVarint uses for x.
+func VarintSize(x int64) int {
+    ux := uint64(x) << 1
+    if x < 0 {
+        ux = ^ux
+    }
+    n := 1
+    for ux >= 0x80 {
+        ux >>= 7
+        n++
+    }
+    return n
+}
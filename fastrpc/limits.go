@@ -0,0 +1,30 @@
+package fastrpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Limits on the lengths that Unmarshal accepts from the wire, which are
+// checked before anything is allocated, so that a corrupted or malicious
+// peer or client cannot make the receiver allocate without bound.
+const (
+	MAX_ARRAY_LEN = 1 << 20  // elements of an array
+	MAX_BYTES_LEN = 16 << 20 // bytes of a byte array or string
+)
+
+var ErrBadLength = errors.New("length out of bounds")
+
+// ReadLen reads the varint length of an array of at most max elements.
+func ReadLen(r io.ByteReader, max int64) (int64, error) {
+	n, err := binary.ReadVarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > max {
+		return 0, fmt.Errorf("%w: %d (at most %d)", ErrBadLength, n, max)
+	}
+	return n, nil
+}
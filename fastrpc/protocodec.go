@@ -0,0 +1,311 @@
+package fastrpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// CODEC_PROTOBUF encodes each message as a protocol buffer, preceded by its
+// length as a uvarint (protobuf's "delimited" framing), so that clients in
+// other languages can use the message definitions of a .proto schema (see
+// genericsmrproto/client.proto) rather than the binary encoding. A message's
+// fields are numbered by their position in its Go struct, from 1, and map to
+// protobuf types by kind:
+//
+//	int8, int16, int32      int32
+//	int64                   int64
+//	uint8, uint16, uint32   uint32
+//	uint64                  uint64
+//	bool                    bool
+//	float32, float64        float, double
+//	string, []byte          string, bytes
+//	struct                  message
+//	slice                   repeated (packed if numeric)
+//
+// Fields at their zero value are left out, as in proto3, and fields the
+// decoder does not know are skipped. Messages with fields of other kinds
+// (maps, pointers, ...) are not supported.
+
+type protoCodec struct{}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func (protoCodec) Encode(w io.Writer, msg Message) error {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("protobuf: cannot encode %T", msg)
+	}
+	data, err := appendProtoStruct(nil, v.Elem())
+	if err != nil {
+		return err
+	}
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutUvarint(b[:], uint64(len(data)))])
+	_, err = w.Write(data)
+	return err
+}
+
+func (protoCodec) Decode(r Reader, msg Message) error {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("protobuf: cannot decode %T", msg)
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	if n > MAX_JSON_MSG_SIZE {
+		return fmt.Errorf("protobuf message of %d bytes", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	v.Elem().Set(reflect.Zero(v.Elem().Type()))
+	return decodeProtoStruct(data, v.Elem())
+}
+
+func appendTag(b []byte, num int, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(num)<<3|uint64(wire))
+}
+
+func appendProtoStruct(b []byte, v reflect.Value) ([]byte, error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if !t.Field(i).IsExported() {
+			continue
+		}
+		var err error
+		if b, err = appendProtoField(b, i+1, v.Field(i)); err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", t.Name(), t.Field(i).Name, err)
+		}
+	}
+	return b, nil
+}
+
+// the wire type of a scalar of kind k, and whether it is one
+func scalarWire(k reflect.Kind) (int, bool) {
+	switch k {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Bool:
+		return wireVarint, true
+	case reflect.Float64:
+		return wireFixed64, true
+	case reflect.Float32:
+		return wireFixed32, true
+	}
+	return 0, false
+}
+
+// append the scalar v, without a tag
+func appendScalar(b []byte, v reflect.Value) []byte {
+	switch v.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.AppendUvarint(b, uint64(v.Int()))
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return binary.AppendUvarint(b, v.Uint())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 1)
+		}
+		return append(b, 0)
+	case reflect.Float64:
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(v.Float()))
+	default: // reflect.Float32
+		return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(v.Float())))
+	}
+}
+
+func appendProtoField(b []byte, num int, v reflect.Value) ([]byte, error) {
+	if wire, ok := scalarWire(v.Kind()); ok {
+		if v.IsZero() {
+			return b, nil
+		}
+		return appendScalar(appendTag(b, num, wire), v), nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		if v.Len() == 0 {
+			return b, nil
+		}
+		b = binary.AppendUvarint(appendTag(b, num, wireBytes), uint64(v.Len()))
+		return append(b, v.String()...), nil
+	case reflect.Struct:
+		body, err := appendProtoStruct(nil, v)
+		if err != nil {
+			return nil, err
+		}
+		b = binary.AppendUvarint(appendTag(b, num, wireBytes), uint64(len(body)))
+		return append(b, body...), nil
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return b, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b = binary.AppendUvarint(appendTag(b, num, wireBytes), uint64(v.Len()))
+			return append(b, v.Bytes()...), nil
+		}
+		if _, ok := scalarWire(v.Type().Elem().Kind()); ok {
+			var packed []byte
+			for i := 0; i < v.Len(); i++ {
+				packed = appendScalar(packed, v.Index(i))
+			}
+			b = binary.AppendUvarint(appendTag(b, num, wireBytes), uint64(len(packed)))
+			return append(b, packed...), nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			e := v.Index(i)
+			if e.Kind() == reflect.Slice || !e.IsZero() {
+				var err error
+				if b, err = appendProtoField(b, num, e); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			// an element at its zero value must still be there
+			b = append(appendTag(b, num, wireBytes), 0)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("protobuf: unsupported %s", v.Type())
+}
+
+func decodeProtoStruct(data []byte, v reflect.Value) error {
+	t := v.Type()
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return io.ErrUnexpectedEOF
+		}
+		data = data[n:]
+		num, wire := int(tag>>3), int(tag&7)
+		var raw []byte // the field's bytes, with a length prefix removed
+		var scalar uint64
+		switch wire {
+		case wireVarint:
+			if scalar, n = binary.Uvarint(data); n <= 0 {
+				return io.ErrUnexpectedEOF
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return io.ErrUnexpectedEOF
+			}
+			scalar, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return io.ErrUnexpectedEOF
+			}
+			scalar, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return io.ErrUnexpectedEOF
+			}
+			raw, data = data[n:n+int(size)], data[n+int(size):]
+		default:
+			return fmt.Errorf("protobuf: wire type %d", wire)
+		}
+		if num < 1 || num > t.NumField() || !t.Field(num-1).IsExported() {
+			continue // a field this version does not know
+		}
+		f := v.Field(num - 1)
+		if err := decodeProtoField(f, wire, scalar, raw); err != nil {
+			return fmt.Errorf("%s.%s: %v", t.Name(), t.Field(num-1).Name, err)
+		}
+	}
+	return nil
+}
+
+func setScalar(f reflect.Value, wire int, x uint64) error {
+	if w, _ := scalarWire(f.Kind()); w != wire {
+		return fmt.Errorf("protobuf: wire type %d for %s", wire, f.Type())
+	}
+	switch f.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f.SetInt(int64(x))
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f.SetUint(x)
+	case reflect.Bool:
+		f.SetBool(x != 0)
+	case reflect.Float64:
+		f.SetFloat(math.Float64frombits(x))
+	case reflect.Float32:
+		f.SetFloat(float64(math.Float32frombits(uint32(x))))
+	}
+	return nil
+}
+
+func decodeProtoField(f reflect.Value, wire int, scalar uint64, raw []byte) error {
+	if _, ok := scalarWire(f.Kind()); ok {
+		return setScalar(f, wire, scalar)
+	}
+	if f.Kind() == reflect.Slice && wire != wireBytes {
+		// a repeated scalar, not packed
+		e := reflect.New(f.Type().Elem()).Elem()
+		if err := setScalar(e, wire, scalar); err != nil {
+			return err
+		}
+		f.Set(reflect.Append(f, e))
+		return nil
+	}
+	if wire != wireBytes {
+		return fmt.Errorf("protobuf: wire type %d for %s", wire, f.Type())
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(string(raw))
+		return nil
+	case reflect.Struct:
+		return decodeProtoStruct(raw, f)
+	case reflect.Slice:
+		et := f.Type().Elem()
+		if et.Kind() == reflect.Uint8 {
+			f.SetBytes(append([]byte(nil), raw...))
+			return nil
+		}
+		if w, ok := scalarWire(et.Kind()); ok {
+			// packed, or else a single element
+			for len(raw) > 0 {
+				var x uint64
+				switch w {
+				case wireVarint:
+					var n int
+					if x, n = binary.Uvarint(raw); n <= 0 {
+						return io.ErrUnexpectedEOF
+					}
+					raw = raw[n:]
+				case wireFixed64:
+					if len(raw) < 8 {
+						return io.ErrUnexpectedEOF
+					}
+					x, raw = binary.LittleEndian.Uint64(raw), raw[8:]
+				case wireFixed32:
+					if len(raw) < 4 {
+						return io.ErrUnexpectedEOF
+					}
+					x, raw = uint64(binary.LittleEndian.Uint32(raw)), raw[4:]
+				}
+				e := reflect.New(et).Elem()
+				setScalar(e, w, x)
+				f.Set(reflect.Append(f, e))
+			}
+			return nil
+		}
+		e := reflect.New(et).Elem()
+		if err := decodeProtoField(e, wire, 0, raw); err != nil {
+			return err
+		}
+		f.Set(reflect.Append(f, e))
+		return nil
+	}
+	return fmt.Errorf("protobuf: unsupported %s", f.Type())
+}
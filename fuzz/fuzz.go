@@ -0,0 +1,130 @@
+//go:build gofuzz
+// +build gofuzz
+
+// Package fuzz holds the go-fuzz harness of the wire formats, which checks
+// that no input makes Unmarshal panic or allocate without bound, and that
+// what Unmarshal accepts marshals back to a canonical form. Build and run it
+// with:
+//
+//	go-fuzz-build github.com/glycerine/qlease/fuzz
+//	go-fuzz -bin fuzz-fuzz.zip -workdir /tmp/qlease-fuzz
+package fuzz
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/glycerine/qlease/epaxosproto"
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/lpaxosproto"
+	"github.com/glycerine/qlease/menciusproto"
+	"github.com/glycerine/qlease/paxosproto"
+	"github.com/glycerine/qlease/qleaseproto"
+)
+
+// every message type that goes on the wire; the first byte of the input
+// picks one
+var messages = []func() fastrpc.Message{
+	func() fastrpc.Message { return new(fastrpc.Chunk) },
+	func() fastrpc.Message { return new(genericsmrproto.Propose) },
+	func() fastrpc.Message { return new(genericsmrproto.ProposeReply) },
+	func() fastrpc.Message { return new(genericsmrproto.ProposeReplyTS) },
+	func() fastrpc.Message { return new(genericsmrproto.Read) },
+	func() fastrpc.Message { return new(genericsmrproto.ReadReply) },
+	func() fastrpc.Message { return new(genericsmrproto.ProposeAndRead) },
+	func() fastrpc.Message { return new(genericsmrproto.ProposeAndReadReply) },
+	func() fastrpc.Message { return new(genericsmrproto.Authenticate) },
+	func() fastrpc.Message { return new(genericsmrproto.AuthenticateReply) },
+	func() fastrpc.Message { return new(genericsmrproto.ClientLease) },
+	func() fastrpc.Message { return new(genericsmrproto.ClientLeaseReply) },
+	func() fastrpc.Message { return new(genericsmrproto.ClientLeaseRelease) },
+	func() fastrpc.Message { return new(genericsmrproto.SelectGroup) },
+	func() fastrpc.Message { return new(genericsmrproto.SelectGroupReply) },
+	func() fastrpc.Message { return new(genericsmrproto.Status) },
+	func() fastrpc.Message { return new(genericsmrproto.StatusReply) },
+	func() fastrpc.Message { return new(genericsmrproto.RequestEntries) },
+	func() fastrpc.Message { return new(genericsmrproto.Entries) },
+	func() fastrpc.Message { return new(genericsmrproto.QuorumRead) },
+	func() fastrpc.Message { return new(genericsmrproto.QuorumReadReply) },
+	func() fastrpc.Message { return new(genericsmrproto.ForwardPropose) },
+	func() fastrpc.Message { return new(genericsmrproto.ForwardProposeReply) },
+	func() fastrpc.Message { return new(genericsmrproto.ReadIndex) },
+	func() fastrpc.Message { return new(genericsmrproto.ReadIndexReply) },
+	func() fastrpc.Message { return new(genericsmrproto.LeaderCheck) },
+	func() fastrpc.Message { return new(genericsmrproto.LeaderCheckReply) },
+	func() fastrpc.Message { return new(genericsmrproto.StateDigest) },
+	func() fastrpc.Message { return new(genericsmrproto.StateDigestReply) },
+	func() fastrpc.Message { return new(genericsmrproto.StateKeys) },
+	func() fastrpc.Message { return new(genericsmrproto.StateKeysReply) },
+	func() fastrpc.Message { return new(genericsmrproto.RequestSnapshot) },
+	func() fastrpc.Message { return new(genericsmrproto.SnapshotChunk) },
+	func() fastrpc.Message { return new(genericsmrproto.Beacon) },
+	func() fastrpc.Message { return new(genericsmrproto.BeaconReply) },
+	func() fastrpc.Message { return new(genericsmrproto.ClockProbe) },
+	func() fastrpc.Message { return new(genericsmrproto.ClockProbeReply) },
+	func() fastrpc.Message { return new(genericsmrproto.RegionLeaseRequest) },
+	func() fastrpc.Message { return new(genericsmrproto.RegionLease) },
+	func() fastrpc.Message { return new(genericsmrproto.LeaseIdle) },
+	func() fastrpc.Message { return new(genericsmrproto.Ping) },
+	func() fastrpc.Message { return new(genericsmrproto.Causal) },
+	func() fastrpc.Message { return new(genericsmrproto.Session) },
+	func() fastrpc.Message { return new(genericsmrproto.Codec) },
+	func() fastrpc.Message { return new(genericsmrproto.CodecReply) },
+	func() fastrpc.Message { return new(genericsmrproto.ConfigUpdate) },
+	func() fastrpc.Message { return new(genericsmrproto.Deadline) },
+	func() fastrpc.Message { return new(genericsmrproto.Priority) },
+	func() fastrpc.Message { return new(qleaseproto.Guard) },
+	func() fastrpc.Message { return new(qleaseproto.GuardReply) },
+	func() fastrpc.Message { return new(qleaseproto.Promise) },
+	func() fastrpc.Message { return new(qleaseproto.PromiseReply) },
+	func() fastrpc.Message { return new(qleaseproto.LeaseMetadata) },
+	func() fastrpc.Message { return new(paxosproto.Prepare) },
+	func() fastrpc.Message { return new(paxosproto.PrepareReply) },
+	func() fastrpc.Message { return new(paxosproto.Accept) },
+	func() fastrpc.Message { return new(paxosproto.AcceptReply) },
+	func() fastrpc.Message { return new(paxosproto.Commit) },
+	func() fastrpc.Message { return new(paxosproto.CommitShort) },
+	func() fastrpc.Message { return new(paxosproto.Forward) },
+	func() fastrpc.Message { return new(paxosproto.ForwardReply) },
+	func() fastrpc.Message { return new(lpaxosproto.ProposeLease) },
+	func() fastrpc.Message { return new(lpaxosproto.Prepare) },
+	func() fastrpc.Message { return new(lpaxosproto.PrepareReply) },
+	func() fastrpc.Message { return new(lpaxosproto.Accept) },
+	func() fastrpc.Message { return new(lpaxosproto.AcceptReply) },
+	func() fastrpc.Message { return new(lpaxosproto.Commit) },
+	func() fastrpc.Message { return new(lpaxosproto.CommitShort) },
+	func() fastrpc.Message { return new(epaxosproto.PreAccept) },
+	func() fastrpc.Message { return new(epaxosproto.PreAcceptReply) },
+	func() fastrpc.Message { return new(epaxosproto.Accept) },
+	func() fastrpc.Message { return new(epaxosproto.AcceptReply) },
+	func() fastrpc.Message { return new(epaxosproto.Commit) },
+	func() fastrpc.Message { return new(menciusproto.Accept) },
+	func() fastrpc.Message { return new(menciusproto.AcceptReply) },
+	func() fastrpc.Message { return new(menciusproto.Commit) },
+	func() fastrpc.Message { return new(menciusproto.Skip) },
+	func() fastrpc.Message { return new(menciusproto.Prepare) },
+	func() fastrpc.Message { return new(menciusproto.PrepareReply) },
+}
+
+func Fuzz(data []byte) int {
+	if len(data) == 0 {
+		return -1
+	}
+	newMsg := messages[int(data[0])%len(messages)]
+	msg := newMsg()
+	if err := msg.Unmarshal(bytes.NewReader(data[1:])); err != nil {
+		return 0
+	}
+	var first, second bytes.Buffer
+	msg.Marshal(&first)
+	again := newMsg()
+	if err := again.Unmarshal(bytes.NewReader(first.Bytes())); err != nil {
+		panic(fmt.Sprintf("%T does not unmarshal what it marshals: %v", msg, err))
+	}
+	again.Marshal(&second)
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		panic(fmt.Sprintf("%T marshals differently after a round trip", msg))
+	}
+	return 1
+}
@@ -0,0 +1,122 @@
+package genericsmr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/glycerine/qlease/fastrpc"
+)
+
+// Peers and clients connect to the same port, and one accept loop tells them
+// apart by the first byte of the connection. A replica dialing a peer
+// without sessions starts with PEER_CONN_MAGIC, which is not a client message
+// type, followed by its ID (little-endian int32); with sessions, it starts
+// with PEER_SESSION_MAGIC (see sessions.go). Anything else is a client. So a
+// peer that connects late (e.g., after restarting) is not served as a
+// client, nor a client that connects early taken for a peer. The two kinds
+// of connections are limited separately: clients by MaxClients, and peers to
+// one connection per replica of the configuration with a higher ID (those
+// with lower IDs are dialed), which replaces any previous one, and which
+// must identify itself within PEER_HANDSHAKE_TIMEOUT. Every replica of a
+// cluster must be of a version that sends the magic byte. The peers of a
+// GroupMux, which cannot reconnect, are only accepted until they are all
+// connected.
+
+const PEER_CONN_MAGIC = 0xA4
+
+// write the handshake that opens replica self's connection to a peer
+func writePeerHandshake(conn net.Conn, self int32) error {
+	var b [5]byte
+	b[0] = PEER_CONN_MAGIC
+	binary.LittleEndian.PutUint32(b[1:5], uint32(self))
+	_, err := conn.Write(b[:])
+	return err
+}
+
+// read the ID of a peer that opened conn with PEER_CONN_MAGIC, and check that
+// it is one of the replicas that dial this one
+func readPeerHandshake(conn net.Conn, self int32, n int) (int32, bool) {
+	var b [4]byte
+	conn.SetReadDeadline(time.Now().Add(PEER_HANDSHAKE_TIMEOUT))
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return 0, false
+	}
+	conn.SetReadDeadline(time.Time{})
+	q := int32(binary.LittleEndian.Uint32(b[:]))
+	if q <= self || q >= int32(n) {
+		log.Printf("Rejecting a peer connection from %s claiming to be replica %d\n", conn.RemoteAddr(), q)
+		return 0, false
+	}
+	return q, true
+}
+
+// serve a connection that opened with PEER_CONN_MAGIC as the replica's
+// connection to the peer, replacing any previous one
+func (r *Replica) acceptPeer(conn net.Conn) {
+	q, ok := readPeerHandshake(conn, r.Id, r.N)
+	if !ok {
+		conn.Close()
+		return
+	}
+	lane := r.acceptControlLane(q, conn)
+	r.tuneConn(conn, true)
+	conn = r.peerConn(q, conn)
+	reader := r.newPeerReader(conn)
+
+	r.PeerWLocks[q].LockControl()
+	r.sessionLock.Lock()
+	old, oldLane := r.Peers[q], r.ctlLanes[q]
+	r.Peers[q] = conn
+	r.ctlLanes[q] = lane
+	r.PeerReaders[q] = reader
+	r.PeerWriters[q] = r.newPeerWriter(conn)
+	r.extendedCodes[q] = false
+	r.reassemblers[q] = fastrpc.NewReassembler()
+	r.sendCodecs[q], r.recvCodecs[q] = fastrpc.Binary, fastrpc.Binary
+	listening := r.listening
+	r.sessionLock.Unlock()
+	r.heardFromPeer(int(q))
+	r.PeerStates.Set(q, PEER_ALIVE)
+	r.PeerWLocks[q].Unlock()
+
+	if oldLane != nil {
+		oldLane.conn.Close()
+	}
+	if old != nil {
+		old.Close()
+		log.Printf("Replica %d reconnected\n", q)
+	}
+	if listening {
+		// ConnectToPeers is done: serve the peer as it would have
+		r.startReplicaListener(int(q), reader)
+		if lane != nil {
+			r.startControlLaneListener(int(q), lane)
+		}
+		r.sayHelloTo(q)
+		r.switchPeerCodec(q)
+	}
+}
+
+// start the listeners of the connected peers, and of those connecting later
+func (r *Replica) startReplicaListeners() {
+	r.sessionLock.Lock()
+	r.listening = true
+	readers := make([]*bufio.Reader, r.N)
+	copy(readers, r.PeerReaders)
+	lanes := make([]*ctlLane, r.N)
+	copy(lanes, r.ctlLanes)
+	r.sessionLock.Unlock()
+	for rid, reader := range readers {
+		if int32(rid) == r.Id || reader == nil {
+			continue
+		}
+		r.startReplicaListener(rid, reader)
+		if lanes[rid] != nil {
+			r.startControlLaneListener(rid, lanes[rid])
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package genericsmr
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/glycerine/qlease/state"
+)
+
+// Access is the set of operations a client identity may perform on a key range.
+type Access uint8
+
+const (
+	ACCESS_READ Access = 1 << iota
+	ACCESS_WRITE
+)
+
+const ACCESS_NONE = Access(0)
+const ACCESS_ALL = ACCESS_READ | ACCESS_WRITE
+
+// rules registered under ANY_IDENTITY apply to every client, authenticated or not
+const ANY_IDENTITY = "*"
+
+type ACLRule struct {
+	Lo     state.Key // first key of the range (inclusive)
+	Hi     state.Key // last key of the range (inclusive)
+	Access Access
+}
+
+// ACL maps authenticated client identities to the key ranges they may read
+// or write. Unauthenticated clients have the empty identity "".
+// A nil *ACL permits everything.
+type ACL struct {
+	lock  *sync.RWMutex
+	rules map[string][]ACLRule
+}
+
+// Authenticator verifies the token presented by a client claiming an identity.
+// A replica without an Authenticator trusts identities as claimed.
+type Authenticator func(identity string, token []byte) bool
+
+func NewACL() *ACL {
+	return &ACL{new(sync.RWMutex), make(map[string][]ACLRule)}
+}
+
+func (acl *ACL) Allow(identity string, lo state.Key, hi state.Key, access Access) {
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+	acl.rules[identity] = append(acl.rules[identity], ACLRule{lo, hi, access})
+}
+
+func (acl *ACL) Revoke(identity string) {
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+	delete(acl.rules, identity)
+}
+
+// the access an identity has been granted on a key, across all matching rules
+func (acl *ACL) AccessFor(identity string, key state.Key) Access {
+	if acl == nil {
+		return ACCESS_ALL
+	}
+	acl.lock.RLock()
+	defer acl.lock.RUnlock()
+	access := ACCESS_NONE
+	for _, id := range [2]string{identity, ANY_IDENTITY} {
+		for _, rule := range acl.rules[id] {
+			if rule.Lo <= key && key <= rule.Hi {
+				access |= rule.Access
+			}
+		}
+	}
+	return access
+}
+
+func (acl *ACL) Permits(identity string, cmd *state.Command) bool {
+	if acl == nil || cmd.Op == state.NONE {
+		return true
+	}
+	need := ACCESS_WRITE
+	if state.IsRead(cmd) {
+		need = ACCESS_READ
+	} else if cmd.Op == state.CPUT {
+		// a failed CPUT returns the current value
+		need = ACCESS_ALL
+	}
+	return acl.AccessFor(identity, cmd.K)&need == need
+}
+
+// ReadACL parses an ACL from lines of the form
+//
+//	identity lo hi access
+//
+// where access is one of "r", "w" or "rw". Blank lines and lines starting
+// with '#' are ignored.
+func ReadACL(rd io.Reader) (*ACL, error) {
+	acl := NewACL()
+	scanner := bufio.NewScanner(rd)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var identity, rights string
+		var lo, hi int64
+		if _, err := fmt.Sscan(line, &identity, &lo, &hi, &rights); err != nil {
+			return nil, fmt.Errorf("acl line %d: %v", lineNo, err)
+		}
+		access := ACCESS_NONE
+		for _, c := range rights {
+			switch c {
+			case 'r':
+				access |= ACCESS_READ
+			case 'w':
+				access |= ACCESS_WRITE
+			default:
+				return nil, fmt.Errorf("acl line %d: unknown access %q", lineNo, rights)
+			}
+		}
+		acl.Allow(identity, state.Key(lo), state.Key(hi), access)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// ReadTokens parses the tokens of client identities from lines of the form
+//
+//	identity token
+//
+// and returns an Authenticator that accepts an identity only with its token.
+// Blank lines and lines starting with '#' are ignored.
+func ReadTokens(rd io.Reader) (Authenticator, error) {
+	tokens := make(map[string][]byte)
+	scanner := bufio.NewScanner(rd)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("tokens line %d: want an identity and a token", lineNo)
+		}
+		tokens[fields[0]] = []byte(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return func(identity string, token []byte) bool {
+		want, present := tokens[identity]
+		return present && subtle.ConstantTimeCompare(want, token) == 1
+	}, nil
+}
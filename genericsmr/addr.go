@@ -0,0 +1,78 @@
+package genericsmr
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// A replica's peer address is the one it advertises to its peers and clients
+// (a routable name or IP); the address it listens on may differ (see
+// WithListenAddr), e.g. to bind every interface of a container.
+
+// NormalizePeerAddr checks that addr is a host:port pair, with IPv6 literals
+// in brackets, and returns it in canonical form: IP literals are written the
+// way net.IP prints them (so that "[::ffff:10.0.0.1]:7070" and
+// "10.0.0.1:7070" are the same peer), host names are lowercased. An empty
+// host, meaning the local machine, is allowed.
+func NormalizePeerAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "[") {
+			return "", fmt.Errorf("peer address %q: IPv6 addresses must be written as [host]:port", addr)
+		}
+		return "", fmt.Errorf("peer address %q: %v", addr, err)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return "", fmt.Errorf("peer address %q: bad port %q", addr, port)
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		// keep the zone of link-local addresses as it is
+		if ip := net.ParseIP(host[:i]); ip != nil {
+			host = ip.String() + host[i:]
+		}
+	} else if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else {
+		host = strings.ToLower(host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// NormalizePeerAddrList normalizes every address of a peer list and checks
+// that no two replicas have the same one.
+func NormalizePeerAddrList(addrs []string) ([]string, error) {
+	norm := make([]string, len(addrs))
+	seen := make(map[string]int, len(addrs))
+	for i, a := range addrs {
+		var err error
+		if norm[i], err = NormalizePeerAddr(a); err != nil {
+			return nil, err
+		}
+		if j, dup := seen[norm[i]]; dup {
+			return nil, fmt.Errorf("replicas %d and %d have the same address %s", j, i, norm[i])
+		}
+		seen[norm[i]] = i
+	}
+	return norm, nil
+}
+
+// ListenAddr returns the address to bind for a replica advertising
+// advertised: listenHost (e.g., "0.0.0.0", "::" or "" for every interface)
+// with the advertised port.
+func ListenAddr(listenHost string, advertised string) (string, error) {
+	_, port, err := net.SplitHostPort(advertised)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(strings.Trim(listenHost, "[]"), port), nil
+}
+
+// the address to bind for the replica's port
+func (r *Replica) listenAddr() string {
+	if r.cfg.ListenAddr != "" {
+		return r.cfg.ListenAddr
+	}
+	return r.PeerAddr(r.Id)
+}
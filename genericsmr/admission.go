@@ -0,0 +1,106 @@
+package genericsmr
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Under overload, proposals arrive faster than the log can commit and
+// execute them, and without a bound they pile up in the protocol's instance
+// space and in ProposeChan, growing memory and the latency of every command
+// behind them. Admission control bounds the commit backlog, the instances
+// this replica has proposed but not yet executed: protocols report the
+// instances they propose with InstanceProposed, and those they execute with
+// StateExecuted. While the backlog is PARAM_MAX_COMMIT_BACKLOG instances or
+// more, a client proposal is answered ERR_OVERLOADED, so that the client
+// backs off (ADMIT_REJECT), or the client connection is paused, not read
+// from, until the backlog drains below the limit, which pushes back on the
+// client through TCP (ADMIT_PAUSE). Replicas that forward their proposals to
+// a leader propose no instances, and admit every proposal; the leader's
+// backlog bounds them.
+type AdmissionPolicy uint32
+
+const (
+	ADMIT_REJECT AdmissionPolicy = iota // answer ERR_OVERLOADED
+	ADMIT_PAUSE                         // stop reading from the client until the backlog drains
+)
+
+var admissionPolicyNames = []string{"reject", "pause"}
+
+func (p AdmissionPolicy) String() string {
+	if int(p) < len(admissionPolicyNames) {
+		return admissionPolicyNames[p]
+	}
+	return fmt.Sprintf("AdmissionPolicy(%d)", uint32(p))
+}
+
+// ParseAdmissionPolicy parses the name of a policy ("reject" or "pause").
+func ParseAdmissionPolicy(name string) (AdmissionPolicy, error) {
+	for i, n := range admissionPolicyNames {
+		if n == name {
+			return AdmissionPolicy(i), nil
+		}
+	}
+	return ADMIT_REJECT, fmt.Errorf("unknown admission policy %q", name)
+}
+
+// how often a paused client connection checks the backlog again
+const ADMISSION_POLL_NS = 1000 * 1000
+
+type admission struct {
+	proposed int32  // the highest instance proposed (-1 before the first)
+	executed int32  // every instance up to this one was executed (-1 before the first)
+	rejected uint64 // proposals answered ERR_OVERLOADED for the backlog
+	paused   uint64 // times a client connection was paused
+}
+
+func newAdmission() *admission {
+	return &admission{proposed: -1, executed: -1}
+}
+
+// InstanceProposed tells admission control that the replica has proposed
+// inst.
+func (r *Replica) InstanceProposed(inst int32) {
+	a := r.admission
+	for {
+		old := atomic.LoadInt32(&a.proposed)
+		if inst <= old || atomic.CompareAndSwapInt32(&a.proposed, old, inst) {
+			return
+		}
+	}
+}
+
+// CommitBacklog returns the number of instances the replica has proposed but
+// not yet executed.
+func (r *Replica) CommitBacklog() int64 {
+	a := r.admission
+	if backlog := int64(atomic.LoadInt32(&a.proposed)) - int64(atomic.LoadInt32(&a.executed)); backlog > 0 {
+		return backlog
+	}
+	return 0
+}
+
+// the backlog is at the limit
+func (r *Replica) overBacklog() bool {
+	max := r.Param(PARAM_MAX_COMMIT_BACKLOG)
+	return max > 0 && r.CommitBacklog() >= max
+}
+
+// admitProposal reports whether a client proposal may go to the protocol,
+// pausing the connection first under ADMIT_PAUSE. With priority scheduling,
+// the proposal waits in its queue instead (see priority.go).
+func (r *Replica) admitProposal() bool {
+	if r.priorities != nil || !r.overBacklog() {
+		return true
+	}
+	if r.cfg.Admission != ADMIT_PAUSE {
+		atomic.AddUint64(&r.admission.rejected, 1)
+		return false
+	}
+	atomic.AddUint64(&r.admission.paused, 1)
+	for r.overBacklog() && !r.Shutdown {
+		time.Sleep(ADMISSION_POLL_NS)
+	}
+	return true
+}
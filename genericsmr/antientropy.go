@@ -0,0 +1,524 @@
+package genericsmr
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/state"
+)
+
+// Replicas that execute the same log must end up with the same state, but a
+// bug or a corrupt disk can make one silently diverge, and nothing would
+// notice until a client read the wrong value. With PARAM_ANTI_ENTROPY_NS set,
+// replicas whose protocol executes commands with ExecuteCommand (or
+// ExecuteBatch) and reports executed instances with StateExecuted (protocols with a single log, such
+// as Paxos or Mencius) look for divergence in the background.
+//
+// Every replica keeps a digest of its state, computed from the state when
+// anti-entropy starts (e.g., as restored from disk) and updated with each
+// write: a two-level Merkle tree whose ANTI_ENTROPY_LEAVES leaves each
+// combine the hashes of the keys (and their values) that hash to them, and
+// whose ANTI_ENTROPY_FANOUT nodes each hash ANTI_ENTROPY_FANOUT leaves. It
+// copies the leaves whenever it has executed a multiple of
+// ANTI_ENTROPY_CHECKPOINT_INSTANCES instances, so that replicas compare
+// their states at the same point of the log. Every period, a replica sends
+// the nodes of its latest digest to its peers; a peer that took a digest at
+// the same instance answers with its leaves under the nodes that differ. For
+// the leaves found to differ, the replica asks every replica to list its
+// keys once it reaches a later checkpoint, and for each key whose values
+// differ, writes the value that a majority of the replicas held through the
+// normal SMR path, so that every replica executes the repair in the same
+// order as any other write. A key written since that checkpoint, or with a
+// write in flight, needs no repair: the write overwrites it on every
+// replica. A repair is an ordinary write, ordered like any other: a client
+// write to the key that the repairing replica has not seen yet may come
+// before it. Keys that a majority does not have, or on which no majority
+// agrees, are only logged.
+
+const (
+	ANTI_ENTROPY_FANOUT               = 32 // nodes under the root, and leaves under each node
+	ANTI_ENTROPY_LEAVES               = ANTI_ENTROPY_FANOUT * ANTI_ENTROPY_FANOUT
+	ANTI_ENTROPY_CHECKPOINT_INSTANCES = 1000 // the state is digested every this many instances
+	ANTI_ENTROPY_CHECKPOINTS          = 8    // digests kept for peers to compare theirs with
+	ANTI_ENTROPY_REPLY_TIMEOUT        = time.Second
+	ANTI_ENTROPY_KEYS_TIMEOUT         = 30 * time.Second // how long to wait for the replicas to list their keys
+	ANTI_ENTROPY_CHAN_SIZE            = 100
+)
+
+// AntiEntropyStats count what anti-entropy found and did.
+type AntiEntropyStats struct {
+	Rounds        uint64 // comparisons with the peers
+	Divergences   uint64 // peers found to diverge, per round
+	Repairs       uint64 // keys written to repair them
+	Unrepairables uint64 // divergent keys no majority agreed on
+}
+
+type stateCheckpoint struct {
+	inst   int32
+	leaves []uint64
+}
+
+// a key listing requested from the replica
+type stateListing struct {
+	req   *genericsmrproto.StateKeys
+	since time.Time
+}
+
+type antiEntropy struct {
+	leaves []uint64 // the digest of the state (nil while off); owned by the executing goroutine
+
+	lock        sync.Mutex
+	executed    int32 // every instance up to this one was executed (-1 before the first)
+	checkpoints []stateCheckpoint
+	listings    map[int32][]stateListing // by instance
+	watched     map[int]bool             // leaves whose keys written are noted in written
+	written     map[state.Key]bool
+
+	digestReplies chan *genericsmrproto.StateDigestReply
+	keysReplies   chan *genericsmrproto.StateKeysReply
+
+	stats AntiEntropyStats // accessed atomically
+}
+
+func newAntiEntropy() *antiEntropy {
+	return &antiEntropy{
+		executed:      -1,
+		listings:      make(map[int32][]stateListing),
+		digestReplies: make(chan *genericsmrproto.StateDigestReply, ANTI_ENTROPY_CHAN_SIZE),
+		keysReplies:   make(chan *genericsmrproto.StateKeysReply, ANTI_ENTROPY_CHAN_SIZE),
+	}
+}
+
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func leafOf(k state.Key) int {
+	return int(mix64(uint64(k)) % ANTI_ENTROPY_LEAVES)
+}
+
+func entryHash(k state.Key, v state.Value) uint64 {
+	return mix64(uint64(k)*0x9e3779b97f4a7c15 + mix64(uint64(v)))
+}
+
+// the nodes under the root of a digest with the given leaves
+func digestNodes(leaves []uint64) []uint64 {
+	nodes := make([]uint64, ANTI_ENTROPY_FANOUT)
+	for i := range nodes {
+		h := uint64(i)
+		for _, l := range leaves[i*ANTI_ENTROPY_FANOUT : (i+1)*ANTI_ENTROPY_FANOUT] {
+			h = mix64(h ^ l)
+		}
+		nodes[i] = h
+	}
+	return nodes
+}
+
+// ExecuteCommand executes cmd on the replica's state, keeping the digest of
+// the state current for anti-entropy, and returns its result with the version
+// of its key (see state.Command.Apply). Protocols must execute committed commands
+// with it, on one goroutine, for anti-entropy and apply notifications (see
+// applynotify.go) to work.
+func (r *Replica) ExecuteCommand(cmd *state.Command) state.Entry {
+	r.beginCut()
+	ae := r.antiEntropy
+	if !state.IsWrite(cmd) || ae.leaves == nil {
+		e := cmd.Apply(r.State)
+		r.appliedCommand(cmd, e.Value)
+		return e
+	}
+	old, present := r.State.Get(cmd.K)
+	e := cmd.Apply(r.State)
+	if cmd.Op == state.CPUT && r.State.CPUTFailed {
+		r.appliedCommand(cmd, e.Value)
+		return e
+	}
+	leaf := leafOf(cmd.K)
+	if present {
+		ae.leaves[leaf] ^= entryHash(cmd.K, old)
+	}
+	ae.leaves[leaf] ^= entryHash(cmd.K, e.Value)
+	ae.lock.Lock()
+	if ae.watched[leaf] {
+		ae.written[cmd.K] = true
+	}
+	ae.lock.Unlock()
+	r.appliedCommand(cmd, e.Value)
+	return e
+}
+
+// ExecuteBatch executes cmds, committed together, as ExecuteCommand does one
+// at a time, calling reply (unless nil) with the index and result of each in
+// order. The batch goes to the state at once (see state.ApplyBatch), unless
+// anti-entropy keeps the digest of the state, or a conditional write must be
+// answered before the next command executes (see conditional.go): then it is
+// executed command by command, each replied to in turn.
+func (r *Replica) ExecuteBatch(cmds []state.Command, reply func(j int, e state.Entry)) {
+	if r.antiEntropy.leaves != nil || hasConditional(cmds) {
+		for j := range cmds {
+			e := r.ExecuteCommand(&cmds[j])
+			if reply != nil {
+				reply(j, e)
+			}
+		}
+		return
+	}
+	r.beginCut()
+	r.execResults = r.State.ApplyBatch(cmds, r.execResults[:0])
+	for j := range cmds {
+		r.appliedCommand(&cmds[j], r.execResults[j].Value)
+		if reply != nil {
+			reply(j, r.execResults[j])
+		}
+	}
+}
+
+func hasConditional(cmds []state.Command) bool {
+	for i := range cmds {
+		if cmds[i].Op == state.CPUT {
+			return true
+		}
+	}
+	return false
+}
+
+// StateExecuted tells anti-entropy, admission control and apply notifications
+// that the replica has executed every instance up to inst, which protocols
+// must report, in order, from the same goroutine as ExecuteCommand.
+func (r *Replica) StateExecuted(inst int32) {
+	atomic.StoreInt32(&r.admission.executed, inst)
+	r.notifyApplied(inst)
+	r.beginCut()
+	defer r.endCut()
+	ae := r.antiEntropy
+	if r.Param(PARAM_ANTI_ENTROPY_NS) <= 0 {
+		if ae.leaves != nil {
+			ae.leaves = nil
+			ae.lock.Lock()
+			ae.checkpoints = nil
+			ae.lock.Unlock()
+		}
+		ae.lock.Lock()
+		ae.executed = inst
+		ae.lock.Unlock()
+		return
+	}
+	if ae.leaves == nil {
+		ae.leaves = make([]uint64, ANTI_ENTROPY_LEAVES)
+		r.State.Range(func(k state.Key, v state.Value) bool {
+			ae.leaves[leafOf(k)] ^= entryHash(k, v)
+			return true
+		})
+	}
+	ae.lock.Lock()
+	ae.executed = inst
+	if inst%ANTI_ENTROPY_CHECKPOINT_INSTANCES == 0 {
+		cp := stateCheckpoint{inst, append([]uint64(nil), ae.leaves...)}
+		if len(ae.checkpoints) == ANTI_ENTROPY_CHECKPOINTS {
+			ae.checkpoints = append(ae.checkpoints[:0], ae.checkpoints[1:]...)
+		}
+		ae.checkpoints = append(ae.checkpoints, cp)
+	}
+	var due []stateListing
+	for i, ls := range ae.listings {
+		if i <= inst {
+			if i == inst {
+				due = ls
+			}
+			delete(ae.listings, i)
+		}
+	}
+	for _, l := range due {
+		if l.req.ReplicaId == r.Id {
+			ae.watched = make(map[int]bool, len(l.req.Leaves))
+			ae.written = make(map[state.Key]bool)
+			for _, leaf := range l.req.Leaves {
+				ae.watched[int(leaf)] = true
+			}
+		}
+	}
+	ae.lock.Unlock()
+	if len(due) > 0 {
+		// listed from a snapshot, while execution goes on
+		go r.listKeys(inst, due, r.State.Snapshot())
+	}
+}
+
+// answer the key listings requested at inst, from a snapshot of the state
+// taken there
+func (r *Replica) listKeys(inst int32, due []stateListing, snap *state.Snapshot) {
+	wanted := make(map[int]bool)
+	for _, l := range due {
+		for _, leaf := range l.req.Leaves {
+			wanted[int(leaf)] = true
+		}
+	}
+	byLeaf := make(map[int][]state.Key)
+	snap.Range(func(k state.Key, v state.Value) bool {
+		if leaf := leafOf(k); wanted[leaf] {
+			byLeaf[leaf] = append(byLeaf[leaf], k)
+		}
+		return true
+	})
+	for _, l := range due {
+		reply := &genericsmrproto.StateKeysReply{ReplicaId: r.Id, Inst: inst, Found: TRUE}
+		for _, leaf := range l.req.Leaves {
+			for _, k := range byLeaf[int(leaf)] {
+				reply.Keys = append(reply.Keys, k)
+				v, _ := snap.Get(k)
+				reply.Values = append(reply.Values, v)
+			}
+		}
+		r.sendKeysReply(l.req.ReplicaId, reply)
+	}
+}
+
+func (r *Replica) sendKeysReply(to int32, reply *genericsmrproto.StateKeysReply) {
+	if to == r.Id {
+		r.handleStateKeysReply(reply)
+		return
+	}
+	go r.SendBackgroundMsg(to, r.stateKeysReplyRPC, reply)
+}
+
+func (r *Replica) handleStateDigest(d *genericsmrproto.StateDigest) {
+	ae := r.antiEntropy
+	reply := &genericsmrproto.StateDigestReply{ReplicaId: r.Id, Inst: d.Inst, Found: FALSE}
+	ae.lock.Lock()
+	reply.Executed = ae.executed
+	for _, cp := range ae.checkpoints {
+		if cp.inst != d.Inst || len(d.Nodes) != ANTI_ENTROPY_FANOUT {
+			continue
+		}
+		reply.Found = TRUE
+		for i, n := range digestNodes(cp.leaves) {
+			if n != d.Nodes[i] {
+				reply.Subtrees = append(reply.Subtrees, int32(i))
+				reply.Leaves = append(reply.Leaves, cp.leaves[i*ANTI_ENTROPY_FANOUT:(i+1)*ANTI_ENTROPY_FANOUT]...)
+			}
+		}
+	}
+	ae.lock.Unlock()
+	r.SendBackgroundMsg(d.ReplicaId, r.stateDigestReplyRPC, reply)
+}
+
+func (r *Replica) handleStateKeys(req *genericsmrproto.StateKeys) {
+	ae := r.antiEntropy
+	ae.lock.Lock()
+	if req.Inst <= ae.executed {
+		ae.lock.Unlock()
+		r.sendKeysReply(req.ReplicaId, &genericsmrproto.StateKeysReply{ReplicaId: r.Id, Inst: req.Inst, Found: FALSE})
+		return
+	}
+	now := time.Now()
+	for i, ls := range ae.listings {
+		if now.Sub(ls[0].since) > ANTI_ENTROPY_KEYS_TIMEOUT {
+			delete(ae.listings, i)
+		}
+	}
+	ae.listings[req.Inst] = append(ae.listings[req.Inst], stateListing{req, now})
+	ae.lock.Unlock()
+}
+
+func (r *Replica) handleStateDigestReply(reply *genericsmrproto.StateDigestReply) {
+	select {
+	case r.antiEntropy.digestReplies <- reply:
+	default:
+	}
+}
+
+func (r *Replica) handleStateKeysReply(reply *genericsmrproto.StateKeysReply) {
+	select {
+	case r.antiEntropy.keysReplies <- reply:
+	default:
+	}
+}
+
+// AntiEntropyStats returns what anti-entropy has found and done so far.
+func (r *Replica) AntiEntropyStats() AntiEntropyStats {
+	st := &r.antiEntropy.stats
+	return AntiEntropyStats{
+		Rounds:        atomic.LoadUint64(&st.Rounds),
+		Divergences:   atomic.LoadUint64(&st.Divergences),
+		Repairs:       atomic.LoadUint64(&st.Repairs),
+		Unrepairables: atomic.LoadUint64(&st.Unrepairables),
+	}
+}
+
+// compare the replica's state with its peers' every PARAM_ANTI_ENTROPY_NS
+func (r *Replica) runAntiEntropy() {
+	for !r.Shutdown {
+		period := r.Param(PARAM_ANTI_ENTROPY_NS)
+		if period <= 0 {
+			time.Sleep(time.Second)
+			continue
+		}
+		time.Sleep(time.Duration(period))
+		r.antiEntropyRound()
+	}
+}
+
+func (r *Replica) antiEntropyRound() {
+	ae := r.antiEntropy
+	ae.lock.Lock()
+	if len(ae.checkpoints) == 0 {
+		ae.lock.Unlock()
+		return
+	}
+	cp := ae.checkpoints[len(ae.checkpoints)-1]
+	executed := ae.executed
+	ae.lock.Unlock()
+	d := &genericsmrproto.StateDigest{ReplicaId: r.Id, Inst: cp.inst, Nodes: digestNodes(cp.leaves)}
+	peers := 0
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id && r.PeerAlive(q) && r.SendBackgroundMsg(q, r.stateDigestRPC, d) == nil {
+			peers++
+		}
+	}
+	if peers == 0 {
+		return
+	}
+	atomic.AddUint64(&ae.stats.Rounds, 1)
+	diverged := make(map[int32]bool)
+	timeout := time.After(ANTI_ENTROPY_REPLY_TIMEOUT)
+	for got := 0; got < peers; {
+		var reply *genericsmrproto.StateDigestReply
+		select {
+		case reply = <-ae.digestReplies:
+		case <-timeout:
+			got = peers
+			continue
+		}
+		if reply.Inst != cp.inst {
+			continue
+		}
+		got++
+		if reply.Executed > executed {
+			executed = reply.Executed
+		}
+		n := 0
+		for i, node := range reply.Subtrees {
+			if node < 0 || node >= ANTI_ENTROPY_FANOUT || len(reply.Leaves) < (i+1)*ANTI_ENTROPY_FANOUT {
+				break
+			}
+			for j := 0; j < ANTI_ENTROPY_FANOUT; j++ {
+				leaf := int(node)*ANTI_ENTROPY_FANOUT + j
+				if reply.Leaves[i*ANTI_ENTROPY_FANOUT+j] != cp.leaves[leaf] {
+					diverged[int32(leaf)] = true
+					n++
+				}
+			}
+		}
+		if n > 0 {
+			log.Printf("Replica %d: state diverges from replica %d's at instance %d, in %d leaves\n", r.Id, reply.ReplicaId, cp.inst, n)
+			atomic.AddUint64(&ae.stats.Divergences, 1)
+		}
+	}
+	if len(diverged) > 0 {
+		leaves := make([]int32, 0, len(diverged))
+		for leaf := range diverged {
+			leaves = append(leaves, leaf)
+		}
+		sort.Slice(leaves, func(i, j int) bool { return leaves[i] < leaves[j] })
+		r.repairLeaves(leaves, executed)
+	}
+}
+
+// list the keys of leaves at a checkpoint that no replica has reached yet,
+// and repair those whose values differ
+func (r *Replica) repairLeaves(leaves []int32, executed int32) {
+	ae := r.antiEntropy
+	inst := (executed/ANTI_ENTROPY_CHECKPOINT_INSTANCES + 2) * ANTI_ENTROPY_CHECKPOINT_INSTANCES
+	req := &genericsmrproto.StateKeys{ReplicaId: r.Id, Inst: inst, Leaves: leaves}
+	defer func() {
+		ae.lock.Lock()
+		ae.watched, ae.written = nil, nil
+		ae.lock.Unlock()
+	}()
+	r.handleStateKeys(req)
+	asked := 1
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id && r.PeerAlive(q) && r.SendBackgroundMsg(q, r.stateKeysRPC, req) == nil {
+			asked++
+		}
+	}
+	listings := make(map[int32]*genericsmrproto.StateKeysReply)
+	answered := make(map[int32]bool)
+	timeout := time.After(ANTI_ENTROPY_KEYS_TIMEOUT)
+wait:
+	for len(answered) < asked {
+		select {
+		case reply := <-ae.keysReplies:
+			if reply.Inst != inst {
+				continue
+			}
+			answered[reply.ReplicaId] = true
+			if reply.Found == TRUE && len(reply.Keys) == len(reply.Values) {
+				listings[reply.ReplicaId] = reply
+			}
+		case <-timeout:
+			break wait
+		}
+	}
+	if listings[r.Id] == nil || len(listings) <= r.N/2 {
+		log.Printf("Replica %d: too few replicas listed their keys at instance %d to repair them\n", r.Id, inst)
+		return
+	}
+	type entry struct {
+		present bool
+		value   state.Value
+	}
+	values := make(map[state.Key]map[int32]entry)
+	for q, l := range listings {
+		for i, k := range l.Keys {
+			if values[k] == nil {
+				values[k] = make(map[int32]entry)
+			}
+			values[k][q] = entry{true, l.Values[i]}
+		}
+	}
+	for k, held := range values {
+		counts := make(map[entry]int)
+		for q := range listings {
+			counts[held[q]]++
+		}
+		if len(counts) == 1 {
+			continue
+		}
+		ae.lock.Lock()
+		written := ae.written[k]
+		ae.lock.Unlock()
+		if written || r.IsUpdating(k) {
+			continue
+		}
+		var majority *entry
+		for e, n := range counts {
+			if n > r.N/2 {
+				e := e
+				majority = &e
+			}
+		}
+		if majority == nil || !majority.present {
+			log.Printf("Replica %d: cannot repair key %d, on which the replicas diverge at instance %d\n", r.Id, k, inst)
+			atomic.AddUint64(&ae.stats.Unrepairables, 1)
+			continue
+		}
+		log.Printf("Replica %d: repairing key %d to %d, its value at instance %d on a majority of replicas\n", r.Id, k, majority.value, inst)
+		atomic.AddUint64(&ae.stats.Repairs, 1)
+		prop := &genericsmrproto.Propose{
+			CommandId: -1,
+			Command:   state.Command{Op: state.PUT, K: k, V: majority.value},
+			Timestamp: time.Now().UnixNano(),
+		}
+		r.ProposeChan <- &Propose{prop, -1, -1, nil, nil, nil, 0, 0, 0, 0, 0}
+	}
+}
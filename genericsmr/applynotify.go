@@ -0,0 +1,85 @@
+package genericsmr
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/glycerine/qlease/state"
+)
+
+// Applications embedding a replica may keep structures derived from its
+// state (indexes, caches) outside the state package by having the replica
+// tell them about every command it executes, with its result: ApplyFuncs
+// (see WithApplyNotify and OnApply) are called, or Applied values sent to
+// the channels of ApplyChan, once the whole instance has executed, in the
+// order the commands were executed, on the protocol's execution goroutine,
+// so they hold up execution for as long as they take (and a channel for as
+// long as it is full). The notifications come from ExecuteCommand (or
+// ExecuteBatch) and StateExecuted, so protocols that execute without them (EPaxos) send none;
+// nor is there one for the state a replica restores from a snapshot or a
+// backup.
+
+// An Applied is a command the replica executed, and its result.
+type Applied struct {
+	Instance int32
+	Command  state.Command
+	Result   state.Value
+}
+
+// An ApplyFunc is told about a command the replica executed.
+type ApplyFunc func(inst int32, cmd *state.Command, result state.Value)
+
+type applyNotify struct {
+	lock  sync.Mutex   // serializes OnApply
+	funcs atomic.Value // []ApplyFunc
+	batch []Applied    // the commands of the instance being executed
+}
+
+func newApplyNotify(funcs []ApplyFunc) *applyNotify {
+	an := new(applyNotify)
+	an.funcs.Store(append([]ApplyFunc(nil), funcs...))
+	return an
+}
+
+// OnApply has f called with every command the replica executes from now on.
+func (r *Replica) OnApply(f ApplyFunc) {
+	an := r.applyNotify
+	an.lock.Lock()
+	defer an.lock.Unlock()
+	funcs := an.funcs.Load().([]ApplyFunc)
+	an.funcs.Store(append(funcs[:len(funcs):len(funcs)], f))
+}
+
+// ApplyChan returns a channel, of the given capacity, that receives every
+// command the replica executes from now on.
+func (r *Replica) ApplyChan(size int) <-chan Applied {
+	c := make(chan Applied, size)
+	r.OnApply(func(inst int32, cmd *state.Command, result state.Value) {
+		c <- Applied{inst, *cmd, result}
+	})
+	return c
+}
+
+// remember that cmd was executed, to notify of it with its instance
+func (r *Replica) appliedCommand(cmd *state.Command, result state.Value) {
+	an := r.applyNotify
+	if len(an.funcs.Load().([]ApplyFunc)) > 0 {
+		an.batch = append(an.batch, Applied{Command: *cmd, Result: result})
+	}
+}
+
+// notify of the commands of instance inst, now executed
+func (r *Replica) notifyApplied(inst int32) {
+	an := r.applyNotify
+	if len(an.batch) == 0 {
+		return
+	}
+	funcs := an.funcs.Load().([]ApplyFunc)
+	for i := range an.batch {
+		a := &an.batch[i]
+		for _, f := range funcs {
+			f(inst, &a.Command, a.Result)
+		}
+	}
+	an.batch = an.batch[:0]
+}
@@ -0,0 +1,213 @@
+package genericsmr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// A replica can keep an audit log (see WithAuditLog): an append-only stream,
+// separate from the protocol's log and stable store, of the operations an
+// operator may have to account for after an incident or for compliance:
+// changes of runtime parameters, switches to a new lease configuration,
+// replicas leaving or rejoining the lease quorums, leader changes, and admin
+// RPCs. Each event is a line of JSON (a genericsmrproto.AuditEvent), written
+// and synced before the replica goes on. The latest AUDIT_TAIL_EVENTS events
+// are also kept in memory, including those found in the file at startup, for
+// Tail and the AuditTail admin RPC (e.g., `bin/client -audit <id>`). The
+// groups of a process share one log; events name their group.
+
+// kinds of audit events
+const (
+	AUDIT_PARAM        = "param"        // a runtime parameter changed
+	AUDIT_LEASE_CONFIG = "lease-config" // the replica switched to a new lease configuration
+	AUDIT_MEMBERSHIP   = "membership"   // the replica proposed to remove replicas from, or return them to, the lease quorums
+	AUDIT_LEADER       = "leader"       // the replica became the leader, or learned of a new one
+	AUDIT_ADMIN        = "admin"        // an admin RPC was called
+)
+
+var ErrNoAuditLog = errors.New("the replica keeps no audit log")
+
+// how many of the latest events an AuditLog keeps in memory
+const AUDIT_TAIL_EVENTS = 4096
+
+type AuditLog struct {
+	lock    sync.Mutex
+	file    *os.File // nil to keep events in memory only
+	seq     uint64
+	tail    []genericsmrproto.AuditEvent // the latest events, oldest first
+	arrived *sync.Cond
+}
+
+// OpenAuditLog opens the audit log at path, appending to it if it exists
+// (path "" keeps the events in memory only). An incomplete event at the end
+// of the file, left by a crash, is discarded.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{}
+	a.arrived = sync.NewCond(&a.lock)
+	if path == "" {
+		return a, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	end, err := a.load(f)
+	if err == nil {
+		err = f.Truncate(end)
+	}
+	if err == nil {
+		_, err = f.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("audit log %s: %v", path, err)
+	}
+	a.file = f
+	return a, nil
+}
+
+// read the events already in f, and return where the last complete one ends
+func (a *AuditLog) load(f *os.File) (int64, error) {
+	r := bufio.NewReader(f)
+	var end int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return end, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		var ev genericsmrproto.AuditEvent
+		if err := json.Unmarshal(bytes.TrimSpace(line), &ev); err != nil {
+			return 0, fmt.Errorf("event after sequence number %d: %v", a.seq, err)
+		}
+		end += int64(len(line))
+		a.remember(ev)
+	}
+}
+
+// the caller holds the lock, or owns a
+func (a *AuditLog) remember(ev genericsmrproto.AuditEvent) {
+	a.seq = ev.Seq
+	if len(a.tail) == AUDIT_TAIL_EVENTS {
+		copy(a.tail, a.tail[1:])
+		a.tail = a.tail[:len(a.tail)-1]
+	}
+	a.tail = append(a.tail, ev)
+}
+
+// Record appends an event of kind to the log, and returns its sequence
+// number.
+func (a *AuditLog) Record(replica int32, group uint16, kind string, detail string) (uint64, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	ev := genericsmrproto.AuditEvent{
+		Seq:       a.seq + 1,
+		TimeNs:    time.Now().UnixNano(),
+		ReplicaId: replica,
+		GroupId:   group,
+		Kind:      kind,
+		Detail:    detail,
+	}
+	if a.file != nil {
+		line, err := json.Marshal(&ev)
+		if err != nil {
+			return 0, err
+		}
+		if _, err = a.file.Write(append(line, '\n')); err != nil {
+			return 0, err
+		}
+		if err = a.file.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	a.remember(ev)
+	a.arrived.Broadcast()
+	return ev.Seq, nil
+}
+
+// Tail returns up to max (0 for no limit) of the remembered events that
+// follow sequence number after, waiting up to wait for one if there are
+// none yet, and the sequence number of the earliest event remembered (0 if
+// none).
+func (a *AuditLog) Tail(after uint64, max int, wait time.Duration) ([]genericsmrproto.AuditEvent, uint64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.seq <= after && wait > 0 {
+		timedOut := false
+		timer := time.AfterFunc(wait, func() {
+			a.lock.Lock()
+			timedOut = true
+			a.arrived.Broadcast()
+			a.lock.Unlock()
+		})
+		for a.seq <= after && !timedOut {
+			a.arrived.Wait()
+		}
+		timer.Stop()
+	}
+	if len(a.tail) == 0 {
+		return nil, 0
+	}
+	first := a.tail[0].Seq
+	i := 0
+	if after >= first {
+		i = int(after - first + 1)
+	}
+	if i > len(a.tail) {
+		i = len(a.tail)
+	}
+	events := a.tail[i:]
+	if max > 0 && len(events) > max {
+		events = events[:max]
+	}
+	return append([]genericsmrproto.AuditEvent(nil), events...), first
+}
+
+// Close closes the log's file.
+func (a *AuditLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// Audit records an event of kind in the replica's audit log, if it keeps
+// one.
+func (r *Replica) Audit(kind string, format string, args ...interface{}) {
+	a := r.cfg.AuditLog
+	if a == nil {
+		return
+	}
+	if _, err := a.Record(r.Id, r.GroupId, kind, fmt.Sprintf(format, args...)); err != nil {
+		log.Printf("Replica %d: cannot write to the audit log: %v\n", r.Id, err)
+	}
+}
+
+/* Admin RPC */
+
+// AuditTail returns the events of the replica's audit log that follow
+// args.After (see AuditLog.Tail).
+func (r *Replica) AuditTail(args *genericsmrproto.AuditTailArgs, reply *genericsmrproto.AuditTailReply) error {
+	a := r.cfg.AuditLog
+	if a == nil {
+		return ErrNoAuditLog
+	}
+	reply.Events, reply.First = a.Tail(args.After, int(args.Max), time.Duration(args.WaitNs))
+	return nil
+}
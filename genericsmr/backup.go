@@ -0,0 +1,441 @@
+package genericsmr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// A replica can back its state up off the node on a schedule (see
+// WithBackups): at the times a BackupSchedule gives, it exports a consistent
+// cut of its state (see export.go) to a temporary file, hands it to a
+// BackupUploader (a local directory, e.g. a mounted network volume, or an
+// S3-compatible object store; see s3.go), and then deletes the backups of
+// the same replica and group that the BackupRetention no longer keeps. The
+// Backup admin RPC (e.g., `bin/client -backup <id>`) takes one at once. A
+// backup is named
+//
+//	replica<id>-group<group>-<UTC time, 20060102T150405Z>-inst<instance>.qlstate
+//
+// so that a replica's backups sort by the time they were taken, and a new
+// cluster is seeded from one with `bin/server -import`. Backups are taken one
+// at a time; a scheduled backup that is due while another is being taken is
+// skipped.
+
+const BACKUP_SUFFIX = ".qlstate"
+
+const backupTimeFormat = "20060102T150405Z"
+
+var ErrNoBackups = errors.New("the replica takes no backups")
+var ErrBackupInProgress = errors.New("a backup is already in progress")
+
+// A BackupUploader stores backups off the node.
+type BackupUploader interface {
+	// Upload stores the size bytes of data under name, replacing any backup
+	// of that name; a backup is either stored whole or not at all.
+	Upload(name string, data io.ReadSeeker, size int64) error
+	// List returns the names of the stored backups that start with prefix.
+	List(prefix string) ([]string, error)
+	Delete(name string) error
+}
+
+// BackupRetention says which of a replica's backups to keep. The latest
+// backup is always kept.
+type BackupRetention struct {
+	Keep   int           // keep at most this many (0 for no limit)
+	MaxAge time.Duration // delete those older than this (0 for no limit)
+}
+
+// BackupConfig is what a replica backs up to, and when.
+type BackupConfig struct {
+	Schedule  *BackupSchedule // when to take backups (nil for only when asked)
+	Uploader  BackupUploader
+	Retention BackupRetention
+}
+
+// BackupStats count the replica's backups.
+type BackupStats struct {
+	Backups  uint64 // taken and uploaded
+	Failures uint64
+	Deleted  uint64 // deleted by the retention policy
+	Last     string // name of the latest backup uploaded
+	LastErr  string // why the latest backup that failed did
+}
+
+type backups struct {
+	cfg     *BackupConfig
+	running int32 // set while a backup is taken
+	stats   BackupStats
+	lock    sync.Mutex // protects stats
+}
+
+func newBackups(cfg *BackupConfig) *backups {
+	return &backups{cfg: cfg}
+}
+
+// the name of a backup of replica's group, at inst, taken at t
+func backupName(replica int32, group uint16, t time.Time, inst int32) string {
+	return fmt.Sprintf("%s%s-inst%d%s", backupPrefix(replica, group), t.UTC().Format(backupTimeFormat), inst, BACKUP_SUFFIX)
+}
+
+func backupPrefix(replica int32, group uint16) string {
+	return fmt.Sprintf("replica%d-group%d-", replica, group)
+}
+
+// when the backup named name was taken
+func backupTime(name string, prefix string) (time.Time, bool) {
+	rest := strings.TrimPrefix(name, prefix)
+	if len(rest) < len(backupTimeFormat) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(backupTimeFormat, rest[:len(backupTimeFormat)])
+	return t, err == nil
+}
+
+// TakeBackup takes a backup of the replica's state and uploads it, applies
+// the retention policy, and returns the backup's name and what it holds.
+func (r *Replica) TakeBackup() (string, *StateExportInfo, error) {
+	b := r.backups
+	if b == nil {
+		return "", nil, ErrNoBackups
+	}
+	if !atomic.CompareAndSwapInt32(&b.running, 0, 1) {
+		return "", nil, ErrBackupInProgress
+	}
+	defer atomic.StoreInt32(&b.running, 0)
+	name, info, err := r.exportBackup()
+	b.lock.Lock()
+	if err != nil {
+		b.stats.Failures++
+		b.stats.LastErr = err.Error()
+		b.lock.Unlock()
+		return "", nil, err
+	}
+	b.stats.Backups++
+	b.stats.Last = name
+	b.lock.Unlock()
+	r.pruneBackups(name)
+	return name, info, nil
+}
+
+func (r *Replica) exportBackup() (string, *StateExportInfo, error) {
+	f, err := os.CreateTemp("", "qlease-backup-*")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	info, err := r.Export(f)
+	if err != nil {
+		return "", nil, err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	name := backupName(r.Id, r.GroupId, time.Unix(0, info.TimeNs), info.Inst)
+	if err = r.backups.cfg.Uploader.Upload(name, f, size); err != nil {
+		return "", nil, fmt.Errorf("uploading %s: %v", name, err)
+	}
+	return name, info, nil
+}
+
+// delete the backups of the replica that the retention policy does not keep,
+// never latest
+func (r *Replica) pruneBackups(latest string) {
+	b := r.backups
+	ret := b.cfg.Retention
+	if ret.Keep <= 0 && ret.MaxAge <= 0 {
+		return
+	}
+	prefix := backupPrefix(r.Id, r.GroupId)
+	names, err := b.cfg.Uploader.List(prefix)
+	if err != nil {
+		log.Printf("Replica %d: cannot list the backups to prune: %v\n", r.Id, err)
+		return
+	}
+	var taken []string
+	for _, name := range names {
+		if strings.HasSuffix(name, BACKUP_SUFFIX) && name != latest {
+			taken = append(taken, name)
+		}
+	}
+	// newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(taken)))
+	now := time.Now()
+	for i, name := range taken {
+		// the latest counts towards Keep
+		expired := ret.Keep > 0 && i+1 >= ret.Keep
+		if t, ok := backupTime(name, prefix); ok && ret.MaxAge > 0 && now.Sub(t) > ret.MaxAge {
+			expired = true
+		}
+		if !expired {
+			continue
+		}
+		if err := b.cfg.Uploader.Delete(name); err != nil {
+			log.Printf("Replica %d: cannot delete backup %s: %v\n", r.Id, name, err)
+			continue
+		}
+		b.lock.Lock()
+		b.stats.Deleted++
+		b.lock.Unlock()
+	}
+}
+
+// take backups at the times of the schedule
+func (r *Replica) runBackups() {
+	sched := r.backups.cfg.Schedule
+	for !r.Shutdown {
+		next := sched.Next(time.Now())
+		if next.IsZero() {
+			log.Printf("Replica %d: the backup schedule has no more times\n", r.Id)
+			return
+		}
+		time.Sleep(time.Until(next))
+		if r.Shutdown {
+			return
+		}
+		name, info, err := r.TakeBackup()
+		if err != nil {
+			log.Printf("Replica %d: backup failed: %v\n", r.Id, err)
+			continue
+		}
+		log.Printf("Replica %d: backed up %d keys, as of instance %d, to %s\n", r.Id, info.Keys, info.Inst, name)
+	}
+}
+
+// BackupStats returns the replica's backup counts (zero if it takes no
+// backups).
+func (r *Replica) BackupStats() BackupStats {
+	b := r.backups
+	if b == nil {
+		return BackupStats{}
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.stats
+}
+
+/* Schedules */
+
+// A BackupSchedule gives the times to take backups at: those matching a cron
+// expression, in the local time zone, or every so often.
+type BackupSchedule struct {
+	every time.Duration // if nonzero, the schedule is every this long
+
+	minutes, hours, days, months, weekdays uint64 // bit i set if value i matches
+	anyDay, anyWeekday                     bool   // the day of the month, or of the week, was *
+}
+
+// ParseBackupSchedule parses a schedule: a cron expression of five fields
+// (minute, hour, day of the month, month, day of the week; each *, a number,
+// a range a-b, a list of those, with an optional step /n), one of @hourly,
+// @daily, @weekly or @monthly, or "@every <duration>" (e.g., @every 6h). As
+// in cron, when both days are restricted, a time matching either matches.
+func ParseBackupSchedule(spec string) (*BackupSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("backup schedule %q: %v", spec, err)
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("backup schedule %q: the period must be at least 1s", spec)
+		}
+		return &BackupSchedule{every: d}, nil
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("backup schedule %q: want 5 fields, or @every <duration>", spec)
+	}
+	s := &BackupSchedule{}
+	var err error
+	if s.minutes, err = parseCronField(fields[0], 0, 59); err == nil {
+		if s.hours, err = parseCronField(fields[1], 0, 23); err == nil {
+			if s.days, err = parseCronField(fields[2], 1, 31); err == nil {
+				if s.months, err = parseCronField(fields[3], 1, 12); err == nil {
+					s.weekdays, err = parseCronField(fields[4], 0, 7)
+				}
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("backup schedule %q: %v", spec, err)
+	}
+	// 7 is Sunday too
+	if s.weekdays&(1<<7) != 0 {
+		s.weekdays |= 1
+	}
+	s.anyDay = fields[2] == "*"
+	s.anyWeekday = fields[4] == "*"
+	return s, nil
+}
+
+// the values in [min, max] that field matches, as a bit set
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			bounds := strings.SplitN(rng, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value in %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value in %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("%q is out of range [%d, %d]", part, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// Next returns the first time of the schedule after t (zero if there is
+// none within five years, e.g. for February 30).
+func (s *BackupSchedule) Next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *BackupSchedule) dayMatches(t time.Time) bool {
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+	if s.anyDay || s.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+/* Uploaders */
+
+// A DirUploader stores backups as files in a directory (e.g., a mounted
+// network volume).
+type DirUploader struct {
+	Dir string
+}
+
+func (d *DirUploader) Upload(name string, data io.ReadSeeker, size int64) error {
+	path := filepath.Join(d.Dir, name)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, data)
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (d *DirUploader) List(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(d.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), prefix) {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d *DirUploader) Delete(name string) error {
+	return os.Remove(filepath.Join(d.Dir, name))
+}
+
+/* Admin RPC */
+
+// Backup takes a backup of the replica's state at once.
+func (r *Replica) Backup(args *genericsmrproto.BackupArgs, reply *genericsmrproto.BackupReply) error {
+	name, info, err := r.TakeBackup()
+	if err != nil {
+		r.Audit(AUDIT_ADMIN, "Backup: %v", err)
+		return err
+	}
+	r.Audit(AUDIT_ADMIN, "Backup: %d keys at instance %d, to %s", info.Keys, info.Inst, name)
+	reply.Name = name
+	reply.Inst = info.Inst
+	reply.Keys = info.Keys
+	return nil
+}
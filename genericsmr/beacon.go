@@ -0,0 +1,162 @@
+package genericsmr
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/glycerine/qlease/dlog"
+)
+
+// a peer that has been silent for this long is suspected to have failed
+const DEFAULT_BEACON_TIMEOUT_NS = 20 * 1e9
+
+// BeaconManager periodically sends beacons to every live peer, answers the
+// peers' beacons and tracks the replies, keeping the replica's Ewma latency
+// estimates (and, with a clock probe alongside every beacon, the estimates
+// of the peers' clocks; see clocks.go) up to date and serving as the input
+// of the failure detector: at
+// every round, it moves the peers it suspects to PEER_SUSPECTED, and back
+// once they answer. While it is running, beacons are handled by the manager instead of being
+// delivered on the replica's BeaconChan.
+type BeaconManager struct {
+	r *Replica
+
+	IntervalNs int64 // time between rounds of beacons (0 to follow PARAM_BEACON_INTERVAL_NS)
+	JitterNs   int64 // each round is delayed by a random amount up to this much
+	TimeoutNs  int64 // silence after which a peer is suspected
+
+	lock      *sync.Mutex
+	lastHeard []int64 // per peer, time (ns) of the latest beacon or reply received
+	stop      chan bool
+}
+
+func NewBeaconManager(r *Replica, intervalNs int64, jitterNs int64, timeoutNs int64) *BeaconManager {
+	if timeoutNs <= 0 {
+		timeoutNs = DEFAULT_BEACON_TIMEOUT_NS
+	}
+	return &BeaconManager{
+		r:          r,
+		IntervalNs: intervalNs,
+		JitterNs:   jitterNs,
+		TimeoutNs:  timeoutNs,
+		lock:       new(sync.Mutex),
+		lastHeard:  make([]int64, r.N),
+	}
+}
+
+// Start begins sending beacons; it does nothing if the manager is already running.
+func (b *BeaconManager) Start() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.stop != nil {
+		return
+	}
+	// nobody is suspected before having had the chance to answer
+	now := time.Now().UnixNano()
+	for i := range b.lastHeard {
+		b.lastHeard[i] = now
+	}
+	b.stop = make(chan bool)
+	go b.loop(b.stop)
+}
+
+// Stop stops sending beacons. Beacons received afterwards go to BeaconChan again.
+func (b *BeaconManager) Stop() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.stop == nil {
+		return
+	}
+	close(b.stop)
+	b.stop = nil
+}
+
+func (b *BeaconManager) Running() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.stop != nil
+}
+
+func (b *BeaconManager) interval() time.Duration {
+	interval := b.IntervalNs
+	if interval <= 0 {
+		interval = b.r.Param(PARAM_BEACON_INTERVAL_NS)
+	}
+	if b.JitterNs > 0 {
+		interval += rand.Int63n(b.JitterNs)
+	}
+	return time.Duration(interval)
+}
+
+func (b *BeaconManager) loop(stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(b.interval()):
+		}
+		for q := int32(0); q < int32(b.r.N); q++ {
+			if q == b.r.Id || !b.r.PeerAlive(q) {
+				continue
+			}
+			if b.Suspected(q) {
+				b.r.PeerStates.Transition(q, PEER_ALIVE, PEER_SUSPECTED)
+			} else {
+				b.r.PeerStates.Transition(q, PEER_SUSPECTED, PEER_ALIVE)
+			}
+			b.r.SendBeacon(q)
+			b.r.sendClockProbe(q)
+		}
+	}
+}
+
+// handle a peer's beacon; returns false if the manager is not running
+func (b *BeaconManager) handleBeacon(beacon *Beacon) bool {
+	if !b.Running() {
+		return false
+	}
+	b.heard(beacon.Rid)
+	b.r.ReplyBeacon(beacon)
+	return true
+}
+
+func (b *BeaconManager) handleBeaconReply(rid int32, timestamp uint64) {
+	b.lock.Lock()
+	b.lastHeard[rid] = time.Now().UnixNano()
+	b.r.Ewma[rid] = 0.99*b.r.Ewma[rid] + 0.01*float64(b.r.Clock.Nanos()-int64(timestamp))
+	dlog.Println(b.r.Ewma)
+	b.lock.Unlock()
+}
+
+func (b *BeaconManager) heard(rid int32) {
+	b.lock.Lock()
+	b.lastHeard[rid] = time.Now().UnixNano()
+	b.lock.Unlock()
+}
+
+// LastHeard returns the time (ns) of the latest beacon or beacon reply from
+// the peer, or 0 if the manager has never run.
+func (b *BeaconManager) LastHeard(rid int32) int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.lastHeard[rid]
+}
+
+// Suspected reports whether the manager is running and has heard nothing
+// from the peer for longer than TimeoutNs.
+func (b *BeaconManager) Suspected(rid int32) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.stop == nil || rid == b.r.Id {
+		return false
+	}
+	return time.Now().UnixNano()-b.lastHeard[rid] >= b.TimeoutNs
+}
+
+// Latency returns the Ewma of the beacon round-trip time to the peer, in ns.
+func (b *BeaconManager) Latency(rid int32) float64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.r.Ewma[rid]
+}
@@ -0,0 +1,449 @@
+package genericsmr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A BootstrapProvider supplies the initial configuration of a cluster from
+// outside (a file, or a coordination service such as etcd or Consul), so that
+// deployment automation only has to start the replicas with the same
+// provider. A starting replica publishes its advertised addresses, then asks
+// for the configuration until the provider has a complete one (it returns
+// ErrNotEnoughPeers until then). The replica's ID is the index of its
+// address in the peer list, as with a PeerResolver.
+type BootstrapProvider interface {
+	Publish(m Member) error
+	Bootstrap() (*ClusterConfig, error)
+}
+
+// Member describes a replica to the bootstrap provider.
+type Member struct {
+	Addr      string // advertised peer address
+	LeaseAddr string // advertised address of its lease replica ("" if none)
+}
+
+// ClusterConfig is the initial configuration of a cluster.
+type ClusterConfig struct {
+	Peers      []string         `json:"peers"`       // peer addresses, by replica ID
+	LeasePeers []string         `json:"lease_peers"` // addresses of the lease replicas, by replica ID (empty if not known)
+	Params     map[string]int64 `json:"params"`      // initial runtime parameters, by ParamName
+	Zones      []string         `json:"zones"`       // zones of the replicas, by replica ID (empty if not known; see Topology)
+	Regions    []string         `json:"regions"`     // regions of the replicas, by replica ID (empty if not known)
+}
+
+// Topology returns the topology of the configuration (nil if it labels no
+// replica with a zone or region).
+func (c *ClusterConfig) Topology() *Topology {
+	if len(c.Zones) == 0 && len(c.Regions) == 0 {
+		return nil
+	}
+	return &Topology{Zones: c.Zones, Regions: c.Regions}
+}
+
+// ReplicaId returns the ID of the replica advertising addr, or -1.
+func (c *ClusterConfig) ReplicaId(addr string) int {
+	return PeerIndex(c.Peers, addr)
+}
+
+// ParamValues validates the parameters of the configuration and returns
+// them by parameter number (see WithParams).
+func (c *ClusterConfig) ParamValues() (map[uint8]int64, error) {
+	values := make(map[uint8]int64, len(c.Params))
+	for name, v := range c.Params {
+		p, ok := ParamByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown parameter %q", name)
+		}
+		if err := validateParam(p, v); err != nil {
+			return nil, err
+		}
+		values[p] = v
+	}
+	var params [NUM_PARAMS]int64
+	setDefaultLeaseTiming(params[:])
+	for p, v := range values {
+		params[p] = v
+	}
+	if err := validateLeaseTiming(params[:]); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// normalize and check the addresses of a configuration
+func (c *ClusterConfig) normalize() error {
+	var err error
+	if c.Peers, err = NormalizePeerAddrList(c.Peers); err != nil {
+		return err
+	}
+	for what, labels := range map[string][]string{"zones": c.Zones, "regions": c.Regions} {
+		if len(labels) != 0 && len(labels) != len(c.Peers) {
+			return fmt.Errorf("%d %s for %d peers", len(labels), what, len(c.Peers))
+		}
+	}
+	if len(c.LeasePeers) == 0 {
+		return nil
+	}
+	if len(c.LeasePeers) != len(c.Peers) {
+		return fmt.Errorf("%d lease addresses for %d peers", len(c.LeasePeers), len(c.Peers))
+	}
+	c.LeasePeers, err = NormalizePeerAddrList(c.LeasePeers)
+	return err
+}
+
+// FileBootstrap reads the configuration from a JSON file (a ClusterConfig,
+// e.g. {"peers": ["10.0.0.1:7070", ...], "params": {"lease-duration-ns":
+// 2000000000}}), written beforehand by the deployment. Publishing is a no-op.
+type FileBootstrap struct {
+	Path string
+}
+
+func (fb *FileBootstrap) Publish(m Member) error {
+	return nil
+}
+
+func (fb *FileBootstrap) Bootstrap() (*ClusterConfig, error) {
+	data, err := ioutil.ReadFile(fb.Path)
+	if err != nil {
+		return nil, err
+	}
+	c := new(ClusterConfig)
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", fb.Path, err)
+	}
+	if err := c.normalize(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fb.Path, err)
+	}
+	return c, nil
+}
+
+// A KV is a key-value store shared by the replicas of a cluster.
+type KV interface {
+	Put(key string, value string) error
+	List(prefix string) (map[string]string, error) // every key that starts with prefix, with its value
+
+	// PutEphemeral puts a key that the store deletes ttl after the process
+	// stops renewing it, which it does until it exits.
+	PutEphemeral(key string, value string, ttl time.Duration) error
+}
+
+// how long the member key of a replica that stopped outlives it
+const MEMBER_TTL = 15 * time.Second
+
+// keep a key put by register, and renewed by the function it returns, until
+// the process exits, putting it again if it expired
+func keepEphemeral(key string, ttl time.Duration, register func() (func() error, error)) error {
+	renew, err := register()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			time.Sleep(ttl / 3)
+			if err := renew(); err != nil {
+				log.Printf("Renewing %s failed: %v\n", key, err)
+				if r, err := register(); err == nil {
+					renew = r
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// KVBootstrap keeps the configuration in a KV under Prefix: every replica
+// publishes itself as Prefix/members/<address> (with the lease address as
+// the value), and the peer list is the sorted list of the members once there
+// are exactly Expected of them. A member key expires MEMBER_TTL after its
+// replica stops, so that those of an earlier run, which would make replicas
+// number each other differently, do not linger; while there are more than
+// Expected, Bootstrap fails. Parameters are read from Prefix/params/<name>,
+// which the deployment may set beforehand.
+type KVBootstrap struct {
+	Store    KV
+	Prefix   string
+	Expected int // the number of replicas in the cluster
+}
+
+func (kb *KVBootstrap) key(parts ...string) string {
+	return strings.TrimSuffix(kb.Prefix, "/") + "/" + strings.Join(parts, "/")
+}
+
+func (kb *KVBootstrap) Publish(m Member) error {
+	return kb.Store.PutEphemeral(kb.key("members", m.Addr), m.LeaseAddr, MEMBER_TTL)
+}
+
+func (kb *KVBootstrap) Bootstrap() (*ClusterConfig, error) {
+	members, err := kb.Store.List(kb.key("members", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(members) < kb.Expected {
+		return nil, ErrNotEnoughPeers
+	}
+	c := &ClusterConfig{Params: make(map[string]int64)}
+	for k := range members {
+		c.Peers = append(c.Peers, strings.TrimPrefix(k, kb.key("members", "")))
+	}
+	sort.Strings(c.Peers)
+	if len(members) > kb.Expected {
+		return nil, fmt.Errorf("%d members under %s for %d replicas, some of them stale or of another cluster: %v",
+			len(members), kb.key("members", ""), kb.Expected, c.Peers)
+	}
+	for _, p := range c.Peers {
+		if la := members[kb.key("members", p)]; la != "" {
+			c.LeasePeers = append(c.LeasePeers, la)
+		}
+	}
+	if len(c.LeasePeers) != len(c.Peers) {
+		c.LeasePeers = nil
+	}
+	params, err := kb.Store.List(kb.key("params", ""))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range params {
+		name := strings.TrimPrefix(k, kb.key("params", ""))
+		if c.Params[name], err = strconv.ParseInt(strings.TrimSpace(v), 10, 64); err != nil {
+			return nil, fmt.Errorf("parameter %s: %v", name, err)
+		}
+	}
+	if err := c.normalize(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// how long a request to a coordination service may take
+const BOOTSTRAP_HTTP_TIMEOUT = 10 * time.Second
+
+var bootstrapClient = &http.Client{Timeout: BOOTSTRAP_HTTP_TIMEOUT}
+
+// ConsulKV is the KV of a Consul agent, through its HTTP API.
+type ConsulKV struct {
+	Addr  string // e.g., "http://127.0.0.1:8500"
+	Token string // ACL token ("" for none)
+}
+
+func (c *ConsulKV) do(method string, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.Addr, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	return bootstrapClient.Do(req)
+}
+
+func (c *ConsulKV) Put(key string, value string) error {
+	resp, err := c.do("PUT", "/v1/kv/"+strings.TrimPrefix(key, "/"), []byte(value))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul: put %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+// PutEphemeral puts the key with a session, which Consul deletes it with
+// once the session's TTL (at least 10s) passes without renewal.
+func (c *ConsulKV) PutEphemeral(key string, value string, ttl time.Duration) error {
+	return keepEphemeral(key, ttl, func() (func() error, error) {
+		id, err := c.createSession(key, ttl)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do("PUT", "/v1/kv/"+strings.TrimPrefix(key, "/")+"?acquire="+id, []byte(value))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		var acquired bool
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("consul: put %s: %s", key, resp.Status)
+		} else if err := json.NewDecoder(resp.Body).Decode(&acquired); err != nil {
+			return nil, err
+		} else if !acquired {
+			return nil, fmt.Errorf("consul: put %s: held by another session", key)
+		}
+		return func() error { return c.renewSession(id) }, nil
+	})
+}
+
+func (c *ConsulKV) createSession(name string, ttl time.Duration) (string, error) {
+	body, _ := json.Marshal(map[string]string{"Name": name, "TTL": ttl.String(), "Behavior": "delete", "LockDelay": "0s"})
+	resp, err := c.do("PUT", "/v1/session/create", body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("consul: create session: %s", resp.Status)
+	}
+	var session struct{ ID string }
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return "", err
+	}
+	return session.ID, nil
+}
+
+func (c *ConsulKV) renewSession(id string) error {
+	resp, err := c.do("PUT", "/v1/session/renew/"+id, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul: renew session %s: %s", id, resp.Status)
+	}
+	return nil
+}
+
+func (c *ConsulKV) List(prefix string) (map[string]string, error) {
+	// Consul keys have no leading slash
+	lead := ""
+	if strings.HasPrefix(prefix, "/") {
+		lead = "/"
+	}
+	resp, err := c.do("GET", "/v1/kv/"+strings.TrimPrefix(prefix, "/")+"?recurse", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	kvs := make(map[string]string)
+	if resp.StatusCode == http.StatusNotFound {
+		return kvs, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul: list %s: %s", prefix, resp.Status)
+	}
+	var entries []struct {
+		Key   string
+		Value []byte // base64 in the JSON
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		kvs[lead+e.Key] = string(e.Value)
+	}
+	return kvs, nil
+}
+
+// EtcdKV is the KV of an etcd (v3) cluster, through its JSON gateway.
+type EtcdKV struct {
+	Addr string // e.g., "http://127.0.0.1:2379"
+}
+
+func (e *EtcdKV) post(path string, req interface{}, reply interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := bootstrapClient.Post(strings.TrimSuffix(e.Addr, "/")+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("etcd: %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+func (e *EtcdKV) Put(key string, value string) error {
+	req := map[string][]byte{"key": []byte(key), "value": []byte(value)}
+	var reply struct{}
+	return e.post("/v3/kv/put", req, &reply)
+}
+
+// PutEphemeral puts the key with a lease, which etcd revokes (deleting the
+// key) once its TTL passes without a keepalive.
+func (e *EtcdKV) PutEphemeral(key string, value string, ttl time.Duration) error {
+	return keepEphemeral(key, ttl, func() (func() error, error) {
+		var lease struct {
+			ID string `json:"ID"` // an int64, which the gateway writes as a string
+		}
+		if err := e.post("/v3/lease/grant", map[string]int64{"TTL": int64(ttl / time.Second)}, &lease); err != nil {
+			return nil, err
+		}
+		req := map[string]interface{}{"key": []byte(key), "value": []byte(value), "lease": lease.ID}
+		var reply struct{}
+		if err := e.post("/v3/kv/put", req, &reply); err != nil {
+			return nil, err
+		}
+		return func() error {
+			var reply struct {
+				Result struct {
+					TTL string `json:"TTL"`
+				} `json:"result"`
+			}
+			if err := e.post("/v3/lease/keepalive", map[string]string{"ID": lease.ID}, &reply); err != nil {
+				return err
+			}
+			if ttl, _ := strconv.ParseInt(reply.Result.TTL, 10, 64); ttl <= 0 {
+				return fmt.Errorf("etcd: lease %s expired", lease.ID)
+			}
+			return nil
+		}, nil
+	})
+}
+
+func (e *EtcdKV) List(prefix string) (map[string]string, error) {
+	// every key from prefix up to, not including, the next prefix
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			end = end[:i+1]
+			break
+		}
+	}
+	req := map[string][]byte{"key": []byte(prefix), "range_end": end}
+	var reply struct {
+		Kvs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := e.post("/v3/kv/range", req, &reply); err != nil {
+		return nil, err
+	}
+	kvs := make(map[string]string, len(reply.Kvs))
+	for _, kv := range reply.Kvs {
+		kvs[string(kv.Key)] = string(kv.Value)
+	}
+	return kvs, nil
+}
+
+// ParseBootstrapProvider parses a provider specification: file:<path>,
+// consul:<agent URL> or etcd:<endpoint URL>; prefix and expected configure
+// the KV-based providers.
+func ParseBootstrapProvider(spec string, prefix string, expected int) (BootstrapProvider, error) {
+	kind, arg := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "file":
+		return &FileBootstrap{Path: arg}, nil
+	case "consul":
+		return &KVBootstrap{Store: &ConsulKV{Addr: arg, Token: os.Getenv("CONSUL_HTTP_TOKEN")}, Prefix: prefix, Expected: expected}, nil
+	case "etcd":
+		return &KVBootstrap{Store: &EtcdKV{Addr: arg}, Prefix: prefix, Expected: expected}, nil
+	}
+	return nil, fmt.Errorf("unknown bootstrap provider %q (want file:, consul: or etcd:)", spec)
+}
@@ -0,0 +1,224 @@
+package genericsmr
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/fastrpc"
+)
+
+// Broadcast sends a request to the peers and waits for a quorum of replies,
+// the loop that protocols otherwise each write for themselves: a request
+// registered with RegisterQuorumRPC carries the ID of the broadcast it
+// belongs to, which its replies echo back to the waiting Broadcast, so that
+// late replies to an earlier broadcast are never counted towards a later
+// one. The request is copied before it is sent, so the caller may go on
+// changing (or reusing) its own message. With a thrifty policy, the request
+// first goes to just enough peers to make the quorum, the fastest first, and
+// to the others once one of them fails to answer in time or rejects it.
+
+// what a quorum request and its replies carry, to be routed back to their
+// broadcast
+type QuorumMsg interface {
+	fastrpc.Serializable
+	// QuorumId returns the replica that sent the message and the ID of the
+	// broadcast it belongs to.
+	QuorumId() (replica int32, id int32)
+	SetQuorumId(replica int32, id int32)
+}
+
+// A QuorumPolicy says which peers a Broadcast asks and when it is done.
+type QuorumPolicy struct {
+	Need     int           // replies needed, counting the replica's own (0 for a majority)
+	Thrifty  bool          // ask only as many peers as needed, until some fail to answer
+	Timeout  time.Duration // give up after this long (0 for QUORUM_TIMEOUT_NS)
+	FailFast bool          // fail on the first rejected reply, rather than once the quorum is out of reach
+}
+
+// how long a Broadcast waits for its quorum, by default
+const QUORUM_TIMEOUT_NS = QUORUM_READ_ROUND_NS
+
+var (
+	ErrQuorumTimeout  = errors.New("timed out waiting for a quorum")
+	ErrQuorumRejected = errors.New("quorum rejected the request")
+	ErrNoQuorum       = errors.New("not enough live peers for a quorum")
+)
+
+// A QuorumRPC is a request and reply registered for Broadcast.
+type QuorumRPC[Req QuorumMsg, Rep QuorumMsg] struct {
+	r        *Replica
+	reqCode  uint16
+	repCode  uint16
+	lastId   int32
+	lock     sync.Mutex
+	pending  map[int32]chan Rep
+	newReq   func() Req
+	answerer func(Req) (Rep, bool)
+}
+
+// RegisterQuorumRPC registers a request and its reply. Requests from peers
+// are answered with answer's reply, if it gives one, on a goroutine of their
+// own, and replies are routed to the Broadcast waiting for them.
+func RegisterQuorumRPC[Req QuorumMsg, Rep QuorumMsg](r *Replica, req Req, rep Rep, answer func(Req) (Rep, bool)) *QuorumRPC[Req, Rep] {
+	qr := &QuorumRPC[Req, Rep]{
+		r:        r,
+		pending:  make(map[int32]chan Rep),
+		newReq:   func() Req { return req.New().(Req) },
+		answerer: answer,
+	}
+	qr.reqCode = RegisterRPCHandler(r, req, qr.answer, 1)
+	qr.repCode = RegisterRPCHandler(r, rep, qr.route, 0)
+	return qr
+}
+
+func (qr *QuorumRPC[Req, Rep]) answer(req Req) {
+	from, id := req.QuorumId()
+	rep, ok := qr.answerer(req)
+	if !ok {
+		return
+	}
+	rep.SetQuorumId(qr.r.Id, id)
+	qr.r.SendMsg(from, qr.repCode, rep)
+}
+
+func (qr *QuorumRPC[Req, Rep]) route(rep Rep) {
+	_, id := rep.QuorumId()
+	qr.lock.Lock()
+	defer qr.lock.Unlock()
+	if c, present := qr.pending[id]; present {
+		select {
+		case c <- rep:
+		default:
+			// a peer answered twice
+		}
+	}
+}
+
+// copy msg through its wire form
+func (qr *QuorumRPC[Req, Rep]) clone(msg Req) Req {
+	var buf bytes.Buffer
+	msg.Marshal(&buf)
+	c := qr.newReq()
+	if err := c.Unmarshal(&buf); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// the live peers, those shed from the preferred quorum last and the fastest
+// first
+func (r *Replica) broadcastOrder() []int32 {
+	peers := make([]int32, 0, r.N-1)
+	for i := 1; i < r.N; i++ {
+		q := (r.Id + int32(i)) % int32(r.N)
+		if r.PeerAlive(q) {
+			peers = append(peers, q)
+		}
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		if si, sj := r.PeerShed(peers[i]), r.PeerShed(peers[j]); si != sj {
+			return sj
+		}
+		return r.Beacons.Latency(peers[i]) < r.Beacons.Latency(peers[j])
+	})
+	return peers
+}
+
+// Broadcast sends msg to the peers as policy says, and returns the replies
+// that ok accepts (nil ok accepts every reply) once they and the replica's
+// own make the quorum. It fails with ErrQuorumRejected once enough replies
+// were rejected that the quorum is out of reach (or on the first one, with
+// FailFast), with ErrNoQuorum if too few peers are alive to ask, and with
+// ErrQuorumTimeout, returning the replies accepted so far.
+func (qr *QuorumRPC[Req, Rep]) Broadcast(msg Req, policy QuorumPolicy, ok func(Rep) bool) ([]Rep, error) {
+	r := qr.r
+	need := policy.Need
+	if need <= 0 {
+		need = r.N/2 + 1
+	}
+	if need > r.N {
+		return nil, ErrNoQuorum
+	}
+	timeout := policy.Timeout
+	if timeout <= 0 {
+		timeout = QUORUM_TIMEOUT_NS
+	}
+	if need == 1 {
+		return nil, nil
+	}
+
+	id := atomic.AddInt32(&qr.lastId, 1)
+	req := qr.clone(msg)
+	req.SetQuorumId(r.Id, id)
+	replies := make(chan Rep, r.N)
+	qr.lock.Lock()
+	qr.pending[id] = replies
+	qr.lock.Unlock()
+	defer func() {
+		qr.lock.Lock()
+		delete(qr.pending, id)
+		qr.lock.Unlock()
+	}()
+
+	peers := r.broadcastOrder()
+	if len(peers)+1 < need {
+		return nil, ErrNoQuorum
+	}
+	// ask peers until want of them may still answer
+	asked, outstanding := 0, 0
+	askUpTo := func(want int) {
+		for outstanding < want && asked < len(peers) {
+			if r.SendMsg(peers[asked], qr.reqCode, req) == nil {
+				outstanding++
+			}
+			asked++
+		}
+	}
+	if policy.Thrifty {
+		askUpTo(need - 1)
+	} else {
+		askUpTo(len(peers))
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	// a thrifty broadcast asks the others once the first ones are late
+	var widen <-chan time.Time
+	if asked < len(peers) {
+		w := time.NewTimer(timeout / 2)
+		defer w.Stop()
+		widen = w.C
+	}
+	var accepted []Rep
+	rejected := 0
+	for len(accepted)+1 < need {
+		if outstanding+len(accepted)+1 < need {
+			askUpTo(need - 1 - len(accepted))
+			if outstanding+len(accepted)+1 < need {
+				if rejected > 0 {
+					return accepted, ErrQuorumRejected
+				}
+				return accepted, ErrNoQuorum
+			}
+		}
+		select {
+		case rep := <-replies:
+			outstanding--
+			if ok == nil || ok(rep) {
+				accepted = append(accepted, rep)
+			} else if rejected++; policy.FailFast {
+				return accepted, ErrQuorumRejected
+			}
+		case <-widen:
+			widen = nil
+			askUpTo(len(peers))
+		case <-deadline.C:
+			return accepted, ErrQuorumTimeout
+		}
+	}
+	return accepted, nil
+}
@@ -0,0 +1,25 @@
+package genericsmr
+
+import (
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// maximum number of instances carried by one Entries message
+const CATCHUP_BATCH = 1000
+
+const CATCHUP_CHAN_SIZE = 100
+
+// RequestEntries asks a peer for the committed instances starting at from.
+// The protocol serves such requests from RequestEntriesChan, and receives
+// the answers on EntriesChan.
+func (r *Replica) RequestEntries(peerId int32, from int32) error {
+	return r.SendMsg(peerId, r.requestEntriesRPC,
+		&genericsmrproto.RequestEntries{ReplicaId: r.Id, From: from, Count: CATCHUP_BATCH})
+}
+
+// SendEntries answers a RequestEntries; batches of entries may be large, so
+// they are streamed.
+func (r *Replica) SendEntries(peerId int32, entries *genericsmrproto.Entries) error {
+	entries.ReplicaId = r.Id
+	return r.SendMsgStreamed(peerId, r.entriesRPC, entries)
+}
@@ -0,0 +1,57 @@
+package genericsmr
+
+import (
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// A client gives a proposal a deadline by sending DEADLINE just before it,
+// with the time it is still willing to wait. The replica sets the deadline on
+// its own clock as it reads the proposal, and a replica that forwards the
+// proposal sends what is left of it along, so the clocks never need to
+// agree. Once the deadline has passed, the client has given up on the
+// proposal, and its replies would be wasted: the replica drops a proposal
+// that gets there before it is proposed (the protocols call DropExpired as
+// they take proposals from ProposeChan), and sends no reply, nor relays one,
+// for a proposal that was executed too late. The work saved is that of the
+// commands a backlog has delayed past their deadlines, which is when the
+// replicas are least able to afford it.
+
+// the deadline of a proposal whose client waits timeoutNs from now (0 for
+// none)
+func (r *Replica) deadlineIn(timeoutNs int64) int64 {
+	if timeoutNs == 0 {
+		return 0
+	}
+	if timeoutNs < 0 {
+		timeoutNs = 0
+	}
+	return r.Now() + timeoutNs
+}
+
+// the time left to the deadline of p, for a replica that p is forwarded to
+// (0 for none, and at least 1 otherwise)
+func (r *Replica) timeLeft(p *Propose) int64 {
+	if p.Deadline == 0 {
+		return 0
+	}
+	if left := p.Deadline - r.Now(); left > 0 {
+		return left
+	}
+	return 1
+}
+
+// whether the client of p has given up on it
+func (r *Replica) pastDeadline(p *Propose) bool {
+	return p.Deadline != 0 && r.Now() > p.Deadline
+}
+
+// DropExpired reports whether the deadline of p has passed, in which case
+// the protocol must not propose it: p is answered ERR_TIMEOUT, so that what
+// the replica holds for it is released, but the reply is not sent.
+func (r *Replica) DropExpired(p *Propose) bool {
+	if !r.pastDeadline(p) {
+		return false
+	}
+	r.ReplyProposeErr(p, genericsmrproto.ERR_TIMEOUT, "deadline exceeded")
+	return true
+}
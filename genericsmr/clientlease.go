@@ -0,0 +1,157 @@
+package genericsmr
+
+import (
+	"bufio"
+	"sync"
+	"time"
+
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/state"
+)
+
+// upper bound on the duration of a client sub-lease
+const MAX_CLIENT_LEASE_NS = 1 * 1e9
+
+type ClientLeaseRequest struct {
+	*genericsmrproto.ClientLease
+	Writer *bufio.Writer // identifies the client connection holding the lease
+	Lock   *sync.Mutex
+	Codec  fastrpc.Codec // of the client connection
+}
+
+// ClientLeaseTable keeps track of the sub-leases that a replica has granted to
+// its clients. Writes to a key must wait until BlockedUntil for that key has
+// passed.
+type ClientLeaseTable struct {
+	lock    *sync.Mutex
+	holders map[state.Key]map[*bufio.Writer]int64 // key -> client connection -> expiration (ns)
+}
+
+func NewClientLeaseTable() *ClientLeaseTable {
+	return &ClientLeaseTable{new(sync.Mutex), make(map[state.Key]map[*bufio.Writer]int64)}
+}
+
+func (t *ClientLeaseTable) Grant(holder *bufio.Writer, keys []state.Key, until int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, k := range keys {
+		h, present := t.holders[k]
+		if !present {
+			h = make(map[*bufio.Writer]int64)
+			t.holders[k] = h
+		}
+		if h[holder] < until {
+			h[holder] = until
+		}
+	}
+}
+
+// Release drops the client's leases on keys (on every key if keys is nil).
+func (t *ClientLeaseTable) Release(holder *bufio.Writer, keys []state.Key) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if keys == nil {
+		for k, h := range t.holders {
+			delete(h, holder)
+			if len(h) == 0 {
+				delete(t.holders, k)
+			}
+		}
+		return
+	}
+	for _, k := range keys {
+		if h, present := t.holders[k]; present {
+			delete(h, holder)
+			if len(h) == 0 {
+				delete(t.holders, k)
+			}
+		}
+	}
+}
+
+// BlockedUntil returns the time (ns) until which writes to any of the commands'
+// keys must be held back, or 0 if there is no client lease on them.
+func (t *ClientLeaseTable) BlockedUntil(cmds []state.Command) int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.holders) == 0 {
+		return 0
+	}
+	now := time.Now().UnixNano()
+	until := int64(0)
+	for i := range cmds {
+		h, present := t.holders[cmds[i].K]
+		if !present {
+			continue
+		}
+		for holder, exp := range h {
+			if exp <= now {
+				delete(h, holder)
+			} else if exp > until {
+				until = exp
+			}
+		}
+		if len(h) == 0 {
+			delete(t.holders, cmds[i].K)
+		}
+	}
+	return until
+}
+
+// WaitForClientLeases blocks until no client holds a lease on the commands' keys.
+func (t *ClientLeaseTable) WaitForClientLeases(cmds []state.Command) {
+	for t.BlockedUntil(cmds) > 0 {
+		time.Sleep(1000 * 1000)
+	}
+}
+
+// GrantClientLease records the lease and sends the client the values it may
+// serve until the lease expires, with their versions. The duration is capped by MAX_CLIENT_LEASE_NS
+// and by limit (if not 0), the expiration of the replica's own read lease,
+// which must outlive the sub-lease.
+func (r *Replica) GrantClientLease(req *ClientLeaseRequest, entries []state.Entry, limit int64) {
+	now := r.Now()
+	duration := req.DurationNs
+	if duration > MAX_CLIENT_LEASE_NS {
+		duration = MAX_CLIENT_LEASE_NS
+	}
+	if limit != 0 && limit-now < duration {
+		duration = limit - now
+	}
+	if duration <= 0 {
+		r.DenyClientLease(req, genericsmrproto.ERR_CONFLICT)
+		return
+	}
+	// the client measures the duration from before it sent the request,
+	// so holding writes back from now on covers it
+	r.ClientLeases.Grant(req.Writer, req.Keys, now+duration)
+	values := make([]state.Value, len(entries))
+	versions := make([]uint64, len(entries))
+	for i, e := range entries {
+		values[i], versions[i] = e.Value, e.Version
+	}
+	r.replyClientLease(&genericsmrproto.ClientLeaseReply{
+		OK:         TRUE,
+		CommandId:  req.CommandId,
+		DurationNs: duration,
+		Values:     values,
+		ErrCode:    genericsmrproto.ERR_NONE,
+		Versions:   versions},
+		req)
+}
+
+func (r *Replica) DenyClientLease(req *ClientLeaseRequest, code uint8) {
+	r.replyClientLease(&genericsmrproto.ClientLeaseReply{
+		OK:        FALSE,
+		CommandId: req.CommandId,
+		ErrCode:   code},
+		req)
+}
+
+func (r *Replica) replyClientLease(reply *genericsmrproto.ClientLeaseReply, req *ClientLeaseRequest) {
+	req.Lock.Lock()
+	defer req.Lock.Unlock()
+	req.Codec.Encode(req.Writer, reply)
+	req.Writer.Flush()
+}
@@ -0,0 +1,134 @@
+package genericsmr
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// how many disconnect notifications may queue up before they are dropped
+const CLIENT_EVENT_CHAN_SIZE = 100
+
+// ClientInfo describes a client connection.
+type ClientInfo struct {
+	Id          uint64
+	RemoteAddr  string
+	ProxyAddr   string // the load balancer the connection came through ("" if none; see proxyproto.go)
+	Identity    string // authenticated identity ("" until the client authenticates)
+	ConnectedAt int64  // ns
+
+	counters *connCounters // the connection's traffic (see connstats.go)
+}
+
+// ClientTable keeps track of the open client connections of a process
+// (shared by all the groups of a GroupMux).
+type ClientTable struct {
+	lock    *sync.Mutex
+	nextId  uint64
+	clients map[uint64]*ClientInfo
+}
+
+func NewClientTable() *ClientTable {
+	return &ClientTable{lock: new(sync.Mutex), clients: make(map[uint64]*ClientInfo)}
+}
+
+// add a connection, unless there are already max (if not 0) connections
+func (t *ClientTable) add(conn net.Conn, max int) *ClientInfo {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if max > 0 && len(t.clients) >= max {
+		return nil
+	}
+	t.nextId++
+	info := &ClientInfo{
+		Id:          t.nextId,
+		RemoteAddr:  conn.RemoteAddr().String(),
+		ConnectedAt: time.Now().UnixNano(),
+		counters:    newConnCounters(),
+	}
+	if pc, ok := conn.(*proxyConn); ok {
+		info.ProxyAddr = pc.Conn.RemoteAddr().String()
+	}
+	t.clients[info.Id] = info
+	return info
+}
+
+func (t *ClientTable) remove(id uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.clients, id)
+}
+
+func (t *ClientTable) setIdentity(id uint64, identity string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if info, present := t.clients[id]; present {
+		info.Identity = identity
+	}
+}
+
+func (t *ClientTable) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.clients)
+}
+
+// List returns a copy of the metadata of every open connection, oldest first.
+func (t *ClientTable) List() []ClientInfo {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	list := make([]ClientInfo, 0, len(t.clients))
+	for _, info := range t.clients {
+		list = append(list, *info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+// admit a new client connection and serve it, or turn it away if the
+// replica already has as many clients as it may
+func (r *Replica) admitClient(conn net.Conn) {
+	if r.cfg.ProxyProtocol {
+		pc, err := readProxyHeader(conn)
+		if err != nil {
+			log.Printf("Closing client connection from %s: %v\n", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn = pc
+	}
+	info := r.Clients.add(conn, r.cfg.MaxClients)
+	if info == nil {
+		log.Printf("Refusing client %s: too many connections (%d)\n", conn.RemoteAddr(), r.cfg.MaxClients)
+		conn.Close()
+		return
+	}
+	r.tuneConn(conn, false)
+	r.Tasks.Go("client "+info.RemoteAddr, RESTART_NEVER, func() error {
+		r.clientListener(conn, info)
+		return nil
+	})
+
+	select {
+	case r.OnClientConnect <- true:
+	default:
+	}
+}
+
+// forget a closed client connection, and notify the protocol
+func (r *Replica) clientGone(info *ClientInfo) {
+	r.Clients.remove(info.Id)
+	select {
+	case r.OnClientDisconnect <- *info:
+	default:
+	}
+}
+
+// extend the deadline for the client's next request
+func (r *Replica) touchClient(conn net.Conn) {
+	if r.cfg.ClientIdleTimeoutNs > 0 {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(r.cfg.ClientIdleTimeoutNs)))
+	}
+}
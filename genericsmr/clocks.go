@@ -0,0 +1,174 @@
+package genericsmr
+
+import (
+	"sync"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// With every round of beacons, the BeaconManager also probes the lease clock
+// (Now) of each live peer, as NTP does: from the time t1 the probe was sent,
+// the times t2 and t3 the peer received it and replied, and the time t4 the
+// reply arrived, the peer's clock is ((t2 - t1) + (t3 - t4)) / 2 ahead of
+// this replica's, give or take half the round trip (t4 - t1) - (t3 - t2).
+// Of the latest CLOCK_SAMPLES probes, the estimate comes from the one with
+// the shortest round trip, whose error bound is the tightest (queueing only
+// ever lengthens a round trip); comparing it with the estimate of the
+// previous CLOCK_SAMPLES probes gives the drift of the peer's clock. Protocols
+// read the estimates with PeerClock, e.g. to bound how far apart the clocks
+// that lease times are read from may be (see ClockSkewBound), rather than
+// assume perfectly synchronized clocks.
+
+// probes each estimate is taken from
+const CLOCK_SAMPLES = 8
+
+// PeerClockInfo is the estimate of a peer's lease clock.
+type PeerClockInfo struct {
+	Peer      int32
+	OffsetNs  int64   // the peer's clock minus this replica's
+	ErrorNs   int64   // the offset is within OffsetNs ± ErrorNs, unless a clock was stepped since
+	DriftPpm  float64 // how fast the offset grows, in ns per ms (0 until 2*CLOCK_SAMPLES probes)
+	Samples   int     // probes answered
+	UpdatedNs int64   // when the probe the estimate comes from was answered, on this replica's clock (0 if none yet)
+}
+
+// Known reports whether the peer has answered a probe.
+func (i PeerClockInfo) Known() bool {
+	return i.Samples > 0
+}
+
+type clockSample struct {
+	offset int64
+	delay  int64 // the round trip, net of the time the peer took to reply
+	at     int64 // when the reply arrived
+}
+
+type peerClock struct {
+	samples [CLOCK_SAMPLES]clockSample
+	n       int         // samples taken
+	prev    clockSample // the best of the previous CLOCK_SAMPLES (at is 0 if none)
+}
+
+// the sample with the shortest round trip, of the latest ones
+func (pc *peerClock) best() clockSample {
+	count := pc.n
+	if count > CLOCK_SAMPLES {
+		count = CLOCK_SAMPLES
+	}
+	best := pc.samples[0]
+	for _, s := range pc.samples[1:count] {
+		if s.delay < best.delay {
+			best = s
+		}
+	}
+	return best
+}
+
+type clocks struct {
+	lock  sync.Mutex
+	peers []peerClock
+}
+
+func newClocks(n int) *clocks {
+	return &clocks{peers: make([]peerClock, n)}
+}
+
+// probe the peer's clock
+func (r *Replica) sendClockProbe(q int32) {
+	r.SendControlMsg(q, r.clockProbeRPC, &genericsmrproto.ClockProbe{ReplicaId: r.Id, Sent: r.Now()})
+}
+
+func (r *Replica) handleClockProbe(probe *genericsmrproto.ClockProbe) {
+	received := r.Now()
+	r.SendControlMsg(probe.ReplicaId, r.clockProbeReplyRPC, &genericsmrproto.ClockProbeReply{
+		ReplicaId: r.Id, Sent: probe.Sent, Received: received, Replied: r.Now()})
+}
+
+func (r *Replica) handleClockProbeReply(reply *genericsmrproto.ClockProbeReply) {
+	now := r.Now()
+	q := reply.ReplicaId
+	if q < 0 || int(q) >= r.N || q == r.Id {
+		return
+	}
+	s := clockSample{
+		offset: ((reply.Received - reply.Sent) + (reply.Replied - now)) / 2,
+		delay:  (now - reply.Sent) - (reply.Replied - reply.Received),
+		at:     now,
+	}
+	if s.delay < 0 {
+		// a clock was stepped during the probe
+		return
+	}
+	c := r.clocks
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pc := &c.peers[q]
+	if pc.n > 0 && pc.n%CLOCK_SAMPLES == 0 {
+		pc.prev = pc.best()
+	}
+	pc.samples[pc.n%CLOCK_SAMPLES] = s
+	pc.n++
+}
+
+// PeerClock returns the estimate of peer q's lease clock; for the replica
+// itself, a zero offset.
+func (r *Replica) PeerClock(q int32) PeerClockInfo {
+	info := PeerClockInfo{Peer: q}
+	if q == r.Id {
+		info.Samples = 1
+		info.UpdatedNs = r.Now()
+		return info
+	}
+	c := r.clocks
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pc := &c.peers[q]
+	if pc.n == 0 {
+		return info
+	}
+	best := pc.best()
+	info.OffsetNs = best.offset
+	info.ErrorNs = best.delay / 2
+	info.Samples = pc.n
+	info.UpdatedNs = best.at
+	if pc.prev.at > 0 && best.at > pc.prev.at {
+		info.DriftPpm = float64(best.offset-pc.prev.offset) * 1e6 / float64(best.at-pc.prev.at)
+	}
+	return info
+}
+
+// PeerClocks returns the estimates of every peer's clock.
+func (r *Replica) PeerClocks() []PeerClockInfo {
+	infos := make([]PeerClockInfo, 0, r.N-1)
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id {
+			infos = append(infos, r.PeerClock(q))
+		}
+	}
+	return infos
+}
+
+// ClockSkewBound returns how far apart, at most, this replica's lease clock
+// and the live peers' are estimated to be, and whether every live peer has
+// an estimate.
+func (r *Replica) ClockSkewBound() (int64, bool) {
+	bound := int64(0)
+	complete := true
+	for _, info := range r.PeerClocks() {
+		if !r.PeerAlive(info.Peer) {
+			continue
+		}
+		if !info.Known() {
+			complete = false
+			continue
+		}
+		skew := info.OffsetNs
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew += info.ErrorNs; skew > bound {
+			bound = skew
+		}
+	}
+	return bound, complete
+}
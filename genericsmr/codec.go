@@ -0,0 +1,80 @@
+package genericsmr
+
+import (
+	"bufio"
+	"fmt"
+
+	"github.com/glycerine/qlease/fastrpc"
+)
+
+// Messages between replicas are binary (fastrpc.CODEC_BINARY) unless the
+// replica is configured with another peer codec (see WithPeerCodec): once
+// connected to a peer, it then writes the peer a switch message, in binary,
+// naming the codec, and encodes every later message to that peer with it,
+// so that the peer knows how to decode what follows. Replicas decode with
+// whichever codec each peer has switched to, so peers may use different
+// codecs, but every replica must have registered the codecs in use
+// (fastrpc.RegisterCodec). Peer codecs are not supported with peer sessions
+// or groups, whose connections are re-established or shared.
+//
+// Client connections switch codecs with a CODEC message (see serveClient).
+
+// check that the replica can use the configured peer codec
+func (r *Replica) initPeerCodecs() error {
+	codec := fastrpc.LookupCodec(r.cfg.PeerCodec)
+	if codec == nil {
+		return fmt.Errorf("unknown peer codec %d", r.cfg.PeerCodec)
+	}
+	if r.cfg.PeerCodec != fastrpc.CODEC_BINARY && (r.cfg.PeerSessions || r.cfg.Mux != nil) {
+		return fmt.Errorf("peer codecs are not supported with peer sessions or groups")
+	}
+	r.sendCodecs = make([]fastrpc.Codec, r.N)
+	r.recvCodecs = make([]fastrpc.Codec, r.N)
+	for i := range r.sendCodecs {
+		r.sendCodecs[i] = fastrpc.Binary
+		r.recvCodecs[i] = fastrpc.Binary
+	}
+	return nil
+}
+
+// tell every connected peer to decode what follows with the configured codec
+func (r *Replica) switchPeerCodecs() {
+	if r.cfg.PeerCodec == fastrpc.CODEC_BINARY {
+		return
+	}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !r.PeerAlive(q) {
+			continue
+		}
+		r.switchPeerCodec(q)
+	}
+}
+
+func (r *Replica) switchPeerCodec(q int32) {
+	if r.cfg.PeerCodec == fastrpc.CODEC_BINARY {
+		return
+	}
+	r.PeerWLocks[q].LockControl()
+	w := r.PeerWriters[q]
+	r.writePeerPrefix(w, q)
+	r.writeCode(w, q, r.codecRPC)
+	w.WriteByte(r.cfg.PeerCodec)
+	if w.Flush() == nil {
+		r.sendCodecs[q] = fastrpc.LookupCodec(r.cfg.PeerCodec)
+	}
+	r.PeerWLocks[q].Unlock()
+}
+
+// read the codec a peer switches to
+func (r *Replica) handleCodecSwitch(rid int, reader *bufio.Reader, deliver bool) error {
+	id, err := reader.ReadByte()
+	if err != nil || !deliver {
+		return err
+	}
+	codec := fastrpc.LookupCodec(id)
+	if codec == nil {
+		return fmt.Errorf("replica %d switched to unknown codec %d", rid, id)
+	}
+	r.recvCodecs[rid] = codec
+	return nil
+}
@@ -0,0 +1,39 @@
+package genericsmr
+
+import (
+	"fmt"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/state"
+)
+
+// A conditional write (state.CPUT) puts V only if its key is still at
+// Version when the command executes, so that a client can read keys cheaply
+// under a lease and commit what it computed from them in a single command,
+// which fails with ERR_CONFLICT if any write got in between. The read token is
+// the version that the reply to the read carried (ProposeReplyTS.Version, or
+// ClientLeaseReply.Versions): every write to a key moves it to the next
+// version, so that a write that changed the key and one that changed it back
+// are noticed too, and version 0 stands for a key never written. Every
+// replica checks the condition as it executes the command in log order, so
+// they all agree on the outcome, but only the execution can tell the client,
+// which therefore needs replies after execution (-dreply).
+
+// the reason to reject a conditional write proposed by a client, or nil
+func (r *Replica) validateConditional(cmd *state.Command) error {
+	if cmd.Op == state.CPUT && !r.Dreply {
+		return fmt.Errorf("replica %d replies before execution, which conditional writes need", r.Id)
+	}
+	return nil
+}
+
+// turn the reply to a conditional write that found its key at another
+// version, executed just before, into a failure
+func (r *Replica) conditionalReply(reply *genericsmrproto.ProposeReplyTS, propose *Propose) {
+	if propose.Command.Op != state.CPUT || reply.OK != TRUE || !r.State.CPUTFailed {
+		return
+	}
+	reply.OK = FALSE
+	reply.ErrCode = genericsmrproto.ERR_CONFLICT
+	reply.ErrMsg = fmt.Sprintf("key %d is no longer at version %d", propose.Command.K, propose.Command.Version)
+}
@@ -0,0 +1,540 @@
+package genericsmr
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/glycerine/qlease/cheaptime"
+	"github.com/glycerine/qlease/sockopt"
+	"github.com/glycerine/qlease/state"
+)
+
+const LEASE_CHAN_SIZE = 1000
+
+// Config holds everything needed to construct a Replica. Build one with
+// DefaultConfig and adjust it directly, or pass Options to NewReplicaWithOptions.
+type Config struct {
+	Id           int      // the ID of the replica being constructed
+	PeerAddrList []string // array with the IP:port address of every replica
+
+	Thrifty bool // send only as many messages as strictly required?
+	Exec    bool // execute commands?
+	Dreply  bool // reply to client after command has been executed?
+	Beacon  bool // send beacons to detect how fast are the other replicas?
+
+	BeaconIntervalNs int64 // fixed beacon interval (0 to follow PARAM_BEACON_INTERVAL_NS)
+	BeaconJitterNs   int64 // random delay added to each beacon interval
+	BeaconTimeoutNs  int64 // silence after which a peer is suspected (0 for DEFAULT_BEACON_TIMEOUT_NS)
+
+	ShedLatencyNs  int64 // in thrifty mode, shed peers slower than this from the preferred quorum (0 to not; see shedding.go)
+	ShedQueueDepth int64 // ... or with more writers queued for their connection (0 to not)
+	ShedLeases     bool  // move the leases of the peers shed to those replacing them
+
+	TimeSource cheaptime.TimeSource // clock timing the beacons (nil for cheaptime.Default())
+	WallClock  func() int64         // time in ns that leases are reckoned in (nil for time.Now)
+
+	Trace  io.Writer     // record the messages reaching the protocol to it (see trace.go)
+	Replay *VirtualClock // the replica is re-driven from a trace, on this clock (see Replay)
+
+	Durable         bool   // log to a stable store?
+	StableStorePath string // file backing the stable store
+
+	Listener   net.Listener // already bound listener (nil to listen on ListenAddr)
+	ListenAddr string       // address to bind, if not the advertised PeerAddrList[Id] (e.g., "[::]:7070")
+
+	PeerSendTimeoutNs int64 // how long SendMsgTimeout may wait on a peer (0 to wait indefinitely)
+	ForwardTimeoutNs  int64 // how long a forwarded proposal waits for its reply (0 for FORWARD_TIMEOUT_NS; see forward.go)
+
+	Transport    Transport // how to reach the peers (nil for TCP)
+	PeerSessions bool      // multiplex streams over peer connections, and reconnect broken ones (see sessions.go)
+	PeerCodec    uint8     // codec of the messages sent to peers (fastrpc.CODEC_BINARY by default; see codec.go)
+
+	TCPKeepAliveNs     int64 // TCP keepalive period of peer and client connections (0 for Go's default, <0 to disable)
+	PeerPingIntervalNs int64 // ping peers silent for this long (0 to not ping)
+	PeerPingTimeoutNs  int64 // disconnect from peers silent for this long (0 to never)
+
+	PeerSocket   sockopt.Options // socket options of peer connections (see sockopts.go)
+	ClientSocket sockopt.Options // socket options of client connections
+
+	PeerReadTimeoutNs    int64 // disconnect from a peer that sends nothing for this long (0 to never; see deadlines.go)
+	PeerWriteTimeoutNs   int64 // disconnect from a peer that accepts no data for this long (0 to never)
+	ClientWriteTimeoutNs int64 // close client connections that accept no reply for this long (0 to never)
+
+	ProposeChanSize int // capacity of ProposeChan
+	BeaconChanSize  int // capacity of BeaconChan
+	LeaseChanSize   int // capacity of each of the quorum lease channels
+
+	LeaseOverflow OverflowPolicy // what to do with lease messages from peers when their channel is full
+
+	PeerReadBufferSize  int // bytes buffered reading from each peer (0 for bufio's default; see peerbuffers.go)
+	PeerWriteBufferSize int // bytes buffered writing to each peer (0 for bufio's default)
+	DirectWriteBytes    int // writes to peers of this many bytes or more bypass the write buffer (0 for never)
+
+	DecodeWorkers int // goroutines that decode the fixed-size messages from peers, off their readers (0 for none; see decodepool.go)
+
+	PiggybackLeases bool // carry lease promises and replies on other messages to peers (see piggyback.go)
+
+	Reads ReadStrategy // how ReadStrict serves linearizable reads (nil for LeaseReads)
+
+	Topology *Topology // zones and regions of the replicas (nil if unknown; see topology.go)
+
+	ResultCacheSize int // results remembered per client session, to answer proposals sent again (0 to not remember; see resultcache.go)
+
+	ACL           *ACL
+	Authenticator Authenticator
+
+	ProxyProtocol bool // client connections start with a PROXY protocol header (see proxyproto.go)
+
+	MaxClients          int   // maximum number of client connections (0 for no limit)
+	ClientIdleTimeoutNs int64 // close client connections idle for this long (0 to keep them open)
+	ClientOpsPerSec     int64 // proposals each client connection may send per second (0 for no limit)
+	ClientBytesPerSec   int64 // bytes each client connection may send per second (0 for no limit)
+	MaxClientMsgBytes   int64 // bytes a client message may take (0 for the codecs' bounds; see ingress.go)
+	MaxLeaseKeys        int64 // keys a client lease may name (0 for no limit)
+
+	MaxCommitBacklog int64           // instances proposed but not executed beyond which client proposals are pushed back (0 for no limit; see admission.go)
+	Admission        AdmissionPolicy // how client proposals are pushed back
+
+	PriorityScheduling bool // hand client proposals to the protocol by priority class (see priority.go)
+
+	SnapshotBytesPerSec   int64 // bytes of snapshots the replica may send per second (0 for no limit)
+	PeerEgressBytesPerSec int64 // bytes sent to each peer per second beyond which background transfers wait (0 for no limit; see egress.go)
+
+	AntiEntropyNs int64 // how often the replica compares its state with its peers' (0 for never; see antientropy.go)
+
+	LeaseIdleNs int64 // how long without reads before the replica suspends its lease (0 for never; see leaseidle.go)
+
+	MaxStateBytes int64             // approximate bytes of state beyond which the replica acts as StateMemory says (0 for no limit; see statememory.go)
+	StateMemory   StateMemoryPolicy // what to do when the state reaches MaxStateBytes
+	OnStateMemory func(state.Stats) // also called when it does (nil for nothing)
+
+	ReadPrefixShift int // client reads are also counted by key prefix k>>ReadPrefixShift (-1 to count them in total only; see readstats.go)
+
+	Faults *Faults // failures injected on the links from the peers, for testing (nil for none; see faults.go)
+
+	LeaseChecker *LeaseChecker // checks local reads against committed writes, for debugging (nil to not check; see leasecheck.go)
+
+	AuditLog *AuditLog // records admin and membership operations (nil for none; see audit.go)
+
+	Backups *BackupConfig // where and when to back the state up (nil for never; see backup.go)
+
+	DebugAddr string // address of the debug HTTP server, with pprof, expvar and channel depths ("" for none; see debug.go)
+
+	ProposeMiddleware []ProposeMiddleware // wraps the path of client proposals to the protocol, first outermost (see middleware.go)
+
+	ApplyNotify []ApplyFunc // called with every command the replica executes (see applynotify.go)
+
+	Params map[uint8]int64 // initial values of runtime parameters (see params.go), unless recovered
+
+	Mux     *GroupMux // shared connections, if the process hosts several groups
+	GroupId uint16
+}
+
+type Option func(*Config)
+
+func DefaultConfig(id int, peerAddrList []string) *Config {
+	return &Config{
+		Id:              id,
+		PeerAddrList:    peerAddrList,
+		StableStorePath: fmt.Sprintf("stable-store-replica%d", id),
+		ProposeChanSize: CHAN_BUFFER_SIZE,
+		BeaconChanSize:  CHAN_BUFFER_SIZE,
+		LeaseChanSize:   LEASE_CHAN_SIZE,
+		ResultCacheSize: RESULT_CACHE_SIZE,
+
+		SnapshotBytesPerSec: DEFAULT_SNAPSHOT_BYTES_PER_SEC,
+		ReadPrefixShift:     -1,
+	}
+}
+
+func WithThrifty(thrifty bool) Option {
+	return func(c *Config) { c.Thrifty = thrifty }
+}
+
+func WithExec(exec bool) Option {
+	return func(c *Config) { c.Exec = exec }
+}
+
+func WithDreply(dreply bool) Option {
+	return func(c *Config) { c.Dreply = dreply }
+}
+
+func WithBeacon(beacon bool) Option {
+	return func(c *Config) { c.Beacon = beacon }
+}
+
+// WithBeaconTiming configures the replica's BeaconManager.
+func WithBeaconTiming(intervalNs int64, jitterNs int64, timeoutNs int64) Option {
+	return func(c *Config) {
+		c.BeaconIntervalNs = intervalNs
+		c.BeaconJitterNs = jitterNs
+		c.BeaconTimeoutNs = timeoutNs
+	}
+}
+
+// WithTimeSource sets the clock that beacon round trips are timed with.
+func WithTimeSource(ts cheaptime.TimeSource) Option {
+	return func(c *Config) { c.TimeSource = ts }
+}
+
+// WithParams sets the initial values of runtime parameters, e.g. from a
+// ClusterConfig. They take precedence over the protocol's defaults, but not
+// over values recovered from the stable store.
+func WithParams(params map[uint8]int64) Option {
+	return func(c *Config) {
+		if c.Params == nil {
+			c.Params = make(map[uint8]int64)
+		}
+		for p, v := range params {
+			c.Params[p] = v
+		}
+	}
+}
+
+// WithTrace records every message that reaches the protocol from peers and
+// clients to w, for Replay to re-drive a replica with.
+func WithTrace(w io.Writer) Option {
+	return func(c *Config) { c.Trace = w }
+}
+
+// WithReplay makes a replica that neither connects to its peers nor accepts
+// clients, to be driven by Replay, and reckons leases on clock.
+func WithReplay(clock *VirtualClock) Option {
+	return func(c *Config) {
+		c.Replay = clock
+		c.WallClock = clock.Now
+	}
+}
+
+// WithDurable turns on logging to the stable store at path
+// (or at the default per-replica path if path is empty).
+func WithDurable(path string) Option {
+	return func(c *Config) {
+		c.Durable = true
+		if path != "" {
+			c.StableStorePath = path
+		}
+	}
+}
+
+// WithStableStorePath sets the file backing the stable store. Replicas of
+// different protocols running in one process need distinct paths.
+func WithStableStorePath(path string) Option {
+	return func(c *Config) { c.StableStorePath = path }
+}
+
+// WithPeerSendTimeout bounds how long SendMsgTimeout may block on a single
+// peer before disconnecting from it.
+func WithPeerSendTimeout(timeoutNs int64) Option {
+	return func(c *Config) { c.PeerSendTimeoutNs = timeoutNs }
+}
+
+// WithForwardTimeout sets how long a proposal forwarded to another replica
+// waits for its reply before its client is answered ERR_TIMEOUT.
+func WithForwardTimeout(timeoutNs int64) Option {
+	return func(c *Config) { c.ForwardTimeoutNs = timeoutNs }
+}
+
+// WithKeepAlive sets the TCP keepalive period of peer and client
+// connections, and has the replica ping its peers when they have been silent
+// for pingIntervalNs, disconnecting from those silent for pingTimeoutNs.
+func WithKeepAlive(tcpPeriodNs int64, pingIntervalNs int64, pingTimeoutNs int64) Option {
+	return func(c *Config) {
+		c.TCPKeepAliveNs = tcpPeriodNs
+		c.PeerPingIntervalNs = pingIntervalNs
+		c.PeerPingTimeoutNs = pingTimeoutNs
+	}
+}
+
+// WithSocketOptions sets the socket options of the replica's connections to
+// its peers, and of those from its clients (see sockopts.go).
+func WithSocketOptions(peer sockopt.Options, client sockopt.Options) Option {
+	return func(c *Config) {
+		c.PeerSocket = peer
+		c.ClientSocket = client
+	}
+}
+
+// WithDeadlines sets how long a peer may send nothing, and how long a peer
+// or a client may accept nothing written to it, before its connection is
+// closed (0 disables any of them; see deadlines.go).
+func WithDeadlines(peerReadNs int64, peerWriteNs int64, clientWriteNs int64) Option {
+	return func(c *Config) {
+		c.PeerReadTimeoutNs = peerReadNs
+		c.PeerWriteTimeoutNs = peerWriteNs
+		c.ClientWriteTimeoutNs = clientWriteNs
+	}
+}
+
+// WithTransport makes the replica connect to its peers, and listen, through t
+// instead of TCP. Not supported with groups, whose connections are the GroupMux's.
+func WithTransport(t Transport) Option {
+	return func(c *Config) { c.Transport = t }
+}
+
+// WithPeerSessions carries peer connections over peermux sessions, which
+// either side re-establishes when they break. Every replica of the cluster
+// must be configured the same way.
+func WithPeerSessions(on bool) Option {
+	return func(c *Config) { c.PeerSessions = on }
+}
+
+// WithPeerCodec makes the replica encode its messages to peers with the codec
+// registered under id (see fastrpc.RegisterCodec), which peers must have.
+func WithPeerCodec(id uint8) Option {
+	return func(c *Config) { c.PeerCodec = id }
+}
+
+func WithListener(l net.Listener) Option {
+	return func(c *Config) { c.Listener = l }
+}
+
+// WithListenAddr makes the replica bind addr rather than the address it
+// advertises to its peers (PeerAddrList[Id]); see ListenAddr.
+func WithListenAddr(addr string) Option {
+	return func(c *Config) { c.ListenAddr = addr }
+}
+
+// WithChannelSizes sets the capacities of the propose, beacon and lease channels.
+// Zero leaves the corresponding default in place.
+func WithChannelSizes(propose int, beacon int, lease int) Option {
+	return func(c *Config) {
+		if propose > 0 {
+			c.ProposeChanSize = propose
+		}
+		if beacon > 0 {
+			c.BeaconChanSize = beacon
+		}
+		if lease > 0 {
+			c.LeaseChanSize = lease
+		}
+	}
+}
+
+// WithPeerBuffers sizes the buffers of the reader and writer of each peer
+// connection (0 to keep bufio's default), e.g. larger for batch workloads.
+func WithPeerBuffers(readSize int, writeSize int) Option {
+	return func(c *Config) {
+		c.PeerReadBufferSize = readSize
+		c.PeerWriteBufferSize = writeSize
+	}
+}
+
+// WithDirectPeerWrites has the parts of messages to peers of at least
+// minBytes bytes, such as snapshot chunks and streamed batches, written
+// straight to the connection rather than copied through its write buffer (see
+// peerbuffers.go).
+func WithDirectPeerWrites(minBytes int) Option {
+	return func(c *Config) { c.DirectWriteBytes = minBytes }
+}
+
+// WithDecodeWorkers has the fixed-size messages from peers decoded by a pool
+// of worker goroutines rather than by the goroutines reading the peers'
+// connections, for many-core machines at high message rates (see
+// decodepool.go).
+func WithDecodeWorkers(workers int) Option {
+	return func(c *Config) { c.DecodeWorkers = workers }
+}
+
+// WithLeaseOverflowPolicy sets what happens to the quorum lease messages from
+// peers that find their channel full (see OverflowPolicy).
+func WithLeaseOverflowPolicy(policy OverflowPolicy) Option {
+	return func(c *Config) { c.LeaseOverflow = policy }
+}
+
+// WithReadStrategy sets how the replica serves linearizable reads (see
+// ReadStrategy).
+func WithReadStrategy(s ReadStrategy) Option {
+	return func(c *Config) { c.Reads = s }
+}
+
+// WithTopology tells the replica where the replicas of the cluster run.
+func WithTopology(t *Topology) Option {
+	return func(c *Config) { c.Topology = t }
+}
+
+// WithResultCache sets how many results the replica remembers per client
+// session (0 to remember none), so that a proposal a client sends again is
+// answered with the original result instead of being executed twice.
+func WithResultCache(size int) Option {
+	return func(c *Config) { c.ResultCacheSize = size }
+}
+
+// WithAntiEntropy sets the initial period at which the replica compares
+// its state with its peers', and repairs the keys that diverge.
+func WithAntiEntropy(periodNs int64) Option {
+	return func(c *Config) { c.AntiEntropyNs = periodNs }
+}
+
+// WithLeaseIdleSuspension sets the initial time without reads after which
+// the replica suspends its lease, until its next read (see leaseidle.go).
+func WithLeaseIdleSuspension(idleNs int64) Option {
+	return func(c *Config) { c.LeaseIdleNs = idleNs }
+}
+
+// WithStateMemoryLimit sets the initial limit on the approximate bytes of
+// the replica's state (0 for none), and what the replica does when its state
+// reaches it: act as policy says, and call onLimit (if not nil) with the
+// state's size (see statememory.go). The limit is the runtime parameter
+// PARAM_MAX_STATE_BYTES.
+func WithStateMemoryLimit(maxBytes int64, policy StateMemoryPolicy, onLimit func(state.Stats)) Option {
+	return func(c *Config) {
+		c.MaxStateBytes = maxBytes
+		c.StateMemory = policy
+		c.OnStateMemory = onLimit
+	}
+}
+
+// WithReadStatsByPrefix has the replica count the client reads it answers
+// by key prefix, the keys k with equal k>>shift, as well as in total (see
+// readstats.go). A negative shift counts them in total only.
+func WithReadStatsByPrefix(shift int) Option {
+	return func(c *Config) { c.ReadPrefixShift = shift }
+}
+
+// WithSnapshotRate sets the initial rate at which the replica sends snapshots
+// to peers fetching them (0 for no limit); it is the runtime parameter
+// PARAM_SNAPSHOT_BYTES_PER_SEC.
+func WithSnapshotRate(bytesPerSec int64) Option {
+	return func(c *Config) { c.SnapshotBytesPerSec = bytesPerSec }
+}
+
+// WithPeerEgressLimit sets the initial bytes per second that may be sent to
+// each peer before background transfers wait (0 for no limit); it is the
+// runtime parameter PARAM_PEER_EGRESS_BYTES_PER_SEC (see egress.go).
+func WithPeerEgressLimit(bytesPerSec int64) Option {
+	return func(c *Config) { c.PeerEgressBytesPerSec = bytesPerSec }
+}
+
+// WithGroup makes the replica a member of the given group, sharing mux's
+// port and peer connections with the other groups of the process.
+func WithGroup(mux *GroupMux, group uint16) Option {
+	return func(c *Config) {
+		c.Mux = mux
+		c.GroupId = group
+	}
+}
+
+// WithClientLimits caps the number of client connections and closes
+// connections on which no request arrives for idleTimeoutNs (0 disables either).
+func WithClientLimits(maxClients int, idleTimeoutNs int64) Option {
+	return func(c *Config) {
+		c.MaxClients = maxClients
+		c.ClientIdleTimeoutNs = idleTimeoutNs
+	}
+}
+
+// WithClientRateLimits sets the initial per-connection rate limits of
+// clients (0 disables either); proposals beyond them are answered with
+// ERR_OVERLOADED. The limits are the runtime parameters
+// PARAM_CLIENT_OPS_PER_SEC and PARAM_CLIENT_BYTES_PER_SEC.
+func WithClientRateLimits(opsPerSec int64, bytesPerSec int64) Option {
+	return func(c *Config) {
+		c.ClientOpsPerSec = opsPerSec
+		c.ClientBytesPerSec = bytesPerSec
+	}
+}
+
+// WithAdmissionControl sets the initial commit backlog, in instances
+// proposed but not yet executed, beyond which client proposals are pushed
+// back as the policy says (0 disables it; see admission.go). The limit is the
+// runtime parameter PARAM_MAX_COMMIT_BACKLOG.
+func WithAdmissionControl(maxBacklog int64, policy AdmissionPolicy) Option {
+	return func(c *Config) {
+		c.MaxCommitBacklog = maxBacklog
+		c.Admission = policy
+	}
+}
+
+// WithSlowPeerShedding sets the initial thresholds beyond which, in thrifty
+// mode, a peer is shed from the preferred quorum (0 disables either; see
+// shedding.go): a beacon latency of latencyNs, and queueDepth writers queued
+// for its connection; with leases, the protocol also proposes to move the
+// shed peer's leases to the peers that replaced it. The thresholds are the
+// runtime parameters PARAM_SHED_LATENCY_NS and PARAM_SHED_QUEUE_DEPTH.
+func WithSlowPeerShedding(latencyNs int64, queueDepth int64, leases bool) Option {
+	return func(c *Config) {
+		c.ShedLatencyNs = latencyNs
+		c.ShedQueueDepth = queueDepth
+		c.ShedLeases = leases
+	}
+}
+
+// WithClientMsgLimits sets the initial size limits of client messages (0
+// disables either; see ingress.go): maxBytes per message on the wire, and
+// maxLeaseKeys per client lease. The limits are the runtime parameters
+// PARAM_MAX_CLIENT_MSG_BYTES and PARAM_MAX_LEASE_KEYS.
+func WithClientMsgLimits(maxBytes int64, maxLeaseKeys int64) Option {
+	return func(c *Config) {
+		c.MaxClientMsgBytes = maxBytes
+		c.MaxLeaseKeys = maxLeaseKeys
+	}
+}
+
+// WithProxyProtocol makes the replica read the original address of each
+// client from the PROXY protocol header its load balancer sends first.
+func WithProxyProtocol(on bool) Option {
+	return func(c *Config) { c.ProxyProtocol = on }
+}
+
+// WithPriorityScheduling has the replica hand client proposals to the
+// protocol by their priority class, rather than as they arrive (see
+// priority.go).
+func WithPriorityScheduling(on bool) Option {
+	return func(c *Config) { c.PriorityScheduling = on }
+}
+
+// WithPiggybackLeases makes the replica send its lease promises and promise
+// replies along with its other messages to peers, when there are any. Every
+// replica of the cluster must understand them (see piggyback.go).
+func WithPiggybackLeases(on bool) Option {
+	return func(c *Config) { c.PiggybackLeases = on }
+}
+
+// WithFaults has the replica inject the failures set in f on the links
+// from its peers.
+func WithFaults(f *Faults) Option {
+	return func(c *Config) { c.Faults = f }
+}
+
+// WithLeaseChecker has the replica check its local reads, and report its
+// commits, to c.
+func WithLeaseChecker(c *LeaseChecker) Option {
+	return func(cfg *Config) { cfg.LeaseChecker = c }
+}
+
+// WithAuditLog has the replica record its admin and membership operations
+// in a.
+func WithAuditLog(a *AuditLog) Option {
+	return func(c *Config) { c.AuditLog = a }
+}
+
+// WithBackups has the replica back its state up as b says.
+func WithBackups(b *BackupConfig) Option {
+	return func(c *Config) { c.Backups = b }
+}
+
+// WithDebugServer has the replica serve its debug HTTP server at addr.
+func WithDebugServer(addr string) Option {
+	return func(c *Config) { c.DebugAddr = addr }
+}
+
+// WithApplyNotify has f called with every command the replica executes, and
+// its result, e.g. to maintain indexes of the state outside it.
+func WithApplyNotify(f ...ApplyFunc) Option {
+	return func(c *Config) { c.ApplyNotify = append(c.ApplyNotify, f...) }
+}
+
+// WithProposeMiddleware adds mw to the middleware that client proposals go
+// through, after that of earlier options.
+func WithProposeMiddleware(mw ...ProposeMiddleware) Option {
+	return func(c *Config) { c.ProposeMiddleware = append(c.ProposeMiddleware, mw...) }
+}
+
+func WithACL(acl *ACL, auth Authenticator) Option {
+	return func(c *Config) {
+		c.ACL = acl
+		c.Authenticator = auth
+	}
+}
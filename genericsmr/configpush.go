@@ -0,0 +1,103 @@
+package genericsmr
+
+import (
+	"sync"
+	"time"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/state"
+)
+
+// Clients that send CONFIG_UPDATE learn of a new leader, or of replicas
+// going down or coming back, as soon as the replica does, rather than from
+// their next request failing: the replica checks its view of the cluster
+// every CONFIG_UPDATE_INTERVAL_NS and pushes it to the subscribed connections
+// whenever it changes (see genericsmrproto.ConfigUpdate).
+
+// how often the replica checks for a change of leader or of live replicas
+const CONFIG_UPDATE_INTERVAL_NS = 50 * 1e6
+
+type configPush struct {
+	lock   sync.Mutex // protects subs
+	subs   map[*clientConn]bool
+	leader int32  // as last pushed
+	alive  uint64 // as last pushed
+}
+
+func newConfigPush() *configPush {
+	return &configPush{subs: make(map[*clientConn]bool), leader: -1}
+}
+
+// the replica's view of the cluster: who leads (-1 if unknown), and the
+// bitmap of the live replicas
+func (r *Replica) clusterConfig() (int32, uint64) {
+	leader := int32(-1)
+	if ll, ok := r.Log.(LeaderLog); ok {
+		leader, _ = ll.Leader()
+	}
+	var alive uint64
+	for i := int32(0); i < int32(r.N) && i < 64; i++ {
+		if i == r.Id || r.PeerAlive(i) {
+			alive |= 1 << uint(i)
+		}
+	}
+	return leader, alive
+}
+
+func configUpdate(leader int32, alive uint64) *genericsmrproto.ProposeReplyTS {
+	return &genericsmrproto.ProposeReplyTS{
+		OK:        TRUE,
+		CommandId: genericsmrproto.CONFIG_UPDATE_ID,
+		Value:     state.Value(leader),
+		Timestamp: time.Now().UnixNano(),
+		Fence:     alive,
+	}
+}
+
+func (c *clientConn) pushConfig(update *genericsmrproto.ProposeReplyTS) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.codec.Encode(c.writer, update)
+	c.writer.Flush()
+}
+
+// subscribe c to configuration updates, sending it the current configuration
+func (r *Replica) subscribeConfig(c *clientConn) {
+	cp := r.configPush
+	cp.lock.Lock()
+	cp.subs[c] = true
+	cp.lock.Unlock()
+	c.configSub = r
+	c.pushConfig(configUpdate(r.clusterConfig()))
+}
+
+func (r *Replica) unsubscribeConfig(c *clientConn) {
+	cp := r.configPush
+	cp.lock.Lock()
+	delete(cp.subs, c)
+	cp.lock.Unlock()
+}
+
+// push every change of configuration to the subscribed connections
+func (r *Replica) pushConfigUpdates() {
+	cp := r.configPush
+	for !r.Shutdown {
+		time.Sleep(CONFIG_UPDATE_INTERVAL_NS)
+		leader, alive := r.clusterConfig()
+		cp.lock.Lock()
+		if leader == cp.leader && alive == cp.alive {
+			cp.lock.Unlock()
+			continue
+		}
+		cp.leader, cp.alive = leader, alive
+		subs := make([]*clientConn, 0, len(cp.subs))
+		for c := range cp.subs {
+			subs = append(subs, c)
+		}
+		cp.lock.Unlock()
+		update := configUpdate(leader, alive)
+		for _, c := range subs {
+			c.pushConfig(update)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package genericsmr
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// Every connection to a peer or client keeps counters of its traffic, for
+// capacity planning: messages sent and received by RPC code (by message type
+// for clients, whose replies are not counted), bytes, writes to the
+// connection (each flush of its buffer, or vectored message, is one), how
+// many times the connection to a peer was replaced, and when data last went
+// each way. Replica.Stats returns them in full, and the Status RPC sums them
+// up per connection. With groups, the bytes and writes of the shared peer
+// connections are counted by the first group.
+
+// ConnStats are the counters of a connection.
+type ConnStats struct {
+	MsgsSent       map[uint16]uint64 // by RPC code
+	MsgsReceived   map[uint16]uint64 // by RPC code (by message type for clients)
+	BytesSent      uint64
+	BytesReceived  uint64
+	Flushes        uint64
+	Reconnects     uint64
+	LastSentNs     int64 // 0 if never
+	LastReceivedNs int64 // 0 if never
+}
+
+type PeerStats struct {
+	ReplicaId int32
+	ConnStats
+}
+
+type ClientStats struct {
+	ClientInfo
+	ConnStats
+}
+
+// Stats are the counters of the replica's connections.
+type Stats struct {
+	Peers   []PeerStats // every replica but this one
+	Clients []ClientStats
+}
+
+// the live counters of a connection
+type connCounters struct {
+	lock           sync.Mutex // protects the maps
+	sent           map[uint16]uint64
+	received       map[uint16]uint64
+	bytesSent      uint64
+	bytesReceived  uint64
+	flushes        uint64
+	conns          uint64
+	lastSentNs     int64
+	lastReceivedNs int64
+}
+
+func newConnCounters() *connCounters {
+	return &connCounters{sent: make(map[uint16]uint64), received: make(map[uint16]uint64)}
+}
+
+func (c *connCounters) sentMsg(code uint16) {
+	c.lock.Lock()
+	c.sent[code]++
+	c.lock.Unlock()
+}
+
+func (c *connCounters) receivedMsg(code uint16) {
+	c.lock.Lock()
+	c.received[code]++
+	c.lock.Unlock()
+}
+
+func (c *connCounters) wrote(n int) {
+	atomic.AddUint64(&c.bytesSent, uint64(n))
+	atomic.AddUint64(&c.flushes, 1)
+	atomic.StoreInt64(&c.lastSentNs, time.Now().UnixNano())
+}
+
+func (c *connCounters) read(n int) {
+	if n > 0 {
+		atomic.AddUint64(&c.bytesReceived, uint64(n))
+		atomic.StoreInt64(&c.lastReceivedNs, time.Now().UnixNano())
+	}
+}
+
+func (c *connCounters) snapshot() ConnStats {
+	st := ConnStats{
+		MsgsSent:       make(map[uint16]uint64),
+		MsgsReceived:   make(map[uint16]uint64),
+		BytesSent:      atomic.LoadUint64(&c.bytesSent),
+		BytesReceived:  atomic.LoadUint64(&c.bytesReceived),
+		Flushes:        atomic.LoadUint64(&c.flushes),
+		LastSentNs:     atomic.LoadInt64(&c.lastSentNs),
+		LastReceivedNs: atomic.LoadInt64(&c.lastReceivedNs),
+	}
+	if conns := atomic.LoadUint64(&c.conns); conns > 1 {
+		st.Reconnects = conns - 1
+	}
+	c.lock.Lock()
+	for code, n := range c.sent {
+		st.MsgsSent[code] = n
+	}
+	for code, n := range c.received {
+		st.MsgsReceived[code] = n
+	}
+	c.lock.Unlock()
+	return st
+}
+
+// A countingConn counts the traffic of the connection it wraps.
+type countingConn struct {
+	net.Conn
+	counters *connCounters
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.counters.read(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.counters.wrote(n)
+	return n, err
+}
+
+// wrap a new connection to peer q with the configured deadlines, and count
+// its traffic
+func (r *Replica) peerConn(q int32, conn net.Conn) net.Conn {
+	c := r.peerCounters[q]
+	atomic.AddUint64(&c.conns, 1)
+	return &countingConn{r.peerDeadlines(conn), c}
+}
+
+// write bufs to conn, with a single vectored write if conn is a TCP
+// connection, even one whose traffic is counted
+func writeBuffers(conn net.Conn, bufs *net.Buffers) (int64, error) {
+	cc, counted := conn.(*countingConn)
+	if !counted {
+		return bufs.WriteTo(conn)
+	}
+	n, err := bufs.WriteTo(cc.Conn)
+	cc.counters.wrote(int(n))
+	return n, err
+}
+
+// Stats returns the counters of the replica's connections to its peers and
+// clients (those of every group, with groups).
+func (r *Replica) Stats() *Stats {
+	st := &Stats{Peers: make([]PeerStats, 0, r.N-1)}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id {
+			st.Peers = append(st.Peers, PeerStats{q, r.peerCounters[q].snapshot()})
+		}
+	}
+	for _, info := range r.Clients.List() {
+		st.Clients = append(st.Clients, ClientStats{info, info.counters.snapshot()})
+	}
+	sort.Slice(st.Clients, func(i, j int) bool { return st.Clients[i].Id < st.Clients[j].Id })
+	return st
+}
+
+// the traffic of the replica's connections, for the Status RPC
+func (r *Replica) traffic() []genericsmrproto.ConnTraffic {
+	st := r.Stats()
+	traffic := make([]genericsmrproto.ConnTraffic, 0, len(st.Peers)+len(st.Clients))
+	for _, p := range st.Peers {
+		t := sumTraffic(&p.ConnStats)
+		t.ReplicaId = p.ReplicaId
+		t.RemoteAddr = r.PeerAddr(p.ReplicaId)
+		traffic = append(traffic, t)
+	}
+	for _, c := range st.Clients {
+		t := sumTraffic(&c.ConnStats)
+		t.ReplicaId = -1
+		t.ClientId = c.Id
+		t.RemoteAddr = c.RemoteAddr
+		traffic = append(traffic, t)
+	}
+	return traffic
+}
+
+func sumTraffic(st *ConnStats) genericsmrproto.ConnTraffic {
+	t := genericsmrproto.ConnTraffic{
+		BytesSent:      st.BytesSent,
+		BytesReceived:  st.BytesReceived,
+		Flushes:        st.Flushes,
+		Reconnects:     st.Reconnects,
+		LastSentNs:     st.LastSentNs,
+		LastReceivedNs: st.LastReceivedNs,
+	}
+	for _, n := range st.MsgsSent {
+		t.MsgsSent += n
+	}
+	for _, n := range st.MsgsReceived {
+		t.MsgsReceived += n
+	}
+	return t
+}
@@ -0,0 +1,108 @@
+package genericsmr
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/glycerine/qlease/fastrpc"
+)
+
+// Over a LaneTransport, the control messages to a peer (those of
+// SendControlMsg and SendMsgTimeout, and beacons) go on a lane of their own
+// rather than on the peer's connection: the replica that dialed the
+// connection opens the lane right after its handshake, and the one that
+// accepted it waits for the lane before serving the peer. The messages on the
+// lane are framed as on the connection, and read by a listener of their own,
+// so that a control message neither waits for the data messages written
+// before it nor, once sent, for the data messages sent before it to arrive.
+// Lanes are only used without peer sessions or groups, and with the binary
+// peer codec: the sequence numbers of sessions, and the switches to another
+// codec, order the messages of one connection only.
+
+// the control lane to a peer
+type ctlLane struct {
+	lock   *PeerLock
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// the transport, if it opens control lanes for the replica
+func (r *Replica) laneTransport() LaneTransport {
+	lt, ok := r.transport().(LaneTransport)
+	if !ok || r.sessions != nil || r.mux != nil || r.cfg.PeerCodec != fastrpc.CODEC_BINARY {
+		return nil
+	}
+	return lt
+}
+
+func (r *Replica) newCtlLane(conn net.Conn) *ctlLane {
+	return &ctlLane{NewPeerLock(), conn, r.newPeerReader(conn), r.newPeerWriter(conn)}
+}
+
+// open the control lane of the connection just dialed to peer q, if the
+// transport has lanes; without one, control messages go on the connection
+func (r *Replica) openControlLane(q int32) {
+	lt := r.laneTransport()
+	if lt == nil {
+		return
+	}
+	conn, err := lt.OpenLane(unwrapConn(r.Peers[q]))
+	if err != nil {
+		log.Printf("No control lane to replica %d: %v\n", q, err)
+		return
+	}
+	r.sessionLock.Lock()
+	r.ctlLanes[q] = r.newCtlLane(conn)
+	r.sessionLock.Unlock()
+}
+
+// wait for peer q to open the control lane of conn, the connection accepted
+// from it, if the transport has lanes
+func (r *Replica) acceptControlLane(q int32, conn net.Conn) *ctlLane {
+	lt := r.laneTransport()
+	if lt == nil {
+		return nil
+	}
+	lane, err := lt.AcceptLane(unwrapConn(conn))
+	if err != nil {
+		log.Printf("No control lane from replica %d: %v\n", q, err)
+		return nil
+	}
+	return r.newCtlLane(lane)
+}
+
+// the control lane to a peer (nil if none)
+func (r *Replica) controlLane(peerId int32) *ctlLane {
+	r.sessionLock.Lock()
+	defer r.sessionLock.Unlock()
+	return r.ctlLanes[peerId]
+}
+
+// write and flush a message to the peer's control lane; the caller must hold
+// the lane's lock
+func (r *Replica) writeLaneMsg(peerId int32, l *ctlLane, code uint16, msg fastrpc.Message) error {
+	if err := r.checkCode(peerId, code); err != nil {
+		return err
+	}
+	r.writeCode(l.writer, peerId, code)
+	if err := r.sendCodecs[peerId].Encode(l.writer, msg); err != nil {
+		return encodeErr(err)
+	}
+	return l.writer.Flush()
+}
+
+// serve the control lane of peer rid until it breaks, which the listener of
+// the peer's connection reports
+func (r *Replica) startControlLaneListener(rid int, l *ctlLane) {
+	r.Tasks.Go(fmt.Sprintf("control lane of replica %d", rid), RESTART_NEVER, func() error {
+		for !r.Shutdown {
+			if err := r.handlePeerMessage(rid, l.reader); err != nil {
+				return nil
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,77 @@
+package genericsmr
+
+import (
+	"net"
+	"time"
+)
+
+// Without deadlines, a connection whose other end stops reading or writing
+// without closing it (e.g., a peer stuck in a long pause, or a client that
+// never reads its replies) blocks the goroutines using it forever. With
+// PeerReadTimeoutNs, a peer that sends nothing for that long is disconnected,
+// as its listener's read fails, and is no longer counted as alive: lease
+// code then stops waiting on it rather than acting, arbitrarily later, on a
+// Promise from a connection that had gone quiet. Peers that may legitimately
+// be idle that long need pings (PeerPingIntervalNs below the timeout). With
+// PeerWriteTimeoutNs and ClientWriteTimeoutNs, a write that the other end
+// does not accept for that long fails, and the connection is closed.
+
+// A deadlineConn arms the connection's deadlines before each Read and Write.
+type deadlineConn struct {
+	net.Conn
+	readTimeout  time.Duration // 0 for none
+	writeTimeout time.Duration // 0 for none
+	deadline     time.Time     // explicit write deadline (see SetWriteDeadline)
+}
+
+// wrap conn so that its reads and writes time out after readNs and writeNs
+// (conn itself if neither is positive)
+func withDeadlines(conn net.Conn, readNs int64, writeNs int64) net.Conn {
+	if readNs <= 0 && writeNs <= 0 {
+		return conn
+	}
+	c := &deadlineConn{Conn: conn}
+	if readNs > 0 {
+		c.readTimeout = time.Duration(readNs)
+	}
+	if writeNs > 0 {
+		c.writeTimeout = time.Duration(writeNs)
+	}
+	return c
+}
+
+// wrap a new peer connection with the configured deadlines
+func (r *Replica) peerDeadlines(conn net.Conn) net.Conn {
+	return withDeadlines(conn, r.cfg.PeerReadTimeoutNs, r.cfg.PeerWriteTimeoutNs)
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if c.readTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		d := time.Now().Add(c.writeTimeout)
+		if !c.deadline.IsZero() && c.deadline.Before(d) {
+			d = c.deadline
+		}
+		c.Conn.SetWriteDeadline(d)
+	}
+	n, err := c.Conn.Write(b)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		// part of a message may have been written: the stream is unusable
+		c.Conn.Close()
+	}
+	return n, err
+}
+
+// SetWriteDeadline sets a deadline that writes keep until it is cleared,
+// however long the write timeout (as SendMsgTimeout does). Like Write, it is
+// called with the connection's write lock held.
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
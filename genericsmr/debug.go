@@ -0,0 +1,244 @@
+package genericsmr
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// A replica can serve a debug HTTP server on an address of its own (see
+// WithDebugServer), apart from its client, peer and admin ports, so that a
+// slow or stuck replica in production can be profiled without rebuilding
+// it. It serves
+//
+//	/debug/pprof/            the runtime profiles (goroutine, heap, allocs,
+//	                         block, mutex, threadcreate), as go tool pprof reads
+//	                         them, or as text with ?debug=1
+//	/debug/pprof/profile     a CPU profile of ?seconds= (30 by default)
+//	/debug/pprof/trace       an execution trace of ?seconds= (1 by default)
+//	/debug/goroutines        the stacks of every goroutine
+//	/debug/channels          the depths of the replicas' input channels
+//	/debug/vars              expvar, with the replicas' status, traffic and
+//	                         background work under "qlease"
+//
+// Only /debug/vars is also served on http.DefaultServeMux, and so on the admin
+// port, as the expvar package registers it there; profiling is not. The groups of a process that are given the
+// same address share one server. The debug server offers no authentication:
+// bind it to a loopback or management address.
+
+// the debug servers of the process, by address
+var debugServers = struct {
+	lock    sync.Mutex
+	byAddr  map[string]*debugServer
+	publish sync.Once
+}{byAddr: make(map[string]*debugServer)}
+
+type debugServer struct {
+	lock     sync.Mutex
+	replicas []*Replica
+}
+
+// serve the debug server at addr for r, starting it if no other group of the
+// process already has
+func (r *Replica) serveDebug(addr string) error {
+	debugServers.lock.Lock()
+	defer debugServers.lock.Unlock()
+	debugServers.publish.Do(func() {
+		expvar.Publish("qlease", expvar.Func(debugVars))
+	})
+	if ds, ok := debugServers.byAddr[addr]; ok {
+		ds.add(r)
+		return nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	ds := &debugServer{}
+	ds.add(r)
+	debugServers.byAddr[addr] = ds
+	log.Printf("Replica %d: debug server listening on %s\n", r.Id, l.Addr())
+	r.Tasks.Go("debug server", RESTART_NEVER, func() error {
+		return http.Serve(l, ds.handler())
+	})
+	return nil
+}
+
+func (ds *debugServer) add(r *Replica) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	ds.replicas = append(ds.replicas, r)
+	sort.Slice(ds.replicas, func(i, j int) bool { return ds.replicas[i].GroupId < ds.replicas[j].GroupId })
+}
+
+func (ds *debugServer) list() []*Replica {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	return append([]*Replica(nil), ds.replicas...)
+}
+
+func (ds *debugServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", debugProfile)
+	mux.HandleFunc("/debug/pprof/profile", debugCPUProfile)
+	mux.HandleFunc("/debug/pprof/trace", debugTrace)
+	mux.HandleFunc("/debug/goroutines", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		pprof.Lookup("goroutine").WriteTo(w, 2)
+	})
+	mux.HandleFunc("/debug/channels", ds.channels)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// the index of the profiles, or the one named in the path
+func debugProfile(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/debug/pprof/")
+	if name == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "profiles (?debug=1 for text):")
+		for _, p := range pprof.Profiles() {
+			fmt.Fprintf(w, "  /debug/pprof/%s (%d)\n", p.Name(), p.Count())
+		}
+		fmt.Fprintln(w, "  /debug/pprof/profile?seconds=30")
+		fmt.Fprintln(w, "  /debug/pprof/trace?seconds=1")
+		return
+	}
+	p := pprof.Lookup(name)
+	if p == nil {
+		http.Error(w, "no such profile: "+name, http.StatusNotFound)
+		return
+	}
+	debug, _ := strconv.Atoi(req.FormValue("debug"))
+	if debug > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	}
+	if name == "heap" && req.FormValue("gc") != "" {
+		runtime.GC()
+	}
+	p.WriteTo(w, debug)
+}
+
+// how long to profile for, from ?seconds=
+func debugSeconds(req *http.Request, def int) time.Duration {
+	s, err := strconv.Atoi(req.FormValue("seconds"))
+	if err != nil || s <= 0 {
+		s = def
+	}
+	return time.Duration(s) * time.Second
+}
+
+func debugCPUProfile(w http.ResponseWriter, req *http.Request) {
+	d := debugSeconds(req, 30)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		// e.g., the process was started with -cpuprofile
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "cannot profile: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sleepOrDone(req, d)
+	pprof.StopCPUProfile()
+}
+
+func debugTrace(w http.ResponseWriter, req *http.Request) {
+	d := debugSeconds(req, 1)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := trace.Start(w); err != nil {
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "cannot trace: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sleepOrDone(req, d)
+	trace.Stop()
+}
+
+// sleep for d, or until the client goes away
+func sleepOrDone(req *http.Request, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-req.Context().Done():
+	}
+}
+
+// the depths of the replicas' input channels, fullest first
+func (ds *debugServer) channels(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "replica\tgroup\tchannel\tlen\tcap\tfull%\tdropped\t")
+	for _, r := range ds.list() {
+		chans := r.Status().Chans
+		sort.SliceStable(chans, func(i, j int) bool {
+			return int64(chans[i].Len)*int64(chans[j].Cap) > int64(chans[j].Len)*int64(chans[i].Cap)
+		})
+		for _, c := range chans {
+			full := 0.0
+			if c.Cap > 0 {
+				full = 100 * float64(c.Len) / float64(c.Cap)
+			}
+			fmt.Fprintf(tw, "%d\t%d\t%s\t%d\t%d\t%.1f\t%d\t\n", r.Id, r.GroupId, c.Name, c.Len, c.Cap, full, c.Dropped)
+		}
+	}
+	tw.Flush()
+}
+
+// the "qlease" expvar: what every replica served by a debug server reports,
+// by group, and the number of goroutines
+func debugVars() interface{} {
+	debugServers.lock.Lock()
+	var reps []*Replica
+	for _, ds := range debugServers.byAddr {
+		reps = append(reps, ds.list()...)
+	}
+	debugServers.lock.Unlock()
+	vars := map[string]interface{}{"goroutines": runtime.NumGoroutine()}
+	for _, r := range reps {
+		params := make(map[string]int64, NUM_PARAMS)
+		for p := uint8(0); p < NUM_PARAMS; p++ {
+			params[ParamName(p)] = r.Param(p)
+		}
+		pending, expired := r.ForwardsPending()
+		reads, readsByPrefix := r.ReadStats()
+		vars[fmt.Sprintf("group%d", r.GroupId)] = map[string]interface{}{
+			"replica":     r.Id,
+			"health":      r.Health().String(),
+			"status":      r.Status(),
+			"params":      params,
+			"antiEntropy": r.AntiEntropyStats(),
+			"backups":     r.BackupStats(),
+			"clocks":      r.PeerClocks(),
+			"egress":      r.EgressStats(),
+			"forwards":    map[string]interface{}{"pending": pending, "expired": expired},
+			"leaseIdle":   r.LeaseIdleStats(),
+			"latencies":   latencyVars(r),
+			"reads":       map[string]interface{}{"total": reads, "byPrefix": readsByPrefix},
+			"stateMemory": r.StateMemoryStats(),
+		}
+	}
+	return vars
+}
+
+// the summary and buckets of every latency histogram, by stage
+func latencyVars(r *Replica) map[string]interface{} {
+	vars := make(map[string]interface{}, NUM_LAT_STAGES)
+	for i, sum := range r.LatencyStats() {
+		vars[sum.Stage] = map[string]interface{}{"summary": sum, "buckets": r.LatencyHistogram(uint8(i))}
+	}
+	return vars
+}
@@ -0,0 +1,181 @@
+package genericsmr
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/glycerine/qlease/fastrpc"
+)
+
+// At very high message rates, the goroutine reading a peer's connection is
+// held up by unmarshaling. With decode workers (see WithDecodeWorkers), the
+// reader only frames the messages of a fixed binary size (BinarySize) and
+// hands their bytes to a pool of workers, each with a queue of its own, to be
+// decoded and delivered there. The messages of a peer are delivered in the
+// order they arrived, by the worker of the peer that the reader hands all of
+// them to, unless their RPC code was marked unordered (see SetUnordered):
+// those are spread over every worker, and may be delivered out of order.
+// The messages the reader still decodes itself (those of variable size,
+// those of other codecs, and the replica's own) are delivered after the
+// ordered messages of the peer before them, by the same worker, and so are
+// RPC handlers of no workers (see RegisterRPCHandler) called on the worker.
+
+// messages queued for each decode worker
+const DECODE_QUEUE_SIZE = 4096
+
+type decodeJob struct {
+	rid  int
+	code uint16
+	pair *RPCPair
+	data *[]byte // the message to decode, or nil to run deliver
+	run  func()
+}
+
+type decodePool struct {
+	queues []chan decodeJob
+	next   []uint32 // per peer, the worker of its next unordered message
+}
+
+var decodeBufs = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+func (r *Replica) startDecodePool(workers int) {
+	dp := &decodePool{queues: make([]chan decodeJob, workers), next: make([]uint32, r.N)}
+	for i := range dp.queues {
+		queue := make(chan decodeJob, DECODE_QUEUE_SIZE)
+		dp.queues[i] = queue
+		r.Tasks.Go(fmt.Sprintf("decode worker %d", i), RESTART_ON_PANIC, func() error {
+			for job := range queue {
+				r.runDecodeJob(job)
+			}
+			return nil
+		})
+	}
+	r.decoders = dp
+}
+
+// SetUnordered marks the messages of an RPC code as safe to deliver out of
+// order, so that decode workers may handle those of a peer concurrently.
+func (r *Replica) SetUnordered(code uint16) {
+	if pair, present := r.rpcTable[code]; present {
+		atomic.StoreUint32(&pair.unordered, 1)
+	}
+}
+
+// the worker that delivers the ordered messages of peer rid
+func (dp *decodePool) ordered(rid int) chan decodeJob {
+	return dp.queues[rid%len(dp.queues)]
+}
+
+// hand deliver to the worker of peer rid, behind the messages it has queued
+func (dp *decodePool) inOrder(rid int, deliver func()) {
+	dp.ordered(rid) <- decodeJob{rid: rid, run: deliver}
+}
+
+// read the size bytes of a message of code from peer rid and queue it to be
+// decoded
+func (dp *decodePool) frame(rid int, code uint16, pair *RPCPair, reader *bufio.Reader, size int) error {
+	buf := decodeBufs.Get().(*[]byte)
+	if cap(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	*buf = (*buf)[:size]
+	if _, err := io.ReadFull(reader, *buf); err != nil {
+		decodeBufs.Put(buf)
+		return err
+	}
+	queue := dp.ordered(rid)
+	if atomic.LoadUint32(&pair.unordered) != 0 {
+		queue = dp.queues[int(atomic.AddUint32(&dp.next[rid], 1))%len(dp.queues)]
+	}
+	queue <- decodeJob{rid: rid, code: code, pair: pair, data: buf}
+	return nil
+}
+
+func (r *Replica) runDecodeJob(job decodeJob) {
+	defer func() {
+		if p := recover(); p != nil {
+			// as if the reader had failed to decode the message
+			r.disconnectPeer(int32(job.rid), fmt.Errorf("malformed message: %v", p))
+		}
+	}()
+	if job.data == nil {
+		r.deliverAfterFaults(job.rid, job.run)
+		return
+	}
+	obj := job.pair.Obj.New()
+	err := obj.Unmarshal(bytes.NewReader(*job.data))
+	if cap(*job.data) <= MAX_POOLED_FRAME_SIZE {
+		decodeBufs.Put(job.data)
+	}
+	if err != nil {
+		r.disconnectPeer(int32(job.rid), fmt.Errorf("malformed message %d: %v", job.code, err))
+		return
+	}
+	r.trace(TRACE_PEER_MSG, int64(job.rid), job.code, obj)
+	r.deliverAfterFaults(job.rid, func() { job.pair.dispatch(obj) })
+}
+
+// whether the message of pair from peer rid can be framed for a decode
+// worker, and its size
+func (r *Replica) decodable(rid int, pair *RPCPair) (int, bool) {
+	if r.decoders == nil || r.recvCodecs[rid] != fastrpc.Binary {
+		return 0, false
+	}
+	size := atomic.LoadInt32(&pair.frameSize)
+	if size == 0 {
+		size = fixedBinarySize(pair.Obj)
+		atomic.StoreInt32(&pair.frameSize, size)
+	}
+	return int(size), size > 0
+}
+
+// the size of every message of the type of obj, or -1 if it varies: the
+// BinarySize of obj, unless the type has fields of variable length, or an
+// empty message does not marshal to that size. A frame of the wrong size
+// would desynchronize the connection.
+func fixedBinarySize(obj fastrpc.Serializable) int32 {
+	bs, ok := obj.(binarySizer)
+	if !ok {
+		return -1
+	}
+	size, known := bs.BinarySize()
+	if !known || size <= 0 || variableSize(reflect.TypeOf(obj)) {
+		return -1
+	}
+	var buf bytes.Buffer
+	obj.New().Marshal(&buf)
+	if buf.Len() != size {
+		log.Printf("%T claims a binary size of %d, but marshals to %d bytes; not decoding it on workers\n", obj, size, buf.Len())
+		return -1
+	}
+	return int32(size)
+}
+
+// whether values of type t may marshal to different sizes
+func variableSize(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Array:
+		return variableSize(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if variableSize(t.Field(i).Type) {
+				return true
+			}
+		}
+		return false
+	case reflect.Slice, reflect.String, reflect.Map, reflect.Interface, reflect.Chan, reflect.Func:
+		return true
+	}
+	return false
+}
+
+// the size of the generated messages, if fixed
+type binarySizer interface {
+	BinarySize() (nbytes int, sizeKnown bool)
+}
@@ -0,0 +1,112 @@
+package genericsmr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"sync"
+)
+
+// Over peer sessions (see sessions.go), every message a replica sends to a
+// peer is preceded by a sequence number (a uvarint, starting at 1 and
+// counting up per peer across reconnections), and the receiving replica
+// drops any message whose number it has already seen, or that is older than
+// its window of the latest DEDUP_WINDOW numbers. Protocol handlers can
+// therefore assume that a message is delivered at most once even if it is
+// sent again on a new session. The numbering restarts with the sender's
+// process, which the receiver learns from the boot ID exchanged when a
+// session is established.
+
+const DEDUP_WINDOW = 1024
+
+// the sequence numbers received from one peer
+type dedupWindow struct {
+	lock    *sync.Mutex
+	boot    uint64 // boot ID of the sender the numbers belong to
+	highest uint64 // the highest number received (0 for none)
+	seen    [DEDUP_WINDOW / 64]uint64
+}
+
+func newDedupWindow() *dedupWindow {
+	return &dedupWindow{lock: new(sync.Mutex)}
+}
+
+// start over if the sender has restarted
+func (d *dedupWindow) reset(boot uint64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.boot != boot {
+		*d = dedupWindow{lock: d.lock, boot: boot}
+	}
+}
+
+func (d *dedupWindow) bit(seq uint64) (int, uint64) {
+	i := seq % DEDUP_WINDOW
+	return int(i / 64), 1 << (i % 64)
+}
+
+// accept reports whether seq is new, and records it.
+func (d *dedupWindow) accept(seq uint64) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if seq > d.highest {
+		if seq-d.highest >= DEDUP_WINDOW {
+			d.seen = [DEDUP_WINDOW / 64]uint64{}
+		} else {
+			for s := d.highest + 1; s < seq; s++ {
+				w, b := d.bit(s)
+				d.seen[w] &^= b
+			}
+		}
+		w, b := d.bit(seq)
+		d.seen[w] |= b
+		d.highest = seq
+		return true
+	}
+	if seq == 0 || d.highest-seq >= DEDUP_WINDOW {
+		return false
+	}
+	w, b := d.bit(seq)
+	if d.seen[w]&b != 0 {
+		return false
+	}
+	d.seen[w] |= b
+	return true
+}
+
+// write what precedes every message to a peer: the group ID if the
+// connection is shared by groups, the sequence number over peer sessions;
+// the caller must hold the peer's write lock
+func (r *Replica) writePeerPrefix(w *bufio.Writer, peerId int32) {
+	r.writeGroupPrefix(w)
+	if r.sessions != nil {
+		var b [binary.MaxVarintLen64]byte
+		r.sendSeq[peerId]++
+		w.Write(b[:binary.PutUvarint(b[:], r.sendSeq[peerId])])
+	}
+}
+
+// append the prefix of writePeerPrefix to b
+func (r *Replica) appendPeerPrefix(b []byte, peerId int32) []byte {
+	if r.mux != nil {
+		b = append(b, byte(r.GroupId), byte(r.GroupId>>8))
+	}
+	if r.sessions != nil {
+		var s [binary.MaxVarintLen64]byte
+		r.sendSeq[peerId]++
+		b = append(b, s[:binary.PutUvarint(s[:], r.sendSeq[peerId])]...)
+	}
+	return b
+}
+
+// read the sequence number of a message from a peer, if there is one, and
+// report whether the message should be delivered
+func (r *Replica) readPeerSeq(rid int, reader *bufio.Reader) (bool, error) {
+	if r.sessions == nil {
+		return true, nil
+	}
+	seq, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return false, err
+	}
+	return r.recvSeqs[rid].accept(seq), nil
+}
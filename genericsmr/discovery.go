@@ -0,0 +1,175 @@
+package genericsmr
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/rpc"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A PeerResolver produces the list of peer addresses, ordered by replica ID.
+// Every replica must resolve the same list for the IDs to agree.
+type PeerResolver interface {
+	ResolvePeers() ([]string, error)
+}
+
+type StaticPeers []string
+
+func (sp StaticPeers) ResolvePeers() ([]string, error) {
+	return sp, nil
+}
+
+// SRVPeers resolves peers from the DNS SRV records of _service._proto.name
+// (e.g., a Kubernetes headless service). Replica IDs follow the sorted order
+// of the resulting host:port strings.
+type SRVPeers struct {
+	Service string
+	Proto   string
+	Name    string
+}
+
+func (sp *SRVPeers) ResolvePeers() ([]string, error) {
+	_, srvs, err := net.LookupSRV(sp.Service, sp.Proto, sp.Name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(srvs))
+	for i, srv := range srvs {
+		addrs[i] = net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+var ErrNotEnoughPeers = errors.New("not enough peers discovered")
+
+// SeedPeers discovers peers by gossiping the set of known peer addresses with
+// a list of seed nodes, until Expected peers (including Self) are known.
+// Every node must also serve gossip requests, with ServeGossip.
+type SeedPeers struct {
+	Self     string   // the peer address advertised by this replica
+	Seeds    []string // gossip addresses of the seed nodes
+	Expected int      // the number of replicas in the cluster
+	Timeout  time.Duration
+
+	lock  sync.Mutex
+	known map[string]bool
+}
+
+type GossipArgs struct {
+	Known []string
+}
+
+type GossipReply struct {
+	Known []string
+}
+
+type PeerGossip struct {
+	sp *SeedPeers
+}
+
+func (g *PeerGossip) Exchange(args *GossipArgs, reply *GossipReply) error {
+	reply.Known = g.sp.merge(args.Known)
+	return nil
+}
+
+func (sp *SeedPeers) merge(addrs []string) []string {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if sp.known == nil {
+		sp.known = map[string]bool{sp.Self: true}
+	}
+	for _, a := range addrs {
+		sp.known[a] = true
+	}
+	all := make([]string, 0, len(sp.known))
+	for a := range sp.known {
+		all = append(all, a)
+	}
+	sort.Strings(all)
+	return all
+}
+
+// ServeGossip answers gossip exchanges from other replicas on l.
+func (sp *SeedPeers) ServeGossip(l net.Listener) {
+	server := rpc.NewServer()
+	server.Register(&PeerGossip{sp})
+	server.Accept(l)
+}
+
+func (sp *SeedPeers) ResolvePeers() ([]string, error) {
+	deadline := time.Now().Add(sp.Timeout)
+	for {
+		known := sp.merge(nil)
+		for _, seed := range sp.Seeds {
+			c, err := rpc.Dial("tcp", seed)
+			if err != nil {
+				continue
+			}
+			reply := new(GossipReply)
+			if err = c.Call("PeerGossip.Exchange", &GossipArgs{known}, reply); err == nil {
+				known = sp.merge(reply.Known)
+			}
+			c.Close()
+		}
+		if len(known) >= sp.Expected {
+			return known, nil
+		}
+		if sp.Timeout > 0 && time.Now().After(deadline) {
+			return known, ErrNotEnoughPeers
+		}
+		time.Sleep(1e9)
+	}
+}
+
+// index of addr in a resolved peer list, or -1
+func PeerIndex(peers []string, addr string) int {
+	for i, p := range peers {
+		if p == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// PeerAddr returns the latest known address of a peer.
+func (r *Replica) PeerAddr(i int32) string {
+	r.peerAddrLock.Lock()
+	defer r.peerAddrLock.Unlock()
+	return r.PeerAddrList[i]
+}
+
+// ResolvePeersPeriodically re-resolves the peer list every interval and
+// records address changes (e.g., a rescheduled pod with a new IP), which take
+// effect the next time a connection to that peer is established.
+// The number of replicas cannot change this way.
+func (r *Replica) ResolvePeersPeriodically(res PeerResolver, interval time.Duration) {
+	for !r.Shutdown {
+		time.Sleep(interval)
+		addrs, err := res.ResolvePeers()
+		if err == nil {
+			addrs, err = NormalizePeerAddrList(addrs)
+		}
+		if err != nil {
+			log.Println("Peer re-resolution failed:", err)
+			continue
+		}
+		if len(addrs) != r.N {
+			log.Printf("Ignoring re-resolved peer list with %d entries (expected %d)\n", len(addrs), r.N)
+			continue
+		}
+		r.peerAddrLock.Lock()
+		for i, a := range addrs {
+			if r.PeerAddrList[i] != a {
+				log.Printf("Replica %d address changed: %s -> %s\n", i, r.PeerAddrList[i], a)
+				r.PeerAddrList[i] = a
+			}
+		}
+		r.peerAddrLock.Unlock()
+	}
+}
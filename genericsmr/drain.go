@@ -0,0 +1,60 @@
+package genericsmr
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// how often Drain checks whether the replica's leases are gone
+const DRAIN_POLL_NS = 50 * 1e6
+
+var ErrDrainUnsupported = errors.New("the protocol cannot hand off its leases")
+var ErrDrainTimeout = errors.New("timed out handing off leases")
+
+// LeaseHandoff is implemented by protocols whose replicas can hand off the
+// leases they hold before a planned stop (see Drain).
+type LeaseHandoff interface {
+	// HandOffLeases asks the cluster to stop granting leases to this replica.
+	HandOffLeases() error
+	// HandedOff reports whether the cluster has agreed to.
+	HandedOff() bool
+}
+
+// Drain prepares the replica for a planned stop, e.g. in a rolling restart:
+// the replica stops renewing the leases it grants (the protocol checks
+// Draining), asks the cluster to stop granting it leases, so that the other
+// replicas read locally without it and writes no longer wait for it, and
+// waits until both its own lease and the ones it granted have expired. Once
+// Drain returns nil, stopping the replica interrupts neither local reads nor
+// writes elsewhere. The replica reports itself not ready from the moment
+// Drain is called, and stays drained until it restarts.
+func (r *Replica) Drain(timeout time.Duration) error {
+	if r.Handoff == nil {
+		return ErrDrainUnsupported
+	}
+	if atomic.SwapInt32(&r.draining, 1) == 0 {
+		log.Printf("Replica %d: draining\n", r.Id)
+		if err := r.Handoff.HandOffLeases(); err != nil {
+			return err
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		ql := r.QLease
+		if r.Handoff.HandedOff() && (ql == nil || (!ql.CanRead() && ql.CanWriteOutside())) {
+			log.Printf("Replica %d: drained, safe to stop\n", r.Id)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrDrainTimeout
+		}
+		time.Sleep(DRAIN_POLL_NS)
+	}
+}
+
+// Draining reports whether Drain has been called on the replica.
+func (r *Replica) Draining() bool {
+	return atomic.LoadInt32(&r.draining) != 0
+}
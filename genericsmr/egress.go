@@ -0,0 +1,85 @@
+package genericsmr
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/fastrpc"
+)
+
+// Background transfers (catch-up entries, snapshot chunks, anti-entropy
+// digests and keys) can fill a WAN link to a peer and hold up the lease and
+// consensus messages queued behind them. PARAM_PEER_EGRESS_BYTES_PER_SEC
+// bounds the bytes sent to each peer per second: every message to the peer is
+// charged to its budget, once written, but only the background ones
+// (SendBackgroundMsg and SendMsgStreamed) wait for it, so that they get
+// whatever bandwidth the control and data lanes (see PeerLock) leave under
+// the limit, and those lanes are never throttled. With groups, the budget
+// covers the traffic the group's connections count (see connstats.go).
+
+type egressLimit struct {
+	lock      sync.Mutex // protects bucket and charged, and serializes the background sends
+	bucket    *TokenBucket
+	charged   uint64 // bytes sent to the peer that were charged to the bucket
+	throttled uint64 // background sends held up by the limit
+	waitedNs  int64  // how long, in total
+}
+
+// EgressStats are the counters of the egress limit of a peer.
+type EgressStats struct {
+	Peer      int32
+	Throttled uint64 // background sends held up by the limit
+	WaitedNs  int64  // how long, in total
+}
+
+func newEgressLimits(n int) []*egressLimit {
+	now := time.Now().UnixNano()
+	limits := make([]*egressLimit, n)
+	for i := range limits {
+		limits[i] = &egressLimit{bucket: NewTokenBucket(0, now)}
+	}
+	return limits
+}
+
+// wait until the bytes sent to peer q are within its budget
+func (r *Replica) throttleEgress(q int32) {
+	l := r.egress[q]
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	start := time.Now().UnixNano()
+	l.bucket.SetRate(float64(r.Param(PARAM_PEER_EGRESS_BYTES_PER_SEC)), start)
+	sent := atomic.LoadUint64(&r.peerCounters[q].bytesSent)
+	l.bucket.Charge(float64(sent-l.charged), start)
+	l.charged = sent
+	if !l.bucket.InDebt() {
+		return
+	}
+	atomic.AddUint64(&l.throttled, 1)
+	for !l.bucket.Take(0, time.Now().UnixNano()) && r.PeerAlive(q) {
+		time.Sleep(time.Millisecond)
+	}
+	atomic.AddInt64(&l.waitedNs, time.Now().UnixNano()-start)
+}
+
+// SendBackgroundMsg is SendMsg for background transfers, which first waits for
+// the peer's egress budget.
+func (r *Replica) SendBackgroundMsg(peerId int32, code uint16, msg fastrpc.Serializable) error {
+	if !r.PeerAlive(peerId) {
+		return r.sendFailed(peerId, code, ErrPeerNotAlive)
+	}
+	r.throttleEgress(peerId)
+	return r.SendMsg(peerId, code, msg)
+}
+
+// EgressStats returns the counters of the egress limits of the peers.
+func (r *Replica) EgressStats() []EgressStats {
+	stats := make([]EgressStats, 0, r.N-1)
+	for q, l := range r.egress {
+		if int32(q) == r.Id {
+			continue
+		}
+		stats = append(stats, EgressStats{Peer: int32(q), Throttled: atomic.LoadUint64(&l.throttled), WaitedNs: atomic.LoadInt64(&l.waitedNs)})
+	}
+	return stats
+}
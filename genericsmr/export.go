@@ -0,0 +1,265 @@
+package genericsmr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/state"
+)
+
+// Export dumps the state machine of a replica, for backups, for migrating
+// it to a new cluster, or to seed test fixtures, and Import loads such a
+// dump. An export is a consistent cut: the state with every instance up to
+// some instance executed, and none after it. This needs the protocol to
+// execute committed commands with ExecuteCommand or ExecuteBatch and report
+// instances with StateExecuted (see antientropy.go), and to set StateCuts;
+// the executing goroutine then holds the replica's cut lock from the first
+// command of an instance until it reports it, and Export takes the lock to
+// copy the state between two instances.
+//
+// The format is versioned and independent of the platform, all integers
+// little-endian:
+//
+//	magic "QLSTATE" (7 bytes) | version (2) | replica ID (4) | group ID (2) |
+//	instance of the cut (4; -1 if none) | time of the cut in ns (8) |
+//	count (8) | (key (8) | value (8) | version (8)) x count, in increasing
+//	key order | CRC-32C of everything before it (4)
+//
+// so that two replicas exporting the same cut produce the same entries. The
+// keys keep their versions (see state.Version), which conditional writes
+// check; exports of version 1 had none, and their keys are imported at
+// version 1.
+
+const EXPORT_VERSION = 2
+
+var exportMagic = []byte("QLSTATE")
+
+const EXPORT_HEADER_SIZE = 7 + 2 + 4 + 2 + 4 + 8 + 8
+
+var ErrExportUnsupported = errors.New("the protocol cannot take consistent cuts of its state")
+var ErrImportAfterExecute = errors.New("cannot import into a replica that has executed commands")
+var ErrNotAnExport = errors.New("not a state export")
+
+// StateExportInfo describes an export.
+type StateExportInfo struct {
+	Version   uint16
+	ReplicaId int32
+	GroupId   uint16
+	Inst      int32 // every instance up to this one is in the export (-1 if none)
+	TimeNs    int64
+	Keys      uint64
+}
+
+// serializes the executing goroutine's instances with Export and Import
+type stateCut struct {
+	lock sync.Mutex
+	held bool // owned by the executing goroutine
+}
+
+// the executing goroutine is about to execute a command
+func (r *Replica) beginCut() {
+	if !r.cut.held {
+		r.cut.lock.Lock()
+		r.cut.held = true
+	}
+}
+
+// the executing goroutine has executed an instance
+func (r *Replica) endCut() {
+	if r.cut.held {
+		r.cut.held = false
+		r.cut.lock.Unlock()
+	}
+}
+
+// Export writes a consistent cut of the replica's state machine to w, and
+// describes it. It snapshots the state between two instances (see
+// state.Snapshot), and writes the snapshot without holding up execution.
+func (r *Replica) Export(w io.Writer) (*StateExportInfo, error) {
+	if !r.StateCuts {
+		return nil, ErrExportUnsupported
+	}
+	r.cut.lock.Lock()
+	r.antiEntropy.lock.Lock()
+	info := &StateExportInfo{
+		Version:   EXPORT_VERSION,
+		ReplicaId: r.Id,
+		GroupId:   r.GroupId,
+		Inst:      r.antiEntropy.executed,
+		TimeNs:    time.Now().UnixNano(),
+	}
+	r.antiEntropy.lock.Unlock()
+	snap := r.State.Snapshot()
+	r.cut.lock.Unlock()
+	keys := make([]state.Key, 0, snap.Len())
+	snap.Range(func(k state.Key, v state.Value) bool {
+		keys = append(keys, k)
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	info.Keys = uint64(len(keys))
+
+	crc := crc32.New(snapshotTable)
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	var b [EXPORT_HEADER_SIZE]byte
+	copy(b[0:7], exportMagic)
+	binary.LittleEndian.PutUint16(b[7:9], info.Version)
+	binary.LittleEndian.PutUint32(b[9:13], uint32(info.ReplicaId))
+	binary.LittleEndian.PutUint16(b[13:15], info.GroupId)
+	binary.LittleEndian.PutUint32(b[15:19], uint32(info.Inst))
+	binary.LittleEndian.PutUint64(b[19:27], uint64(info.TimeNs))
+	binary.LittleEndian.PutUint64(b[27:35], info.Keys)
+	bw.Write(b[:])
+	for _, k := range keys {
+		binary.LittleEndian.PutUint64(b[0:8], uint64(k))
+		v, _ := snap.Get(k)
+		binary.LittleEndian.PutUint64(b[8:16], uint64(v))
+		binary.LittleEndian.PutUint64(b[16:24], snap.Version(k))
+		bw.Write(b[:24])
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(b[0:4], crc.Sum32())
+	if _, err := w.Write(b[:4]); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ExportFile exports the replica's state to the file at path, which only
+// appears, or is replaced, once the export is complete and synced.
+func (r *Replica) ExportFile(path string) (*StateExportInfo, error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	info, err := r.Export(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return info, nil
+}
+
+// ImportFile imports the export in the file at path (see Import).
+func (r *Replica) ImportFile(path string) (*StateExportInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return r.Import(f)
+}
+
+// readExport reads and checks an export, without loading it anywhere.
+func readExport(rd io.Reader) (*StateExportInfo, map[state.Key]state.Entry, error) {
+	crc := crc32.New(snapshotTable)
+	br := io.TeeReader(bufio.NewReader(rd), crc)
+	var b [EXPORT_HEADER_SIZE]byte
+	if _, err := io.ReadFull(br, b[:]); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(b[0:7], exportMagic) {
+		return nil, nil, ErrNotAnExport
+	}
+	info := &StateExportInfo{
+		Version:   binary.LittleEndian.Uint16(b[7:9]),
+		ReplicaId: int32(binary.LittleEndian.Uint32(b[9:13])),
+		GroupId:   binary.LittleEndian.Uint16(b[13:15]),
+		Inst:      int32(binary.LittleEndian.Uint32(b[15:19])),
+		TimeNs:    int64(binary.LittleEndian.Uint64(b[19:27])),
+		Keys:      binary.LittleEndian.Uint64(b[27:35]),
+	}
+	entrySize := 24
+	if info.Version == 1 {
+		entrySize = 16
+	} else if info.Version != EXPORT_VERSION {
+		return nil, nil, fmt.Errorf("state export of version %d, not %d", info.Version, EXPORT_VERSION)
+	}
+	store := make(map[state.Key]state.Entry)
+	for i := uint64(0); i < info.Keys; i++ {
+		if _, err := io.ReadFull(br, b[:entrySize]); err != nil {
+			return nil, nil, err
+		}
+		e := state.Entry{Value: state.Value(binary.LittleEndian.Uint64(b[8:16])), Version: 1}
+		if entrySize == 24 {
+			e.Version = binary.LittleEndian.Uint64(b[16:24])
+		}
+		store[state.Key(binary.LittleEndian.Uint64(b[0:8]))] = e
+	}
+	sum := crc.Sum32()
+	if _, err := io.ReadFull(br, b[:4]); err != nil {
+		return nil, nil, err
+	}
+	if binary.LittleEndian.Uint32(b[0:4]) != sum {
+		return nil, nil, errors.New("state export is corrupt (checksum mismatch)")
+	}
+	return info, store, nil
+}
+
+// Import replaces the replica's state machine with the export read from rd,
+// and describes it. The replica must not have executed anything yet (e.g.,
+// it is the replica of a new cluster, which every replica must then be
+// seeded with the same export before clients connect); nothing is changed
+// unless the whole export reads back intact.
+func (r *Replica) Import(rd io.Reader) (*StateExportInfo, error) {
+	if !r.StateCuts {
+		return nil, ErrExportUnsupported
+	}
+	info, store, err := readExport(rd)
+	if err != nil {
+		return nil, err
+	}
+	r.cut.lock.Lock()
+	defer r.cut.lock.Unlock()
+	ae := r.antiEntropy
+	ae.lock.Lock()
+	executed := ae.executed
+	ae.lock.Unlock()
+	if executed >= 0 || r.State.Len() > 0 {
+		return nil, ErrImportAfterExecute
+	}
+	r.State.Replace(store)
+	// rebuilt from the new state with the first instance executed
+	ae.leaves = nil
+	log.Printf("Replica %d: imported %d keys exported by replica %d at instance %d\n", r.Id, info.Keys, info.ReplicaId, info.Inst)
+	return info, nil
+}
+
+/* Admin RPC */
+
+// ExportState exports the replica's state to a file of its own, at
+// args.Path.
+func (r *Replica) ExportState(args *genericsmrproto.ExportStateArgs, reply *genericsmrproto.ExportStateReply) error {
+	info, err := r.ExportFile(args.Path)
+	if err != nil {
+		r.Audit(AUDIT_ADMIN, "ExportState to %s: %v", args.Path, err)
+		return err
+	}
+	r.Audit(AUDIT_ADMIN, "ExportState to %s: %d keys at instance %d", args.Path, info.Keys, info.Inst)
+	reply.Inst = info.Inst
+	reply.Keys = info.Keys
+	return nil
+}
@@ -0,0 +1,243 @@
+package genericsmr
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Faults injects network failures between a replica and its peers, for
+// testing (e.g., qlease-cluster's chaos mode): the messages arriving from a
+// partitioned peer are dropped, as if they never arrived (they do not count
+// as hearing from the peer, so pings and beacons time out), and those from a
+// delayed peer are handed to the protocol only once the given latency has
+// passed since they arrived, in order. Faults act on the receiving side: to
+// cut the link between two replicas both ways, partition each from the
+// other. The replicas of one process (e.g., a Paxos replica and its
+// Lease-Paxos replica) share one Faults. Client connections are not
+// affected.
+type Faults struct {
+	lock    sync.Mutex
+	dropped []bool
+	delays  []time.Duration
+	active  int32 // 1 if any fault is set, so that replicas without any skip the lock
+}
+
+// the capacity of the queue of delayed messages from each peer, beyond which
+// the peer's listener waits
+const FAULT_QUEUE_SIZE = 10000
+
+func NewFaults(n int) *Faults {
+	return &Faults{dropped: make([]bool, n), delays: make([]time.Duration, n)}
+}
+
+// Partition drops (on) or stops dropping (!on) the messages from peer q.
+func (f *Faults) Partition(q int32, on bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.dropped[q] = on
+	f.update()
+}
+
+// SetLatency delays the messages from peer q by d (0 for no delay).
+func (f *Faults) SetLatency(q int32, d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.delays[q] = d
+	f.update()
+}
+
+// Heal removes every fault.
+func (f *Faults) Heal() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for q := range f.dropped {
+		f.dropped[q] = false
+		f.delays[q] = 0
+	}
+	f.update()
+}
+
+// with f.lock held
+func (f *Faults) update() {
+	var active int32
+	for q := range f.dropped {
+		if f.dropped[q] || f.delays[q] > 0 {
+			active = 1
+		}
+	}
+	atomic.StoreInt32(&f.active, active)
+}
+
+// Dropped reports whether the messages from peer q are dropped.
+func (f *Faults) Dropped(q int32) bool {
+	if f == nil || atomic.LoadInt32(&f.active) == 0 {
+		return false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.dropped[q]
+}
+
+// Latency returns the delay of the messages from peer q.
+func (f *Faults) Latency(q int32) time.Duration {
+	if f == nil || atomic.LoadInt32(&f.active) == 0 {
+		return 0
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.delays[q]
+}
+
+func (f *Faults) String() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var faults []string
+	for q := range f.dropped {
+		if f.dropped[q] {
+			faults = append(faults, fmt.Sprintf("from %d: dropped", q))
+		} else if f.delays[q] > 0 {
+			faults = append(faults, fmt.Sprintf("from %d: delayed %v", q, f.delays[q]))
+		}
+	}
+	if len(faults) == 0 {
+		return "no faults"
+	}
+	return strings.Join(faults, "\n")
+}
+
+// a message from a peer, held back until due
+type delayedMsg struct {
+	due     time.Time
+	deliver func()
+}
+
+// the replica's queues of delayed messages, one per peer, started when first
+// needed
+type faultQueues struct {
+	lock    sync.Mutex
+	queues  []chan delayedMsg
+	pending []int32 // per peer, messages queued and not yet delivered
+}
+
+func newFaultQueues(n int) *faultQueues {
+	return &faultQueues{queues: make([]chan delayedMsg, n), pending: make([]int32, n)}
+}
+
+// hand a message from peer rid to the protocol, once the latency injected
+// on its link has passed; messages from a peer are delivered in the order
+// they arrived, whatever the latency when they did
+func (r *Replica) deliverFromPeer(rid int, deliver func()) {
+	if dp := r.decoders; dp != nil {
+		// behind the messages from the peer that are still being decoded
+		dp.inOrder(rid, deliver)
+		return
+	}
+	r.deliverAfterFaults(rid, deliver)
+}
+
+func (r *Replica) deliverAfterFaults(rid int, deliver func()) {
+	fq := r.faultQueues
+	if fq == nil {
+		deliver()
+		return
+	}
+	d := r.cfg.Faults.Latency(int32(rid))
+	if d == 0 && atomic.LoadInt32(&fq.pending[rid]) == 0 {
+		deliver()
+		return
+	}
+	fq.lock.Lock()
+	queue := fq.queues[rid]
+	if queue == nil {
+		queue = make(chan delayedMsg, FAULT_QUEUE_SIZE)
+		fq.queues[rid] = queue
+		r.Tasks.Go(fmt.Sprintf("delayed messages from replica %d", rid), RESTART_ON_PANIC, func() error {
+			for m := range queue {
+				time.Sleep(time.Until(m.due))
+				m.deliver()
+				atomic.AddInt32(&fq.pending[rid], -1)
+			}
+			return nil
+		})
+	}
+	atomic.AddInt32(&fq.pending[rid], 1)
+	fq.lock.Unlock()
+	queue <- delayedMsg{time.Now().Add(d), deliver}
+}
+
+// HandleFaults serves /faults on mux, to inject failures in f remotely (for
+// testing only: anyone who can reach mux can partition the replica):
+//
+//	/faults                          show the faults
+//	/faults?drop=1,2                 drop the messages from peers 1 and 2 (only)
+//	/faults?drop=                    stop dropping messages
+//	/faults?delay=50ms&peers=1,2     delay the messages from peers 1 and 2 (all if no peers)
+//	/faults?heal                     remove every fault
+func HandleFaults(mux *http.ServeMux, f *Faults) {
+	mux.HandleFunc("/faults", func(w http.ResponseWriter, req *http.Request) {
+		if err := f.apply(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, f)
+	})
+}
+
+func (f *Faults) apply(req *http.Request) error {
+	q := req.URL.Query()
+	if _, ok := q["heal"]; ok {
+		f.Heal()
+	}
+	if drop, ok := q["drop"]; ok {
+		peers, err := f.parsePeers(drop[0], false)
+		if err != nil {
+			return err
+		}
+		for p := range f.dropped {
+			f.Partition(int32(p), false)
+		}
+		for _, p := range peers {
+			f.Partition(p, true)
+		}
+	}
+	if delay := q.Get("delay"); delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil || d < 0 {
+			return fmt.Errorf("bad delay %q", delay)
+		}
+		peers, err := f.parsePeers(q.Get("peers"), true)
+		if err != nil {
+			return err
+		}
+		for _, p := range peers {
+			f.SetLatency(p, d)
+		}
+	}
+	return nil
+}
+
+// parse a comma-separated list of peers (all of them if empty and all)
+func (f *Faults) parsePeers(list string, all bool) ([]int32, error) {
+	var peers []int32
+	if list == "" {
+		if all {
+			for p := range f.dropped {
+				peers = append(peers, int32(p))
+			}
+		}
+		return peers, nil
+	}
+	for _, s := range strings.Split(list, ",") {
+		p, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || p < 0 || p >= len(f.dropped) {
+			return nil, fmt.Errorf("no replica %q", s)
+		}
+		peers = append(peers, int32(p))
+	}
+	return peers, nil
+}
@@ -0,0 +1,191 @@
+package genericsmr
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/state"
+)
+
+// A replica that does not lead can hand a client's proposal to one that does
+// with ForwardPropose: the proposal reaches the other replica's ProposeChan
+// with FwdReplica and FwdId set and no Writer, and when the protocol there
+// replies to it with ReplyProposeTS, the reply goes back to the forwarding
+// replica, which relays it to the client. Until then, the forwarding replica
+// keeps the proposal in its table of forwards, by FwdId, with FwdReplica set
+// to its own ID; if its protocol answers the client first (e.g., after direct
+// acks), the reply that comes back later is dropped. A forward delivered
+// twice is proposed once (see DuplicateForward), and a proposal forwarded
+// again (e.g., to a new leader) keeps its FwdId, so that its client gets
+// whichever reply comes back first, and only that one. A forward that gets
+// no reply within the forward timeout (see WithForwardTimeout), or whose
+// replica is found dead, is answered ERR_TIMEOUT and dropped from the table.
+
+const FORWARD_CHAN_SIZE = 10000
+
+// how long a forwarded proposal waits for its reply, by default
+const FORWARD_TIMEOUT_NS = RESULT_PENDING_TIMEOUT_NS
+
+// how often forwards are checked for expiry
+const FORWARD_EXPIRY_INTERVAL_NS = 100 * 1e6
+
+type forward struct {
+	p     *Propose
+	to    int32 // the replica it was last forwarded to
+	since int64 // when
+}
+
+type forwards struct {
+	lock    *sync.Mutex
+	lastId  int32
+	pending map[int32]*forward
+	expired uint64 // forwards answered ERR_TIMEOUT
+}
+
+func newForwards() *forwards {
+	return &forwards{
+		lock: new(sync.Mutex),
+		// forward IDs must not repeat across restarts (see DuplicateForward)
+		lastId:  int32(time.Now().UnixNano()),
+		pending: make(map[int32]*forward),
+	}
+}
+
+// ForwardPropose sends a client's proposal to replica to, and relays the
+// reply to the client once it comes back. A proposal that another replica
+// forwarded here is sent on as that replica's, so that the reply goes
+// straight back to it.
+func (r *Replica) ForwardPropose(to int32, p *Propose) error {
+	if r.DropExpired(p) {
+		return nil
+	}
+	if p.FwdReplica >= 0 && p.FwdReplica != r.Id {
+		return r.SendMsg(to, r.forwardProposeRPC,
+			&genericsmrproto.ForwardPropose{ReplicaId: p.FwdReplica, FwdId: p.FwdId, TimeoutNs: r.timeLeft(p), Priority: p.Priority, Propose: *p.Propose})
+	}
+	r.fwds.lock.Lock()
+	again := p.FwdReplica == r.Id && r.fwds.pending[p.FwdId] != nil
+	if !again {
+		p.FwdReplica, p.FwdId = r.Id, atomic.AddInt32(&r.fwds.lastId, 1)
+	}
+	// forwarded again, e.g. to a new leader: under the same ID
+	id := p.FwdId
+	r.fwds.pending[id] = &forward{p, to, time.Now().UnixNano()}
+	r.fwds.lock.Unlock()
+	err := r.SendMsg(to, r.forwardProposeRPC,
+		&genericsmrproto.ForwardPropose{ReplicaId: r.Id, FwdId: id, TimeoutNs: r.timeLeft(p), Priority: p.Priority, Propose: *p.Propose})
+	if err != nil && !again {
+		r.takeForward(id)
+		p.FwdReplica, p.FwdId = -1, -1
+	}
+	return err
+}
+
+// Forwarded returns the proposal this replica forwarded as fwdId, until the
+// client has been answered (nil afterwards).
+func (r *Replica) Forwarded(fwdId int32) *Propose {
+	r.fwds.lock.Lock()
+	defer r.fwds.lock.Unlock()
+	if f := r.fwds.pending[fwdId]; f != nil {
+		return f.p
+	}
+	return nil
+}
+
+// take a forwarded proposal out of the table, to answer its client; nil if
+// the client has been answered already
+func (r *Replica) takeForward(fwdId int32) *Propose {
+	r.fwds.lock.Lock()
+	defer r.fwds.lock.Unlock()
+	f := r.fwds.pending[fwdId]
+	if f == nil {
+		return nil
+	}
+	delete(r.fwds.pending, fwdId)
+	return f.p
+}
+
+// ForwardsPending returns how many forwarded proposals await their replies,
+// and how many were answered ERR_TIMEOUT instead.
+func (r *Replica) ForwardsPending() (pending int, expired uint64) {
+	r.fwds.lock.Lock()
+	defer r.fwds.lock.Unlock()
+	return len(r.fwds.pending), r.fwds.expired
+}
+
+// answer ERR_TIMEOUT to the forwards that have waited too long for their
+// replies, whose replica died, or whose client gave up on them
+func (r *Replica) expireForwards() {
+	timeout := r.cfg.ForwardTimeoutNs
+	if timeout <= 0 {
+		timeout = FORWARD_TIMEOUT_NS
+	}
+	now := time.Now().UnixNano()
+	var expired []*forward
+	r.fwds.lock.Lock()
+	for id, f := range r.fwds.pending {
+		if now-f.since > timeout || !r.PeerAlive(f.to) || r.pastDeadline(f.p) {
+			delete(r.fwds.pending, id)
+			expired = append(expired, f)
+		}
+	}
+	r.fwds.expired += uint64(len(expired))
+	r.fwds.lock.Unlock()
+	for _, f := range expired {
+		r.replyClient(&genericsmrproto.ProposeReplyTS{
+			OK:        FALSE,
+			CommandId: f.p.CommandId,
+			Value:     state.NIL,
+			Timestamp: f.p.Timestamp,
+			ErrCode:   genericsmrproto.ERR_TIMEOUT,
+			ErrMsg:    fmt.Sprintf("no reply from replica %d, which the proposal was forwarded to", f.to)},
+			f.p, false)
+	}
+}
+
+// send the reply to a proposal that another replica forwarded back to it
+func (r *Replica) relayReply(reply *genericsmrproto.ProposeReplyTS, p *Propose) {
+	if r.pastDeadline(p) {
+		atomic.AddUint64(&r.deadlineDropped, 1)
+		return
+	}
+	if reply.OK == TRUE && reply.HLC == 0 {
+		reply.HLC = r.HLC.Now()
+	}
+	r.SendMsg(p.FwdReplica, r.forwardProposeReplyRPC, &genericsmrproto.ForwardProposeReply{FwdId: p.FwdId, ProposeReplyTS: *reply})
+}
+
+// propose what peers forward, and relay the replies to what this replica
+// forwarded to its clients
+func (r *Replica) serveForwards(props chan fastrpc.Serializable, replies chan fastrpc.Serializable) {
+	expiry := time.NewTicker(FORWARD_EXPIRY_INTERVAL_NS)
+	defer expiry.Stop()
+	for !r.Shutdown {
+		select {
+		case <-expiry.C:
+			r.expireForwards()
+		case m := <-props:
+			fp := m.(*genericsmrproto.ForwardPropose)
+			if r.DuplicateForward(fp.ReplicaId, fp.FwdId) {
+				break
+			}
+			r.schedule(&Propose{&fp.Propose, fp.ReplicaId, fp.FwdId, nil, nil, nil, 0, r.deadlineIn(fp.TimeoutNs), fp.Priority, r.Clock.Nanos(), 0})
+		case m := <-replies:
+			fr := m.(*genericsmrproto.ForwardProposeReply)
+			p := r.takeForward(fr.FwdId)
+			if p == nil {
+				break
+			}
+			reply := fr.ProposeReplyTS
+			reply.CommandId, reply.Timestamp = p.CommandId, p.Timestamp
+			if reply.HLC > 0 {
+				r.HLC.Update(reply.HLC)
+			}
+			r.replyClient(&reply, p, false)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package genericsmr
 
 import (
 	"bufio"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -11,13 +10,15 @@ import (
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/glycerine/qlease/cheaptime"
 	"github.com/glycerine/qlease/fastrpc"
 	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/hlc"
 	"github.com/glycerine/qlease/qlease"
 	"github.com/glycerine/qlease/qleaseproto"
-	"github.com/glycerine/qlease/rdtsc"
 	"github.com/glycerine/qlease/state"
 )
 
@@ -30,15 +31,30 @@ const (
 
 type RPCPair struct {
 	Obj  fastrpc.Serializable
-	Chan chan fastrpc.Serializable
+	Chan chan fastrpc.Serializable // nil for typed RPCs and handlers (see typedrpc.go)
+
+	put       func(fastrpc.Serializable)      // deliver, waiting for room
+	offer     func(fastrpc.Serializable) bool // deliver if there is room
+	evict     func() bool                     // drop the oldest undelivered message, if any
+	depth     func() (int, int)               // length and capacity of the queue
+	policy    uint32                          // OverflowPolicy, accessed atomically
+	dropped   uint64                          // accessed atomically
+	unordered uint32                          // set if its messages may be delivered out of order (see decodepool.go)
+	frameSize int32                           // size framed for decode workers, -1 if not fixed, 0 if not yet known (accessed atomically)
 }
 
 type Propose struct {
 	*genericsmrproto.Propose
-	FwdReplica int32
-	FwdId      int32
-	Writer     *bufio.Writer
-	Lock       *sync.Mutex
+	FwdReplica  int32 // the replica that forwarded the proposal, or -1 (see forward.go)
+	FwdId       int32 // the forwarding replica's ID for the proposal
+	Writer      *bufio.Writer
+	Lock        *sync.Mutex
+	Replies     *ReplyQueue // flushes the replies to the client (nil to flush each reply right away)
+	Session     uint64      // the client session, whose results are remembered (0 for none; see resultcache.go)
+	Deadline    int64       // when the client gives up on it, by the replica's clock (0 for none; see clientdeadline.go)
+	Priority    uint8       // its priority class (genericsmrproto.PRIORITY_*; see priority.go)
+	ReceivedNs  int64       // when the replica received it, by its TimeSource (0 if not from a client; see latency.go)
+	CommittedNs int64       // when the protocol committed it (0 until then; accessed atomically)
 }
 
 type Beacon struct {
@@ -47,20 +63,23 @@ type Beacon struct {
 }
 
 type Replica struct {
-	N            int        // total number of replicas
-	Id           int32      // the ID of the current replica
-	PeerAddrList []string   // array with the IP:port address of every replica
+	N            int      // total number of replicas
+	Id           int32    // the ID of the current replica
+	PeerAddrList []string // array with the IP:port address of every replica
+	peerAddrLock *sync.Mutex
 	Peers        []net.Conn // cache of connections to all other replicas
 	PeerReaders  []*bufio.Reader
 	PeerWriters  []*bufio.Writer
-	PeerWLocks   []*sync.Mutex
-	Alive        []bool // connection status
+	PeerWLocks   []*PeerLock
+	PeerStates   *PeerStates // connection status of each peer (see peerstate.go)
 	Listener     net.Listener
 
 	State *state.State
 
-	ProposeChan chan *Propose // channel for client proposals
-	BeaconChan  chan *Beacon  // channel for beacons from peer replicas
+	ProposeChan     chan *Propose            // channel for client proposals
+	BeaconChan      chan *Beacon             // channel for beacons from peer replicas
+	ClientLeaseChan chan *ClientLeaseRequest // channel for client sub-lease requests
+	ClientLeases    *ClientLeaseTable        // sub-leases granted to clients
 
 	Shutdown bool
 
@@ -68,90 +87,437 @@ type Replica struct {
 	Exec    bool // execute commands?
 	Dreply  bool // reply to client after command has been executed?
 	Beacon  bool // send beacons to detect how fast are the other replicas?
+	Beacons *BeaconManager
 
 	Durable     bool     // log to a stable store?
 	StableStore *os.File // file support for the persistent log
+	stableLock  *sync.Mutex
 
-	PreferredPeerOrder []int32 // replicas in the preferred order of communication
+	PreferredPeerOrder []int32    // replicas in the preferred order of communication
+	slowPeers          *slowPeers // peers shed from the preferred quorum (see shedding.go)
 
 	QLease                *qlease.Lease             // the latest quorum lease (nil if not initialized)
 	QLPromiseChan         chan fastrpc.Serializable // channel for incoming quorum read lease promises
 	QLPromiseReplyChan    chan fastrpc.Serializable // channel for incoming quorum read lease promise-replies
-	qleasePromiseRPC      uint8
-	qleasePromiseReplyRPC uint8
+	qleasePromiseRPC      uint16
+	qleasePromiseReplyRPC uint16
 	QLGuardChan           chan fastrpc.Serializable
 	QLGuardReplyChan      chan fastrpc.Serializable
-	qleaseGuardRPC        uint8
-	qleaseGuardReplyRPC   uint8
+	qleaseGuardRPC        uint16
+	qleaseGuardReplyRPC   uint16
+	QLRegionLeaseChan     chan fastrpc.Serializable // sub-grants from the delegate of the replica's region (see regionlease.go)
+	regionLease           *regionLease
+	regionLeaseRequestRPC uint16
+	regionLeaseRPC        uint16
+	leaseIdle             *leaseIdle
+	leaseIdleRPC          uint16
+	configPush            *configPush     // client connections subscribed to configuration updates
+	deadlineDropped       uint64          // client proposals dropped, or replies not sent, past their deadlines (accessed atomically)
+	priorities            *priorityQueues // client proposals waiting for the protocol, by priority class (nil without priority scheduling)
+	readStats             *readStats      // client reads by how they were served (see readstats.go)
+	execResults           []state.Entry   // the results of the batch last executed, which only the executing goroutine touches
+
+	RequestEntriesChan chan fastrpc.Serializable // requests for committed instances from lagging peers
+	EntriesChan        chan fastrpc.Serializable // committed instances sent by peers while catching up
+	requestEntriesRPC  uint16
+	entriesRPC         uint16
+
+	Snapshots          Snapshotter // the snapshots peers may fetch (nil if unsupported; see snapshot.go)
+	snaps              *snapshots
+	requestSnapshotRPC uint16
+	snapshotChunkRPC   uint16
+
+	Log                LogState // the protocol's log, for ReadStrict (nil if unsupported)
+	qreads             *quorumReads
+	quorumReadRPC      uint16
+	quorumReadReplyRPC uint16
+
+	rindexes          *readIndexes // read index reads in progress (see readindex.go)
+	readIndexRPC      uint16
+	readIndexReplyRPC uint16
+	leaderChecks      *QuorumRPC[*genericsmrproto.LeaderCheck, *genericsmrproto.LeaderCheckReply]
+
+	fwds                   *forwards // proposals forwarded to other replicas, awaiting replies (see forward.go)
+	forwardProposeRPC      uint16
+	forwardProposeReplyRPC uint16
+
+	antiEntropy         *antiEntropy // digests of the state, compared with the peers' (see antientropy.go)
+	stateDigestRPC      uint16
+	stateDigestReplyRPC uint16
+	stateKeysRPC        uint16
+	stateKeysReplyRPC   uint16
+
+	clocks             *clocks        // estimates of the peers' lease clocks (see clocks.go)
+	egress             []*egressLimit // per peer, the budget of background sends (see egress.go)
+	clockProbeRPC      uint16
+	clockProbeReplyRPC uint16
+
+	StateCuts bool       // the protocol executes through ExecuteCommand and StateExecuted, so Export can take consistent cuts
+	cut       stateCut   // held by the executing goroutine during an instance (see export.go)
+	backups   *backups   // nil if the replica takes no backups (see backup.go)
+	admission *admission // the commit backlog, which bounds client proposals (see admission.go)
+
+	applyNotify *applyNotify // who to tell about executed commands (see applynotify.go)
+
+	results *resultCache // recent results of client sessions (nil if not remembered; see resultcache.go)
+
+	Handoff  LeaseHandoff // hands off the replica's leases, for Drain (nil if unsupported)
+	draining int32        // set once Drain is called (see drain.go)
+	readOnly int32        // set in read-only mode (see readonly.go)
+
+	stateMemory *stateMemory // the limit on the size of the state (see statememory.go)
+	latencies   latencies    // the time client proposals take, by stage (see latency.go)
+
+	Updating *UpdatingKeys // keys being updated (i.e., the current replica has received a
+	// (Pre)Accept, for an update on that key, but not yet executed it)
+
+	rpcTable map[uint16]*RPCPair
+	rpcCode  uint16
+
+	extendedCodes []bool // per peer, does it understand RPC codes above the single-byte range?
+
+	peerCounters []*connCounters // per peer, the traffic of its connections (see connstats.go)
+
+	peerHeard []int64 // per peer, time (ns) anything last arrived from it, if pinging peers (see keepalive.go)
+
+	leaseRejoined []int32 // per peer, 1 if it was dead since its leases were last renewed (see peerstate.go)
+
+	sessions    []*peerSession // per peer, the session carrying the connection (nil without peer sessions)
+	ctlLanes    []*ctlLane     // per peer, the control lane of the connection, if any (protected by sessionLock; see ctllane.go)
+	sessionLock *sync.Mutex
+	acceptOnce  sync.Once
+	listening   bool           // the peers' listeners are started (protected by sessionLock)
+	bootId      uint64         // tells this process from earlier ones, to peers numbering its messages
+	sendSeq     []uint64       // per peer, the sequence number of the latest message sent (see dedup.go)
+	recvSeqs    []*dedupWindow // per peer, the sequence numbers received
+
+	chunkRPC     uint16                 // code of the chunks of streamed messages
+	codecRPC     uint16                 // code of the switches to another codec (see codec.go)
+	piggybackRPC uint16                 // code of the messages carrying lease messages (see piggyback.go)
+	sendCodecs   []fastrpc.Codec        // per peer, the codec of the messages sent to it
+	recvCodecs   []fastrpc.Codec        // per peer, the codec of the messages received from it
+	streamId     uint32                 // ID of the latest stream sent
+	reassemblers []*fastrpc.Reassembler // per peer, streamed messages being received
+	decoders     *decodePool            // decode the messages from peers off their readers (nil if not; see decodepool.go)
+
+	sendErrHandler atomic.Value // the *SendErrorHandler of failed sends (see senderr.go)
+
+	Ewma  []float64            // per peer, the moving average of the beacon round-trip time, in ns
+	Clock cheaptime.TimeSource // times the beacons
+	HLC   *hlc.Clock           // stamps the replies to clients (shared by the groups of a GroupMux)
+
+	tracer *tracer // records inbound messages (nil if not tracing)
+
+	OnClientConnect    chan bool
+	OnClientDisconnect chan ClientInfo // best effort: notifications are dropped if nobody reads them
+	Clients            *ClientTable    // open client connections
+	Tasks              *Supervisor     // runs the replica's goroutines (see supervisor.go)
+	cork               *replyCork
 
-	Updating map[state.Key]bool // set of keys being updated (i.e., the current replica has received a
-	// (Pre)Accept, for an update on that key, but not yet a Commit
+	LastReplyReceivedTimestamp []int64
 
-	rpcTable map[uint8]*RPCPair
-	rpcCode  uint8
+	ACL           *ACL          // per-key access control for clients (nil to allow everything)
+	Authenticator Authenticator // verifies client identities (nil to trust them as claimed)
 
-	Ewma []float64
+	cfg *Config // the configuration this replica was constructed from
 
-	OnClientConnect chan bool
+	params         [NUM_PARAMS]int64 // runtime-tunable parameters (see params.go)
+	paramRecovered [NUM_PARAMS]bool
 
-	LastReplyReceivedTimestamp []int64
+	GroupId uint16    // the SMR group this replica belongs to, if it shares a GroupMux
+	mux     *GroupMux // nil if the replica has its own connections
+
+	Recovered    *Recovered    // state found in the stable store at startup (nil if none)
+	Incarnation  int64         // number of times this replica has started from its stable store
+	recovering   int32         // set while the protocol restores the log it had before a restart (see health.go)
+	leaseHorizon int64         // until when the promises sent may be in effect, as recorded (see leasewal.go)
+	epochLimit   uint32        // the lease epochs below it are reserved, as recorded (see leasewal.go)
+	writeHorizon int64         // QLease.WriteInQuorumUntil, for WaitForWriteQuorumSafe (accessed atomically)
+	grace        *startupGrace // the lease's startup grace period (nil if none, see startupgrace.go)
+	faultQueues  *faultQueues  // messages held back by injected latency (nil without Faults, see faults.go)
+	piggybacks   *piggybacks   // lease messages waiting for a message to ride on (nil unless PiggybackLeases)
+	renewals     *renewals     // when to renew the lease next (see renewals.go)
+
+	propose ProposeHandler // the middleware chain ending in ProposeChan (see middleware.go)
 }
 
 func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool) *Replica {
+	return NewReplicaWithOptions(id, peerAddrList, WithThrifty(thrifty), WithExec(exec), WithDreply(dreply))
+}
+
+func NewReplicaWithOptions(id int, peerAddrList []string, opts ...Option) *Replica {
+	cfg := DefaultConfig(id, peerAddrList)
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return NewReplicaFromConfig(cfg)
+}
+
+func NewReplicaFromConfig(cfg *Config) *Replica {
+	n := len(cfg.PeerAddrList)
+	peerAddrList, err := NormalizePeerAddrList(cfg.PeerAddrList)
+	if err != nil {
+		log.Fatal(err)
+	}
 	r := &Replica{
-		len(peerAddrList),
-		int32(id),
-		peerAddrList,
-		make([]net.Conn, len(peerAddrList)),
-		make([]*bufio.Reader, len(peerAddrList)),
-		make([]*bufio.Writer, len(peerAddrList)),
-		make([]*sync.Mutex, len(peerAddrList)),
-		make([]bool, len(peerAddrList)),
-		nil,
-		state.InitState(),
-		make(chan *Propose, CHAN_BUFFER_SIZE),
-		make(chan *Beacon, CHAN_BUFFER_SIZE),
-		false,
-		thrifty,
-		exec,
-		dreply,
-		false,
-		false,
-		nil,
-		make([]int32, len(peerAddrList)),
-		nil,
-		make(chan fastrpc.Serializable, 1000),
-		make(chan fastrpc.Serializable, 1000),
-		0,
-		0,
-		make(chan fastrpc.Serializable, 1000),
-		make(chan fastrpc.Serializable, 1000),
-		0,
-		0,
-		make(map[state.Key]bool, 10000),
-		make(map[uint8]*RPCPair),
-		genericsmrproto.GENERIC_SMR_BEACON_REPLY + 1,
-		make([]float64, len(peerAddrList)),
-		make(chan bool, 100),
-		make([]int64, len(peerAddrList))}
+		N:                          n,
+		Id:                         int32(cfg.Id),
+		PeerAddrList:               peerAddrList,
+		peerAddrLock:               new(sync.Mutex),
+		Peers:                      make([]net.Conn, n),
+		PeerReaders:                make([]*bufio.Reader, n),
+		PeerWriters:                make([]*bufio.Writer, n),
+		PeerWLocks:                 make([]*PeerLock, n),
+		Listener:                   cfg.Listener,
+		State:                      state.InitState(),
+		ProposeChan:                make(chan *Propose, cfg.ProposeChanSize),
+		BeaconChan:                 make(chan *Beacon, cfg.BeaconChanSize),
+		ClientLeaseChan:            make(chan *ClientLeaseRequest, cfg.LeaseChanSize),
+		ClientLeases:               NewClientLeaseTable(),
+		Thrifty:                    cfg.Thrifty,
+		Exec:                       cfg.Exec,
+		Dreply:                     cfg.Dreply,
+		Beacon:                     cfg.Beacon,
+		Durable:                    cfg.Durable,
+		stableLock:                 new(sync.Mutex),
+		PreferredPeerOrder:         make([]int32, n),
+		slowPeers:                  newSlowPeers(n),
+		admission:                  newAdmission(),
+		applyNotify:                newApplyNotify(cfg.ApplyNotify),
+		QLPromiseChan:              make(chan fastrpc.Serializable, cfg.LeaseChanSize),
+		QLPromiseReplyChan:         make(chan fastrpc.Serializable, cfg.LeaseChanSize),
+		QLGuardChan:                make(chan fastrpc.Serializable, cfg.LeaseChanSize),
+		QLGuardReplyChan:           make(chan fastrpc.Serializable, cfg.LeaseChanSize),
+		QLRegionLeaseChan:          make(chan fastrpc.Serializable, cfg.LeaseChanSize),
+		RequestEntriesChan:         make(chan fastrpc.Serializable, CATCHUP_CHAN_SIZE),
+		EntriesChan:                make(chan fastrpc.Serializable, CATCHUP_CHAN_SIZE),
+		Updating:                   NewUpdatingKeys(),
+		rpcTable:                   make(map[uint16]*RPCPair),
+		rpcCode:                    uint16(genericsmrproto.GENERIC_SMR_BEACON_REPLY) + 1,
+		Ewma:                       make([]float64, n),
+		OnClientConnect:            make(chan bool, 100),
+		OnClientDisconnect:         make(chan ClientInfo, CLIENT_EVENT_CHAN_SIZE),
+		Clients:                    NewClientTable(),
+		cork:                       newReplyCork(),
+		LastReplyReceivedTimestamp: make([]int64, n),
+		extendedCodes:              make([]bool, n),
+		peerCounters:               make([]*connCounters, n),
+		peerHeard:                  make([]int64, n),
+		PeerStates:                 NewPeerStates(n),
+		leaseRejoined:              make([]int32, n),
+		leaseIdle:                  newLeaseIdle(n),
+		stateMemory:                new(stateMemory),
+		readStats:                  newReadStats(cfg.ReadPrefixShift),
+		sessionLock:                new(sync.Mutex),
+		ctlLanes:                   make([]*ctlLane, n),
+		ACL:                        cfg.ACL,
+		Authenticator:              cfg.Authenticator,
+		cfg:                        cfg,
+	}
+	r.Tasks = NewSupervisor(func() bool { return r.Shutdown })
+	r.Clock = cfg.TimeSource
+	if r.Clock == nil {
+		r.Clock = cheaptime.Default()
+	}
+	r.HLC = hlc.New(r.Now)
+	r.Beacons = NewBeaconManager(r, cfg.BeaconIntervalNs, cfg.BeaconJitterNs, cfg.BeaconTimeoutNs)
+	if cfg.Trace != nil {
+		r.tracer = newTracer(cfg.Trace)
+	}
+	if cfg.Faults != nil {
+		r.faultQueues = newFaultQueues(n)
+	}
+	if cfg.DecodeWorkers > 0 {
+		r.startDecodePool(cfg.DecodeWorkers)
+	}
+	if cfg.PiggybackLeases {
+		r.piggybacks = newPiggybacks(n)
+	}
+	r.renewals = newRenewals(r.Id)
+	r.propose = ChainProposeMiddleware(r.submitProposal, cfg.ProposeMiddleware...)
+	if cfg.Replay != nil && (cfg.Mux != nil || cfg.PeerSessions) {
+		log.Fatal("Replays are not supported with groups or peer sessions")
+	}
 
-	var err error
+	if cfg.PeerSessions {
+		if cfg.Mux != nil {
+			log.Fatal("Peer sessions are not supported with groups")
+		}
+		r.sessions = make([]*peerSession, n)
+		r.bootId = uint64(time.Now().UnixNano())
+		r.sendSeq = make([]uint64, n)
+		r.recvSeqs = make([]*dedupWindow, n)
+		for i := range r.recvSeqs {
+			r.recvSeqs[i] = newDedupWindow()
+		}
+	}
+
+	if cfg.Mux != nil {
+		r.GroupId = cfg.GroupId
+		r.mux = cfg.Mux
+		r.Peers = r.mux.Peers
+		r.PeerReaders = r.mux.PeerReaders
+		r.PeerWriters = r.mux.PeerWriters
+		r.Listener = nil
+		r.Clients = r.mux.Clients
+		r.cork = r.mux.cork
+		r.HLC = r.mux.HLC
+		r.PeerStates = r.mux.PeerStates
+		if err := r.mux.addGroup(r.GroupId, r); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	r.PeerStates.Subscribe(r.watchLeasePeers)
 
-	if r.StableStore, err = os.Create(fmt.Sprintf("stable-store-replica%d", r.Id)); err != nil {
+	if cfg.ResultCacheSize > 0 {
+		r.results = newResultCache(cfg.ResultCacheSize)
+	}
+
+	r.initParams()
+
+	if err := r.openStableStore(cfg.StableStorePath); err != nil {
 		log.Fatal(err)
 	}
 
 	for i := 0; i < r.N; i++ {
 		r.PreferredPeerOrder[i] = int32((int(r.Id) + 1 + i) % r.N)
 		r.Ewma[i] = 0.0
-		r.PeerWLocks[i] = new(sync.Mutex)
+		if r.mux != nil {
+			r.PeerWLocks[i] = r.mux.PeerWLocks[i]
+		} else {
+			r.PeerWLocks[i] = NewPeerLock()
+		}
 		r.LastReplyReceivedTimestamp[i] = 0 //time.Now().UnixNano()
+		r.peerCounters[i] = newConnCounters()
+	}
+
+	// chunks are not delivered on a channel, but reassembled by the listener
+	r.chunkRPC = r.rpcCode
+	r.rpcCode = nextRPCCode(r.rpcCode)
+	r.codecRPC = r.rpcCode
+	r.rpcCode = nextRPCCode(r.rpcCode)
+	r.piggybackRPC = r.rpcCode
+	r.rpcCode = nextRPCCode(r.rpcCode)
+	if err := r.initPeerCodecs(); err != nil {
+		log.Fatal(err)
+	}
+	r.reassemblers = make([]*fastrpc.Reassembler, r.N)
+	for i := range r.reassemblers {
+		r.reassemblers[i] = fastrpc.NewReassembler()
 	}
 
 	r.qleasePromiseRPC = r.RegisterRPC(new(qleaseproto.Promise), r.QLPromiseChan)
 	r.qleasePromiseReplyRPC = r.RegisterRPC(new(qleaseproto.PromiseReply), r.QLPromiseReplyChan)
 	r.qleaseGuardRPC = r.RegisterRPC(new(qleaseproto.Guard), r.QLGuardChan)
 	r.qleaseGuardReplyRPC = r.RegisterRPC(new(qleaseproto.GuardReply), r.QLGuardReplyChan)
+	for _, code := range []uint16{r.qleasePromiseRPC, r.qleasePromiseReplyRPC, r.qleaseGuardRPC, r.qleaseGuardReplyRPC} {
+		r.SetOverflowPolicy(code, cfg.LeaseOverflow)
+	}
+	r.requestEntriesRPC = r.RegisterRPC(new(genericsmrproto.RequestEntries), r.RequestEntriesChan)
+	r.entriesRPC = r.RegisterRPC(new(genericsmrproto.Entries), r.EntriesChan)
+
+	r.snaps = newSnapshots(n)
+	rsChan := make(chan fastrpc.Serializable, CATCHUP_CHAN_SIZE)
+	r.requestSnapshotRPC = r.RegisterRPC(new(genericsmrproto.RequestSnapshot), rsChan)
+	r.snapshotChunkRPC = r.RegisterRPC(new(genericsmrproto.SnapshotChunk), r.snaps.chunks)
+	// a dropped chunk is sent again when the transfer resumes
+	r.SetOverflowPolicy(r.snapshotChunkRPC, OVERFLOW_DROP_NEWEST)
+	r.Tasks.Go("snapshot requests", RESTART_ON_PANIC, func() error {
+		r.serveSnapshotRequests(rsChan)
+		return nil
+	})
+	for q := int32(0); q < int32(n); q++ {
+		if q != r.Id {
+			q := q
+			r.Tasks.Go(fmt.Sprintf("snapshot sender to replica %d", q), RESTART_ON_PANIC, func() error {
+				r.sendSnapshots(q)
+				return nil
+			})
+		}
+	}
+
+	r.qreads = &quorumReads{lock: new(sync.Mutex), pending: make(map[int32]chan *genericsmrproto.QuorumReadReply)}
+	qrChan := make(chan fastrpc.Serializable, QUORUM_READ_CHAN_SIZE)
+	qrReplyChan := make(chan fastrpc.Serializable, QUORUM_READ_CHAN_SIZE)
+	r.quorumReadRPC = r.RegisterRPC(new(genericsmrproto.QuorumRead), qrChan)
+	r.quorumReadReplyRPC = r.RegisterRPC(new(genericsmrproto.QuorumReadReply), qrReplyChan)
+	r.Tasks.Go("quorum reads", RESTART_ON_PANIC, func() error {
+		r.serveQuorumReads(qrChan, qrReplyChan)
+		return nil
+	})
+
+	r.rindexes = newReadIndexes()
+	riChan := make(chan fastrpc.Serializable, QUORUM_READ_CHAN_SIZE)
+	riReplyChan := make(chan fastrpc.Serializable, QUORUM_READ_CHAN_SIZE)
+	r.readIndexRPC = r.RegisterRPC(new(genericsmrproto.ReadIndex), riChan)
+	r.readIndexReplyRPC = r.RegisterRPC(new(genericsmrproto.ReadIndexReply), riReplyChan)
+	r.leaderChecks = RegisterQuorumRPC(r, new(genericsmrproto.LeaderCheck), new(genericsmrproto.LeaderCheckReply), r.answerLeaderCheck)
+	r.Tasks.Go("read indexes", RESTART_ON_PANIC, func() error {
+		r.serveReadIndexes(riChan, riReplyChan)
+		return nil
+	})
+
+	r.fwds = newForwards()
+	fpChan := make(chan fastrpc.Serializable, FORWARD_CHAN_SIZE)
+	fpReplyChan := make(chan fastrpc.Serializable, FORWARD_CHAN_SIZE)
+	r.forwardProposeRPC = r.RegisterRPC(new(genericsmrproto.ForwardPropose), fpChan)
+	r.forwardProposeReplyRPC = r.RegisterRPC(new(genericsmrproto.ForwardProposeReply), fpReplyChan)
+	r.Tasks.Go("forwarded proposals", RESTART_ON_PANIC, func() error {
+		r.serveForwards(fpChan, fpReplyChan)
+		return nil
+	})
+
+	r.antiEntropy = newAntiEntropy()
+	r.stateDigestRPC = RegisterRPCHandler(r, new(genericsmrproto.StateDigest), r.handleStateDigest, 1)
+	r.stateDigestReplyRPC = RegisterRPCHandler(r, new(genericsmrproto.StateDigestReply), r.handleStateDigestReply, 0)
+	r.stateKeysRPC = RegisterRPCHandler(r, new(genericsmrproto.StateKeys), r.handleStateKeys, 0)
+	r.stateKeysReplyRPC = RegisterRPCHandler(r, new(genericsmrproto.StateKeysReply), r.handleStateKeysReply, 0)
+
+	r.clocks = newClocks(n)
+	r.egress = newEgressLimits(n)
+	r.clockProbeRPC = RegisterRPCHandler(r, new(genericsmrproto.ClockProbe), r.handleClockProbe, 1)
+	r.clockProbeReplyRPC = RegisterRPCHandler(r, new(genericsmrproto.ClockProbeReply), r.handleClockProbeReply, 0)
+	r.regionLease = newRegionLease()
+	r.regionLeaseRequestRPC = RegisterRPCHandler(r, new(genericsmrproto.RegionLeaseRequest), r.handleRegionLeaseRequest, 1)
+	r.regionLeaseRPC = r.RegisterRPC(new(genericsmrproto.RegionLease), r.QLRegionLeaseChan)
+	r.leaseIdleRPC = RegisterRPCHandler(r, new(genericsmrproto.LeaseIdle), r.handleLeaseIdle, 1)
+	r.Tasks.Go("lease-idle", RESTART_ON_PANIC, func() error {
+		r.suspendIdleLease()
+		return nil
+	})
+	r.Tasks.Go("state-memory", RESTART_ON_PANIC, func() error {
+		r.watchStateMemory()
+		return nil
+	})
+	r.Tasks.Go("anti-entropy", RESTART_ON_PANIC, func() error {
+		r.runAntiEntropy()
+		return nil
+	})
+	r.configPush = newConfigPush()
+	if cfg.PriorityScheduling {
+		r.priorities = newPriorityQueues(cap(r.ProposeChan))
+		r.Tasks.Go("priority-scheduler", RESTART_ON_PANIC, func() error {
+			r.schedulePriorities()
+			return nil
+		})
+	}
+
+	if cfg.DebugAddr != "" {
+		if err := r.serveDebug(cfg.DebugAddr); err != nil {
+			log.Printf("Replica %d: cannot serve the debug server at %s: %v\n", r.Id, cfg.DebugAddr, err)
+		}
+	}
+
+	if cfg.Backups != nil {
+		r.backups = newBackups(cfg.Backups)
+		if cfg.Backups.Schedule != nil {
+			r.Tasks.Go("backups", RESTART_ON_PANIC, func() error {
+				r.runBackups()
+				return nil
+			})
+		}
+	}
 
 	return r
 }
@@ -169,8 +535,20 @@ func (r *Replica) BeTheLeader(args *genericsmrproto.BeTheLeaderArgs, reply *gene
 /* ============= */
 
 func (r *Replica) ConnectToPeers() {
-	var b [4]byte
-	bs := b[:4]
+	if r.cfg.Replay != nil {
+		r.connectReplayPeers()
+		return
+	}
+	defer r.peersConnected()
+	if r.mux != nil {
+		r.mux.ConnectToPeers()
+		return
+	}
+	if r.sessions != nil {
+		r.connectPeerSessions()
+		return
+	}
+
 	done := make(chan bool)
 
 	go r.waitForPeerConnections(done)
@@ -178,36 +556,45 @@ func (r *Replica) ConnectToPeers() {
 	//connect to peers
 	for i := 0; i < int(r.Id); i++ {
 		for done := false; !done; {
-			if conn, err := net.Dial("tcp", r.PeerAddrList[i]); err == nil {
-				r.Peers[i] = conn
+			if conn, err := r.transport().Dial(r.PeerAddr(int32(i))); err == nil {
+				r.tuneConn(conn, true)
+				r.Peers[i] = r.peerConn(int32(i), conn)
 				done = true
 			} else {
 				time.Sleep(1e9)
 			}
 		}
-		binary.LittleEndian.PutUint32(bs, uint32(r.Id))
-		if _, err := r.Peers[i].Write(bs); err != nil {
+		if err := writePeerHandshake(r.Peers[i], r.Id); err != nil {
 			fmt.Println("Write id error:", err)
 			continue
 		}
-		r.Alive[i] = true
-		r.PeerReaders[i] = bufio.NewReader(r.Peers[i])
-		r.PeerWriters[i] = bufio.NewWriter(r.Peers[i])
+		r.openControlLane(int32(i))
+		r.PeerReaders[i] = r.newPeerReader(r.Peers[i])
+		r.PeerWriters[i] = r.newPeerWriter(r.Peers[i])
+		r.PeerStates.Set(int32(i), PEER_ALIVE)
 	}
 	<-done
 	log.Printf("Replica id: %d. Done connecting to peers\n", r.Id)
 
-	for rid, reader := range r.PeerReaders {
-		if int32(rid) == r.Id {
-			continue
-		}
-		go r.replicaListener(rid, reader)
-	}
+	r.startReplicaListeners()
 }
 
 func (r *Replica) ConnectToPeersNoListeners() {
-	var b [4]byte
-	bs := b[:4]
+	if r.cfg.Replay != nil {
+		r.connectReplayPeers()
+		return
+	}
+	defer r.peersConnected()
+	if r.mux != nil {
+		r.mux.ConnectToPeers()
+		return
+	}
+	if r.sessions != nil {
+		// the sessions need their listeners to reconnect
+		r.connectPeerSessions()
+		return
+	}
+
 	done := make(chan bool)
 
 	go r.waitForPeerConnections(done)
@@ -215,21 +602,22 @@ func (r *Replica) ConnectToPeersNoListeners() {
 	//connect to peers
 	for i := 0; i < int(r.Id); i++ {
 		for done := false; !done; {
-			if conn, err := net.Dial("tcp", r.PeerAddrList[i]); err == nil {
-				r.Peers[i] = conn
+			if conn, err := r.transport().Dial(r.PeerAddr(int32(i))); err == nil {
+				r.tuneConn(conn, true)
+				r.Peers[i] = r.peerConn(int32(i), conn)
 				done = true
 			} else {
 				time.Sleep(1e9)
 			}
 		}
-		binary.LittleEndian.PutUint32(bs, uint32(r.Id))
-		if _, err := r.Peers[i].Write(bs); err != nil {
+		if err := writePeerHandshake(r.Peers[i], r.Id); err != nil {
 			fmt.Println("Write id error:", err)
 			continue
 		}
-		r.Alive[i] = true
-		r.PeerReaders[i] = bufio.NewReader(r.Peers[i])
-		r.PeerWriters[i] = bufio.NewWriter(r.Peers[i])
+		r.openControlLane(int32(i))
+		r.PeerReaders[i] = r.newPeerReader(r.Peers[i])
+		r.PeerWriters[i] = r.newPeerWriter(r.Peers[i])
+		r.PeerStates.Set(int32(i), PEER_ALIVE)
 	}
 	<-done
 	log.Printf("Replica id: %d. Done connecting to peers\n", r.Id)
@@ -237,25 +625,12 @@ func (r *Replica) ConnectToPeersNoListeners() {
 
 /* Peer (replica) connections dispatcher */
 func (r *Replica) waitForPeerConnections(done chan bool) {
-	var b [4]byte
-	bs := b[:4]
-
-	r.Listener, _ = net.Listen("tcp", r.PeerAddrList[r.Id])
-	for i := r.Id + 1; i < int32(r.N); i++ {
-		conn, err := r.Listener.Accept()
-		if err != nil {
-			fmt.Println("Accept error:", err)
-			continue
-		}
-		if _, err := io.ReadFull(conn, bs); err != nil {
-			fmt.Println("Connection establish error:", err)
-			continue
+	// the replicas with higher IDs dial this one
+	r.startAccepting()
+	for q := r.Id + 1; q < int32(r.N); q++ {
+		for !r.PeerAlive(q) {
+			time.Sleep(10 * time.Millisecond)
 		}
-		id := int32(binary.LittleEndian.Uint32(bs))
-		r.Peers[id] = conn
-		r.PeerReaders[id] = bufio.NewReader(conn)
-		r.PeerWriters[id] = bufio.NewWriter(conn)
-		r.Alive[id] = true
 	}
 
 	done <- true
@@ -263,89 +638,283 @@ func (r *Replica) waitForPeerConnections(done chan bool) {
 
 /* Client connections dispatcher */
 func (r *Replica) WaitForClientConnections() {
-	for !r.Shutdown {
-		conn, err := r.Listener.Accept()
-		if err != nil {
-			log.Println("Accept error:", err)
-			continue
-		}
-		go r.clientListener(conn)
-
-		r.OnClientConnect <- true
+	if r.cfg.Replay != nil {
+		return
 	}
+	// started here rather than with the replica, once the protocol has set Log
+	r.Tasks.Go("config-updates", RESTART_ON_PANIC, func() error {
+		r.pushConfigUpdates()
+		return nil
+	})
+	if r.mux != nil {
+		r.mux.WaitForClientConnections()
+		return
+	}
+	// clients arrive on the same port as the peers (see accept.go)
+	r.startAccepting()
+}
+
+func (r *Replica) startReplicaListener(rid int, reader *bufio.Reader) {
+	r.Tasks.Go(fmt.Sprintf("listener of replica %d", rid), RESTART_NEVER, func() error {
+		return r.replicaListener(rid, reader)
+	})
 }
 
-func (r *Replica) replicaListener(rid int, reader *bufio.Reader) {
-	var msgType uint8
+// serve a peer connection until it breaks, which is the error returned
+// (nil if the connection was replaced, or the replica shut down)
+func (r *Replica) replicaListener(rid int, reader *bufio.Reader) error {
 	var err error = nil
+
+	for err == nil && !r.Shutdown {
+		err = r.handlePeerMessage(rid, reader)
+	}
+	if err != nil && r.currentPeerReader(rid, reader) {
+		log.Printf("Connection to replica %d lost: %v\n", rid, err)
+		r.PeerStates.Set(int32(rid), PEER_DEAD)
+		return err
+	}
+	return nil
+}
+
+// read one message from a peer and dispatch it; a message that makes the
+// replica panic is treated as a broken connection
+func (r *Replica) handlePeerMessage(rid int, reader *bufio.Reader) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("malformed message: %v", p)
+		}
+	}()
 	var gbeacon genericsmrproto.Beacon
 	var gbeaconReply genericsmrproto.BeaconReply
 
-	for err == nil && !r.Shutdown {
+	deliver, err := r.readPeerSeq(rid, reader)
+	if err != nil {
+		return err
+	}
+	msgType, err := readCode(reader)
+	if err != nil {
+		return err
+	}
+	r.peerCounters[rid].receivedMsg(msgType)
+	if r.cfg.Faults.Dropped(int32(rid)) {
+		// read the message, but as if it never arrived
+		deliver = false
+	} else {
+		r.heardFromPeer(rid)
+	}
 
-		if msgType, err = reader.ReadByte(); err != nil {
-			break
+	switch msgType {
+
+	case RPC_CODE_HELLO:
+		r.extendedCodes[rid] = true
+		break
+
+	case RPC_CODE_PING:
+		// not from the listener, which must not wait on our side of the connection
+		if deliver {
+			go r.sendPeerCode(int32(rid), RPC_CODE_PONG, PEER_PONG_TIMEOUT)
 		}
+		break
 
-		switch uint8(msgType) {
+	case RPC_CODE_PONG:
+		break
 
-		case genericsmrproto.GENERIC_SMR_BEACON:
-			if err = gbeacon.Unmarshal(reader); err != nil {
-				break
-			}
-			beacon := &Beacon{int32(rid), gbeacon.Timestamp}
-			r.BeaconChan <- beacon
+	case uint16(genericsmrproto.GENERIC_SMR_BEACON):
+		if err = r.recvCodecs[rid].Decode(reader, &gbeacon); err != nil {
 			break
-
-		case genericsmrproto.GENERIC_SMR_BEACON_REPLY:
-			if err = gbeaconReply.Unmarshal(reader); err != nil {
-				break
+		}
+		beacon := &Beacon{int32(rid), gbeacon.Timestamp}
+		if !deliver {
+			break
+		}
+		r.trace(TRACE_BEACON, int64(rid), 0, &gbeacon)
+		r.deliverFromPeer(rid, func() {
+			if !r.Beacons.handleBeacon(beacon) {
+				r.BeaconChan <- beacon
 			}
-			//TODO: UPDATE STUFF
-			r.Ewma[rid] = 0.99*r.Ewma[rid] + 0.01*float64(rdtsc.Cputicks()-gbeaconReply.Timestamp)
-			log.Println(r.Ewma)
+		})
+		break
+
+	case uint16(genericsmrproto.GENERIC_SMR_BEACON_REPLY):
+		if err = r.recvCodecs[rid].Decode(reader, &gbeaconReply); err != nil || !deliver {
 			break
+		}
+		r.trace(TRACE_BEACON_REPLY, int64(rid), 0, &gbeaconReply)
+		ts := gbeaconReply.Timestamp
+		r.deliverFromPeer(rid, func() { r.Beacons.handleBeaconReply(int32(rid), ts) })
+		break
+
+	default:
+		if msgType == r.piggybackRPC {
+			err = r.handlePiggybacked(rid, reader, deliver)
+		} else {
+			err = r.dispatchPeerRPC(rid, msgType, reader, deliver)
+		}
+	}
+	return err
+}
 
-		default:
-			if rpair, present := r.rpcTable[msgType]; present {
-				obj := rpair.Obj.New()
-				if err = obj.Unmarshal(reader); err != nil {
-					break
-				}
-				rpair.Chan <- obj
-			} else {
-				log.Println("Error: received unknown message type")
-			}
+// read a message of a registered (or internal) type from a peer, and hand it
+// to the protocol if deliver
+func (r *Replica) dispatchPeerRPC(rid int, msgType uint16, reader *bufio.Reader, deliver bool) error {
+	if msgType == r.chunkRPC {
+		return r.handleChunk(rid, reader, deliver)
+	} else if msgType == r.codecRPC {
+		return r.handleCodecSwitch(rid, reader, deliver)
+	} else if rpair, present := r.rpcTable[msgType]; present {
+		if size, ok := r.decodable(rid, rpair); ok && deliver {
+			return r.decoders.frame(rid, msgType, rpair, reader, size)
+		}
+		obj := rpair.Obj.New()
+		if err := r.recvCodecs[rid].Decode(reader, obj); err != nil || !deliver {
+			return err
 		}
+		r.trace(TRACE_PEER_MSG, int64(rid), msgType, obj)
+		r.deliverFromPeer(rid, func() { rpair.dispatch(obj) })
+	} else {
+		log.Println("Error: received unknown message type")
 	}
+	return nil
+}
+
+type clientConn struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	in       *msgLimitReader // reader, limiting each message (see ingress.go)
+	writer   *bufio.Writer
+	lock     *sync.Mutex
+	identity string
+	info     *ClientInfo
+	replies  *ReplyQueue
+	limits   *clientLimits
+	session  uint64        // set by a SESSION message
+	codec    fastrpc.Codec // set by a CODEC message (under lock)
+	deadline int64         // set by a DEADLINE message, for the next proposal
+	priority uint8         // set by a PRIORITY message
+
+	configSub *Replica // the replica whose configuration updates the connection subscribed to (see configpush.go)
 }
 
-func (r *Replica) clientListener(conn net.Conn) {
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
-	lock := new(sync.Mutex)
+func (r *Replica) clientListener(conn net.Conn, info *ClientInfo) {
+	conn = &countingConn{conn, info.counters}
+	counter := &countingReader{r: conn}
+	w := bufio.NewWriter(withDeadlines(conn, 0, r.cfg.ClientWriteTimeoutNs))
+	reader := bufio.NewReader(counter)
+	c := &clientConn{conn, reader, &msgLimitReader{r: reader}, w, new(sync.Mutex), "", info, nil, nil, 0, fastrpc.Binary, 0, 0, nil}
+	c.replies = r.newReplyQueue(c.writer, c.lock)
+	c.limits = newClientLimits(counter, c.reader)
+	defer c.replies.Close()
+	defer conn.Close()
+	defer r.clientGone(info)
 
-	var msgType byte //:= make([]byte, 1)
 	var err error
+	for cur := r; cur != nil; {
+		cur, err = cur.serveClient(c)
+	}
+	if c.configSub != nil {
+		c.configSub.unsubscribeConfig(c)
+	}
+
+	// a client that goes away cannot keep blocking writes
+	if r.mux != nil {
+		for _, g := range r.mux.Groups() {
+			g.ClientLeases.Release(c.writer, nil)
+		}
+	} else {
+		r.ClientLeases.Release(c.writer, nil)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		log.Printf("Closing idle client connection from %s\n", info.RemoteAddr)
+	} else if err != nil && err != io.EOF {
+		log.Println("Error when reading from client connection:", err)
+	}
+}
+
+// serve a client connection until it fails, or until the client selects
+// another group, which serveClient returns
+func (r *Replica) serveClient(c *clientConn) (next *Replica, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			next, err = nil, fmt.Errorf("malformed message: %v", p)
+		}
+	}()
+	reader, writer, lock := c.in, c.writer, c.lock
+	identity := c.identity
+	defer func() { c.identity = identity }()
+
+	var msgType byte //:= make([]byte, 1)
 	for !r.Shutdown && err == nil {
 
+		r.touchClient(c.conn)
+		reader.reset(r.Param(PARAM_MAX_CLIENT_MSG_BYTES))
 		if msgType, err = reader.ReadByte(); err != nil {
 			break
 		}
+		c.info.counters.receivedMsg(uint16(msgType))
 
 		switch uint8(msgType) {
 
 		case genericsmrproto.PROPOSE:
+			received := r.Clock.Nanos()
 			prop := new(genericsmrproto.Propose)
-			if err = prop.Unmarshal(reader); err != nil {
+			deadline := c.deadline
+			c.deadline = 0
+			if err = c.codec.Decode(reader, prop); err != nil {
+				if errors.Is(err, ErrClientMsgTooLarge) {
+					r.replyTooLarge(c, prop, err)
+				}
+				break
+			}
+			if verr := validateIngressCommand(&prop.Command); verr != nil {
+				r.ReplyProposeErr(&Propose{prop, -1, -1, writer, lock, c.replies, 0, 0, 0, 0, 0}, genericsmrproto.ERR_INVALID, verr.Error())
+				break
+			}
+			owner, g := r.route(prop.Command.K)
+			if owner == nil {
+				r.ReplyProposeErr(&Propose{prop, -1, -1, writer, lock, c.replies, 0, 0, 0, 0, 0}, genericsmrproto.ERR_WRONG_GROUP, fmt.Sprintf("group %d", g))
+				break
+			}
+			if state.IsRead(&prop.Command) {
+				owner.noteLeaseRead()
+			}
+			if verr := owner.validateConditional(&prop.Command); verr != nil {
+				r.ReplyProposeErr(&Propose{prop, -1, -1, writer, lock, c.replies, 0, 0, 0, 0, 0}, genericsmrproto.ERR_INVALID, verr.Error())
+				break
+			}
+			if !owner.ACL.Permits(identity, &prop.Command) {
+				r.ReplyProposeErr(&Propose{prop, -1, -1, writer, lock, c.replies, 0, 0, 0, 0, 0}, genericsmrproto.ERR_UNAUTHORIZED, "access denied for "+identity)
+				break
+			}
+			if !c.limits.admit(r) {
+				r.ReplyProposeErr(&Propose{prop, -1, -1, writer, lock, c.replies, 0, 0, 0, 0, 0}, genericsmrproto.ERR_OVERLOADED, "client rate limit exceeded")
+				break
+			}
+			if owner.ReadOnly() && !state.IsRead(&prop.Command) {
+				r.ReplyProposeErr(&Propose{prop, -1, -1, writer, lock, c.replies, 0, 0, 0, 0, 0}, genericsmrproto.ERR_NOT_WRITABLE, fmt.Sprintf("replica %d is read-only", owner.Id))
+				break
+			}
+			if !state.IsRead(&prop.Command) && !owner.admitWrite() {
+				r.ReplyProposeErr(&Propose{prop, -1, -1, writer, lock, c.replies, 0, 0, 0, 0, 0}, genericsmrproto.ERR_NOT_WRITABLE, fmt.Sprintf("the state of replica %d is at its memory limit", owner.Id))
+				break
+			}
+			if !owner.admitProposal() {
+				r.ReplyProposeErr(&Propose{prop, -1, -1, writer, lock, c.replies, 0, 0, 0, 0, 0}, genericsmrproto.ERR_OVERLOADED, fmt.Sprintf("commit backlog of %d instances", owner.CommitBacklog()))
+				break
+			}
+			p := &Propose{prop, -1, -1, writer, lock, c.replies, c.session, deadline, c.priority, received, 0}
+			if owner.pastDeadline(p) {
+				atomic.AddUint64(&owner.deadlineDropped, 1)
 				break
 			}
-			r.ProposeChan <- &Propose{prop, -1, -1, writer, lock}
+			if !owner.beginProposal(p) {
+				break
+			}
+			owner.propose(c.info, p)
 			break
 
 		case genericsmrproto.READ:
 			read := new(genericsmrproto.Read)
-			if err = read.Unmarshal(reader); err != nil {
+			if err = c.codec.Decode(reader, read); err != nil {
 				break
 			}
 			//r.ReadChan <- read
@@ -353,70 +922,257 @@ func (r *Replica) clientListener(conn net.Conn) {
 
 		case genericsmrproto.PROPOSE_AND_READ:
 			pr := new(genericsmrproto.ProposeAndRead)
-			if err = pr.Unmarshal(reader); err != nil {
+			if err = c.codec.Decode(reader, pr); err != nil {
 				break
 			}
 			//r.ProposeAndReadChan <- pr
 			break
+
+		case genericsmrproto.CLIENT_LEASE:
+			cl := new(genericsmrproto.ClientLease)
+			if err = c.codec.Decode(reader, cl); err != nil {
+				if errors.Is(err, ErrClientMsgTooLarge) {
+					r.replyTooLarge(c, cl, err)
+				}
+				break
+			}
+			req := &ClientLeaseRequest{cl, writer, lock, c.codec}
+			if verr := r.validateLeaseKeys(cl.Keys); verr != nil {
+				log.Printf("Denying a client lease to %s: %v\n", c.info.RemoteAddr, verr)
+				r.DenyClientLease(req, genericsmrproto.ERR_TOO_LARGE)
+				break
+			}
+			owner := r
+			if len(cl.Keys) > 0 {
+				owner, _ = r.route(cl.Keys[0])
+			}
+			for _, k := range cl.Keys {
+				if o, _ := r.route(k); o == nil || o != owner {
+					// a client lease cannot span groups
+					r.DenyClientLease(req, genericsmrproto.ERR_WRONG_GROUP)
+					req = nil
+					break
+				}
+				if !owner.ACL.Permits(identity, &state.Command{Op: state.GET, K: k}) {
+					r.DenyClientLease(req, genericsmrproto.ERR_UNAUTHORIZED)
+					req = nil
+					break
+				}
+			}
+			if req != nil {
+				owner.trace(TRACE_CLIENT_LEASE, int64(c.info.Id), 0, cl)
+				owner.ClientLeaseChan <- req
+			}
+			break
+
+		case genericsmrproto.CLIENT_LEASE_RELEASE:
+			rel := new(genericsmrproto.ClientLeaseRelease)
+			if err = c.codec.Decode(reader, rel); err != nil {
+				break
+			}
+			if len(rel.Keys) == 0 {
+				r.ClientLeases.Release(writer, nil)
+			} else {
+				r.ClientLeases.Release(writer, rel.Keys)
+			}
+			break
+
+		case genericsmrproto.SELECT_GROUP:
+			sg := new(genericsmrproto.SelectGroup)
+			if err = c.codec.Decode(reader, sg); err != nil {
+				break
+			}
+			var next *Replica
+			if r.mux != nil {
+				next = r.mux.Group(sg.Group)
+			} else if sg.Group == 0 {
+				next = r
+			}
+			sgreply := &genericsmrproto.SelectGroupReply{OK: FALSE}
+			if next != nil {
+				sgreply.OK = TRUE
+			}
+			lock.Lock()
+			c.codec.Encode(writer, sgreply)
+			writer.Flush()
+			lock.Unlock()
+			if next != nil && next != r {
+				return next, nil
+			}
+			break
+
+		case genericsmrproto.STATUS:
+			if err = c.codec.Decode(reader, new(genericsmrproto.Status)); err != nil {
+				break
+			}
+			st := r.Status()
+			lock.Lock()
+			c.codec.Encode(writer, st)
+			writer.Flush()
+			lock.Unlock()
+			break
+
+		case genericsmrproto.PING:
+			ping := new(genericsmrproto.Ping)
+			if err = c.codec.Decode(reader, ping); err != nil {
+				break
+			}
+			prop := &genericsmrproto.Propose{CommandId: ping.CommandId, Timestamp: ping.Timestamp}
+			r.ReplyProposeTS(&genericsmrproto.ProposeReplyTS{OK: TRUE, CommandId: ping.CommandId, Timestamp: ping.Timestamp},
+				&Propose{prop, -1, -1, writer, lock, c.replies, 0, 0, 0, 0, 0})
+			break
+
+		case genericsmrproto.CAUSAL:
+			causal := new(genericsmrproto.Causal)
+			if err = c.codec.Decode(reader, causal); err != nil {
+				break
+			}
+			r.HLC.Update(causal.HLC)
+			break
+
+		case genericsmrproto.DEADLINE:
+			dl := new(genericsmrproto.Deadline)
+			if err = c.codec.Decode(reader, dl); err != nil {
+				break
+			}
+			c.deadline = r.deadlineIn(dl.TimeoutNs)
+			break
+
+		case genericsmrproto.PRIORITY:
+			pr := new(genericsmrproto.Priority)
+			if err = c.codec.Decode(reader, pr); err != nil {
+				break
+			}
+			if pr.Class < genericsmrproto.NUM_PRIORITIES {
+				c.priority = pr.Class
+			}
+			break
+
+		case genericsmrproto.SESSION:
+			session := new(genericsmrproto.Session)
+			if err = c.codec.Decode(reader, session); err != nil {
+				break
+			}
+			c.session = session.ClientId
+			break
+
+		case genericsmrproto.CODEC:
+			cd := new(genericsmrproto.Codec)
+			if err = cd.Unmarshal(reader); err != nil {
+				break
+			}
+			creply := &genericsmrproto.CodecReply{OK: FALSE}
+			codec := fastrpc.LookupCodec(cd.Codec)
+			lock.Lock()
+			if codec != nil {
+				creply.OK = TRUE
+				c.codec = codec
+				c.replies.codec = codec
+			}
+			creply.Marshal(writer)
+			writer.Flush()
+			lock.Unlock()
+			break
+
+		case genericsmrproto.CONFIG_UPDATE:
+			if err = c.codec.Decode(reader, new(genericsmrproto.ConfigUpdate)); err != nil {
+				break
+			}
+			if c.configSub == nil {
+				r.subscribeConfig(c)
+			}
+			break
+
+		case genericsmrproto.AUTHENTICATE:
+			auth := new(genericsmrproto.Authenticate)
+			if err = c.codec.Decode(reader, auth); err != nil {
+				break
+			}
+			areply := &genericsmrproto.AuthenticateReply{OK: FALSE}
+			if r.Authenticator == nil || r.Authenticator(auth.Identity, auth.Token) {
+				identity = auth.Identity
+				r.Clients.setIdentity(c.info.Id, identity)
+				areply.OK = TRUE
+			} else {
+				log.Printf("Client authentication failed for identity %q\n", auth.Identity)
+			}
+			lock.Lock()
+			c.codec.Encode(writer, areply)
+			writer.Flush()
+			lock.Unlock()
+			break
 		}
 	}
-	if err != nil && err != io.EOF {
-		log.Println("Error when reading from client connection:", err)
-	}
+	return nil, err
 }
 
-func (r *Replica) RegisterRPC(msgObj fastrpc.Serializable, notify chan fastrpc.Serializable) uint8 {
+func (r *Replica) RegisterRPC(msgObj fastrpc.Serializable, notify chan fastrpc.Serializable) uint16 {
 	code := r.rpcCode
-	r.rpcCode++
-	r.rpcTable[code] = &RPCPair{msgObj, notify}
+	r.rpcCode = nextRPCCode(r.rpcCode)
+	pair := &RPCPair{Obj: msgObj, Chan: notify}
+	setChanOps(pair, notify)
+	r.rpcTable[code] = pair
 	return code
 }
 
-var SendError bool
-
-func (r *Replica) SendMsg(peerId int32, code uint8, msg fastrpc.Serializable) (retErr error) {
+// SendMsg sends a message to a peer; it fails with a *PeerSendError (see
+// senderr.go).
+func (r *Replica) SendMsg(peerId int32, code uint16, msg fastrpc.Serializable) (retErr error) {
 	defer func() {
 		if err := recover(); err != nil {
-			r.Alive[peerId] = false
 			log.Println("Send Error: ", err)
-			retErr = errors.New("Send Error")
-			SendError = true
+			retErr = r.sendPanicked(peerId, code, err)
 		}
 	}()
-	SendError = false
-	if !r.Alive[peerId] {
-		SendError = true
-		return errors.New("Trying to send to a replica that may not be alive")
+	if !r.PeerAlive(peerId) {
+		return r.sendFailed(peerId, code, ErrPeerNotAlive)
+	}
+	if err := r.checkCode(peerId, code); err != nil {
+		return r.sendFailed(peerId, code, err)
 	}
 	r.PeerWLocks[peerId].Lock()
 	defer r.PeerWLocks[peerId].Unlock()
-	w := r.PeerWriters[peerId]
-	w.WriteByte(code)
-	msg.Marshal(w)
-	w.Flush()
-	return nil
+	if sent, err := r.writePiggybacked(peerId, code, msg); sent {
+		return r.sendWritten(peerId, code, err)
+	}
+	return r.sendWritten(peerId, code, r.writeMsg(peerId, code, msg))
 }
 
-func (r *Replica) SendMsgNoFlush(peerId int32, code uint8, msg fastrpc.Serializable) (retErr error) {
-	defer func() error {
+func (r *Replica) SendMsgNoFlush(peerId int32, code uint16, msg fastrpc.Serializable) (retErr error) {
+	defer func() {
 		if err := recover(); err != nil {
-			r.Alive[peerId] = false
-			retErr = errors.New("SendNoFlush Error")
-			SendError = true
+			retErr = r.sendPanicked(peerId, code, err)
 		}
-		return nil
 	}()
-	SendError = false
-	if !r.Alive[peerId] {
-		SendError = true
-		return errors.New("Trying to send to a replica that may not be alive")
+	if !r.PeerAlive(peerId) {
+		return r.sendFailed(peerId, code, ErrPeerNotAlive)
+	}
+	if err := r.checkCode(peerId, code); err != nil {
+		return r.sendFailed(peerId, code, err)
 	}
 	r.PeerWLocks[peerId].Lock()
 	defer r.PeerWLocks[peerId].Unlock()
 	w := r.PeerWriters[peerId]
-	w.WriteByte(code)
-	msg.Marshal(w)
-	return nil
+	r.writePeerPrefix(w, peerId)
+	r.writeCode(w, peerId, code)
+	return r.sendWritten(peerId, code, encodeErr(r.sendCodecs[peerId].Encode(w, msg)))
+}
+
+// the codec of the client connection the proposal came from; the caller
+// holds the connection's lock
+func (p *Propose) codec() fastrpc.Codec {
+	if p.Replies != nil {
+		return p.Replies.codec
+	}
+	return fastrpc.Binary
+}
+
+func (p *Propose) flush() {
+	if p.Replies != nil {
+		p.Replies.Written()
+	} else {
+		p.Writer.Flush()
+	}
 }
 
 func (r *Replica) ReplyPropose(reply *genericsmrproto.ProposeReply, propose *Propose) {
@@ -426,67 +1182,149 @@ func (r *Replica) ReplyPropose(reply *genericsmrproto.ProposeReply, propose *Pro
 	propose.Lock.Lock()
 	defer propose.Lock.Unlock()
 	//w.WriteByte(genericsmrproto.PROPOSE_REPLY)
-	reply.Marshal(propose.Writer)
-	propose.Writer.Flush()
+	propose.codec().Encode(propose.Writer, reply)
+	propose.flush()
 }
 
+// ReplyProposeTS stamps successful replies with the replica's HLC, so that
+// the replies to commands executed in order carry increasing timestamps, and
+// remembers the results of client sessions (see resultcache.go). Replies to
+// proposals forwarded by other replicas go back to them (see forward.go).
 func (r *Replica) ReplyProposeTS(reply *genericsmrproto.ProposeReplyTS, propose *Propose) {
+	r.replyPropose(reply, propose, false)
+}
+
+func (r *Replica) replyPropose(reply *genericsmrproto.ProposeReplyTS, propose *Propose, local bool) {
+	r.conditionalReply(reply, propose)
 	if propose.Writer == nil || propose.Lock == nil {
+		if propose.FwdReplica >= 0 && propose.FwdReplica != r.Id {
+			r.relayReply(reply, propose)
+		}
 		return
 	}
+	if propose.FwdReplica == r.Id && r.takeForward(propose.FwdId) == nil {
+		// the reply from the replica it was forwarded to came first
+		return
+	}
+	r.replyClient(reply, propose, local)
+}
+
+func (r *Replica) replyClient(reply *genericsmrproto.ProposeReplyTS, propose *Propose, local bool) {
+	r.countRead(reply, propose, local)
+	if reply.OK == TRUE && reply.HLC == 0 {
+		reply.HLC = r.HLC.Now()
+	}
+	ready := r.replyReady(propose)
+	r.finishProposal(reply, propose)
+	if r.pastDeadline(propose) {
+		atomic.AddUint64(&r.deadlineDropped, 1)
+		return
+	}
+	r.writeReply(reply, propose)
+	r.replied(propose, ready, local)
+}
+
+func (r *Replica) writeReply(reply *genericsmrproto.ProposeReplyTS, propose *Propose) {
 	propose.Lock.Lock()
 	defer propose.Lock.Unlock()
 	//w.WriteByte(genericsmrproto.PROPOSE_REPLY)
-	reply.Marshal(propose.Writer)
-	propose.Writer.Flush()
+	propose.codec().Encode(propose.Writer, reply)
+	propose.flush()
+}
+
+// reply to a proposal that failed without being executed
+func (r *Replica) ReplyProposeErr(propose *Propose, code uint8, msg string) {
+	r.ReplyProposeTS(&genericsmrproto.ProposeReplyTS{
+		OK:        FALSE,
+		CommandId: propose.CommandId,
+		Value:     state.NIL,
+		Timestamp: propose.Timestamp,
+		ErrCode:   code,
+		ErrMsg:    msg},
+		propose)
 }
 
 func (r *Replica) SendBeacon(peerId int32) {
+	if l := r.controlLane(peerId); l != nil {
+		l.lock.LockControl()
+		defer l.lock.Unlock()
+		r.writeLaneMsg(peerId, l, uint16(genericsmrproto.GENERIC_SMR_BEACON), &genericsmrproto.Beacon{Timestamp: uint64(r.Clock.Nanos())})
+		return
+	}
+	r.PeerWLocks[peerId].LockControl()
+	defer r.PeerWLocks[peerId].Unlock()
 	w := r.PeerWriters[peerId]
+	r.writePeerPrefix(w, peerId)
 	w.WriteByte(genericsmrproto.GENERIC_SMR_BEACON)
-	beacon := &genericsmrproto.Beacon{rdtsc.Cputicks()}
-	beacon.Marshal(w)
+	r.peerCounters[peerId].sentMsg(uint16(genericsmrproto.GENERIC_SMR_BEACON))
+	beacon := &genericsmrproto.Beacon{uint64(r.Clock.Nanos())}
+	r.sendCodecs[peerId].Encode(w, beacon)
 	w.Flush()
 }
 
 func (r *Replica) ReplyBeacon(beacon *Beacon) {
+	if l := r.controlLane(beacon.Rid); l != nil {
+		l.lock.LockControl()
+		defer l.lock.Unlock()
+		r.writeLaneMsg(beacon.Rid, l, uint16(genericsmrproto.GENERIC_SMR_BEACON_REPLY), &genericsmrproto.BeaconReply{Timestamp: beacon.Timestamp})
+		return
+	}
+	r.PeerWLocks[beacon.Rid].LockControl()
+	defer r.PeerWLocks[beacon.Rid].Unlock()
 	w := r.PeerWriters[beacon.Rid]
+	r.writePeerPrefix(w, beacon.Rid)
 	w.WriteByte(genericsmrproto.GENERIC_SMR_BEACON_REPLY)
+	r.peerCounters[beacon.Rid].sentMsg(uint16(genericsmrproto.GENERIC_SMR_BEACON_REPLY))
 	rb := &genericsmrproto.BeaconReply{beacon.Timestamp}
-	rb.Marshal(w)
+	r.sendCodecs[beacon.Rid].Encode(w, rb)
 	w.Flush()
 }
 
 func (r *Replica) EstablishQLease(ql *qlease.Lease) {
-	now := time.Now().UnixNano()
+	now := r.Now()
 	ql.LatestTsSent = now
 	ql.PromiseRejects = 0
-	g := &qleaseproto.Guard{r.Id, now, qlease.GUARD_DURATION_NS}
+	g := &qleaseproto.Guard{r.Id, now, ql.Guard}
 	for i := int32(0); i < int32(r.N); i++ {
-		if i == r.Id || !r.Alive[i] {
+		if i == r.Id || !r.PeerAlive(i) || !r.promisesTo(i) || r.peerLeaseIdle(i) {
 			continue
 		}
-		r.SendMsg(i, r.qleaseGuardRPC, g)
+		atomic.StoreInt32(&r.leaseRejoined[i], 0)
+		r.SendMsgTimeout(i, r.qleaseGuardRPC, g)
 	}
+	r.requestRegionLease(now)
 }
 
 func (r *Replica) RenewQLease(ql *qlease.Lease, latestAccInst int32) {
-	now := time.Now().UnixNano()
+	now := r.Now()
 	ql.PromiseRejects = 0
 	p := &qleaseproto.Promise{r.Id, ql.PromisedByMeInst, now, ql.Duration, latestAccInst}
+	if ql.WriteInQuorumUntil > now {
+		r.logPromiseHorizon(ql, ql.WriteInQuorumUntil+ql.Duration)
+	} else {
+		r.logPromiseHorizon(ql, now+ql.Duration)
+	}
 	for i := int32(0); i < int32(r.N); i++ {
-		if i == r.Id || !r.Alive[i] {
+		// renewals pause while a peer is dead, or has suspended its lease
+		if i == r.Id || !r.PeerAlive(i) || !r.promisesTo(i) || r.peerLeaseIdle(i) {
 			continue
 		}
+		if atomic.CompareAndSwapInt32(&r.leaseRejoined[i], 1, 0) {
+			// the peer ignores promises until guarded again
+			r.SendMsgTimeout(i, r.qleaseGuardRPC, &qleaseproto.Guard{r.Id, now, ql.Guard})
+		}
 		ql.LatestRepliesReceived[i] += ql.Duration
-		r.SendMsg(i, r.qleasePromiseRPC, p)
+		r.sendLeaseMsg(i, r.qleasePromiseRPC, p, r.SendMsgTimeout)
 	}
 	ql.LatestTsSent = now
+	r.leaseRenewed(now+ql.Duration, now, false)
+	r.requestRegionLease(now)
 
 	// sufficient to extend wait time by the duration of the lease, because
 	// grantees must receive the lease refresh message before the previous lease expires
 	// (otherwise they will dicount the refresh)
 	ql.WriteInQuorumUntil += ql.Duration
+	r.publishWriteHorizon(ql)
 }
 
 type Int64Slice []int64
@@ -504,9 +1342,9 @@ func (s Int64Slice) Swap(i, j int) {
 }
 
 func (r *Replica) HandleQLeaseGuard(ql *qlease.Lease, g *qleaseproto.Guard) {
-	ql.GuardExpires[g.ReplicaId] = time.Now().UnixNano() + g.GuardDuration
+	ql.GuardExpires[g.ReplicaId] = r.Now() + g.GuardDuration
 	gr := &qleaseproto.GuardReply{r.Id, g.TimestampNs}
-	r.SendMsg(g.ReplicaId, r.qleaseGuardReplyRPC, gr)
+	r.SendControlMsg(g.ReplicaId, r.qleaseGuardReplyRPC, gr)
 }
 
 func (r *Replica) HandleQLeaseGuardReply(ql *qlease.Lease, gr *qleaseproto.GuardReply, latestAccInst int32) {
@@ -516,21 +1354,25 @@ func (r *Replica) HandleQLeaseGuardReply(ql *qlease.Lease, gr *qleaseproto.Guard
 		return
 	}
 
-	now := time.Now().UnixNano()
+	now := r.Now()
 
 	p := &qleaseproto.Promise{r.Id, ql.PromisedByMeInst, now, ql.Duration, latestAccInst}
 
-	ql.LatestRepliesReceived[gr.ReplicaId] = now + qlease.GUARD_DURATION_NS + ql.Duration
+	r.graceGuarded(gr.ReplicaId)
+	ql.LatestRepliesReceived[gr.ReplicaId] = now + ql.Guard + ql.Duration
 
 	if ql.WriteInQuorumUntil < ql.LatestRepliesReceived[gr.ReplicaId] {
 		ql.WriteInQuorumUntil = ql.LatestRepliesReceived[gr.ReplicaId]
+		r.publishWriteHorizon(ql)
 	}
+	r.logPromiseHorizon(ql, ql.WriteInQuorumUntil)
+	r.leaseRenewed(now+ql.Duration, now, true)
 
-	r.SendMsg(gr.ReplicaId, r.qleasePromiseRPC, p)
+	r.SendControlMsg(gr.ReplicaId, r.qleasePromiseRPC, p)
 }
 
 func (r *Replica) HandleQLeasePromise(ql *qlease.Lease, p *qleaseproto.Promise) bool {
-	now := time.Now().UnixNano()
+	now := r.Now()
 	// check that this promise was received on time
 	if ql.LatestPromisesReceived[p.ReplicaId] < now && ql.GuardExpires[p.ReplicaId] < now {
 		//didn't receive promise on time, must ignore
@@ -541,27 +1383,38 @@ func (r *Replica) HandleQLeasePromise(ql *qlease.Lease, p *qleaseproto.Promise)
 	if p.LeaseInstance < ql.PromisedToMeInst {
 		// the sender must update its lease view
 		pr := &qleaseproto.PromiseReply{r.Id, ql.PromisedToMeInst, p.TimestampNs}
-		r.SendMsg(p.ReplicaId, r.qleasePromiseReplyRPC, pr)
+		r.sendLeaseMsg(p.ReplicaId, r.qleasePromiseReplyRPC, pr, r.SendControlMsg)
 		return false
 	} else if p.LeaseInstance > ql.PromisedToMeInst {
-		ql.PromisedToMeInst = p.LeaseInstance
+		atomic.StoreInt32(&ql.PromisedToMeInst, p.LeaseInstance)
 		for i := int32(0); i < int32(r.N); i++ {
 			ql.LatestPromisesReceived[i] = 0
 		}
+		r.RecordLeaseInstances(ql)
 	}
 
 	ql.LatestPromisesReceived[p.ReplicaId] = now + p.DurationNs
 
 	//send reply
 	pr := &qleaseproto.PromiseReply{r.Id, ql.PromisedToMeInst, p.TimestampNs}
-	r.SendMsg(p.ReplicaId, r.qleasePromiseReplyRPC, pr)
+	r.sendLeaseMsg(p.ReplicaId, r.qleasePromiseReplyRPC, pr, r.SendControlMsg)
 
 	sorted := make([]int64, r.N)
 	copy(sorted, ql.LatestPromisesReceived)
 	sorted[r.Id] = 0
 	sort.Sort(Int64Slice(sorted))
 
-	ql.ReadLocallyUntil = sorted[r.N-(r.N/2)]
+	wasReading := now <= ql.ReadLocallyUntil
+	until := sorted[r.N-(r.N/2)]
+	if !r.startupGraceOver(now) {
+		until = 0
+	}
+	atomic.StoreInt64(&ql.ReadLocallyUntil, until)
+	r.holdRegionLease(ql, now)
+	if !wasReading && now <= ql.ReadLocallyUntil {
+		r.nextLeaseEpoch(ql)
+		r.leaseReacquired(now)
+	}
 
 	return true
 }
@@ -575,10 +1428,11 @@ func (r *Replica) HandleQLeaseReply(ql *qlease.Lease, pr *qleaseproto.PromiseRep
 		ql.PromiseRejects++
 		if ql.PromiseRejects == r.N {
 			ql.WriteInQuorumUntil = 0
+			r.holdWritesInQuorum(ql)
 		}
 		return
 	}
-	now := time.Now().UnixNano()
+	now := r.Now()
 	max := now
 	for i := int32(0); i < int32(r.N); i++ {
 		if i == r.Id {
@@ -593,6 +1447,8 @@ func (r *Replica) HandleQLeaseReply(ql *qlease.Lease, pr *qleaseproto.PromiseRep
 	}
 
 	ql.WriteInQuorumUntil = max
+	r.holdWritesInQuorum(ql)
+	r.logPromiseHorizon(ql, max)
 
 	r.LastReplyReceivedTimestamp[pr.ReplicaId] = now
 }
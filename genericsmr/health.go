@@ -0,0 +1,98 @@
+package genericsmr
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Health tells whether a replica can serve clients: it must be connected to
+// enough replicas to make progress, and done restoring its log after a
+// restart; until then, proposals sent to it would stall.
+type Health struct {
+	Connected  int  // replicas this one is connected to, itself included
+	Quorum     int  // replicas needed to make progress
+	Recovering bool // still restoring the log it had before a restart
+	Draining   bool // handing off its leases before a planned stop
+	ReadOnly   bool // serving reads only (see readonly.go)
+	Shutdown   bool
+}
+
+func (h Health) Ready() bool {
+	return h.Connected >= h.Quorum && !h.Recovering && !h.Draining && !h.Shutdown
+}
+
+func (h Health) String() string {
+	var why []string
+	if h.Shutdown {
+		why = append(why, "shutting down")
+	}
+	if h.Connected < h.Quorum {
+		why = append(why, fmt.Sprintf("connected to %d of the %d replicas needed", h.Connected, h.Quorum))
+	}
+	if h.Recovering {
+		why = append(why, "restoring its log")
+	}
+	if h.Draining {
+		why = append(why, "draining")
+	}
+	if len(why) == 0 && h.ReadOnly {
+		return "ready, read-only"
+	}
+	if len(why) == 0 {
+		return "ready"
+	}
+	return "not ready: " + strings.Join(why, ", ")
+}
+
+func (r *Replica) Health() Health {
+	h := Health{Connected: 1, Quorum: r.N/2 + 1, Recovering: r.Recovering(), Draining: r.Draining(), ReadOnly: r.ReadOnly(), Shutdown: r.Shutdown}
+	for q := 0; q < r.N; q++ {
+		if int32(q) != r.Id && r.PeerAlive(int32(q)) {
+			h.Connected++
+		}
+	}
+	return h
+}
+
+// SetRecovering marks the replica as restoring its log (e.g., fetching the
+// instances it lost in a restart from its peers), which keeps it from
+// reporting itself ready.
+func (r *Replica) SetRecovering(recovering bool) {
+	v := int32(0)
+	if recovering {
+		v = 1
+	}
+	atomic.StoreInt32(&r.recovering, v)
+}
+
+func (r *Replica) Recovering() bool {
+	return atomic.LoadInt32(&r.recovering) != 0
+}
+
+// HandleHealth serves health checks for the replicas of a process on mux:
+// /healthz answers 200 as long as the process serves HTTP, and /readyz
+// answers 200 if every replica is ready and 503 otherwise, with one line
+// per replica saying why, so that load balancers and orchestrators only send
+// clients to replicas that can serve them.
+func HandleHealth(mux *http.ServeMux, reps ...*Replica) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		ready := true
+		lines := make([]string, len(reps))
+		for i, r := range reps {
+			h := r.Health()
+			ready = ready && h.Ready()
+			lines[i] = fmt.Sprintf("replica %d (group %d): %v", r.Id, r.GroupId, h)
+		}
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		for _, l := range lines {
+			fmt.Fprintln(w, l)
+		}
+	})
+}
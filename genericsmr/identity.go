@@ -0,0 +1,187 @@
+package genericsmr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/glycerine/qlease/qlease"
+)
+
+// Identity is written to a durable replica's stable store every time the
+// replica starts, so that a restarted process can check (or learn) which
+// replica it is.
+type Identity struct {
+	ReplicaId   int32
+	N           int32
+	Incarnation int64 // number of times a replica has started from this store
+}
+
+// Recovered holds what a durable replica learned from its stable store at startup.
+type Recovered struct {
+	Identity         Identity
+	PromisedByMeInst int32  // latest lease instance this replica promised to others
+	PromisedToMeInst int32  // latest lease instance promised to this replica
+	PromisedUntil    int64  // until when the promises this replica sent may be in effect (see leasewal.go)
+	EpochLimit       uint32 // the lease epochs below it may have been used (see leasewal.go)
+	Records          int    // number of valid records found
+}
+
+func (id *Identity) marshal() []byte {
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint32(b[0:4], uint32(id.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(id.N))
+	binary.LittleEndian.PutUint64(b[8:16], uint64(id.Incarnation))
+	return b
+}
+
+func (id *Identity) unmarshal(b []byte) error {
+	if len(b) < 16 {
+		return io.ErrUnexpectedEOF
+	}
+	id.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	id.N = int32(binary.LittleEndian.Uint32(b[4:8]))
+	id.Incarnation = int64(binary.LittleEndian.Uint64(b[8:16]))
+	return nil
+}
+
+// ReadIdentity returns the latest identity recorded in the stable store at
+// path, or nil if there is none.
+func ReadIdentity(path string) (*Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var id *Identity
+	for {
+		kind, payload, err := ReadRecord(f)
+		if err != nil {
+			break
+		}
+		if kind == RECORD_IDENTITY {
+			id = new(Identity)
+			id.unmarshal(payload)
+		}
+	}
+	return id, nil
+}
+
+// open (and replay) the stable store of a durable replica; non-durable
+// replicas start from an empty store
+func (r *Replica) openStableStore(path string) error {
+	var err error
+	if !r.Durable {
+		r.StableStore, err = os.Create(path)
+		return err
+	}
+	if r.StableStore, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return err
+	}
+	rec := &Recovered{Identity{r.Id, int32(r.N), 0}, -1, -1, 0, 0, 0}
+	var good int64
+	for {
+		kind, payload, err := ReadRecord(r.StableStore)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Stable store %s: discarding records after offset %d: %v\n", path, good, err)
+			}
+			break
+		}
+		good += int64(RECORD_HEADER_SIZE + len(payload))
+		rec.Records++
+		switch kind {
+		case RECORD_IDENTITY:
+			rec.Identity.unmarshal(payload)
+		case RECORD_PARAM:
+			if len(payload) >= 9 && payload[0] < NUM_PARAMS {
+				r.params[payload[0]] = int64(binary.LittleEndian.Uint64(payload[1:9]))
+				r.paramRecovered[payload[0]] = true
+			}
+		case RECORD_LEASE_INSTANCES:
+			if len(payload) >= 8 {
+				rec.PromisedByMeInst = int32(binary.LittleEndian.Uint32(payload[0:4]))
+				rec.PromisedToMeInst = int32(binary.LittleEndian.Uint32(payload[4:8]))
+			}
+		case RECORD_LEASE_STATE:
+			rec.unmarshalLeaseState(payload)
+		case RECORD_LEASE_EPOCHS:
+			if len(payload) >= 4 {
+				rec.EpochLimit = binary.LittleEndian.Uint32(payload[0:4])
+			}
+		}
+	}
+	if rec.Records > 0 && (rec.Identity.ReplicaId != r.Id || rec.Identity.N != int32(r.N)) {
+		return fmt.Errorf("stable store %s belongs to replica %d of %d, not replica %d of %d",
+			path, rec.Identity.ReplicaId, rec.Identity.N, r.Id, r.N)
+	}
+	if err = r.StableStore.Truncate(good); err != nil {
+		return err
+	}
+	if _, err = r.StableStore.Seek(good, io.SeekStart); err != nil {
+		return err
+	}
+	if rec.Records > 0 {
+		log.Printf("Replica %d restarting (incarnation %d) from %d stable store records\n", r.Id, rec.Identity.Incarnation+1, rec.Records)
+		r.Recovered = rec
+	}
+	rec.Identity.Incarnation++
+	r.Incarnation = rec.Identity.Incarnation
+	if err = r.RecordToStableStore(RECORD_IDENTITY, rec.Identity.marshal()); err != nil {
+		return err
+	}
+	return r.StableStore.Sync()
+}
+
+// RecordLeaseInstances persists the lease instance counters; protocols must call
+// it whenever PromisedByMeInst or PromisedToMeInst change.
+func (r *Replica) RecordLeaseInstances(ql *qlease.Lease) {
+	if !r.Durable {
+		return
+	}
+	r.recordLeaseState(ql)
+}
+
+// NewQLease creates the replica's quorum lease. After a restart, the lease
+// starts from the recovered instance counters, in a startup grace period
+// (see startupgrace.go): it grants no local reads, and writes must reach
+// every possible grantee, until any lease this replica may have promised
+// before the restart has certainly expired and fresh guards have been
+// answered.
+func (r *Replica) NewQLease() (*qlease.Lease, error) {
+	guard, duration, renewLead := r.currentLeaseTiming()
+	ql, err := qlease.NewLeaseWithTiming(r.N, guard, duration, renewLead)
+	if err != nil {
+		return nil, err
+	}
+	ql.Clock = r.Now
+	if r.Recovered != nil {
+		ql.PromisedByMeInst = r.Recovered.PromisedByMeInst
+		ql.PromisedToMeInst = r.Recovered.PromisedToMeInst
+		r.leaseHorizon = r.Recovered.PromisedUntil
+	}
+	r.beginStartupGrace(ql)
+	if r.Durable {
+		// keep fencing tokens monotonic across restarts
+		if r.Recovered != nil {
+			ql.Epoch = r.Recovered.EpochLimit
+		}
+		r.reserveLeaseEpochs(ql.Epoch)
+	}
+	return ql, nil
+}
+
+// FencingToken returns the fencing token of the lease this replica holds,
+// and whether it currently holds one (i.e., may serve local reads).
+func (r *Replica) FencingToken() (uint64, bool) {
+	ql := r.QLease
+	if ql == nil || !ql.CanRead() {
+		return 0, false
+	}
+	return ql.FencingToken(), true
+}
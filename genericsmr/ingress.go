@@ -0,0 +1,102 @@
+package genericsmr
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/state"
+)
+
+// Client messages are checked as they are read, before they reach the
+// protocol. A message may take at most PARAM_MAX_CLIENT_MSG_BYTES on the
+// wire (message type included), below the codecs' own bounds (see
+// fastrpc/limits.go), so that a client cannot have the replica allocate and
+// decode a huge message, e.g. a client lease naming a million keys: reading
+// stops at the limit, the client is answered ERR_TOO_LARGE if the message
+// was a proposal or a client lease request (with its CommandId, if it was
+// read by then), and the connection is closed, as the rest of the message
+// cannot be told from the next one. A client lease may also name at most
+// PARAM_MAX_LEASE_KEYS keys, or is denied with ERR_TOO_LARGE, and a proposal
+// must carry a known operation, or is answered ERR_INVALID.
+
+// the smallest PARAM_MAX_CLIENT_MSG_BYTES, which every fixed-size client
+// message fits in
+const MIN_CLIENT_MSG_BYTES = 64
+
+var ErrClientMsgTooLarge = errors.New("client message too large")
+
+// reads a client's messages, stopping a message at the limit
+type msgLimitReader struct {
+	r     fastrpc.Reader
+	limit int64 // 0 for none
+	left  int64 // bytes the current message may still take
+}
+
+// the next message may take up to limit bytes
+func (l *msgLimitReader) reset(limit int64) {
+	l.limit = limit
+	l.left = limit
+}
+
+func (l *msgLimitReader) exceeded() error {
+	return fmt.Errorf("%w: over the limit of %d bytes", ErrClientMsgTooLarge, l.limit)
+}
+
+func (l *msgLimitReader) Read(p []byte) (int, error) {
+	if l.limit <= 0 {
+		return l.r.Read(p)
+	}
+	if l.left <= 0 {
+		return 0, l.exceeded()
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
+func (l *msgLimitReader) ReadByte() (byte, error) {
+	if l.limit > 0 {
+		if l.left <= 0 {
+			return 0, l.exceeded()
+		}
+		l.left--
+	}
+	return l.r.ReadByte()
+}
+
+// the reason to reject cmd, proposed by a client, or nil
+func validateIngressCommand(cmd *state.Command) error {
+	if cmd.Op > state.CPUT {
+		return fmt.Errorf("unknown operation %d", cmd.Op)
+	}
+	return nil
+}
+
+// the reason to deny a client lease on keys, or nil
+func (r *Replica) validateLeaseKeys(keys []state.Key) error {
+	if max := r.Param(PARAM_MAX_LEASE_KEYS); max > 0 && int64(len(keys)) > max {
+		return fmt.Errorf("client lease on %d keys, over the limit of %d", len(keys), max)
+	}
+	return nil
+}
+
+// answer a message cut short at the limit, if its reply can carry the error,
+// before the connection is closed
+func (r *Replica) replyTooLarge(c *clientConn, msg interface{}, err error) {
+	switch m := msg.(type) {
+	case *genericsmrproto.Propose:
+		r.ReplyProposeErr(&Propose{m, -1, -1, c.writer, c.lock, c.replies, 0, 0, 0, 0, 0}, genericsmrproto.ERR_TOO_LARGE, err.Error())
+	case *genericsmrproto.ClientLease:
+		r.DenyClientLease(&ClientLeaseRequest{m, c.writer, c.lock, c.codec}, genericsmrproto.ERR_TOO_LARGE)
+	default:
+		return
+	}
+	c.lock.Lock()
+	c.writer.Flush()
+	c.lock.Unlock()
+}
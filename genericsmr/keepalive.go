@@ -0,0 +1,92 @@
+package genericsmr
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Half-open connections (e.g., to a peer whose machine died without closing
+// its sockets) are detected in two ways. TCP keepalives are turned on for
+// peer and client connections, with a configurable probe period instead of
+// the system's. And replicas ping their peers: every PeerPingIntervalNs, each
+// peer that has sent nothing for that long is sent RPC_CODE_PING, which it
+// answers with RPC_CODE_PONG, and a peer that has sent nothing at all for
+// PeerPingTimeoutNs is disconnected (see disconnectPeer). Like the hello,
+// pings carry no payload and are only sent to peers that have announced
+// extended RPC codes, so that older replicas never see them.
+
+var ErrPeerPingTimeout = errors.New("peer did not answer pings")
+
+// how long answering a ping may wait for the peer's connection
+const PEER_PONG_TIMEOUT = time.Second
+
+// turn on TCP keepalives on conn, probing every periodNs (0 leaves Go's
+// defaults in place, a negative period turns keepalives off)
+func setKeepAlive(conn net.Conn, periodNs int64) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok || periodNs == 0 {
+		return
+	}
+	if periodNs < 0 {
+		tc.SetKeepAlive(false)
+		return
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(time.Duration(periodNs))
+}
+
+// note that something arrived from the peer
+func (r *Replica) heardFromPeer(rid int) {
+	if r.cfg.PeerPingIntervalNs > 0 {
+		atomic.StoreInt64(&r.peerHeard[rid], time.Now().UnixNano())
+	}
+}
+
+// start pinging the peers, if configured to
+func (r *Replica) startPeerPings() {
+	if r.cfg.PeerPingIntervalNs <= 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	for i := range r.peerHeard {
+		atomic.StoreInt64(&r.peerHeard[i], now)
+	}
+	r.Tasks.Go("peer pings", RESTART_ON_PANIC, func() error {
+		r.pingPeers(time.Duration(r.cfg.PeerPingIntervalNs), r.cfg.PeerPingTimeoutNs)
+		return nil
+	})
+}
+
+func (r *Replica) pingPeers(interval time.Duration, timeoutNs int64) {
+	for !r.Shutdown {
+		time.Sleep(interval)
+		now := time.Now().UnixNano()
+		for q := int32(0); q < int32(r.N); q++ {
+			if q == r.Id || !r.PeerAlive(q) {
+				continue
+			}
+			silent := now - atomic.LoadInt64(&r.peerHeard[q])
+			if timeoutNs > 0 && silent >= timeoutNs {
+				r.disconnectPeer(q, ErrPeerPingTimeout)
+			} else if silent >= int64(interval) && r.extendedCodes[q] {
+				r.sendPeerCode(q, RPC_CODE_PING, interval)
+			}
+		}
+	}
+}
+
+// write a payload-less code to a peer, unless its connection is busy for
+// longer than timeout (the peer is then not silent, or will time out anyway)
+func (r *Replica) sendPeerCode(peerId int32, code byte, timeout time.Duration) {
+	if !lockWithTimeout(r.PeerWLocks[peerId], timeout) {
+		return
+	}
+	w := r.PeerWriters[peerId]
+	r.writePeerPrefix(w, peerId)
+	w.WriteByte(code)
+	r.peerCounters[peerId].sentMsg(uint16(code))
+	w.Flush()
+	r.PeerWLocks[peerId].Unlock()
+}
@@ -0,0 +1,86 @@
+package genericsmr
+
+import (
+	"sync"
+
+	"github.com/glycerine/qlease/fastrpc"
+)
+
+// PeerLock serializes the writers of a peer connection, with two priorities.
+// Lock takes it in the data lane; LockControl takes it in the control lane,
+// which goes first: while a control message (a lease guard or promise, or a
+// beacon) waits, no data message starts, so control messages wait for at most
+// the one data message being written.
+type PeerLock struct {
+	lock       *sync.Mutex
+	cond       *sync.Cond
+	held       bool
+	ctlWaiting int
+	waiting    int // writers waiting for the lock, in either lane
+}
+
+func NewPeerLock() *PeerLock {
+	l := &PeerLock{lock: new(sync.Mutex)}
+	l.cond = sync.NewCond(l.lock)
+	return l
+}
+
+func (l *PeerLock) Lock() {
+	l.lock.Lock()
+	l.waiting++
+	for l.held || l.ctlWaiting > 0 {
+		l.cond.Wait()
+	}
+	l.waiting--
+	l.held = true
+	l.lock.Unlock()
+}
+
+func (l *PeerLock) LockControl() {
+	l.lock.Lock()
+	l.ctlWaiting++
+	l.waiting++
+	for l.held {
+		l.cond.Wait()
+	}
+	l.ctlWaiting--
+	l.waiting--
+	l.held = true
+	l.lock.Unlock()
+}
+
+func (l *PeerLock) Unlock() {
+	l.lock.Lock()
+	l.held = false
+	l.cond.Broadcast()
+	l.lock.Unlock()
+}
+
+// Queued returns how many writers hold or wait for the lock: the depth of
+// the peer's send queue.
+func (l *PeerLock) Queued() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.held {
+		return l.waiting + 1
+	}
+	return l.waiting
+}
+
+// SendControlMsg is SendMsg in the control lane.
+func (r *Replica) SendControlMsg(peerId int32, code uint16, msg fastrpc.Serializable) error {
+	if !r.PeerAlive(peerId) {
+		return r.sendFailed(peerId, code, ErrPeerNotAlive)
+	}
+	if err := r.checkCode(peerId, code); err != nil {
+		return r.sendFailed(peerId, code, err)
+	}
+	if l := r.controlLane(peerId); l != nil {
+		l.lock.LockControl()
+		defer l.lock.Unlock()
+		return r.sendWritten(peerId, code, r.writeLaneMsg(peerId, l, code, msg))
+	}
+	r.PeerWLocks[peerId].LockControl()
+	defer r.PeerWLocks[peerId].Unlock()
+	return r.sendWritten(peerId, code, r.writeMsg(peerId, code, msg))
+}
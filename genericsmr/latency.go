@@ -0,0 +1,219 @@
+package genericsmr
+
+import (
+	"math/bits"
+	"sync/atomic"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// To tell whether slow commands are slowed by the network and the protocol,
+// by execution or by the clients, a replica stamps every client proposal
+// with the time it was received and the time the protocol committed it
+// (ProposalsCommitted), and when it replies, records in a histogram per
+// stage how long the proposal spent in each:
+//
+//	commit   from its receipt to its commit: waiting in the propose queue,
+//	         batching, and the protocol's rounds with its peers
+//	execute  from its commit to its reply: waiting for the instances before
+//	         it, and executing it (without Dreply, replies go out at commit,
+//	         so this is about nothing)
+//	reply    writing the reply to the client's connection
+//	total    from its receipt to its reply, of the proposals committed here
+//	local    from its receipt to its reply, of the reads served under the lease
+//
+// Proposals forwarded to another replica are timed there. Times are taken
+// from the replica's TimeSource, and the histograms have 4 buckets per power
+// of 2 of nanoseconds, so a percentile is at most 25% above the true one.
+// The Status RPC and the debug server report them (see LatencyStats).
+
+const (
+	LAT_COMMIT uint8 = iota
+	LAT_EXECUTE
+	LAT_REPLY
+	LAT_TOTAL
+	LAT_LOCAL
+	NUM_LAT_STAGES
+)
+
+var latStageNames = [NUM_LAT_STAGES]string{"commit", "execute", "reply", "total", "local"}
+
+func LatencyStageName(stage uint8) string {
+	if stage < NUM_LAT_STAGES {
+		return latStageNames[stage]
+	}
+	return "unknown"
+}
+
+// sub-buckets per power of 2
+const LAT_SUB_BITS = 2
+
+const latBuckets = (64 + 1) << LAT_SUB_BITS
+
+// A Histogram counts durations in buckets of exponentially growing width.
+// It may be recorded to and read from any goroutine.
+type Histogram struct {
+	counts [latBuckets]uint64
+	sumNs  uint64
+	maxNs  uint64
+}
+
+// the bucket of ns: its power of 2, then the LAT_SUB_BITS bits below the top one
+func latBucket(ns uint64) int {
+	e := bits.Len64(ns)
+	if e <= LAT_SUB_BITS {
+		return int(ns)
+	}
+	sub := (ns >> uint(e-1-LAT_SUB_BITS)) & (1<<LAT_SUB_BITS - 1)
+	return (e-LAT_SUB_BITS)<<LAT_SUB_BITS | int(sub)
+}
+
+// the largest duration in bucket b
+func latBucketMax(b int) uint64 {
+	if b < 1<<LAT_SUB_BITS {
+		return uint64(b)
+	}
+	e := b>>LAT_SUB_BITS + LAT_SUB_BITS
+	sub := uint64(b & (1<<LAT_SUB_BITS - 1))
+	if e == 64 && sub == 1<<LAT_SUB_BITS-1 {
+		return ^uint64(0)
+	}
+	return (1<<LAT_SUB_BITS|sub+1)<<uint(e-1-LAT_SUB_BITS) - 1
+}
+
+// Record counts a duration (negative ones, from clock steps, as 0).
+func (h *Histogram) Record(ns int64) {
+	if ns < 0 {
+		ns = 0
+	}
+	d := uint64(ns)
+	atomic.AddUint64(&h.counts[latBucket(d)], 1)
+	atomic.AddUint64(&h.sumNs, d)
+	for {
+		max := atomic.LoadUint64(&h.maxNs)
+		if d <= max || atomic.CompareAndSwapUint64(&h.maxNs, max, d) {
+			break
+		}
+	}
+}
+
+// LatencyBucket is a bucket of a histogram: Count durations of at most LeNs
+// (and more than the LeNs of the bucket before).
+type LatencyBucket struct {
+	LeNs  int64
+	Count uint64
+}
+
+// Buckets returns the buckets of the histogram that are not empty, in
+// order.
+func (h *Histogram) Buckets() []LatencyBucket {
+	var bs []LatencyBucket
+	for b := range h.counts {
+		if n := atomic.LoadUint64(&h.counts[b]); n > 0 {
+			le := latBucketMax(b)
+			if le > 1<<63-1 {
+				le = 1<<63 - 1
+			}
+			bs = append(bs, LatencyBucket{int64(le), n})
+		}
+	}
+	return bs
+}
+
+// Summary returns the count, mean, maximum and percentiles of the
+// durations recorded; a percentile is the upper bound of its bucket, or the
+// maximum if that is lower.
+func (h *Histogram) Summary() genericsmrproto.LatencySummary {
+	var s genericsmrproto.LatencySummary
+	bs := h.Buckets()
+	for _, b := range bs {
+		s.Count += b.Count
+	}
+	if s.Count == 0 {
+		return s
+	}
+	s.MeanNs = int64(atomic.LoadUint64(&h.sumNs) / s.Count)
+	s.MaxNs = int64(atomic.LoadUint64(&h.maxNs))
+	pct := func(p float64) int64 {
+		rank := uint64(p*float64(s.Count-1)) + 1
+		seen := uint64(0)
+		for _, b := range bs {
+			if seen += b.Count; seen >= rank {
+				if b.LeNs > s.MaxNs {
+					return s.MaxNs
+				}
+				return b.LeNs
+			}
+		}
+		return s.MaxNs
+	}
+	s.P50Ns, s.P90Ns, s.P99Ns, s.P999Ns = pct(0.5), pct(0.9), pct(0.99), pct(0.999)
+	return s
+}
+
+type latencies struct {
+	stages [NUM_LAT_STAGES]Histogram
+}
+
+// ProposalsCommitted stamps the client proposals of an instance the protocol
+// has just committed, and records how long they took to commit.
+func (r *Replica) ProposalsCommitted(props []*Propose) {
+	now := r.Clock.Nanos()
+	for _, p := range props {
+		if p == nil {
+			continue
+		}
+		atomic.StoreInt64(&p.CommittedNs, now)
+		if p.ReceivedNs > 0 {
+			r.latencies.stages[LAT_COMMIT].Record(now - p.ReceivedNs)
+		}
+	}
+}
+
+// record how long a proposal about to be replied to took to execute, and
+// return when its reply was ready
+func (r *Replica) replyReady(propose *Propose) int64 {
+	if propose.ReceivedNs == 0 {
+		return 0
+	}
+	ready := r.Clock.Nanos()
+	if committed := atomic.LoadInt64(&propose.CommittedNs); committed > 0 {
+		r.latencies.stages[LAT_EXECUTE].Record(ready - committed)
+	}
+	return ready
+}
+
+// record how long the reply to a proposal, ready since ready, took to write,
+// and how long the proposal took in all
+func (r *Replica) replied(propose *Propose, ready int64, local bool) {
+	if ready == 0 {
+		return
+	}
+	lat := &r.latencies.stages
+	now := r.Clock.Nanos()
+	lat[LAT_REPLY].Record(now - ready)
+	if local {
+		lat[LAT_LOCAL].Record(now - propose.ReceivedNs)
+	} else if atomic.LoadInt64(&propose.CommittedNs) > 0 {
+		lat[LAT_TOTAL].Record(now - propose.ReceivedNs)
+	}
+}
+
+// LatencyStats summarizes the replica's latency histograms, by stage.
+func (r *Replica) LatencyStats() []genericsmrproto.LatencySummary {
+	sums := make([]genericsmrproto.LatencySummary, NUM_LAT_STAGES)
+	for stage := uint8(0); stage < NUM_LAT_STAGES; stage++ {
+		sums[stage] = r.latencies.stages[stage].Summary()
+		sums[stage].Stage = LatencyStageName(stage)
+	}
+	return sums
+}
+
+// LatencyHistogram returns the non-empty buckets of the histogram of a
+// stage.
+func (r *Replica) LatencyHistogram(stage uint8) []LatencyBucket {
+	if stage >= NUM_LAT_STAGES {
+		return nil
+	}
+	return r.latencies.stages[stage].Buckets()
+}
@@ -0,0 +1,72 @@
+package genericsmr
+
+import (
+	"time"
+)
+
+// lease acknowledgments describe the reachable replicas with a bit mask
+const MAX_LEASE_ACK_REPLICAS = 64
+
+// LeaseObligations returns what a replica reports when it acknowledges a
+// write, for the proposer's LeaseAcks: the replicas it can still reach, and
+// so renew leases to (bit i for replica i, itself included), and until when
+// the promises it made to the others may keep their leases in effect.
+func (r *Replica) LeaseObligations() (until int64, reachable uint64) {
+	reachable = uint64(1) << uint(r.Id)
+	for q := 0; q < r.N; q++ {
+		if r.PeerAlive(int32(q)) {
+			reachable |= 1 << uint(q)
+		} else if ql := r.QLease; ql != nil && q != int(r.Id) && ql.LatestRepliesReceived[q] > until {
+			until = ql.LatestRepliesReceived[q]
+		}
+	}
+	return until, reachable
+}
+
+// LeaseAcks collects the acknowledgments of a write to keys under lease, for
+// protocols without a leader that tracks lease configurations (e.g., where
+// every replica grants leases on every key to every other replica).
+//
+// Such a write may commit only once every replica that may hold a read lease
+// on its keys knows it is in flight (and so stops reading them locally until
+// it is executed). A replica that has not acknowledged the write must be
+// unreachable from every replica that has, so that none of these can renew
+// its lease, and the promises they made before must have expired; as the
+// acknowledgments come from a majority, the replica cannot hold a lease.
+type LeaseAcks struct {
+	acked     []bool
+	until     int64  // when the promises of the replicas in acked to unreachable replicas expire
+	reachable uint64 // the replicas reachable by some replica in acked
+}
+
+func NewLeaseAcks(n int) *LeaseAcks {
+	return &LeaseAcks{acked: make([]bool, n)}
+}
+
+// Note records the acknowledgment of replica from, with its LeaseObligations.
+func (a *LeaseAcks) Note(from int32, until int64, reachable uint64) {
+	a.acked[from] = true
+	if until > a.until {
+		a.until = until
+	}
+	a.reachable |= reachable
+}
+
+func (a *LeaseAcks) Acked(q int32) bool {
+	return a.acked[q]
+}
+
+// Allows reports whether the write may commit, as far as leases are concerned.
+func (a *LeaseAcks) Allows() bool {
+	missing := false
+	for q := range a.acked {
+		if a.acked[q] {
+			continue
+		}
+		if a.reachable&(1<<uint(q)) != 0 {
+			return false
+		}
+		missing = true
+	}
+	return !missing || time.Now().UnixNano() >= a.until
+}
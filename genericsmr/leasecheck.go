@@ -0,0 +1,96 @@
+package genericsmr
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/glycerine/qlease/state"
+)
+
+// A LeaseChecker asserts, while developing a protocol on top of the lease
+// layer, that no read served locally misses a write already committed to the
+// key. It remembers, per key, the latest instance that committed a write to
+// it, as protocols report commits (LeaseWriteCommitted), and checks every
+// local read (LeaseReadServed) against it: a read of a key by a replica that
+// has only executed up to an earlier instance is a violation, which is
+// counted and logged, or made to panic. Instances must be those of a single
+// log (e.g., Paxos or Mencius, not EPaxos). Replicas only see the commits
+// they learn of; replicas that run in one process (e.g., a test cluster)
+// should share one checker, so that a commit anywhere is checked against
+// reads everywhere. Checking costs a lock and a map lookup per read and per
+// write, so it is meant for debugging.
+type LeaseChecker struct {
+	lock       sync.Mutex
+	writes     map[state.Key]committedWrite
+	panics     bool
+	violations uint64
+}
+
+// the latest committed write to a key
+type committedWrite struct {
+	inst    int32
+	replica int32 // the replica that reported it first
+}
+
+// NewLeaseChecker returns a checker that panics on violations if panics,
+// and otherwise logs and counts them.
+func NewLeaseChecker(panics bool) *LeaseChecker {
+	return &LeaseChecker{writes: make(map[state.Key]committedWrite), panics: panics}
+}
+
+// Committed notes that replica learned that instance inst, running cmds,
+// committed.
+func (c *LeaseChecker) Committed(replica int32, inst int32, cmds []state.Command) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i := range cmds {
+		if !state.IsWrite(&cmds[i]) && cmds[i].Op != state.DELETE {
+			continue
+		}
+		if w, present := c.writes[cmds[i].K]; !present || w.inst < inst {
+			c.writes[cmds[i].K] = committedWrite{inst, replica}
+		}
+	}
+}
+
+// Read checks a local read of k by replica, which had executed every
+// instance up to applied, and reports whether it saw every committed write.
+func (c *LeaseChecker) Read(replica int32, k state.Key, applied int32) bool {
+	c.lock.Lock()
+	w, present := c.writes[k]
+	c.lock.Unlock()
+	if !present || w.inst <= applied {
+		return true
+	}
+	atomic.AddUint64(&c.violations, 1)
+	msg := fmt.Sprintf("lease violation: replica %d read key %d locally at instance %d, but instance %d (committed at replica %d) writes it",
+		replica, k, applied, w.inst, w.replica)
+	if c.panics {
+		panic(msg)
+	}
+	log.Println(msg)
+	return false
+}
+
+// Violations returns the number of violations found so far.
+func (c *LeaseChecker) Violations() uint64 {
+	return atomic.LoadUint64(&c.violations)
+}
+
+// LeaseWriteCommitted reports to the replica's LeaseChecker, if any, that
+// instance inst, running cmds, committed.
+func (r *Replica) LeaseWriteCommitted(inst int32, cmds []state.Command) {
+	if c := r.cfg.LeaseChecker; c != nil {
+		c.Committed(r.Id, inst, cmds)
+	}
+}
+
+// LeaseReadServed reports to the replica's LeaseChecker, if any, a read of k
+// served locally with every instance up to applied executed.
+func (r *Replica) LeaseReadServed(k state.Key, applied int32) {
+	if c := r.cfg.LeaseChecker; c != nil {
+		c.Read(r.Id, k, applied)
+	}
+}
@@ -0,0 +1,163 @@
+package genericsmr
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// A replica holds its quorum lease through the promises its peers renew
+// every renewal interval, whether or not its clients read from it. With
+// PARAM_LEASE_IDLE_NS set, a replica whose clients have sent it no reads for
+// that long suspends its lease: it tells its peers (LeaseIdle), which stop
+// renewing their promises to it, as they do for a dead peer, so that the
+// lease lapses and costs no more traffic. The next read it receives resumes
+// the lease: that read is served as it would be without the lease, and the
+// replica tells its peers, which guard it again on their next renewal, as
+// they do a peer that came back, and renew it from then on. A peer that
+// loses its connection to the replica forgets the suspension, which the
+// replica therefore repeats every PARAM_LEASE_IDLE_NS while it lasts. With
+// hierarchical leases, a delegate counts the sub-grants it is asked for as
+// reads, since the replicas of its region read under its lease.
+// LeaseIdleStats counts the suspensions, and the time from resuming the
+// lease to reading locally again.
+
+// how often the replica checks whether it has gone without reads
+const LEASE_IDLE_CHECK_NS = 100 * 1e6
+
+// LeaseIdleStats count the suspensions of the replica's lease, and the
+// reacquisitions that followed them.
+type LeaseIdleStats struct {
+	Suspended       bool   // the lease is suspended now
+	Suspensions     uint64 // times the lease was suspended
+	Reacquisitions  uint64 // times the replica read locally again after resuming it
+	ReacquireNs     uint64 // the time the reacquisitions took, in total
+	LastReacquireNs uint64 // the time the latest one took
+	MaxReacquireNs  uint64 // the time the longest one took
+}
+
+type leaseIdle struct {
+	lastRead  int64   // when a client last sent a read (accessed atomically)
+	suspended int32   // 1 while the lease is suspended (accessed atomically)
+	resumed   int64   // when the lease was resumed, until it is held again (0 if not; accessed atomically)
+	announced int64   // when the suspension was last announced, which only the checking goroutine touches
+	peers     []int32 // per peer, 1 while it has its lease suspended (accessed atomically)
+	stats     LeaseIdleStats
+}
+
+func newLeaseIdle(n int) *leaseIdle {
+	return &leaseIdle{peers: make([]int32, n)}
+}
+
+// LeaseSuspended reports whether the replica has suspended its lease for
+// lack of reads.
+func (r *Replica) LeaseSuspended() bool {
+	return atomic.LoadInt32(&r.leaseIdle.suspended) == 1
+}
+
+// whether peer q has suspended its lease, so that its promises are not
+// renewed
+func (r *Replica) peerLeaseIdle(q int32) bool {
+	return atomic.LoadInt32(&r.leaseIdle.peers[q]) == 1
+}
+
+// note a read from a client, which resumes a suspended lease
+func (r *Replica) noteLeaseRead() {
+	li := r.leaseIdle
+	now := r.Now()
+	atomic.StoreInt64(&li.lastRead, now)
+	if atomic.CompareAndSwapInt32(&li.suspended, 1, 0) {
+		atomic.StoreInt64(&li.resumed, now)
+		r.announceLeaseIdle(FALSE)
+	}
+}
+
+// note that the replica may read locally again, after ql.ReadLocallyUntil
+// moved past now
+func (r *Replica) leaseReacquired(now int64) {
+	li := r.leaseIdle
+	resumed := atomic.SwapInt64(&li.resumed, 0)
+	if resumed == 0 || now < resumed {
+		return
+	}
+	took := uint64(now - resumed)
+	st := &li.stats
+	atomic.AddUint64(&st.Reacquisitions, 1)
+	atomic.AddUint64(&st.ReacquireNs, took)
+	atomic.StoreUint64(&st.LastReacquireNs, took)
+	for {
+		max := atomic.LoadUint64(&st.MaxReacquireNs)
+		if took <= max || atomic.CompareAndSwapUint64(&st.MaxReacquireNs, max, took) {
+			break
+		}
+	}
+}
+
+func (r *Replica) announceLeaseIdle(idle uint8) {
+	m := &genericsmrproto.LeaseIdle{ReplicaId: r.Id, Idle: idle}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id && r.PeerAlive(q) {
+			r.SendControlMsg(q, r.leaseIdleRPC, m)
+		}
+	}
+}
+
+func (r *Replica) handleLeaseIdle(m *genericsmrproto.LeaseIdle) {
+	q := m.ReplicaId
+	if q < 0 || q >= int32(r.N) || q == r.Id {
+		return
+	}
+	if m.Idle == TRUE {
+		atomic.StoreInt32(&r.leaseIdle.peers[q], 1)
+		return
+	}
+	if atomic.SwapInt32(&r.leaseIdle.peers[q], 0) == 1 {
+		// it ignores promises until guarded again
+		atomic.StoreInt32(&r.leaseRejoined[q], 1)
+	}
+}
+
+// suspend the lease whenever PARAM_LEASE_IDLE_NS passes without reads
+func (r *Replica) suspendIdleLease() {
+	li := r.leaseIdle
+	atomic.CompareAndSwapInt64(&li.lastRead, 0, r.Now())
+	for !r.Shutdown {
+		time.Sleep(LEASE_IDLE_CHECK_NS)
+		idle := r.Param(PARAM_LEASE_IDLE_NS)
+		now := r.Now()
+		if r.LeaseSuspended() {
+			if idle <= 0 {
+				// suspension turned off: resume
+				r.noteLeaseRead()
+			} else if now-li.announced >= idle {
+				li.announced = now
+				r.announceLeaseIdle(TRUE)
+			}
+			continue
+		}
+		if idle <= 0 || now-atomic.LoadInt64(&li.lastRead) < idle {
+			continue
+		}
+		if atomic.CompareAndSwapInt32(&li.suspended, 0, 1) {
+			atomic.StoreInt64(&li.resumed, 0)
+			atomic.AddUint64(&li.stats.Suspensions, 1)
+			li.announced = now
+			r.announceLeaseIdle(TRUE)
+		}
+	}
+}
+
+// LeaseIdleStats returns the suspensions and reacquisitions of the lease so
+// far.
+func (r *Replica) LeaseIdleStats() LeaseIdleStats {
+	st := &r.leaseIdle.stats
+	return LeaseIdleStats{
+		Suspended:       r.LeaseSuspended(),
+		Suspensions:     atomic.LoadUint64(&st.Suspensions),
+		Reacquisitions:  atomic.LoadUint64(&st.Reacquisitions),
+		ReacquireNs:     atomic.LoadUint64(&st.ReacquireNs),
+		LastReacquireNs: atomic.LoadUint64(&st.LastReacquireNs),
+		MaxReacquireNs:  atomic.LoadUint64(&st.MaxReacquireNs),
+	}
+}
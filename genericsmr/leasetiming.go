@@ -0,0 +1,101 @@
+package genericsmr
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/glycerine/qlease/qlease"
+)
+
+// The timing of the quorum lease comes from runtime parameters, so that
+// each deployment can fit it to its network (a WAN needs a much longer
+// guard, lease and renewal lead time than a LAN), and operators can change
+// it later: PARAM_LEASE_GUARD_NS, PARAM_LEASE_DURATION_NS,
+// PARAM_LEASE_RENEW_LEAD_NS and PARAM_LEASE_RENEW_JITTER_NS. The guard must
+// be shorter than the lease, and the lead time and jitter together too.
+// Changes take effect with the next guard or promise, which carry their own
+// durations, and protocols renew their leases when NextLeaseRenewal says
+// (see renewals.go).
+
+func isLeaseTiming(p uint8) bool {
+	return p == PARAM_LEASE_GUARD_NS || p == PARAM_LEASE_DURATION_NS || p == PARAM_LEASE_RENEW_LEAD_NS ||
+		p == PARAM_LEASE_RENEW_JITTER_NS
+}
+
+func setDefaultLeaseTiming(params []int64) {
+	params[PARAM_LEASE_GUARD_NS] = qlease.GUARD_DURATION_NS
+	params[PARAM_LEASE_DURATION_NS] = qlease.DEFAULT_LEASE_DURATION_NS
+	params[PARAM_LEASE_RENEW_LEAD_NS] = 0
+	params[PARAM_LEASE_RENEW_JITTER_NS] = 0
+}
+
+// the lease timing set by params (indexed by parameter)
+func leaseTiming(params []int64) (guard time.Duration, duration time.Duration, renewLead time.Duration) {
+	guard = time.Duration(params[PARAM_LEASE_GUARD_NS])
+	duration = time.Duration(params[PARAM_LEASE_DURATION_NS])
+	renewLead = time.Duration(params[PARAM_LEASE_RENEW_LEAD_NS])
+	if renewLead == 0 {
+		renewLead = qlease.DefaultRenewLead(duration)
+	}
+	return
+}
+
+// the renewal jitter set by params, for a lease of duration renewed renewLead
+// before it expires
+func renewJitter(params []int64, duration time.Duration, renewLead time.Duration) time.Duration {
+	if jitter := time.Duration(params[PARAM_LEASE_RENEW_JITTER_NS]); jitter > 0 {
+		return jitter
+	}
+	return defaultRenewJitter(duration, renewLead)
+}
+
+// the default renewal jitter: 100ms, but at most an eighth of the lease, and
+// half of what the lead time leaves of it
+func defaultRenewJitter(duration time.Duration, renewLead time.Duration) time.Duration {
+	jitter := 100 * time.Millisecond
+	if jitter > duration/8 {
+		jitter = duration / 8
+	}
+	if jitter > (duration-renewLead)/2 {
+		jitter = (duration - renewLead) / 2
+	}
+	return jitter
+}
+
+// check that the lease timing parameters of params fit together
+func validateLeaseTiming(params []int64) error {
+	guard, duration, renewLead := leaseTiming(params)
+	if err := qlease.ValidateTiming(guard, duration, renewLead); err != nil {
+		return err
+	}
+	if jitter := renewJitter(params, duration, renewLead); renewLead+jitter >= duration {
+		return fmt.Errorf("renewal lead time %v plus jitter %v must be less than the lease duration %v", renewLead, jitter, duration)
+	}
+	return nil
+}
+
+func (r *Replica) currentLeaseParams() []int64 {
+	var params [NUM_PARAMS]int64
+	for _, p := range []uint8{PARAM_LEASE_GUARD_NS, PARAM_LEASE_DURATION_NS, PARAM_LEASE_RENEW_LEAD_NS, PARAM_LEASE_RENEW_JITTER_NS} {
+		params[p] = r.Param(p)
+	}
+	return params[:]
+}
+
+func (r *Replica) currentLeaseTiming() (time.Duration, time.Duration, time.Duration) {
+	return leaseTiming(r.currentLeaseParams())
+}
+
+// RefreshLeaseTiming sets the timing of ql from the parameters.
+func (r *Replica) RefreshLeaseTiming(ql *qlease.Lease) {
+	guard, duration, renewLead := r.currentLeaseTiming()
+	ql.Guard, ql.Duration, ql.RenewLead = int64(guard), int64(duration), int64(renewLead)
+}
+
+// LeaseRenewInterval is how long a lease lasts before it is renewed: the
+// lease duration less the renewal lead time (see NextLeaseRenewal for when
+// to renew).
+func (r *Replica) LeaseRenewInterval() time.Duration {
+	_, duration, renewLead := r.currentLeaseTiming()
+	return duration - renewLead
+}
@@ -0,0 +1,77 @@
+package genericsmr
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/glycerine/qlease/qlease"
+)
+
+// A durable replica logs its lease state to the stable store ahead of the
+// messages that depend on it: the lease instances it promised and was
+// promised (whenever they change), and how long the promises it has sent may
+// keep grantees' leases in effect, before it sends them. A replica that
+// crashes and restarts then neither serves local reads from promises it has
+// forgotten (it holds no lease until promised again) nor lets writes skip
+// replicas that may still hold leases it granted: they must reach every
+// grantee until both the recorded horizon and a full lease duration after
+// the restart have passed (see NewQLease). So that renewals seldom wait on
+// the disk, the horizon is recorded LEASE_HORIZON_LOOKAHEAD lease durations
+// further than needed.
+//
+// The epochs of the lease's fencing tokens (qlease.Lease.Epoch) must not
+// repeat across restarts either. A durable replica reserves them in blocks
+// of LEASE_EPOCH_BLOCK, recording the end of the block before it uses the
+// first epoch in it, and after a restart starts past the last block
+// recorded; the epoch goes on counting in all 32 bits of the token,
+// however often the lease is reacquired and the replica restarted.
+
+const LEASE_HORIZON_LOOKAHEAD = 2
+
+const LEASE_EPOCH_BLOCK = 1 << 10
+
+// record that promises sent from now on may keep grantees' leases in effect
+// until until, unless the recorded horizon covers it already
+func (r *Replica) logPromiseHorizon(ql *qlease.Lease, until int64) {
+	if !r.Durable || until <= r.leaseHorizon {
+		return
+	}
+	r.leaseHorizon = until + LEASE_HORIZON_LOOKAHEAD*ql.Duration
+	r.recordLeaseState(ql)
+}
+
+// payload: PromisedByMeInst (int32) | PromisedToMeInst (int32) | horizon (int64)
+func (r *Replica) recordLeaseState(ql *qlease.Lease) {
+	var b [16]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(ql.PromisedByMeInst))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(ql.PromisedToMeInst))
+	binary.LittleEndian.PutUint64(b[8:16], uint64(r.leaseHorizon))
+	r.RecordToStableStore(RECORD_LEASE_STATE, b[:])
+	r.SyncStableStore()
+}
+
+func (rec *Recovered) unmarshalLeaseState(b []byte) {
+	if len(b) < 16 {
+		return
+	}
+	rec.PromisedByMeInst = int32(binary.LittleEndian.Uint32(b[0:4]))
+	rec.PromisedToMeInst = int32(binary.LittleEndian.Uint32(b[4:8]))
+	rec.PromisedUntil = int64(binary.LittleEndian.Uint64(b[8:16]))
+}
+
+// start a new epoch of the lease, as the replica holds it anew
+func (r *Replica) nextLeaseEpoch(ql *qlease.Lease) {
+	atomic.AddUint32(&ql.Epoch, 1)
+	if r.Durable && ql.Epoch >= r.epochLimit {
+		r.reserveLeaseEpochs(ql.Epoch)
+	}
+}
+
+// record that the epochs from from on, for a block, may be used
+func (r *Replica) reserveLeaseEpochs(from uint32) {
+	r.epochLimit = from + LEASE_EPOCH_BLOCK
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], r.epochLimit)
+	r.RecordToStableStore(RECORD_LEASE_EPOCHS, b[:])
+	r.SyncStableStore()
+}
@@ -0,0 +1,54 @@
+package genericsmr
+
+import (
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/state"
+)
+
+// Applications can wrap the path of client proposals to the protocol with
+// middleware (see WithProposeMiddleware), without modifying genericsmr: to
+// validate commands, transform them, audit them, or route them elsewhere. A
+// ProposeMiddleware takes the next handler of the chain and returns a
+// handler that does its work and then either calls next, or answers the
+// proposal itself (e.g., with ReplyProposeErr) and does not. The chain runs
+// on the goroutine of the client's connection, once the proposal has been
+// routed to its group, checked against the ACL and rate limits, and found
+// not to be a retry the result cache answers; so middleware that rewrites a
+// command must keep its key in the group, and must not make it one the
+// client may not propose. The last handler hands the proposal to the
+// protocol (and records it, when tracing). Middleware configured first runs
+// first.
+
+// A ProposeHandler handles a proposal from client.
+type ProposeHandler func(client *ClientInfo, p *Propose)
+
+// A ProposeMiddleware wraps the rest of the chain, next.
+type ProposeMiddleware func(next ProposeHandler) ProposeHandler
+
+// ChainProposeMiddleware wraps h in mw, the first outermost.
+func ChainProposeMiddleware(h ProposeHandler, mw ...ProposeMiddleware) ProposeHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// hand a client's proposal to the protocol
+func (r *Replica) submitProposal(client *ClientInfo, p *Propose) {
+	r.trace(TRACE_PROPOSE, int64(client.Id), 0, p.Propose)
+	r.schedule(p)
+}
+
+// ValidateProposals returns middleware that answers the proposals whose
+// command valid rejects with ERR_INVALID, and the error's message.
+func ValidateProposals(r *Replica, valid func(client *ClientInfo, cmd *state.Command) error) ProposeMiddleware {
+	return func(next ProposeHandler) ProposeHandler {
+		return func(client *ClientInfo, p *Propose) {
+			if err := valid(client, &p.Command); err != nil {
+				r.ReplyProposeErr(p, genericsmrproto.ERR_INVALID, err.Error())
+				return
+			}
+			next(client, p)
+		}
+	}
+}
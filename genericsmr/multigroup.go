@@ -0,0 +1,278 @@
+package genericsmr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/glycerine/qlease/hlc"
+)
+
+// A GroupMux lets one process host several independent SMR groups, each a
+// Replica with its own state, lease and log, on a single port. Every pair of
+// processes shares one connection, and every message on it is prefixed by the
+// (2-byte, little-endian) ID of the group it belongs to.
+// Client connections start out talking to group 0 and may switch groups with
+// a SELECT_GROUP message.
+type GroupMux struct {
+	Id           int32
+	N            int
+	PeerAddrList []string
+	Listener     net.Listener
+	ListenAddr   string // address to bind if Listener is nil (empty for PeerAddrList[Id])
+
+	Peers       []net.Conn
+	PeerReaders []*bufio.Reader
+	PeerWriters []*bufio.Writer
+	PeerWLocks  []*PeerLock
+	PeerStates  *PeerStates // shared by the groups
+
+	Shards  *ShardMap    // routes client requests to the group owning the key (nil to disable routing)
+	Clients *ClientTable // client connections of all the groups
+	HLC     *hlc.Clock   // the groups' shared HLC, so that their timestamps compare
+	cork    *replyCork
+
+	lock      *sync.Mutex
+	groups    map[uint16]*Replica
+	connect   sync.Once
+	connected chan bool // closed once all peers are connected
+	accept    sync.Once
+}
+
+// how long a message for a group that does not exist (yet) may wait for it
+const GROUP_REGISTRATION_WAIT_MS = 10000
+
+// NewGroupMux creates a mux for replica id of every group. If l is nil, the mux
+// listens on ListenAddr or peerAddrList[id] when it first connects to its peers.
+func NewGroupMux(id int, peerAddrList []string, l net.Listener) *GroupMux {
+	n := len(peerAddrList)
+	peerAddrList, err := NormalizePeerAddrList(peerAddrList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m := &GroupMux{
+		Id:           int32(id),
+		N:            n,
+		PeerAddrList: peerAddrList,
+		Listener:     l,
+		Peers:        make([]net.Conn, n),
+		PeerReaders:  make([]*bufio.Reader, n),
+		PeerWriters:  make([]*bufio.Writer, n),
+		PeerWLocks:   make([]*PeerLock, n),
+		PeerStates:   NewPeerStates(n),
+		lock:         new(sync.Mutex),
+		Clients:      NewClientTable(),
+		HLC:          hlc.New(nil),
+		cork:         newReplyCork(),
+		groups:       make(map[uint16]*Replica),
+		connected:    make(chan bool),
+	}
+	for i := range m.PeerWLocks {
+		m.PeerWLocks[i] = NewPeerLock()
+	}
+	return m
+}
+
+func (m *GroupMux) addGroup(group uint16, r *Replica) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, present := m.groups[group]; present {
+		return fmt.Errorf("group %d already registered", group)
+	}
+	if r.N != m.N || r.Id != m.Id {
+		return fmt.Errorf("group %d has replica %d of %d, but the mux is for replica %d of %d", group, r.Id, r.N, m.Id, m.N)
+	}
+	m.groups[group] = r
+	return nil
+}
+
+// Group returns the replica of the given group, or nil.
+func (m *GroupMux) Group(group uint16) *Replica {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.groups[group]
+}
+
+// Groups returns the replicas of all the groups, ordered by group ID.
+func (m *GroupMux) Groups() []*Replica {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ids := make([]int, 0, len(m.groups))
+	for g := range m.groups {
+		ids = append(ids, int(g))
+	}
+	sort.Ints(ids)
+	reps := make([]*Replica, len(ids))
+	for i, g := range ids {
+		reps[i] = m.groups[uint16(g)]
+	}
+	return reps
+}
+
+// ConnectToPeers connects to every peer process once, whichever group asks
+// first, and returns when all connections are established.
+func (m *GroupMux) ConnectToPeers() {
+	m.connect.Do(func() {
+		go m.connectToPeers()
+	})
+	<-m.connected
+}
+
+func (m *GroupMux) connectToPeers() {
+	m.startAccepting()
+
+	for i := 0; i < int(m.Id); i++ {
+		var conn net.Conn
+		for {
+			var err error
+			if conn, err = net.Dial("tcp", m.PeerAddrList[i]); err == nil {
+				break
+			}
+			time.Sleep(1e9)
+		}
+		if err := writePeerHandshake(conn, m.Id); err != nil {
+			fmt.Println("Write id error:", err)
+			continue
+		}
+		m.addPeer(int32(i), conn)
+	}
+	// the replicas with higher IDs dial this one
+	for q := m.Id + 1; q < int32(m.N); q++ {
+		for !m.PeerStates.Get(q).Connected() {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	log.Printf("Replica id: %d. Done connecting to peers for all groups\n", m.Id)
+
+	for rid := 0; rid < m.N; rid++ {
+		if int32(rid) == m.Id || m.PeerReaders[rid] == nil {
+			continue
+		}
+		go m.peerListener(rid, m.PeerReaders[rid])
+	}
+	close(m.connected)
+}
+
+// make conn the connection to peer id, unless it already has one
+func (m *GroupMux) addPeer(id int32, conn net.Conn) bool {
+	reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+	if groups := m.Groups(); len(groups) > 0 {
+		// the groups are expected to agree on them
+		groups[0].tuneConn(conn, true)
+		conn = groups[0].peerConn(id, conn)
+		reader, writer = groups[0].newPeerReader(conn), groups[0].newPeerWriter(conn)
+	}
+	m.lock.Lock()
+	if m.Peers[id] != nil {
+		m.lock.Unlock()
+		return false
+	}
+	m.Peers[id] = conn
+	m.PeerReaders[id] = reader
+	m.PeerWriters[id] = writer
+	m.lock.Unlock()
+	m.PeerStates.Set(id, PEER_ALIVE)
+	return true
+}
+
+func (m *GroupMux) peerListener(rid int, reader *bufio.Reader) {
+	var b [2]byte
+	for {
+		if _, err := io.ReadFull(reader, b[:]); err != nil {
+			log.Printf("Connection to replica %d lost: %v\n", rid, err)
+			break
+		}
+		group := binary.LittleEndian.Uint16(b[:])
+		r := m.Group(group)
+		for i := 0; r == nil && i < GROUP_REGISTRATION_WAIT_MS; i++ {
+			// the group may not have been created in this process yet
+			time.Sleep(1e6)
+			r = m.Group(group)
+		}
+		if r == nil {
+			// without knowing the group's message types, the stream cannot be resynchronized
+			log.Printf("Message for unknown group %d from replica %d; dropping the connection\n", group, rid)
+			break
+		}
+		if err := r.handlePeerMessage(rid, reader); err != nil {
+			log.Printf("Error reading from replica %d (group %d): %v\n", rid, group, err)
+			break
+		}
+	}
+	m.PeerStates.Set(int32(rid), PEER_DEAD)
+}
+
+// WaitForClientConnections accepts client connections for all the groups,
+// on the peers' port (see accept.go).
+func (m *GroupMux) WaitForClientConnections() {
+	m.startAccepting()
+}
+
+// accept peer and client connections on the mux's port, once
+func (m *GroupMux) startAccepting() {
+	m.accept.Do(func() {
+		if m.Listener == nil {
+			addr := m.ListenAddr
+			if addr == "" {
+				addr = m.PeerAddrList[m.Id]
+			}
+			var err error
+			if m.Listener, err = net.Listen("tcp", addr); err != nil {
+				log.Fatal(err)
+			}
+		}
+		go func() {
+			for {
+				conn, err := m.Listener.Accept()
+				if err != nil {
+					log.Println("Accept error:", err)
+					continue
+				}
+				go m.classifyConn(conn)
+			}
+		}()
+	})
+}
+
+// tell a peer dialing in from a client, by the first byte
+func (m *GroupMux) classifyConn(conn net.Conn) {
+	var b [1]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		conn.Close()
+		return
+	}
+	if b[0] == PEER_CONN_MAGIC {
+		q, ok := readPeerHandshake(conn, m.Id, m.N)
+		if ok && !m.addPeer(q, conn) {
+			log.Printf("Rejecting another connection from replica %d\n", q)
+			ok = false
+		}
+		if !ok {
+			conn.Close()
+		}
+		return
+	}
+	r := m.Group(0)
+	if r == nil {
+		log.Println("No group 0 to serve client connections")
+		conn.Close()
+		return
+	}
+	r.tuneConn(conn, false)
+	r.admitClient(&prefixConn{conn, b[0], true})
+}
+
+func (r *Replica) writeGroupPrefix(w *bufio.Writer) {
+	if r.mux == nil {
+		return
+	}
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], r.GroupId)
+	w.Write(b[:])
+}
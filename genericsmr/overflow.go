@@ -0,0 +1,81 @@
+package genericsmr
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/glycerine/qlease/fastrpc"
+)
+
+// What happens to a message from a peer when the queue of its RPC code is
+// full. By default, the reader of the peer's connection waits for room, which
+// holds up every other message from that peer until the protocol catches up.
+// Messages that are only useful while fresh (e.g., lease promises, which are
+// renewed anyway) may be dropped instead, and counted.
+type OverflowPolicy uint32
+
+const (
+	OVERFLOW_BLOCK       OverflowPolicy = iota // wait for room
+	OVERFLOW_DROP_OLDEST                       // make room by dropping the oldest queued message
+	OVERFLOW_DROP_NEWEST                       // drop the message that does not fit
+)
+
+var overflowPolicyNames = []string{"block", "drop-oldest", "drop-newest"}
+
+func (p OverflowPolicy) String() string {
+	if int(p) < len(overflowPolicyNames) {
+		return overflowPolicyNames[p]
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", uint32(p))
+}
+
+// ParseOverflowPolicy parses the name of a policy ("block", "drop-oldest" or
+// "drop-newest").
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	for i, n := range overflowPolicyNames {
+		if n == name {
+			return OverflowPolicy(i), nil
+		}
+	}
+	return OVERFLOW_BLOCK, fmt.Errorf("unknown overflow policy %q", name)
+}
+
+// SetOverflowPolicy sets the overflow policy of an RPC code, which may be
+// changed at any time.
+func (r *Replica) SetOverflowPolicy(code uint16, policy OverflowPolicy) {
+	if pair, present := r.rpcTable[code]; present {
+		atomic.StoreUint32(&pair.policy, uint32(policy))
+	}
+}
+
+// Dropped returns how many messages of an RPC code have been dropped because
+// its queue was full.
+func (r *Replica) Dropped(code uint16) uint64 {
+	if pair, present := r.rpcTable[code]; present {
+		return atomic.LoadUint64(&pair.dropped)
+	}
+	return 0
+}
+
+// hand a message received from a peer to the protocol
+func (p *RPCPair) dispatch(obj fastrpc.Serializable) {
+	switch OverflowPolicy(atomic.LoadUint32(&p.policy)) {
+	case OVERFLOW_DROP_NEWEST:
+		if !p.offer(obj) {
+			atomic.AddUint64(&p.dropped, 1)
+		}
+	case OVERFLOW_DROP_OLDEST:
+		for !p.offer(obj) {
+			if p.evict() {
+				atomic.AddUint64(&p.dropped, 1)
+			}
+		}
+	default:
+		p.put(obj)
+	}
+}
+
+// the length and capacity of the queue the messages are delivered on
+func (p *RPCPair) queueDepth() (int, int) {
+	return p.depth()
+}
@@ -0,0 +1,203 @@
+package genericsmr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/dlog"
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// parameters that operators may change at runtime, through the SetParam RPC
+const (
+	PARAM_LEASE_DURATION_NS uint8 = iota
+	PARAM_BEACON_INTERVAL_NS
+	PARAM_MAX_BATCH
+	PARAM_LOG_LEVEL
+	PARAM_CLIENT_OPS_PER_SEC        // proposals each client connection may send per second (0 for no limit)
+	PARAM_CLIENT_BYTES_PER_SEC      // bytes each client connection may send per second (0 for no limit)
+	PARAM_SNAPSHOT_BYTES_PER_SEC    // bytes of snapshots the replica may send per second (0 for no limit)
+	PARAM_LEASE_GUARD_NS            // how long a guard precedes a lease (see leasetiming.go)
+	PARAM_LEASE_RENEW_LEAD_NS       // how long before it expires a lease is renewed (0 for qlease.DefaultRenewLead)
+	PARAM_LEASE_RENEW_JITTER_NS     // how much earlier still, at random, it may be renewed (0 for defaultRenewJitter)
+	PARAM_ANTI_ENTROPY_NS           // how often the replica compares its state with its peers' (0 for never; see antientropy.go)
+	PARAM_MAX_CLIENT_MSG_BYTES      // bytes a client message may take (0 for the codecs' bounds; see ingress.go)
+	PARAM_MAX_LEASE_KEYS            // keys a client lease may name (0 for no limit)
+	PARAM_SHED_LATENCY_NS           // in thrifty mode, shed peers slower than this from the preferred quorum (0 to not; see shedding.go)
+	PARAM_SHED_QUEUE_DEPTH          // ... or with more writers queued for their connection (0 to not)
+	PARAM_MAX_COMMIT_BACKLOG        // instances proposed but not executed beyond which client proposals are pushed back (0 for no limit; see admission.go)
+	PARAM_PEER_EGRESS_BYTES_PER_SEC // bytes sent to each peer per second beyond which background transfers wait (0 for no limit; see egress.go)
+	PARAM_LEASE_IDLE_NS             // how long without reads before the replica suspends its lease (0 for never; see leaseidle.go)
+	PARAM_MAX_STATE_BYTES           // approximate bytes of state beyond which the replica acts as its StateMemoryPolicy says (0 for no limit; see statememory.go)
+	NUM_PARAMS
+)
+
+const DEFAULT_BEACON_INTERVAL_NS = 2 * 1e9
+
+var paramNames = [NUM_PARAMS]string{
+	"lease-duration-ns",
+	"beacon-interval-ns",
+	"max-batch",
+	"log-level",
+	"client-ops-per-sec",
+	"client-bytes-per-sec",
+	"snapshot-bytes-per-sec",
+	"lease-guard-ns",
+	"lease-renew-lead-ns",
+	"lease-renew-jitter-ns",
+	"anti-entropy-ns",
+	"max-client-msg-bytes",
+	"max-lease-keys",
+	"shed-latency-ns",
+	"shed-queue-depth",
+	"max-commit-backlog",
+	"peer-egress-bytes-per-sec",
+	"lease-idle-ns",
+	"max-state-bytes",
+}
+
+func ParamName(p uint8) string {
+	if p < NUM_PARAMS {
+		return paramNames[p]
+	}
+	return fmt.Sprintf("param-%d", p)
+}
+
+func ParamByName(name string) (uint8, bool) {
+	for p, n := range paramNames {
+		if n == name {
+			return uint8(p), true
+		}
+	}
+	return 0, false
+}
+
+func (r *Replica) initParams() {
+	setDefaultLeaseTiming(r.params[:])
+	r.params[PARAM_BEACON_INTERVAL_NS] = DEFAULT_BEACON_INTERVAL_NS
+	r.params[PARAM_MAX_BATCH] = 1
+	r.params[PARAM_LOG_LEVEL] = 0
+	if dlog.DLOG {
+		r.params[PARAM_LOG_LEVEL] = 1
+	}
+	r.params[PARAM_CLIENT_OPS_PER_SEC] = r.cfg.ClientOpsPerSec
+	r.params[PARAM_CLIENT_BYTES_PER_SEC] = r.cfg.ClientBytesPerSec
+	r.params[PARAM_SNAPSHOT_BYTES_PER_SEC] = r.cfg.SnapshotBytesPerSec
+	r.params[PARAM_ANTI_ENTROPY_NS] = r.cfg.AntiEntropyNs
+	r.params[PARAM_MAX_CLIENT_MSG_BYTES] = r.cfg.MaxClientMsgBytes
+	r.params[PARAM_MAX_LEASE_KEYS] = r.cfg.MaxLeaseKeys
+	r.params[PARAM_SHED_LATENCY_NS] = r.cfg.ShedLatencyNs
+	r.params[PARAM_SHED_QUEUE_DEPTH] = r.cfg.ShedQueueDepth
+	r.params[PARAM_MAX_COMMIT_BACKLOG] = r.cfg.MaxCommitBacklog
+	r.params[PARAM_PEER_EGRESS_BYTES_PER_SEC] = r.cfg.PeerEgressBytesPerSec
+	r.params[PARAM_LEASE_IDLE_NS] = r.cfg.LeaseIdleNs
+	r.params[PARAM_MAX_STATE_BYTES] = r.cfg.MaxStateBytes
+	for p, v := range r.cfg.Params {
+		if err := validateParam(p, v); err != nil {
+			log.Fatal(err)
+		}
+		r.params[p] = v
+	}
+	if err := validateLeaseTiming(r.params[:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (r *Replica) Param(p uint8) int64 {
+	return atomic.LoadInt64(&r.params[p])
+}
+
+// InitParam sets a protocol-specific default, without journaling it.
+// Values recovered from the stable store or configured with WithParams take
+// precedence.
+func (r *Replica) InitParam(p uint8, value int64) {
+	if _, configured := r.cfg.Params[p]; configured || r.paramRecovered[p] {
+		return
+	}
+	atomic.StoreInt64(&r.params[p], value)
+}
+
+func validateParam(p uint8, value int64) error {
+	switch p {
+	case PARAM_LEASE_DURATION_NS, PARAM_LEASE_GUARD_NS, PARAM_BEACON_INTERVAL_NS, PARAM_MAX_BATCH:
+		if value <= 0 {
+			return fmt.Errorf("%s must be positive", ParamName(p))
+		}
+	case PARAM_LOG_LEVEL, PARAM_CLIENT_OPS_PER_SEC, PARAM_CLIENT_BYTES_PER_SEC, PARAM_SNAPSHOT_BYTES_PER_SEC, PARAM_LEASE_RENEW_LEAD_NS, PARAM_LEASE_RENEW_JITTER_NS,
+		PARAM_ANTI_ENTROPY_NS, PARAM_MAX_LEASE_KEYS, PARAM_SHED_LATENCY_NS, PARAM_SHED_QUEUE_DEPTH,
+		PARAM_MAX_COMMIT_BACKLOG, PARAM_PEER_EGRESS_BYTES_PER_SEC, PARAM_LEASE_IDLE_NS, PARAM_MAX_STATE_BYTES:
+		if value < 0 {
+			return fmt.Errorf("%s must not be negative", ParamName(p))
+		}
+	case PARAM_MAX_CLIENT_MSG_BYTES:
+		if value != 0 && value < MIN_CLIENT_MSG_BYTES {
+			return fmt.Errorf("%s must be 0 or at least %d", ParamName(p), MIN_CLIENT_MSG_BYTES)
+		}
+	default:
+		return fmt.Errorf("unknown parameter %d", p)
+	}
+	return nil
+}
+
+// ApplyParam validates and applies a new parameter value, journaling the change
+// to the stable store if the replica is durable. It returns the previous value.
+func (r *Replica) ApplyParam(p uint8, value int64) (int64, error) {
+	if err := validateParam(p, value); err != nil {
+		return 0, err
+	}
+	if isLeaseTiming(p) {
+		var params [NUM_PARAMS]int64
+		for q := range params {
+			params[q] = r.Param(uint8(q))
+		}
+		params[p] = value
+		if err := validateLeaseTiming(params[:]); err != nil {
+			return 0, err
+		}
+	}
+	if r.Durable {
+		var b [9]byte
+		b[0] = p
+		binary.LittleEndian.PutUint64(b[1:9], uint64(value))
+		if err := r.RecordToStableStore(RECORD_PARAM, b[:]); err != nil {
+			return 0, err
+		}
+		r.SyncStableStore()
+	}
+	old := atomic.SwapInt64(&r.params[p], value)
+	if p == PARAM_LOG_LEVEL {
+		dlog.SetLevel(int(value))
+	}
+	log.Printf("Replica %d: %s changed from %d to %d\n", r.Id, ParamName(p), old, value)
+	r.Audit(AUDIT_PARAM, "%s changed from %d to %d", ParamName(p), old, value)
+	return old, nil
+}
+
+/* Admin RPC */
+
+func (r *Replica) SetParam(args *genericsmrproto.SetParamArgs, reply *genericsmrproto.SetParamReply) error {
+	old, err := r.ApplyParam(args.Param, args.Value)
+	if err != nil {
+		r.Audit(AUDIT_ADMIN, "SetParam %s=%d: %v", ParamName(args.Param), args.Value, err)
+		reply.OK = FALSE
+		return err
+	}
+	r.Audit(AUDIT_ADMIN, "SetParam %s=%d", ParamName(args.Param), args.Value)
+	reply.OK = TRUE
+	reply.OldValue = old
+	return nil
+}
+
+// PrepareStop drains the replica (see Drain) for an administrator.
+func (r *Replica) PrepareStop(args *genericsmrproto.PrepareStopArgs, reply *genericsmrproto.PrepareStopReply) error {
+	r.Audit(AUDIT_ADMIN, "PrepareStop (timeout %v)", time.Duration(args.TimeoutNs))
+	if err := r.Drain(time.Duration(args.TimeoutNs)); err != nil {
+		r.Audit(AUDIT_ADMIN, "PrepareStop: %v", err)
+		return err
+	}
+	r.Audit(AUDIT_ADMIN, "PrepareStop: drained")
+	return nil
+}
@@ -0,0 +1,60 @@
+package genericsmr
+
+import (
+	"bufio"
+	"io"
+	"net"
+)
+
+// Each peer connection is read and written through a bufio.Reader and
+// bufio.Writer, of bufio's default 4KB unless WithPeerBuffers sizes them: a
+// batch of commands or a catch-up of log entries then takes many reads and
+// writes of the connection. Larger messages (snapshot chunks, streamed
+// messages) need not be copied through the writer's buffer at all: with
+// WithDirectPeerWrites, the writes of their encoding of at least so many
+// bytes go straight to the connection, after flushing what the writer holds
+// before them (their header, and any messages queued without flushing).
+
+// the reader of a new connection to a peer
+func (r *Replica) newPeerReader(conn io.Reader) *bufio.Reader {
+	if r.cfg.PeerReadBufferSize <= 0 {
+		return bufio.NewReader(conn)
+	}
+	return bufio.NewReaderSize(conn, r.cfg.PeerReadBufferSize)
+}
+
+// the writer of a new connection to a peer
+func (r *Replica) newPeerWriter(conn io.Writer) *bufio.Writer {
+	if r.cfg.PeerWriteBufferSize <= 0 {
+		return bufio.NewWriter(conn)
+	}
+	return bufio.NewWriterSize(conn, r.cfg.PeerWriteBufferSize)
+}
+
+// writes to a peer's connection, those of at least min bytes bypassing its
+// writer
+type directWriter struct {
+	w    *bufio.Writer
+	conn net.Conn
+	min  int
+}
+
+func (d directWriter) Write(b []byte) (int, error) {
+	if len(b) < d.min {
+		return d.w.Write(b)
+	}
+	if err := d.w.Flush(); err != nil {
+		return 0, err
+	}
+	return d.conn.Write(b)
+}
+
+// where to encode a message to the peer: its writer, or a directWriter if
+// large writes bypass it. The caller must hold the peer's write lock.
+func (r *Replica) peerEncoder(peerId int32) io.Writer {
+	w := r.PeerWriters[peerId]
+	if r.cfg.DirectWriteBytes <= 0 || r.Peers[peerId] == nil {
+		return w
+	}
+	return directWriter{w, r.Peers[peerId], r.cfg.DirectWriteBytes}
+}
@@ -0,0 +1,134 @@
+package genericsmr
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Every peer of a replica is in one of the PeerStates below, which the
+// goroutines that connect to peers, read from them, and watch them for
+// silence move it between with atomic compare-and-swaps, and which anything
+// may read without locking. Subscribers are told of every transition, in
+// the goroutine making it: the replica itself subscribes so that lease
+// renewals toward a peer pause while it is dead, and resume with a guard once
+// it is back (see RenewQLease). Replicas of a GroupMux share the states of
+// their shared connections.
+type PeerState int32
+
+const (
+	PEER_CONNECTING PeerState = iota // not connected yet
+	PEER_ALIVE                       // connected
+	PEER_SUSPECTED                   // connected, but silent for longer than the beacon timeout
+	PEER_DEAD                        // the connection was lost, or the peer excluded
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PEER_CONNECTING:
+		return "connecting"
+	case PEER_ALIVE:
+		return "alive"
+	case PEER_SUSPECTED:
+		return "suspected"
+	case PEER_DEAD:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// Connected reports whether messages can be sent to a peer in state s.
+func (s PeerState) Connected() bool {
+	return s == PEER_ALIVE || s == PEER_SUSPECTED
+}
+
+// A PeerTransition is a change of state of a peer.
+type PeerTransition struct {
+	Peer int32
+	From PeerState
+	To   PeerState
+}
+
+// PeerStates holds the states of the peers of a replica.
+type PeerStates struct {
+	states []int32
+
+	lock   *sync.Mutex // protects subs
+	subs   map[int]func(PeerTransition)
+	nextId int
+}
+
+func NewPeerStates(n int) *PeerStates {
+	return &PeerStates{
+		states: make([]int32, n),
+		lock:   new(sync.Mutex),
+		subs:   make(map[int]func(PeerTransition)),
+	}
+}
+
+// Get returns the state of peer q.
+func (p *PeerStates) Get(q int32) PeerState {
+	return PeerState(atomic.LoadInt32(&p.states[q]))
+}
+
+// Set moves peer q to state s, and returns the state it was in.
+func (p *PeerStates) Set(q int32, s PeerState) PeerState {
+	from := PeerState(atomic.SwapInt32(&p.states[q], int32(s)))
+	if from != s {
+		p.publish(PeerTransition{q, from, s})
+	}
+	return from
+}
+
+// Transition moves peer q from state from to state to, and reports whether
+// it was in state from.
+func (p *PeerStates) Transition(q int32, from PeerState, to PeerState) bool {
+	if !atomic.CompareAndSwapInt32(&p.states[q], int32(from), int32(to)) {
+		return false
+	}
+	if from != to {
+		p.publish(PeerTransition{q, from, to})
+	}
+	return true
+}
+
+// Subscribe calls f with every later transition, until cancel is called. f
+// runs in the goroutine making the transition, which it must not block.
+func (p *PeerStates) Subscribe(f func(PeerTransition)) (cancel func()) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	id := p.nextId
+	p.nextId++
+	p.subs[id] = f
+	return func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		delete(p.subs, id)
+	}
+}
+
+func (p *PeerStates) publish(t PeerTransition) {
+	p.lock.Lock()
+	subs := make([]func(PeerTransition), 0, len(p.subs))
+	for _, f := range p.subs {
+		subs = append(subs, f)
+	}
+	p.lock.Unlock()
+	for _, f := range subs {
+		f(t)
+	}
+}
+
+// PeerAlive reports whether the replica is connected to peer q.
+func (r *Replica) PeerAlive(q int32) bool {
+	return r.PeerStates.Get(q).Connected()
+}
+
+// note that a peer that has come back must be guarded before its leases are
+// renewed again, since it ignored the promises made while it was away
+func (r *Replica) watchLeasePeers(t PeerTransition) {
+	if t.To == PEER_DEAD {
+		atomic.StoreInt32(&r.leaseRejoined[t.Peer], 1)
+		// it says again if it has its lease suspended (see leaseidle.go)
+		atomic.StoreInt32(&r.leaseIdle.peers[t.Peer], 0)
+	}
+}
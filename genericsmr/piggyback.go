@@ -0,0 +1,153 @@
+package genericsmr
+
+import (
+	"bufio"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/glycerine/qlease/fastrpc"
+)
+
+// Under load, a replica sends its peers a steady stream of protocol messages
+// (accepts, accept replies, commits), and lease promises and their replies
+// need not travel on their own. With PiggybackLeases, the replica holds each
+// promise or promise reply for a peer for up to PIGGYBACK_WAIT, and the next
+// message SendMsg writes to that peer carries it as a trailer:
+//
+//	piggybackRPC | code of the message | message | count | (lease code | lease message) x count
+//
+// in one frame (one sequence number with peer sessions). The peer hands the
+// message and then the lease messages to the protocol, as if they had
+// arrived one after the other. A lease message that finds no message to ride
+// on within PIGGYBACK_WAIT is sent on its own, so an idle replica renews its
+// leases as before, only slightly later; a newer promise (or reply) to a
+// peer replaces one still held. Holding them back is safe: the grantor
+// only counts a lease from when its reply arrives, and the grantee from when
+// the promise arrives, and PIGGYBACK_WAIT is well within the lead time of
+// renewals. Every replica of the cluster must be of a version that
+// understands the trailer (it need not piggyback itself).
+
+// how long a lease message may wait for a message to ride on
+const PIGGYBACK_WAIT = 20 * time.Millisecond
+
+// a lease message held for a peer, and how to send it on its own
+type heldLeaseMsg struct {
+	code uint16
+	msg  fastrpc.Serializable
+	send func(int32, uint16, fastrpc.Serializable) error
+}
+
+type piggybacks struct {
+	lock     sync.Mutex
+	held     [][]heldLeaseMsg // per peer, at most one message per code
+	flushing []bool           // per peer, a flush is scheduled
+}
+
+func newPiggybacks(n int) *piggybacks {
+	return &piggybacks{held: make([][]heldLeaseMsg, n), flushing: make([]bool, n)}
+}
+
+// send the lease message msg to peer q: with the next message to q, if
+// piggybacking, or else with send
+func (r *Replica) sendLeaseMsg(q int32, code uint16, msg fastrpc.Serializable, send func(int32, uint16, fastrpc.Serializable) error) {
+	pb := r.piggybacks
+	if pb == nil {
+		send(q, code, msg)
+		return
+	}
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	held := pb.held[q]
+	for i := range held {
+		if held[i].code == code {
+			held[i].msg = msg
+			return
+		}
+	}
+	pb.held[q] = append(held, heldLeaseMsg{code, msg, send})
+	if !pb.flushing[q] {
+		pb.flushing[q] = true
+		time.AfterFunc(PIGGYBACK_WAIT, func() { r.flushLeaseMsgs(q) })
+	}
+}
+
+// take the lease messages held for peer q
+func (pb *piggybacks) take(q int32) []heldLeaseMsg {
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	held := pb.held[q]
+	pb.held[q] = nil
+	return held
+}
+
+// send on their own the lease messages that found nothing to ride on
+func (r *Replica) flushLeaseMsgs(q int32) {
+	pb := r.piggybacks
+	pb.lock.Lock()
+	pb.flushing[q] = false
+	pb.lock.Unlock()
+	for _, h := range pb.take(q) {
+		h.send(q, h.code, h.msg)
+	}
+}
+
+// write msg to peer q with the lease messages held for it, if any, and
+// report whether it did, and the error of writing them; the caller holds the
+// peer's lock
+func (r *Replica) writePiggybacked(q int32, code uint16, msg fastrpc.Serializable) (bool, error) {
+	if r.piggybacks == nil || code == r.piggybackRPC {
+		return false, nil
+	}
+	held := r.piggybacks.take(q)
+	if len(held) == 0 {
+		return false, nil
+	}
+	w := r.PeerWriters[q]
+	codec := r.sendCodecs[q]
+	r.writePeerPrefix(w, q)
+	r.writeCode(w, q, r.piggybackRPC)
+	r.writeCode(w, q, code)
+	if err := codec.Encode(w, msg); err != nil {
+		return true, encodeErr(err)
+	}
+	w.WriteByte(byte(len(held)))
+	for _, h := range held {
+		r.writeCode(w, q, h.code)
+		if err := codec.Encode(w, h.msg); err != nil {
+			return true, encodeErr(err)
+		}
+	}
+	return true, w.Flush()
+}
+
+// read a message from peer rid and the lease messages trailing it, and
+// dispatch them in that order
+func (r *Replica) handlePiggybacked(rid int, reader *bufio.Reader, deliver bool) error {
+	code, err := readCode(reader)
+	if err != nil {
+		return err
+	}
+	if code == r.piggybackRPC {
+		return fmt.Errorf("nested piggybacked message from replica %d", rid)
+	}
+	if err = r.dispatchPeerRPC(rid, code, reader, deliver); err != nil {
+		return err
+	}
+	count, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < int(count); i++ {
+		if code, err = readCode(reader); err != nil {
+			return err
+		}
+		if code != r.qleasePromiseRPC && code != r.qleasePromiseReplyRPC {
+			return fmt.Errorf("replica %d piggybacked a message of type %d", rid, code)
+		}
+		if err = r.dispatchPeerRPC(rid, code, reader, deliver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
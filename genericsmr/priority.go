@@ -0,0 +1,151 @@
+package genericsmr
+
+import (
+	"sync"
+	"time"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// Client proposals reach the protocol through ProposeChan in the order they
+// arrive, so that near capacity a small latency-sensitive command waits
+// behind every command of a bulk load queued before it. With priority
+// scheduling (see WithPriorityScheduling), client proposals, and those
+// forwarded by peers, instead wait in a queue per priority class (set by the
+// client with PRIORITY), and a scheduler hands them to the protocol only as
+// ProposeChan drains, so that it never holds more than PRIORITY_CHAN_DEPTH
+// proposals (or a batch, if larger): the next proposal is then the oldest of
+// the highest class waiting, HIGH, then NORMAL, then BULK. Under admission
+// control, the scheduler also holds the proposals back while the commit
+// backlog is at its limit, rather than have them answered ERR_OVERLOADED or
+// their clients paused, which is what lets a high class overtake a load that
+// the protocol cannot keep up with (see admission.go). So that lower classes
+// are slowed but never starved, one proposal in PRIORITY_AGED_SHARE goes by
+// age instead: the oldest of those that have waited PRIORITY_MAX_WAIT_NS,
+// whatever its class. The queues together hold at most as
+// many proposals as ProposeChan would, and the client connections that find
+// them full wait, as they would for ProposeChan.
+
+// proposals the scheduler lets wait in ProposeChan, unless a batch is larger
+const PRIORITY_CHAN_DEPTH = 32
+
+// how long a proposal may wait behind the higher classes before it may go
+// by age
+const PRIORITY_MAX_WAIT_NS = 100 * 1e6
+
+// one proposal in this many goes by age
+const PRIORITY_AGED_SHARE = 8
+
+// how often the scheduler checks whether ProposeChan has drained
+const PRIORITY_POLL_NS = 20 * 1000
+
+// the classes, highest first
+var priorityOrder = [genericsmrproto.NUM_PRIORITIES]uint8{
+	genericsmrproto.PRIORITY_HIGH, genericsmrproto.PRIORITY_NORMAL, genericsmrproto.PRIORITY_BULK}
+
+var priorityNames = [genericsmrproto.NUM_PRIORITIES]string{"normal", "high", "bulk"}
+
+type queuedPropose struct {
+	p     *Propose
+	since int64 // when it was queued
+}
+
+type priorityQueues struct {
+	lock   sync.Mutex // protects queues
+	queues [genericsmrproto.NUM_PRIORITIES][]queuedPropose
+	ready  chan struct{} // signalled when a proposal is queued
+	slots  chan struct{} // one per queued proposal, bounding them
+	picks  int           // proposals taken, which only the scheduler touches
+}
+
+func newPriorityQueues(size int) *priorityQueues {
+	return &priorityQueues{ready: make(chan struct{}, 1), slots: make(chan struct{}, size)}
+}
+
+// hand p to the protocol, through the priority queues if the replica
+// schedules proposals by priority
+func (r *Replica) schedule(p *Propose) {
+	pq := r.priorities
+	if pq == nil {
+		r.ProposeChan <- p
+		return
+	}
+	class := p.Priority
+	if class >= genericsmrproto.NUM_PRIORITIES {
+		class = genericsmrproto.PRIORITY_NORMAL
+	}
+	pq.slots <- struct{}{}
+	pq.lock.Lock()
+	pq.queues[class] = append(pq.queues[class], queuedPropose{p, time.Now().UnixNano()})
+	pq.lock.Unlock()
+	select {
+	case pq.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take the next proposal to hand to the protocol (nil if none waits)
+func (pq *priorityQueues) next(now int64) *Propose {
+	pq.lock.Lock()
+	defer pq.lock.Unlock()
+	// the oldest of the highest class, or on its turn to go by age, the
+	// oldest of those that have waited too long
+	pq.picks++
+	byAge := pq.picks%PRIORITY_AGED_SHARE == 0
+	pick := -1
+	for _, class := range priorityOrder {
+		q := pq.queues[class]
+		if len(q) == 0 {
+			continue
+		}
+		if pick < 0 {
+			pick = int(class)
+		} else if byAge && now-q[0].since > PRIORITY_MAX_WAIT_NS && q[0].since < pq.queues[pick][0].since {
+			pick = int(class)
+		}
+	}
+	if pick < 0 {
+		pq.picks--
+		return nil
+	}
+	p := pq.queues[pick][0].p
+	pq.queues[pick][0] = queuedPropose{}
+	pq.queues[pick] = pq.queues[pick][1:]
+	<-pq.slots
+	return p
+}
+
+func (pq *priorityQueues) depths() []genericsmrproto.ChanDepth {
+	pq.lock.Lock()
+	defer pq.lock.Unlock()
+	depths := make([]genericsmrproto.ChanDepth, 0, len(priorityOrder))
+	for _, class := range priorityOrder {
+		depths = append(depths, genericsmrproto.ChanDepth{
+			Name: "priority-" + priorityNames[class], Len: int32(len(pq.queues[class])), Cap: int32(cap(pq.slots))})
+	}
+	return depths
+}
+
+// hand the queued proposals to the protocol as ProposeChan drains
+func (r *Replica) schedulePriorities() {
+	pq := r.priorities
+	for !r.Shutdown {
+		depth := int(r.Param(PARAM_MAX_BATCH))
+		if depth < PRIORITY_CHAN_DEPTH {
+			depth = PRIORITY_CHAN_DEPTH
+		}
+		if len(r.ProposeChan) >= depth || r.overBacklog() {
+			time.Sleep(PRIORITY_POLL_NS)
+			continue
+		}
+		p := pq.next(time.Now().UnixNano())
+		if p == nil {
+			select {
+			case <-pq.ready:
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		r.ProposeChan <- p
+	}
+}
@@ -0,0 +1,142 @@
+package genericsmr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Behind an L4 load balancer, the address of a client connection is the
+// balancer's. With ProxyProtocol, every client connection must start with a
+// PROXY protocol header (version 1 or 2, as sent by HAProxy, AWS NLBs, etc.)
+// naming the original client, which the replica then reports as the
+// connection's remote address: in ClientInfo (and so in logs, the client
+// list and rate limiting), with the balancer's address in ProxyAddr. A
+// connection without a valid header is closed. Turn it on only if clients
+// cannot reach the port but through the balancer, as anyone else could claim
+// any address. Peers connect without a header.
+
+// how long a client connection may take to send its PROXY header
+const PROXY_HEADER_TIMEOUT = 5 * time.Second
+
+var ErrBadProxyHeader = errors.New("malformed PROXY protocol header")
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// a client connection that arrived through a proxy
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader // holds what followed the header
+	remote net.Addr      // the original client
+}
+
+func (pc *proxyConn) Read(p []byte) (int, error) {
+	return pc.reader.Read(p)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+// read the PROXY header that conn starts with, and return the connection
+// with the remote address of the original client
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(PROXY_HEADER_TIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	var remote net.Addr
+	if first[0] == proxyV2Signature[0] {
+		remote, err = readProxyV2(reader)
+	} else {
+		remote, err = readProxyV1(reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		// a health check from the proxy itself, or an unknown protocol
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{conn, reader, remote}, nil
+}
+
+// e.g., "PROXY TCP4 192.0.2.1 198.51.100.1 56324 7070\r\n"
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrBadProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, ErrBadProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, ErrBadProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrBadProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// a binary header: the signature, version and command, address family,
+// length of the addresses, and the addresses
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(reader, hdr[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Signature) {
+		return nil, ErrBadProxyHeader
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("PROXY protocol version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0xF == 0 {
+		// LOCAL: the proxy's own connection
+		return nil, nil
+	}
+	switch hdr[13] >> 4 {
+	case 1: // IPv4
+		if len(body) < 12 {
+			return nil, ErrBadProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // IPv6
+		if len(body) < 36 {
+			return nil, ErrBadProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,117 @@
+package genericsmr
+
+import (
+	"bufio"
+	"io"
+	"time"
+)
+
+// TokenBucket is a token bucket rate limiter that holds up to one second's
+// worth of tokens. It is not safe for concurrent use.
+type TokenBucket struct {
+	rate   float64 // tokens added per second (0 for no limit)
+	tokens float64
+	last   int64 // ns
+}
+
+func NewTokenBucket(rate float64, now int64) *TokenBucket {
+	return &TokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+// SetRate changes the rate, keeping the tokens already in the bucket (up to
+// the new capacity).
+func (b *TokenBucket) SetRate(rate float64, now int64) {
+	b.refill(now)
+	if b.rate <= 0 {
+		// there was no limit: start full
+		b.tokens = rate
+	}
+	b.rate = rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+}
+
+func (b *TokenBucket) refill(now int64) {
+	if now > b.last {
+		b.tokens += b.rate * float64(now-b.last) / 1e9
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+}
+
+// Take removes n tokens if there are that many.
+func (b *TokenBucket) Take(n float64, now int64) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Charge removes n tokens unconditionally, possibly leaving the bucket in
+// debt, for usage that is only known after the fact.
+func (b *TokenBucket) Charge(n float64, now int64) {
+	if b.rate <= 0 {
+		return
+	}
+	b.refill(now)
+	b.tokens -= n
+}
+
+func (b *TokenBucket) InDebt() bool {
+	return b.rate > 0 && b.tokens < 0
+}
+
+// counts the bytes read from a client connection
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// the rate limits of a client connection, which follow the replica's
+// PARAM_CLIENT_OPS_PER_SEC and PARAM_CLIENT_BYTES_PER_SEC
+type clientLimits struct {
+	counter *countingReader
+	reader  *bufio.Reader
+	charged int64 // bytes already charged to the bytes bucket
+	ops     *TokenBucket
+	bytes   *TokenBucket
+}
+
+func newClientLimits(counter *countingReader, reader *bufio.Reader) *clientLimits {
+	now := time.Now().UnixNano()
+	return &clientLimits{counter: counter, reader: reader, ops: NewTokenBucket(0, now), bytes: NewTokenBucket(0, now)}
+}
+
+// admit reports whether the connection may submit one more proposal. All the
+// bytes the client has sent so far count against the bytes limit, whatever
+// the messages they carried.
+func (l *clientLimits) admit(r *Replica) bool {
+	now := time.Now().UnixNano()
+	if rate := float64(r.Param(PARAM_CLIENT_OPS_PER_SEC)); rate != l.ops.rate {
+		l.ops.SetRate(rate, now)
+	}
+	if rate := float64(r.Param(PARAM_CLIENT_BYTES_PER_SEC)); rate != l.bytes.rate {
+		l.bytes.SetRate(rate, now)
+	}
+	consumed := l.counter.n - int64(l.reader.Buffered())
+	l.bytes.Charge(float64(consumed-l.charged), now)
+	l.charged = consumed
+	if l.bytes.InDebt() {
+		return false
+	}
+	return l.ops.Take(1, now)
+}
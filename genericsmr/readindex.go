@@ -0,0 +1,204 @@
+package genericsmr
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/state"
+)
+
+var ErrReadIndexUnsupported = errors.New("the protocol does not support read index reads")
+
+// A ReadStrategy decides how ReadStrict serves linearizable reads.
+type ReadStrategy interface {
+	Read(r *Replica, k state.Key) (state.Entry, error)
+}
+
+// LeaseReads reads locally under a quorum lease covering the key, and
+// through a quorum read otherwise. It is the default.
+type LeaseReads struct{}
+
+func (LeaseReads) Read(r *Replica, k state.Key) (state.Entry, error) {
+	if ql := r.QLease; ql != nil && ql.CanRead() && ql.Covers(k) {
+		if e, applied, updating := r.Log.ReadApplied(k); !updating {
+			r.LeaseReadServed(k, applied)
+			return e, nil
+		}
+	}
+	return r.quorumRead(k)
+}
+
+// IndexReads does not rely on clocks at all: the leader confirms with a
+// quorum round that it still leads, and hands out the latest instance it has
+// accepted as the read index; any replica then reads locally once it has
+// executed up to the read index. It needs a leader-based protocol (see
+// LeaderLog).
+type IndexReads struct{}
+
+func (IndexReads) Read(r *Replica, k state.Key) (state.Entry, error) {
+	if _, ok := r.Log.(LeaderLog); !ok {
+		return state.Entry{}, ErrReadIndexUnsupported
+	}
+	deadline := time.Now().UnixNano() + QUORUM_READ_TIMEOUT_NS
+	index, err := r.readIndex(deadline)
+	if err != nil {
+		return state.Entry{}, err
+	}
+	for time.Now().UnixNano() < deadline {
+		if e, applied, _ := r.Log.ReadApplied(k); applied >= index {
+			return e, nil
+		}
+		time.Sleep(1000 * 1000)
+	}
+	return state.Entry{}, ErrReadTimeout
+}
+
+var readStrategies = map[string]ReadStrategy{"lease": LeaseReads{}, "readindex": IndexReads{}}
+
+// ParseReadStrategy returns the read strategy called name: lease or readindex.
+func ParseReadStrategy(name string) (ReadStrategy, error) {
+	if s, present := readStrategies[name]; present {
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown read strategy %q (want lease or readindex)", name)
+}
+
+// ReadsByLease reports whether the replica serves linearizable reads under
+// quorum leases; with any other read strategy, protocols hand client reads to
+// ReadStrict.
+func (r *Replica) ReadsByLease() bool {
+	_, byLease := r.reads().(LeaseReads)
+	return byLease
+}
+
+func (r *Replica) reads() ReadStrategy {
+	if r.cfg.Reads == nil {
+		return LeaseReads{}
+	}
+	return r.cfg.Reads
+}
+
+// LeaderLog is implemented by leader-based protocols that support IndexReads.
+type LeaderLog interface {
+	LogState
+	// Leader returns the replica this one believes leads, and the highest
+	// ballot this one has promised (its own, if it leads).
+	Leader() (leader int32, ballot int32)
+}
+
+type readIndexes struct {
+	lock    *sync.Mutex
+	lastId  int32
+	pending map[int32]chan *genericsmrproto.ReadIndexReply
+}
+
+func newReadIndexes() *readIndexes {
+	return &readIndexes{
+		lock:    new(sync.Mutex),
+		pending: make(map[int32]chan *genericsmrproto.ReadIndexReply),
+	}
+}
+
+// get a read index from the leader, asking again until deadline if the
+// replica it believes leads cannot confirm that it does
+func (r *Replica) readIndex(deadline int64) (int32, error) {
+	for time.Now().UnixNano() < deadline {
+		leader, _ := r.Log.(LeaderLog).Leader()
+		if leader == r.Id {
+			if index, ok := r.confirmedIndex(); ok {
+				return index, nil
+			}
+		} else if index, ok := r.askReadIndex(leader); ok {
+			return index, nil
+		}
+		time.Sleep(1000 * 1000)
+	}
+	return -1, ErrReadTimeout
+}
+
+func (r *Replica) askReadIndex(leader int32) (int32, bool) {
+	id := atomic.AddInt32(&r.rindexes.lastId, 1)
+	replies := make(chan *genericsmrproto.ReadIndexReply, 1)
+	r.rindexes.lock.Lock()
+	r.rindexes.pending[id] = replies
+	r.rindexes.lock.Unlock()
+	defer func() {
+		r.rindexes.lock.Lock()
+		delete(r.rindexes.pending, id)
+		r.rindexes.lock.Unlock()
+	}()
+
+	if r.SendMsg(leader, r.readIndexRPC, &genericsmrproto.ReadIndex{ReplicaId: r.Id, ReadId: id}) != nil {
+		return -1, false
+	}
+	timeout := time.NewTimer(QUORUM_READ_ROUND_NS)
+	defer timeout.Stop()
+	select {
+	case reply := <-replies:
+		return reply.Index, reply.OK == TRUE
+	case <-timeout.C:
+		return -1, false
+	}
+}
+
+// the latest instance this replica has accepted, once a quorum has confirmed
+// that it still leads
+func (r *Replica) confirmedIndex() (int32, bool) {
+	index := r.Log.LatestAccepted()
+	leader, ballot := r.Log.(LeaderLog).Leader()
+	if leader != r.Id {
+		return -1, false
+	}
+	_, err := r.leaderChecks.Broadcast(&genericsmrproto.LeaderCheck{Ballot: ballot},
+		QuorumPolicy{Timeout: QUORUM_READ_ROUND_NS, FailFast: true},
+		func(reply *genericsmrproto.LeaderCheckReply) bool { return reply.OK == TRUE })
+	if err != nil {
+		return -1, false
+	}
+	return index, true
+}
+
+// answer a leadership check: OK unless a higher ballot was promised
+func (r *Replica) answerLeaderCheck(lc *genericsmrproto.LeaderCheck) (*genericsmrproto.LeaderCheckReply, bool) {
+	ll, ok := r.Log.(LeaderLog)
+	if !ok {
+		return nil, false
+	}
+	reply := &genericsmrproto.LeaderCheckReply{OK: TRUE}
+	if _, promised := ll.Leader(); promised > lc.Ballot {
+		reply.OK = FALSE
+	}
+	return reply, true
+}
+
+// answer the read index requests of peers, and route the replies to our own
+func (r *Replica) serveReadIndexes(reqs chan fastrpc.Serializable, replies chan fastrpc.Serializable) {
+	for !r.Shutdown {
+		select {
+		case m := <-reqs:
+			ri := m.(*genericsmrproto.ReadIndex)
+			if _, ok := r.Log.(LeaderLog); ok {
+				// the leadership check takes a round trip
+				go func() {
+					reply := &genericsmrproto.ReadIndexReply{ReplicaId: r.Id, ReadId: ri.ReadId, OK: FALSE}
+					if index, ok := r.confirmedIndex(); ok {
+						reply.Index, reply.OK = index, TRUE
+					}
+					r.SendMsg(ri.ReplicaId, r.readIndexReplyRPC, reply)
+				}()
+			}
+		case m := <-replies:
+			reply := m.(*genericsmrproto.ReadIndexReply)
+			r.rindexes.lock.Lock()
+			if c, present := r.rindexes.pending[reply.ReadId]; present {
+				c <- reply
+			}
+			r.rindexes.lock.Unlock()
+		}
+	}
+}
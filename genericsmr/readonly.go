@@ -0,0 +1,53 @@
+package genericsmr
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// A replica can be put in read-only mode, and back, at runtime (SetReadOnly,
+// or the ReadOnlyMode admin RPC), e.g. while its storage is under maintenance
+// or its disk is degraded but its state in memory is still valid: it goes on
+// serving reads, under its leases as before, but answers the writes its
+// clients propose ERR_NOT_WRITABLE, so that they send them to another
+// replica. It still takes part in the protocol, so the writes proposed
+// elsewhere are executed on it as usual.
+
+// SetReadOnly puts the replica in read-only mode, or back out of it, and
+// returns whether it was read-only.
+func (r *Replica) SetReadOnly(readOnly bool) bool {
+	v := int32(0)
+	if readOnly {
+		v = 1
+	}
+	was := atomic.SwapInt32(&r.readOnly, v) != 0
+	if was != readOnly {
+		if readOnly {
+			log.Printf("Replica %d: read-only\n", r.Id)
+		} else {
+			log.Printf("Replica %d: writable\n", r.Id)
+		}
+	}
+	return was
+}
+
+// ReadOnly reports whether the replica answers client writes ERR_NOT_WRITABLE.
+func (r *Replica) ReadOnly() bool {
+	return atomic.LoadInt32(&r.readOnly) != 0
+}
+
+/* Admin RPC */
+
+// ReadOnlyMode puts the replica in read-only mode, or back out of it, for an
+// administrator.
+func (r *Replica) ReadOnlyMode(args *genericsmrproto.ReadOnlyArgs, reply *genericsmrproto.ReadOnlyReply) error {
+	readOnly := args.ReadOnly == TRUE
+	r.Audit(AUDIT_ADMIN, "ReadOnlyMode %v", readOnly)
+	reply.WasReadOnly = FALSE
+	if r.SetReadOnly(readOnly) {
+		reply.WasReadOnly = TRUE
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package genericsmr
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/state"
+)
+
+// Leases pay off only where the reads they cover are served locally. Every
+// client read the replica answers is counted by how it was served: locally,
+// under the replica's lease (see ReplyLocalRead); through the protocol,
+// which takes a quorum round whether by consensus, a quorum read or a read
+// index; by another replica it was forwarded to; or not at all, answered
+// with an error. A replica started with WithReadStatsByPrefix also counts
+// them by key prefix (k>>shift), for the first READ_STATS_MAX_PREFIXES
+// prefixes read, so that operators can tell which keys are read locally and
+// which are not, e.g. to grant leases to the replicas that read them. The
+// counts are part of the replica's status, and of its debug variables.
+
+// prefixes counted apart at most; the reads of the others count in total only
+const READ_STATS_MAX_PREFIXES = 4096
+
+// how a client read was served
+const (
+	READ_LOCAL = iota
+	READ_QUORUM
+	READ_FORWARDED
+	READ_REJECTED
+	NUM_READ_KINDS
+)
+
+type readCounts [NUM_READ_KINDS]uint64 // by kind (accessed atomically)
+
+func (rc *readCounts) counts(prefix int64) genericsmrproto.ReadCounts {
+	return genericsmrproto.ReadCounts{
+		Prefix:    prefix,
+		Local:     atomic.LoadUint64(&rc[READ_LOCAL]),
+		Quorum:    atomic.LoadUint64(&rc[READ_QUORUM]),
+		Forwarded: atomic.LoadUint64(&rc[READ_FORWARDED]),
+		Rejected:  atomic.LoadUint64(&rc[READ_REJECTED]),
+	}
+}
+
+type readStats struct {
+	shift    int // negative to not count by prefix
+	total    readCounts
+	lock     sync.RWMutex // protects prefixes
+	prefixes map[int64]*readCounts
+}
+
+func newReadStats(shift int) *readStats {
+	if shift > 63 {
+		shift = 63
+	}
+	rs := &readStats{shift: shift}
+	if shift >= 0 {
+		rs.prefixes = make(map[int64]*readCounts)
+	}
+	return rs
+}
+
+func (rs *readStats) count(k state.Key, kind int) {
+	atomic.AddUint64(&rs.total[kind], 1)
+	if rs.shift < 0 {
+		return
+	}
+	prefix := int64(k) >> uint(rs.shift)
+	rs.lock.RLock()
+	rc := rs.prefixes[prefix]
+	rs.lock.RUnlock()
+	if rc == nil {
+		rs.lock.Lock()
+		if rc = rs.prefixes[prefix]; rc == nil && len(rs.prefixes) < READ_STATS_MAX_PREFIXES {
+			rc = new(readCounts)
+			rs.prefixes[prefix] = rc
+		}
+		rs.lock.Unlock()
+		if rc == nil {
+			return
+		}
+	}
+	atomic.AddUint64(&rc[kind], 1)
+}
+
+// count the reply to a client's read
+func (r *Replica) countRead(reply *genericsmrproto.ProposeReplyTS, p *Propose, local bool) {
+	if p.Propose == nil || !state.IsRead(&p.Command) {
+		return
+	}
+	kind := READ_QUORUM
+	switch {
+	case reply.OK != TRUE:
+		kind = READ_REJECTED
+	case local:
+		kind = READ_LOCAL
+	case p.FwdReplica == r.Id:
+		kind = READ_FORWARDED
+	}
+	r.readStats.count(p.Command.K, kind)
+}
+
+// ReplyLocalRead replies to a client read that the replica served locally,
+// under its lease, rather than through the protocol, as ReplyProposeTS does.
+func (r *Replica) ReplyLocalRead(reply *genericsmrproto.ProposeReplyTS, propose *Propose) {
+	r.replyPropose(reply, propose, true)
+}
+
+// ReadStats returns the client reads the replica answered, by how it served
+// them: in total, and by key prefix (sorted; nil unless it counts them).
+func (r *Replica) ReadStats() (total genericsmrproto.ReadCounts, byPrefix []genericsmrproto.ReadCounts) {
+	rs := r.readStats
+	total = rs.total.counts(0)
+	if rs.shift < 0 {
+		return total, nil
+	}
+	rs.lock.RLock()
+	byPrefix = make([]genericsmrproto.ReadCounts, 0, len(rs.prefixes))
+	for prefix, rc := range rs.prefixes {
+		byPrefix = append(byPrefix, rc.counts(prefix))
+	}
+	rs.lock.RUnlock()
+	sort.Slice(byPrefix, func(i, j int) bool { return byPrefix[i].Prefix < byPrefix[j].Prefix })
+	return total, byPrefix
+}
@@ -0,0 +1,142 @@
+package genericsmr
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/state"
+)
+
+// how long ReadStrict keeps trying to complete a quorum read
+const QUORUM_READ_TIMEOUT_NS = 2 * 1e9
+
+// how long a quorum read round waits for replies before starting over
+const QUORUM_READ_ROUND_NS = 100 * 1e6
+
+const QUORUM_READ_CHAN_SIZE = 1000
+
+var ErrReadStrictUnsupported = errors.New("the protocol does not support strict reads")
+var ErrReadTimeout = errors.New("timed out waiting for a read quorum")
+
+// LogState is implemented by protocols that support ReadStrict.
+type LogState interface {
+	// ReadApplied returns the value of k, with its version, with every
+	// instance up to applied executed, and whether some accepted but not yet
+	// executed command updates k.
+	ReadApplied(k state.Key) (e state.Entry, applied int32, updating bool)
+	// LatestAccepted returns the latest instance this replica has accepted.
+	LatestAccepted() int32
+}
+
+type quorumReads struct {
+	lock    *sync.Mutex
+	lastId  int32
+	pending map[int32]chan *genericsmrproto.QuorumReadReply
+}
+
+// ReadStrict returns the value of k linearizably, as the replica's read
+// strategy dictates (see WithReadStrategy): by default, locally if the replica
+// holds a read lease covering k and k is not being updated, and otherwise
+// through a quorum read. The value comes with its version.
+func (r *Replica) ReadStrict(k state.Key) (state.Entry, error) {
+	if r.Log == nil {
+		return state.Entry{}, ErrReadStrictUnsupported
+	}
+	return r.reads().Read(r, k)
+}
+
+// a quorum read, retried until some member of the quorum has executed every
+// instance accepted by the others
+func (r *Replica) quorumRead(k state.Key) (state.Entry, error) {
+	deadline := time.Now().UnixNano() + QUORUM_READ_TIMEOUT_NS
+	for time.Now().UnixNano() < deadline {
+		if e, done := r.quorumReadRound(k); done {
+			return e, nil
+		}
+		time.Sleep(1000 * 1000)
+	}
+	return state.Entry{}, ErrReadTimeout
+}
+
+// one round of a quorum read; returns false if it must be retried
+func (r *Replica) quorumReadRound(k state.Key) (state.Entry, bool) {
+	id := atomic.AddInt32(&r.qreads.lastId, 1)
+	replies := make(chan *genericsmrproto.QuorumReadReply, r.N)
+	r.qreads.lock.Lock()
+	r.qreads.pending[id] = replies
+	r.qreads.lock.Unlock()
+	defer func() {
+		r.qreads.lock.Lock()
+		delete(r.qreads.pending, id)
+		r.qreads.lock.Unlock()
+	}()
+
+	qr := &genericsmrproto.QuorumRead{ReplicaId: r.Id, ReadId: id, Key: k}
+	replies <- r.quorumReadReply(qr)
+	for i := int32(0); i < int32(r.N); i++ {
+		if i != r.Id && r.PeerAlive(i) {
+			r.SendMsg(i, r.quorumReadRPC, qr)
+		}
+	}
+
+	got := make([]*genericsmrproto.QuorumReadReply, 0, r.N)
+	timeout := time.NewTimer(QUORUM_READ_ROUND_NS)
+	defer timeout.Stop()
+	for len(got) < r.N/2+1 {
+		select {
+		case reply := <-replies:
+			got = append(got, reply)
+		case <-timeout.C:
+			return state.Entry{}, false
+		}
+	}
+	accepted := int32(-1)
+	for _, reply := range got {
+		if reply.Accepted > accepted {
+			accepted = reply.Accepted
+		}
+	}
+	for _, reply := range got {
+		if reply.Applied >= accepted {
+			return state.Entry{Value: reply.Value, Version: reply.Version}, true
+		}
+	}
+	return state.Entry{}, false
+}
+
+func (r *Replica) quorumReadReply(qr *genericsmrproto.QuorumRead) *genericsmrproto.QuorumReadReply {
+	accepted := r.Log.LatestAccepted()
+	e, applied, _ := r.Log.ReadApplied(qr.Key)
+	return &genericsmrproto.QuorumReadReply{
+		ReplicaId: r.Id,
+		ReadId:    qr.ReadId,
+		Value:     e.Value,
+		Accepted:  accepted,
+		Applied:   applied,
+		Version:   e.Version,
+	}
+}
+
+// answer the quorum reads of peers, and route the replies to our own
+func (r *Replica) serveQuorumReads(reads chan fastrpc.Serializable, replies chan fastrpc.Serializable) {
+	for !r.Shutdown {
+		select {
+		case m := <-reads:
+			qr := m.(*genericsmrproto.QuorumRead)
+			if r.Log != nil {
+				r.SendMsg(qr.ReplicaId, r.quorumReadReplyRPC, r.quorumReadReply(qr))
+			}
+		case m := <-replies:
+			reply := m.(*genericsmrproto.QuorumReadReply)
+			r.qreads.lock.Lock()
+			if c, present := r.qreads.pending[reply.ReadId]; present {
+				c <- reply
+			}
+			r.qreads.lock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package genericsmr
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/qlease"
+)
+
+// Quorum leases are renewed with promises from every replica to every other,
+// every renewal interval: across regions, most of those cross a WAN. With a
+// topology whose HierarchicalLeases is set, the replicas of a region instead
+// rely on its delegate (the live replica of the region with the lowest ID).
+// Replicas send their guards and promises only to the replicas of their own
+// region and to the delegates of the others, so that a delegate still hears
+// from every replica and holds its lease from a majority of the cluster, as
+// before. The other replicas of its region ask it for a sub-grant every
+// renewal interval (RegionLeaseRequest) and read locally until the time they
+// asked plus what was left of the delegate's lease when it answered: that is
+// never later than the delegate's own lease, which ends before the promises
+// it holds do, so writes still cannot bypass them. Promises then cross
+// regions only to the delegates, and a region's sub-grants never leave it.
+
+type regionLease struct {
+	lock  sync.Mutex // protects inst and until, which the protocol's goroutine sets
+	inst  int32      // the lease instance that a majority promised this replica
+	until int64      // until when, by their promises, it may read (0 if it may not)
+
+	// the latest sub-grant from the delegate, which only the protocol's
+	// goroutine touches
+	grantInst  int32
+	grantUntil int64
+}
+
+func newRegionLease() *regionLease {
+	return &regionLease{inst: -1, grantInst: -1}
+}
+
+func (r *Replica) hierarchicalLeases() bool {
+	t := r.cfg.Topology
+	return t != nil && t.HierarchicalLeases && len(t.Regions) > 0
+}
+
+// the live replica of region with the lowest ID (-1 if none)
+func (r *Replica) regionDelegate(region string) int32 {
+	for i := int32(0); i < int32(r.N); i++ {
+		if r.cfg.Topology.Region(i) == region && (i == r.Id || r.PeerAlive(i)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// whether this replica sends its lease guards and promises to peer q
+func (r *Replica) promisesTo(q int32) bool {
+	if !r.hierarchicalLeases() {
+		return true
+	}
+	region := r.cfg.Topology.Region(q)
+	return region == r.cfg.Topology.Region(r.Id) || r.regionDelegate(region) == q
+}
+
+// ask the delegate of this replica's region for a sub-grant, unless this
+// replica is the delegate
+func (r *Replica) requestRegionLease(now int64) {
+	if !r.hierarchicalLeases() || r.LeaseSuspended() {
+		return
+	}
+	d := r.regionDelegate(r.cfg.Topology.Region(r.Id))
+	if d < 0 || d == r.Id {
+		return
+	}
+	r.SendControlMsg(d, r.regionLeaseRequestRPC, &genericsmrproto.RegionLeaseRequest{ReplicaId: r.Id, Sent: now})
+}
+
+func (r *Replica) handleRegionLeaseRequest(req *genericsmrproto.RegionLeaseRequest) {
+	if !r.hierarchicalLeases() || r.Draining() {
+		return
+	}
+	region := r.cfg.Topology.Region(r.Id)
+	if r.cfg.Topology.Region(req.ReplicaId) != region || r.regionDelegate(region) != r.Id {
+		return
+	}
+	// the delegate holds its lease for the replicas of its region too
+	r.noteLeaseRead()
+	rl := r.regionLease
+	rl.lock.Lock()
+	inst, until := rl.inst, rl.until
+	rl.lock.Unlock()
+	now := r.Now()
+	if until <= now {
+		return
+	}
+	r.SendControlMsg(req.ReplicaId, r.regionLeaseRPC, &genericsmrproto.RegionLease{
+		ReplicaId: r.Id, LeaseInstance: inst, Sent: req.Sent, DurationNs: until - now})
+}
+
+// HandleRegionLease takes up a sub-grant from the delegate of the replica's
+// region, and reports whether it did. Protocols call it from the goroutine
+// that handles the lease's promises, with the grants that arrive on
+// QLRegionLeaseChan.
+func (r *Replica) HandleRegionLease(ql *qlease.Lease, g *genericsmrproto.RegionLease) bool {
+	if g.LeaseInstance < ql.PromisedToMeInst {
+		return false
+	}
+	now := r.Now()
+	wasReading := now <= ql.ReadLocallyUntil
+	if g.LeaseInstance > ql.PromisedToMeInst {
+		atomic.StoreInt32(&ql.PromisedToMeInst, g.LeaseInstance)
+		for i := int32(0); i < int32(r.N); i++ {
+			ql.LatestPromisesReceived[i] = 0
+		}
+		atomic.StoreInt64(&ql.ReadLocallyUntil, 0)
+		r.RecordLeaseInstances(ql)
+	}
+	rl := r.regionLease
+	if rl.grantInst != g.LeaseInstance || rl.grantUntil < g.Sent+g.DurationNs {
+		rl.grantInst, rl.grantUntil = g.LeaseInstance, g.Sent+g.DurationNs
+	}
+	if rl.grantUntil > ql.ReadLocallyUntil && r.startupGraceOver(now) {
+		atomic.StoreInt64(&ql.ReadLocallyUntil, rl.grantUntil)
+	}
+	if !wasReading && now <= ql.ReadLocallyUntil {
+		r.nextLeaseEpoch(ql)
+		r.leaseReacquired(now)
+	}
+	return true
+}
+
+// with ql.ReadLocallyUntil just set from the promises of a majority, offer
+// that lease to the region as its delegate, and extend it to the sub-grant
+// held from the delegate
+func (r *Replica) holdRegionLease(ql *qlease.Lease, now int64) {
+	if !r.hierarchicalLeases() {
+		return
+	}
+	rl := r.regionLease
+	rl.lock.Lock()
+	rl.inst, rl.until = ql.PromisedToMeInst, ql.ReadLocallyUntil
+	rl.lock.Unlock()
+	if rl.grantInst == ql.PromisedToMeInst && rl.grantUntil > ql.ReadLocallyUntil && r.startupGraceOver(now) {
+		atomic.StoreInt64(&ql.ReadLocallyUntil, rl.grantUntil)
+	}
+}
@@ -0,0 +1,64 @@
+package genericsmr
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Protocols renew their quorum leases from a timer goroutine. Sleeping a
+// fixed LeaseRenewInterval between renewals lets every delay in the event
+// loop push each renewal later than the one before, until a promise races
+// its own expiry, and replicas started together keep renewing together, in
+// bursts that grow with the cluster. So protocols sleep for NextLeaseRenewal
+// instead, which counts from when the promises of the latest renewal expire:
+// the renewal lead time before then, less a random jitter of up to
+// PARAM_LEASE_RENEW_JITTER_NS drawn anew for every renewal, so that jitter
+// only ever moves renewals earlier.
+
+// the shortest wait between two renewals, so that a replica that cannot
+// renew (e.g., while catching up) does not spin
+const MIN_LEASE_RENEW_WAIT = 10 * time.Millisecond
+
+type renewals struct {
+	lock    sync.Mutex
+	rand    *rand.Rand
+	expires int64 // when the promises of the latest renewal expire (0 if none were sent)
+}
+
+func newRenewals(id int32) *renewals {
+	return &renewals{rand: rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))}
+}
+
+// note that promises lasting until expires were sent; promises answering
+// guards, sent one by one, only start a renewal when none is in effect
+func (r *Replica) leaseRenewed(expires int64, now int64, guarded bool) {
+	rn := r.renewals
+	rn.lock.Lock()
+	if !guarded || rn.expires <= now {
+		rn.expires = expires
+	}
+	rn.lock.Unlock()
+}
+
+// NextLeaseRenewal returns how long protocols should wait before renewing
+// their lease again.
+func (r *Replica) NextLeaseRenewal() time.Duration {
+	params := r.currentLeaseParams()
+	_, duration, renewLead := leaseTiming(params)
+	jitter := renewJitter(params, duration, renewLead)
+	rn := r.renewals
+	rn.lock.Lock()
+	defer rn.lock.Unlock()
+	if jitter > 0 {
+		jitter = time.Duration(rn.rand.Int63n(int64(jitter) + 1))
+	}
+	wait := duration - renewLead - jitter
+	if now := r.Now(); rn.expires > now {
+		wait = time.Duration(rn.expires-now) - renewLead - jitter
+	}
+	if wait < MIN_LEASE_RENEW_WAIT {
+		wait = MIN_LEASE_RENEW_WAIT
+	}
+	return wait
+}
@@ -0,0 +1,92 @@
+package genericsmr
+
+import (
+	"bufio"
+	"sync"
+
+	"github.com/glycerine/qlease/fastrpc"
+)
+
+// While a replica's replies are corked, the replies it writes to its clients
+// stay buffered; they are flushed together once the last Uncork call returns.
+type replyCork struct {
+	lock  *sync.Mutex
+	cond  *sync.Cond
+	depth int
+}
+
+func newReplyCork() *replyCork {
+	c := &replyCork{lock: new(sync.Mutex)}
+	c.cond = sync.NewCond(c.lock)
+	return c
+}
+
+func (c *replyCork) wait() {
+	c.lock.Lock()
+	for c.depth > 0 {
+		c.cond.Wait()
+	}
+	c.lock.Unlock()
+}
+
+// CorkReplies holds back the flushing of client replies, e.g., while executing
+// a batch of commands that each produce a reply. Calls nest.
+func (r *Replica) CorkReplies() {
+	r.cork.lock.Lock()
+	r.cork.depth++
+	r.cork.lock.Unlock()
+}
+
+func (r *Replica) UncorkReplies() {
+	r.cork.lock.Lock()
+	r.cork.depth--
+	if r.cork.depth == 0 {
+		r.cork.cond.Broadcast()
+	}
+	r.cork.lock.Unlock()
+}
+
+// A ReplyQueue coalesces the flushes of the replies to one client connection.
+// Replies are marshaled into the connection's writer as they are produced,
+// and a flusher goroutine flushes whatever has accumulated, so that replies
+// produced together go out in as few writes as possible.
+type ReplyQueue struct {
+	writer  *bufio.Writer
+	lock    *sync.Mutex   // the connection's writer lock
+	codec   fastrpc.Codec // the connection's codec (under lock)
+	cork    *replyCork
+	pending chan bool // signaled when there are replies to flush
+	done    chan bool
+}
+
+func (r *Replica) newReplyQueue(writer *bufio.Writer, lock *sync.Mutex) *ReplyQueue {
+	q := &ReplyQueue{writer, lock, fastrpc.Binary, r.cork, make(chan bool, 1), make(chan bool)}
+	go q.flusher()
+	return q
+}
+
+// Written tells the queue that a reply has been written and must be flushed.
+func (q *ReplyQueue) Written() {
+	select {
+	case q.pending <- true:
+	default:
+	}
+}
+
+func (q *ReplyQueue) flusher() {
+	for {
+		select {
+		case <-q.pending:
+		case <-q.done:
+			return
+		}
+		q.cork.wait()
+		q.lock.Lock()
+		q.writer.Flush()
+		q.lock.Unlock()
+	}
+}
+
+func (q *ReplyQueue) Close() {
+	close(q.done)
+}
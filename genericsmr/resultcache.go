@@ -0,0 +1,197 @@
+package genericsmr
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// A replica remembers the results of the latest commands of every client
+// session (see WithResultCache), by (ClientId, CommandId), so that a proposal
+// sent again, e.g. by a client retrying on a new connection after losing the
+// reply, is answered with the original result instead of being executed
+// twice, which matters for commands that are not idempotent (e.g., INCR).
+// Clients name their session with a SESSION message; the proposals of
+// connections that do not are not remembered. A proposal sent again while the
+// original is in progress gets its reply when the original does, unless the
+// original has been in progress for RESULT_PENDING_TIMEOUT_NS, in which case
+// it is proposed again. Failures are forgotten, so that the client can retry
+// them. The results are local to the replica: a proposal sent again to
+// another replica is executed again.
+//
+// Peers forwarding proposals to the leader are sessions too, with FwdReplica
+// as the client and FwdId as the command (see DuplicateForward).
+
+const RESULT_CACHE_SIZE = 1024 // results remembered per session, by default
+
+// how many sessions are remembered; the least recently used are dropped
+const RESULT_CACHE_SESSIONS = 16 * 1024
+
+// how long a proposal sent again waits for the original before being
+// proposed again
+const RESULT_PENDING_TIMEOUT_NS = 10 * 1e9
+
+type sessionKey struct {
+	peer int32  // the forwarding peer, or -1 for a client session
+	id   uint64 // the client's session ID
+}
+
+type cachedResult struct {
+	cmdId   int32
+	reply   *genericsmrproto.ProposeReplyTS // nil while the command is in progress
+	since   int64                           // when the command was proposed
+	waiters []*Propose                      // proposals sent again in the meantime
+}
+
+type sessionResults struct {
+	key     sessionKey
+	results map[int32]*list.Element // of *cachedResult
+	order   *list.List              // most recently used first
+}
+
+type resultCache struct {
+	lock     *sync.Mutex
+	size     int
+	sessions map[sessionKey]*list.Element // of *sessionResults
+	order    *list.List                   // most recently used first
+}
+
+func newResultCache(size int) *resultCache {
+	return &resultCache{
+		lock:     new(sync.Mutex),
+		size:     size,
+		sessions: make(map[sessionKey]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// what forwarded proposals are remembered with: the forwarding peer answers
+// the client itself
+var forwarded = new(genericsmrproto.ProposeReplyTS)
+
+// the results of a session, if it has any; the caller holds the lock
+func (rc *resultCache) session(k sessionKey, create bool) *sessionResults {
+	if e, present := rc.sessions[k]; present {
+		rc.order.MoveToFront(e)
+		return e.Value.(*sessionResults)
+	}
+	if !create {
+		return nil
+	}
+	s := &sessionResults{key: k, results: make(map[int32]*list.Element), order: list.New()}
+	rc.sessions[k] = rc.order.PushFront(s)
+	for rc.order.Len() > RESULT_CACHE_SESSIONS {
+		delete(rc.sessions, rc.order.Remove(rc.order.Back()).(*sessionResults).key)
+	}
+	return s
+}
+
+// remember that the session has proposed a command; the oldest results
+// beyond the cache size are dropped, once their commands have completed
+func (rc *resultCache) add(s *sessionResults, res *cachedResult) {
+	s.results[res.cmdId] = s.order.PushFront(res)
+	for s.order.Len() > rc.size {
+		oldest := s.order.Back()
+		if oldest.Value.(*cachedResult).reply == nil {
+			break
+		}
+		delete(s.results, s.order.Remove(oldest).(*cachedResult).cmdId)
+	}
+}
+
+// beginProposal reports whether a client's proposal should go to the
+// protocol: it should not if its session has proposed the command before, in
+// which case it has been answered with the original result, or will be when
+// the original completes.
+func (r *Replica) beginProposal(p *Propose) bool {
+	rc := r.results
+	if rc == nil || p.Session == 0 {
+		return true
+	}
+	now := r.Now()
+	rc.lock.Lock()
+	s := rc.session(sessionKey{-1, p.Session}, true)
+	e, present := s.results[p.CommandId]
+	if !present {
+		rc.add(s, &cachedResult{cmdId: p.CommandId, since: now})
+		rc.lock.Unlock()
+		return true
+	}
+	s.order.MoveToFront(e)
+	res := e.Value.(*cachedResult)
+	if res.reply != nil {
+		reply := *res.reply
+		rc.lock.Unlock()
+		reply.Timestamp = p.Timestamp
+		r.writeReply(&reply, p)
+		return false
+	}
+	if now-res.since < RESULT_PENDING_TIMEOUT_NS {
+		res.waiters = append(res.waiters, p)
+		rc.lock.Unlock()
+		return false
+	}
+	// the original may have been lost; whichever completes first answers
+	// the waiters
+	res.since = now
+	rc.lock.Unlock()
+	return true
+}
+
+// remember the result of a client's proposal, and answer the proposals its
+// session sent again while it was in progress
+func (r *Replica) finishProposal(reply *genericsmrproto.ProposeReplyTS, p *Propose) {
+	rc := r.results
+	if rc == nil || p.Session == 0 || reply.CommandId != p.CommandId {
+		return
+	}
+	rc.lock.Lock()
+	s := rc.session(sessionKey{-1, p.Session}, false)
+	if s == nil {
+		rc.lock.Unlock()
+		return
+	}
+	e, present := s.results[p.CommandId]
+	if !present || e.Value.(*cachedResult).reply != nil {
+		rc.lock.Unlock()
+		return
+	}
+	res := e.Value.(*cachedResult)
+	waiters := res.waiters
+	res.waiters = nil
+	if reply.OK == TRUE {
+		saved := *reply
+		res.reply = &saved
+	} else {
+		delete(s.results, p.CommandId)
+		s.order.Remove(e)
+	}
+	rc.lock.Unlock()
+	for _, w := range waiters {
+		wreply := *reply
+		wreply.Timestamp = w.Timestamp
+		r.writeReply(&wreply, w)
+	}
+}
+
+// DuplicateForward reports whether a peer has already forwarded proposal
+// fwdId to this replica, and remembers that it has. Protocols call it before
+// proposing a forwarded command, so that a forward delivered twice is not
+// executed twice; the peer, which answers the client, learns the outcome of
+// the original. A peer must not reuse forward IDs, even across restarts.
+func (r *Replica) DuplicateForward(peer int32, fwdId int32) bool {
+	rc := r.results
+	if rc == nil {
+		return false
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	s := rc.session(sessionKey{peer, 0}, true)
+	if e, present := s.results[fwdId]; present {
+		s.order.MoveToFront(e)
+		return true
+	}
+	rc.add(s, &cachedResult{cmdId: fwdId, reply: forwarded})
+	return false
+}
@@ -0,0 +1,100 @@
+package genericsmr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+)
+
+// RPC codes below RPC_CODE_PING go on the wire as a single byte, as they
+// always have. Larger codes are written as RPC_CODE_ESCAPE followed by the
+// code as a little-endian uint16, which only peers that have announced that
+// they understand it can parse. Replicas announce it by sending RPC_CODE_HELLO
+// (with no payload) to every peer once connected; older replicas log the
+// hello as an unknown message type and otherwise ignore it. RPC_CODE_PING and
+// RPC_CODE_PONG are reserved for peer keepalives (see keepalive.go).
+const (
+	RPC_CODE_PING   = 0xFC
+	RPC_CODE_PONG   = 0xFD
+	RPC_CODE_HELLO  = 0xFE
+	RPC_CODE_ESCAPE = 0xFF
+	MAX_RPC_CODE    = 0xFFFF
+)
+
+var ErrExtendedCodeUnsupported = errors.New("peer does not support RPC codes above 251")
+
+// the next code RegisterRPC may hand out after code
+func nextRPCCode(code uint16) uint16 {
+	if code == MAX_RPC_CODE {
+		log.Fatal("Too many registered RPCs")
+	}
+	code++
+	if code == RPC_CODE_PING {
+		// reserved on the wire
+		code = RPC_CODE_ESCAPE + 1
+	}
+	return code
+}
+
+// check that the peer can parse code, before starting to write a message
+func (r *Replica) checkCode(peerId int32, code uint16) error {
+	if code >= RPC_CODE_PING && !r.extendedCodes[peerId] {
+		return ErrExtendedCodeUnsupported
+	}
+	return nil
+}
+
+// append the wire form of code to b
+func appendCode(b []byte, code uint16) []byte {
+	if code < RPC_CODE_PING {
+		return append(b, byte(code))
+	}
+	return append(b, RPC_CODE_ESCAPE, byte(code), byte(code>>8))
+}
+
+func (r *Replica) writeCode(w *bufio.Writer, peerId int32, code uint16) {
+	var b [3]byte
+	w.Write(appendCode(b[:0], code))
+	r.peerCounters[peerId].sentMsg(code)
+}
+
+func readCode(reader *bufio.Reader) (uint16, error) {
+	b, err := reader.ReadByte()
+	if err != nil || b != RPC_CODE_ESCAPE {
+		return uint16(b), err
+	}
+	var bs [2]byte
+	if _, err = io.ReadFull(reader, bs[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(bs[:]), nil
+}
+
+// once connected to the peers: say hello, switch codecs, and start pinging them
+func (r *Replica) peersConnected() {
+	r.sayHello()
+	r.switchPeerCodecs()
+	r.startPeerPings()
+}
+
+// announce support for extended RPC codes to every connected peer
+func (r *Replica) sayHello() {
+	for i := int32(0); i < int32(r.N); i++ {
+		if i == r.Id || !r.PeerAlive(i) {
+			continue
+		}
+		r.sayHelloTo(i)
+	}
+}
+
+func (r *Replica) sayHelloTo(peerId int32) {
+	r.PeerWLocks[peerId].LockControl()
+	w := r.PeerWriters[peerId]
+	r.writePeerPrefix(w, peerId)
+	w.WriteByte(RPC_CODE_HELLO)
+	r.peerCounters[peerId].sentMsg(RPC_CODE_HELLO)
+	w.Flush()
+	r.PeerWLocks[peerId].Unlock()
+}
@@ -0,0 +1,102 @@
+package genericsmr
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// A send to a peer fails with a *PeerSendError, which says which peer and
+// message it was and wraps the cause, so that protocols can tell, with
+// errors.Is, what to do about it:
+//
+//	ErrPeerNotAlive   the peer is not connected, or was found dead; the
+//	                  message was not sent, and may be sent to another peer
+//	ErrWriteTimeout   the message could not be written in time (see
+//	                  WithPeerSendTimeout); the peer was disconnected
+//	ErrMarshal        the message could not be encoded; sending it again
+//	                  will not help
+//	ErrExtendedCodeUnsupported
+//	                  the peer runs a version that cannot read the message
+//
+// or the error of the connection, after which the peer is marked dead. A
+// protocol may also have every failed send reported to a handler of its own
+// (see SetSendErrorHandler), e.g. to suspect the peer or re-route the
+// messages that follow.
+var (
+	ErrPeerNotAlive = errors.New("peer may not be alive")
+	ErrWriteTimeout = errors.New("timed out writing to peer")
+	ErrMarshal      = errors.New("cannot marshal message")
+)
+
+type PeerSendError struct {
+	Peer int32
+	Code uint16 // the message's RPC code
+	Err  error
+}
+
+func (e *PeerSendError) Error() string {
+	return fmt.Sprintf("sending message %d to replica %d: %v", e.Code, e.Peer, e.Err)
+}
+
+func (e *PeerSendError) Unwrap() error {
+	return e.Err
+}
+
+// SendRetryable reports whether a message whose send failed with err may
+// reach its peer if sent again later, or another peer instead.
+func SendRetryable(err error) bool {
+	return err != nil && !errors.Is(err, ErrMarshal) && !errors.Is(err, ErrExtendedCodeUnsupported)
+}
+
+// A SendErrorHandler is called, on the sending goroutine, with the error of
+// every send to a peer that fails.
+type SendErrorHandler func(err *PeerSendError)
+
+// SetSendErrorHandler sets the handler of failed sends (nil for none), which
+// may be changed at any time.
+func (r *Replica) SetSendErrorHandler(h SendErrorHandler) {
+	r.sendErrHandler.Store(&h)
+}
+
+// the error of a failed send of a code message to peerId, reported to the
+// handler
+func (r *Replica) sendFailed(peerId int32, code uint16, err error) error {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() && !errors.Is(err, ErrWriteTimeout) {
+		err = fmt.Errorf("%w: %v", ErrWriteTimeout, err)
+	}
+	serr := &PeerSendError{Peer: peerId, Code: code, Err: err}
+	if h, _ := r.sendErrHandler.Load().(*SendErrorHandler); h != nil && *h != nil {
+		(*h)(serr)
+	}
+	return serr
+}
+
+// the error of a send that panicked, which leaves the peer's connection in an
+// unknown state: marshaling a malformed message, or writing to a connection
+// that was never set up
+func (r *Replica) sendPanicked(peerId int32, code uint16, p interface{}) error {
+	r.PeerStates.Set(peerId, PEER_DEAD)
+	return r.sendFailed(peerId, code, fmt.Errorf("%w: %v", ErrMarshal, p))
+}
+
+// the error of encoding a message to a peer's connection: a connection error
+// from a write the encoding caused, or ErrMarshal
+func encodeErr(err error) error {
+	var ne net.Error
+	if err == nil || errors.As(err, &ne) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrMarshal, err)
+}
+
+// the error of a message written to the peer's connection, which is marked
+// dead if that failed, as part of the message may have gone out
+func (r *Replica) sendWritten(peerId int32, code uint16, err error) error {
+	if err == nil {
+		return nil
+	}
+	r.PeerStates.Set(peerId, PEER_DEAD)
+	return r.sendFailed(peerId, code, err)
+}
@@ -0,0 +1,82 @@
+package genericsmr
+
+import (
+	"log"
+	"time"
+
+	"github.com/glycerine/qlease/fastrpc"
+)
+
+// ErrSendTimeout is the former name of ErrWriteTimeout.
+var ErrSendTimeout = ErrWriteTimeout
+
+// lock l in the control lane, unless that takes longer than timeout
+func lockWithTimeout(l *PeerLock, timeout time.Duration) bool {
+	got := make(chan bool)
+	go func() {
+		l.LockControl()
+		close(got)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-got:
+		return true
+	case <-t.C:
+		// release the lock as soon as the goroutine gets it
+		go func() {
+			<-got
+			l.Unlock()
+		}()
+		return false
+	}
+}
+
+// SendMsgTimeout is like SendControlMsg, but gives up if the message cannot be
+// handed to the peer's connection within the configured per-peer send
+// timeout (see WithPeerSendTimeout), either because another sender is stuck on
+// it or because the peer is not reading. The peer is then marked as not alive
+// and its connection is closed, so that one stuck peer cannot hold back
+// messages (e.g., lease renewals) to the others. Without a timeout configured,
+// SendMsgTimeout is the same as SendControlMsg.
+func (r *Replica) SendMsgTimeout(peerId int32, code uint16, msg fastrpc.Serializable) error {
+	timeout := time.Duration(r.cfg.PeerSendTimeoutNs)
+	if timeout <= 0 {
+		return r.SendControlMsg(peerId, code, msg)
+	}
+	if !r.PeerAlive(peerId) {
+		return r.sendFailed(peerId, code, ErrPeerNotAlive)
+	}
+	deadline := time.Now().Add(timeout)
+	lock, conn := r.PeerWLocks[peerId], r.Peers[peerId]
+	lane := r.controlLane(peerId)
+	if lane != nil {
+		lock, conn = lane.lock, lane.conn
+	}
+	if !lockWithTimeout(lock, timeout) {
+		r.disconnectPeer(peerId, ErrWriteTimeout)
+		return r.sendFailed(peerId, code, ErrWriteTimeout)
+	}
+	defer lock.Unlock()
+	conn.SetWriteDeadline(deadline)
+	var err error
+	if lane != nil {
+		err = r.writeLaneMsg(peerId, lane, code, msg)
+	} else {
+		err = r.writeMsg(peerId, code, msg)
+	}
+	if err != nil {
+		r.disconnectPeer(peerId, err)
+		return r.sendFailed(peerId, code, err)
+	}
+	conn.SetWriteDeadline(time.Time{})
+	return nil
+}
+
+// mark the peer as dead (in every group sharing the connection) and close
+// the connection; the peer must connect again to be heard from
+func (r *Replica) disconnectPeer(peerId int32, reason error) {
+	log.Printf("Disconnecting from replica %d: %v\n", peerId, reason)
+	r.PeerStates.Set(peerId, PEER_DEAD)
+	r.closePeerConn(peerId)
+}
@@ -0,0 +1,270 @@
+package genericsmr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/peermux"
+)
+
+// With peer sessions (see WithPeerSessions), every pair of replicas shares one
+// peermux session, whose control stream carries the replica's messages in
+// place of the raw connection; the other streams are available to protocols
+// through PeerStream. Either replica of a pair may (re)establish the session:
+// both dial each other at startup and whenever the session breaks, so that a
+// replica that restarts, or that only one side can reach, gets reconnected.
+// When two sessions between a pair are up at once, both replicas keep the one
+// dialed by the lower replica ID (or the newer one, if they were dialed by the
+// same replica) and close the other.
+//
+// Peer and client connections arrive on the same port: a replica dialing a
+// peer starts with PEER_SESSION_MAGIC, which is not a client message type,
+// followed by its ID and boot ID (little-endian int32 and uint64), and the
+// peer answers with its own boot ID (see dedup.go). Sessions are not
+// supported with a GroupMux, and every replica of a cluster must use them or
+// none.
+
+const PEER_SESSION_MAGIC = 0xA5
+
+// how long to wait between attempts to (re)connect to a peer
+const PEER_REDIAL_INTERVAL = time.Second
+
+// how long the peer may take to answer the session handshake
+const PEER_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+type peerSession struct {
+	s      *peermux.Session
+	dialer int32
+}
+
+// PeerStream returns a stream of the session with a peer (e.g.,
+// peermux.STREAM_SNAPSHOT), or nil if the replica does not use peer sessions
+// or is not connected to the peer.
+func (r *Replica) PeerStream(peerId int32, stream uint8) net.Conn {
+	r.sessionLock.Lock()
+	defer r.sessionLock.Unlock()
+	if r.sessions == nil || r.sessions[peerId] == nil {
+		return nil
+	}
+	return r.sessions[peerId].s.Stream(stream)
+}
+
+func (r *Replica) connectPeerSessions() {
+	r.startAccepting()
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id {
+			q := q
+			r.Tasks.Go(fmt.Sprintf("session with replica %d", q), RESTART_ON_PANIC, func() error {
+				r.maintainSession(q)
+				return nil
+			})
+		}
+	}
+	for {
+		connected := true
+		for q := int32(0); q < int32(r.N); q++ {
+			if q != r.Id && !r.PeerAlive(q) {
+				connected = false
+			}
+		}
+		if connected {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Printf("Replica id: %d. Done connecting to peers\n", r.Id)
+}
+
+// accept peer and client connections on the replica's port, once
+func (r *Replica) startAccepting() {
+	r.acceptOnce.Do(func() {
+		if r.Listener == nil {
+			var err error
+			if r.Listener, err = r.transport().Listen(r.listenAddr()); err != nil {
+				log.Fatal(err)
+			}
+		}
+		go func() {
+			for !r.Shutdown {
+				conn, err := r.Listener.Accept()
+				if err != nil {
+					log.Println("Accept error:", err)
+					continue
+				}
+				go r.classifyConn(conn)
+			}
+		}()
+	})
+}
+
+// tell a peer dialing in from a client, by the first byte (see accept.go)
+func (r *Replica) classifyConn(conn net.Conn) {
+	var b [13]byte
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		conn.Close()
+		return
+	}
+	if b[0] == PEER_CONN_MAGIC && r.sessions == nil {
+		r.acceptPeer(conn)
+		return
+	}
+	if b[0] != PEER_SESSION_MAGIC || r.sessions == nil {
+		r.tuneConn(conn, false)
+		r.admitClient(&prefixConn{conn, b[0], true})
+		return
+	}
+	conn.SetDeadline(time.Now().Add(PEER_HANDSHAKE_TIMEOUT))
+	if _, err := io.ReadFull(conn, b[1:13]); err != nil {
+		conn.Close()
+		return
+	}
+	q := int32(binary.LittleEndian.Uint32(b[1:5]))
+	if q < 0 || q >= int32(r.N) || q == r.Id {
+		log.Printf("Rejecting a peer connection from %s claiming to be replica %d\n", conn.RemoteAddr(), q)
+		conn.Close()
+		return
+	}
+	binary.LittleEndian.PutUint64(b[5:13], r.bootId)
+	if _, err := conn.Write(b[5:13]); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	r.installSession(q, conn, q, binary.LittleEndian.Uint64(b[5:13]))
+}
+
+// keep a session with peer q up, redialing whenever it breaks
+func (r *Replica) maintainSession(q int32) {
+	for !r.Shutdown {
+		if ps := r.session(q); ps != nil && ps.s.Err() == nil {
+			<-ps.s.Done()
+			continue
+		}
+		if conn, err := r.transport().Dial(r.PeerAddr(q)); err == nil {
+			if boot, err := r.dialerHandshake(conn); err != nil {
+				conn.Close()
+			} else {
+				r.installSession(q, conn, r.Id, boot)
+				continue
+			}
+		}
+		// spread out the attempts of the two sides
+		time.Sleep(PEER_REDIAL_INTERVAL + time.Duration(rand.Int63n(int64(PEER_REDIAL_INTERVAL))))
+	}
+}
+
+// introduce this replica to the peer it has dialed; returns the peer's boot ID
+func (r *Replica) dialerHandshake(conn net.Conn) (uint64, error) {
+	var b [13]byte
+	b[0] = PEER_SESSION_MAGIC
+	binary.LittleEndian.PutUint32(b[1:5], uint32(r.Id))
+	binary.LittleEndian.PutUint64(b[5:13], r.bootId)
+	conn.SetDeadline(time.Now().Add(PEER_HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(b[:]); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(conn, b[5:13]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b[5:13]), nil
+}
+
+func (r *Replica) session(q int32) *peerSession {
+	r.sessionLock.Lock()
+	defer r.sessionLock.Unlock()
+	return r.sessions[q]
+}
+
+// make a new connection with peer q the replica's connection to it, unless a
+// preferred session is already up
+func (r *Replica) installSession(q int32, conn net.Conn, dialer int32, peerBoot uint64) {
+	r.tuneConn(conn, true)
+	s := peermux.NewSession(conn)
+
+	ps := &peerSession{s, dialer}
+	r.sessionLock.Lock()
+	old := r.sessions[q]
+	if old != nil && old.s.Err() == nil && old.dialer < dialer {
+		r.sessionLock.Unlock()
+		s.Close()
+		return
+	}
+	r.sessions[q] = ps
+	r.sessionLock.Unlock()
+	if old != nil {
+		// also releases the writers stuck on it
+		old.s.Close()
+		log.Printf("Reconnected to replica %d\n", q)
+	}
+
+	stream := r.peerConn(q, s.Stream(peermux.STREAM_CONTROL))
+	reader := r.newPeerReader(stream)
+	r.PeerWLocks[q].LockControl()
+	r.sessionLock.Lock()
+	current := r.sessions[q] == ps
+	if current {
+		r.Peers[q] = stream
+		r.PeerReaders[q] = reader
+		r.PeerWriters[q] = r.newPeerWriter(stream)
+		r.extendedCodes[q] = false
+		r.reassemblers[q] = fastrpc.NewReassembler()
+		r.recvSeqs[q].reset(peerBoot)
+		r.heardFromPeer(int(q))
+		r.PeerStates.Set(q, PEER_ALIVE)
+	}
+	r.sessionLock.Unlock()
+	r.PeerWLocks[q].Unlock()
+	if !current {
+		// a newer session has replaced this one (and closed it)
+		return
+	}
+	r.startReplicaListener(int(q), reader)
+	r.sayHelloTo(q)
+}
+
+// whether reader is (still) that of the replica's connection to peer rid
+func (r *Replica) currentPeerReader(rid int, reader *bufio.Reader) bool {
+	r.sessionLock.Lock()
+	defer r.sessionLock.Unlock()
+	return r.PeerReaders[rid] == reader
+}
+
+// close the connection to a peer, the whole session if there is one
+func (r *Replica) closePeerConn(peerId int32) {
+	if r.sessions != nil {
+		if ps := r.session(peerId); ps != nil {
+			ps.s.Close()
+			return
+		}
+	}
+	if l := r.controlLane(peerId); l != nil {
+		l.conn.Close()
+	}
+	if conn := r.Peers[peerId]; conn != nil {
+		conn.Close()
+	}
+}
+
+// a connection whose first byte has already been read
+type prefixConn struct {
+	net.Conn
+	first   byte
+	pending bool
+}
+
+func (pc *prefixConn) Read(p []byte) (int, error) {
+	if pc.pending && len(p) > 0 {
+		p[0] = pc.first
+		pc.pending = false
+		return 1, nil
+	}
+	return pc.Conn.Read(p)
+}
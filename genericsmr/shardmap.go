@@ -0,0 +1,109 @@
+package genericsmr
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/glycerine/qlease/state"
+)
+
+// A ShardRange assigns the keys in [Lo, Hi] to an SMR group.
+type ShardRange struct {
+	Lo, Hi state.Key
+	Group  uint16
+}
+
+// A ShardMap partitions the keyspace among the groups of a deployment.
+// Keys outside every range belong to group 0.
+type ShardMap struct {
+	lock   *sync.RWMutex
+	ranges []ShardRange // sorted by Lo, non-overlapping
+}
+
+func NewShardMap() *ShardMap {
+	return &ShardMap{lock: new(sync.RWMutex)}
+}
+
+// Assign gives the keys in [lo, hi] to group. Ranges may not overlap.
+func (sm *ShardMap) Assign(lo state.Key, hi state.Key, group uint16) error {
+	if lo > hi {
+		return fmt.Errorf("empty shard range [%d, %d]", lo, hi)
+	}
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	i := sort.Search(len(sm.ranges), func(i int) bool { return sm.ranges[i].Lo > lo })
+	if (i > 0 && sm.ranges[i-1].Hi >= lo) || (i < len(sm.ranges) && sm.ranges[i].Lo <= hi) {
+		return fmt.Errorf("shard range [%d, %d] overlaps an existing range", lo, hi)
+	}
+	sm.ranges = append(sm.ranges, ShardRange{})
+	copy(sm.ranges[i+1:], sm.ranges[i:])
+	sm.ranges[i] = ShardRange{lo, hi, group}
+	return nil
+}
+
+// GroupFor returns the group that owns key k. A nil map puts every key in group 0.
+func (sm *ShardMap) GroupFor(k state.Key) uint16 {
+	if sm == nil {
+		return 0
+	}
+	sm.lock.RLock()
+	defer sm.lock.RUnlock()
+	i := sort.Search(len(sm.ranges), func(i int) bool { return sm.ranges[i].Hi >= k })
+	if i < len(sm.ranges) && sm.ranges[i].Lo <= k {
+		return sm.ranges[i].Group
+	}
+	return 0
+}
+
+func (sm *ShardMap) Ranges() []ShardRange {
+	sm.lock.RLock()
+	defer sm.lock.RUnlock()
+	return append([]ShardRange(nil), sm.ranges...)
+}
+
+// ReadShardMap parses a shard map with one range per line:
+//
+//	lo hi group
+//
+// Empty lines and lines starting with '#' are ignored.
+func ReadShardMap(rd io.Reader) (*ShardMap, error) {
+	sm := NewShardMap()
+	scanner := bufio.NewScanner(rd)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var lo, hi int64
+		var group uint16
+		if _, err := fmt.Sscan(line, &lo, &hi, &group); err != nil {
+			return nil, fmt.Errorf("shard map line %d: %v", lineNo, err)
+		}
+		if err := sm.Assign(state.Key(lo), state.Key(hi), group); err != nil {
+			return nil, fmt.Errorf("shard map line %d: %v", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sm, nil
+}
+
+// route returns the replica of the group that owns key k, if this process
+// hosts it; otherwise it returns nil and the owning group.
+func (r *Replica) route(k state.Key) (*Replica, uint16) {
+	if r.mux == nil || r.mux.Shards == nil {
+		return r, r.GroupId
+	}
+	g := r.mux.Shards.GroupFor(k)
+	if g == r.GroupId {
+		return r, g
+	}
+	return r.mux.Group(g), g
+}
@@ -0,0 +1,120 @@
+package genericsmr
+
+import (
+	"log"
+	"sort"
+	"sync/atomic"
+)
+
+// In thrifty mode, a protocol sends to a preferred quorum of peers, the
+// first N/2 of PreferredPeerOrder, rather than to every peer; a member of
+// that quorum that becomes slow then slows down every round. Protocols that
+// call ShedSlowPeers periodically, from the goroutine that reads
+// PreferredPeerOrder, have such peers shed from the quorum: a peer is slow
+// while its beacon latency (Ewma) exceeds PARAM_SHED_LATENCY_NS, or while
+// more than PARAM_SHED_QUEUE_DEPTH writers hold or wait for its connection, and a
+// slow peer is moved behind the peers that are not, so that the next-best
+// peer takes its slot. A shed peer is only taken back once its latency and
+// queue are below 3/4 of the thresholds, so that a peer hovering around them
+// does not flap in and out of the quorum. The protocol may also move the
+// shed peer's leases to the peers that replaced it (see WithSlowPeerShedding).
+
+type slowPeers struct {
+	shed []int32 // per peer, set while shed; written by the protocol's goroutine
+}
+
+func newSlowPeers(n int) *slowPeers {
+	return &slowPeers{shed: make([]int32, n)}
+}
+
+// PeerShed reports whether the peer is shed from the preferred quorum.
+func (r *Replica) PeerShed(q int32) bool {
+	return atomic.LoadInt32(&r.slowPeers.shed[q]) != 0
+}
+
+// ShedLeases reports whether shed peers should also lose their leases.
+func (r *Replica) ShedLeases() bool {
+	return r.cfg.ShedLeases
+}
+
+// whether q is slow; scale (in quarters) lowers the thresholds
+func (r *Replica) peerSlow(q int32, scale int64) bool {
+	if lat := r.Param(PARAM_SHED_LATENCY_NS); lat > 0 && r.Beacons.Latency(q) > float64(lat*scale/4) {
+		return true
+	}
+	if depth := r.Param(PARAM_SHED_QUEUE_DEPTH); depth > 0 && int64(r.PeerWLocks[q].Queued()) > depth*scale/4 {
+		return true
+	}
+	return false
+}
+
+// ShedSlowPeers reorders PreferredPeerOrder so that the slow peers leave the
+// preferred quorum, if enough others can take their slots, and returns the
+// peers it shed and those it took back. It must be called from the goroutine
+// that reads PreferredPeerOrder.
+func (r *Replica) ShedSlowPeers() (shed []int32, restored []int32) {
+	if r.Param(PARAM_SHED_LATENCY_NS) <= 0 && r.Param(PARAM_SHED_QUEUE_DEPTH) <= 0 {
+		return nil, r.restoreShedPeers()
+	}
+	slots := r.N / 2
+	var fast, slow []int32
+	for _, q := range r.PreferredPeerOrder {
+		if q == r.Id {
+			continue
+		}
+		scale := int64(4)
+		if r.PeerShed(q) {
+			scale = 3
+		}
+		if r.PeerAlive(q) && !r.peerSlow(q, scale) {
+			fast = append(fast, q)
+		} else {
+			slow = append(slow, q)
+		}
+	}
+	// the peers already in the quorum keep their slots, the others are
+	// ranked by latency
+	inQuorum := make(map[int32]bool, slots)
+	for _, q := range r.PreferredPeerOrder[:slots] {
+		inQuorum[q] = true
+	}
+	sort.SliceStable(fast, func(i, j int) bool {
+		if inQuorum[fast[i]] != inQuorum[fast[j]] {
+			return inQuorum[fast[i]]
+		}
+		return r.Beacons.Latency(fast[i]) < r.Beacons.Latency(fast[j])
+	})
+	sort.SliceStable(slow, func(i, j int) bool { return r.Beacons.Latency(slow[i]) < r.Beacons.Latency(slow[j]) })
+	order := append(fast, slow...)
+	for i, q := range order {
+		// dead peers are left to the failure detector
+		out := int32(0)
+		if i >= slots && i >= len(fast) && r.PeerAlive(q) {
+			out = 1
+		}
+		if old := atomic.SwapInt32(&r.slowPeers.shed[q], out); old != out {
+			if out == 1 {
+				log.Printf("Replica %d: shedding slow peer %d (latency %.0fns, %d writers queued)\n", r.Id, q, r.Beacons.Latency(q), r.PeerWLocks[q].Queued())
+				shed = append(shed, q)
+			} else {
+				log.Printf("Replica %d: taking peer %d back\n", r.Id, q)
+				restored = append(restored, q)
+			}
+		}
+	}
+	// the replica itself stays last
+	order = append(order, r.Id)
+	copy(r.PreferredPeerOrder, order)
+	return shed, restored
+}
+
+// take every shed peer back, once shedding is turned off
+func (r *Replica) restoreShedPeers() []int32 {
+	var restored []int32
+	for q := range r.slowPeers.shed {
+		if atomic.SwapInt32(&r.slowPeers.shed[q], 0) != 0 {
+			restored = append(restored, int32(q))
+		}
+	}
+	return restored
+}
@@ -0,0 +1,245 @@
+package genericsmr
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// A replica too far behind to catch up from its peers' logs (see
+// RequestEntries) fetches a snapshot of their state instead, with
+// FetchSnapshot. Snapshots may be large, so they are sent in chunks of
+// SNAPSHOT_CHUNK_SIZE, each with its own checksum, that the fetching replica
+// requests a window at a time, at most PARAM_SNAPSHOT_BYTES_PER_SEC per
+// sending replica, so that a transfer does not crowd out the messages of the
+// protocol. A transfer that stalls (e.g., because the connection broke) or
+// that receives a corrupt chunk resumes from the last good byte, and a
+// failed FetchSnapshot can be resumed later, from the same peer or another
+// one holding the same snapshot.
+
+// SNAPSHOT_CHUNK_SIZE is at most fastrpc.CHUNK_SIZE, so that chunks are sent
+// whole between the other messages to the peer.
+const SNAPSHOT_CHUNK_SIZE = fastrpc.CHUNK_SIZE - 64
+
+// bytes the fetching replica requests at once; it requests the next window
+// once half of the current one has arrived
+const SNAPSHOT_WINDOW = 64 * SNAPSHOT_CHUNK_SIZE
+
+// how long a transfer may go without receiving a chunk before it is resumed
+const SNAPSHOT_STALL_TIMEOUT = 5 * time.Second
+
+// how many times in a row a transfer may stall before FetchSnapshot gives up
+const SNAPSHOT_MAX_STALLS = 5
+
+const SNAPSHOT_CHAN_SIZE = 2 * SNAPSHOT_WINDOW / SNAPSHOT_CHUNK_SIZE
+
+const DEFAULT_SNAPSHOT_BYTES_PER_SEC = 32 << 20
+
+var ErrNoSnapshot = errors.New("the peer does not have the snapshot")
+var ErrSnapshotStalled = errors.New("snapshot transfer stalled")
+
+var snapshotTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A Snapshot is the state of a protocol at some point, in a form it can
+// restore (e.g., the state machine and the instance it was taken at).
+type Snapshot struct {
+	Id   int64 // nonzero, and different for every snapshot the replica takes
+	Size int64
+	Data io.ReaderAt
+}
+
+// A Snapshotter provides the snapshots that peers fetch from the replica.
+type Snapshotter interface {
+	// Snapshot returns the snapshot with the given ID, or the latest one if
+	// id is 0; nil if there is no such snapshot (anymore).
+	Snapshot(id int64) *Snapshot
+}
+
+// SnapshotFetch is the progress of a transfer, from which a FetchSnapshot
+// that failed can be resumed.
+type SnapshotFetch struct {
+	Peer   int32 // the replica sending the snapshot
+	Id     int64 // the snapshot (0 for the peer's latest, until it names it)
+	Size   int64 // 0 until the first chunk arrives
+	Offset int64 // bytes received and written so far
+}
+
+func (f *SnapshotFetch) done() bool {
+	return f.Size > 0 && f.Offset >= f.Size
+}
+
+type snapshots struct {
+	fetchLock *sync.Mutex // one transfer at a time
+	transfer  int32       // ID of the latest transfer requested
+	chunks    chan fastrpc.Serializable
+
+	latest []int32                                 // per peer, the latest transfer it requested
+	queues []chan *genericsmrproto.RequestSnapshot // per peer, the windows it requested
+	bucket *TokenBucket
+	lock   *sync.Mutex // protects bucket
+}
+
+func newSnapshots(n int) *snapshots {
+	s := &snapshots{
+		fetchLock: new(sync.Mutex),
+		chunks:    make(chan fastrpc.Serializable, SNAPSHOT_CHAN_SIZE),
+		latest:    make([]int32, n),
+		queues:    make([]chan *genericsmrproto.RequestSnapshot, n),
+		bucket:    NewTokenBucket(0, time.Now().UnixNano()),
+		lock:      new(sync.Mutex),
+	}
+	for q := range s.queues {
+		s.queues[q] = make(chan *genericsmrproto.RequestSnapshot, 4)
+	}
+	return s
+}
+
+// FetchSnapshot receives a snapshot from f.Peer, starting at f.Offset, and
+// writes it to w, in order. It returns nil once the whole snapshot has been
+// written, and otherwise leaves f where the transfer stopped, for a later
+// FetchSnapshot to resume from.
+func (r *Replica) FetchSnapshot(f *SnapshotFetch, w io.Writer) error {
+	s := r.snaps
+	s.fetchLock.Lock()
+	defer s.fetchLock.Unlock()
+	var transfer int32
+	var requested int64 // end of the windows requested so far
+	request := func(resume bool) error {
+		if resume {
+			transfer = atomic.AddInt32(&s.transfer, 1)
+			requested = f.Offset
+		}
+		err := r.SendMsg(f.Peer, r.requestSnapshotRPC, &genericsmrproto.RequestSnapshot{
+			ReplicaId: r.Id, Transfer: transfer, SnapshotId: f.Id, Offset: requested, Length: SNAPSHOT_WINDOW})
+		requested += SNAPSHOT_WINDOW
+		return err
+	}
+	if f.done() {
+		return nil
+	}
+	request(true)
+	timer := time.NewTimer(SNAPSHOT_STALL_TIMEOUT)
+	defer timer.Stop()
+	stalls := 0
+	for {
+		var c *genericsmrproto.SnapshotChunk
+		select {
+		case m := <-s.chunks:
+			c = m.(*genericsmrproto.SnapshotChunk)
+		case <-timer.C:
+			if stalls++; stalls >= SNAPSHOT_MAX_STALLS {
+				return ErrSnapshotStalled
+			}
+			log.Printf("Snapshot transfer from replica %d stalled at %d bytes, resuming\n", f.Peer, f.Offset)
+			request(true)
+			timer.Reset(SNAPSHOT_STALL_TIMEOUT)
+			continue
+		}
+		if c.Transfer != transfer || c.ReplicaId != f.Peer {
+			continue
+		}
+		if c.SnapshotId == 0 || (f.Id != 0 && c.SnapshotId != f.Id) {
+			return ErrNoSnapshot
+		}
+		if c.Offset != f.Offset || crc32.Checksum(c.Data, snapshotTable) != c.Checksum {
+			// a chunk was dropped or corrupted: resume from the last good one
+			request(true)
+			continue
+		}
+		if _, err := w.Write(c.Data); err != nil {
+			return err
+		}
+		f.Id, f.Size = c.SnapshotId, c.Size
+		f.Offset += int64(len(c.Data))
+		if f.Offset >= f.Size {
+			return nil
+		}
+		stalls = 0
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timer.Reset(SNAPSHOT_STALL_TIMEOUT)
+		if requested < f.Size && f.Offset >= requested-SNAPSHOT_WINDOW/2 {
+			request(false)
+		}
+	}
+}
+
+// queue the windows that peers request, for each peer's sender
+func (r *Replica) serveSnapshotRequests(reqs chan fastrpc.Serializable) {
+	s := r.snaps
+	for !r.Shutdown {
+		req := (<-reqs).(*genericsmrproto.RequestSnapshot)
+		q := req.ReplicaId
+		if q < 0 || int(q) >= r.N {
+			continue
+		}
+		atomic.StoreInt32(&s.latest[q], req.Transfer)
+		select {
+		case s.queues[q] <- req:
+		default:
+			// the peer will resume when its transfer stalls
+		}
+	}
+}
+
+// send a peer the windows it requests, until it requests another transfer
+func (r *Replica) sendSnapshots(q int32) {
+	s := r.snaps
+	for req := range s.queues[q] {
+		var snap *Snapshot
+		if r.Snapshots != nil {
+			snap = r.Snapshots.Snapshot(req.SnapshotId)
+		}
+		c := &genericsmrproto.SnapshotChunk{ReplicaId: r.Id, Transfer: req.Transfer}
+		if snap == nil {
+			r.SendMsg(q, r.snapshotChunkRPC, c)
+			continue
+		}
+		c.SnapshotId, c.Size = snap.Id, snap.Size
+		end := req.Offset + req.Length
+		if end > snap.Size {
+			end = snap.Size
+		}
+		buf := make([]byte, SNAPSHOT_CHUNK_SIZE)
+		for off := req.Offset; atomic.LoadInt32(&s.latest[q]) == req.Transfer; {
+			// a window past the end gets an empty chunk, with the size
+			n := end - off
+			if n > SNAPSHOT_CHUNK_SIZE {
+				n = SNAPSHOT_CHUNK_SIZE
+			} else if n < 0 {
+				n = 0
+			}
+			if _, err := snap.Data.ReadAt(buf[:n], off); err != nil && err != io.EOF {
+				log.Printf("Reading snapshot %d: %v\n", snap.Id, err)
+				break
+			}
+			r.throttleSnapshot(n)
+			c.Offset, c.Data = off, buf[:n]
+			c.Checksum = crc32.Checksum(c.Data, snapshotTable)
+			if off += n; r.SendBackgroundMsg(q, r.snapshotChunkRPC, c) != nil || off >= end {
+				break
+			}
+		}
+	}
+}
+
+// wait until n more bytes of snapshots may be sent
+func (r *Replica) throttleSnapshot(n int64) {
+	s := r.snaps
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now().UnixNano()
+	s.bucket.SetRate(float64(r.Param(PARAM_SNAPSHOT_BYTES_PER_SEC)), now)
+	s.bucket.Charge(float64(n), now)
+	for !s.bucket.Take(0, time.Now().UnixNano()) {
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,44 @@
+package genericsmr
+
+import (
+	"log"
+	"net"
+)
+
+// Every new TCP connection to a peer or a client gets its keepalives (see
+// keepalive.go) and the socket options configured for its kind with
+// WithSocketOptions: Go's defaults (no Nagle, the system's buffer sizes,
+// unmarked packets) do not suit every link, e.g. a WAN path whose routers
+// give lease renewals precedence only if their packets are marked, or whose
+// bandwidth-delay product exceeds the default buffers.
+
+// the TCP connection under the replica's own wrappers
+func unwrapConn(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case *prefixConn:
+			conn = c.Conn
+		case *proxyConn:
+			conn = c.Conn
+		case *countingConn:
+			conn = c.Conn
+		case *deadlineConn:
+			conn = c.Conn
+		default:
+			return conn
+		}
+	}
+}
+
+// set up a new connection to a peer, or to a client
+func (r *Replica) tuneConn(conn net.Conn, peer bool) {
+	conn = unwrapConn(conn)
+	setKeepAlive(conn, r.cfg.TCPKeepAliveNs)
+	opts := &r.cfg.ClientSocket
+	if peer {
+		opts = &r.cfg.PeerSocket
+	}
+	if err := opts.Apply(conn); err != nil {
+		log.Printf("Replica %d: setting socket options %q on %s: %v\n", r.Id, opts.String(), conn.RemoteAddr(), err)
+	}
+}
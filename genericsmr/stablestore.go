@@ -0,0 +1,83 @@
+package genericsmr
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// Records in the stable store are framed as
+//
+//	kind (1 byte) | payload length (4 bytes) | CRC-32 of payload (4 bytes) | payload
+//
+// with integers in little-endian order, so that records written by different
+// layers (protocol log, parameter journal, ...) can share one file and be
+// told apart when it is read back.
+const (
+	RECORD_INSTANCE_METADATA uint8 = iota + 1
+	RECORD_COMMANDS
+	RECORD_PARAM
+	RECORD_IDENTITY
+	RECORD_LEASE_INSTANCES // superseded by RECORD_LEASE_STATE, still read back
+	RECORD_LEASE_STATE
+	RECORD_LEASE_EPOCHS
+)
+
+const RECORD_HEADER_SIZE = 9
+
+const MAX_RECORD_SIZE = 64 * 1024 * 1024
+
+var ErrBadChecksum = errors.New("stable store record checksum mismatch")
+var ErrRecordTooLarge = errors.New("stable store record too large")
+
+func EncodeRecordHeader(b []byte, kind uint8, payload []byte) {
+	b[0] = kind
+	binary.LittleEndian.PutUint32(b[1:5], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(b[5:9], crc32.ChecksumIEEE(payload))
+}
+
+// append a framed record to the stable store
+func (r *Replica) RecordToStableStore(kind uint8, payload []byte) error {
+	var b [RECORD_HEADER_SIZE]byte
+	EncodeRecordHeader(b[:], kind, payload)
+	r.stableLock.Lock()
+	defer r.stableLock.Unlock()
+	if _, err := r.StableStore.Write(b[:]); err != nil {
+		return err
+	}
+	_, err := r.StableStore.Write(payload)
+	return err
+}
+
+func (r *Replica) SyncStableStore() error {
+	r.stableLock.Lock()
+	defer r.stableLock.Unlock()
+	return r.StableStore.Sync()
+}
+
+// ReadRecord reads the next framed record. It returns io.EOF at a clean end
+// of file, io.ErrUnexpectedEOF for a torn trailing record, and ErrBadChecksum
+// if the payload does not match its checksum (the payload is returned anyway).
+func ReadRecord(rd io.Reader) (kind uint8, payload []byte, err error) {
+	var b [RECORD_HEADER_SIZE]byte
+	if _, err = io.ReadFull(rd, b[:]); err != nil {
+		return 0, nil, err
+	}
+	kind = b[0]
+	size := binary.LittleEndian.Uint32(b[1:5])
+	if size > MAX_RECORD_SIZE {
+		return kind, nil, ErrRecordTooLarge
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(rd, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return kind, nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(b[5:9]) {
+		return kind, payload, ErrBadChecksum
+	}
+	return kind, payload, nil
+}
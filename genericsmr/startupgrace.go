@@ -0,0 +1,106 @@
+package genericsmr
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/glycerine/qlease/qlease"
+)
+
+// A replica that may be restarting (any replica without a stable store, as
+// it cannot tell, or one whose store has records) starts its lease in a
+// startup grace period. Its peers may still hold leases it promised before
+// the restart, which it does not know of (or only knows of up to the
+// recorded horizon, see leasewal.go), and may still count promises it was
+// sent before. So during the grace period:
+//
+//   - it serves no local reads: ReadLocallyUntil stays 0, whatever promises
+//     arrive;
+//   - writes must reach every possible grantee: WriteQuorumSafe is false, even
+//     for a lease this replica never promised in this process, and
+//     WriteInQuorumUntil is kept at least until the end of the period;
+//   - its first promise to each peer is preceded by a guard, as to a peer
+//     that has come back (see RenewQLease).
+//
+// The period ends once both every lease of the previous process has
+// certainly expired (a guard and a lease duration after the start, or the
+// recorded horizon, whichever is later) and a majority of the replicas,
+// counting itself, have replied to a guard of this process, so that leases
+// are only ever granted and held again on fresh guard/promise rounds.
+
+type startupGrace struct {
+	until   int64   // no lease of the previous process is in effect after then
+	guarded []int32 // per peer, 1 once it replied to a guard of this process
+	over    int32   // 1 once the period is over
+}
+
+// start the lease ql in a startup grace period, unless this replica is known
+// to be starting for the first time
+func (r *Replica) beginStartupGrace(ql *qlease.Lease) {
+	if r.Durable && r.Recovered == nil {
+		return
+	}
+	g := &startupGrace{
+		until:   r.Now() + ql.Guard + ql.Duration,
+		guarded: make([]int32, r.N),
+	}
+	if r.Recovered != nil && g.until < r.Recovered.PromisedUntil {
+		g.until = r.Recovered.PromisedUntil
+	}
+	atomic.StoreInt64(&ql.ReadLocallyUntil, 0)
+	if ql.WriteInQuorumUntil < g.until {
+		ql.WriteInQuorumUntil = g.until
+	}
+	r.publishWriteHorizon(ql)
+	for q := range r.leaseRejoined {
+		atomic.StoreInt32(&r.leaseRejoined[q], 1)
+	}
+	r.grace = g
+}
+
+// InStartupGrace reports whether the replica's lease is still in its startup
+// grace period.
+func (r *Replica) InStartupGrace() bool {
+	g := r.grace
+	return g != nil && atomic.LoadInt32(&g.over) == 0
+}
+
+// note that peer q replied to a guard sent by this process
+func (r *Replica) graceGuarded(q int32) {
+	if g := r.grace; g != nil {
+		atomic.StoreInt32(&g.guarded[q], 1)
+	}
+}
+
+// check whether the startup grace period is over at time now, and end it if so
+func (r *Replica) startupGraceOver(now int64) bool {
+	g := r.grace
+	if g == nil || atomic.LoadInt32(&g.over) == 1 {
+		return true
+	}
+	if now < g.until {
+		return false
+	}
+	guarded := 0
+	for q := range g.guarded {
+		if atomic.LoadInt32(&g.guarded[q]) == 1 {
+			guarded++
+		}
+	}
+	if guarded < r.N/2 {
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&g.over, 0, 1) {
+		log.Printf("Replica %d: lease startup grace period over\n", r.Id)
+	}
+	return true
+}
+
+// keep writes in the lease quorum for the rest of the grace period, once
+// WriteInQuorumUntil has been updated
+func (r *Replica) holdWritesInQuorum(ql *qlease.Lease) {
+	if g := r.grace; g != nil && !r.startupGraceOver(r.Now()) && ql.WriteInQuorumUntil < g.until {
+		ql.WriteInQuorumUntil = g.until
+	}
+	r.publishWriteHorizon(ql)
+}
@@ -0,0 +1,150 @@
+package genericsmr
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/state"
+)
+
+// The state lives in memory, and grows with every key written until a small
+// node runs out of it and the replica is killed. With PARAM_MAX_STATE_BYTES
+// set, the replica compares the approximate size of its state (state.Stats)
+// with that limit, and when it reaches it, acts as its StateMemoryPolicy
+// says: while over the limit, it answers the writes its clients propose
+// ERR_NOT_WRITABLE, as in read-only mode (MEM_REJECT_WRITES); and on
+// reaching it, it takes a backup (see backup.go), which spills a snapshot of
+// the state to the backup store, to seed a cluster of larger nodes from
+// (MEM_BACKUP). The callback set with WithStateMemoryLimit is called then
+// too, e.g. to page an operator. The writes proposed at other replicas are
+// still executed, since every replica executes the same commands, so the
+// limit should leave headroom, and be the same at every replica. The
+// replica checks its state every STATE_MEMORY_CHECK_NS, and acts once each
+// time it goes over the limit.
+type StateMemoryPolicy uint32
+
+const (
+	MEM_REJECT_WRITES StateMemoryPolicy = 1 << iota // answer client writes ERR_NOT_WRITABLE while over the limit
+	MEM_BACKUP                                      // take a backup on reaching the limit
+)
+
+var stateMemoryPolicyNames = []string{"reject", "backup"}
+
+func (p StateMemoryPolicy) String() string {
+	var names []string
+	for i, n := range stateMemoryPolicyNames {
+		if p&(1<<i) != 0 {
+			names = append(names, n)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseStateMemoryPolicy parses a comma-separated list of the actions of a
+// policy ("reject" and "backup"), or "none".
+func ParseStateMemoryPolicy(spec string) (StateMemoryPolicy, error) {
+	var p StateMemoryPolicy
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "none" {
+			continue
+		}
+		found := false
+		for i, n := range stateMemoryPolicyNames {
+			if n == name {
+				p |= 1 << i
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown state memory action %q (want reject, backup or none)", name)
+		}
+	}
+	return p, nil
+}
+
+// how often the replica compares the size of its state with the limit
+const STATE_MEMORY_CHECK_NS = 100 * 1e6
+
+// StateMemoryStats are the size of the replica's state, and what the limit
+// on it has done.
+type StateMemoryStats struct {
+	state.Stats
+	Limit          int64  // PARAM_MAX_STATE_BYTES (0 for none)
+	Over           bool   // the state is at the limit or above, as last checked
+	Crossings      uint64 // times the state went over the limit
+	WritesRejected uint64 // client writes answered ERR_NOT_WRITABLE for the limit
+}
+
+type stateMemory struct {
+	over           int32 // 1 while over the limit, as last checked (accessed atomically)
+	crossings      uint64
+	writesRejected uint64
+}
+
+// whether the state is over the limit, at this instant
+func (r *Replica) overStateMemory() bool {
+	limit := r.Param(PARAM_MAX_STATE_BYTES)
+	return limit > 0 && r.State != nil && r.State.Stats().Bytes >= limit
+}
+
+// admitWrite reports whether a client write may be proposed, as far as the
+// size of the state goes.
+func (r *Replica) admitWrite() bool {
+	if r.cfg.StateMemory&MEM_REJECT_WRITES == 0 || !r.overStateMemory() {
+		return true
+	}
+	atomic.AddUint64(&r.stateMemory.writesRejected, 1)
+	return false
+}
+
+// StateMemoryStats returns the size of the replica's state, and what the
+// limit on it has done.
+func (r *Replica) StateMemoryStats() StateMemoryStats {
+	sm := r.stateMemory
+	st := StateMemoryStats{
+		Limit:          r.Param(PARAM_MAX_STATE_BYTES),
+		Over:           atomic.LoadInt32(&sm.over) == 1,
+		Crossings:      atomic.LoadUint64(&sm.crossings),
+		WritesRejected: atomic.LoadUint64(&sm.writesRejected),
+	}
+	if r.State != nil {
+		st.Stats = r.State.Stats()
+	}
+	return st
+}
+
+// act on the state going over the limit, every time it does
+func (r *Replica) watchStateMemory() {
+	sm := r.stateMemory
+	for !r.Shutdown {
+		time.Sleep(STATE_MEMORY_CHECK_NS)
+		if !r.overStateMemory() {
+			atomic.StoreInt32(&sm.over, 0)
+			continue
+		}
+		if !atomic.CompareAndSwapInt32(&sm.over, 0, 1) {
+			continue
+		}
+		atomic.AddUint64(&sm.crossings, 1)
+		st := r.State.Stats()
+		log.Printf("Replica %d: state of %d keys takes about %d bytes, over the limit of %d (%v)\n",
+			r.Id, st.Keys, st.Bytes, r.Param(PARAM_MAX_STATE_BYTES), r.cfg.StateMemory)
+		if r.cfg.StateMemory&MEM_BACKUP != 0 {
+			if name, _, err := r.TakeBackup(); err != nil {
+				log.Printf("Replica %d: cannot back the state up at the memory limit: %v\n", r.Id, err)
+			} else {
+				log.Printf("Replica %d: backed the state up at the memory limit, to %s\n", r.Id, name)
+			}
+		}
+		if r.cfg.OnStateMemory != nil {
+			r.cfg.OnStateMemory(st)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package genericsmr
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// Status returns a snapshot of the replica's view of its peers, the depths of
+// its input channels and the bounds of its current lease. Values are read
+// without stopping the replica, so they may be slightly inconsistent.
+func (r *Replica) Status() *genericsmrproto.StatusReply {
+	st := &genericsmrproto.StatusReply{
+		ReplicaId: r.Id,
+		GroupId:   r.GroupId,
+		Peers:     make([]genericsmrproto.PeerStatus, 0, r.N-1),
+		LeaseInst: -1,
+		Leader:    -1,
+		NowNs:     r.Now(),
+		Zone:      r.Topology().Zone(r.Id),
+		Region:    r.Topology().Region(r.Id),
+	}
+	if ll, ok := r.Log.(LeaderLog); ok {
+		st.Leader, _ = ll.Leader()
+	}
+	for i := int32(0); i < int32(r.N); i++ {
+		if i == r.Id {
+			continue
+		}
+		ps := genericsmrproto.PeerStatus{
+			ReplicaId:   i,
+			Alive:       FALSE,
+			EwmaLatency: r.Beacons.Latency(i),
+			LastReplyNs: r.LastReplyReceivedTimestamp[i],
+			LastHeardNs: r.Beacons.LastHeard(i),
+		}
+		if r.PeerAlive(i) {
+			ps.Alive = TRUE
+		}
+		if clock := r.PeerClock(i); clock.Known() {
+			ps.ClockOffset, ps.ClockError = clock.OffsetNs, clock.ErrorNs
+		}
+		st.Peers = append(st.Peers, ps)
+	}
+
+	st.Chans = append(st.Chans,
+		genericsmrproto.ChanDepth{Name: "propose", Len: int32(len(r.ProposeChan)), Cap: int32(cap(r.ProposeChan))},
+		genericsmrproto.ChanDepth{Name: "beacon", Len: int32(len(r.BeaconChan)), Cap: int32(cap(r.BeaconChan))},
+		genericsmrproto.ChanDepth{Name: "client-lease", Len: int32(len(r.ClientLeaseChan)), Cap: int32(cap(r.ClientLeaseChan))})
+	if r.priorities != nil {
+		st.Chans = append(st.Chans, r.priorities.depths()...)
+	}
+	named := map[chan fastrpc.Serializable]string{
+		r.QLPromiseChan:      "qlease-promise",
+		r.QLPromiseReplyChan: "qlease-promise-reply",
+		r.QLGuardChan:        "qlease-guard",
+		r.QLGuardReplyChan:   "qlease-guard-reply",
+		r.QLRegionLeaseChan:  "qlease-region-lease",
+		r.RequestEntriesChan: "request-entries",
+		r.EntriesChan:        "entries",
+	}
+	rpcs := make([]genericsmrproto.ChanDepth, 0, len(r.rpcTable))
+	for code, pair := range r.rpcTable {
+		name, known := named[pair.Chan]
+		if !known {
+			// the protocol's own RPCs are only known by code
+			name = fmt.Sprintf("rpc-%d", code)
+		}
+		l, c := pair.queueDepth()
+		rpcs = append(rpcs, genericsmrproto.ChanDepth{Name: name, Len: int32(l), Cap: int32(c), Dropped: int64(atomic.LoadUint64(&pair.dropped))})
+	}
+	sort.Slice(rpcs, func(i, j int) bool { return rpcs[i].Name < rpcs[j].Name })
+	st.Chans = append(st.Chans, rpcs...)
+
+	if ql := r.QLease; ql != nil {
+		st.LeaseInst = atomic.LoadInt32(&ql.PromisedToMeInst)
+		st.ReadLocallyUntil = atomic.LoadInt64(&ql.ReadLocallyUntil)
+		st.WriteInQuorumUntil = ql.WriteInQuorumUntil
+	}
+	st.Traffic = r.traffic()
+	st.CommitBacklog = r.CommitBacklog()
+	st.BacklogRejected = atomic.LoadUint64(&r.admission.rejected)
+	st.BacklogPaused = atomic.LoadUint64(&r.admission.paused)
+	st.DeadlineDropped = atomic.LoadUint64(&r.deadlineDropped)
+	st.Reads, st.ReadsByPrefix = r.ReadStats()
+	if shift := r.readStats.shift; shift >= 0 {
+		st.ReadPrefixShift = uint8(shift)
+	}
+	mem := r.StateMemoryStats()
+	st.StateKeys, st.StateBytes, st.MaxStateBytes, st.StateRejected = mem.Keys, mem.Bytes, mem.Limit, mem.WritesRejected
+	st.Latencies = r.LatencyStats()
+	return st
+}
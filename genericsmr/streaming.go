@@ -0,0 +1,83 @@
+package genericsmr
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/glycerine/qlease/fastrpc"
+)
+
+// SendMsgStreamed sends a message that may be large (e.g., a batch of log
+// entries or a snapshot). The message is marshaled before taking the peer's
+// write lock, and if it is larger than fastrpc.CHUNK_SIZE it goes out as a
+// stream of chunks, taking the lock once per chunk, so that it does not stall
+// the other messages to the peer. The receiver reassembles the chunks and
+// delivers the message on the channel registered for code, as usual. As a
+// background transfer, the message (each chunk) waits for the peer's egress
+// budget (see egress.go).
+func (r *Replica) SendMsgStreamed(peerId int32, code uint16, msg fastrpc.Serializable) error {
+	var buf bytes.Buffer
+	if err := r.sendCodecs[peerId].Encode(&buf, msg); err != nil {
+		return r.sendFailed(peerId, code, encodeErr(err))
+	}
+	if buf.Len() <= fastrpc.CHUNK_SIZE {
+		r.throttleEgress(peerId)
+		return r.sendMarshaled(peerId, code, buf.Bytes())
+	}
+	stream := atomic.AddUint32(&r.streamId, 1)
+	for _, c := range fastrpc.SplitChunks(stream, code, buf.Bytes()) {
+		if err := r.SendBackgroundMsg(peerId, r.chunkRPC, &c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send an already marshaled message
+func (r *Replica) sendMarshaled(peerId int32, code uint16, data []byte) (retErr error) {
+	defer func() {
+		if err := recover(); err != nil {
+			retErr = r.sendPanicked(peerId, code, err)
+		}
+	}()
+	if !r.PeerAlive(peerId) {
+		return r.sendFailed(peerId, code, ErrPeerNotAlive)
+	}
+	if err := r.checkCode(peerId, code); err != nil {
+		return r.sendFailed(peerId, code, err)
+	}
+	r.PeerWLocks[peerId].Lock()
+	defer r.PeerWLocks[peerId].Unlock()
+	w := r.PeerWriters[peerId]
+	r.writePeerPrefix(w, peerId)
+	r.writeCode(w, peerId, code)
+	if _, err := r.peerEncoder(peerId).Write(data); err != nil {
+		return r.sendWritten(peerId, code, err)
+	}
+	return r.sendWritten(peerId, code, w.Flush())
+}
+
+// receive a chunk from a peer, and dispatch the message it completes, if any
+func (r *Replica) handleChunk(rid int, reader *bufio.Reader, deliver bool) error {
+	c := new(fastrpc.Chunk)
+	if err := c.Unmarshal(reader); err != nil || !deliver {
+		return err
+	}
+	data, err := r.reassemblers[rid].Add(c)
+	if err != nil || data == nil {
+		return err
+	}
+	rpair, present := r.rpcTable[c.Code]
+	if !present {
+		return fmt.Errorf("streamed message with unknown type %d", c.Code)
+	}
+	obj := rpair.Obj.New()
+	if err = r.recvCodecs[rid].Decode(bytes.NewReader(data), obj); err != nil {
+		return err
+	}
+	r.trace(TRACE_PEER_MSG, int64(rid), c.Code, obj)
+	r.deliverFromPeer(rid, func() { rpair.dispatch(obj) })
+	return nil
+}
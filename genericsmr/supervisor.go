@@ -0,0 +1,156 @@
+package genericsmr
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// The replica's goroutines (peer and client listeners, the loops serving
+// quorum reads, forwards and snapshots, the workers of typed RPCs) run under
+// a Supervisor: a panic in one of them is recovered instead of crashing the
+// process, and it and any error the goroutine ends with are reported on
+// Errors(), for the embedding application to log, alert on, or shut the
+// replica down. Loops that keep no state worth losing are restarted after a
+// panic, with a growing delay; protocols should start their own background
+// loops with Tasks.Go too.
+
+// RestartPolicy says what a Supervisor does when a task ends.
+type RestartPolicy uint8
+
+const (
+	RESTART_NEVER      RestartPolicy = iota // report the failure, if any, and let the task end
+	RESTART_ON_PANIC                        // restart the task if it panicked
+	RESTART_ON_FAILURE                      // restart the task if it panicked or returned an error
+)
+
+// delays before restarting a task that keeps failing
+const (
+	RESTART_MIN_DELAY = 10 * time.Millisecond
+	RESTART_MAX_DELAY = 5 * time.Second
+)
+
+const TASK_ERRORS_CHAN_SIZE = 100
+
+// A TaskError is the failure of a supervised task.
+type TaskError struct {
+	Task      string
+	Err       error
+	Panic     bool   // Err is a recovered panic
+	Stack     []byte // where the task panicked
+	Restarted bool   // the task is restarted
+}
+
+func (e *TaskError) Error() string {
+	if e.Panic {
+		return fmt.Sprintf("%s panicked: %v", e.Task, e.Err)
+	}
+	return fmt.Sprintf("%s failed: %v", e.Task, e.Err)
+}
+
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
+// A Supervisor runs tasks in goroutines, like an errgroup, recovering their
+// panics and restarting them according to their RestartPolicy.
+type Supervisor struct {
+	stopped func() bool // once true, tasks are no longer restarted
+	errors  chan *TaskError
+	wg      sync.WaitGroup
+	lock    sync.Mutex
+	first   error
+}
+
+// NewSupervisor returns a supervisor that restarts tasks until stopped
+// returns true (nil to restart them for as long as their policies say).
+func NewSupervisor(stopped func() bool) *Supervisor {
+	return &Supervisor{stopped: stopped, errors: make(chan *TaskError, TASK_ERRORS_CHAN_SIZE)}
+}
+
+// Go runs f in a new goroutine, under the given restart policy; name
+// identifies the task in its errors.
+func (s *Supervisor) Go(name string, policy RestartPolicy, f func() error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		delay := RESTART_MIN_DELAY
+		for {
+			start := time.Now()
+			e := run(name, f)
+			if e == nil {
+				return
+			}
+			e.Restarted = (policy == RESTART_ON_FAILURE || (policy == RESTART_ON_PANIC && e.Panic)) &&
+				(s.stopped == nil || !s.stopped())
+			s.report(e)
+			if !e.Restarted {
+				return
+			}
+			if time.Since(start) > RESTART_MAX_DELAY {
+				delay = RESTART_MIN_DELAY
+			}
+			time.Sleep(delay)
+			if delay *= 2; delay > RESTART_MAX_DELAY {
+				delay = RESTART_MAX_DELAY
+			}
+		}
+	}()
+}
+
+// run f once, turning a panic into a TaskError
+func run(name string, f func() error) (e *TaskError) {
+	defer func() {
+		if p := recover(); p != nil {
+			err, ok := p.(error)
+			if !ok {
+				err = fmt.Errorf("%v", p)
+			}
+			e = &TaskError{Task: name, Err: err, Panic: true, Stack: debug.Stack()}
+		}
+	}()
+	if err := f(); err != nil {
+		return &TaskError{Task: name, Err: err}
+	}
+	return nil
+}
+
+func (s *Supervisor) report(e *TaskError) {
+	log.Println(e)
+	if e.Panic {
+		log.Printf("%s", e.Stack)
+	}
+	s.lock.Lock()
+	if s.first == nil {
+		s.first = e
+	}
+	s.lock.Unlock()
+	select {
+	case s.errors <- e:
+	default:
+		// nobody is watching: the failure is logged
+	}
+}
+
+// Errors returns the channel on which task failures are reported. Failures
+// are dropped (but still logged) while it is full.
+func (s *Supervisor) Errors() <-chan *TaskError {
+	return s.errors
+}
+
+// Wait waits until every task has ended for good, and returns the first
+// failure reported, if any.
+func (s *Supervisor) Wait() error {
+	s.wg.Wait()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.first
+}
+
+// Errors returns the channel on which the failures of the replica's
+// goroutines are reported (see Supervisor).
+func (r *Replica) Errors() <-chan *TaskError {
+	return r.Tasks.Errors()
+}
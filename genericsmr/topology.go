@@ -0,0 +1,106 @@
+package genericsmr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Topology labels the replicas of a cluster with where they run: a zone
+// (e.g., an availability zone, or a rack) within a region. Protocols use it
+// to spread write quorums over zones (see SpreadOverZones), and to grant
+// read leases to replicas in the regions that read a key, so that lease
+// reads stay region-local; the leases themselves can be renewed region by
+// region (see regionlease.go).
+type Topology struct {
+	Zones   []string // by replica ID ("" if unknown)
+	Regions []string // by replica ID ("" if unknown)
+
+	// ZoneSafe makes SpreadOverZones extend write quorums that would sit in
+	// a single zone, so that every write survives the outage of a zone.
+	ZoneSafe bool
+
+	// HierarchicalLeases has the replicas of each region renew their
+	// leases through the region's delegate, which alone exchanges promises
+	// with the other regions.
+	HierarchicalLeases bool
+}
+
+// ParseTopology builds a topology from comma-separated lists of the zones and
+// regions of the replicas, by replica ID (either may be empty).
+func ParseTopology(n int, zones string, regions string, zoneSafe bool) (*Topology, error) {
+	t := &Topology{ZoneSafe: zoneSafe}
+	var err error
+	if t.Zones, err = parseLabels(n, zones, "zones"); err != nil {
+		return nil, err
+	}
+	if t.Regions, err = parseLabels(n, regions, "regions"); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func parseLabels(n int, list string, what string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	labels := strings.Split(list, ",")
+	if len(labels) != n {
+		return nil, fmt.Errorf("%d %s for %d replicas", len(labels), what, n)
+	}
+	for i := range labels {
+		labels[i] = strings.TrimSpace(labels[i])
+	}
+	return labels, nil
+}
+
+func label(labels []string, id int32) string {
+	if id < 0 || int(id) >= len(labels) {
+		return ""
+	}
+	return labels[id]
+}
+
+// Zone returns the zone of a replica ("" if unknown).
+func (t *Topology) Zone(id int32) string {
+	if t == nil {
+		return ""
+	}
+	return label(t.Zones, id)
+}
+
+// Region returns the region of a replica ("" if unknown).
+func (t *Topology) Region(id int32) string {
+	if t == nil {
+		return ""
+	}
+	return label(t.Regions, id)
+}
+
+// Topology returns the replica's topology (nil if it was not given one).
+func (r *Replica) Topology() *Topology {
+	return r.cfg.Topology
+}
+
+// SpreadOverZones returns q, the peers that a write must reach besides this
+// replica, extended with the first live peer in PreferredPeerOrder from
+// another zone if the topology is ZoneSafe and q and this replica all sit in
+// one zone, so that the write survives the loss of that zone. It returns q
+// unchanged if no such peer is available.
+func (r *Replica) SpreadOverZones(q []int32) []int32 {
+	t := r.cfg.Topology
+	if t == nil || !t.ZoneSafe || len(t.Zones) == 0 {
+		return q
+	}
+	zone := t.Zone(r.Id)
+	for _, id := range q {
+		if t.Zone(id) != zone {
+			return q
+		}
+	}
+	for _, id := range r.PreferredPeerOrder {
+		if id != r.Id && r.PeerAlive(id) && t.Zone(id) != zone {
+			return append(q[:len(q):len(q)], id)
+		}
+	}
+	return q
+}
@@ -0,0 +1,277 @@
+package genericsmr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/genericsmrproto"
+)
+
+// A replica can record every message that reaches its protocol from peers
+// and clients (see WithTrace), with the time it arrived, so that an incident
+// (e.g., a lease violation) can be reproduced offline: a replica built with
+// WithReplay, which neither connects to peers nor accepts clients, is fed the
+// recorded messages by Replay, in order, one at a time, with its lease clock
+// set to the time each message arrived. Its peers look connected to it, but
+// what it sends them is dropped. The protocol's own timers (e.g., the lease
+// renewal clock) still run in real time, and beacon latencies are not
+// reproduced.
+//
+// A trace is a sequence of records: kind (1 byte), arrival time in ns (8),
+// source (8: the peer's ID, or the client connection's), RPC code (2),
+// payload length (4), all little-endian, and the marshaled message.
+
+const (
+	TRACE_PEER_MSG     uint8 = iota // a protocol message, by RPC code
+	TRACE_BEACON                    // a genericsmrproto.Beacon
+	TRACE_BEACON_REPLY              // a genericsmrproto.BeaconReply
+	TRACE_PROPOSE                   // a client's genericsmrproto.Propose
+	TRACE_CLIENT_LEASE              // a client's genericsmrproto.ClientLease
+)
+
+const TRACE_HEADER_SIZE = 23
+
+// how often the trace is flushed
+const TRACE_FLUSH_INTERVAL = 100 * time.Millisecond
+
+type TraceRecord struct {
+	Kind    uint8
+	TimeNs  int64
+	Source  int64
+	Code    uint16
+	Payload []byte
+}
+
+// ReadTraceRecord reads the next record of a trace; it returns io.EOF at the
+// end of the trace, and io.ErrUnexpectedEOF if the last record is torn.
+func ReadTraceRecord(rd io.Reader) (*TraceRecord, error) {
+	var hdr [TRACE_HEADER_SIZE]byte
+	if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+		return nil, err
+	}
+	rec := &TraceRecord{
+		Kind:   hdr[0],
+		TimeNs: int64(binary.LittleEndian.Uint64(hdr[1:9])),
+		Source: int64(binary.LittleEndian.Uint64(hdr[9:17])),
+		Code:   binary.LittleEndian.Uint16(hdr[17:19]),
+	}
+	rec.Payload = make([]byte, binary.LittleEndian.Uint32(hdr[19:23]))
+	if _, err := io.ReadFull(rd, rec.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return rec, nil
+}
+
+type tracer struct {
+	lock *sync.Mutex
+	w    *bufio.Writer
+	buf  bytes.Buffer
+}
+
+func newTracer(w io.Writer) *tracer {
+	t := &tracer{lock: new(sync.Mutex), w: bufio.NewWriter(w)}
+	go func() {
+		for {
+			time.Sleep(TRACE_FLUSH_INTERVAL)
+			t.lock.Lock()
+			t.w.Flush()
+			t.lock.Unlock()
+		}
+	}()
+	return t
+}
+
+// what the trace records of a message
+type marshaler interface {
+	Marshal(io.Writer)
+}
+
+// record a message reaching the protocol, if tracing
+func (r *Replica) trace(kind uint8, source int64, code uint16, msg marshaler) {
+	t := r.tracer
+	if t == nil {
+		return
+	}
+	now := r.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.buf.Reset()
+	msg.Marshal(&t.buf)
+	var hdr [TRACE_HEADER_SIZE]byte
+	hdr[0] = kind
+	binary.LittleEndian.PutUint64(hdr[1:9], uint64(now))
+	binary.LittleEndian.PutUint64(hdr[9:17], uint64(source))
+	binary.LittleEndian.PutUint16(hdr[17:19], code)
+	binary.LittleEndian.PutUint32(hdr[19:23], uint32(t.buf.Len()))
+	t.w.Write(hdr[:])
+	t.w.Write(t.buf.Bytes())
+}
+
+// FlushTrace writes out the records still buffered, if tracing.
+func (r *Replica) FlushTrace() error {
+	t := r.tracer
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.w.Flush()
+}
+
+// A VirtualClock is a clock that only moves when set, for replays.
+type VirtualClock struct {
+	ns int64
+}
+
+func NewVirtualClock(ns int64) *VirtualClock {
+	return &VirtualClock{ns: ns}
+}
+
+// Now returns the time in ns.
+func (c *VirtualClock) Now() int64 {
+	return atomic.LoadInt64(&c.ns)
+}
+
+func (c *VirtualClock) Set(ns int64) {
+	atomic.StoreInt64(&c.ns, ns)
+}
+
+// Now returns the time in ns that the replica reckons leases in: the wall
+// clock, unless the replica was configured otherwise (e.g., for a replay).
+func (r *Replica) Now() int64 {
+	if r.cfg.WallClock != nil {
+		return r.cfg.WallClock()
+	}
+	return time.Now().UnixNano()
+}
+
+// what a replaying replica is connected to: everything it sends is dropped
+type discardConn struct{}
+
+func (discardConn) Read(b []byte) (int, error)         { return 0, io.EOF }
+func (discardConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (discardConn) Close() error                       { return nil }
+func (discardConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (discardConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (discardConn) SetDeadline(t time.Time) error      { return nil }
+func (discardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (discardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// make the peers of a replaying replica look connected, so that the protocol
+// behaves as it did when the trace was recorded
+func (r *Replica) connectReplayPeers() {
+	for q := 0; q < r.N; q++ {
+		if int32(q) == r.Id {
+			continue
+		}
+		r.Peers[q] = discardConn{}
+		r.PeerWriters[q] = bufio.NewWriter(r.Peers[q])
+		r.PeerStates.Set(int32(q), PEER_ALIVE)
+	}
+}
+
+// Replay feeds the messages of a trace to a replica built with WithReplay,
+// in order, waiting for the protocol to take each one before moving the
+// clock to the next. It returns the number of records replayed.
+func (r *Replica) Replay(rd io.Reader) (int, error) {
+	if r.cfg.Replay == nil {
+		return 0, fmt.Errorf("replica %d is not set up for replays", r.Id)
+	}
+	br := bufio.NewReader(rd)
+	lock := new(sync.Mutex)
+	clients := make(map[int64]*bufio.Writer) // the replies are dropped
+	client := func(id int64) *bufio.Writer {
+		if clients[id] == nil {
+			clients[id] = bufio.NewWriter(ioutil.Discard)
+		}
+		return clients[id]
+	}
+	n := 0
+	for {
+		rec, err := ReadTraceRecord(br)
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		r.cfg.Replay.Set(rec.TimeNs)
+		payload := bytes.NewReader(rec.Payload)
+		switch rec.Kind {
+		case TRACE_PEER_MSG:
+			rpair, present := r.rpcTable[rec.Code]
+			if !present {
+				return n, fmt.Errorf("record %d: unknown RPC code %d", n, rec.Code)
+			}
+			obj := rpair.Obj.New()
+			if err = obj.Unmarshal(payload); err != nil {
+				break
+			}
+			rpair.put(obj)
+			waitDrained(func() int {
+				l, _ := rpair.queueDepth()
+				return l
+			})
+
+		case TRACE_BEACON:
+			var gbeacon genericsmrproto.Beacon
+			if err = gbeacon.Unmarshal(payload); err != nil {
+				break
+			}
+			beacon := &Beacon{int32(rec.Source), gbeacon.Timestamp}
+			if !r.Beacons.handleBeacon(beacon) {
+				r.BeaconChan <- beacon
+				waitDrained(func() int { return len(r.BeaconChan) })
+			}
+
+		case TRACE_BEACON_REPLY:
+			var gbeaconReply genericsmrproto.BeaconReply
+			if err = gbeaconReply.Unmarshal(payload); err != nil {
+				break
+			}
+			r.Beacons.handleBeaconReply(int32(rec.Source), gbeaconReply.Timestamp)
+
+		case TRACE_PROPOSE:
+			prop := new(genericsmrproto.Propose)
+			if err = prop.Unmarshal(payload); err != nil {
+				break
+			}
+			r.ProposeChan <- &Propose{prop, -1, -1, client(rec.Source), lock, nil, 0, 0, 0, r.Clock.Nanos(), 0}
+			waitDrained(func() int { return len(r.ProposeChan) })
+
+		case TRACE_CLIENT_LEASE:
+			cl := new(genericsmrproto.ClientLease)
+			if err = cl.Unmarshal(payload); err != nil {
+				break
+			}
+			r.ClientLeaseChan <- &ClientLeaseRequest{cl, client(rec.Source), lock, fastrpc.Binary}
+			waitDrained(func() int { return len(r.ClientLeaseChan) })
+
+		default:
+			err = fmt.Errorf("unknown record kind %d", rec.Kind)
+		}
+		if err != nil {
+			return n, fmt.Errorf("record %d: %v", n, err)
+		}
+		n++
+	}
+}
+
+// wait until the protocol has taken everything off a queue
+func waitDrained(queued func() int) {
+	for queued() > 0 {
+		runtime.Gosched()
+	}
+}
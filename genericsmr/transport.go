@@ -0,0 +1,51 @@
+package genericsmr
+
+import (
+	"net"
+)
+
+// A Transport makes the connections between replicas: the replica dials its
+// peers and listens on its port through it (clients arrive on the same
+// listener). The default is plain TCP.
+//
+// On a TCP connection, a lost packet of bulk data holds back the lease
+// renewals queued behind it (head-of-line blocking). A LaneTransport, such as
+// the QUIC transport of package quictransport, avoids that by carrying the
+// control messages to a peer on a lane of their own (see ctllane.go). With
+// peer sessions (see sessions.go), the peermux streams keep bulk transfers
+// from holding back control messages, but still share one connection.
+type Transport interface {
+	Dial(addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+// A LaneTransport opens more than one lane per connection to a peer, e.g.
+// one stream each of a QUIC connection, that do not hold each other back.
+// The replica that dialed a connection (returned by Dial) opens a lane with
+// OpenLane, which the replica that accepted it (from a listener returned by
+// Listen) waits for with AcceptLane; a lane closes with its connection.
+type LaneTransport interface {
+	Transport
+	OpenLane(conn net.Conn) (net.Conn, error)
+	AcceptLane(conn net.Conn) (net.Conn, error)
+}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// TCP is the default transport.
+var TCP Transport = tcpTransport{}
+
+func (r *Replica) transport() Transport {
+	if r.cfg.Transport != nil {
+		return r.cfg.Transport
+	}
+	return TCP
+}
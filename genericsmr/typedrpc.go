@@ -0,0 +1,80 @@
+package genericsmr
+
+import (
+	"fmt"
+
+	"github.com/glycerine/qlease/fastrpc"
+)
+
+// RegisterRPC registers a protocol message like Replica.RegisterRPC, but
+// delivers the messages received on a channel of their own type, so that
+// the protocol needs no type assertion (nor risks a panic on a wrong one)
+// to handle them. It returns the code to send the messages with.
+func RegisterRPC[T fastrpc.Serializable](r *Replica, msgObj T, notify chan T) uint16 {
+	code := r.rpcCode
+	r.rpcCode = nextRPCCode(r.rpcCode)
+	pair := &RPCPair{Obj: msgObj}
+	setChanOps(pair, notify)
+	r.rpcTable[code] = pair
+	return code
+}
+
+// RegisterRPCHandler registers a protocol message whose messages are handed
+// straight to handler, instead of going through a channel to the protocol's
+// event loop, which saves a channel hop on latency-critical messages. With
+// workers <= 0, handler runs on the goroutine reading the sender's
+// connection, in order, and nothing more is read from that peer until it
+// returns, so it must not block. With workers > 0, the messages are queued
+// (up to CHAN_BUFFER_SIZE of them) for that many goroutines, which handle
+// them concurrently and in no particular order. Either way, handler runs
+// concurrently with the event loop, so whatever state it shares with the
+// protocol must be synchronized.
+func RegisterRPCHandler[T fastrpc.Serializable](r *Replica, msgObj T, handler func(T), workers int) uint16 {
+	code := r.rpcCode
+	r.rpcCode = nextRPCCode(r.rpcCode)
+	pair := &RPCPair{Obj: msgObj}
+	if workers <= 0 {
+		pair.put = func(obj fastrpc.Serializable) { handler(obj.(T)) }
+		pair.offer = func(obj fastrpc.Serializable) bool {
+			handler(obj.(T))
+			return true
+		}
+		pair.evict = func() bool { return false }
+		pair.depth = func() (int, int) { return 0, 0 }
+	} else {
+		queue := make(chan T, CHAN_BUFFER_SIZE)
+		for i := 0; i < workers; i++ {
+			r.Tasks.Go(fmt.Sprintf("handler of RPC %d", code), RESTART_ON_PANIC, func() error {
+				for msg := range queue {
+					handler(msg)
+				}
+				return nil
+			})
+		}
+		setChanOps(pair, queue)
+	}
+	r.rpcTable[code] = pair
+	return code
+}
+
+// deliver the messages of pair on c
+func setChanOps[T fastrpc.Serializable](pair *RPCPair, c chan T) {
+	pair.put = func(obj fastrpc.Serializable) { c <- obj.(T) }
+	pair.offer = func(obj fastrpc.Serializable) bool {
+		select {
+		case c <- obj.(T):
+			return true
+		default:
+			return false
+		}
+	}
+	pair.evict = func() bool {
+		select {
+		case <-c:
+			return true
+		default:
+			return false
+		}
+	}
+	pair.depth = func() (int, int) { return len(c), cap(c) }
+}
@@ -0,0 +1,106 @@
+package genericsmr
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/glycerine/qlease/state"
+)
+
+// UpdatingKeys tracks the keys with updates in flight, i.e., for which the
+// replica has (pre-)accepted a command that it has not executed yet. Local
+// reads of such keys must wait, since the update may already be committed.
+// Every mark is tagged with the instance of the command, and a key may be
+// marked several times, by the same or different instances; it stays
+// updating until every mark has been cleared. It is safe for concurrent use.
+type UpdatingKeys struct {
+	lock *sync.Mutex
+	keys map[state.Key]map[int32]int // key -> instance -> number of marks
+}
+
+func NewUpdatingKeys() *UpdatingKeys {
+	return &UpdatingKeys{new(sync.Mutex), make(map[state.Key]map[int32]int, 10000)}
+}
+
+// Mark records an update in flight for the key of every command, on behalf of instance inst.
+func (u *UpdatingKeys) Mark(inst int32, cmds []state.Command) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for i := range cmds {
+		insts, present := u.keys[cmds[i].K]
+		if !present {
+			insts = make(map[int32]int, 1)
+			u.keys[cmds[i].K] = insts
+		}
+		insts[inst]++
+	}
+}
+
+// Clear removes one mark of instance inst from the key of every command.
+// Marks that were never made are ignored.
+func (u *UpdatingKeys) Clear(inst int32, cmds []state.Command) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for i := range cmds {
+		insts, present := u.keys[cmds[i].K]
+		if !present || insts[inst] == 0 {
+			continue
+		}
+		if insts[inst]--; insts[inst] == 0 {
+			delete(insts, inst)
+		}
+		if len(insts) == 0 {
+			delete(u.keys, cmds[i].K)
+		}
+	}
+}
+
+func (u *UpdatingKeys) IsUpdating(k state.Key) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return len(u.keys[k]) > 0
+}
+
+// Count returns the number of marks on k.
+func (u *UpdatingKeys) Count(k state.Key) int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	n := 0
+	for _, c := range u.keys[k] {
+		n += c
+	}
+	return n
+}
+
+// Instances returns the instances with updates to k in flight, in increasing order.
+func (u *UpdatingKeys) Instances(k state.Key) []int32 {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	insts := make([]int32, 0, len(u.keys[k]))
+	for inst := range u.keys[k] {
+		insts = append(insts, inst)
+	}
+	sort.Slice(insts, func(i, j int) bool { return insts[i] < insts[j] })
+	return insts
+}
+
+// Len returns the number of keys being updated.
+func (u *UpdatingKeys) Len() int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return len(u.keys)
+}
+
+// MarkUpdating, ClearUpdating and IsUpdating operate on the replica's Updating keys.
+
+func (r *Replica) MarkUpdating(inst int32, cmds []state.Command) {
+	r.Updating.Mark(inst, cmds)
+}
+
+func (r *Replica) ClearUpdating(inst int32, cmds []state.Command) {
+	r.Updating.Clear(inst, cmds)
+}
+
+func (r *Replica) IsUpdating(k state.Key) bool {
+	return r.Updating.IsUpdating(k)
+}
@@ -0,0 +1,63 @@
+package genericsmr
+
+import (
+	"net"
+	"sync"
+
+	"github.com/glycerine/qlease/fastrpc"
+)
+
+// payload buffers larger than this are not kept for reuse
+const MAX_POOLED_FRAME_SIZE = 1024 * 1024
+
+type frame struct {
+	hdr     [15]byte // group prefix or sequence number (if any) and message code
+	payload []byte
+	vec     [2][]byte
+	bufs    net.Buffers
+}
+
+var framePool = sync.Pool{New: func() interface{} { return new(frame) }}
+
+// write a message to the peer's connection with a single vectored write of
+// its header and payload, bypassing the peer's bufio.Writer. The caller must
+// hold the peer's write lock, and the writer must not have buffered data.
+func (r *Replica) writeVectored(peerId int32, code uint16, msg fastrpc.SizedMarshaler) error {
+	f := framePool.Get().(*frame)
+	defer func() {
+		if cap(f.payload) > MAX_POOLED_FRAME_SIZE {
+			f.payload = nil
+		}
+		framePool.Put(f)
+	}()
+	hdr := r.appendPeerPrefix(f.hdr[:0], peerId)
+	hdr = appendCode(hdr, code)
+	size := msg.Size()
+	if cap(f.payload) < size {
+		f.payload = make([]byte, size)
+	}
+	f.vec[0] = hdr
+	f.vec[1] = f.payload[:msg.MarshalTo(f.payload[:size])]
+	f.bufs = f.vec[:]
+	_, err := writeBuffers(r.Peers[peerId], &f.bufs)
+	r.peerCounters[peerId].sentMsg(code)
+	return err
+}
+
+// write and flush a message to the peer, vectored if possible; the caller must
+// hold the peer's write lock
+func (r *Replica) writeMsg(peerId int32, code uint16, msg fastrpc.Serializable) error {
+	if err := r.checkCode(peerId, code); err != nil {
+		return err
+	}
+	w := r.PeerWriters[peerId]
+	if sm, ok := msg.(fastrpc.SizedMarshaler); ok && w.Buffered() == 0 && r.sendCodecs[peerId] == fastrpc.Binary {
+		return r.writeVectored(peerId, code, sm)
+	}
+	r.writePeerPrefix(w, peerId)
+	r.writeCode(w, peerId, code)
+	if err := r.sendCodecs[peerId].Encode(r.peerEncoder(peerId), msg); err != nil {
+		return encodeErr(err)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,68 @@
+package genericsmr
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/glycerine/qlease/qlease"
+)
+
+// WriteQuorumSafe reports whether writes may be committed by any majority.
+// While a lease this replica promised may still be in effect (i.e., until
+// WriteInQuorumUntil), writes must instead be acknowledged by every holder of
+// that lease, or the holders could serve stale local reads; and so they must
+// during the lease's startup grace period (see startupgrace.go).
+func (r *Replica) WriteQuorumSafe() bool {
+	ql := r.QLease
+	return ql == nil || (ql.CanWriteOutside() && r.startupGraceOver(r.Now()))
+}
+
+// PromisesExpired reports whether every lease this replica promised, in
+// this process or before a restart, has expired, so that it may promise a
+// new lease configuration. Unlike WriteQuorumSafe, it does not wait for the
+// fresh guards that end the startup grace period: promising the new
+// configuration (EstablishQLease) sends them.
+func (r *Replica) PromisesExpired() bool {
+	ql := r.QLease
+	if ql == nil {
+		return true
+	}
+	if g := r.grace; g != nil && r.Now() < g.until {
+		return false
+	}
+	return ql.CanWriteOutside()
+}
+
+// publish the WriteInQuorumUntil of the replica's lease, which the protocol
+// updates in its event loop, to WaitForWriteQuorumSafe
+func (r *Replica) publishWriteHorizon(ql *qlease.Lease) {
+	if ql == r.QLease || r.QLease == nil {
+		atomic.StoreInt64(&r.writeHorizon, ql.WriteInQuorumUntil)
+	}
+}
+
+// WaitForWriteQuorumSafe blocks until WriteQuorumSafe holds, or until ctx is
+// done, in which case it returns ctx's error. Unlike WriteQuorumSafe, it may
+// be called outside the protocol's event loop. Leases may be renewed while it
+// waits, so the condition is checked again every time the wait runs out.
+func (r *Replica) WaitForWriteQuorumSafe(ctx context.Context) error {
+	for {
+		now := r.Now()
+		wait := time.Duration(atomic.LoadInt64(&r.writeHorizon) - now)
+		if wait <= 0 {
+			if r.startupGraceOver(now) {
+				return nil
+			}
+			// waiting for guard replies
+			wait = 1000 * 1000
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package genericsmrproto
+
+import (
+	"fmt"
+)
+
+var errCodeNames = map[uint8]string{
+	ERR_NONE:         "NONE",
+	ERR_UNAUTHORIZED: "UNAUTHORIZED",
+	ERR_NOT_LEADER:   "NOT_LEADER",
+	ERR_TIMEOUT:      "TIMEOUT",
+	ERR_CONFLICT:     "CONFLICT",
+	ERR_OVERLOADED:   "OVERLOADED",
+	ERR_WRONG_GROUP:  "WRONG_GROUP",
+	ERR_INVALID:      "INVALID",
+	ERR_TOO_LARGE:    "TOO_LARGE",
+	ERR_NOT_WRITABLE: "NOT_WRITABLE",
+}
+
+func ErrCodeString(code uint8) string {
+	if name, present := errCodeNames[code]; present {
+		return name
+	}
+	return fmt.Sprintf("ERR_%d", code)
+}
+
+// ProposeError is the client-side view of a failed proposal.
+type ProposeError struct {
+	CommandId int32
+	Code      uint8
+	Msg       string
+}
+
+func (e *ProposeError) Error() string {
+	if e.Msg == "" {
+		return fmt.Sprintf("command %d: %s", e.CommandId, ErrCodeString(e.Code))
+	}
+	return fmt.Sprintf("command %d: %s: %s", e.CommandId, ErrCodeString(e.Code), e.Msg)
+}
+
+// Retryable reports whether the command is known not to have taken effect,
+// so that resubmitting it cannot execute it twice.
+func (e *ProposeError) Retryable() bool {
+	switch e.Code {
+	case ERR_NOT_LEADER, ERR_CONFLICT, ERR_OVERLOADED, ERR_WRONG_GROUP, ERR_NOT_WRITABLE:
+		return true
+	}
+	return false
+}
+
+// Err returns nil for a successful reply and a *ProposeError otherwise.
+// Replies from servers that predate error codes report failure with ERR_NONE.
+func (t *ProposeReply) Err() error {
+	if t.OK != 0 {
+		return nil
+	}
+	return &ProposeError{t.CommandId, t.ErrCode, t.ErrMsg}
+}
+
+func (t *ProposeReplyTS) Err() error {
+	if t.OK != 0 {
+		return nil
+	}
+	return &ProposeError{t.CommandId, t.ErrCode, t.ErrMsg}
+}
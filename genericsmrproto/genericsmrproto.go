@@ -13,6 +13,36 @@ const (
 	PROPOSE_AND_READ_REPLY
 	GENERIC_SMR_BEACON
 	GENERIC_SMR_BEACON_REPLY
+	AUTHENTICATE
+	AUTHENTICATE_REPLY
+	CLIENT_LEASE
+	CLIENT_LEASE_REPLY
+	CLIENT_LEASE_RELEASE
+	SELECT_GROUP
+	SELECT_GROUP_REPLY
+	STATUS
+	STATUS_REPLY
+	PING          // answered by a ProposeReplyTS, so that pings share the reply stream with proposals
+	CAUSAL        // a client's causal token; not answered
+	SESSION       // names the client session the connection belongs to; not answered
+	CODEC         // switches the connection to another codec; answered by a CodecReply
+	CONFIG_UPDATE // subscribes the connection to configuration updates; not answered
+	DEADLINE      // the deadline of the connection's next proposal; not answered
+	PRIORITY      // the priority class of the connection's later proposals; not answered
+)
+
+// error codes carried by ProposeReply and ProposeReplyTS when OK is false
+const (
+	ERR_NONE         uint8 = iota
+	ERR_UNAUTHORIZED       // the client may not perform this operation on this key
+	ERR_NOT_LEADER         // retry at the leader
+	ERR_TIMEOUT            // the command may or may not have been executed
+	ERR_CONFLICT           // the command was preempted by a conflicting command; safe to retry
+	ERR_OVERLOADED         // the replica is shedding load; back off and retry
+	ERR_WRONG_GROUP        // the key belongs to a group this process does not host; ErrMsg names the group
+	ERR_INVALID            // the command was rejected as invalid (e.g., by validating middleware); ErrMsg says why
+	ERR_TOO_LARGE          // the request exceeds the replica's size limits; ErrMsg says which
+	ERR_NOT_WRITABLE       // the replica is read-only; send writes to another replica
 )
 
 type Propose struct {
@@ -24,6 +54,8 @@ type Propose struct {
 type ProposeReply struct {
 	OK        uint8
 	CommandId int32
+	ErrCode   uint8
+	ErrMsg    string // optional human-readable detail for ErrCode
 }
 
 type ProposeReplyTS struct {
@@ -31,6 +63,11 @@ type ProposeReplyTS struct {
 	CommandId int32
 	Value     state.Value
 	Timestamp int64
+	ErrCode   uint8
+	ErrMsg    string // optional human-readable detail for ErrCode
+	Fence     uint64 // fencing token of the lease a local read was served under (0 otherwise)
+	HLC       uint64 // hybrid logical clock timestamp of the reply (see package hlc; 0 on errors)
+	Version   uint64 // version of the key read or written, or of the key a failed CPUT found (see state.Version)
 }
 
 type Read struct {
@@ -55,16 +92,406 @@ type ProposeAndReadReply struct {
 	Value     state.Value
 }
 
+// client authentication; the identity is what the replica's ACL is keyed on
+
+type Authenticate struct {
+	Identity string
+	Token    []byte
+}
+
+type AuthenticateReply struct {
+	OK uint8
+}
+
+// client sub-leases: a replica holding a read lease on some keys may delegate
+// it, for a shorter time, to a (co-located) client, which can then serve reads
+// on those keys from its cache; the replica holds back writes to the keys
+// until the client lease expires or is released
+
+type ClientLease struct {
+	CommandId  int32
+	DurationNs int64 // requested duration
+	Keys       []state.Key
+}
+
+type ClientLeaseReply struct {
+	OK         uint8
+	CommandId  int32
+	DurationNs int64         // granted duration, to be measured from when the client sent the request
+	Values     []state.Value // the current value of each key
+	ErrCode    uint8
+	Versions   []uint64 // the current version of each key
+}
+
+type ClientLeaseRelease struct {
+	Keys []state.Key // empty releases every key held through the connection
+}
+
+// in a process hosting several SMR groups, a client connection talks to group
+// 0 until it selects another one
+
+type SelectGroup struct {
+	Group uint16
+}
+
+type SelectGroupReply struct {
+	OK uint8
+}
+
+// replica status, for external orchestration (e.g., to decide where to place
+// leaders and lease quorums)
+
+type Status struct {
+}
+
+type PeerStatus struct {
+	ReplicaId   int32
+	Alive       uint8
+	EwmaLatency float64 // beacon round-trip time, in ns (0 without beacons)
+	LastReplyNs int64   // when the peer last answered a lease promise (0 if never)
+	LastHeardNs int64   // when the latest beacon or beacon reply arrived (0 without beacons)
+	ClockOffset int64   // the peer's lease clock minus the replica's, in ns, as estimated from clock probes
+	ClockError  int64   // how far the estimate may be off, in ns (0 if there is no estimate yet)
+}
+
+type ChanDepth struct {
+	Name    string
+	Len     int32
+	Cap     int32
+	Dropped int64 // messages dropped because the channel was full (see genericsmr.OverflowPolicy)
+}
+
+// ConnTraffic sums up the traffic of a connection to a peer or client.
+type ConnTraffic struct {
+	ReplicaId      int32  // the peer (-1 for a client)
+	ClientId       uint64 // the client (0 for a peer)
+	RemoteAddr     string
+	MsgsSent       uint64 // messages written (not counted for clients)
+	MsgsReceived   uint64
+	BytesSent      uint64
+	BytesReceived  uint64
+	Flushes        uint64 // writes to the connection
+	Reconnects     uint64 // times the connection to the peer was replaced
+	LastSentNs     int64  // when data was last written (0 if never)
+	LastReceivedNs int64  // when data last arrived (0 if never)
+}
+
+type StatusReply struct {
+	ReplicaId          int32
+	GroupId            uint16
+	Peers              []PeerStatus // every replica but the one replying
+	Chans              []ChanDepth
+	LeaseInst          int32 // the lease instance promised to the replica (-1 if none)
+	ReadLocallyUntil   int64 // the replica may serve local reads until then
+	WriteInQuorumUntil int64 // writes must reach the lease quorum until then
+	Leader             int32 // the replica this one believes leads (-1 if unknown, or the protocol has no leader)
+	NowNs              int64 // the replica's lease clock when replying, to tell how long the lease times above are from now
+	Zone               string
+	Region             string
+	Traffic            []ConnTraffic    // per peer, then per client connection
+	CommitBacklog      int64            // instances proposed but not yet executed
+	BacklogRejected    uint64           // client proposals answered ERR_OVERLOADED for the backlog
+	BacklogPaused      uint64           // times a client connection was paused for the backlog
+	DeadlineDropped    uint64           // client proposals dropped, or replies not sent, past their deadlines
+	Reads              ReadCounts       // the client reads answered, by all keys
+	ReadPrefixShift    uint8            // the low bits of the keys that ReadsByPrefix ignores
+	ReadsByPrefix      []ReadCounts     // the client reads answered, by key prefix, sorted (none unless the replica counts them)
+	StateKeys          int64            // keys of the state that have a value
+	StateBytes         int64            // approximate bytes of the state
+	MaxStateBytes      int64            // the limit on StateBytes (0 for none)
+	StateRejected      uint64           // client writes answered ERR_NOT_WRITABLE for the limit
+	Latencies          []LatencySummary // the time client proposals took, by stage
+}
+
+// LatencySummary summarizes the times, in ns, that client proposals spent in
+// a stage (see genericsmr/latency.go).
+type LatencySummary struct {
+	Stage  string
+	Count  uint64
+	MeanNs int64
+	P50Ns  int64
+	P90Ns  int64
+	P99Ns  int64
+	P999Ns int64
+	MaxNs  int64
+}
+
+// ReadCounts counts the client reads of the keys under a prefix (k with
+// k>>ReadPrefixShift == Prefix) by how the replica served them.
+type ReadCounts struct {
+	Prefix    int64
+	Local     uint64 // under the replica's lease
+	Quorum    uint64 // through the protocol: consensus, a quorum read or a read index
+	Forwarded uint64 // by the replica they were forwarded to
+	Rejected  uint64 // answered with an error
+}
+
+// state transfer to replicas that missed committed commands (e.g., while down)
+
+type RequestEntries struct {
+	ReplicaId int32 // the lagging replica
+	From      int32 // first instance it is missing
+	Count     int32 // maximum number of instances to send back
+}
+
+type Entry struct {
+	Ballot  int32
+	Command []state.Command
+}
+
+type Entries struct {
+	ReplicaId     int32   // the replica sending the entries
+	From          int32   // instance number of Entries[0]
+	CommittedUpTo int32   // every instance up to this one is committed at the sender
+	Entries       []Entry // committed instances From, From+1, ...
+}
+
+// snapshot transfers, to replicas too far behind to catch up from the log
+// (see genericsmr.FetchSnapshot)
+
+// the largest chunk of a snapshot that a SnapshotChunk may carry
+const MAX_SNAPSHOT_CHUNK = 1 << 20
+
+type RequestSnapshot struct {
+	ReplicaId  int32 // the replica fetching the snapshot
+	Transfer   int32 // echoed back in the chunks, to tell them from those of earlier requests
+	SnapshotId int64 // the snapshot being resumed (0 for the latest)
+	Offset     int64 // first byte to send
+	Length     int64 // number of bytes to send, from Offset
+}
+
+type SnapshotChunk struct {
+	ReplicaId  int32 // the replica sending the snapshot
+	Transfer   int32
+	SnapshotId int64  // 0 if the sender does not have the snapshot requested
+	Size       int64  // of the whole snapshot
+	Offset     int64  // of Data in the snapshot
+	Checksum   uint32 // CRC-32C of Data
+	Data       []byte
+}
+
+// quorum reads, for linearizable reads without a valid lease: the reader
+// returns the value of a responder that has executed every instance accepted
+// by any responder
+
+type QuorumRead struct {
+	ReplicaId int32
+	ReadId    int32
+	Key       state.Key
+}
+
+type QuorumReadReply struct {
+	ReplicaId int32
+	ReadId    int32
+	Value     state.Value
+	Accepted  int32 // latest instance accepted by the responder
+	Applied   int32 // every instance up to this one has been executed by the responder
+	Version   uint64
+}
+
+// a client's proposal that a replica forwards to another (e.g., the leader),
+// which relays the reply back to it (see genericsmr.ForwardPropose)
+type ForwardPropose struct {
+	ReplicaId int32 // the forwarding replica
+	FwdId     int32
+	TimeoutNs int64 // the time left to the proposal's deadline (0 for none)
+	Priority  uint8 // the proposal's priority class
+	Propose
+}
+
+type ForwardProposeReply struct {
+	FwdId int32
+	ProposeReplyTS
+}
+
+// read index reads, for linearizable reads without clocks: the leader
+// confirms with a quorum that it still leads, and the reader returns its value
+// once it has executed every instance the leader had accepted
+
+type ReadIndex struct {
+	ReplicaId int32
+	ReadId    int32
+}
+
+type ReadIndexReply struct {
+	ReplicaId int32
+	ReadId    int32
+	Index     int32 // the leader's latest accepted instance when the read arrived
+	OK        uint8 // FALSE if the responder could not confirm that it leads
+}
+
+type LeaderCheck struct {
+	ReplicaId int32
+	ReadId    int32
+	Ballot    int32 // the leader's ballot
+}
+
+type LeaderCheckReply struct {
+	ReplicaId int32
+	ReadId    int32
+	OK        uint8 // FALSE if the responder has promised a higher ballot
+}
+
+// leadership checks are broadcast with genericsmr.QuorumRPC
+
+func (t *LeaderCheck) QuorumId() (int32, int32)      { return t.ReplicaId, t.ReadId }
+func (t *LeaderCheck) SetQuorumId(replica, id int32) { t.ReplicaId, t.ReadId = replica, id }
+
+func (t *LeaderCheckReply) QuorumId() (int32, int32)      { return t.ReplicaId, t.ReadId }
+func (t *LeaderCheckReply) SetQuorumId(replica, id int32) { t.ReplicaId, t.ReadId = replica, id }
+
+// anti-entropy: replicas compare digests of their state at the same
+// instance, and list the keys of the parts that differ (see
+// genericsmr.ExecuteCommand)
+
+type StateDigest struct {
+	ReplicaId int32
+	Inst      int32    // every instance up to this one was executed when the digest was taken
+	Nodes     []uint64 // the digest's tree nodes under the root
+}
+
+type StateDigestReply struct {
+	ReplicaId int32
+	Inst      int32
+	Found     uint8    // FALSE if the responder has no digest at Inst
+	Executed  int32    // every instance up to this one has been executed by the responder
+	Subtrees  []int32  // the nodes that differ from the sender's
+	Leaves    []uint64 // the responder's leaves under them, in order
+}
+
+type StateKeys struct {
+	ReplicaId int32
+	Inst      int32   // list the keys once every instance up to this one is executed
+	Leaves    []int32 // the leaves whose keys to list
+}
+
+type StateKeysReply struct {
+	ReplicaId int32
+	Inst      int32
+	Found     uint8 // FALSE if the responder had already executed past Inst
+	Keys      []state.Key
+	Values    []state.Value
+}
+
 // handling stalls and failures
 
 type Beacon struct {
-	Timestamp uint64
+	Timestamp uint64 // the sender's genericsmr.Replica.Clock, echoed back in the reply
 }
 
 type BeaconReply struct {
 	Timestamp uint64
 }
 
+// a probe of a peer's clock, sent with every round of beacons: the times are
+// read from the lease clocks (genericsmr.Replica.Now) of the prober and of the
+// peer (see genericsmr/clocks.go)
+type ClockProbe struct {
+	ReplicaId int32 // the prober
+	Sent      int64 // when the prober sent the probe
+}
+
+type ClockProbeReply struct {
+	ReplicaId int32 // the peer
+	Sent      int64 // the probe's
+	Received  int64 // when the peer received the probe
+	Replied   int64 // when it sent the reply
+}
+
+// with hierarchical leases, a replica's request for a sub-grant of the lease
+// of its region's delegate, every lease renewal interval (see
+// genericsmr/regionlease.go)
+type RegionLeaseRequest struct {
+	ReplicaId int32 // the requester
+	Sent      int64 // when it sent the request, by its lease clock
+}
+
+// the delegate's sub-grant: the requester may read locally, under lease
+// instance LeaseInstance, until Sent plus DurationNs
+type RegionLease struct {
+	ReplicaId     int32 // the delegate
+	LeaseInstance int32
+	Sent          int64 // the request's
+	DurationNs    int64 // what was left of the delegate's lease when it answered
+}
+
+// a replica's notice that it has suspended its lease for lack of reads
+// (Idle TRUE), so that its peers stop renewing their promises to it, or that
+// it reads again (Idle FALSE) and wants them renewed (see
+// genericsmr/leaseidle.go)
+type LeaseIdle struct {
+	ReplicaId int32
+	Idle      uint8
+}
+
+// a client's keepalive; the replica answers right away with an OK
+// ProposeReplyTS carrying CommandId and Timestamp
+type Ping struct {
+	CommandId int32
+	Timestamp int64
+}
+
+// a client's causal token: the latest HLC timestamp it has seen in replies,
+// possibly from other groups; the replica's HLC moves past it, so that the
+// client's later commands are stamped after everything it has observed
+type Causal struct {
+	HLC uint64
+}
+
+// names the client session that the connection's proposals belong to, so
+// that the replica answers a proposal the session sends again (e.g., after
+// reconnecting) with the original result; the client must not reuse command
+// IDs within a session
+type Session struct {
+	ClientId uint64
+}
+
+// asks the replica to encode everything after the CodecReply, in both
+// directions, with the codec registered under Codec (see fastrpc.Codec);
+// message types still go as single bytes. Both messages are binary.
+type Codec struct {
+	Codec uint8
+}
+
+type CodecReply struct {
+	OK uint8 // FALSE if the replica does not have the codec, and stays with the one in use
+}
+
+// subscribes the client connection to the replica's configuration updates:
+// whenever the leader or the replicas it holds alive change (and once on
+// subscribing), the replica pushes a ProposeReplyTS with CommandId
+// CONFIG_UPDATE_ID, so that updates share the reply stream with proposals, as
+// pings do. Its Value is the leader's ID (-1 if unknown), its Fence the bitmap
+// of the live replicas (bit i for replica i, up to 64), and its Timestamp when
+// the replica saw the change (ns).
+type ConfigUpdate struct {
+}
+
+const CONFIG_UPDATE_ID int32 = -1 << 31
+
+// gives the connection's next proposal a deadline, TimeoutNs from when the
+// replica reads it (so that the clocks of client and replica need not
+// agree): past it, the replicas drop the proposal if they have not proposed
+// it yet, and send no reply to it, since its client has given up
+type Deadline struct {
+	TimeoutNs int64
+}
+
+// priority classes of client proposals, which replicas that schedule
+// proposals by priority take in the order HIGH, NORMAL, BULK (see
+// genericsmr.WithPriorityScheduling)
+const (
+	PRIORITY_NORMAL uint8 = iota // the default
+	PRIORITY_HIGH                // small latency-sensitive commands
+	PRIORITY_BULK                // bulk loads, which may wait
+	NUM_PRIORITIES
+)
+
+// sets the priority class of the connection's proposals from then on
+type Priority struct {
+	Class uint8
+}
+
 type PingArgs struct {
 	ActAsLeader uint8
 }
@@ -77,3 +504,71 @@ type BeTheLeaderArgs struct {
 
 type BeTheLeaderReply struct {
 }
+
+// administration
+
+type SetParamArgs struct {
+	Param uint8
+	Value int64
+}
+
+type SetParamReply struct {
+	OK       uint8
+	OldValue int64
+}
+
+type PrepareStopArgs struct {
+	TimeoutNs int64
+}
+
+type PrepareStopReply struct {
+}
+
+type ReadOnlyArgs struct {
+	ReadOnly uint8 // TRUE to serve reads only, FALSE to accept writes again
+}
+
+type ReadOnlyReply struct {
+	WasReadOnly uint8
+}
+
+// an entry of a replica's audit log
+type AuditEvent struct {
+	Seq       uint64 `json:"seq"` // position in the log, from 1
+	TimeNs    int64  `json:"time_ns"`
+	ReplicaId int32  `json:"replica"`
+	GroupId   uint16 `json:"group"`
+	Kind      string `json:"kind"` // what happened: "param", "lease-config", "membership", "leader" or "admin"
+	Detail    string `json:"detail"`
+}
+
+type AuditTailArgs struct {
+	After  uint64 // return the events after this sequence number
+	Max    int32  // at most this many (0 for all those remembered)
+	WaitNs int64  // if there are none yet, wait this long for some
+}
+
+type AuditTailReply struct {
+	Events []AuditEvent
+	First  uint64 // the earliest event still remembered (0 if none), to tell if some were missed
+}
+
+type ExportStateArgs struct {
+	Path  string // the file on the replica's host to export to (replaced if it exists)
+	Group uint16 // the group whose state to export, if the process hosts several
+}
+
+type ExportStateReply struct {
+	Inst int32  // every instance up to this one is in the export
+	Keys uint64 // how many keys it holds
+}
+
+type BackupArgs struct {
+	Group uint16 // the group whose state to back up, if the process hosts several
+}
+
+type BackupReply struct {
+	Name string // of the backup, where it was uploaded
+	Inst int32
+	Keys uint64
+}
@@ -1,10 +1,42 @@
 package genericsmrproto
 
 import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"math"
 	"sync"
+
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/state"
 )
 
+type byteReader interface {
+	io.Reader
+	ReadByte() (c byte, err error)
+}
+
+func marshalString(wire io.Writer, str string) {
+	var b [10]byte
+	if wlen := binary.PutVarint(b[:], int64(len(str))); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	io.WriteString(wire, str)
+}
+
+func unmarshalString(wire byteReader) (string, error) {
+	alen, err := fastrpc.ReadLen(wire, fastrpc.MAX_BYTES_LEN)
+	if err != nil {
+		return "", err
+	}
+	bs := make([]byte, alen)
+	if _, err := io.ReadFull(wire, bs); err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
+
 func (t *Propose) BinarySize() (nbytes int, sizeKnown bool) {
 	return 0, false
 }
@@ -568,7 +600,7 @@ func (t *ProposeAndReadReply) Unmarshal(wire io.Reader) error {
 }
 
 func (t *ProposeReply) BinarySize() (nbytes int, sizeKnown bool) {
-	return 5, true
+	return 0, false
 }
 
 type ProposeReplyCache struct {
@@ -601,28 +633,38 @@ func (p *ProposeReplyCache) Put(t *ProposeReply) {
 	p.mu.Unlock()
 }
 func (t *ProposeReply) Marshal(wire io.Writer) {
-	var b [5]byte
+	var b [6]byte
 	var bs []byte
-	bs = b[:5]
+	bs = b[:6]
 	bs[0] = byte(t.OK)
 	tmp32 := t.CommandId
 	bs[1] = byte(tmp32)
 	bs[2] = byte(tmp32 >> 8)
 	bs[3] = byte(tmp32 >> 16)
 	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(t.ErrCode)
 	wire.Write(bs)
+	marshalString(wire, t.ErrMsg)
 }
 
-func (t *ProposeReply) Unmarshal(wire io.Reader) error {
-	var b [5]byte
+func (t *ProposeReply) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [6]byte
 	var bs []byte
-	bs = b[:5]
-	if _, err := io.ReadAtLeast(wire, bs, 5); err != nil {
+	bs = b[:6]
+	if _, err := io.ReadAtLeast(wire, bs, 6); err != nil {
 		return err
 	}
 	t.OK = uint8(bs[0])
 	t.CommandId = int32((uint32(bs[1]) | (uint32(bs[2]) << 8) | (uint32(bs[3]) << 16) | (uint32(bs[4]) << 24)))
-	return nil
+	t.ErrCode = uint8(bs[5])
+	var err error
+	t.ErrMsg, err = unmarshalString(wire)
+	return err
 }
 
 func (t *BeTheLeaderReply) BinarySize() (nbytes int, sizeKnown bool) {
@@ -721,9 +763,25 @@ func (t *ProposeReplyTS) Marshal(wire io.Writer) {
 	bs[6] = byte(tmp64 >> 48)
 	bs[7] = byte(tmp64 >> 56)
 	wire.Write(bs)
+	bs = b[:1]
+	bs[0] = byte(t.ErrCode)
+	wire.Write(bs)
+	marshalString(wire, t.ErrMsg)
+	bs = b[:8]
+	binary.LittleEndian.PutUint64(bs, t.Fence)
+	wire.Write(bs)
+	binary.LittleEndian.PutUint64(bs, t.HLC)
+	wire.Write(bs)
+	binary.LittleEndian.PutUint64(bs, t.Version)
+	wire.Write(bs)
 }
 
-func (t *ProposeReplyTS) Unmarshal(wire io.Reader) error {
+func (t *ProposeReplyTS) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
 	var b [8]byte
 	var bs []byte
 	bs = b[:5]
@@ -738,5 +796,1531 @@ func (t *ProposeReplyTS) Unmarshal(wire io.Reader) error {
 		return err
 	}
 	t.Timestamp = int64((uint64(bs[0]) | (uint64(bs[1]) << 8) | (uint64(bs[2]) << 16) | (uint64(bs[3]) << 24) | (uint64(bs[4]) << 32) | (uint64(bs[5]) << 40) | (uint64(bs[6]) << 48) | (uint64(bs[7]) << 56)))
+	bs = b[:1]
+	if _, err := io.ReadAtLeast(wire, bs, 1); err != nil {
+		return err
+	}
+	t.ErrCode = uint8(bs[0])
+	var err error
+	if t.ErrMsg, err = unmarshalString(wire); err != nil {
+		return err
+	}
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.Fence = binary.LittleEndian.Uint64(bs)
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.HLC = binary.LittleEndian.Uint64(bs)
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.Version = binary.LittleEndian.Uint64(bs)
+	return nil
+}
+
+func (t *Authenticate) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type AuthenticateCache struct {
+	mu	sync.Mutex
+	cache	[]*Authenticate
+}
+
+func NewAuthenticateCache() *AuthenticateCache {
+	c := &AuthenticateCache{}
+	c.cache = make([]*Authenticate, 0)
+	return c
+}
+
+func (p *AuthenticateCache) Get() *Authenticate {
+	var t *Authenticate
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &Authenticate{}
+	}
+	return t
+}
+func (p *AuthenticateCache) Put(t *Authenticate) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *Authenticate) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	marshalString(wire, t.Identity)
+	bs = b[:]
+	alen2 := int64(len(t.Token))
+	if wlen := binary.PutVarint(bs, alen2); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	wire.Write(t.Token)
+}
+
+func (t *Authenticate) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var err error
+	if t.Identity, err = unmarshalString(wire); err != nil {
+		return err
+	}
+	alen2, err := fastrpc.ReadLen(wire, fastrpc.MAX_BYTES_LEN)
+	if err != nil {
+		return err
+	}
+	t.Token = make([]byte, alen2)
+	if _, err := io.ReadFull(wire, t.Token); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *AuthenticateReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 1, true
+}
+
+type AuthenticateReplyCache struct {
+	mu	sync.Mutex
+	cache	[]*AuthenticateReply
+}
+
+func NewAuthenticateReplyCache() *AuthenticateReplyCache {
+	c := &AuthenticateReplyCache{}
+	c.cache = make([]*AuthenticateReply, 0)
+	return c
+}
+
+func (p *AuthenticateReplyCache) Get() *AuthenticateReply {
+	var t *AuthenticateReply
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &AuthenticateReply{}
+	}
+	return t
+}
+func (p *AuthenticateReplyCache) Put(t *AuthenticateReply) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *AuthenticateReply) Marshal(wire io.Writer) {
+	var b [1]byte
+	var bs []byte
+	bs = b[:1]
+	bs[0] = byte(t.OK)
+	wire.Write(bs)
+}
+
+func (t *AuthenticateReply) Unmarshal(wire io.Reader) error {
+	var b [1]byte
+	var bs []byte
+	bs = b[:1]
+	if _, err := io.ReadAtLeast(wire, bs, 1); err != nil {
+		return err
+	}
+	t.OK = uint8(bs[0])
+	return nil
+}
+
+func (t *RequestEntries) New() fastrpc.Serializable {
+	return new(RequestEntries)
+}
+func (t *RequestEntries) BinarySize() (nbytes int, sizeKnown bool) {
+	return 12, true
+}
+
+func (t *RequestEntries) Marshal(wire io.Writer) {
+	var b [12]byte
+	bs := b[:12]
+	binary.LittleEndian.PutUint32(bs[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(bs[4:8], uint32(t.From))
+	binary.LittleEndian.PutUint32(bs[8:12], uint32(t.Count))
+	wire.Write(bs)
+}
+
+func (t *RequestEntries) Unmarshal(wire io.Reader) error {
+	var b [12]byte
+	bs := b[:12]
+	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(bs[0:4]))
+	t.From = int32(binary.LittleEndian.Uint32(bs[4:8]))
+	t.Count = int32(binary.LittleEndian.Uint32(bs[8:12]))
+	return nil
+}
+
+func (t *Entries) New() fastrpc.Serializable {
+	return new(Entries)
+}
+func (t *Entries) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *Entries) Marshal(wire io.Writer) {
+	var b [12]byte
+	bs := b[:12]
+	binary.LittleEndian.PutUint32(bs[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(bs[4:8], uint32(t.From))
+	binary.LittleEndian.PutUint32(bs[8:12], uint32(t.CommittedUpTo))
+	wire.Write(bs)
+	bs = b[:]
+	if wlen := binary.PutVarint(bs, int64(len(t.Entries))); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		bs = b[:4]
+		binary.LittleEndian.PutUint32(bs, uint32(e.Ballot))
+		wire.Write(bs)
+		bs = b[:]
+		if wlen := binary.PutVarint(bs, int64(len(e.Command))); wlen >= 0 {
+			wire.Write(b[0:wlen])
+		}
+		for j := range e.Command {
+			e.Command[j].Marshal(wire)
+		}
+	}
+}
+
+func (t *Entries) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [12]byte
+	bs := b[:12]
+	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(bs[0:4]))
+	t.From = int32(binary.LittleEndian.Uint32(bs[4:8]))
+	t.CommittedUpTo = int32(binary.LittleEndian.Uint32(bs[8:12]))
+	alen, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
+	if err != nil {
+		return err
+	}
+	t.Entries = make([]Entry, alen)
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		bs = b[:4]
+		if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+			return err
+		}
+		e.Ballot = int32(binary.LittleEndian.Uint32(bs))
+		clen, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
+		if err != nil {
+			return err
+		}
+		e.Command = make([]state.Command, clen)
+		for j := range e.Command {
+			if err := e.Command[j].Unmarshal(wire); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func marshalKeys(wire io.Writer, keys []state.Key) {
+	var b [10]byte
+	if wlen := binary.PutVarint(b[:], int64(len(keys))); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := range keys {
+		keys[i].Marshal(wire)
+	}
+}
+
+func unmarshalKeys(wire byteReader) ([]state.Key, error) {
+	alen, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]state.Key, alen)
+	for i := range keys {
+		if err := keys[i].Unmarshal(wire); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func (t *ClientLease) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *ClientLease) Marshal(wire io.Writer) {
+	var b [12]byte
+	bs := b[:12]
+	binary.LittleEndian.PutUint32(bs[0:4], uint32(t.CommandId))
+	binary.LittleEndian.PutUint64(bs[4:12], uint64(t.DurationNs))
+	wire.Write(bs)
+	marshalKeys(wire, t.Keys)
+}
+
+func (t *ClientLease) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [12]byte
+	bs := b[:12]
+	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
+		return err
+	}
+	t.CommandId = int32(binary.LittleEndian.Uint32(bs[0:4]))
+	t.DurationNs = int64(binary.LittleEndian.Uint64(bs[4:12]))
+	var err error
+	t.Keys, err = unmarshalKeys(wire)
+	return err
+}
+
+func (t *ClientLeaseReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *ClientLeaseReply) Marshal(wire io.Writer) {
+	var b [13]byte
+	bs := b[:13]
+	bs[0] = t.OK
+	binary.LittleEndian.PutUint32(bs[1:5], uint32(t.CommandId))
+	binary.LittleEndian.PutUint64(bs[5:13], uint64(t.DurationNs))
+	wire.Write(bs)
+	bs = b[:]
+	if wlen := binary.PutVarint(bs, int64(len(t.Values))); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := range t.Values {
+		t.Values[i].Marshal(wire)
+	}
+	bs = b[:1]
+	bs[0] = t.ErrCode
+	wire.Write(bs)
+	bs = b[:]
+	if wlen := binary.PutVarint(bs, int64(len(t.Versions))); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for _, v := range t.Versions {
+		binary.LittleEndian.PutUint64(bs, v)
+		wire.Write(bs[:8])
+	}
+}
+
+func (t *ClientLeaseReply) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [13]byte
+	bs := b[:13]
+	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
+		return err
+	}
+	t.OK = bs[0]
+	t.CommandId = int32(binary.LittleEndian.Uint32(bs[1:5]))
+	t.DurationNs = int64(binary.LittleEndian.Uint64(bs[5:13]))
+	alen, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
+	if err != nil {
+		return err
+	}
+	t.Values = make([]state.Value, alen)
+	for i := range t.Values {
+		if err := t.Values[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
+	if t.ErrCode, err = wire.ReadByte(); err != nil {
+		return err
+	}
+	if alen, err = fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN); err != nil {
+		return err
+	}
+	t.Versions = make([]uint64, alen)
+	for i := range t.Versions {
+		if _, err := io.ReadFull(wire, bs[:8]); err != nil {
+			return err
+		}
+		t.Versions[i] = binary.LittleEndian.Uint64(bs[:8])
+	}
+	return nil
+}
+
+func (t *ClientLeaseRelease) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *ClientLeaseRelease) Marshal(wire io.Writer) {
+	marshalKeys(wire, t.Keys)
+}
+
+func (t *ClientLeaseRelease) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var err error
+	t.Keys, err = unmarshalKeys(wire)
+	return err
+}
+
+func (t *SelectGroup) BinarySize() (nbytes int, sizeKnown bool) {
+	return 2, true
+}
+
+func (t *SelectGroup) Marshal(wire io.Writer) {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], t.Group)
+	wire.Write(b[:])
+}
+
+func (t *SelectGroup) Unmarshal(wire io.Reader) error {
+	var b [2]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.Group = binary.LittleEndian.Uint16(b[:])
+	return nil
+}
+
+func (t *SelectGroupReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 1, true
+}
+
+func (t *SelectGroupReply) Marshal(wire io.Writer) {
+	var b [1]byte
+	b[0] = t.OK
+	wire.Write(b[:])
+}
+
+func (t *SelectGroupReply) Unmarshal(wire io.Reader) error {
+	var b [1]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.OK = b[0]
+	return nil
+}
+
+func (t *Ping) BinarySize() (nbytes int, sizeKnown bool) {
+	return 12, true
+}
+
+func (t *Ping) Marshal(wire io.Writer) {
+	var b [12]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.CommandId))
+	binary.LittleEndian.PutUint64(b[4:12], uint64(t.Timestamp))
+	wire.Write(b[:])
+}
+
+func (t *Ping) Unmarshal(wire io.Reader) error {
+	var b [12]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.CommandId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.Timestamp = int64(binary.LittleEndian.Uint64(b[4:12]))
+	return nil
+}
+
+func (t *Status) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, true
+}
+
+func (t *Status) Marshal(wire io.Writer) {
+}
+
+func (t *Status) Unmarshal(wire io.Reader) error {
+	return nil
+}
+
+func (t *StatusReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *StatusReply) Marshal(wire io.Writer) {
+	var b [48]byte
+	bs := b[:6]
+	binary.LittleEndian.PutUint32(bs[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint16(bs[4:6], t.GroupId)
+	wire.Write(bs)
+	bs = b[:]
+	if wlen := binary.PutVarint(bs, int64(len(t.Peers))); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := range t.Peers {
+		p := &t.Peers[i]
+		bs = b[:45]
+		binary.LittleEndian.PutUint32(bs[0:4], uint32(p.ReplicaId))
+		bs[4] = p.Alive
+		binary.LittleEndian.PutUint64(bs[5:13], math.Float64bits(p.EwmaLatency))
+		binary.LittleEndian.PutUint64(bs[13:21], uint64(p.LastReplyNs))
+		binary.LittleEndian.PutUint64(bs[21:29], uint64(p.LastHeardNs))
+		binary.LittleEndian.PutUint64(bs[29:37], uint64(p.ClockOffset))
+		binary.LittleEndian.PutUint64(bs[37:45], uint64(p.ClockError))
+		wire.Write(bs)
+	}
+	bs = b[:]
+	if wlen := binary.PutVarint(bs, int64(len(t.Chans))); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := range t.Chans {
+		c := &t.Chans[i]
+		marshalString(wire, c.Name)
+		bs = b[:16]
+		binary.LittleEndian.PutUint32(bs[0:4], uint32(c.Len))
+		binary.LittleEndian.PutUint32(bs[4:8], uint32(c.Cap))
+		binary.LittleEndian.PutUint64(bs[8:16], uint64(c.Dropped))
+		wire.Write(bs)
+	}
+	bs = b[:32]
+	binary.LittleEndian.PutUint32(bs[0:4], uint32(t.LeaseInst))
+	binary.LittleEndian.PutUint64(bs[4:12], uint64(t.ReadLocallyUntil))
+	binary.LittleEndian.PutUint64(bs[12:20], uint64(t.WriteInQuorumUntil))
+	binary.LittleEndian.PutUint32(bs[20:24], uint32(t.Leader))
+	binary.LittleEndian.PutUint64(bs[24:32], uint64(t.NowNs))
+	wire.Write(bs)
+	marshalString(wire, t.Zone)
+	marshalString(wire, t.Region)
+	bs = b[:]
+	if wlen := binary.PutVarint(bs, int64(len(t.Traffic))); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	var tb [64]byte
+	for i := range t.Traffic {
+		c := &t.Traffic[i]
+		bs = b[:12]
+		binary.LittleEndian.PutUint32(bs[0:4], uint32(c.ReplicaId))
+		binary.LittleEndian.PutUint64(bs[4:12], c.ClientId)
+		wire.Write(bs)
+		marshalString(wire, c.RemoteAddr)
+		binary.LittleEndian.PutUint64(tb[0:8], c.MsgsSent)
+		binary.LittleEndian.PutUint64(tb[8:16], c.MsgsReceived)
+		binary.LittleEndian.PutUint64(tb[16:24], c.BytesSent)
+		binary.LittleEndian.PutUint64(tb[24:32], c.BytesReceived)
+		binary.LittleEndian.PutUint64(tb[32:40], c.Flushes)
+		binary.LittleEndian.PutUint64(tb[40:48], c.Reconnects)
+		binary.LittleEndian.PutUint64(tb[48:56], uint64(c.LastSentNs))
+		binary.LittleEndian.PutUint64(tb[56:64], uint64(c.LastReceivedNs))
+		wire.Write(tb[:])
+	}
+	bs = b[:32]
+	binary.LittleEndian.PutUint64(bs[0:8], uint64(t.CommitBacklog))
+	binary.LittleEndian.PutUint64(bs[8:16], t.BacklogRejected)
+	binary.LittleEndian.PutUint64(bs[16:24], t.BacklogPaused)
+	binary.LittleEndian.PutUint64(bs[24:32], t.DeadlineDropped)
+	wire.Write(bs)
+	bs = b[:41]
+	t.Reads.marshal(bs[0:40])
+	bs[40] = t.ReadPrefixShift
+	wire.Write(bs)
+	bs = b[:]
+	if wlen := binary.PutVarint(bs, int64(len(t.ReadsByPrefix))); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := range t.ReadsByPrefix {
+		bs = b[:40]
+		t.ReadsByPrefix[i].marshal(bs)
+		wire.Write(bs)
+	}
+	bs = b[:32]
+	binary.LittleEndian.PutUint64(bs[0:8], uint64(t.StateKeys))
+	binary.LittleEndian.PutUint64(bs[8:16], uint64(t.StateBytes))
+	binary.LittleEndian.PutUint64(bs[16:24], uint64(t.MaxStateBytes))
+	binary.LittleEndian.PutUint64(bs[24:32], t.StateRejected)
+	wire.Write(bs)
+	bs = b[:]
+	if wlen := binary.PutVarint(bs, int64(len(t.Latencies))); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	var lb [56]byte
+	for i := range t.Latencies {
+		l := &t.Latencies[i]
+		marshalString(wire, l.Stage)
+		binary.LittleEndian.PutUint64(lb[0:8], l.Count)
+		binary.LittleEndian.PutUint64(lb[8:16], uint64(l.MeanNs))
+		binary.LittleEndian.PutUint64(lb[16:24], uint64(l.P50Ns))
+		binary.LittleEndian.PutUint64(lb[24:32], uint64(l.P90Ns))
+		binary.LittleEndian.PutUint64(lb[32:40], uint64(l.P99Ns))
+		binary.LittleEndian.PutUint64(lb[40:48], uint64(l.P999Ns))
+		binary.LittleEndian.PutUint64(lb[48:56], uint64(l.MaxNs))
+		wire.Write(lb[:])
+	}
+}
+
+func (c *ReadCounts) marshal(bs []byte) {
+	binary.LittleEndian.PutUint64(bs[0:8], uint64(c.Prefix))
+	binary.LittleEndian.PutUint64(bs[8:16], c.Local)
+	binary.LittleEndian.PutUint64(bs[16:24], c.Quorum)
+	binary.LittleEndian.PutUint64(bs[24:32], c.Forwarded)
+	binary.LittleEndian.PutUint64(bs[32:40], c.Rejected)
+}
+
+func (c *ReadCounts) unmarshal(bs []byte) {
+	c.Prefix = int64(binary.LittleEndian.Uint64(bs[0:8]))
+	c.Local = binary.LittleEndian.Uint64(bs[8:16])
+	c.Quorum = binary.LittleEndian.Uint64(bs[16:24])
+	c.Forwarded = binary.LittleEndian.Uint64(bs[24:32])
+	c.Rejected = binary.LittleEndian.Uint64(bs[32:40])
+}
+
+func (t *StatusReply) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [48]byte
+	bs := b[:6]
+	if _, err := io.ReadFull(wire, bs); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(bs[0:4]))
+	t.GroupId = binary.LittleEndian.Uint16(bs[4:6])
+	alen, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
+	if err != nil {
+		return err
+	}
+	t.Peers = make([]PeerStatus, alen)
+	for i := range t.Peers {
+		p := &t.Peers[i]
+		bs = b[:45]
+		if _, err := io.ReadFull(wire, bs); err != nil {
+			return err
+		}
+		p.ReplicaId = int32(binary.LittleEndian.Uint32(bs[0:4]))
+		p.Alive = bs[4]
+		p.EwmaLatency = math.Float64frombits(binary.LittleEndian.Uint64(bs[5:13]))
+		p.LastReplyNs = int64(binary.LittleEndian.Uint64(bs[13:21]))
+		p.LastHeardNs = int64(binary.LittleEndian.Uint64(bs[21:29]))
+		p.ClockOffset = int64(binary.LittleEndian.Uint64(bs[29:37]))
+		p.ClockError = int64(binary.LittleEndian.Uint64(bs[37:45]))
+	}
+	if alen, err = fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN); err != nil {
+		return err
+	}
+	t.Chans = make([]ChanDepth, alen)
+	for i := range t.Chans {
+		c := &t.Chans[i]
+		if c.Name, err = unmarshalString(wire); err != nil {
+			return err
+		}
+		bs = b[:16]
+		if _, err := io.ReadFull(wire, bs); err != nil {
+			return err
+		}
+		c.Len = int32(binary.LittleEndian.Uint32(bs[0:4]))
+		c.Cap = int32(binary.LittleEndian.Uint32(bs[4:8]))
+		c.Dropped = int64(binary.LittleEndian.Uint64(bs[8:16]))
+	}
+	bs = b[:32]
+	if _, err := io.ReadFull(wire, bs); err != nil {
+		return err
+	}
+	t.LeaseInst = int32(binary.LittleEndian.Uint32(bs[0:4]))
+	t.ReadLocallyUntil = int64(binary.LittleEndian.Uint64(bs[4:12]))
+	t.WriteInQuorumUntil = int64(binary.LittleEndian.Uint64(bs[12:20]))
+	t.Leader = int32(binary.LittleEndian.Uint32(bs[20:24]))
+	t.NowNs = int64(binary.LittleEndian.Uint64(bs[24:32]))
+	if t.Zone, err = unmarshalString(wire); err != nil {
+		return err
+	}
+	if t.Region, err = unmarshalString(wire); err != nil {
+		return err
+	}
+	if alen, err = fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN); err != nil {
+		return err
+	}
+	t.Traffic = make([]ConnTraffic, alen)
+	var tb [64]byte
+	for i := range t.Traffic {
+		c := &t.Traffic[i]
+		bs = b[:12]
+		if _, err := io.ReadFull(wire, bs); err != nil {
+			return err
+		}
+		c.ReplicaId = int32(binary.LittleEndian.Uint32(bs[0:4]))
+		c.ClientId = binary.LittleEndian.Uint64(bs[4:12])
+		if c.RemoteAddr, err = unmarshalString(wire); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(wire, tb[:]); err != nil {
+			return err
+		}
+		c.MsgsSent = binary.LittleEndian.Uint64(tb[0:8])
+		c.MsgsReceived = binary.LittleEndian.Uint64(tb[8:16])
+		c.BytesSent = binary.LittleEndian.Uint64(tb[16:24])
+		c.BytesReceived = binary.LittleEndian.Uint64(tb[24:32])
+		c.Flushes = binary.LittleEndian.Uint64(tb[32:40])
+		c.Reconnects = binary.LittleEndian.Uint64(tb[40:48])
+		c.LastSentNs = int64(binary.LittleEndian.Uint64(tb[48:56]))
+		c.LastReceivedNs = int64(binary.LittleEndian.Uint64(tb[56:64]))
+	}
+	bs = b[:32]
+	if _, err := io.ReadFull(wire, bs); err != nil {
+		return err
+	}
+	t.CommitBacklog = int64(binary.LittleEndian.Uint64(bs[0:8]))
+	t.BacklogRejected = binary.LittleEndian.Uint64(bs[8:16])
+	t.BacklogPaused = binary.LittleEndian.Uint64(bs[16:24])
+	t.DeadlineDropped = binary.LittleEndian.Uint64(bs[24:32])
+	bs = b[:41]
+	if _, err := io.ReadFull(wire, bs); err != nil {
+		return err
+	}
+	t.Reads.unmarshal(bs[0:40])
+	t.ReadPrefixShift = bs[40]
+	if alen, err = fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN); err != nil {
+		return err
+	}
+	t.ReadsByPrefix = make([]ReadCounts, alen)
+	for i := range t.ReadsByPrefix {
+		bs = b[:40]
+		if _, err := io.ReadFull(wire, bs); err != nil {
+			return err
+		}
+		t.ReadsByPrefix[i].unmarshal(bs)
+	}
+	bs = b[:32]
+	if _, err := io.ReadFull(wire, bs); err != nil {
+		return err
+	}
+	t.StateKeys = int64(binary.LittleEndian.Uint64(bs[0:8]))
+	t.StateBytes = int64(binary.LittleEndian.Uint64(bs[8:16]))
+	t.MaxStateBytes = int64(binary.LittleEndian.Uint64(bs[16:24]))
+	t.StateRejected = binary.LittleEndian.Uint64(bs[24:32])
+	if alen, err = fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN); err != nil {
+		return err
+	}
+	t.Latencies = make([]LatencySummary, alen)
+	var lb [56]byte
+	for i := range t.Latencies {
+		l := &t.Latencies[i]
+		if l.Stage, err = unmarshalString(wire); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(wire, lb[:]); err != nil {
+			return err
+		}
+		l.Count = binary.LittleEndian.Uint64(lb[0:8])
+		l.MeanNs = int64(binary.LittleEndian.Uint64(lb[8:16]))
+		l.P50Ns = int64(binary.LittleEndian.Uint64(lb[16:24]))
+		l.P90Ns = int64(binary.LittleEndian.Uint64(lb[24:32]))
+		l.P99Ns = int64(binary.LittleEndian.Uint64(lb[32:40]))
+		l.P999Ns = int64(binary.LittleEndian.Uint64(lb[40:48]))
+		l.MaxNs = int64(binary.LittleEndian.Uint64(lb[48:56]))
+	}
+	return nil
+}
+
+func (t *QuorumRead) New() fastrpc.Serializable {
+	return new(QuorumRead)
+}
+
+func (t *QuorumRead) BinarySize() (nbytes int, sizeKnown bool) {
+	return 16, true
+}
+
+func (t *QuorumRead) Marshal(wire io.Writer) {
+	var b [16]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.ReadId))
+	binary.LittleEndian.PutUint64(b[8:16], uint64(t.Key))
+	wire.Write(b[:])
+}
+
+func (t *QuorumRead) Unmarshal(wire io.Reader) error {
+	var b [16]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.ReadId = int32(binary.LittleEndian.Uint32(b[4:8]))
+	t.Key = state.Key(binary.LittleEndian.Uint64(b[8:16]))
+	return nil
+}
+
+func (t *QuorumReadReply) New() fastrpc.Serializable {
+	return new(QuorumReadReply)
+}
+
+func (t *QuorumReadReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 32, true
+}
+
+func (t *QuorumReadReply) Marshal(wire io.Writer) {
+	var b [32]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.ReadId))
+	binary.LittleEndian.PutUint64(b[8:16], uint64(t.Value))
+	binary.LittleEndian.PutUint32(b[16:20], uint32(t.Accepted))
+	binary.LittleEndian.PutUint32(b[20:24], uint32(t.Applied))
+	binary.LittleEndian.PutUint64(b[24:32], t.Version)
+	wire.Write(b[:])
+}
+
+func (t *QuorumReadReply) Unmarshal(wire io.Reader) error {
+	var b [32]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.ReadId = int32(binary.LittleEndian.Uint32(b[4:8]))
+	t.Value = state.Value(binary.LittleEndian.Uint64(b[8:16]))
+	t.Accepted = int32(binary.LittleEndian.Uint32(b[16:20]))
+	t.Applied = int32(binary.LittleEndian.Uint32(b[20:24]))
+	t.Version = binary.LittleEndian.Uint64(b[24:32])
+	return nil
+}
+
+func (t *ReadIndex) New() fastrpc.Serializable {
+	return new(ReadIndex)
+}
+
+func (t *ReadIndex) BinarySize() (nbytes int, sizeKnown bool) {
+	return 8, true
+}
+
+func (t *ReadIndex) Marshal(wire io.Writer) {
+	var b [8]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.ReadId))
+	wire.Write(b[:])
+}
+
+func (t *ReadIndex) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.ReadId = int32(binary.LittleEndian.Uint32(b[4:8]))
+	return nil
+}
+
+func (t *ReadIndexReply) New() fastrpc.Serializable {
+	return new(ReadIndexReply)
+}
+
+func (t *ReadIndexReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 13, true
+}
+
+func (t *ReadIndexReply) Marshal(wire io.Writer) {
+	var b [13]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.ReadId))
+	binary.LittleEndian.PutUint32(b[8:12], uint32(t.Index))
+	b[12] = t.OK
+	wire.Write(b[:])
+}
+
+func (t *ReadIndexReply) Unmarshal(wire io.Reader) error {
+	var b [13]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.ReadId = int32(binary.LittleEndian.Uint32(b[4:8]))
+	t.Index = int32(binary.LittleEndian.Uint32(b[8:12]))
+	t.OK = b[12]
+	return nil
+}
+
+func (t *LeaderCheck) New() fastrpc.Serializable {
+	return new(LeaderCheck)
+}
+
+func (t *LeaderCheck) BinarySize() (nbytes int, sizeKnown bool) {
+	return 12, true
+}
+
+func (t *LeaderCheck) Marshal(wire io.Writer) {
+	var b [12]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.ReadId))
+	binary.LittleEndian.PutUint32(b[8:12], uint32(t.Ballot))
+	wire.Write(b[:])
+}
+
+func (t *LeaderCheck) Unmarshal(wire io.Reader) error {
+	var b [12]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.ReadId = int32(binary.LittleEndian.Uint32(b[4:8]))
+	t.Ballot = int32(binary.LittleEndian.Uint32(b[8:12]))
+	return nil
+}
+
+func (t *LeaderCheckReply) New() fastrpc.Serializable {
+	return new(LeaderCheckReply)
+}
+
+func (t *LeaderCheckReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 9, true
+}
+
+func (t *LeaderCheckReply) Marshal(wire io.Writer) {
+	var b [9]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.ReadId))
+	b[8] = t.OK
+	wire.Write(b[:])
+}
+
+func (t *LeaderCheckReply) Unmarshal(wire io.Reader) error {
+	var b [9]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.ReadId = int32(binary.LittleEndian.Uint32(b[4:8]))
+	t.OK = b[8]
+	return nil
+}
+
+func (t *StateDigest) New() fastrpc.Serializable {
+	return new(StateDigest)
+}
+
+func (t *StateDigest) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *StateDigest) Marshal(wire io.Writer) {
+	var b [8]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.Inst))
+	wire.Write(b[:])
+	marshalUint64s(wire, t.Nodes)
+}
+
+func (t *StateDigest) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [8]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.Inst = int32(binary.LittleEndian.Uint32(b[4:8]))
+	var err error
+	t.Nodes, err = unmarshalUint64s(wire)
+	return err
+}
+
+func (t *StateDigestReply) New() fastrpc.Serializable {
+	return new(StateDigestReply)
+}
+
+func (t *StateDigestReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *StateDigestReply) Marshal(wire io.Writer) {
+	var b [13]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.Inst))
+	b[8] = t.Found
+	binary.LittleEndian.PutUint32(b[9:13], uint32(t.Executed))
+	wire.Write(b[:])
+	marshalInt32s(wire, t.Subtrees)
+	marshalUint64s(wire, t.Leaves)
+}
+
+func (t *StateDigestReply) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [13]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.Inst = int32(binary.LittleEndian.Uint32(b[4:8]))
+	t.Found = b[8]
+	t.Executed = int32(binary.LittleEndian.Uint32(b[9:13]))
+	var err error
+	if t.Subtrees, err = unmarshalInt32s(wire); err != nil {
+		return err
+	}
+	t.Leaves, err = unmarshalUint64s(wire)
+	return err
+}
+
+func (t *StateKeys) New() fastrpc.Serializable {
+	return new(StateKeys)
+}
+
+func (t *StateKeys) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *StateKeys) Marshal(wire io.Writer) {
+	var b [8]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.Inst))
+	wire.Write(b[:])
+	marshalInt32s(wire, t.Leaves)
+}
+
+func (t *StateKeys) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [8]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.Inst = int32(binary.LittleEndian.Uint32(b[4:8]))
+	var err error
+	t.Leaves, err = unmarshalInt32s(wire)
+	return err
+}
+
+func (t *StateKeysReply) New() fastrpc.Serializable {
+	return new(StateKeysReply)
+}
+
+func (t *StateKeysReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *StateKeysReply) Marshal(wire io.Writer) {
+	var b [16]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.Inst))
+	b[8] = t.Found
+	wire.Write(b[:9])
+	bs := b[:]
+	if wlen := binary.PutVarint(bs, int64(len(t.Keys))); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := range t.Keys {
+		binary.LittleEndian.PutUint64(b[0:8], uint64(t.Keys[i]))
+		binary.LittleEndian.PutUint64(b[8:16], uint64(t.Values[i]))
+		wire.Write(b[:16])
+	}
+}
+
+func (t *StateKeysReply) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [16]byte
+	if _, err := io.ReadFull(wire, b[:9]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.Inst = int32(binary.LittleEndian.Uint32(b[4:8]))
+	t.Found = b[8]
+	n, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
+	if err != nil {
+		return err
+	}
+	t.Keys = make([]state.Key, n)
+	t.Values = make([]state.Value, n)
+	for i := range t.Keys {
+		if _, err := io.ReadFull(wire, b[:]); err != nil {
+			return err
+		}
+		t.Keys[i] = state.Key(binary.LittleEndian.Uint64(b[0:8]))
+		t.Values[i] = state.Value(binary.LittleEndian.Uint64(b[8:16]))
+	}
+	return nil
+}
+
+func marshalUint64s(wire io.Writer, s []uint64) {
+	var b [10]byte
+	bs := b[:]
+	if wlen := binary.PutVarint(bs, int64(len(s))); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for _, x := range s {
+		binary.LittleEndian.PutUint64(b[0:8], x)
+		wire.Write(b[:8])
+	}
+}
+
+func unmarshalUint64s(wire byteReader) ([]uint64, error) {
+	n, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
+	if err != nil {
+		return nil, err
+	}
+	s := make([]uint64, n)
+	var b [8]byte
+	for i := range s {
+		if _, err := io.ReadFull(wire, b[:]); err != nil {
+			return nil, err
+		}
+		s[i] = binary.LittleEndian.Uint64(b[:])
+	}
+	return s, nil
+}
+
+func marshalInt32s(wire io.Writer, s []int32) {
+	var b [10]byte
+	bs := b[:]
+	if wlen := binary.PutVarint(bs, int64(len(s))); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for _, x := range s {
+		binary.LittleEndian.PutUint32(b[0:4], uint32(x))
+		wire.Write(b[:4])
+	}
+}
+
+func unmarshalInt32s(wire byteReader) ([]int32, error) {
+	n, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
+	if err != nil {
+		return nil, err
+	}
+	s := make([]int32, n)
+	var b [4]byte
+	for i := range s {
+		if _, err := io.ReadFull(wire, b[:]); err != nil {
+			return nil, err
+		}
+		s[i] = int32(binary.LittleEndian.Uint32(b[:]))
+	}
+	return s, nil
+}
+
+func (t *Causal) New() fastrpc.Serializable {
+	return new(Causal)
+}
+
+func (t *Causal) BinarySize() (nbytes int, sizeKnown bool) {
+	return 8, true
+}
+
+func (t *Causal) Marshal(wire io.Writer) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], t.HLC)
+	wire.Write(b[:])
+}
+
+func (t *Causal) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.HLC = binary.LittleEndian.Uint64(b[:])
+	return nil
+}
+
+func (t *Session) New() fastrpc.Serializable {
+	return new(Session)
+}
+
+func (t *Session) BinarySize() (nbytes int, sizeKnown bool) {
+	return 8, true
+}
+
+func (t *Session) Marshal(wire io.Writer) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], t.ClientId)
+	wire.Write(b[:])
+}
+
+func (t *Session) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ClientId = binary.LittleEndian.Uint64(b[:])
+	return nil
+}
+
+func (t *ForwardPropose) New() fastrpc.Serializable {
+	return new(ForwardPropose)
+}
+
+func (t *ForwardPropose) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *ForwardPropose) Marshal(wire io.Writer) {
+	var b [17]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.FwdId))
+	binary.LittleEndian.PutUint64(b[8:16], uint64(t.TimeoutNs))
+	b[16] = t.Priority
+	wire.Write(b[:])
+	t.Propose.Marshal(wire)
+}
+
+func (t *ForwardPropose) Unmarshal(wire io.Reader) error {
+	var b [17]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.FwdId = int32(binary.LittleEndian.Uint32(b[4:8]))
+	t.TimeoutNs = int64(binary.LittleEndian.Uint64(b[8:16]))
+	t.Priority = b[16]
+	return t.Propose.Unmarshal(wire)
+}
+
+func (t *ForwardProposeReply) New() fastrpc.Serializable {
+	return new(ForwardProposeReply)
+}
+
+func (t *ForwardProposeReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *ForwardProposeReply) Marshal(wire io.Writer) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(t.FwdId))
+	wire.Write(b[:])
+	t.ProposeReplyTS.Marshal(wire)
+}
+
+func (t *ForwardProposeReply) Unmarshal(wire io.Reader) error {
+	var b [4]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.FwdId = int32(binary.LittleEndian.Uint32(b[:]))
+	return t.ProposeReplyTS.Unmarshal(wire)
+}
+
+func (t *RequestSnapshot) New() fastrpc.Serializable {
+	return new(RequestSnapshot)
+}
+
+func (t *RequestSnapshot) BinarySize() (nbytes int, sizeKnown bool) {
+	return 32, true
+}
+
+func (t *RequestSnapshot) Marshal(wire io.Writer) {
+	var b [32]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.Transfer))
+	binary.LittleEndian.PutUint64(b[8:16], uint64(t.SnapshotId))
+	binary.LittleEndian.PutUint64(b[16:24], uint64(t.Offset))
+	binary.LittleEndian.PutUint64(b[24:32], uint64(t.Length))
+	wire.Write(b[:])
+}
+
+func (t *RequestSnapshot) Unmarshal(wire io.Reader) error {
+	var b [32]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.Transfer = int32(binary.LittleEndian.Uint32(b[4:8]))
+	t.SnapshotId = int64(binary.LittleEndian.Uint64(b[8:16]))
+	t.Offset = int64(binary.LittleEndian.Uint64(b[16:24]))
+	t.Length = int64(binary.LittleEndian.Uint64(b[24:32]))
+	return nil
+}
+
+func (t *SnapshotChunk) New() fastrpc.Serializable {
+	return new(SnapshotChunk)
+}
+
+func (t *SnapshotChunk) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *SnapshotChunk) Marshal(wire io.Writer) {
+	var b [40]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.Transfer))
+	binary.LittleEndian.PutUint64(b[8:16], uint64(t.SnapshotId))
+	binary.LittleEndian.PutUint64(b[16:24], uint64(t.Size))
+	binary.LittleEndian.PutUint64(b[24:32], uint64(t.Offset))
+	binary.LittleEndian.PutUint32(b[32:36], t.Checksum)
+	binary.LittleEndian.PutUint32(b[36:40], uint32(len(t.Data)))
+	wire.Write(b[:])
+	wire.Write(t.Data)
+}
+
+func (t *SnapshotChunk) Unmarshal(wire io.Reader) error {
+	var b [40]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.Transfer = int32(binary.LittleEndian.Uint32(b[4:8]))
+	t.SnapshotId = int64(binary.LittleEndian.Uint64(b[8:16]))
+	t.Size = int64(binary.LittleEndian.Uint64(b[16:24]))
+	t.Offset = int64(binary.LittleEndian.Uint64(b[24:32]))
+	t.Checksum = binary.LittleEndian.Uint32(b[32:36])
+	n := binary.LittleEndian.Uint32(b[36:40])
+	if n > MAX_SNAPSHOT_CHUNK {
+		return fmt.Errorf("snapshot chunk of %d bytes", n)
+	}
+	t.Data = make([]byte, n)
+	_, err := io.ReadFull(wire, t.Data)
+	return err
+}
+
+func (t *Codec) New() fastrpc.Serializable {
+	return new(Codec)
+}
+
+func (t *Codec) BinarySize() (nbytes int, sizeKnown bool) {
+	return 1, true
+}
+
+func (t *Codec) Marshal(wire io.Writer) {
+	wire.Write([]byte{t.Codec})
+}
+
+func (t *Codec) Unmarshal(wire io.Reader) error {
+	var b [1]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.Codec = b[0]
+	return nil
+}
+
+func (t *CodecReply) New() fastrpc.Serializable {
+	return new(CodecReply)
+}
+
+func (t *CodecReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 1, true
+}
+
+func (t *CodecReply) Marshal(wire io.Writer) {
+	wire.Write([]byte{t.OK})
+}
+
+func (t *CodecReply) Unmarshal(wire io.Reader) error {
+	var b [1]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.OK = b[0]
+	return nil
+}
+
+func (t *ClockProbe) New() fastrpc.Serializable {
+	return new(ClockProbe)
+}
+
+func (t *ClockProbe) BinarySize() (nbytes int, sizeKnown bool) {
+	return 12, true
+}
+
+func (t *ClockProbe) Marshal(wire io.Writer) {
+	var b [12]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint64(b[4:12], uint64(t.Sent))
+	wire.Write(b[:])
+}
+
+func (t *ClockProbe) Unmarshal(wire io.Reader) error {
+	var b [12]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.Sent = int64(binary.LittleEndian.Uint64(b[4:12]))
+	return nil
+}
+
+func (t *ClockProbeReply) New() fastrpc.Serializable {
+	return new(ClockProbeReply)
+}
+
+func (t *ClockProbeReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 28, true
+}
+
+func (t *ClockProbeReply) Marshal(wire io.Writer) {
+	var b [28]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint64(b[4:12], uint64(t.Sent))
+	binary.LittleEndian.PutUint64(b[12:20], uint64(t.Received))
+	binary.LittleEndian.PutUint64(b[20:28], uint64(t.Replied))
+	wire.Write(b[:])
+}
+
+func (t *ClockProbeReply) Unmarshal(wire io.Reader) error {
+	var b [28]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.Sent = int64(binary.LittleEndian.Uint64(b[4:12]))
+	t.Received = int64(binary.LittleEndian.Uint64(b[12:20]))
+	t.Replied = int64(binary.LittleEndian.Uint64(b[20:28]))
+	return nil
+}
+
+func (t *RegionLeaseRequest) New() fastrpc.Serializable {
+	return new(RegionLeaseRequest)
+}
+
+func (t *RegionLeaseRequest) BinarySize() (nbytes int, sizeKnown bool) {
+	return 12, true
+}
+
+func (t *RegionLeaseRequest) Marshal(wire io.Writer) {
+	var b [12]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint64(b[4:12], uint64(t.Sent))
+	wire.Write(b[:])
+}
+
+func (t *RegionLeaseRequest) Unmarshal(wire io.Reader) error {
+	var b [12]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.Sent = int64(binary.LittleEndian.Uint64(b[4:12]))
+	return nil
+}
+
+func (t *RegionLease) New() fastrpc.Serializable {
+	return new(RegionLease)
+}
+
+func (t *RegionLease) BinarySize() (nbytes int, sizeKnown bool) {
+	return 24, true
+}
+
+func (t *RegionLease) Marshal(wire io.Writer) {
+	var b [24]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.LeaseInstance))
+	binary.LittleEndian.PutUint64(b[8:16], uint64(t.Sent))
+	binary.LittleEndian.PutUint64(b[16:24], uint64(t.DurationNs))
+	wire.Write(b[:])
+}
+
+func (t *RegionLease) Unmarshal(wire io.Reader) error {
+	var b [24]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.LeaseInstance = int32(binary.LittleEndian.Uint32(b[4:8]))
+	t.Sent = int64(binary.LittleEndian.Uint64(b[8:16]))
+	t.DurationNs = int64(binary.LittleEndian.Uint64(b[16:24]))
+	return nil
+}
+
+func (t *ConfigUpdate) New() fastrpc.Serializable {
+	return new(ConfigUpdate)
+}
+
+func (t *ConfigUpdate) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, true
+}
+
+func (t *ConfigUpdate) Marshal(wire io.Writer) {
+}
+
+func (t *ConfigUpdate) Unmarshal(wire io.Reader) error {
+	return nil
+}
+
+func (t *Deadline) New() fastrpc.Serializable {
+	return new(Deadline)
+}
+
+func (t *Deadline) BinarySize() (nbytes int, sizeKnown bool) {
+	return 8, true
+}
+
+func (t *Deadline) Marshal(wire io.Writer) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(t.TimeoutNs))
+	wire.Write(b[:])
+}
+
+func (t *Deadline) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.TimeoutNs = int64(binary.LittleEndian.Uint64(b[:]))
+	return nil
+}
+
+func (t *Priority) New() fastrpc.Serializable {
+	return new(Priority)
+}
+
+func (t *Priority) BinarySize() (nbytes int, sizeKnown bool) {
+	return 1, true
+}
+
+func (t *Priority) Marshal(wire io.Writer) {
+	wire.Write([]byte{t.Class})
+}
+
+func (t *Priority) Unmarshal(wire io.Reader) error {
+	var b [1]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.Class = b[0]
+	return nil
+}
+
+func (t *LeaseIdle) New() fastrpc.Serializable {
+	return new(LeaseIdle)
+}
+
+func (t *LeaseIdle) BinarySize() (nbytes int, sizeKnown bool) {
+	return 5, true
+}
+
+func (t *LeaseIdle) Marshal(wire io.Writer) {
+	var b [5]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	b[4] = t.Idle
+	wire.Write(b[:])
+}
+
+func (t *LeaseIdle) Unmarshal(wire io.Reader) error {
+	var b [5]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.ReplicaId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.Idle = b[4]
 	return nil
 }
@@ -0,0 +1,91 @@
+// Package hlc implements hybrid logical clocks: timestamps that stay close to
+// the wall clock, yet never go backwards and always exceed every timestamp
+// the clock has been shown, so that they order causally related events across
+// replicas and clients whose wall clocks disagree.
+//
+// A timestamp is a uint64 holding the wall clock in ns, with its low
+// LOGICAL_BITS bits replaced by a logical counter, so that timestamps compare
+// as integers. The counter only grows when the wall clock does not move
+// between events, or lags behind a timestamp the clock was shown.
+package hlc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const LOGICAL_BITS = 16
+
+const logicalMask = 1<<LOGICAL_BITS - 1
+
+type Clock struct {
+	lock *sync.Mutex
+	last uint64
+	wall func() int64
+}
+
+// New returns a clock following wall, which reads the time in ns (nil for
+// time.Now).
+func New(wall func() int64) *Clock {
+	if wall == nil {
+		wall = func() int64 { return time.Now().UnixNano() }
+	}
+	return &Clock{lock: new(sync.Mutex), wall: wall}
+}
+
+func (c *Clock) physical() uint64 {
+	return uint64(c.wall()) &^ logicalMask
+}
+
+// Now returns a timestamp for a local event (e.g., executing a command),
+// greater than every timestamp returned or seen before.
+func (c *Clock) Now() uint64 {
+	pt := c.physical()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if pt > c.last {
+		c.last = pt
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+// Update moves the clock past a timestamp received from elsewhere (e.g., a
+// client's causal token), and returns a timestamp for the receipt.
+func (c *Clock) Update(remote uint64) uint64 {
+	pt := c.physical()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if pt > c.last && pt > remote {
+		c.last = pt
+	} else if remote > c.last {
+		c.last = remote + 1
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+// Last returns the latest timestamp returned, without advancing the clock.
+func (c *Clock) Last() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.last
+}
+
+// Physical returns the wall clock part of a timestamp, in ns.
+func Physical(ts uint64) int64 {
+	return int64(ts &^ logicalMask)
+}
+
+// Logical returns the logical counter of a timestamp.
+func Logical(ts uint64) uint16 {
+	return uint16(ts & logicalMask)
+}
+
+// Format renders a timestamp for logs, as its wall clock time and counter.
+func Format(ts uint64) string {
+	return fmt.Sprintf("%s+%d", time.Unix(0, Physical(ts)).UTC().Format(time.RFC3339Nano), Logical(ts))
+}
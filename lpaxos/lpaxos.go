@@ -10,7 +10,10 @@ package lpaxos
 
 import (
 	"encoding/binary"
+	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 
 	"github.com/glycerine/qlease/dlog"
 	"github.com/glycerine/qlease/fastrpc"
@@ -34,13 +37,13 @@ type Replica struct {
 	commitShortChan     chan fastrpc.Serializable
 	prepareReplyChan    chan fastrpc.Serializable
 	acceptReplyChan     chan fastrpc.Serializable
-	proposeLeaseRPC     uint8
-	prepareRPC          uint8
-	acceptRPC           uint8
-	commitRPC           uint8
-	commitShortRPC      uint8
-	prepareReplyRPC     uint8
-	acceptReplyRPC      uint8
+	proposeLeaseRPC     uint16
+	prepareRPC          uint16
+	acceptRPC           uint16
+	commitRPC           uint16
+	commitShortRPC      uint16
+	prepareReplyRPC     uint16
+	acceptReplyRPC      uint16
 	IsLeader            bool        // does this replica think it is the leader
 	InstanceSpace       []*Instance // the space of all instances (used and not yet used)
 	crtInstance         int32       // highest active instance number that this replica knows about
@@ -49,7 +52,11 @@ type Replica struct {
 	counter             int
 	flush               bool
 	LeaderId            int32
-	LatestCommitted     int32
+	LatestCommitted     int32               // written by the run goroutine only (accessed atomically by others)
+	pa                  *lpaxosproto.Accept // scratch messages for broadcasts
+	pc                  *lpaxosproto.Commit
+	pcs                 *lpaxosproto.CommitShort
+	instLock            *sync.Mutex // guards the instances the run goroutine changes, for Instance
 }
 
 type InstanceStatus int
@@ -76,7 +83,18 @@ type LeaderBookkeeping struct {
 }
 
 func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool) *Replica {
-	r := &Replica{genericsmr.NewReplica(id, peerAddrList, thrifty, exec, dreply),
+	opts := []genericsmr.Option{genericsmr.WithThrifty(thrifty), genericsmr.WithExec(exec), genericsmr.WithDreply(dreply)}
+	if durable {
+		opts = append(opts, genericsmr.WithDurable(""))
+	}
+	return NewReplicaWithOptions(id, peerAddrList, opts...)
+}
+
+// NewReplicaWithOptions creates a replica configured through genericsmr options.
+// Its stable store defaults to a different file than that of the classic Paxos replica.
+func NewReplicaWithOptions(id int, peerAddrList []string, opts ...genericsmr.Option) *Replica {
+	opts = append([]genericsmr.Option{genericsmr.WithStableStorePath(fmt.Sprintf("stable-store-lease-replica%d", id))}, opts...)
+	r := &Replica{genericsmr.NewReplicaWithOptions(id, peerAddrList, opts...),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
@@ -93,9 +111,11 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 		0,
 		true,
 		-1,
-		-1}
-
-	r.Durable = durable
+		-1,
+		new(lpaxosproto.Accept),
+		new(lpaxosproto.Commit),
+		new(lpaxosproto.CommitShort),
+		new(sync.Mutex)}
 
 	r.proposeLeaseRPC = r.RegisterRPC(new(lpaxosproto.ProposeLease), r.ProposeLeaseChan)
 	r.prepareRPC = r.RegisterRPC(new(lpaxosproto.Prepare), r.prepareChan)
@@ -119,7 +139,7 @@ func (r *Replica) recordInstanceMetadata(inst *Instance) {
 	var b [5]byte
 	binary.LittleEndian.PutUint32(b[0:4], uint32(inst.ballot))
 	b[4] = byte(inst.Status)
-	r.StableStore.Write(b[:])
+	r.RecordToStableStore(genericsmr.RECORD_INSTANCE_METADATA, b[:])
 }
 
 //write a sequence of commands to stable storage
@@ -271,7 +291,7 @@ func (r *Replica) bcastPrepare(instance int32, ballot int32, toInfinity bool) {
 		if q == r.Id {
 			break
 		}
-		if !r.Alive[q] {
+		if !r.PeerAlive(q) {
 			continue
 		}
 		sent++
@@ -279,19 +299,18 @@ func (r *Replica) bcastPrepare(instance int32, ballot int32, toInfinity bool) {
 	}
 }
 
-var pa lpaxosproto.Accept
-
 func (r *Replica) bcastAccept(instance int32, ballot int32, leaseUpdate []qleaseproto.LeaseMetadata) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Println("Accept bcast failed:", err)
 		}
 	}()
+	pa := r.pa
 	pa.LeaderId = r.Id
 	pa.Instance = instance
 	pa.Ballot = ballot
 	pa.LeaseUpdate = leaseUpdate
-	args := &pa
+	args := pa
 
 	n := r.N - 1
 	if r.Thrifty {
@@ -304,7 +323,7 @@ func (r *Replica) bcastAccept(instance int32, ballot int32, leaseUpdate []qlease
 		if q == r.Id {
 			break
 		}
-		if !r.Alive[q] {
+		if !r.PeerAlive(q) {
 			continue
 		}
 		sent++
@@ -312,27 +331,25 @@ func (r *Replica) bcastAccept(instance int32, ballot int32, leaseUpdate []qlease
 	}
 }
 
-var pc lpaxosproto.Commit
-var pcs lpaxosproto.CommitShort
-
 func (r *Replica) bcastCommit(instance int32, ballot int32, leaseUpdate []qleaseproto.LeaseMetadata) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Println("Commit bcast failed:", err)
 		}
 	}()
+	pc, pcs := r.pc, r.pcs
 	pc.LeaderId = r.Id
 	pc.Instance = instance
 	pc.Ballot = ballot
 	pc.LeaseUpdate = leaseUpdate
 
-	args := &pc
+	args := pc
 
 	pcs.LeaderId = r.Id
 	pcs.Instance = instance
 	pcs.Ballot = ballot
 	pcs.Count = int32(len(leaseUpdate))
-	argsShort := &pcs
+	argsShort := pcs
 
 	n := r.N - 1
 	if r.Thrifty {
@@ -346,7 +363,7 @@ func (r *Replica) bcastCommit(instance int32, ballot int32, leaseUpdate []qlease
 		if q == r.Id {
 			break
 		}
-		if !r.Alive[q] {
+		if !r.PeerAlive(q) {
 			continue
 		}
 		sent++
@@ -358,7 +375,7 @@ func (r *Replica) bcastCommit(instance int32, ballot int32, leaseUpdate []qlease
 			if q == r.Id {
 				break
 			}
-			if !r.Alive[q] {
+			if !r.PeerAlive(q) {
 				continue
 			}
 			sent++
@@ -369,6 +386,17 @@ func (r *Replica) bcastCommit(instance int32, ballot int32, leaseUpdate []qlease
 
 //TODO: Propose lease updates
 
+// Instance returns a copy of lease instance i, for other goroutines than the
+// run goroutine, and whether there is one.
+func (r *Replica) Instance(i int32) (Instance, bool) {
+	r.instLock.Lock()
+	defer r.instLock.Unlock()
+	if r.InstanceSpace[i] == nil {
+		return Instance{}, false
+	}
+	return *r.InstanceSpace[i], true
+}
+
 func (r *Replica) handleProposeLease(propose *lpaxosproto.ProposeLease) {
 	if !r.IsLeader {
 		//TODO: should notify sender? not necessary, but may speed things up
@@ -383,19 +411,23 @@ func (r *Replica) handleProposeLease(propose *lpaxosproto.ProposeLease) {
 	r.crtInstance++
 
 	if r.defaultBallot == -1 {
+		r.instLock.Lock()
 		r.InstanceSpace[instNo] = &Instance{
 			propose.Updates,
 			r.makeUniqueBallot(0),
 			PREPARING,
 			&LeaderBookkeeping{0, 0, 0, 0}}
+		r.instLock.Unlock()
 		r.bcastPrepare(instNo, r.makeUniqueBallot(0), true)
 		dlog.Printf("Classic round for instance %d\n", instNo)
 	} else {
+		r.instLock.Lock()
 		r.InstanceSpace[instNo] = &Instance{
 			propose.Updates,
 			r.defaultBallot,
 			PREPARED,
 			&LeaderBookkeeping{0, 0, 0, 0}}
+		r.instLock.Unlock()
 
 		/*r.recordInstanceMetadata(r.InstanceSpace[instNo])
 		  r.recordCommands(cmds)
@@ -439,31 +471,37 @@ func (r *Replica) handleAccept(accept *lpaxosproto.Accept) {
 		if accept.Ballot < r.defaultBallot {
 			areply = &lpaxosproto.AcceptReply{accept.Instance, FALSE, r.defaultBallot}
 		} else {
+			r.instLock.Lock()
 			r.InstanceSpace[accept.Instance] = &Instance{
 				accept.LeaseUpdate,
 				accept.Ballot,
 				ACCEPTED,
 				nil}
+			r.instLock.Unlock()
 			areply = &lpaxosproto.AcceptReply{accept.Instance, TRUE, r.defaultBallot}
 		}
 	} else if inst.ballot > accept.Ballot {
 		areply = &lpaxosproto.AcceptReply{accept.Instance, FALSE, inst.ballot}
 	} else if inst.ballot < accept.Ballot {
+		r.instLock.Lock()
 		inst.Updates = accept.LeaseUpdate
 		inst.ballot = accept.Ballot
 		inst.Status = ACCEPTED
+		r.instLock.Unlock()
 		areply = &lpaxosproto.AcceptReply{accept.Instance, TRUE, inst.ballot}
 		//try to propose in a different instance or just give up?
 	} else {
 		// reordered ACCEPT
+		r.instLock.Lock()
 		r.InstanceSpace[accept.Instance].Updates = accept.LeaseUpdate
 		if r.InstanceSpace[accept.Instance].Status != COMMITTED {
 			r.InstanceSpace[accept.Instance].Status = ACCEPTED
 		} else {
 			if r.LatestCommitted < accept.Instance {
-				r.LatestCommitted = accept.Instance
+				atomic.StoreInt32(&r.LatestCommitted, accept.Instance)
 			}
 		}
+		r.instLock.Unlock()
 		areply = &lpaxosproto.AcceptReply{accept.Instance, TRUE, r.defaultBallot}
 	}
 
@@ -481,6 +519,7 @@ func (r *Replica) handleCommit(commit *lpaxosproto.Commit) {
 
 	dlog.Printf("Committing instance %d\n", commit.Instance)
 
+	r.instLock.Lock()
 	if inst == nil {
 		r.InstanceSpace[commit.Instance] = &Instance{
 			commit.LeaseUpdate,
@@ -493,9 +532,10 @@ func (r *Replica) handleCommit(commit *lpaxosproto.Commit) {
 		r.InstanceSpace[commit.Instance].ballot = commit.Ballot
 		//try to propose in a different instance or just give up?
 	}
+	r.instLock.Unlock()
 
 	if r.LatestCommitted < commit.Instance {
-		r.LatestCommitted = commit.Instance
+		atomic.StoreInt32(&r.LatestCommitted, commit.Instance)
 	}
 
 	/*r.recordInstanceMetadata(r.InstanceSpace[commit.Instance])
@@ -511,6 +551,7 @@ func (r *Replica) handleCommitShort(commit *lpaxosproto.CommitShort) {
 
 	dlog.Printf("Committing instance %d\n", commit.Instance)
 
+	r.instLock.Lock()
 	if inst == nil {
 		r.InstanceSpace[commit.Instance] = &Instance{nil,
 			commit.Ballot,
@@ -520,10 +561,11 @@ func (r *Replica) handleCommitShort(commit *lpaxosproto.CommitShort) {
 		r.InstanceSpace[commit.Instance].Status = COMMITTED
 		r.InstanceSpace[commit.Instance].ballot = commit.Ballot
 		if r.LatestCommitted < commit.Instance {
-			r.LatestCommitted = commit.Instance
+			atomic.StoreInt32(&r.LatestCommitted, commit.Instance)
 		}
 		//try to propose in a different instance or just give up?
 	}
+	r.instLock.Unlock()
 	//r.recordInstanceMetadata(r.InstanceSpace[commit.Instance])
 }
 
@@ -540,13 +582,17 @@ func (r *Replica) handlePrepareReply(preply *lpaxosproto.PrepareReply) {
 		inst.lb.prepareOKs++
 
 		if preply.Ballot > inst.lb.maxRecvBallot {
+			r.instLock.Lock()
 			inst.Updates = preply.LeaseUpdate
+			r.instLock.Unlock()
 			inst.lb.maxRecvBallot = preply.Ballot
 			//try to propose in a different instance or just give up?
 		}
 
 		if inst.lb.prepareOKs+1 > r.N>>1 {
+			r.instLock.Lock()
 			inst.Status = PREPARED
+			r.instLock.Unlock()
 			inst.lb.nacks = 0
 			if inst.ballot > r.defaultBallot {
 				r.defaultBallot = inst.ballot
@@ -579,14 +625,16 @@ func (r *Replica) handleAcceptReply(areply *lpaxosproto.AcceptReply) {
 		inst.lb.acceptOKs++
 		if inst.lb.acceptOKs+1 > r.N>>1 {
 			inst = r.InstanceSpace[areply.Instance]
+			r.instLock.Lock()
 			inst.Status = COMMITTED
+			r.instLock.Unlock()
 
 			/*
 			   r.recordInstanceMetadata(r.InstanceSpace[areply.Instance])
 			   r.sync()//is this necessary?*/
 
 			if r.LatestCommitted < areply.Instance {
-				r.LatestCommitted = areply.Instance
+				atomic.StoreInt32(&r.LatestCommitted, areply.Instance)
 			}
 
 			r.bcastCommit(areply.Instance, inst.ballot, inst.Updates)
@@ -84,13 +84,15 @@ func (t *ProposeLease) Unmarshal(rr io.Reader) error {
 		return err
 	}
 	t.ReplicaId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
-	alen1, err := binary.ReadVarint(wire)
+	alen1, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
 	if err != nil {
 		return err
 	}
 	t.Updates = make([]qleaseproto.LeaseMetadata, alen1)
 	for i := int64(0); i < alen1; i++ {
-		t.Updates[i].Unmarshal(wire)
+		if err := t.Updates[i].Unmarshal(wire); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -245,13 +247,15 @@ func (t *PrepareReply) Unmarshal(rr io.Reader) error {
 	t.Instance = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.OK = uint8(bs[4])
 	t.Ballot = int32((uint32(bs[5]) | (uint32(bs[6]) << 8) | (uint32(bs[7]) << 16) | (uint32(bs[8]) << 24)))
-	alen1, err := binary.ReadVarint(wire)
+	alen1, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
 	if err != nil {
 		return err
 	}
 	t.LeaseUpdate = make([]qleaseproto.LeaseMetadata, alen1)
 	for i := int64(0); i < alen1; i++ {
-		t.LeaseUpdate[i].Unmarshal(wire)
+		if err := t.LeaseUpdate[i].Unmarshal(wire); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -337,13 +341,15 @@ func (t *Accept) Unmarshal(rr io.Reader) error {
 	t.LeaderId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.Instance = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
 	t.Ballot = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
-	alen1, err := binary.ReadVarint(wire)
+	alen1, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
 	if err != nil {
 		return err
 	}
 	t.LeaseUpdate = make([]qleaseproto.LeaseMetadata, alen1)
 	for i := int64(0); i < alen1; i++ {
-		t.LeaseUpdate[i].Unmarshal(wire)
+		if err := t.LeaseUpdate[i].Unmarshal(wire); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -496,13 +502,15 @@ func (t *Commit) Unmarshal(rr io.Reader) error {
 	t.LeaderId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.Instance = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
 	t.Ballot = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
-	alen1, err := binary.ReadVarint(wire)
+	alen1, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
 	if err != nil {
 		return err
 	}
 	t.LeaseUpdate = make([]qleaseproto.LeaseMetadata, alen1)
 	for i := int64(0); i < alen1; i++ {
-		t.LeaseUpdate[i].Unmarshal(wire)
+		if err := t.LeaseUpdate[i].Unmarshal(wire); err != nil {
+			return err
+		}
 	}
 	return nil
 }
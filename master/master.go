@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/http"
 	"net/rpc"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -73,7 +74,7 @@ func (master *Master) run() {
 	// connect to SMR servers
 	for i := 0; i < master.N; i++ {
 		var err error
-		addr := fmt.Sprintf("%s:%d", master.addrList[i], master.portList[i]+1000)
+		addr := net.JoinHostPort(master.addrList[i], strconv.Itoa(master.portList[i]+1000))
 		master.nodes[i], err = rpc.DialHTTP("tcp", addr)
 		if err != nil {
 			log.Fatalf("Error connecting to replica %d\n", i)
@@ -123,8 +124,8 @@ func (master *Master) Register(args *masterproto.RegisterArgs, reply *masterprot
 	nlen := len(master.nodeList)
 	index := nlen
 
-	addrPort := fmt.Sprintf("%s:%d", args.Addr, args.Port)
-	leaseAddrPort := fmt.Sprintf("%s:%d", args.Addr, args.LeasePort)
+	addrPort := net.JoinHostPort(args.Addr, strconv.Itoa(args.Port))
+	leaseAddrPort := net.JoinHostPort(args.Addr, strconv.Itoa(args.LeasePort))
 
 	for i, ap := range master.nodeList {
 		if addrPort == ap {
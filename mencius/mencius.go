@@ -0,0 +1,736 @@
+// Package mencius is a Mencius replica built on genericsmr, with quorum read
+// leases. The coordinator of instance i is replica i mod N, so the replicas
+// take turns proposing, and every replica serves its own clients' writes in
+// one round trip to a majority, which suits deployments where writes
+// originate everywhere. A replica with nothing to propose skips its turns as
+// soon as it sees a later instance, and the turns of a coordinator that the
+// beacons (or a lost connection) show to have failed are revoked by the next
+// replica, through a Prepare phase followed by the usual Accept phase.
+//
+// Replicas read locally while they hold a read lease and no write to the key
+// is in flight; in exchange, writes under lease reach every replica that may
+// hold a lease before they commit (see genericsmr.LeaseAcks). Run replicas
+// with beacons enabled, so that failed coordinators are suspected before
+// their connections time out. Instances are not logged to the stable store.
+package mencius
+
+import (
+	"log"
+	"time"
+
+	"github.com/glycerine/qlease/dlog"
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/genericsmr"
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/menciusproto"
+	"github.com/glycerine/qlease/qleaseproto"
+	"github.com/glycerine/qlease/state"
+)
+
+const TRUE = uint8(1)
+const FALSE = uint8(0)
+
+const MAX_BATCH = 1
+
+const CLOCK_TICK_NS = 10 * 1e6 // 10 ms
+
+// number of ticks after which an instance still waiting for replies is sent
+// again to the replicas that have not acknowledged it
+const TICKS_TO_RESEND = 50
+
+// the lease instance every replica promises: every replica grants read
+// leases on every key to every other replica
+const LEASE_INSTANCE = 0
+
+// ballots carry the ID of the replica that picked them in their low 4 bits
+const MAX_REPLICAS = 16
+
+type InstanceStatus int8
+
+const (
+	NONE InstanceStatus = iota
+	ACCEPTED
+	COMMITTED
+	EXECUTED
+)
+
+type Instance struct {
+	cmds      []state.Command // empty for a no-op
+	ballot    int32           // the highest ballot promised
+	accBallot int32           // the ballot cmds were accepted in
+	status    InstanceStatus
+	marked    bool // are the keys of cmds marked as updating?
+	lb        *LeaderBookkeeping
+}
+
+type LeaderBookkeeping struct {
+	proposals  []*genericsmr.Propose // nil when revoking another replica's instance
+	ballot     int32
+	preparing  bool
+	prepareOKs int
+	found      bool // has some acceptor accepted commands in the instance?
+	foundBal   int32
+	foundCmds  []state.Command
+	acceptOKs  int
+	nacks      int
+	writes     bool                  // does the instance update a key under lease?
+	acks       *genericsmr.LeaseAcks // acknowledgments of the Accept phase
+	ticks      int                   // ticks spent waiting
+}
+
+type Replica struct {
+	*genericsmr.Replica // extends a generic replica
+	acceptChan          chan fastrpc.Serializable
+	acceptReplyChan     chan fastrpc.Serializable
+	commitChan          chan fastrpc.Serializable
+	skipChan            chan fastrpc.Serializable
+	prepareChan         chan fastrpc.Serializable
+	prepareReplyChan    chan fastrpc.Serializable
+	acceptRPC           uint16
+	acceptReplyRPC      uint16
+	commitRPC           uint16
+	skipRPC             uint16
+	prepareRPC          uint16
+	prepareReplyRPC     uint16
+	instanceSpace       []*Instance
+	nextOwn             int32          // the next instance this replica coordinates
+	maxSeen             int32          // the latest instance seen
+	executedUpTo        int32          // every instance up to this one has been executed
+	pending             map[int32]bool // instances this replica is proposing in
+	clockChan           chan bool
+	leaseClockChan      chan bool
+}
+
+// NewReplicaWithOptions creates a Mencius replica configured through
+// genericsmr options.
+func NewReplicaWithOptions(id int, peerAddrList []string, opts ...genericsmr.Option) *Replica {
+	if n := len(peerAddrList); n > MAX_REPLICAS {
+		log.Fatalf("Mencius supports at most %d replicas, not %d\n", MAX_REPLICAS, n)
+	}
+	r := &Replica{
+		Replica:          genericsmr.NewReplicaWithOptions(id, peerAddrList, opts...),
+		acceptChan:       make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		acceptReplyChan:  make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		commitChan:       make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		skipChan:         make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		prepareChan:      make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		prepareReplyChan: make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+		nextOwn:          int32(id),
+		maxSeen:          -1,
+		executedUpTo:     -1,
+		pending:          make(map[int32]bool),
+	}
+
+	r.InitParam(genericsmr.PARAM_MAX_BATCH, MAX_BATCH)
+	r.StateCuts = true
+
+	r.acceptRPC = r.RegisterRPC(new(menciusproto.Accept), r.acceptChan)
+	r.acceptReplyRPC = r.RegisterRPC(new(menciusproto.AcceptReply), r.acceptReplyChan)
+	r.commitRPC = r.RegisterRPC(new(menciusproto.Commit), r.commitChan)
+	r.skipRPC = r.RegisterRPC(new(menciusproto.Skip), r.skipChan)
+	r.prepareRPC = r.RegisterRPC(new(menciusproto.Prepare), r.prepareChan)
+	r.prepareReplyRPC = r.RegisterRPC(new(menciusproto.PrepareReply), r.prepareReplyChan)
+
+	go r.run()
+
+	return r
+}
+
+func (r *Replica) coordinator(i int32) int32 {
+	return i % int32(r.N)
+}
+
+func (r *Replica) instance(i int32) *Instance {
+	if int(i) >= len(r.instanceSpace) {
+		return nil
+	}
+	return r.instanceSpace[i]
+}
+
+func (r *Replica) getInstance(i int32) *Instance {
+	for int(i) >= len(r.instanceSpace) {
+		r.instanceSpace = append(r.instanceSpace, nil)
+	}
+	if r.instanceSpace[i] == nil {
+		r.instanceSpace[i] = new(Instance)
+	}
+	return r.instanceSpace[i]
+}
+
+func (r *Replica) makeBallotLargerThan(ballot int32) int32 {
+	return ((ballot>>4)+1)<<4 | r.Id
+}
+
+func (r *Replica) clock() {
+	for !r.Shutdown {
+		time.Sleep(CLOCK_TICK_NS)
+		r.clockChan <- true
+	}
+}
+
+func (r *Replica) leaseClock() {
+	for !r.Shutdown {
+		time.Sleep(r.NextLeaseRenewal())
+		r.leaseClockChan <- true
+	}
+}
+
+/* Main event processing loop */
+
+func (r *Replica) run() {
+	r.ConnectToPeers()
+
+	dlog.Println("Waiting for client connections")
+
+	go r.WaitForClientConnections()
+
+	var err error
+	if r.QLease, err = r.NewQLease(); err != nil {
+		log.Fatal(err)
+	}
+	r.QLease.PromisedByMeInst = LEASE_INSTANCE
+	r.RecordLeaseInstances(r.QLease)
+
+	if r.Beacon {
+		r.Beacons.Start()
+	}
+
+	r.clockChan = make(chan bool, 1)
+	go r.clock()
+	r.leaseClockChan = make(chan bool, 1)
+	go r.leaseClock()
+
+	for !r.Shutdown {
+
+		select {
+
+		case propose := <-r.ProposeChan:
+			dlog.Printf("Proposal with op %d\n", propose.Command.Op)
+			r.handlePropose(propose)
+			break
+
+		case aS := <-r.acceptChan:
+			a := aS.(*menciusproto.Accept)
+			dlog.Printf("Received Accept from replica %d, for instance %d\n", a.LeaderId, a.Instance)
+			r.handleAccept(a)
+			break
+
+		case arS := <-r.acceptReplyChan:
+			ar := arS.(*menciusproto.AcceptReply)
+			dlog.Printf("Received AcceptReply from replica %d, for instance %d\n", ar.AcceptorId, ar.Instance)
+			r.handleAcceptReply(ar)
+			break
+
+		case cS := <-r.commitChan:
+			c := cS.(*menciusproto.Commit)
+			dlog.Printf("Received Commit from replica %d, for instance %d\n", c.LeaderId, c.Instance)
+			r.handleCommit(c)
+			break
+
+		case sS := <-r.skipChan:
+			s := sS.(*menciusproto.Skip)
+			dlog.Printf("Received Skip from replica %d, for instances %d to %d\n", s.LeaderId, s.StartInstance, s.EndInstance)
+			r.handleSkip(s)
+			break
+
+		case pS := <-r.prepareChan:
+			p := pS.(*menciusproto.Prepare)
+			dlog.Printf("Received Prepare from replica %d, for instance %d\n", p.LeaderId, p.Instance)
+			r.handlePrepare(p)
+			break
+
+		case prS := <-r.prepareReplyChan:
+			pr := prS.(*menciusproto.PrepareReply)
+			dlog.Printf("Received PrepareReply from replica %d, for instance %d\n", pr.AcceptorId, pr.Instance)
+			r.handlePrepareReply(pr)
+			break
+
+		case <-r.clockChan:
+			r.checkPending()
+			r.checkRevocations()
+			break
+
+		case <-r.leaseClockChan:
+			// takes effect with the next guard or promise, which carry their own durations
+			r.RefreshLeaseTiming(r.QLease)
+			if r.WriteQuorumSafe() {
+				r.EstablishQLease(r.QLease)
+			} else {
+				r.RenewQLease(r.QLease, r.maxSeen)
+			}
+			break
+
+		case guardS := <-r.QLGuardChan:
+			r.HandleQLeaseGuard(r.QLease, guardS.(*qleaseproto.Guard))
+			break
+
+		case guardReplyS := <-r.QLGuardReplyChan:
+			r.HandleQLeaseGuardReply(r.QLease, guardReplyS.(*qleaseproto.GuardReply), r.maxSeen)
+			break
+
+		case promiseS := <-r.QLPromiseChan:
+			r.HandleQLeasePromise(r.QLease, promiseS.(*qleaseproto.Promise))
+			break
+
+		case preplyS := <-r.QLPromiseReplyChan:
+			r.HandleQLeaseReply(r.QLease, preplyS.(*qleaseproto.PromiseReply))
+			break
+
+		case grantS := <-r.QLRegionLeaseChan:
+			r.HandleRegionLease(r.QLease, grantS.(*genericsmrproto.RegionLease))
+			break
+
+		case beacon := <-r.BeaconChan:
+			dlog.Printf("Received Beacon from replica %d with timestamp %d\n", beacon.Rid, beacon.Timestamp)
+			r.ReplyBeacon(beacon)
+			break
+
+		case clr := <-r.ClientLeaseChan:
+			// client sub-leases would have to hold back the writes of every replica
+			r.DenyClientLease(clr, genericsmrproto.ERR_CONFLICT)
+			break
+		}
+	}
+
+	r.Beacons.Stop()
+}
+
+/* Leases */
+
+func (r *Replica) canReadLocally(k state.Key) bool {
+	ql := r.QLease
+	return ql.CanRead() && ql.Covers(k) && !r.IsUpdating(k)
+}
+
+func (r *Replica) writesUnderLease(cmds []state.Command) bool {
+	for i := range cmds {
+		if state.IsWrite(&cmds[i]) && r.QLease.Covers(cmds[i].K) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Proposing */
+
+func (r *Replica) handlePropose(propose *genericsmr.Propose) {
+	batchSize := len(r.ProposeChan) + 1
+	if maxBatch := int(r.Param(genericsmr.PARAM_MAX_BATCH)); batchSize > maxBatch {
+		batchSize = maxBatch
+	}
+
+	cmds := make([]state.Command, 0, batchSize)
+	proposals := make([]*genericsmr.Propose, 0, batchSize)
+	for i := 0; i < batchSize; i++ {
+		if i > 0 {
+			propose = <-r.ProposeChan
+		}
+		if r.DropExpired(propose) {
+			continue
+		}
+		if state.IsRead(&propose.Command) && r.canReadLocally(propose.Command.K) {
+			fence, _ := r.FencingToken()
+			e := propose.Command.Apply(r.State)
+			r.ReplyLocalRead(
+				&genericsmrproto.ProposeReplyTS{
+					OK:        TRUE,
+					CommandId: propose.CommandId,
+					Value:     e.Value,
+					Timestamp: propose.Timestamp,
+					ErrCode:   genericsmrproto.ERR_NONE,
+					Fence:     fence,
+					Version:   e.Version},
+				propose)
+			continue
+		}
+		cmds = append(cmds, propose.Command)
+		proposals = append(proposals, propose)
+	}
+	if len(cmds) == 0 {
+		return
+	}
+
+	// turns that another replica started revoking are its to decide
+	for inst := r.instance(r.nextOwn); inst != nil && (inst.ballot > 0 || inst.status != NONE); inst = r.instance(r.nextOwn) {
+		r.nextOwn += int32(r.N)
+	}
+	i := r.nextOwn
+	r.nextOwn += int32(r.N)
+	r.seen(i)
+	r.InstanceProposed(i)
+	inst := r.getInstance(i)
+	inst.lb = &LeaderBookkeeping{proposals: proposals, ballot: 0}
+	r.startAccept(i, inst, cmds)
+}
+
+// starts the Accept phase of an instance this replica proposes in
+func (r *Replica) startAccept(i int32, inst *Instance, cmds []state.Command) {
+	lb := inst.lb
+	lb.writes = r.writesUnderLease(cmds)
+	lb.acks = genericsmr.NewLeaseAcks(r.N)
+	until, reachable := r.LeaseObligations()
+	lb.acks.Note(r.Id, until, reachable)
+	r.acceptLocally(i, inst, lb.ballot, cmds)
+	r.pending[i] = true
+	r.bcastAccept(i, inst, false)
+	r.tryCommit(i, inst)
+}
+
+func (r *Replica) acceptLocally(i int32, inst *Instance, ballot int32, cmds []state.Command) {
+	if inst.marked {
+		r.ClearUpdating(i, inst.cmds)
+	}
+	inst.cmds = cmds
+	inst.ballot = ballot
+	inst.accBallot = ballot
+	inst.status = ACCEPTED
+	inst.marked = len(cmds) > 0
+	if inst.marked {
+		r.MarkUpdating(i, cmds)
+	}
+}
+
+func (r *Replica) bcastAccept(i int32, inst *Instance, missingOnly bool) {
+	a := &menciusproto.Accept{
+		LeaderId: r.Id,
+		Instance: i,
+		Ballot:   inst.lb.ballot,
+		Command:  inst.cmds}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !r.PeerAlive(q) || (missingOnly && inst.lb.acks.Acked(q)) {
+			continue
+		}
+		r.SendMsg(q, r.acceptRPC, a)
+	}
+}
+
+func (r *Replica) handleAcceptReply(ar *menciusproto.AcceptReply) {
+	inst := r.instance(ar.Instance)
+	if inst == nil || inst.lb == nil || inst.lb.preparing || inst.status != ACCEPTED {
+		// a late reply
+		return
+	}
+	lb := inst.lb
+	if ar.OK == FALSE {
+		// the instance is being revoked
+		lb.nacks++
+		return
+	}
+	if ar.Ballot != lb.ballot || lb.acks.Acked(ar.AcceptorId) {
+		return
+	}
+	lb.acceptOKs++
+	lb.acks.Note(ar.AcceptorId, ar.WriteInQuorumUntil, ar.Reachable)
+	r.tryCommit(ar.Instance, inst)
+}
+
+func (r *Replica) tryCommit(i int32, inst *Instance) {
+	lb := inst.lb
+	if inst.status != ACCEPTED || lb.preparing || lb.acceptOKs < r.N/2 {
+		return
+	}
+	if lb.writes && !lb.acks.Allows() {
+		return
+	}
+	inst.status = COMMITTED
+	delete(r.pending, i)
+	r.ProposalsCommitted(lb.proposals)
+	c := &menciusproto.Commit{
+		LeaderId: r.Id,
+		Instance: i,
+		Ballot:   lb.ballot,
+		Command:  inst.cmds}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id && r.PeerAlive(q) {
+			r.SendMsg(q, r.commitRPC, c)
+		}
+	}
+	if !r.Dreply {
+		for _, p := range lb.proposals {
+			r.ReplyProposeTS(
+				&genericsmrproto.ProposeReplyTS{
+					OK:        TRUE,
+					CommandId: p.CommandId,
+					Value:     state.NIL,
+					Timestamp: p.Timestamp,
+					ErrCode:   genericsmrproto.ERR_NONE},
+				p)
+		}
+	}
+	r.executeCommands()
+}
+
+// retries the instances waiting for replies or for the lease checks
+func (r *Replica) checkPending() {
+	for i := range r.pending {
+		inst := r.instance(i)
+		r.tryCommit(i, inst)
+		if inst.status != ACCEPTED && !inst.lb.preparing {
+			delete(r.pending, i)
+			continue
+		}
+		inst.lb.ticks++
+		if inst.lb.ticks%TICKS_TO_RESEND != 0 {
+			continue
+		}
+		if inst.lb.preparing {
+			// give up; the revocation starts over if still needed
+			delete(r.pending, i)
+			inst.lb = nil
+		} else {
+			r.bcastAccept(i, inst, true)
+		}
+	}
+}
+
+/* Skipping */
+
+// notes that instance i exists; this replica's turns before it are skipped
+func (r *Replica) seen(i int32) {
+	if i > r.maxSeen {
+		r.maxSeen = i
+	}
+	if r.nextOwn >= i {
+		return
+	}
+	start := r.nextOwn
+	for ; r.nextOwn < i; r.nextOwn += int32(r.N) {
+		r.commitNoop(r.nextOwn)
+	}
+	s := &menciusproto.Skip{LeaderId: r.Id, StartInstance: start, EndInstance: r.nextOwn - int32(r.N)}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id && r.PeerAlive(q) {
+			r.SendMsg(q, r.skipRPC, s)
+		}
+	}
+}
+
+func (r *Replica) commitNoop(i int32) {
+	inst := r.getInstance(i)
+	if inst.status >= COMMITTED {
+		return
+	}
+	if inst.marked {
+		r.ClearUpdating(i, inst.cmds)
+		inst.marked = false
+	}
+	inst.cmds = nil
+	inst.status = COMMITTED
+}
+
+func (r *Replica) handleSkip(s *menciusproto.Skip) {
+	for i := s.StartInstance; i <= s.EndInstance; i += int32(r.N) {
+		r.commitNoop(i)
+	}
+	r.seen(s.EndInstance)
+	r.executeCommands()
+}
+
+/* Accepting */
+
+func (r *Replica) handleAccept(a *menciusproto.Accept) {
+	inst := r.getInstance(a.Instance)
+	until, reachable := r.LeaseObligations()
+	reply := &menciusproto.AcceptReply{
+		AcceptorId:         r.Id,
+		Instance:           a.Instance,
+		OK:                 TRUE,
+		Ballot:             a.Ballot,
+		WriteInQuorumUntil: until,
+		Reachable:          reachable}
+	if a.Ballot < inst.ballot {
+		reply.OK = FALSE
+		reply.Ballot = inst.ballot
+	} else if inst.status < COMMITTED {
+		r.acceptLocally(a.Instance, inst, a.Ballot, a.Command)
+	}
+	r.SendMsg(a.LeaderId, r.acceptReplyRPC, reply)
+	r.seen(a.Instance)
+	r.executeCommands()
+}
+
+func (r *Replica) handleCommit(c *menciusproto.Commit) {
+	inst := r.getInstance(c.Instance)
+	if inst.status >= COMMITTED {
+		return
+	}
+	r.acceptLocally(c.Instance, inst, c.Ballot, c.Command)
+	inst.status = COMMITTED
+	if lb := inst.lb; lb != nil && len(lb.proposals) > 0 {
+		// this replica's turn was revoked
+		delete(r.pending, c.Instance)
+		if len(c.Command) == 0 {
+			// propose again, in a later turn
+			proposals := lb.proposals
+			lb.proposals = nil
+			go func() {
+				for _, p := range proposals {
+					r.ProposeChan <- p
+				}
+			}()
+		} else if !r.Dreply {
+			for _, p := range lb.proposals {
+				r.ReplyProposeTS(
+					&genericsmrproto.ProposeReplyTS{
+						OK:        TRUE,
+						CommandId: p.CommandId,
+						Value:     state.NIL,
+						Timestamp: p.Timestamp,
+						ErrCode:   genericsmrproto.ERR_NONE},
+					p)
+			}
+		}
+	}
+	r.seen(c.Instance)
+	r.executeCommands()
+}
+
+/* Revoking */
+
+func (r *Replica) suspected(q int32) bool {
+	return q != r.Id && (!r.PeerAlive(q) || r.Beacons.Suspected(q))
+}
+
+// the replica in charge of revoking q's turns: the next one that is not suspected
+func (r *Replica) revoker(q int32) int32 {
+	for d := int32(1); d < int32(r.N); d++ {
+		if p := (q + d) % int32(r.N); !r.suspected(p) {
+			return p
+		}
+	}
+	return r.Id
+}
+
+// revokes the turns of a suspected coordinator that hold up execution
+func (r *Replica) checkRevocations() {
+	i := r.executedUpTo + 1
+	if i > r.maxSeen {
+		return
+	}
+	if inst := r.instance(i); inst != nil && inst.status >= COMMITTED {
+		return
+	}
+	q := r.coordinator(i)
+	if !r.suspected(q) || r.revoker(q) != r.Id {
+		return
+	}
+	for ; i <= r.maxSeen; i += int32(r.N) {
+		if !r.pending[i] {
+			r.startRevocation(i)
+		}
+	}
+}
+
+func (r *Replica) startRevocation(i int32) {
+	inst := r.getInstance(i)
+	if inst.status >= COMMITTED {
+		return
+	}
+	dlog.Printf("Revoking instance %d of replica %d\n", i, r.coordinator(i))
+	lb := &LeaderBookkeeping{ballot: r.makeBallotLargerThan(inst.ballot), preparing: true}
+	inst.ballot = lb.ballot
+	if inst.status == ACCEPTED {
+		lb.found, lb.foundBal, lb.foundCmds = true, inst.accBallot, inst.cmds
+	}
+	inst.lb = lb
+	r.pending[i] = true
+	p := &menciusproto.Prepare{LeaderId: r.Id, Instance: i, Ballot: lb.ballot}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q != r.Id && r.PeerAlive(q) {
+			r.SendMsg(q, r.prepareRPC, p)
+		}
+	}
+	r.tryPrepared(i, inst)
+}
+
+func (r *Replica) handlePrepare(p *menciusproto.Prepare) {
+	inst := r.getInstance(p.Instance)
+	reply := &menciusproto.PrepareReply{
+		AcceptorId: r.Id,
+		Instance:   p.Instance,
+		OK:         TRUE,
+		Ballot:     p.Ballot}
+	if p.Ballot < inst.ballot {
+		reply.OK = FALSE
+		reply.Ballot = inst.ballot
+	} else {
+		inst.ballot = p.Ballot
+		if inst.status >= ACCEPTED {
+			reply.Accepted = TRUE
+			reply.AcceptedBallot = inst.accBallot
+			reply.Command = inst.cmds
+		}
+	}
+	r.SendMsg(p.LeaderId, r.prepareReplyRPC, reply)
+	r.seen(p.Instance)
+}
+
+func (r *Replica) handlePrepareReply(pr *menciusproto.PrepareReply) {
+	inst := r.instance(pr.Instance)
+	if inst == nil || inst.lb == nil || !inst.lb.preparing {
+		return
+	}
+	lb := inst.lb
+	if pr.OK == FALSE {
+		lb.nacks++
+		return
+	}
+	if pr.Ballot != lb.ballot {
+		return
+	}
+	lb.prepareOKs++
+	if pr.Accepted == TRUE && (!lb.found || pr.AcceptedBallot > lb.foundBal) {
+		lb.found, lb.foundBal, lb.foundCmds = true, pr.AcceptedBallot, pr.Command
+	}
+	r.tryPrepared(pr.Instance, inst)
+}
+
+// once a majority promised, proposes what the instance may have chosen
+// already (or a no-op)
+func (r *Replica) tryPrepared(i int32, inst *Instance) {
+	lb := inst.lb
+	if inst.status >= COMMITTED || lb.prepareOKs < r.N/2 {
+		return
+	}
+	lb.preparing = false
+	var cmds []state.Command
+	if lb.found {
+		cmds = lb.foundCmds
+	}
+	r.startAccept(i, inst, cmds)
+}
+
+/* Execution */
+
+func (r *Replica) executeCommands() {
+	for {
+		inst := r.instance(r.executedUpTo + 1)
+		if inst == nil || inst.status != COMMITTED {
+			return
+		}
+		i := r.executedUpTo + 1
+		if r.Exec {
+			r.ExecuteBatch(inst.cmds, func(j int, e state.Entry) {
+				if r.Dreply && inst.lb != nil && j < len(inst.lb.proposals) {
+					p := inst.lb.proposals[j]
+					r.ReplyProposeTS(
+						&genericsmrproto.ProposeReplyTS{
+							OK:        TRUE,
+							CommandId: p.CommandId,
+							Value:     e.Value,
+							Timestamp: p.Timestamp,
+							ErrCode:   genericsmrproto.ERR_NONE,
+							Version:   e.Version},
+						p)
+				}
+			})
+		}
+		if inst.marked {
+			r.ClearUpdating(i, inst.cmds)
+			inst.marked = false
+		}
+		inst.status = EXECUTED
+		r.executedUpTo = i
+		r.StateExecuted(i)
+	}
+}
@@ -0,0 +1,59 @@
+package menciusproto
+
+import (
+	"github.com/glycerine/qlease/state"
+)
+
+// Instance i is coordinated by replica i mod N. An empty Command is a no-op,
+// which is what a skipped instance commits.
+
+type Accept struct {
+	LeaderId int32
+	Instance int32
+	Ballot   int32 // 0 when sent by the coordinator of the instance
+	Command  []state.Command
+}
+
+type AcceptReply struct {
+	AcceptorId int32
+	Instance   int32
+	OK         uint8
+	Ballot     int32
+	// the acceptor's lease obligations (see genericsmr.LeaseObligations)
+	WriteInQuorumUntil int64
+	Reachable          uint64
+}
+
+type Commit struct {
+	LeaderId int32
+	Instance int32
+	Ballot   int32
+	Command  []state.Command
+}
+
+// Skip commits no-ops in the sender's instances from StartInstance to
+// EndInstance (both included): only the coordinator of an instance may
+// propose anything other than a no-op in it, so no agreement is needed.
+type Skip struct {
+	LeaderId      int32
+	StartInstance int32
+	EndInstance   int32
+}
+
+// Prepare and PrepareReply revoke an instance of a coordinator suspected to
+// have failed.
+type Prepare struct {
+	LeaderId int32
+	Instance int32
+	Ballot   int32
+}
+
+type PrepareReply struct {
+	AcceptorId     int32
+	Instance       int32
+	OK             uint8
+	Ballot         int32
+	Accepted       uint8 // has the acceptor accepted a command in the instance?
+	AcceptedBallot int32
+	Command        []state.Command
+}
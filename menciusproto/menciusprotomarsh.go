@@ -0,0 +1,216 @@
+package menciusproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/state"
+)
+
+type byteReader interface {
+	io.Reader
+	ReadByte() (c byte, err error)
+}
+
+func asByteReader(rr io.Reader) byteReader {
+	if wire, ok := rr.(byteReader); ok {
+		return wire
+	}
+	return bufio.NewReader(rr)
+}
+
+func marshalInt32s(wire io.Writer, vs ...int32) {
+	var b [16]byte
+	bs := b[:4*len(vs)]
+	for i, v := range vs {
+		binary.LittleEndian.PutUint32(bs[4*i:4*i+4], uint32(v))
+	}
+	wire.Write(bs)
+}
+
+func unmarshalInt32s(wire io.Reader, vs ...*int32) error {
+	var b [16]byte
+	bs := b[:4*len(vs)]
+	if _, err := io.ReadFull(wire, bs); err != nil {
+		return err
+	}
+	for i, v := range vs {
+		*v = int32(binary.LittleEndian.Uint32(bs[4*i : 4*i+4]))
+	}
+	return nil
+}
+
+func marshalCommands(wire io.Writer, cmds []state.Command) {
+	var b [10]byte
+	wlen := binary.PutVarint(b[:], int64(len(cmds)))
+	wire.Write(b[:wlen])
+	for i := range cmds {
+		cmds[i].Marshal(wire)
+	}
+}
+
+func unmarshalCommands(wire byteReader) ([]state.Command, error) {
+	n, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([]state.Command, n)
+	for i := range cmds {
+		if err := cmds[i].Unmarshal(wire); err != nil {
+			return nil, err
+		}
+	}
+	return cmds, nil
+}
+
+func (t *Accept) New() fastrpc.Serializable {
+	return new(Accept)
+}
+
+func (t *Accept) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *Accept) Marshal(wire io.Writer) {
+	marshalInt32s(wire, t.LeaderId, t.Instance, t.Ballot)
+	marshalCommands(wire, t.Command)
+}
+
+func (t *Accept) Unmarshal(rr io.Reader) error {
+	wire := asByteReader(rr)
+	var err error
+	if err = unmarshalInt32s(wire, &t.LeaderId, &t.Instance, &t.Ballot); err != nil {
+		return err
+	}
+	t.Command, err = unmarshalCommands(wire)
+	return err
+}
+
+func (t *AcceptReply) New() fastrpc.Serializable {
+	return new(AcceptReply)
+}
+
+func (t *AcceptReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 29, true
+}
+
+func (t *AcceptReply) Marshal(wire io.Writer) {
+	var b [29]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.AcceptorId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.Instance))
+	b[8] = t.OK
+	binary.LittleEndian.PutUint32(b[9:13], uint32(t.Ballot))
+	binary.LittleEndian.PutUint64(b[13:21], uint64(t.WriteInQuorumUntil))
+	binary.LittleEndian.PutUint64(b[21:29], t.Reachable)
+	wire.Write(b[:])
+}
+
+func (t *AcceptReply) Unmarshal(wire io.Reader) error {
+	var b [29]byte
+	if _, err := io.ReadFull(wire, b[:]); err != nil {
+		return err
+	}
+	t.AcceptorId = int32(binary.LittleEndian.Uint32(b[0:4]))
+	t.Instance = int32(binary.LittleEndian.Uint32(b[4:8]))
+	t.OK = b[8]
+	t.Ballot = int32(binary.LittleEndian.Uint32(b[9:13]))
+	t.WriteInQuorumUntil = int64(binary.LittleEndian.Uint64(b[13:21]))
+	t.Reachable = binary.LittleEndian.Uint64(b[21:29])
+	return nil
+}
+
+func (t *Commit) New() fastrpc.Serializable {
+	return new(Commit)
+}
+
+func (t *Commit) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *Commit) Marshal(wire io.Writer) {
+	marshalInt32s(wire, t.LeaderId, t.Instance, t.Ballot)
+	marshalCommands(wire, t.Command)
+}
+
+func (t *Commit) Unmarshal(rr io.Reader) error {
+	wire := asByteReader(rr)
+	var err error
+	if err = unmarshalInt32s(wire, &t.LeaderId, &t.Instance, &t.Ballot); err != nil {
+		return err
+	}
+	t.Command, err = unmarshalCommands(wire)
+	return err
+}
+
+func (t *Skip) New() fastrpc.Serializable {
+	return new(Skip)
+}
+
+func (t *Skip) BinarySize() (nbytes int, sizeKnown bool) {
+	return 12, true
+}
+
+func (t *Skip) Marshal(wire io.Writer) {
+	marshalInt32s(wire, t.LeaderId, t.StartInstance, t.EndInstance)
+}
+
+func (t *Skip) Unmarshal(wire io.Reader) error {
+	return unmarshalInt32s(wire, &t.LeaderId, &t.StartInstance, &t.EndInstance)
+}
+
+func (t *Prepare) New() fastrpc.Serializable {
+	return new(Prepare)
+}
+
+func (t *Prepare) BinarySize() (nbytes int, sizeKnown bool) {
+	return 12, true
+}
+
+func (t *Prepare) Marshal(wire io.Writer) {
+	marshalInt32s(wire, t.LeaderId, t.Instance, t.Ballot)
+}
+
+func (t *Prepare) Unmarshal(wire io.Reader) error {
+	return unmarshalInt32s(wire, &t.LeaderId, &t.Instance, &t.Ballot)
+}
+
+func (t *PrepareReply) New() fastrpc.Serializable {
+	return new(PrepareReply)
+}
+
+func (t *PrepareReply) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+func (t *PrepareReply) Marshal(wire io.Writer) {
+	marshalInt32s(wire, t.AcceptorId, t.Instance)
+	wire.Write([]byte{t.OK})
+	marshalInt32s(wire, t.Ballot)
+	wire.Write([]byte{t.Accepted})
+	marshalInt32s(wire, t.AcceptedBallot)
+	marshalCommands(wire, t.Command)
+}
+
+func (t *PrepareReply) Unmarshal(rr io.Reader) error {
+	wire := asByteReader(rr)
+	var err error
+	if err = unmarshalInt32s(wire, &t.AcceptorId, &t.Instance); err != nil {
+		return err
+	}
+	if t.OK, err = wire.ReadByte(); err != nil {
+		return err
+	}
+	if err = unmarshalInt32s(wire, &t.Ballot); err != nil {
+		return err
+	}
+	if t.Accepted, err = wire.ReadByte(); err != nil {
+		return err
+	}
+	if err = unmarshalInt32s(wire, &t.AcceptedBallot); err != nil {
+		return err
+	}
+	t.Command, err = unmarshalCommands(wire)
+	return err
+}
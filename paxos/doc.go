@@ -0,0 +1,21 @@
+// Package paxos is the reference protocol built on genericsmr: a leader-based
+// Multi-Paxos replicated key-value store that serves reads locally under
+// quorum read leases.
+//
+// The leader batches client proposals into instances and replicates them with
+// Prepare/Accept/Commit messages, registered with genericsmr.RegisterRPC.
+// Which keys each replica may read locally is decided by a separate lpaxos
+// log of lease configurations; the leases themselves are established and
+// renewed with the genericsmr lease handlers (guards, promises and their
+// replies), and writes to leased keys must be accepted by every grantee.
+// Durable replicas record instance metadata and commands to the stable store
+// before answering, and replicas that fall behind catch up from their peers.
+//
+// The server command runs it:
+//
+//	master -N 3 &
+//	server -port 7070 -lport 7060 -exec &
+//	server -port 7071 -lport 7061 -exec &
+//	server -port 7072 -lport 7062 -exec &
+//	client -q 5000 -w 50
+package paxos
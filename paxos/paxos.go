@@ -1,20 +1,21 @@
 package paxos
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/glycerine/qlease/dlog"
-	"github.com/glycerine/qlease/fastrpc"
 	"github.com/glycerine/qlease/genericsmr"
 	"github.com/glycerine/qlease/genericsmrproto"
 	"github.com/glycerine/qlease/lpaxos"
 	"github.com/glycerine/qlease/lpaxosproto"
 	"github.com/glycerine/qlease/paxosproto"
-	"github.com/glycerine/qlease/qlease"
 	"github.com/glycerine/qlease/qleaseproto"
 	"github.com/glycerine/qlease/state"
 )
@@ -28,24 +29,29 @@ const HT_INIT_SIZE = 150000
 const MAX_BATCH = 1
 const GRACE_PERIOD = 5 * 1e9
 
+// number of consecutive 2-second checks a gap in the log may persist before
+// the replica fetches the missing instances from the leader, and after which
+// a catch-up that makes no progress moves on to another peer
+const STALLED_CHECKS_TO_CATCH_UP = 2
+
 type Replica struct {
 	*genericsmr.Replica     // extends a generic Paxos replica
-	prepareChan             chan fastrpc.Serializable
-	acceptChan              chan fastrpc.Serializable
-	commitChan              chan fastrpc.Serializable
-	commitShortChan         chan fastrpc.Serializable
-	prepareReplyChan        chan fastrpc.Serializable
-	acceptReplyChan         chan fastrpc.Serializable
-	forwardChan             chan fastrpc.Serializable
-	forwardReplyChan        chan fastrpc.Serializable
-	prepareRPC              uint8
-	acceptRPC               uint8
-	commitRPC               uint8
-	commitShortRPC          uint8
-	prepareReplyRPC         uint8
-	acceptReplyRPC          uint8
-	forwardRPC              uint8
-	forwardReplyRPC         uint8
+	prepareChan             chan *paxosproto.Prepare
+	acceptChan              chan *paxosproto.Accept
+	commitChan              chan *paxosproto.Commit
+	commitShortChan         chan *paxosproto.CommitShort
+	prepareReplyChan        chan *paxosproto.PrepareReply
+	acceptReplyChan         chan *paxosproto.AcceptReply
+	forwardChan             chan *paxosproto.Forward
+	forwardReplyChan        chan *paxosproto.ForwardReply
+	prepareRPC              uint16
+	acceptRPC               uint16
+	commitRPC               uint16
+	commitShortRPC          uint16
+	prepareReplyRPC         uint16
+	acceptReplyRPC          uint16
+	forwardRPC              uint16
+	forwardReplyRPC         uint16
 	IsLeader                bool // does this replica think it is the leader
 	leaderId                int32
 	instanceSpace           []*Instance // the space of all instances (used and not yet used)
@@ -59,10 +65,9 @@ type Replica struct {
 	keyGranted              map[state.Key]bool    // map with keys granted to the current replica
 	latestAcceptedInst      int32                 // latest instance accepted or committed
 	delayedInstances        chan int32            // used to keep track of instances delayed because of lease mismatches
-	updating                map[state.Key]int
-	updatingLock            *sync.Mutex
-	newestInstanceIDontKnow int32
-	committedUpTo           int32
+	updatingLock            *sync.Mutex // serializes execution with the local reads that check Updating
+	newestInstanceIDontKnow int32 // written by the run goroutine, and read by reader (accessed atomically)
+	committedUpTo           int32 // written by the run goroutine, and read by the others (accessed atomically)
 	readsChannel            chan *genericsmr.Propose
 	fwdReadsChannel         chan *paxosproto.Forward
 	fwdPropMap              map[int32]*genericsmr.Propose
@@ -72,6 +77,23 @@ type Replica struct {
 	directAcks              bool
 	disasbledReplica        []bool
 	noReplicasDisabled      bool
+	catchingUp              bool  // fetching missed committed instances from a peer; no lease participation meanwhile
+	catchUpPeer             int32 // the peer we are catching up from
+	stalledChecks           int   // consecutive checks that found a gap below latestAcceptedInst (or no catch-up progress)
+	lastCommittedUpTo       int32 // committedUpTo at the previous check
+	clockChan               chan bool
+	leaseClockChan          chan bool
+	leaseClockRestart       chan bool
+	ticks                   int
+	newPromiseCount         int
+	pa                      *paxosproto.Accept // scratch messages for broadcasts
+	pc                      *paxosproto.Commit
+	pcs                     *paxosproto.CommitShort
+	executedUpTo            int32 // every instance up to this one has been executed
+	handoffFrom             int32 // the latest lease instance committed when this replica started draining
+	leader                  int64 // the leader and ballot Leader returns, packed (accessed atomically)
+	execLock                *sync.Mutex // orders the run goroutine's changes to committed instances with executeCommands
+	grantLock               *sync.Mutex // guards what isKeyGranted reads from reader: keyGranted, keyToQuorum, catchingUp and IsLeader
 }
 
 type InstanceStatus int8
@@ -103,15 +125,25 @@ type LeaderBookkeeping struct {
 }
 
 func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply bool, durable bool, beacon bool, leaseRep *lpaxos.Replica, directAcks bool) *Replica {
-	r := &Replica{genericsmr.NewReplica(id, peerAddrList, thrifty, exec, dreply),
-		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
-		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
-		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
-		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
-		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
-		make(chan fastrpc.Serializable, 3*genericsmr.CHAN_BUFFER_SIZE),
-		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
-		make(chan fastrpc.Serializable, genericsmr.CHAN_BUFFER_SIZE),
+	opts := []genericsmr.Option{genericsmr.WithThrifty(thrifty), genericsmr.WithExec(exec), genericsmr.WithDreply(dreply), genericsmr.WithBeacon(beacon)}
+	if durable {
+		opts = append(opts, genericsmr.WithDurable(""))
+	}
+	return NewReplicaWithOptions(id, peerAddrList, leaseRep, directAcks, opts...)
+}
+
+// NewReplicaWithOptions creates a replica configured through genericsmr options
+// (e.g., genericsmr.WithGroup, for a process that hosts several groups).
+func NewReplicaWithOptions(id int, peerAddrList []string, leaseRep *lpaxos.Replica, directAcks bool, opts ...genericsmr.Option) *Replica {
+	r := &Replica{genericsmr.NewReplicaWithOptions(id, peerAddrList, opts...),
+		make(chan *paxosproto.Prepare, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan *paxosproto.Accept, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan *paxosproto.Commit, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan *paxosproto.CommitShort, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan *paxosproto.PrepareReply, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan *paxosproto.AcceptReply, 3*genericsmr.CHAN_BUFFER_SIZE),
+		make(chan *paxosproto.Forward, genericsmr.CHAN_BUFFER_SIZE),
+		make(chan *paxosproto.ForwardReply, genericsmr.CHAN_BUFFER_SIZE),
 		0, 0, 0, 0, 0, 0, 0, 0,
 		false,
 		0,
@@ -126,7 +158,6 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 		make(map[state.Key]bool, HT_INIT_SIZE),
 		-1,
 		make(chan int32, genericsmr.CHAN_BUFFER_SIZE),
-		make(map[state.Key]int, 15000),
 		new(sync.Mutex),
 		-1,
 		-1,
@@ -138,19 +169,39 @@ func NewReplica(id int, peerAddrList []string, thrifty bool, exec bool, dreply b
 		true,
 		directAcks,
 		make([]bool, len(peerAddrList)),
-		true}
-
-	r.Durable = durable
-	r.Beacon = beacon
-
-	r.prepareRPC = r.RegisterRPC(new(paxosproto.Prepare), r.prepareChan)
-	r.acceptRPC = r.RegisterRPC(new(paxosproto.Accept), r.acceptChan)
-	r.commitRPC = r.RegisterRPC(new(paxosproto.Commit), r.commitChan)
-	r.commitShortRPC = r.RegisterRPC(new(paxosproto.CommitShort), r.commitShortChan)
-	r.prepareReplyRPC = r.RegisterRPC(new(paxosproto.PrepareReply), r.prepareReplyChan)
-	r.acceptReplyRPC = r.RegisterRPC(new(paxosproto.AcceptReply), r.acceptReplyChan)
-	r.forwardRPC = r.RegisterRPC(new(paxosproto.Forward), r.forwardChan)
-	r.forwardReplyRPC = r.RegisterRPC(new(paxosproto.ForwardReply), r.forwardReplyChan)
+		true,
+		false,
+		0,
+		0,
+		-1,
+		nil,
+		nil,
+		nil,
+		10,
+		0,
+		new(paxosproto.Accept),
+		new(paxosproto.Commit),
+		new(paxosproto.CommitShort),
+		-1,
+		-1,
+		0,
+		new(sync.Mutex),
+		new(sync.Mutex)}
+
+	r.publishLeader()
+	r.Log = r
+	r.StateCuts = true
+	r.Handoff = r
+	r.InitParam(genericsmr.PARAM_MAX_BATCH, MAX_BATCH)
+
+	r.prepareRPC = genericsmr.RegisterRPC(r.Replica, new(paxosproto.Prepare), r.prepareChan)
+	r.acceptRPC = genericsmr.RegisterRPC(r.Replica, new(paxosproto.Accept), r.acceptChan)
+	r.commitRPC = genericsmr.RegisterRPC(r.Replica, new(paxosproto.Commit), r.commitChan)
+	r.commitShortRPC = genericsmr.RegisterRPC(r.Replica, new(paxosproto.CommitShort), r.commitShortChan)
+	r.prepareReplyRPC = genericsmr.RegisterRPC(r.Replica, new(paxosproto.PrepareReply), r.prepareReplyChan)
+	r.acceptReplyRPC = genericsmr.RegisterRPC(r.Replica, new(paxosproto.AcceptReply), r.acceptReplyChan)
+	r.forwardRPC = genericsmr.RegisterRPC(r.Replica, new(paxosproto.Forward), r.forwardChan)
+	r.forwardReplyRPC = genericsmr.RegisterRPC(r.Replica, new(paxosproto.ForwardReply), r.forwardReplyChan)
 
 	go r.run()
 
@@ -166,7 +217,7 @@ func (r *Replica) recordInstanceMetadata(inst *Instance) {
 	var b [5]byte
 	binary.LittleEndian.PutUint32(b[0:4], uint32(inst.ballot))
 	b[4] = byte(inst.status)
-	r.StableStore.Write(b[:])
+	r.RecordToStableStore(genericsmr.RECORD_INSTANCE_METADATA, b[:])
 }
 
 //write a sequence of commands to stable storage
@@ -178,9 +229,11 @@ func (r *Replica) recordCommands(cmds []state.Command) {
 	if cmds == nil {
 		return
 	}
+	var buf bytes.Buffer
 	for i := 0; i < len(cmds); i++ {
-		cmds[i].Marshal(io.Writer(r.StableStore))
+		cmds[i].Marshal(io.Writer(&buf))
 	}
+	r.RecordToStableStore(genericsmr.RECORD_COMMANDS, buf.Bytes())
 }
 
 //sync with the stable store
@@ -189,52 +242,57 @@ func (r *Replica) sync() {
 		return
 	}
 
-	r.StableStore.Sync()
+	r.SyncStableStore()
 }
 
 /* RPC to be called by master */
 
 func (r *Replica) BeTheLeader(args *genericsmrproto.BeTheLeaderArgs, reply *genericsmrproto.BeTheLeaderReply) error {
+	r.grantLock.Lock()
 	r.IsLeader = true
+	r.grantLock.Unlock()
+	_, ballot := r.Leader()
+	r.publishLeading(ballot)
 	r.leaseSMR.BeTheLeader()
+	r.Audit(genericsmr.AUDIT_ADMIN, "BeTheLeader")
+	r.Audit(genericsmr.AUDIT_LEADER, "replica %d became the leader", r.Id)
 	return nil
 }
 
 /* ============= */
 
-var leaseClockChan chan bool
-var leaseClockRestart chan bool
-
-var clockChan chan bool
+const CLOCK_TICK_NS = 100 * 1e6 // 100 ms
 
 func (r *Replica) clock() {
 	for !r.Shutdown {
-		time.Sleep(100 * 1e6) // 100 ms
-		clockChan <- true
+		time.Sleep(CLOCK_TICK_NS)
+		r.clockChan <- true
 	}
 }
 
 //var hackflag int = 2
 const TICKS_TO_RECONF_LEASE = 20
 
-var ticks = 10
-
 func (r *Replica) leaseClock() {
 	for !r.Shutdown {
-		time.Sleep(500 * 1e6) // 500 ms
-		leaseClockChan <- true
-		<-leaseClockRestart
+		time.Sleep(r.NextLeaseRenewal())
+		r.leaseClockChan <- true
+		<-r.leaseClockRestart
 	}
 }
 
-var newPromiseCount int = 0
-
 /* Main event processing loop */
 
 func (r *Replica) run() {
 
 	r.ConnectToPeers()
 
+	// before the goroutines that read the lease
+	var err error
+	if r.QLease, err = r.NewQLease(); err != nil {
+		log.Fatal(err)
+	}
+
 	dlog.Println("Waiting for client connections")
 
 	go r.WaitForClientConnections()
@@ -245,54 +303,57 @@ func (r *Replica) run() {
 	}
 
 	if r.Id == 0 {
+		r.grantLock.Lock()
 		r.IsLeader = true
-		r.readStats = NewReadStats(r.N, r.Id)
+		r.grantLock.Unlock()
+		r.publishLeader()
+		r.readStats = NewReadStats(r.N, r.Id, r.Topology())
+		r.Audit(genericsmr.AUDIT_LEADER, "replica %d is the initial leader", r.Id)
 	}
 
-	clockChan = make(chan bool, 1)
+	r.clockChan = make(chan bool, 1)
 	go r.clock()
 
-	r.QLease = qlease.NewLease(r.N)
+	if r.Recovered != nil && r.N > 1 {
+		// the log did not survive the restart
+		r.SetRecovering(true)
+		r.startCatchUp(r.PreferredPeerOrder[0])
+	}
 
-	leaseClockChan = make(chan bool, 1)
-	leaseClockRestart = make(chan bool)
+	r.leaseClockChan = make(chan bool, 1)
+	r.leaseClockRestart = make(chan bool)
 	go r.leaseClock()
 
 	//	clockRang := false
 
 	var tickCounter uint64 = 0
-	latestBeaconFromReplica := make([]uint64, r.N)
 	proposedDead := make([]bool, r.N)
 	for i := 0; i < r.N; i++ {
-		latestBeaconFromReplica[i] = 0
 		proposedDead[i] = false
 	}
 
+	if r.Beacon {
+		r.Beacons.Start()
+	}
+
 	stopRenewing := false
+	proposedReinstate := make([]bool, r.N)
 
 	for !r.Shutdown {
 
 		select {
 
-		case <-clockChan:
+		case <-r.clockChan:
 			//clockRang = true
 			tickCounter++
 			if tickCounter%20 == 0 {
-				if r.Beacon {
-					for q := int32(0); q < int32(r.N); q++ {
-						if q == r.Id {
-							continue
-						}
-						r.SendBeacon(q)
-					}
-				}
 
 				if r.IsLeader && r.Beacon {
 					for rid := int32(0); rid < int32(r.N); rid++ {
 						if rid == r.Id {
 							continue
 						}
-						if !proposedDead[rid] && tickCounter-latestBeaconFromReplica[rid] >= 200 {
+						if !proposedDead[rid] && r.Beacons.Suspected(rid) {
 							log.Println("Proposing replica dead: ", rid)
 							//replica might be dead
 							//propose a lease configuration change
@@ -323,11 +384,36 @@ func (r *Replica) run() {
 					}
 				}
 
+				if r.Thrifty {
+					// move slow peers out of the preferred quorum (see genericsmr/shedding.go)
+					shed, _ := r.ShedSlowPeers()
+					if r.IsLeader && r.ShedLeases() && len(shed) > 0 {
+						log.Println("Proposing slow replicas out of the lease quorums: ", shed)
+						r.proposeReplicasDead(shed)
+					}
+				}
+
+				if r.IsLeader {
+					// a replica that was drained (or found dead or slow) and is back
+					for rid := int32(0); rid < int32(r.N); rid++ {
+						if rid != r.Id && r.disasbledReplica[rid] && r.PeerAlive(rid) && !r.PeerShed(rid) && !proposedReinstate[rid] {
+							log.Println("Proposing replica reinstated: ", rid)
+							r.proposeReplicasReinstated([]int32{rid})
+							proposedReinstate[rid] = true
+							proposedDead[rid] = false
+						}
+						if !r.disasbledReplica[rid] {
+							proposedReinstate[rid] = false
+						}
+					}
+				}
+
 				if r.IsLeader {
 					for i := r.committedUpTo; i >= 0 && i < r.crtInstance; i++ {
 						r.delayedInstances <- i
 					}
 				}
+				r.checkForGaps()
 			}
 			break
 
@@ -338,54 +424,46 @@ func (r *Replica) run() {
 			//clockRang = false
 			break
 
-		case forwardS := <-r.forwardChan:
-			forward := forwardS.(*paxosproto.Forward)
+		case forward := <-r.forwardChan:
 			dlog.Printf("Forward proposal from replica %d\n", forward.ReplicaId)
 			r.handleForward(forward)
 			break
 
-		case frS := <-r.forwardReplyChan:
-			fr := frS.(*paxosproto.ForwardReply)
+		case fr := <-r.forwardReplyChan:
 			r.handleForwardReply(fr)
 			break
 
-		case prepareS := <-r.prepareChan:
-			prepare := prepareS.(*paxosproto.Prepare)
+		case prepare := <-r.prepareChan:
 			//got a Prepare message
 			dlog.Printf("Received Prepare from replica %d, for instance %d\n", prepare.LeaderId, prepare.Instance)
 			r.handlePrepare(prepare)
 			break
 
-		case acceptS := <-r.acceptChan:
-			accept := acceptS.(*paxosproto.Accept)
+		case accept := <-r.acceptChan:
 			//got an Accept message
 			dlog.Printf("Received Accept from replica %d, for instance %d\n", accept.LeaderId, accept.Instance)
 			r.handleAccept(accept)
 			break
 
-		case commitS := <-r.commitChan:
-			commit := commitS.(*paxosproto.Commit)
+		case commit := <-r.commitChan:
 			//got a Commit message
 			dlog.Printf("Received Commit from replica %d, for instance %d\n", commit.LeaderId, commit.Instance)
 			r.handleCommit(commit)
 			break
 
-		case commitS := <-r.commitShortChan:
-			commit := commitS.(*paxosproto.CommitShort)
+		case commit := <-r.commitShortChan:
 			//got a Commit message
 			dlog.Printf("Received Commit from replica %d, for instance %d\n", commit.LeaderId, commit.Instance)
 			r.handleCommitShort(commit)
 			break
 
-		case prepareReplyS := <-r.prepareReplyChan:
-			prepareReply := prepareReplyS.(*paxosproto.PrepareReply)
+		case prepareReply := <-r.prepareReplyChan:
 			//got a Prepare reply
 			dlog.Printf("Received PrepareReply for instance %d\n", prepareReply.Instance)
 			r.handlePrepareReply(prepareReply)
 			break
 
-		case acceptReplyS := <-r.acceptReplyChan:
-			acceptReply := acceptReplyS.(*paxosproto.AcceptReply)
+		case acceptReply := <-r.acceptReplyChan:
 			//got an Accept reply
 			dlog.Printf("Received AcceptReply for instance %d\n", acceptReply.Instance)
 			r.handleAcceptReply(acceptReply)
@@ -398,16 +476,32 @@ func (r *Replica) run() {
 				inst.status = PREPARED
 				inst.lb.acceptOKs = 0
 				inst.ballot = r.makeBallotLargerThan(inst.ballot)
-				inst.lb.acceptOKsToWait, _ = r.bcastAccept(instNo, inst.ballot, inst.cmds, inst.lb.clientProposals[0].FwdReplica, inst.lb.clientProposals[0].FwdId)
-				if genericsmr.SendError {
+				var err error
+				inst.lb.acceptOKsToWait, err = r.bcastAccept(instNo, inst.ballot, inst.cmds, inst.lb.clientProposals[0].FwdReplica, inst.lb.clientProposals[0].FwdId)
+				if genericsmr.SendRetryable(err) {
 					r.delayedInstances <- instNo
 				}
 			}
 
+		case clr := <-r.ClientLeaseChan:
+			dlog.Printf("Client lease request for %d keys\n", len(clr.Keys))
+			r.handleClientLease(clr)
+			break
+
+		case reS := <-r.RequestEntriesChan:
+			re := reS.(*genericsmrproto.RequestEntries)
+			dlog.Printf("Replica %d requests entries from instance %d\n", re.ReplicaId, re.From)
+			r.handleRequestEntries(re)
+			break
+
+		case entriesS := <-r.EntriesChan:
+			entries := entriesS.(*genericsmrproto.Entries)
+			r.handleEntries(entries)
+			break
+
 		case beacon := <-r.BeaconChan:
 			dlog.Printf("Received Beacon from replica %d with timestamp %d\n", beacon.Rid, beacon.Timestamp)
-			//r.ReplyBeacon(beacon)
-			latestBeaconFromReplica[beacon.Rid] = tickCounter
+			r.ReplyBeacon(beacon)
 			break
 
 		case guardS := <-r.QLGuardChan:
@@ -428,12 +522,12 @@ func (r *Replica) run() {
 			}
 			if prev != r.QLease.PromisedToMeInst {
 				r.updateGrantedKeys(prev)
-				newPromiseCount = 0
+				r.newPromiseCount = 0
 			}
-			newPromiseCount++
-			if newPromiseCount <= r.N/2 {
+			r.newPromiseCount++
+			if r.newPromiseCount <= r.N/2 {
 				if r.newestInstanceIDontKnow < promise.LatestAcceptedInst {
-					r.newestInstanceIDontKnow = promise.LatestAcceptedInst
+					atomic.StoreInt32(&r.newestInstanceIDontKnow, promise.LatestAcceptedInst)
 				}
 			}
 			break
@@ -443,18 +537,34 @@ func (r *Replica) run() {
 			r.HandleQLeaseReply(r.QLease, preply)
 			break
 
-		case <-leaseClockChan:
-			if r.QLease.PromisedByMeInst < r.leaseSMR.LatestCommitted {
+		case grantS := <-r.QLRegionLeaseChan:
+			prev := r.QLease.PromisedToMeInst
+			if r.HandleRegionLease(r.QLease, grantS.(*genericsmrproto.RegionLease)) && prev != r.QLease.PromisedToMeInst {
+				r.updateGrantedKeys(prev)
+				r.newPromiseCount = 0
+			}
+			break
+
+		case <-r.leaseClockChan:
+			// takes effect with the next guard or promise, which carry their own durations
+			r.RefreshLeaseTiming(r.QLease)
+			if r.catchingUp {
+				// do not promise anything based on a log with holes
+			} else if r.Draining() {
+				// let the leases granted by this replica expire
+			} else if latest := atomic.LoadInt32(&r.leaseSMR.LatestCommitted); r.QLease.PromisedByMeInst < latest {
 				// wait for previous lease to expire before switching to new config
-				if r.QLease.CanWriteOutside() {
-					r.updateKeyQuorumInfo(r.leaseSMR.LatestCommitted)
-					r.QLease.PromisedByMeInst = r.leaseSMR.LatestCommitted
+				if r.PromisesExpired() {
+					r.updateKeyQuorumInfo(latest)
+					r.QLease.PromisedByMeInst = latest
+					r.RecordLeaseInstances(r.QLease)
 					log.Printf("Replica %d - New lease for instance %d\n", r.Id, r.QLease.PromisedByMeInst)
+					r.Audit(genericsmr.AUDIT_LEASE_CONFIG, "lease configuration of instance %d", r.QLease.PromisedByMeInst)
 					r.EstablishQLease(r.QLease)
 					stopRenewing = false
 				}
 			} else if r.QLease.PromisedByMeInst >= 0 {
-				if r.QLease.CanWriteOutside() {
+				if r.WriteQuorumSafe() {
 					r.EstablishQLease(r.QLease)
 					stopRenewing = false
 				} else if !stopRenewing {
@@ -463,45 +573,83 @@ func (r *Replica) run() {
 			}
 
 			if r.maintainReadStats {
-				ticks--
-				if ticks == 0 {
+				r.ticks--
+				if r.ticks == 0 {
 					r.maintainReadStats = false
 					if r.IsLeader && r.readStats != nil {
-						go r.proposeLeaseReconf()
+						// the read stats are the run goroutine's: only the proposal waits
+						lms := r.readStats.GetQuorums()
+						r.maintainReadStats = true
+						go r.proposeLeaseReconf(lms)
 					}
 
-					ticks = TICKS_TO_RECONF_LEASE
+					r.ticks = TICKS_TO_RECONF_LEASE
 					//ticks = 60
 				}
 			}
 			// restart the clock
-			leaseClockRestart <- true
+			r.leaseClockRestart <- true
 
 		case <-r.OnClientConnect:
-			log.Printf("reads: %d, local: %d\n", reads, local)
+			log.Printf("reads: %d, local: %d\n", atomic.LoadInt64(&reads), atomic.LoadInt64(&local))
 		}
 	}
+	r.Beacons.Stop()
 }
 
-func (r *Replica) proposeLeaseReconf() {
-	lms := r.readStats.GetQuorums()
+func (r *Replica) proposeLeaseReconf(lms []qleaseproto.LeaseMetadata) {
 	if lms != nil && len(lms) > 0 {
 		r.leaseSMR.ProposeLeaseChan <- &lpaxosproto.ProposeLease{r.Id, lms}
 		//r.readStats = NewReadStats(r.N, r.Id)
 	}
-	/*hackflag--
-	  if hackflag > 0 {
-	      r.maintainReadStats = true
-	  }*/
-	r.maintainReadStats = true
 }
 
 func (r *Replica) proposeReplicasDead(rids []int32) {
 	lms := make([]qleaseproto.LeaseMetadata, 1)
 	lms[0] = qleaseproto.LeaseMetadata{rids, nil, TRUE, FALSE}
+	r.Audit(genericsmr.AUDIT_MEMBERSHIP, "proposed to remove dead replicas %v from the lease quorums", rids)
+	r.leaseSMR.ProposeLeaseChan <- &lpaxosproto.ProposeLease{r.Id, lms}
+}
+
+func (r *Replica) proposeReplicasReinstated(rids []int32) {
+	lms := make([]qleaseproto.LeaseMetadata, 1)
+	lms[0] = qleaseproto.LeaseMetadata{rids, nil, FALSE, TRUE}
+	r.Audit(genericsmr.AUDIT_MEMBERSHIP, "proposed to return replicas %v to the lease quorums", rids)
 	r.leaseSMR.ProposeLeaseChan <- &lpaxosproto.ProposeLease{r.Id, lms}
 }
 
+// HandOffLeases and HandedOff let genericsmr drain the replica: the other
+// replicas stop granting it leases once they switch to a lease configuration
+// that ignores it.
+func (r *Replica) HandOffLeases() error {
+	atomic.StoreInt32(&r.handoffFrom, atomic.LoadInt32(&r.leaseSMR.LatestCommitted))
+	lms := []qleaseproto.LeaseMetadata{{[]int32{r.Id}, nil, TRUE, FALSE}}
+	if !r.leaseSMR.ProposeLeaseChange(lms) {
+		return fmt.Errorf("replica %d does not know the lease leader", r.Id)
+	}
+	r.Audit(genericsmr.AUDIT_MEMBERSHIP, "proposed to hand off the leases of replica %d", r.Id)
+	return nil
+}
+
+func (r *Replica) HandedOff() bool {
+	for i := atomic.LoadInt32(&r.handoffFrom) + 1; i <= atomic.LoadInt32(&r.leaseSMR.LatestCommitted); i++ {
+		inst, ok := r.leaseSMR.Instance(i)
+		if !ok || inst.Status != lpaxos.COMMITTED {
+			continue
+		}
+		for _, upd := range inst.Updates {
+			if upd.IgnoreReplicas == TRUE {
+				for _, id := range upd.Quorum {
+					if id == r.Id {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
 func (r *Replica) makeUniqueBallot(ballot int32) int32 {
 	return (ballot << 4) | r.Id
 }
@@ -519,22 +667,30 @@ func (r *Replica) replyAccept(replicaId int32, reply *paxosproto.AcceptReply) {
 }
 
 func (r *Replica) updateKeyQuorumInfo(li int32) {
-	if li < 0 || r.leaseSMR.InstanceSpace[li] == nil || r.leaseSMR.InstanceSpace[li].Status != lpaxos.COMMITTED {
+	if li < 0 {
+		return
+	}
+	if inst, ok := r.leaseSMR.Instance(li); !ok || inst.Status != lpaxos.COMMITTED {
 		return
 	}
 	for i := r.QLease.PromisedByMeInst + 1; i <= li; i++ {
-		for _, upd := range r.leaseSMR.InstanceSpace[i].Updates {
+		inst, ok := r.leaseSMR.Instance(i)
+		if !ok {
+			// committed before this replica (re)started: the lease log is not caught up
+			continue
+		}
+		for _, upd := range inst.Updates {
 			if upd.IgnoreReplicas == TRUE {
 				for _, id := range upd.Quorum {
 					r.disasbledReplica[id] = true
 					log.Println("Excluded replica ", id)
-					r.Alive[id] = false
+					r.PeerStates.Set(id, genericsmr.PEER_DEAD)
 				}
 				r.noReplicasDisabled = false
 			} else if upd.ReinstateReplicas == TRUE {
 				for _, id := range upd.Quorum {
 					r.disasbledReplica[id] = false
-					r.Alive[id] = true
+					r.PeerStates.Set(id, genericsmr.PEER_ALIVE)
 				}
 				r.noReplicasDisabled = true
 				for i := int32(0); i < int32(r.N); i++ {
@@ -544,9 +700,11 @@ func (r *Replica) updateKeyQuorumInfo(li int32) {
 					}
 				}
 			} else {
+				r.grantLock.Lock()
 				for _, k := range upd.ObjectKeys {
 					r.keyToQuorum[k] = upd.Quorum
 				}
+				r.grantLock.Unlock()
 			}
 		}
 	}
@@ -554,7 +712,11 @@ func (r *Replica) updateKeyQuorumInfo(li int32) {
 
 func (r *Replica) updateGrantedKeys(li int32) {
 	for i := li + 1; i <= r.QLease.PromisedToMeInst; i++ {
-		for _, upd := range r.leaseSMR.InstanceSpace[i].Updates {
+		inst, ok := r.leaseSMR.Instance(i)
+		if !ok {
+			continue
+		}
+		for _, upd := range inst.Updates {
 			found := false
 			for _, rid := range upd.Quorum {
 				if rid == r.Id {
@@ -562,6 +724,7 @@ func (r *Replica) updateGrantedKeys(li int32) {
 					break
 				}
 			}
+			r.grantLock.Lock()
 			for _, k := range upd.ObjectKeys {
 				if found {
 					r.keyGranted[k] = true
@@ -570,47 +733,92 @@ func (r *Replica) updateGrantedKeys(li int32) {
 					//TODO: is marking it false faster?
 				}
 			}
+			r.grantLock.Unlock()
 		}
 	}
 }
 
-func (r *Replica) addUpdatingKeys(cmds []state.Command) {
+func (r *Replica) addUpdatingKeys(inst int32, cmds []state.Command) {
 	r.updatingLock.Lock()
 	defer r.updatingLock.Unlock()
-	for i := 0; i < len(cmds); i++ {
-		if u, present := r.updating[cmds[i].K]; present {
-			r.updating[cmds[i].K] = u + 1
-		} else {
-			r.updating[cmds[i].K] = 1
-		}
-	}
+	r.MarkUpdating(inst, cmds)
 }
 
-func (r *Replica) removeUpdatingKeys(cmds []state.Command) {
+func (r *Replica) removeUpdatingKeys(inst int32, cmds []state.Command) {
 	r.updatingLock.Lock()
 	defer r.updatingLock.Unlock()
-	for i := 0; i < len(cmds); i++ {
-		if u, present := r.updating[cmds[i].K]; present {
-			r.updating[cmds[i].K] = u - 1
-		}
+	r.ClearUpdating(inst, cmds)
+}
+
+// ReadApplied and LatestAccepted let genericsmr serve strict reads.
+func (r *Replica) ReadApplied(k state.Key) (state.Entry, int32, bool) {
+	r.updatingLock.Lock()
+	defer r.updatingLock.Unlock()
+	get := state.Command{Op: state.GET, K: k, V: state.NIL}
+	return get.Apply(r.State), atomic.LoadInt32(&r.executedUpTo), r.IsUpdating(k)
+}
+
+func (r *Replica) LatestAccepted() int32 {
+	return atomic.LoadInt32(&r.latestAcceptedInst)
+}
+
+// Leader lets genericsmr serve read index reads. It may be called from any
+// goroutine: it returns what the protocol last published.
+func (r *Replica) Leader() (int32, int32) {
+	l := atomic.LoadInt64(&r.leader)
+	return int32(l >> 32), int32(l)
+}
+
+// publish who leads and the ballot promised, for Leader, whenever the run
+// goroutine changes them
+func (r *Replica) publishLeader() {
+	if r.IsLeader {
+		r.publishLeading(r.defaultBallot)
+		return
 	}
+	atomic.StoreInt64(&r.leader, int64(r.leaderId)<<32|int64(uint32(r.defaultBallot)))
 }
 
-func (r *Replica) isKeyUpdating(k state.Key) bool {
-	if u, present := r.updating[k]; present && u > 0 {
-		return true
+// publish this replica as the leader, at ballot (or a ballot of its own, if
+// it has promised none)
+func (r *Replica) publishLeading(ballot int32) {
+	if ballot <= -1 {
+		ballot = r.makeUniqueBallot(0)
 	}
-	return false
+	atomic.StoreInt64(&r.leader, int64(r.Id)<<32|int64(uint32(ballot)))
+}
+
+// serve a client read through ReadStrict, for read strategies other than
+// quorum leases
+func (r *Replica) readStrict(propose *genericsmr.Propose) {
+	e, err := r.ReadStrict(propose.Command.K)
+	if err != nil {
+		r.ReplyProposeErr(propose, genericsmrproto.ERR_TIMEOUT, err.Error())
+		return
+	}
+	r.ReplyProposeTS(
+		&genericsmrproto.ProposeReplyTS{
+			TRUE,
+			propose.CommandId,
+			e.Value,
+			propose.Timestamp,
+			genericsmrproto.ERR_NONE, "", 0, 0, e.Version},
+		propose)
 }
 
 func (r *Replica) updateCommittedUpTo() {
 	for r.instanceSpace[r.committedUpTo+1] != nil &&
 		r.instanceSpace[r.committedUpTo+1].status == COMMITTED {
-		r.committedUpTo++
+		atomic.StoreInt32(&r.committedUpTo, r.committedUpTo+1)
 	}
 }
 
 func (r *Replica) isKeyGranted(key state.Key) bool {
+	r.grantLock.Lock()
+	defer r.grantLock.Unlock()
+	if r.catchingUp {
+		return false
+	}
 	if _, present := r.keyGranted[key]; !present {
 		//return false
 		if !r.IsLeader {
@@ -623,6 +831,12 @@ func (r *Replica) isKeyGranted(key state.Key) bool {
 	return true
 }
 
+func (r *Replica) setCatchingUp(catchingUp bool) {
+	r.grantLock.Lock()
+	r.catchingUp = catchingUp
+	r.grantLock.Unlock()
+}
+
 func (r *Replica) isMyLeaseActive() bool {
 	if r.QLease == nil || !r.QLease.CanRead() {
 		return false
@@ -655,7 +869,7 @@ func (r *Replica) getLeaseQuorumForKey(key state.Key, originReplica int32) []int
 	}
 
 	if r.noReplicasDisabled {
-		return q
+		return r.SpreadOverZones(q)
 	}
 
 	taken := make([]bool, r.N)
@@ -680,7 +894,7 @@ func (r *Replica) getLeaseQuorumForKey(key state.Key, originReplica int32) []int
 		//not enough valid replicas to form a quorum
 		return nil
 	}
-	return newQuorum
+	return r.SpreadOverZones(newQuorum)
 }
 
 func quorumToInt64(q []int32) int64 {
@@ -702,14 +916,13 @@ func (r *Replica) bcastPrepare(instance int32, ballot int32, toInfinity bool) er
 	if r.Thrifty {
 		n = r.N >> 1
 	}
-	q := r.Id
 
-	for sent := 0; sent < n; {
-		q = (q + 1) % int32(r.N)
-		if q == r.Id {
+	sent := 0
+	for _, q := range r.PreferredPeerOrder {
+		if sent >= n {
 			break
 		}
-		if !r.Alive[q] {
+		if q == r.Id || !r.PeerAlive(q) {
 			continue
 		}
 		sent++
@@ -718,9 +931,8 @@ func (r *Replica) bcastPrepare(instance int32, ballot int32, toInfinity bool) er
 	return nil
 }
 
-var pa paxosproto.Accept
-
 func (r *Replica) bcastAccept(instance int32, ballot int32, command []state.Command, originReplica int32, fwdId int32) (int, error) {
+	pa := r.pa
 	pa.LeaderId = r.Id
 	pa.Instance = instance
 	pa.Ballot = ballot
@@ -728,7 +940,7 @@ func (r *Replica) bcastAccept(instance int32, ballot int32, command []state.Comm
 	pa.LeaseInstance = r.QLease.PromisedByMeInst
 	pa.OriginReplica = originReplica
 	pa.PropId = fwdId
-	args := &pa
+	args := pa
 
 	q := r.getLeaseQuorumForKey(command[0].K, originReplica)
 	sent := 0
@@ -746,16 +958,14 @@ func (r *Replica) bcastAccept(instance int32, ballot int32, command []state.Comm
 	return sent, nil
 }
 
-var pc paxosproto.Commit
-var pcs paxosproto.CommitShort
-
 func (r *Replica) bcastCommit(instance int32, ballot int32, command []state.Command) error {
+	pc, pcs := r.pc, r.pcs
 	pc.LeaderId = r.Id
 	pc.Instance = instance
 	pc.Ballot = ballot
 	pc.Command = command
 
-	args := &pc
+	args := pc
 
 	pcs.LeaderId = r.Id
 	pcs.Instance = instance
@@ -780,7 +990,7 @@ func (r *Replica) bcastCommit(instance int32, ballot int32, command []state.Comm
 	       if q == r.Id {
 	           break
 	       }
-	       if !r.Alive[q] {
+	       if !r.PeerAlive(q) {
 	           continue
 	       }
 	       sent++
@@ -792,7 +1002,7 @@ func (r *Replica) bcastCommit(instance int32, ballot int32, command []state.Comm
 		if q == r.Id {
 			break
 		}
-		if !r.Alive[q] {
+		if !r.PeerAlive(q) {
 			continue
 		}
 		sent++
@@ -802,8 +1012,8 @@ func (r *Replica) bcastCommit(instance int32, ballot int32, command []state.Comm
 	return nil
 }
 
-var reads int = 0
-var local int = 0
+var reads int64 = 0 // accessed atomically
+var local int64 = 0 // accessed atomically
 
 func (r *Replica) handlePropose(propose *genericsmr.Propose) {
 
@@ -814,13 +1024,18 @@ func (r *Replica) handlePropose(propose *genericsmr.Propose) {
 
 	totalLen := len(r.ProposeChan) + 1
 
-	if totalLen > MAX_BATCH {
-		totalLen = MAX_BATCH
+	if maxBatch := int(r.Param(genericsmr.PARAM_MAX_BATCH)); totalLen > maxBatch {
+		totalLen = maxBatch
 	}
 
 	for i := 0; i < totalLen; i++ {
-		if state.IsRead(&propose.Command) && (r.IsLeader || r.isKeyGranted(propose.Command.K)) {
-			reads++
+		if r.DropExpired(propose) {
+			// its client has given up on it
+		} else if state.IsRead(&propose.Command) && !r.ReadsByLease() {
+			atomic.AddInt64(&reads, 1)
+			go r.readStrict(propose)
+		} else if state.IsRead(&propose.Command) && (r.IsLeader || r.isKeyGranted(propose.Command.K)) {
+			atomic.AddInt64(&reads, 1)
 			//make sure that the channel is not going to be full,
 			//because this may cause the consumer to block when trying to
 			//put request back
@@ -828,13 +1043,16 @@ func (r *Replica) handlePropose(propose *genericsmr.Propose) {
 				time.Sleep(1000)
 			}
 			r.readsChannel <- propose
-		} else if !r.IsLeader {
-			if state.IsRead(&propose.Command) {
-				reads++
-			}
+		} else if !r.IsLeader && state.IsRead(&propose.Command) {
+			atomic.AddInt64(&reads, 1)
 			r.fwdId++
 			r.fwdPropMap[r.fwdId] = propose
 			r.SendMsg(r.leaderId, r.forwardRPC, &paxosproto.Forward{r.Id, r.fwdId, propose.Command})
+		} else if !r.IsLeader {
+			r.ForwardPropose(r.leaderId, propose)
+		} else if r.ClientLeases.BlockedUntil([]state.Command{propose.Command}) > 0 {
+			// a client holds a sub-lease on the key
+			go r.delayPropose(propose)
 		} else {
 			q := quorumToInt64(r.getLeaseQuorumForKey(propose.Command.K, r.Id))
 			var cmds []state.Command
@@ -892,6 +1110,7 @@ func (r *Replica) handlePropose(propose *genericsmr.Propose) {
 			status,
 			&LeaderBookkeeping{props, 0, 0, 0, 0, 0},
 			0, false}
+		r.InstanceProposed(r.crtInstance)
 		if status == PREPARING {
 			r.bcastPrepare(r.crtInstance, ballot, true)
 			dlog.Printf("Classic round for instance %d\n", r.crtInstance)
@@ -905,13 +1124,14 @@ func (r *Replica) handlePropose(propose *genericsmr.Propose) {
 			}
 
 			if props[0].FwdReplica >= 0 && props[0].FwdReplica != r.Id {
-				r.addUpdatingKeys(cmds)
+				r.addUpdatingKeys(r.crtInstance, cmds)
 			}
 
 			//TODO: make sure it supports Forwards
-			r.instanceSpace[r.crtInstance].lb.acceptOKsToWait, _ = r.bcastAccept(r.crtInstance, ballot, cmds, props[0].FwdReplica, props[0].FwdId)
+			var err error
+			r.instanceSpace[r.crtInstance].lb.acceptOKsToWait, err = r.bcastAccept(r.crtInstance, ballot, cmds, props[0].FwdReplica, props[0].FwdId)
 			dlog.Printf("Fast round for instance %d\n", r.crtInstance)
-			if genericsmr.SendError {
+			if genericsmr.SendRetryable(err) {
 				log.Println("BCAST ERROR")
 				r.delayedInstances <- r.crtInstance
 			}
@@ -934,7 +1154,10 @@ func (r *Replica) handleForward(fwd *paxosproto.Forward) {
 		r.fwdReadsChannel <- fwd
 	} else {
 		// the forward is a write
-		r.handlePropose(&genericsmr.Propose{&genericsmrproto.Propose{0, fwd.Command, 0}, fwd.ReplicaId, fwd.PropId, nil, nil})
+		if r.DuplicateForward(fwd.ReplicaId, fwd.PropId) {
+			return
+		}
+		r.handlePropose(&genericsmr.Propose{&genericsmrproto.Propose{0, fwd.Command, 0}, fwd.ReplicaId, fwd.PropId, nil, nil, nil, 0, 0, 0, r.Clock.Nanos(), 0})
 	}
 }
 
@@ -944,7 +1167,8 @@ func (r *Replica) handleForwardReply(fr *paxosproto.ForwardReply) {
 		fr.OK,
 		prop.CommandId,
 		fr.Value,
-		prop.Timestamp},
+		prop.Timestamp,
+		genericsmrproto.ERR_NONE, "", 0, 0, fr.Version},
 		prop)
 	delete(r.fwdPropMap, fr.PropId)
 }
@@ -971,12 +1195,23 @@ func (r *Replica) handlePrepare(prepare *paxosproto.Prepare) {
 
 	if prepare.ToInfinity == TRUE && prepare.Ballot > r.defaultBallot {
 		r.defaultBallot = prepare.Ballot
+		if r.leaderId != prepare.LeaderId {
+			r.Audit(genericsmr.AUDIT_LEADER, "replica %d is the leader (ballot %d)", prepare.LeaderId, prepare.Ballot)
+		}
+		r.leaderId = prepare.LeaderId
+		r.publishLeader()
 		//update leader id for the lease-maintaining Paxos replica
 		r.leaseSMR.LeaderId = prepare.LeaderId
 	}
 }
 
 func (r *Replica) handleAccept(accept *paxosproto.Accept) {
+	if r.ClientLeases.BlockedUntil(accept.Command) > 0 {
+		// do not acknowledge the write while a client may read the old value
+		go r.delayAccept(accept)
+		return
+	}
+
 	inst := r.instanceSpace[accept.Instance]
 	var areply *paxosproto.AcceptReply
 
@@ -991,15 +1226,15 @@ func (r *Replica) handleAccept(accept *paxosproto.Accept) {
 				nil,
 				1, false}
 			areply = &paxosproto.AcceptReply{accept.Instance, TRUE, accept.Ballot, -1, accept.OriginReplica, accept.PropId}
-			r.addUpdatingKeys(accept.Command)
+			r.addUpdatingKeys(accept.Instance, accept.Command)
 		}
 	} else if inst.ballot > accept.Ballot {
 		areply = &paxosproto.AcceptReply{accept.Instance, FALSE, inst.ballot, -1, accept.OriginReplica, accept.PropId}
 	} else if inst.ballot < accept.Ballot && inst.status != COMMITTED {
 		if inst.cmds != nil {
-			r.removeUpdatingKeys(inst.cmds)
+			r.removeUpdatingKeys(accept.Instance, inst.cmds)
 		}
-		r.addUpdatingKeys(accept.Command)
+		r.addUpdatingKeys(accept.Instance, accept.Command)
 		inst.cmds = accept.Command
 		inst.ballot = accept.Ballot
 		inst.status = ACCEPTED
@@ -1015,7 +1250,9 @@ func (r *Replica) handleAccept(accept *paxosproto.Accept) {
 		}
 	} else {
 		// reordered ACCEPT
+		r.execLock.Lock()
 		r.instanceSpace[accept.Instance].cmds = accept.Command
+		r.execLock.Unlock()
 		if r.instanceSpace[accept.Instance].status < COMMITTED {
 			r.instanceSpace[accept.Instance].status = ACCEPTED
 		}
@@ -1026,11 +1263,11 @@ func (r *Replica) handleAccept(accept *paxosproto.Accept) {
 		}*/
 	}
 
-	if accept.LeaseInstance != r.QLease.PromisedByMeInst && !r.QLease.CanWriteOutside() {
+	if accept.LeaseInstance != r.QLease.PromisedByMeInst && !r.WriteQuorumSafe() {
 		// cannot accept because lease eras do not match
 		areply.OK = FALSE
 		areply.LeaseInstance = r.QLease.PromisedByMeInst
-		log.Println(accept.LeaseInstance, r.leaseSMR.LatestCommitted)
+		log.Println(accept.LeaseInstance, atomic.LoadInt32(&r.leaseSMR.LatestCommitted))
 	}
 
 	if areply.OK == TRUE {
@@ -1043,15 +1280,20 @@ func (r *Replica) handleAccept(accept *paxosproto.Accept) {
 			inst.directAcks++
 			if inst.directAcks == int8(r.N/2+1) {
 				//safe to commit
-				prop := r.fwdPropMap[accept.PropId]
+				prop := r.Forwarded(accept.PropId)
 				inst.status = COMMITTED
-				// give client the all clear
-				if !r.Dreply && !inst.sentReply {
+				r.LeaseWriteCommitted(accept.Instance, inst.cmds)
+				if prop != nil {
+					r.ProposalsCommitted([]*genericsmr.Propose{prop})
+				}
+				// give client the all clear (unless the leader's reply came first)
+				if prop != nil && !r.Dreply && !inst.sentReply {
 					propreply := &genericsmrproto.ProposeReplyTS{
 						TRUE,
 						prop.CommandId,
 						state.NIL,
-						prop.Timestamp}
+						prop.Timestamp,
+						genericsmrproto.ERR_NONE, "", 0, 0, 0}
 					r.ReplyProposeTS(propreply, prop)
 					inst.sentReply = true
 				} else if inst.sentReply {
@@ -1089,22 +1331,27 @@ func (r *Replica) handleCommit(commit *paxosproto.Commit) {
 			COMMITTED,
 			nil,
 			0, false}
-		r.addUpdatingKeys(commit.Command)
+		r.addUpdatingKeys(commit.Instance, commit.Command)
 	} else {
+		r.execLock.Lock()
 		r.instanceSpace[commit.Instance].cmds = commit.Command
+		r.execLock.Unlock()
 		r.instanceSpace[commit.Instance].status = COMMITTED
 		r.instanceSpace[commit.Instance].ballot = commit.Ballot
 		if inst.lb != nil && inst.lb.clientProposals != nil {
 			for i := 0; i < len(inst.lb.clientProposals); i++ {
 				r.ProposeChan <- inst.lb.clientProposals[i]
 			}
+			r.execLock.Lock()
 			inst.lb.clientProposals = nil
+			r.execLock.Unlock()
 		}
 	}
 
 	if commit.Instance > r.latestAcceptedInst {
 		r.latestAcceptedInst = commit.Instance
 	}
+	r.LeaseWriteCommitted(commit.Instance, commit.Command)
 
 	r.updateCommittedUpTo()
 
@@ -1123,7 +1370,7 @@ func (r *Replica) handleCommitShort(commit *paxosproto.CommitShort) {
 			COMMITTED,
 			nil,
 			0, false}
-		r.addUpdatingKeys(r.instanceSpace[commit.Instance].cmds)
+		r.addUpdatingKeys(commit.Instance, r.instanceSpace[commit.Instance].cmds)
 	} else {
 		r.instanceSpace[commit.Instance].status = COMMITTED
 		r.instanceSpace[commit.Instance].ballot = commit.Ballot
@@ -1131,12 +1378,15 @@ func (r *Replica) handleCommitShort(commit *paxosproto.CommitShort) {
 			for i := 0; i < len(inst.lb.clientProposals); i++ {
 				r.ProposeChan <- inst.lb.clientProposals[i]
 			}
+			r.execLock.Lock()
 			inst.lb.clientProposals = nil
+			r.execLock.Unlock()
 		}
 	}
 	if commit.Instance > r.latestAcceptedInst {
 		r.latestAcceptedInst = commit.Instance
 	}
+	r.LeaseWriteCommitted(commit.Instance, r.instanceSpace[commit.Instance].cmds)
 
 	r.updateCommittedUpTo()
 
@@ -1174,14 +1424,16 @@ func (r *Replica) handlePrepareReply(preply *paxosproto.PrepareReply) {
 			inst.lb.nacks = 0
 			if inst.ballot > r.defaultBallot {
 				r.defaultBallot = inst.ballot
+				r.publishLeader()
 			}
 			r.recordInstanceMetadata(r.instanceSpace[preply.Instance])
 			r.sync()
 			if inst.lb.clientProposals[0].FwdReplica >= 0 && inst.lb.clientProposals[0].FwdReplica != r.Id {
-				r.addUpdatingKeys(inst.cmds)
+				r.addUpdatingKeys(preply.Instance, inst.cmds)
 			}
-			inst.lb.acceptOKsToWait, _ = r.bcastAccept(preply.Instance, inst.ballot, inst.cmds, inst.lb.clientProposals[0].FwdReplica, inst.lb.clientProposals[0].FwdId)
-			if genericsmr.SendError {
+			var err error
+			inst.lb.acceptOKsToWait, err = r.bcastAccept(preply.Instance, inst.ballot, inst.cmds, inst.lb.clientProposals[0].FwdReplica, inst.lb.clientProposals[0].FwdId)
+			if genericsmr.SendRetryable(err) {
 				r.delayedInstances <- preply.Instance
 			}
 		}
@@ -1208,7 +1460,11 @@ func (r *Replica) handleAcceptReply(areply *paxosproto.AcceptReply) {
 
 	if !r.IsLeader && areply.OK == TRUE && areply.OriginReplica == r.Id {
 		//direct ACK optimization
-		prop := r.fwdPropMap[areply.PropId]
+		prop := r.Forwarded(areply.PropId)
+		if prop == nil {
+			// the client has had the leader's reply
+			return
+		}
 		if inst == nil {
 			cmds := make([]state.Command, 1)
 			cmds[0] = prop.Command
@@ -1219,7 +1475,7 @@ func (r *Replica) handleAcceptReply(areply *paxosproto.AcceptReply) {
 				nil,
 				1, false}
 			inst = r.instanceSpace[areply.Instance]
-			r.addUpdatingKeys(cmds)
+			r.addUpdatingKeys(areply.Instance, cmds)
 		}
 		if inst.ballot > areply.Ballot {
 			return
@@ -1234,6 +1490,8 @@ func (r *Replica) handleAcceptReply(areply *paxosproto.AcceptReply) {
 			(inst.status != COMMITTED && inst.directAcks == int8(r.N/2+1)) {
 			//safe to commit
 			inst.status = COMMITTED
+			r.LeaseWriteCommitted(areply.Instance, inst.cmds)
+			r.ProposalsCommitted([]*genericsmr.Propose{prop})
 			// give the client the all clear
 			inst.directAcks = int8(r.N/2 + 2)
 			if !r.Dreply && !inst.sentReply {
@@ -1241,7 +1499,8 @@ func (r *Replica) handleAcceptReply(areply *paxosproto.AcceptReply) {
 					TRUE,
 					prop.CommandId,
 					state.NIL,
-					prop.Timestamp}
+					prop.Timestamp,
+					genericsmrproto.ERR_NONE, "", 0, 0, 0}
 				r.ReplyProposeTS(propreply, prop)
 				inst.sentReply = true
 			} else if inst.sentReply {
@@ -1267,6 +1526,8 @@ func (r *Replica) handleAcceptReply(areply *paxosproto.AcceptReply) {
 		if inst.lb.acceptOKs >= inst.lb.acceptOKsToWait {
 			inst = r.instanceSpace[areply.Instance]
 			inst.status = COMMITTED
+			r.LeaseWriteCommitted(areply.Instance, inst.cmds)
+			r.ProposalsCommitted(inst.lb.clientProposals)
 			if inst.lb.clientProposals != nil && !r.Dreply {
 				// give client the all clear
 				for i := 0; i < len(inst.cmds); i++ {
@@ -1274,7 +1535,8 @@ func (r *Replica) handleAcceptReply(areply *paxosproto.AcceptReply) {
 						TRUE,
 						inst.lb.clientProposals[i].CommandId,
 						state.NIL,
-						inst.lb.clientProposals[i].Timestamp}
+						inst.lb.clientProposals[i].Timestamp,
+						genericsmrproto.ERR_NONE, "", 0, 0, 0}
 					r.ReplyProposeTS(propreply, inst.lb.clientProposals[i])
 				}
 			}
@@ -1283,7 +1545,7 @@ func (r *Replica) handleAcceptReply(areply *paxosproto.AcceptReply) {
 			r.sync() //is this necessary?
 
 			if areply.OriginReplica < 0 || areply.OriginReplica == r.Id {
-				r.addUpdatingKeys(inst.cmds)
+				r.addUpdatingKeys(areply.Instance, inst.cmds)
 			}
 			r.updateCommittedUpTo()
 
@@ -1306,27 +1568,176 @@ func (r *Replica) handleAcceptReply(areply *paxosproto.AcceptReply) {
 	}
 }
 
+/* Client sub-leases */
+
+func (r *Replica) handleClientLease(req *genericsmr.ClientLeaseRequest) {
+	limit := int64(0)
+	if !r.IsLeader {
+		if !r.isMyLeaseActive() {
+			r.DenyClientLease(req, genericsmrproto.ERR_NOT_LEADER)
+			return
+		}
+		for _, k := range req.Keys {
+			if !r.isKeyGranted(k) {
+				r.DenyClientLease(req, genericsmrproto.ERR_NOT_LEADER)
+				return
+			}
+		}
+		limit = r.QLease.ReadLocallyUntil
+	}
+
+	r.updatingLock.Lock()
+	defer r.updatingLock.Unlock()
+	entries := make([]state.Entry, len(req.Keys))
+	for i, k := range req.Keys {
+		if r.IsUpdating(k) {
+			r.DenyClientLease(req, genericsmrproto.ERR_CONFLICT)
+			return
+		}
+		entries[i] = (&state.Command{Op: state.GET, K: k}).Apply(r.State)
+	}
+	r.GrantClientLease(req, entries, limit)
+}
+
+// hold a write back until the client sub-leases on its keys expire or are released
+func (r *Replica) delayPropose(propose *genericsmr.Propose) {
+	r.ClientLeases.WaitForClientLeases([]state.Command{propose.Command})
+	r.ProposeChan <- propose
+}
+
+func (r *Replica) delayAccept(accept *paxosproto.Accept) {
+	r.ClientLeases.WaitForClientLeases(accept.Command)
+	r.acceptChan <- accept
+}
+
+/* Catching up with the committed log */
+
+func (r *Replica) startCatchUp(peer int32) {
+	if r.catchingUp || peer == r.Id {
+		return
+	}
+	log.Printf("Replica %d catching up from replica %d, starting at instance %d\n", r.Id, peer, r.committedUpTo+1)
+	r.setCatchingUp(true)
+	r.catchUpPeer = peer
+	r.stalledChecks = 0
+	if err := r.RequestEntries(peer, r.committedUpTo+1); err != nil {
+		log.Println("Catch-up request failed:", err)
+		r.setCatchingUp(false)
+	}
+}
+
+// a follower whose log has a hole that does not fill up (e.g., because it
+// missed commits while disconnected) fetches the missing instances
+func (r *Replica) checkForGaps() {
+	if r.catchingUp {
+		r.stalledChecks++
+		if r.stalledChecks >= STALLED_CHECKS_TO_CATCH_UP {
+			peer := (r.catchUpPeer + 1) % int32(r.N)
+			if peer == r.Id {
+				peer = (peer + 1) % int32(r.N)
+			}
+			r.setCatchingUp(false)
+			r.startCatchUp(peer)
+		}
+		return
+	}
+	if r.Recovering() {
+		// the catch-up after the restart could not start; try the next peer
+		peer := (r.catchUpPeer + 1) % int32(r.N)
+		if peer == r.Id {
+			peer = (peer + 1) % int32(r.N)
+		}
+		r.catchUpPeer = peer
+		r.startCatchUp(peer)
+		return
+	}
+	if r.IsLeader || r.latestAcceptedInst <= r.committedUpTo+1 || r.committedUpTo != r.lastCommittedUpTo {
+		r.stalledChecks = 0
+		r.lastCommittedUpTo = r.committedUpTo
+		return
+	}
+	r.stalledChecks++
+	if r.stalledChecks >= STALLED_CHECKS_TO_CATCH_UP {
+		r.stalledChecks = 0
+		r.startCatchUp(r.leaderId)
+	}
+}
+
+func (r *Replica) handleRequestEntries(re *genericsmrproto.RequestEntries) {
+	entries := &genericsmrproto.Entries{From: re.From, CommittedUpTo: r.committedUpTo}
+	if re.From < 0 {
+		// a malformed request gets no entries
+		r.SendEntries(re.ReplicaId, entries)
+		return
+	}
+	for i := re.From; i <= r.committedUpTo && i-re.From < re.Count; i++ {
+		inst := r.instanceSpace[i]
+		if inst == nil || inst.cmds == nil {
+			// committed through CommitShort, before the Accept arrived
+			break
+		}
+		entries.Entries = append(entries.Entries, genericsmrproto.Entry{Ballot: inst.ballot, Command: inst.cmds})
+	}
+	r.SendEntries(re.ReplicaId, entries)
+}
+
+func (r *Replica) handleEntries(entries *genericsmrproto.Entries) {
+	if !r.catchingUp {
+		return
+	}
+	if entries.From < 0 || int(entries.From)+len(entries.Entries) > len(r.instanceSpace) {
+		log.Printf("Replica %d: ignoring entries %d..%d from replica %d, outside the log\n",
+			r.Id, entries.From, int(entries.From)+len(entries.Entries)-1, entries.ReplicaId)
+		return
+	}
+	for i, e := range entries.Entries {
+		instance := entries.From + int32(i)
+		if inst := r.instanceSpace[instance]; inst != nil && inst.status == COMMITTED && inst.cmds != nil {
+			continue
+		}
+		r.handleCommit(&paxosproto.Commit{LeaderId: entries.ReplicaId, Instance: instance, Ballot: e.Ballot, Command: e.Command})
+	}
+	r.sync()
+
+	if len(entries.Entries) > 0 && r.committedUpTo < entries.CommittedUpTo {
+		r.stalledChecks = 0
+		r.RequestEntries(entries.ReplicaId, r.committedUpTo+1)
+		return
+	}
+	r.setCatchingUp(false)
+	r.lastCommittedUpTo = r.committedUpTo
+	r.SetRecovering(false)
+	log.Printf("Replica %d caught up to instance %d\n", r.Id, r.committedUpTo)
+}
+
 func (r *Replica) executeCommands() {
 	i := int32(0)
 	for !r.Shutdown {
 		executed := false
 
-		for i <= r.committedUpTo {
-			if r.instanceSpace[i].cmds != nil {
-				inst := r.instanceSpace[i]
-				for j := 0; j < len(inst.cmds); j++ {
-					val := inst.cmds[j].Execute(r.State)
-					if r.Dreply && inst.lb != nil && inst.lb.clientProposals != nil {
+		// the replies to a batch of commands go out together
+		r.CorkReplies()
+		for i <= atomic.LoadInt32(&r.committedUpTo) {
+			if cmds, proposals := r.committedInstance(i); cmds != nil {
+				var reply func(j int, e state.Entry)
+				if r.Dreply && proposals != nil {
+					reply = func(j int, e state.Entry) {
 						propreply := &genericsmrproto.ProposeReplyTS{
 							TRUE,
-							inst.lb.clientProposals[j].CommandId,
-							val,
-							inst.lb.clientProposals[j].Timestamp}
-						r.ReplyProposeTS(propreply, inst.lb.clientProposals[j])
+							proposals[j].CommandId,
+							e.Value,
+							proposals[j].Timestamp,
+							genericsmrproto.ERR_NONE, "", 0, 0, e.Version}
+						r.ReplyProposeTS(propreply, proposals[j])
 					}
 				}
+				r.updatingLock.Lock()
+				r.ExecuteBatch(cmds, reply)
+				r.updatingLock.Unlock()
 
-				r.removeUpdatingKeys(inst.cmds)
+				r.removeUpdatingKeys(i, cmds)
+				atomic.StoreInt32(&r.executedUpTo, i)
+				r.StateExecuted(i)
 
 				i++
 				executed = true
@@ -1334,6 +1745,7 @@ func (r *Replica) executeCommands() {
 				break
 			}
 		}
+		r.UncorkReplies()
 
 		if !executed {
 			time.Sleep(1000 * 1000)
@@ -1341,18 +1753,30 @@ func (r *Replica) executeCommands() {
 	}
 }
 
+// the commands of committed instance i (nil until they arrive), and the
+// client proposals they answer
+func (r *Replica) committedInstance(i int32) ([]state.Command, []*genericsmr.Propose) {
+	r.execLock.Lock()
+	defer r.execLock.Unlock()
+	inst := r.instanceSpace[i]
+	if inst.lb == nil {
+		return inst.cmds, nil
+	}
+	return inst.cmds, inst.lb.clientProposals
+}
+
 func (r *Replica) reader() {
 	for !r.Shutdown {
 		select {
 		case prop := <-r.readsChannel:
-			for r.committedUpTo < r.newestInstanceIDontKnow {
+			for atomic.LoadInt32(&r.committedUpTo) < atomic.LoadInt32(&r.newestInstanceIDontKnow) {
 				time.Sleep(1000 * 1000)
 			}
 			for !r.isMyLeaseActive() {
 				time.Sleep(1000 * 1000)
 			}
 			r.updatingLock.Lock()
-			if r.isKeyUpdating(prop.Command.K) /*|| !r.isMyLeaseActive()*/ {
+			if r.IsUpdating(prop.Command.K) /*|| !r.isMyLeaseActive()*/ {
 				r.updatingLock.Unlock()
 				r.readsChannel <- prop
 				if len(r.readsChannel) <= 1 {
@@ -1367,16 +1791,19 @@ func (r *Replica) reader() {
 				  prop)*/
 				break
 			}
-			val := prop.Command.Execute(r.State)
+			e := prop.Command.Apply(r.State)
+			applied := atomic.LoadInt32(&r.executedUpTo)
 			r.updatingLock.Unlock()
-			if r.isKeyGranted(prop.Command.K) && r.isMyLeaseActive() {
-				local++
-				r.ReplyProposeTS(
+			if fence, held := r.FencingToken(); held && r.isKeyGranted(prop.Command.K) {
+				atomic.AddInt64(&local, 1)
+				r.LeaseReadServed(prop.Command.K, applied)
+				r.ReplyLocalRead(
 					&genericsmrproto.ProposeReplyTS{
 						TRUE,
 						prop.CommandId,
-						1000772,
-						prop.Timestamp},
+						e.Value,
+						prop.Timestamp,
+						genericsmrproto.ERR_NONE, "", fence, 0, e.Version},
 					prop)
 			} else {
 				//r.ProposeChan <- prop
@@ -1384,20 +1811,21 @@ func (r *Replica) reader() {
 					&genericsmrproto.ProposeReplyTS{
 						FALSE,
 						prop.CommandId,
-						val,
-						prop.Timestamp},
+						e.Value,
+						prop.Timestamp,
+						genericsmrproto.ERR_NONE, "", 0, 0, e.Version},
 					prop)
 			}
 			break
 		case fwd := <-r.fwdReadsChannel:
-			for r.committedUpTo < r.newestInstanceIDontKnow {
+			for atomic.LoadInt32(&r.committedUpTo) < atomic.LoadInt32(&r.newestInstanceIDontKnow) {
 				time.Sleep(1000 * 1000)
 			}
 			for !r.isMyLeaseActive() {
 				time.Sleep(1000 * 1000)
 			}
 			r.updatingLock.Lock()
-			if r.isKeyUpdating(fwd.Command.K) /*|| !r.isMyLeaseActive()*/ {
+			if r.IsUpdating(fwd.Command.K) /*|| !r.isMyLeaseActive()*/ {
 				r.updatingLock.Unlock()
 				r.fwdReadsChannel <- fwd
 				if len(r.fwdReadsChannel) <= 1 {
@@ -1406,13 +1834,15 @@ func (r *Replica) reader() {
 				//r.SendMsg(fwd.ReplicaId, r.forwardReplyRPC, &paxosproto.ForwardReply{fwd.PropId, FALSE, 0})
 				break
 			}
-			val := fwd.Command.Execute(r.State)
+			e := fwd.Command.Apply(r.State)
+			applied := atomic.LoadInt32(&r.executedUpTo)
 			r.updatingLock.Unlock()
 			if r.isKeyGranted(fwd.Command.K) && r.isMyLeaseActive() {
-				local++
-				r.SendMsg(fwd.ReplicaId, r.forwardReplyRPC, &paxosproto.ForwardReply{fwd.PropId, TRUE, val})
+				atomic.AddInt64(&local, 1)
+				r.LeaseReadServed(fwd.Command.K, applied)
+				r.SendMsg(fwd.ReplicaId, r.forwardReplyRPC, &paxosproto.ForwardReply{fwd.PropId, TRUE, e.Value, e.Version})
 			} else {
-				r.SendMsg(fwd.ReplicaId, r.forwardReplyRPC, &paxosproto.ForwardReply{fwd.PropId, FALSE, val})
+				r.SendMsg(fwd.ReplicaId, r.forwardReplyRPC, &paxosproto.ForwardReply{fwd.PropId, FALSE, e.Value, e.Version})
 			}
 		}
 	}
@@ -0,0 +1,247 @@
+package paxos
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glycerine/qlease/clientlib"
+	"github.com/glycerine/qlease/genericsmr"
+	"github.com/glycerine/qlease/genericsmrproto"
+	"github.com/glycerine/qlease/lpaxos"
+	"github.com/glycerine/qlease/masterproto"
+	"github.com/glycerine/qlease/quictransport"
+	"github.com/glycerine/qlease/state"
+)
+
+// The tests run a cluster of three replicas in the test process, each with
+// the Lease-Paxos replica it keeps its lease configurations with, on
+// loopback ports, and talk to it as clients do, through a stand-in master.
+// Replicas are never shut down, so every test starts its own cluster.
+
+const TEST_N = 3
+
+// short leases, for leases to take effect within the tests: the leader
+// configures them after TICKS_TO_RECONF_LEASE renewals
+var testLeaseParams = map[uint8]int64{
+	genericsmr.PARAM_LEASE_DURATION_NS: int64(400 * time.Millisecond),
+	genericsmr.PARAM_LEASE_GUARD_NS:    int64(200 * time.Millisecond),
+}
+
+// how long a test waits for something the cluster does on its own (a lease
+// to take effect, a replica to catch up)
+const TEST_TIMEOUT = 30 * time.Second
+
+type testCluster struct {
+	reps   []*Replica
+	faults []*genericsmr.Faults
+	client *clientlib.Client
+}
+
+// serves the replica list, as the master does
+type testMaster struct {
+	replicas []string
+}
+
+func (m *testMaster) GetReplicaList(args *masterproto.GetReplicaListArgs, reply *masterproto.GetReplicaListReply) error {
+	reply.ReplicaList, reply.Ready = m.replicas, true
+	return nil
+}
+
+func (m *testMaster) GetLeader(args *masterproto.GetLeaderArgs, reply *masterproto.GetLeaderReply) error {
+	reply.LeaderId = 0
+	return nil
+}
+
+func listen(t *testing.T, n int, tr genericsmr.Transport) ([]net.Listener, []string) {
+	ls := make([]net.Listener, n)
+	addrs := make([]string, n)
+	for i := range ls {
+		l, err := tr.Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ls[i], addrs[i] = l, l.Addr().String()
+	}
+	return ls, addrs
+}
+
+func startCluster(t *testing.T) *testCluster {
+	return startClusterOver(t, genericsmr.TCP)
+}
+
+// start a cluster whose replicas connect to each other through tr
+func startClusterOver(t *testing.T, tr genericsmr.Transport) *testCluster {
+	dir := t.TempDir()
+	ls, addrs := listen(t, TEST_N, tr)
+	leaseLs, leaseAddrs := listen(t, TEST_N, tr)
+	c := &testCluster{reps: make([]*Replica, TEST_N), faults: make([]*genericsmr.Faults, TEST_N)}
+	for i := 0; i < TEST_N; i++ {
+		c.faults[i] = genericsmr.NewFaults(TEST_N)
+		leaseRep := lpaxos.NewReplicaWithOptions(i, leaseAddrs, genericsmr.WithExec(true), genericsmr.WithDreply(true),
+			genericsmr.WithListener(leaseLs[i]), genericsmr.WithTransport(tr),
+			genericsmr.WithStableStorePath(filepath.Join(dir, fmt.Sprintf("lease-%d", i))))
+		c.reps[i] = NewReplicaWithOptions(i, addrs, leaseRep, false, genericsmr.WithExec(true), genericsmr.WithDreply(true),
+			genericsmr.WithListener(ls[i]), genericsmr.WithTransport(tr),
+			genericsmr.WithStableStorePath(filepath.Join(dir, fmt.Sprintf("paxos-%d", i))),
+			genericsmr.WithParams(testLeaseParams), genericsmr.WithFaults(c.faults[i]))
+	}
+
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Master", &testMaster{addrs}); err != nil {
+		t.Fatal(err)
+	}
+	ml, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(ml, srv)
+	if c.client, err = clientlib.Dial("127.0.0.1", ml.Addr().(*net.TCPAddr).Port); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.client.Close()
+		ml.Close()
+	})
+	return c
+}
+
+func (c *testCluster) propose(t *testing.T, replica int, cmd state.Command) *genericsmrproto.ProposeReplyTS {
+	t.Helper()
+	reply, err := c.client.ProposeDeadline(replica, cmd, time.Now().Add(TEST_TIMEOUT))
+	if err != nil {
+		t.Fatalf("%v at replica %d: %v", cmd, replica, err)
+	}
+	return reply
+}
+
+func (c *testCluster) put(t *testing.T, replica int, k state.Key, v state.Value) {
+	t.Helper()
+	if reply := c.propose(t, replica, state.Command{Op: state.PUT, K: k, V: v}); reply.OK == FALSE {
+		t.Fatalf("PUT %d at replica %d failed: error %d %s", k, replica, reply.ErrCode, reply.ErrMsg)
+	}
+}
+
+// wait until the state of replica r has executed k = v
+func (c *testCluster) waitApplied(t *testing.T, r int, k state.Key, v state.Value) {
+	t.Helper()
+	deadline := time.Now().Add(TEST_TIMEOUT)
+	for {
+		got, _, _ := c.reps[r].ReadApplied(k)
+		if got.Value == v {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("replica %d has %d = %d, not %d", r, k, got, v)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProposeCommitExecute(t *testing.T) {
+	c := startCluster(t)
+
+	// at the leader, and at followers, which forward to it
+	for r := 0; r < TEST_N; r++ {
+		c.put(t, r, state.Key(r), state.Value(100+r))
+	}
+	c.put(t, 1, 0, 200)
+	// the replies come after execution, with its result
+	reply := c.propose(t, 2, state.Command{Op: state.CPUT, K: 0, V: 300, Version: 1})
+	if reply.OK == TRUE || reply.ErrCode != genericsmrproto.ERR_CONFLICT || reply.Value != 200 || reply.Version != 2 {
+		t.Errorf("CPUT of 0 at version 1 succeeded, or did not return 200 at version 2: %+v", reply)
+	}
+	reply = c.propose(t, 2, state.Command{Op: state.CPUT, K: 1, V: 301, Version: 1})
+	if reply.OK != TRUE || reply.Value != 301 || reply.Version != 2 {
+		t.Errorf("CPUT of 1 at version 1 failed, or did not return 301 at version 2: %+v", reply)
+	}
+
+	// every replica executes every command, in the same order
+	for r := 0; r < TEST_N; r++ {
+		c.waitApplied(t, r, 0, 200)
+		c.waitApplied(t, r, 1, 301)
+		c.waitApplied(t, r, 2, 102)
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	c := startCluster(t)
+	c.put(t, 0, 1, 1)
+	c.waitApplied(t, 2, 1, 1)
+
+	// replica 2 misses the commands the others commit meanwhile
+	for q := int32(0); q < 2; q++ {
+		c.faults[2].Partition(q, true)
+	}
+	const missed = 50
+	for i := 0; i < missed; i++ {
+		c.put(t, 0, state.Key(10+i), state.Value(i))
+	}
+	if e, _, _ := c.reps[2].ReadApplied(10); e.Value != state.NIL {
+		t.Fatalf("partitioned replica 2 executed %d = %d", 10, e.Value)
+	}
+
+	// and fetches them once it hears of newer ones
+	c.faults[2].Heal()
+	c.put(t, 0, 1, 2)
+	for i := 0; i < missed; i++ {
+		c.waitApplied(t, 2, state.Key(10+i), state.Value(i))
+	}
+	c.waitApplied(t, 2, 1, 2)
+}
+
+// read k at a replica until the read is served locally, under a lease
+func (c *testCluster) leaseRead(t *testing.T, replica int, k state.Key) *genericsmrproto.ProposeReplyTS {
+	t.Helper()
+	deadline := time.Now().Add(TEST_TIMEOUT)
+	for {
+		reply := c.propose(t, replica, state.Command{Op: state.GET, K: k})
+		if reply.OK == TRUE && reply.Fence != 0 {
+			return reply
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no local read of %d at replica %d: %+v", k, replica, reply)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestLeaseReads(t *testing.T) {
+	testLeaseReads(t, startCluster(t))
+}
+
+// over QUIC, the lease messages go on streams of their own
+func TestLeaseReadsOverQUIC(t *testing.T) {
+	tlsConf, err := quictransport.SelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testLeaseReads(t, startClusterOver(t, quictransport.New(tlsConf)))
+}
+
+func testLeaseReads(t *testing.T, c *testCluster) {
+	c.put(t, 0, 7, 70)
+
+	// reads at a follower are forwarded to the leader until the leader,
+	// having counted them, grants the follower a lease on the key; then
+	// they are served locally, tagged with the follower's fencing token
+	reply := c.leaseRead(t, 1, 7)
+	if reply.Value != 70 {
+		t.Errorf("local read of 7 at replica 1 returned %d, not 70", reply.Value)
+	}
+
+	// a write to a leased key reaches the grantee before it commits, so that
+	// its local reads never return the old value after the write's reply
+	c.put(t, 0, 7, 71)
+	if reply = c.leaseRead(t, 1, 7); reply.Value != 71 {
+		t.Errorf("local read of 7 at replica 1 after writing 71 returned %d", reply.Value)
+	}
+	c.put(t, 2, 7, 72)
+	if reply = c.leaseRead(t, 1, 7); reply.Value != 72 {
+		t.Errorf("local read of 7 at replica 1 after writing 72 returned %d", reply.Value)
+	}
+}
@@ -1,6 +1,7 @@
 package paxos
 
 import (
+	"github.com/glycerine/qlease/genericsmr"
 	"github.com/glycerine/qlease/qleaseproto"
 	"github.com/glycerine/qlease/state"
 )
@@ -10,14 +11,16 @@ type ReadStats struct {
 	leaderId int32
 	freqMap  map[state.Key][]int
 	prevMap  map[state.Key][]int
+	topo     *genericsmr.Topology // with regions, leases go to the regions that read a key (nil if unknown)
 }
 
-func NewReadStats(N int, leaderId int32) *ReadStats {
+func NewReadStats(N int, leaderId int32, topo *genericsmr.Topology) *ReadStats {
 	return &ReadStats{
 		N,
 		leaderId,
 		make(map[state.Key][]int, 1000),
-		make(map[state.Key][]int, 1000)}
+		make(map[state.Key][]int, 1000),
+		topo}
 }
 
 func (rs *ReadStats) AddRead(key state.Key, replicaId int32) {
@@ -43,19 +46,69 @@ func (rs *ReadStats) findMax2Indices(slice []int) (int32, int32) {
 	return max1, max2
 }
 
+// the busiest reader of each of the two regions that read the key most,
+// leaving out the leader's region, whose reads the leader serves; the two
+// busiest readers if no other region reads the key, or without regions
+func (rs *ReadStats) findGrantees(slice []int) (int32, int32) {
+	if rs.topo == nil || len(rs.topo.Regions) == 0 {
+		return rs.findMax2Indices(slice)
+	}
+	leaderRegion := rs.topo.Region(rs.leaderId)
+	var regions []string
+	reads := make(map[string]int)
+	busiest := make(map[string]int32)
+	for i, v := range slice {
+		region := rs.topo.Region(int32(i))
+		if v == 0 || region == leaderRegion {
+			continue
+		}
+		if b, present := busiest[region]; !present {
+			regions = append(regions, region)
+			busiest[region] = int32(i)
+		} else if v > slice[b] {
+			busiest[region] = int32(i)
+		}
+		reads[region] += v
+	}
+	if len(regions) == 0 {
+		return rs.findMax2Indices(slice)
+	}
+	first, second := "", ""
+	for _, region := range regions {
+		if first == "" || reads[region] > reads[first] {
+			first, second = region, first
+		} else if second == "" || reads[region] > reads[second] {
+			second = region
+		}
+	}
+	if second == "" {
+		max1, max2 := rs.findMax2Indices(slice)
+		if max1 == busiest[first] {
+			max1 = max2
+		}
+		return busiest[first], max1
+	}
+	return busiest[first], busiest[second]
+}
+
 func (rs *ReadStats) GetQuorums() []qleaseproto.LeaseMetadata {
 	lm := make(map[int64][]state.Key)
 	for k, v := range rs.freqMap {
-		r1, r2 := rs.findMax2Indices(v)
+		r1, r2 := rs.findGrantees(v)
 		if r1 > r2 {
 			aux := r1
 			r1 = r2
 			r2 = aux
 		}
-		for r1 == rs.leaderId || r1 == r2 {
-			r1++
-			if r1 == int32(rs.N) {
-				r1 = 0
+		// the leader is in every quorum already: keep the other reader first,
+		// as the quorums of three replicas have room for only one more
+		if r1 == rs.leaderId {
+			r1, r2 = r2, r1
+		}
+		for r2 == rs.leaderId || r2 == r1 {
+			r2++
+			if r2 == int32(rs.N) {
+				r2 = 0
 			}
 		}
 
@@ -58,7 +58,8 @@ type Forward struct {
 }
 
 type ForwardReply struct {
-	PropId int32
-	OK     uint8
-	Value  state.Value
+	PropId  int32
+	OK      uint8
+	Value   state.Value
+	Version uint64
 }
@@ -165,13 +165,15 @@ func (t *PrepareReply) Unmarshal(rr io.Reader) error {
 	t.Instance = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.OK = uint8(bs[4])
 	t.Ballot = int32((uint32(bs[5]) | (uint32(bs[6]) << 8) | (uint32(bs[7]) << 16) | (uint32(bs[8]) << 24)))
-	alen1, err := binary.ReadVarint(wire)
+	alen1, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
 	if err != nil {
 		return err
 	}
 	t.Command = make([]state.Command, alen1)
 	for i := int64(0); i < alen1; i++ {
-		t.Command[i].Unmarshal(wire)
+		if err := t.Command[i].Unmarshal(wire); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -273,13 +275,15 @@ func (t *Accept) Unmarshal(rr io.Reader) error {
 	t.LeaderId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.Instance = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
 	t.Ballot = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
-	alen1, err := binary.ReadVarint(wire)
+	alen1, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
 	if err != nil {
 		return err
 	}
 	t.Command = make([]state.Command, alen1)
 	for i := int64(0); i < alen1; i++ {
-		t.Command[i].Unmarshal(wire)
+		if err := t.Command[i].Unmarshal(wire); err != nil {
+			return err
+		}
 	}
 	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
 		return err
@@ -456,13 +460,15 @@ func (t *Commit) Unmarshal(rr io.Reader) error {
 	t.LeaderId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.Instance = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
 	t.Ballot = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
-	alen1, err := binary.ReadVarint(wire)
+	alen1, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
 	if err != nil {
 		return err
 	}
 	t.Command = make([]state.Command, alen1)
 	for i := int64(0); i < alen1; i++ {
-		t.Command[i].Unmarshal(wire)
+		if err := t.Command[i].Unmarshal(wire); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -607,7 +613,9 @@ func (t *Forward) Unmarshal(wire io.Reader) error {
 	}
 	t.ReplicaId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.PropId = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
-	t.Command.Unmarshal(wire)
+	if err := t.Command.Unmarshal(wire); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -659,6 +667,9 @@ func (t *ForwardReply) Marshal(wire io.Writer) {
 	bs[4] = byte(t.OK)
 	wire.Write(bs)
 	t.Value.Marshal(wire)
+	var v [8]byte
+	binary.LittleEndian.PutUint64(v[:], t.Version)
+	wire.Write(v[:])
 }
 
 func (t *ForwardReply) Unmarshal(wire io.Reader) error {
@@ -670,6 +681,74 @@ func (t *ForwardReply) Unmarshal(wire io.Reader) error {
 	}
 	t.PropId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	t.OK = uint8(bs[4])
-	t.Value.Unmarshal(wire)
+	if err := t.Value.Unmarshal(wire); err != nil {
+		return err
+	}
+	var v [8]byte
+	if _, err := io.ReadFull(wire, v[:]); err != nil {
+		return err
+	}
+	t.Version = binary.LittleEndian.Uint64(v[:])
 	return nil
 }
+
+func (t *Accept) Size() int {
+	n := len(t.Command)
+	return 24 + fastrpc.VarintSize(int64(n)) + state.CommandsSize(t.Command)
+}
+
+func (t *Accept) MarshalTo(b []byte) int {
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.LeaderId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.Instance))
+	binary.LittleEndian.PutUint32(b[8:12], uint32(t.Ballot))
+	n := 12 + binary.PutVarint(b[12:], int64(len(t.Command)))
+	for i := range t.Command {
+		n += t.Command[i].MarshalTo(b[n:])
+	}
+	binary.LittleEndian.PutUint32(b[n:n+4], uint32(t.LeaseInstance))
+	binary.LittleEndian.PutUint32(b[n+4:n+8], uint32(t.OriginReplica))
+	binary.LittleEndian.PutUint32(b[n+8:n+12], uint32(t.PropId))
+	return n + 12
+}
+
+func (t *AcceptReply) Size() int {
+	return 21
+}
+
+func (t *AcceptReply) MarshalTo(b []byte) int {
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.Instance))
+	b[4] = t.OK
+	binary.LittleEndian.PutUint32(b[5:9], uint32(t.Ballot))
+	binary.LittleEndian.PutUint32(b[9:13], uint32(t.LeaseInstance))
+	binary.LittleEndian.PutUint32(b[13:17], uint32(t.OriginReplica))
+	binary.LittleEndian.PutUint32(b[17:21], uint32(t.PropId))
+	return 21
+}
+
+func (t *Commit) Size() int {
+	n := len(t.Command)
+	return 12 + fastrpc.VarintSize(int64(n)) + state.CommandsSize(t.Command)
+}
+
+func (t *Commit) MarshalTo(b []byte) int {
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.LeaderId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.Instance))
+	binary.LittleEndian.PutUint32(b[8:12], uint32(t.Ballot))
+	n := 12 + binary.PutVarint(b[12:], int64(len(t.Command)))
+	for i := range t.Command {
+		n += t.Command[i].MarshalTo(b[n:])
+	}
+	return n
+}
+
+func (t *CommitShort) Size() int {
+	return 16
+}
+
+func (t *CommitShort) MarshalTo(b []byte) int {
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.LeaderId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.Instance))
+	binary.LittleEndian.PutUint32(b[8:12], uint32(t.Count))
+	binary.LittleEndian.PutUint32(b[12:16], uint32(t.Ballot))
+	return 16
+}
@@ -0,0 +1,411 @@
+// Package peermux multiplexes logical streams over one connection between two
+// replicas, so that a bulky transfer (e.g., a snapshot) does not hold back
+// the control traffic behind it, and so that either side of a pair can
+// re-establish the connection after it breaks.
+//
+// Streams are identified by a byte and need no setup: a stream exists as soon
+// as either side uses it, and both sides agree on what the well-known IDs
+// carry. Every frame is a 6-byte header (type, stream, little-endian uint32
+// length) followed, for data frames, by length bytes of payload. Each stream
+// has its own flow control window of WINDOW bytes: a sender never has more
+// than that many bytes unread by the receiving side, and the receiver credits
+// the bytes back with window frames as they are read. The reading side of a
+// session therefore never blocks on a slow stream, and data stays in order
+// within each stream, but not across streams.
+package peermux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// well-known streams between replicas
+const (
+	STREAM_CONTROL  uint8 = iota // the replica's messages, in the order they were sent
+	STREAM_DATA                  // bulk data that may overtake, or be overtaken by, control messages
+	STREAM_SNAPSHOT              // state transfers
+)
+
+const (
+	WINDOW         = 256 * 1024 // per-stream flow control window, in bytes; both sides must agree on it
+	MAX_FRAME_SIZE = 32 * 1024  // largest data frame payload
+	HEADER_SIZE    = 6
+)
+
+const (
+	frameData   uint8 = iota
+	frameWindow       // the length field is a credit of that many bytes
+	frameClose        // the sender will write no more to the stream
+	frameGoAway       // the sender is closing the session
+)
+
+var ErrSessionClosed = errors.New("peermux: session closed")
+var ErrStreamClosed = errors.New("peermux: stream closed")
+
+// the net.Error returned by operations past a deadline
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "peermux: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// A Session multiplexes streams over a connection. Both ends of the
+// connection must wrap it in a Session.
+type Session struct {
+	conn net.Conn
+
+	wlock *sync.Mutex // serializes frames on conn
+	wbuf  []byte
+
+	lock    *sync.Mutex
+	streams map[uint8]*Stream
+	err     error
+	done    chan struct{}
+}
+
+func NewSession(conn net.Conn) *Session {
+	s := &Session{
+		conn:    conn,
+		wlock:   new(sync.Mutex),
+		lock:    new(sync.Mutex),
+		streams: make(map[uint8]*Stream),
+		done:    make(chan struct{}),
+	}
+	go s.readFrames()
+	return s
+}
+
+// Stream returns the stream with the given ID.
+func (s *Session) Stream(id uint8) *Stream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stream(id)
+}
+
+// with s.lock held
+func (s *Session) stream(id uint8) *Stream {
+	st := s.streams[id]
+	if st == nil {
+		st = &Stream{s: s, id: id, lock: new(sync.Mutex), sendWindow: WINDOW}
+		st.cond = sync.NewCond(st.lock)
+		s.streams[id] = st
+	}
+	return st
+}
+
+// Done is closed when the session fails or is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error the session failed with, or nil while it works.
+func (s *Session) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Close tells the other side that the session is going away and closes the
+// connection.
+func (s *Session) Close() error {
+	if s.Err() != nil {
+		return nil
+	}
+	s.writeFrame(frameGoAway, 0, 0, nil, time.Now().Add(time.Second))
+	s.fail(ErrSessionClosed)
+	return nil
+}
+
+// closes the connection and wakes up every stream; the first error sticks
+func (s *Session) fail(err error) {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return
+	}
+	s.err = err
+	streams := make([]*Stream, 0, len(s.streams))
+	for _, st := range s.streams {
+		streams = append(streams, st)
+	}
+	s.lock.Unlock()
+
+	s.conn.Close()
+	close(s.done)
+	for _, st := range streams {
+		st.lock.Lock()
+		st.cond.Broadcast()
+		st.lock.Unlock()
+	}
+}
+
+// write one frame, with payload for data frames; a frame that cannot be
+// written whole ruins the session
+func (s *Session) writeFrame(typ uint8, id uint8, length int, payload []byte, deadline time.Time) error {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	if err := s.Err(); err != nil {
+		return err
+	}
+	s.wbuf = append(s.wbuf[:0], typ, id, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(s.wbuf[2:HEADER_SIZE], uint32(length))
+	s.wbuf = append(s.wbuf, payload...)
+	if !deadline.IsZero() {
+		s.conn.SetWriteDeadline(deadline)
+		defer s.conn.SetWriteDeadline(time.Time{})
+	}
+	if _, err := s.conn.Write(s.wbuf); err != nil {
+		s.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) writeCredit(id uint8, n int) {
+	s.writeFrame(frameWindow, id, n, nil, time.Time{})
+}
+
+func (s *Session) readFrames() {
+	var hdr [HEADER_SIZE]byte
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			s.fail(err)
+			return
+		}
+		typ, id, length := hdr[0], hdr[1], int(binary.LittleEndian.Uint32(hdr[2:]))
+		s.lock.Lock()
+		st := s.stream(id)
+		s.lock.Unlock()
+
+		switch typ {
+		case frameData:
+			if length > MAX_FRAME_SIZE {
+				s.fail(fmt.Errorf("peermux: %d-byte frame on stream %d", length, id))
+				return
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(s.conn, payload); err != nil {
+				s.fail(err)
+				return
+			}
+			dropped, err := st.received(payload)
+			if err != nil {
+				s.fail(err)
+				return
+			}
+			if dropped {
+				// nobody will read it: let the sender go on
+				s.writeCredit(id, length)
+			}
+		case frameWindow:
+			st.credited(length)
+		case frameClose:
+			st.remoteClosed()
+		case frameGoAway:
+			s.fail(io.EOF)
+			return
+		default:
+			s.fail(fmt.Errorf("peermux: unknown frame type %d", typ))
+			return
+		}
+	}
+}
+
+// A Stream is one direction-independent byte stream of a session. It
+// implements net.Conn; closing it only closes the stream.
+type Stream struct {
+	s  *Session
+	id uint8
+
+	lock          *sync.Mutex
+	cond          *sync.Cond
+	buf           []byte // received but not yet read
+	unacked       int    // bytes read but not yet credited back to the sender
+	sendWindow    int    // bytes that may be sent before the receiver credits more
+	eof           bool   // the other side closed the stream
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// buffer a data frame; returns true if it was dropped because the stream is
+// closed on this side
+func (st *Stream) received(payload []byte) (bool, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.closed {
+		return true, nil
+	}
+	if len(st.buf)+len(payload) > WINDOW {
+		return false, fmt.Errorf("peermux: peer overran the window of stream %d", st.id)
+	}
+	st.buf = append(st.buf, payload...)
+	st.cond.Broadcast()
+	return false, nil
+}
+
+func (st *Stream) credited(n int) {
+	st.lock.Lock()
+	st.sendWindow += n
+	st.cond.Broadcast()
+	st.lock.Unlock()
+}
+
+func (st *Stream) remoteClosed() {
+	st.lock.Lock()
+	st.eof = true
+	st.cond.Broadcast()
+	st.lock.Unlock()
+}
+
+// wait for a broadcast, or until deadline; with st.lock held
+func (st *Stream) wait(deadline time.Time) error {
+	if deadline.IsZero() {
+		st.cond.Wait()
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return timeoutError{}
+	}
+	t := time.AfterFunc(d, func() {
+		st.lock.Lock()
+		st.cond.Broadcast()
+		st.lock.Unlock()
+	})
+	st.cond.Wait()
+	t.Stop()
+	return nil
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	st.lock.Lock()
+	for len(st.buf) == 0 {
+		var err error
+		switch {
+		case st.closed:
+			err = ErrStreamClosed
+		case st.eof:
+			err = io.EOF
+		default:
+			err = st.s.Err()
+		}
+		if err == nil {
+			err = st.wait(st.readDeadline)
+		}
+		if err != nil {
+			st.lock.Unlock()
+			return 0, err
+		}
+	}
+	n := copy(p, st.buf)
+	st.buf = st.buf[n:]
+	if len(st.buf) == 0 {
+		st.buf = nil
+	}
+	st.unacked += n
+	credit := 0
+	if st.unacked >= WINDOW/4 {
+		// the sender still had at least 3/4 of the window
+		credit, st.unacked = st.unacked, 0
+	}
+	st.lock.Unlock()
+	if credit > 0 {
+		st.s.writeCredit(st.id, credit)
+	}
+	return n, nil
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.lock.Lock()
+		var err error
+		for err == nil && st.sendWindow == 0 {
+			if st.closed {
+				err = ErrStreamClosed
+			} else if err = st.s.Err(); err == nil {
+				err = st.wait(st.writeDeadline)
+			}
+		}
+		if err == nil && st.closed {
+			err = ErrStreamClosed
+		}
+		if err != nil {
+			st.lock.Unlock()
+			return written, err
+		}
+		n := len(p) - written
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		if n > MAX_FRAME_SIZE {
+			n = MAX_FRAME_SIZE
+		}
+		st.sendWindow -= n
+		deadline := st.writeDeadline
+		st.lock.Unlock()
+
+		if err := st.s.writeFrame(frameData, st.id, n, p[written:written+n], deadline); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close closes the stream on this side and tells the other side that
+// nothing more will be written to it.
+func (st *Stream) Close() error {
+	st.lock.Lock()
+	if st.closed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.buf = nil
+	st.cond.Broadcast()
+	st.lock.Unlock()
+	return st.s.writeFrame(frameClose, st.id, 0, nil, time.Time{})
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.s.conn.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.s.conn.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.readDeadline = t
+	st.cond.Broadcast()
+	st.lock.Unlock()
+	return nil
+}
+
+// SetWriteDeadline bounds both the wait for window and the write of the
+// frames to the connection. A frame cut short by the deadline ruins the
+// whole session.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.writeDeadline = t
+	st.cond.Broadcast()
+	st.lock.Unlock()
+	return nil
+}
@@ -1,46 +1,152 @@
 package qlease
 
 import (
+    "errors"
+    "fmt"
+    "sync/atomic"
     "time"
+
+    "github.com/glycerine/qlease/state"
 )
 
+// defaults, for leases among nearby replicas; WAN deployments need longer ones
 const GUARD_DURATION_NS = 1 * 1e9 // 1 second
 const DEFAULT_LEASE_DURATION_NS = 2000 * 1e6 // 2000 ms
+const DEFAULT_RENEW_LEAD_NS = 1500 * 1e6 // 1500 ms
 
 type Lease struct {
     PromisedByMeInst int32                  // the current lease instance for which we've sent promises
-    PromisedToMeInst int32                  // the lease instance for which we've received promises 
+    PromisedToMeInst int32                  // the lease instance for which we've received promises (written atomically)
     Duration int64
+    Guard int64                             // how long after a guard grantees accept a first promise
+    RenewLead int64                         // how long before the lease expires it is renewed
     LatestTsSent int64
     LatestPromisesReceived []int64
     LatestRepliesReceived []int64
-    ReadLocallyUntil int64
+    ReadLocallyUntil int64                  // written atomically, as CanRead may run in another goroutine
     WriteInQuorumUntil int64
     PromiseRejects int
     GuardExpires []int64
+    Keys []state.Key                        // the keys covered by the lease (nil for all keys)
+    Epoch uint32                            // incremented (atomically) every time this replica starts holding the lease anew
+    Clock func() int64                      // reads the time in ns (nil for the wall clock)
+}
+
+func (ql *Lease) now() int64 {
+    if ql.Clock != nil {
+        return ql.Clock()
+    }
+    return time.Now().UnixNano()
+}
+
+var ErrNoReplicas = errors.New("a lease needs at least one replica")
+
+// ValidateDuration checks that a lease lasts longer than the guard that
+// precedes it; otherwise a lease could expire before it ever takes effect.
+func ValidateDuration(duration time.Duration) error {
+    if duration <= GUARD_DURATION_NS {
+        return fmt.Errorf("lease duration %v must exceed the guard duration %v", duration, time.Duration(GUARD_DURATION_NS))
+    }
+    return nil
+}
+
+// ValidateTiming checks that a lease lasts longer than its guard, and that
+// it is renewed some time before it expires, but after it is granted.
+func ValidateTiming(guard time.Duration, duration time.Duration, renewLead time.Duration) error {
+    if guard <= 0 {
+        return fmt.Errorf("guard duration %v must be positive", guard)
+    }
+    if duration <= guard {
+        return fmt.Errorf("lease duration %v must exceed the guard duration %v", duration, guard)
+    }
+    if renewLead <= 0 || renewLead >= duration {
+        return fmt.Errorf("renewal lead time %v must be positive and less than the lease duration %v", renewLead, duration)
+    }
+    return nil
+}
+
+// NewLease creates a lease among n replicas, covering the given keys
+// (all keys if none are given), with the default guard and renewal lead time.
+func NewLease(n int, duration time.Duration, keys ...state.Key) (*Lease, error) {
+    return NewLeaseWithTiming(n, GUARD_DURATION_NS, duration, DefaultRenewLead(duration), keys...)
+}
+
+// DefaultRenewLead returns the default renewal lead time of a lease that
+// lasts duration: DEFAULT_RENEW_LEAD_NS, or three quarters of a shorter lease.
+func DefaultRenewLead(duration time.Duration) time.Duration {
+    if duration * 3 / 4 < DEFAULT_RENEW_LEAD_NS {
+        return duration * 3 / 4
+    }
+    return DEFAULT_RENEW_LEAD_NS
 }
 
-func NewLease(n int) *Lease {
+// NewLeaseWithTiming creates a lease among n replicas, covering the given
+// keys (all keys if none are given), that lasts duration after a guard, and
+// is renewed renewLead before it expires.
+func NewLeaseWithTiming(n int, guard time.Duration, duration time.Duration, renewLead time.Duration, keys ...state.Key) (*Lease, error) {
+    if n <= 0 {
+        return nil, ErrNoReplicas
+    }
+    if err := ValidateTiming(guard, duration, renewLead); err != nil {
+        return nil, err
+    }
     return &Lease{
-        -1,
-        -1,
-        DEFAULT_LEASE_DURATION_NS,
-        0,
-        make([]int64, n),
-        make([]int64, n),
-        0,
-        0,
-        0,
-        make([]int64, n)}
+        PromisedByMeInst: -1,
+        PromisedToMeInst: -1,
+        Duration: int64(duration),
+        Guard: int64(guard),
+        RenewLead: int64(renewLead),
+        LatestPromisesReceived: make([]int64, n),
+        LatestRepliesReceived: make([]int64, n),
+        GuardExpires: make([]int64, n),
+        Keys: keys}, nil
+}
+
+// RenewInterval is how often the lease is renewed.
+func (ql *Lease) RenewInterval() time.Duration {
+    return time.Duration(ql.Duration - ql.RenewLead)
 }
 
+// Covers reports whether the lease applies to key k.
+func (ql *Lease) Covers(k state.Key) bool {
+    if ql.Keys == nil {
+        return true
+    }
+    for _, key := range ql.Keys {
+        if key == k {
+            return true
+        }
+    }
+    return false
+}
+
+// A fencing token identifies a period during which a replica held a lease.
+// Tokens are monotonic: the lease instance (high 32 bits) orders tokens
+// across replicas, and the epoch (low 32 bits) orders the periods during which
+// one replica held the same lease instance. External services can reject
+// operations that carry a token older than the newest one they have seen.
+func MakeFencingToken(inst int32, epoch uint32) uint64 {
+    return uint64(uint32(inst)) << 32 | uint64(epoch)
+}
+
+func FencingTokenInstance(token uint64) int32 {
+    return int32(token >> 32)
+}
+
+func FencingTokenEpoch(token uint64) uint32 {
+    return uint32(token)
+}
+
+func (ql *Lease) FencingToken() uint64 {
+    return MakeFencingToken(atomic.LoadInt32(&ql.PromisedToMeInst), atomic.LoadUint32(&ql.Epoch))
+}
 
 func (ql *Lease) CanRead() bool {
-    if ql.PromisedToMeInst < 0 {
+    if atomic.LoadInt32(&ql.PromisedToMeInst) < 0 {
         return false
     }
-    now := time.Now().UnixNano()
-    if now > ql.ReadLocallyUntil {
+    now := ql.now()
+    if now > atomic.LoadInt64(&ql.ReadLocallyUntil) {
         return false
     }
     return true
@@ -50,7 +156,7 @@ func (ql *Lease) CanWriteOutside() bool {
     if ql.PromisedByMeInst < 0 {
         return true
     }
-    now := time.Now().UnixNano()
+    now := ql.now()
     if now < ql.WriteInQuorumUntil {
         return false
     }
@@ -404,7 +404,7 @@ func (t *LeaseMetadata) Unmarshal(rr io.Reader) error {
 	}
 	var b [10]byte
 	var bs []byte
-	alen1, err := binary.ReadVarint(wire)
+	alen1, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
 	if err != nil {
 		return err
 	}
@@ -416,13 +416,15 @@ func (t *LeaseMetadata) Unmarshal(rr io.Reader) error {
 		}
 		t.Quorum[i] = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
 	}
-	alen2, err := binary.ReadVarint(wire)
+	alen2, err := fastrpc.ReadLen(wire, fastrpc.MAX_ARRAY_LEN)
 	if err != nil {
 		return err
 	}
 	t.ObjectKeys = make([]state.Key, alen2)
 	for i := int64(0); i < alen2; i++ {
-		t.ObjectKeys[i].Unmarshal(wire)
+		if err := t.ObjectKeys[i].Unmarshal(wire); err != nil {
+			return err
+		}
 	}
 	bs = b[:2]
 	if _, err := io.ReadAtLeast(wire, bs, 2); err != nil {
@@ -432,3 +434,48 @@ func (t *LeaseMetadata) Unmarshal(rr io.Reader) error {
 	t.ReinstateReplicas = uint8(bs[1])
 	return nil
 }
+
+func (t *Guard) Size() int {
+	return 20
+}
+
+func (t *Guard) MarshalTo(b []byte) int {
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint64(b[4:12], uint64(t.TimestampNs))
+	binary.LittleEndian.PutUint64(b[12:20], uint64(t.GuardDuration))
+	return 20
+}
+
+func (t *GuardReply) Size() int {
+	return 12
+}
+
+func (t *GuardReply) MarshalTo(b []byte) int {
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint64(b[4:12], uint64(t.TimestampNs))
+	return 12
+}
+
+func (t *Promise) Size() int {
+	return 28
+}
+
+func (t *Promise) MarshalTo(b []byte) int {
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.LeaseInstance))
+	binary.LittleEndian.PutUint64(b[8:16], uint64(t.TimestampNs))
+	binary.LittleEndian.PutUint64(b[16:24], uint64(t.DurationNs))
+	binary.LittleEndian.PutUint32(b[24:28], uint32(t.LatestAcceptedInst))
+	return 28
+}
+
+func (t *PromiseReply) Size() int {
+	return 16
+}
+
+func (t *PromiseReply) MarshalTo(b []byte) int {
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.ReplicaId))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.LeaseInstance))
+	binary.LittleEndian.PutUint64(b[8:16], uint64(t.TimestampNs))
+	return 16
+}
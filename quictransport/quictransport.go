@@ -0,0 +1,293 @@
+// Package quictransport connects replicas over QUIC (see
+// genericsmr.WithTransport). Each connection between two replicas is a QUIC
+// connection with one stream per message lane: the data messages go on one
+// stream, and the control messages (lease guards and promises, beacons) on
+// another, so that a lost packet of bulk data holds back only the data
+// stream, and not the lease renewals as it would on a TCP connection.
+// Clients still connect over TCP, on the same port number as the replicas.
+package quictransport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN protocol of the replicas' QUIC connections
+const ALPN = "qlease"
+
+// how long dialing a replica, or waiting for its lane, may take
+const CONNECT_TIMEOUT = 10 * time.Second
+
+// how often an otherwise silent connection sends a packet, so that it does not
+// time out (quic-go's idle timeout is 30s)
+const KEEPALIVE_PERIOD = 5 * time.Second
+
+// first byte of a lane's stream, with which its opener announces it (a QUIC
+// stream reaches the peer with its first data)
+const LANE_MAGIC = 0xA6
+
+var ErrNotQUIC = errors.New("not a QUIC connection")
+
+// A Transport is a genericsmr.LaneTransport over QUIC.
+type Transport struct {
+	TLS  *tls.Config // must hold the replica's certificate, to listen
+	QUIC *quic.Config
+}
+
+// New returns a transport with the TLS configuration tlsConf (see SelfSigned
+// and LoadTLS).
+func New(tlsConf *tls.Config) *Transport {
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{ALPN}
+	return &Transport{TLS: tlsConf, QUIC: &quic.Config{KeepAlivePeriod: KEEPALIVE_PERIOD}}
+}
+
+// Dial connects to the replica at addr, whose data lane is the connection
+// returned: closing it closes the QUIC connection.
+func (t *Transport) Dial(addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONNECT_TIMEOUT)
+	defer cancel()
+	qc, err := quic.DialAddr(ctx, addr, t.TLS, t.QUIC)
+	if err != nil {
+		return nil, err
+	}
+	s, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		qc.CloseWithError(0, "")
+		return nil, err
+	}
+	return &streamConn{s, qc, true}, nil
+}
+
+// Listen accepts the replicas' QUIC connections on the UDP port of addr, and
+// the clients' TCP connections on the TCP port of the same number (picked by
+// the system if addr's port is 0).
+func (t *Transport) Listen(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	tl, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	port := tl.Addr().(*net.TCPAddr).Port
+	ql, err := quic.ListenAddr(net.JoinHostPort(host, strconv.Itoa(port)), t.TLS, t.QUIC)
+	if err != nil {
+		tl.Close()
+		return nil, err
+	}
+	l := &listener{tcp: tl, quic: ql, accepted: make(chan accepted), done: make(chan struct{})}
+	go l.acceptTCP()
+	go l.acceptQUIC()
+	return l, nil
+}
+
+// OpenLane opens another lane of conn, a connection returned by Dial.
+func (t *Transport) OpenLane(conn net.Conn) (net.Conn, error) {
+	c, ok := conn.(*streamConn)
+	if !ok {
+		return nil, ErrNotQUIC
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), CONNECT_TIMEOUT)
+	defer cancel()
+	s, err := c.qc.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.Write([]byte{LANE_MAGIC}); err != nil {
+		s.CancelWrite(0)
+		return nil, err
+	}
+	return &streamConn{s, c.qc, false}, nil
+}
+
+// AcceptLane waits for the peer to open another lane of conn, a connection
+// accepted by a listener of the transport.
+func (t *Transport) AcceptLane(conn net.Conn) (net.Conn, error) {
+	c, ok := conn.(*streamConn)
+	if !ok {
+		return nil, ErrNotQUIC
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), CONNECT_TIMEOUT)
+	defer cancel()
+	s, err := c.qc.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var b [1]byte
+	s.SetReadDeadline(time.Now().Add(CONNECT_TIMEOUT))
+	if _, err := io.ReadFull(s, b[:]); err != nil || b[0] != LANE_MAGIC {
+		s.CancelRead(0)
+		s.CancelWrite(0)
+		return nil, fmt.Errorf("no lane opened by %s", c.RemoteAddr())
+	}
+	s.SetReadDeadline(time.Time{})
+	return &streamConn{s, c.qc, false}, nil
+}
+
+// a stream of a QUIC connection, as a net.Conn
+type streamConn struct {
+	*quic.Stream
+	qc    *quic.Conn
+	whole bool // closing the stream closes the connection (the data lane)?
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.qc.LocalAddr()
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.qc.RemoteAddr()
+}
+
+func (c *streamConn) Close() error {
+	if c.whole {
+		return c.qc.CloseWithError(0, "")
+	}
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+// a listener for both the QUIC connections and the TCP ones
+type listener struct {
+	tcp       net.Listener
+	quic      *quic.Listener
+	accepted  chan accepted
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *listener) acceptTCP() {
+	for {
+		conn, err := l.tcp.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		select {
+		case l.accepted <- accepted{conn, err}:
+		case <-l.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func (l *listener) acceptQUIC() {
+	for {
+		qc, err := l.quic.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		go l.acceptDataLane(qc)
+	}
+}
+
+// wait for the data lane that the dialer opens with its handshake
+func (l *listener) acceptDataLane(qc *quic.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONNECT_TIMEOUT)
+	defer cancel()
+	s, err := qc.AcceptStream(ctx)
+	if err != nil {
+		qc.CloseWithError(0, "")
+		return
+	}
+	select {
+	case l.accepted <- accepted{&streamConn{s, qc, true}, nil}:
+	case <-l.done:
+		qc.CloseWithError(0, "")
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case a := <-l.accepted:
+		return a.conn, a.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.quic.Close()
+		l.tcp.Close()
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.tcp.Addr()
+}
+
+// SelfSigned returns a TLS configuration with a new self-signed certificate,
+// which accepts any certificate from the peers: the connections are
+// encrypted, but the replicas are no better authenticated than over TCP.
+func SelfSigned() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: ALPN},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}, nil
+}
+
+// LoadTLS returns a TLS configuration with the certificate and key in the PEM
+// files certFile and keyFile, which requires the peers' certificates to be
+// signed by a certificate authority in the PEM file caFile. As a replica both
+// dials and accepts its peers, its certificate must be valid for both, and
+// for the address it is dialed at.
+func LoadTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in %s", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
@@ -0,0 +1,7 @@
+// func Cputicks() (t uint64)
+TEXT ·Cputicks(SB),7,$0-8
+    RDTSC
+    SHLQ  $32, DX
+    ADDQ  DX, AX
+    MOVQ  AX, t+0(FP)
+    RET
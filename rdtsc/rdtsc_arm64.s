@@ -0,0 +1,8 @@
+#include "textflag.h"
+
+// func Cputicks() (t uint64)
+TEXT ·Cputicks(SB),NOSPLIT,$0-8
+    ISB   $15
+    MRS   CNTVCT_EL0, R0
+    MOVD  R0, t+0(FP)
+    RET
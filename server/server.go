@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
@@ -11,11 +12,20 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/glycerine/qlease/epaxos"
+	"github.com/glycerine/qlease/fastrpc"
+	"github.com/glycerine/qlease/genericsmr"
+	"github.com/glycerine/qlease/genericsmrproto"
 	"github.com/glycerine/qlease/lpaxos"
 	"github.com/glycerine/qlease/masterproto"
+	"github.com/glycerine/qlease/mencius"
 	"github.com/glycerine/qlease/paxos"
+	"github.com/glycerine/qlease/quictransport"
+	"github.com/glycerine/qlease/sockopt"
 )
 
 var portnum *int = flag.Int("port", 7070, "Port # to listen on. Defaults to 7070")
@@ -23,6 +33,7 @@ var leaseport *int = flag.Int("lport", 7060, "Lease port # to listen on. Default
 var masterAddr *string = flag.String("maddr", "", "Master address. Defaults to localhost.")
 var masterPort *int = flag.Int("mport", 7077, "Master port.  Defaults to 7087.")
 var myAddr *string = flag.String("addr", "", "Server address (this machine). Defaults to localhost.")
+var listenHost = flag.String("listen", "", "Address to bind (e.g., 0.0.0.0 or ::) if not the -addr advertised to peers and clients. Defaults to -addr.")
 var procs *int = flag.Int("p", 2, "GOMAXPROCS. Defaults to 2")
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 var thrifty = flag.Bool("thrifty", false, "Use only as many messages as strictly required for inter-replica communication.")
@@ -30,11 +41,160 @@ var exec = flag.Bool("exec", false, "Execute commands.")
 var dreply = flag.Bool("dreply", false, "Reply to client only after command has been executed.")
 var beacon = flag.Bool("beacon", false, "Send beacons to other replicas to compare their relative speeds.")
 var durable = flag.Bool("durable", false, "Log to a stable store (i.e., a file in the current dir).")
+var shedLatency = flag.Duration("shedlatency", 0, "With -thrifty, shed a peer whose beacon latency exceeds this from the preferred quorum (needs -beacon). Defaults to never.")
+var shedQueue = flag.Int64("shedqueue", 0, "With -thrifty, shed a peer with more writers than this queued for its connection from the preferred quorum. Defaults to never.")
+var shedLeases = flag.Bool("shedleases", false, "Also move the leases of the peers shed from the preferred quorum to the peers replacing them.")
 var directAcks = flag.Bool("directAcks", false, "Send Accept Replies directly to the originating replica, not only the leader.")
+var aclFile = flag.String("acl", "", "File with per-key client access rules (needs -tokens). Defaults to allowing all clients everything.")
+var tokensFile = flag.String("tokens", "", "File with the token of each client identity (lines of \"identity token\"), which clients must present to be granted the identity's -acl rules.")
+var srvName = flag.String("srv", "", "Discover peers from the DNS SRV records with this name instead of registering with the master.")
+var seeds = flag.String("seeds", "", "Comma-separated gossip addresses of seed replicas to discover peers from, instead of registering with the master.")
+var gossipPort = flag.Int("gport", 7050, "Gossip port # for seed-based peer discovery. Defaults to 7050.")
+var numReplicas = flag.Int("N", 3, "Number of replicas to wait for with seed-based peer discovery. Defaults to 3.")
+var groups = flag.Int("groups", 1, "Number of independent SMR groups to host, sharing the same ports and peer connections. Defaults to 1.")
+var shardFile = flag.String("shards", "", "File assigning key ranges to groups; client requests are routed to the owning group. Defaults to sending everything to group 0.")
+var fwdTimeout = flag.Duration("fwdtimeout", 0, "Answer ERR_TIMEOUT to a proposal forwarded to the leader that gets no reply for this long. Defaults to 10s.")
+var sendTimeout = flag.Duration("sendtimeout", 0, "Disconnect from a peer that blocks lease messages for longer than this. Defaults to waiting indefinitely.")
+var maxClients = flag.Int("maxclients", 0, "Maximum number of client connections. Defaults to no limit.")
+var clientIdle = flag.Duration("clientidle", 0, "Close client connections that send no request for this long. Defaults to keeping them open.")
+var sessions = flag.Bool("sessions", false, "Multiplex peer connections into sessions that either side re-establishes when they break (all replicas must agree; single group only).")
+var tcpKeepAlive = flag.Duration("keepalive", 0, "TCP keepalive period of peer and client connections. Defaults to Go's (15s).")
+var peerSockOpt = flag.String("peersockopt", "", "Socket options of peer connections, e.g. nagle=off,sndbuf=4M,rcvbuf=4M,dscp=ef. Defaults to Go's and the system's.")
+var clientSockOpt = flag.String("clientsockopt", "", "Socket options of client connections, as for -peersockopt.")
+var pingInterval = flag.Duration("pinginterval", 0, "Ping peers that have been silent for this long. Defaults to not pinging.")
+var pingTimeout = flag.Duration("pingtimeout", 0, "Disconnect from peers that have been silent for this long (use with -pinginterval). Defaults to never.")
+var peerReadTimeout = flag.Duration("peerreadtimeout", 0, "Disconnect from a peer that sends nothing for this long (use with a shorter -pinginterval). Defaults to never.")
+var peerWriteTimeout = flag.Duration("peerwritetimeout", 0, "Disconnect from a peer that accepts no data for this long. Defaults to never.")
+var clientWriteTimeout = flag.Duration("clientwritetimeout", 0, "Close client connections that accept no reply for this long. Defaults to never.")
+var injectFaults = flag.Bool("faults", false, "Let network failures between replicas be injected through /faults on the RPC port (port+1000), for testing.")
+var proxyProtocol = flag.Bool("proxyprotocol", false, "Read the original client address from the PROXY protocol header (v1 or v2) that a load balancer sends; every client connection must then come through it.")
+var clientOps = flag.Int64("clientops", 0, "Maximum proposals per second per client connection; more are answered OVERLOADED. Defaults to no limit.")
+var clientBytes = flag.Int64("clientbytes", 0, "Maximum bytes per second per client connection; proposals beyond it are answered OVERLOADED. Defaults to no limit.")
+var maxClientMsg = flag.Int64("maxclientmsg", 0, "Maximum bytes of a client message; clients sending larger ones are answered TOO_LARGE and disconnected. Defaults to the codecs' own bounds.")
+var maxLeaseKeys = flag.Int64("maxleasekeys", 0, "Maximum keys a client lease may name; larger requests are denied TOO_LARGE. Defaults to no limit.")
+var piggyback = flag.Bool("piggyback", false, "Carry lease promises and replies on other messages to peers when possible, rather than on their own (every replica must understand them).")
+var peerEgress = flag.Int64("peeregress", 0, "Bytes per second sent to each peer beyond which catch-up, snapshot and anti-entropy transfers wait (0 for no limit).")
+var snapshotRate = flag.Int64("snapshotrate", genericsmr.DEFAULT_SNAPSHOT_BYTES_PER_SEC, "Maximum bytes per second of snapshots sent to peers fetching them (0 for no limit).")
+var maxBacklog = flag.Int64("maxbacklog", 0, "Push back on client proposals while this many instances are proposed but not yet executed. Defaults to no limit.")
+var backlogPolicy = flag.String("backlogpolicy", "reject", "How to push back on clients beyond -maxbacklog: reject (answer OVERLOADED) or pause (stop reading from the client until the backlog drains).")
+var peerReadBuffer = flag.Int("peerreadbuf", 0, "Bytes buffered reading from each peer connection. Defaults to 4KB.")
+var peerWriteBuffer = flag.Int("peerwritebuf", 0, "Bytes buffered writing to each peer connection. Defaults to 4KB.")
+var directWrites = flag.Int("directwrites", 0, "Write the parts of peer messages of at least this many bytes straight to the connection, bypassing its buffer. Defaults to never.")
+var decodeWorkers = flag.Int("decodeworkers", 0, "Decode the fixed-size messages from peers on this many worker goroutines instead of on each peer's reader. Defaults to none.")
+var leaseOverflow = flag.String("leaseoverflow", "block", "What to do with lease messages from a peer when their queue is full: block (holding up the peer's other messages), drop-oldest or drop-newest.")
+var leaseGuard = flag.Duration("leaseguard", 0, "Guard that precedes quorum leases (longer in a WAN). Defaults to 1s, or the bootstrapped value.")
+var leaseDuration = flag.Duration("leaseduration", 0, "Duration of quorum leases; must exceed the guard. Defaults to 2s, or the bootstrapped value.")
+var leaseRenewLead = flag.Duration("leaserenewlead", 0, "How long before they expire quorum leases are renewed; must be less than their duration. Defaults to 1.5s (less for short leases), or the bootstrapped value.")
+var leaseRenewJitter = flag.Duration("leaserenewjitter", 0, "Renew quorum leases up to this much earlier still, at random, so that replicas do not renew together. Defaults to 100ms (less for short leases), or the bootstrapped value.")
+var readStrategy = flag.String("reads", "lease", "How to serve linearizable reads: lease (locally under quorum leases) or readindex (confirmed by the leader with a quorum round, without relying on clocks).")
+var resultCache = flag.Int("resultcache", genericsmr.RESULT_CACHE_SIZE, "Results remembered per client session, so that proposals a client sends again are not executed twice (0 to remember none).")
+var tracePath = flag.String("trace", "", "Record the messages reaching the replica from peers and clients to this file, for qlease-replay.")
+var useEPaxos = flag.Bool("epaxos", false, "Run EPaxos instead of classic Paxos (single group only).")
+var useMencius = flag.Bool("mencius", false, "Run Mencius instead of classic Paxos (single group only).")
+var bootstrap = flag.String("bootstrap", "", "Fetch the peers and initial parameters from a bootstrap provider (file:<path>, consul:<agent URL> or etcd:<URL>) instead of registering with the master.")
+var bootstrapPrefix = flag.String("bootstrapprefix", "qlease", "Key prefix of the cluster in a consul: or etcd: -bootstrap provider, which waits for -N replicas.")
+var zones = flag.String("zones", "", "Comma-separated zones of the replicas, by replica ID (e.g., us-east-1a,us-east-1b,eu-west-1a); with -bootstrap file:, the file's zones are used by default.")
+var regions = flag.String("regions", "", "Comma-separated regions of the replicas, by replica ID; leases are granted to the regions that read a key.")
+var zoneSafe = flag.Bool("zonesafe", false, "Make every write reach a replica outside the leader's zone, so that it survives a zone outage (needs -zones).")
+var priorities = flag.Bool("priorities", false, "Hand client proposals to the protocol by their priority class (high, normal, then bulk) rather than as they arrive.")
+var hierLeases = flag.Bool("hierleases", false, "Renew the leases of each region through one replica of the region, so that only it exchanges promises with the other regions (needs -regions).")
+var peerCodecName = flag.String("peercodec", "binary", "Codec of the messages sent to peers: binary or json (for debugging); not with -sessions or -groups.")
+var useQUIC = flag.Bool("quic", false, "Connect to peers over QUIC, on the UDP port of each replica's port number, with their lease messages on a stream of their own; clients still connect over TCP (all replicas must agree; not with -groups).")
+var quicCert = flag.String("quiccert", "", "PEM certificate of this replica for -quic, valid for its -addr, and signed by -quicca. Defaults to a self-signed certificate, with which peers are not authenticated.")
+var quicKey = flag.String("quickey", "", "PEM key of the -quiccert certificate.")
+var quicCA = flag.String("quicca", "", "PEM certificates of the authorities that sign the peers' -quiccert certificates.")
+var leaseCheck = flag.String("leasecheck", "", "Check every local read against the writes this replica knows to be committed, for debugging: log (and count) violations, or panic on them. Defaults to not checking.")
+var readPrefix = flag.Int("readprefix", -1, "Count client reads by key prefix as well as in total, the keys that are equal shifted right by this many bits sharing a prefix. Defaults to in total only.")
+var leaseIdle = flag.Duration("leaseidle", 0, "Suspend a replica's lease once its clients have sent it no reads for this long, until the next read. Defaults to never.")
+var maxState = flag.Int64("maxstate", 0, "Act as -statepolicy says once the state takes about this many bytes of memory (with -groups, each group's). Defaults to no limit.")
+var statePolicy = flag.String("statepolicy", "reject", "What to do at -maxstate, a comma-separated list of: reject (answer client writes NOT_WRITABLE while over it), backup (take a backup, which needs -backupto), or none (only log).")
+var antiEntropy = flag.Duration("antientropy", 0, "Compare the state with the peers' this often, and repair the keys that diverge (Paxos and Mencius). Defaults to never.")
+var auditPath = flag.String("audit", "", "Append parameter, lease configuration, membership and leader changes, and admin RPCs, to this audit log (read it with client -audit). Defaults to keeping none.")
+var backupSchedule = flag.String("backup", "", "Back the state up on this schedule: a cron expression (e.g., \"0 3 * * *\"), @hourly, @daily, or \"@every <duration>\" (Paxos and Mencius; needs -backupto). Defaults to backing up only when asked (client -backup).")
+var backupTo = flag.String("backupto", "", "Where to upload backups: a directory, or s3://<bucket>/<prefix> (with -s3endpoint, and the credentials in AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN). Defaults to taking no backups.")
+var backupKeep = flag.Int("backupkeep", 0, "Keep at most this many backups of each replica and group. Defaults to keeping them all.")
+var backupMaxAge = flag.Duration("backupmaxage", 0, "Delete backups older than this (the latest is always kept). Defaults to keeping them all.")
+var s3Endpoint = flag.String("s3endpoint", "https://s3.amazonaws.com", "Endpoint of the S3-compatible object store of an s3:// -backupto.")
+var s3Region = flag.String("s3region", os.Getenv("AWS_REGION"), "Region of the S3-compatible object store of an s3:// -backupto. Defaults to $AWS_REGION, or us-east-1.")
+var debugAddr = flag.String("debugaddr", "", "Serve pprof profiles, goroutine dumps, channel depths and expvar over HTTP at this address (e.g., 127.0.0.1:6060), which should not be public. Defaults to not serving them.")
+var importPath = flag.String("import", "", "Seed the state machine from this state export (made with client -export) at startup; with -groups, from <file>.<group> for each group. Every replica of a new cluster must import the same export.")
+var reresolve = flag.Duration("reresolve", 30*time.Second, "How often to re-resolve discovered peer addresses.")
 
 func main() {
 	flag.Parse()
 
+	overflow, err := genericsmr.ParseOverflowPolicy(*leaseOverflow)
+	if err != nil {
+		log.Fatal(err)
+	}
+	leaseOverflowPolicy = overflow
+	if admissionPolicy, err = genericsmr.ParseAdmissionPolicy(*backlogPolicy); err != nil {
+		log.Fatal(err)
+	}
+	if stateMemoryPolicy, err = genericsmr.ParseStateMemoryPolicy(*statePolicy); err != nil {
+		log.Fatal(err)
+	}
+	if reads, err = genericsmr.ParseReadStrategy(*readStrategy); err != nil {
+		log.Fatal(err)
+	}
+	if peerCodec, err = fastrpc.CodecByName(*peerCodecName); err != nil {
+		log.Fatal(err)
+	}
+	if peerSocket, err = sockopt.Parse(*peerSockOpt); err != nil {
+		log.Fatal(err)
+	}
+	if *useQUIC {
+		if *groups > 1 {
+			log.Fatal("-quic is for single-group replicas")
+		}
+		var tlsConf *tls.Config
+		if *quicCert != "" {
+			tlsConf, err = quictransport.LoadTLS(*quicCert, *quicKey, *quicCA)
+		} else {
+			tlsConf, err = quictransport.SelfSigned()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		peerTransport = quictransport.New(tlsConf)
+	}
+	if clientSocket, err = sockopt.Parse(*clientSockOpt); err != nil {
+		log.Fatal(err)
+	}
+	switch *leaseCheck {
+	case "":
+	case "log", "panic":
+		leaseChecker = genericsmr.NewLeaseChecker(*leaseCheck == "panic")
+	default:
+		log.Fatalf("-leasecheck must be log or panic, not %q", *leaseCheck)
+	}
+	if *auditPath != "" {
+		if auditLog, err = genericsmr.OpenAuditLog(*auditPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *backupTo != "" {
+		if backups, err = backupConfig(); err != nil {
+			log.Fatal(err)
+		}
+	} else if *backupSchedule != "" {
+		log.Fatal("-backup needs -backupto")
+	} else if *maxState > 0 && stateMemoryPolicy&genericsmr.MEM_BACKUP != 0 {
+		log.Fatal("-statepolicy backup needs -backupto")
+	}
+	if *aclFile != "" && *tokensFile == "" {
+		// clients would be trusted with whatever identity they claim
+		log.Fatal("-acl needs -tokens")
+	}
+	if *tracePath != "" {
+		if *groups > 1 {
+			log.Fatal("-trace is for single-group replicas")
+		}
+		if traceFile, err = os.Create(*tracePath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	runtime.GOMAXPROCS(*procs)
 
 	if *cpuprofile != "" {
@@ -51,23 +211,114 @@ func main() {
 
 	log.Printf("Server starting on port %d\n", *portnum)
 
-	replicaId, nodeList, leaseNodeList := registerWithMaster(fmt.Sprintf("%s:%d", *masterAddr, *masterPort))
+	var replicaId int
+	var nodeList, leaseNodeList []string
+	resolver := peerResolver()
+	if *bootstrap != "" {
+		replicaId, nodeList, leaseNodeList = bootstrapPeers()
+	} else if resolver != nil {
+		replicaId, nodeList, leaseNodeList = discoverPeers(resolver)
+	} else {
+		replicaId, nodeList, leaseNodeList = registerWithMaster(net.JoinHostPort(*masterAddr, strconv.Itoa(*masterPort)))
+	}
+	setLeaseTiming()
+	if *injectFaults {
+		faults = genericsmr.NewFaults(len(nodeList))
+	}
+	if *zones != "" || *regions != "" {
+		if topology, err = genericsmr.ParseTopology(len(nodeList), *zones, *regions, *zoneSafe); err != nil {
+			log.Fatal(err)
+		}
+	} else if topology != nil {
+		topology.ZoneSafe = *zoneSafe
+	}
+	if topology != nil {
+		topology.HierarchicalLeases = *hierLeases
+	}
 	log.Println("Lease nodes:")
 	log.Println(leaseNodeList)
 	log.Println(nodeList)
 	log.Println(replicaId)
 
-	// we first start a Lease-Paxos replica -- we use Lease-Paxos to maintain consensus on lease info
-	log.Println("Starting Lease-Paxos replica...")
-	leaseRep := lpaxos.NewReplica(replicaId, leaseNodeList, *thrifty, *exec, *dreply, *durable)
+	var reps replicaGroups
+	if *useEPaxos {
+		log.Println("Starting EPaxos replica...")
+		rep := epaxos.NewReplicaWithOptions(replicaId, nodeList, replicaOptions(nodeList[replicaId])...)
+		reps = append(reps, rep.Replica)
+		rpc.Register(rep)
+	} else if *useMencius {
+		log.Println("Starting Mencius replica...")
+		rep := mencius.NewReplicaWithOptions(replicaId, nodeList, replicaOptions(nodeList[replicaId])...)
+		reps = append(reps, rep.Replica)
+		rpc.Register(rep)
+	} else if *groups <= 1 {
+		// we first start a Lease-Paxos replica -- we use Lease-Paxos to maintain consensus on lease info
+		log.Println("Starting Lease-Paxos replica...")
+		lopts := []genericsmr.Option{genericsmr.WithThrifty(*thrifty), genericsmr.WithExec(*exec), genericsmr.WithDreply(*dreply),
+			genericsmr.WithListenAddr(bindAddr(leaseNodeList[replicaId])), genericsmr.WithPeerSessions(*sessions), genericsmr.WithPeerCodec(peerCodec),
+			genericsmr.WithParams(bootstrapParams), genericsmr.WithFaults(faults), genericsmr.WithSocketOptions(peerSocket, clientSocket),
+			genericsmr.WithTransport(peerTransport)}
+		if *durable {
+			lopts = append(lopts, genericsmr.WithDurable(""))
+		}
+		leaseRep := lpaxos.NewReplicaWithOptions(replicaId, leaseNodeList, lopts...)
 
-	log.Println("Starting classic Paxos replica...")
-	rep := paxos.NewReplica(replicaId, nodeList, *thrifty, *exec, *dreply, *durable, *beacon, leaseRep, *directAcks)
-	rpc.Register(rep)
+		log.Println("Starting classic Paxos replica...")
+		rep := paxos.NewReplicaWithOptions(replicaId, nodeList, leaseRep, *directAcks, replicaOptions(nodeList[replicaId])...)
+		reps = append(reps, rep.Replica)
+		rpc.Register(rep)
+	} else {
+		reps = startGroups(replicaId, nodeList, leaseNodeList)
+		rpc.RegisterName("Replica", reps)
+	}
+	rep := reps[0]
+	if *importPath != "" {
+		for g, r := range reps {
+			path := *importPath
+			if len(reps) > 1 {
+				path = fmt.Sprintf("%s.%d", path, g)
+			}
+			info, err := r.ImportFile(path)
+			if err != nil {
+				log.Fatalf("cannot import %s: %v", path, err)
+			}
+			log.Printf("Imported %d keys from %s (replica %d, instance %d)\n", info.Keys, path, info.ReplicaId, info.Inst)
+		}
+	}
+	if *aclFile != "" {
+		f, err := os.Open(*aclFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		acl, err := genericsmr.ReadACL(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		f.Close()
+		if f, err = os.Open(*tokensFile); err != nil {
+			log.Fatal(err)
+		}
+		auth, err := genericsmr.ReadTokens(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		f.Close()
+		for _, r := range reps {
+			r.ACL = acl
+			r.Authenticator = auth
+		}
+	}
+	if resolver != nil {
+		go rep.ResolvePeersPeriodically(resolver, *reresolve)
+	}
 
 	rpc.HandleHTTP()
-	//listen for RPC on a different port (8070 by default)
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", *portnum+1000))
+	genericsmr.HandleHealth(http.DefaultServeMux, reps...)
+	if faults != nil {
+		genericsmr.HandleFaults(http.DefaultServeMux, faults)
+	}
+	//listen for RPC and health checks on a different port (8070 by default)
+	l, err := net.Listen("tcp", net.JoinHostPort(*listenHost, strconv.Itoa(*portnum+1000)))
 	if err != nil {
 		log.Fatal("listen error:", err)
 	}
@@ -75,6 +326,263 @@ func main() {
 	http.Serve(l, nil)
 }
 
+// the address to bind for a port advertised as advertised
+func bindAddr(advertised string) string {
+	if *listenHost == "" {
+		return ""
+	}
+	addr, err := genericsmr.ListenAddr(*listenHost, advertised)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return addr
+}
+
+// parsed from -leaseoverflow
+var leaseOverflowPolicy genericsmr.OverflowPolicy
+
+// parsed from -backlogpolicy
+var admissionPolicy genericsmr.AdmissionPolicy
+
+// parsed from -statepolicy
+var stateMemoryPolicy genericsmr.StateMemoryPolicy
+
+// fetched with -bootstrap
+var bootstrapParams map[uint8]int64
+
+// parsed from -reads
+var reads genericsmr.ReadStrategy
+
+// parsed from -peercodec
+var peerCodec uint8
+
+// parsed from -peersockopt and -clientsockopt
+var peerSocket, clientSocket sockopt.Options
+
+// created with -quic (nil for TCP)
+var peerTransport genericsmr.Transport
+
+// parsed from -zones and -regions, or fetched with -bootstrap
+var topology *genericsmr.Topology
+
+// opened from -trace
+var traceFile *os.File
+
+// created with -faults
+var faults *genericsmr.Faults
+
+// created with -leasecheck
+var leaseChecker *genericsmr.LeaseChecker
+
+// opened with -audit
+var auditLog *genericsmr.AuditLog
+
+// parsed from -backup and -backupto
+var backups *genericsmr.BackupConfig
+
+// the options of a single-group replica advertising addr
+func replicaOptions(addr string) []genericsmr.Option {
+	opts := []genericsmr.Option{genericsmr.WithThrifty(*thrifty), genericsmr.WithExec(*exec), genericsmr.WithDreply(*dreply),
+		genericsmr.WithListenAddr(bindAddr(addr)), genericsmr.WithPeerSessions(*sessions), genericsmr.WithPeerCodec(peerCodec),
+		genericsmr.WithBeacon(*beacon), genericsmr.WithPeerSendTimeout(int64(*sendTimeout)), genericsmr.WithForwardTimeout(int64(*fwdTimeout)),
+		genericsmr.WithSlowPeerShedding(int64(*shedLatency), *shedQueue, *shedLeases),
+		genericsmr.WithClientLimits(*maxClients, int64(*clientIdle)), genericsmr.WithClientRateLimits(*clientOps, *clientBytes),
+		genericsmr.WithClientMsgLimits(*maxClientMsg, *maxLeaseKeys), genericsmr.WithProxyProtocol(*proxyProtocol),
+		genericsmr.WithAdmissionControl(*maxBacklog, admissionPolicy), genericsmr.WithPriorityScheduling(*priorities),
+		genericsmr.WithSnapshotRate(*snapshotRate), genericsmr.WithPeerEgressLimit(*peerEgress), genericsmr.WithAntiEntropy(int64(*antiEntropy)),
+		genericsmr.WithLeaseIdleSuspension(int64(*leaseIdle)), genericsmr.WithReadStatsByPrefix(*readPrefix),
+		genericsmr.WithStateMemoryLimit(*maxState, stateMemoryPolicy, nil),
+		genericsmr.WithKeepAlive(int64(*tcpKeepAlive), int64(*pingInterval), int64(*pingTimeout)), genericsmr.WithSocketOptions(peerSocket, clientSocket),
+		genericsmr.WithTransport(peerTransport),
+		genericsmr.WithDeadlines(int64(*peerReadTimeout), int64(*peerWriteTimeout), int64(*clientWriteTimeout)),
+		genericsmr.WithLeaseOverflowPolicy(leaseOverflowPolicy), genericsmr.WithParams(bootstrapParams),
+		genericsmr.WithDecodeWorkers(*decodeWorkers),
+		genericsmr.WithPeerBuffers(*peerReadBuffer, *peerWriteBuffer), genericsmr.WithDirectPeerWrites(*directWrites),
+		genericsmr.WithPiggybackLeases(*piggyback), genericsmr.WithLeaseChecker(leaseChecker), genericsmr.WithAuditLog(auditLog),
+		genericsmr.WithBackups(backups), genericsmr.WithDebugServer(*debugAddr), genericsmr.WithReadStrategy(reads), genericsmr.WithResultCache(*resultCache),
+		genericsmr.WithTopology(topology), genericsmr.WithFaults(faults)}
+	if *durable {
+		opts = append(opts, genericsmr.WithDurable(""))
+	}
+	if traceFile != nil {
+		opts = append(opts, genericsmr.WithTrace(traceFile))
+	}
+	return opts
+}
+
+// the backups that -backup, -backupto, -backupkeep and -backupmaxage set
+func backupConfig() (*genericsmr.BackupConfig, error) {
+	b := &genericsmr.BackupConfig{Retention: genericsmr.BackupRetention{Keep: *backupKeep, MaxAge: *backupMaxAge}}
+	if *backupSchedule != "" {
+		sched, err := genericsmr.ParseBackupSchedule(*backupSchedule)
+		if err != nil {
+			return nil, err
+		}
+		b.Schedule = sched
+	}
+	if strings.HasPrefix(*backupTo, "s3://") {
+		bucket := strings.TrimPrefix(*backupTo, "s3://")
+		prefix := ""
+		if i := strings.IndexByte(bucket, '/'); i >= 0 {
+			bucket, prefix = bucket[:i], bucket[i+1:]
+		}
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		b.Uploader = &genericsmr.S3Uploader{
+			Endpoint:     *s3Endpoint,
+			Region:       *s3Region,
+			Bucket:       bucket,
+			Prefix:       prefix,
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		return b, nil
+	}
+	if err := os.MkdirAll(*backupTo, 0755); err != nil {
+		return nil, err
+	}
+	b.Uploader = &genericsmr.DirUploader{Dir: *backupTo}
+	return b, nil
+}
+
+// start one Lease-Paxos and one classic Paxos replica per group, each kind
+// multiplexed over its own port
+func startGroups(replicaId int, nodeList []string, leaseNodeList []string) replicaGroups {
+	mux := genericsmr.NewGroupMux(replicaId, nodeList, nil)
+	mux.ListenAddr = bindAddr(nodeList[replicaId])
+	if *shardFile != "" {
+		f, err := os.Open(*shardFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if mux.Shards, err = genericsmr.ReadShardMap(f); err != nil {
+			log.Fatal(err)
+		}
+		f.Close()
+		for _, sr := range mux.Shards.Ranges() {
+			if int(sr.Group) >= *groups {
+				log.Printf("Shard [%d, %d] belongs to group %d, which is not hosted here; its clients will be redirected\n", sr.Lo, sr.Hi, sr.Group)
+			}
+		}
+	}
+	leaseMux := genericsmr.NewGroupMux(replicaId, leaseNodeList, nil)
+	leaseMux.ListenAddr = bindAddr(leaseNodeList[replicaId])
+	reps := make(replicaGroups, *groups)
+	for g := 0; g < *groups; g++ {
+		common := []genericsmr.Option{genericsmr.WithThrifty(*thrifty), genericsmr.WithExec(*exec), genericsmr.WithDreply(*dreply),
+			genericsmr.WithParams(bootstrapParams), genericsmr.WithFaults(faults), genericsmr.WithSocketOptions(peerSocket, clientSocket)}
+
+		log.Printf("Starting Lease-Paxos replica for group %d...\n", g)
+		lopts := append(common,
+			genericsmr.WithGroup(leaseMux, uint16(g)),
+			genericsmr.WithStableStorePath(fmt.Sprintf("stable-store-lease-replica%d-group%d", replicaId, g)))
+		if *durable {
+			lopts = append(lopts, genericsmr.WithDurable(""))
+		}
+		leaseRep := lpaxos.NewReplicaWithOptions(replicaId, leaseNodeList, lopts...)
+
+		log.Printf("Starting classic Paxos replica for group %d...\n", g)
+		opts := append(common,
+			genericsmr.WithBeacon(*beacon),
+			genericsmr.WithSlowPeerShedding(int64(*shedLatency), *shedQueue, *shedLeases),
+			genericsmr.WithPeerSendTimeout(int64(*sendTimeout)),
+			genericsmr.WithForwardTimeout(int64(*fwdTimeout)),
+			genericsmr.WithClientLimits(*maxClients, int64(*clientIdle)),
+			genericsmr.WithClientRateLimits(*clientOps, *clientBytes),
+			genericsmr.WithClientMsgLimits(*maxClientMsg, *maxLeaseKeys),
+			genericsmr.WithAdmissionControl(*maxBacklog, admissionPolicy),
+			genericsmr.WithPriorityScheduling(*priorities),
+			genericsmr.WithProxyProtocol(*proxyProtocol),
+			genericsmr.WithSnapshotRate(*snapshotRate),
+			genericsmr.WithPeerEgressLimit(*peerEgress),
+			genericsmr.WithAntiEntropy(int64(*antiEntropy)),
+			genericsmr.WithLeaseIdleSuspension(int64(*leaseIdle)),
+			genericsmr.WithReadStatsByPrefix(*readPrefix),
+			genericsmr.WithStateMemoryLimit(*maxState, stateMemoryPolicy, nil),
+			genericsmr.WithKeepAlive(int64(*tcpKeepAlive), int64(*pingInterval), int64(*pingTimeout)),
+			genericsmr.WithDeadlines(int64(*peerReadTimeout), int64(*peerWriteTimeout), int64(*clientWriteTimeout)),
+			genericsmr.WithLeaseOverflowPolicy(leaseOverflowPolicy),
+			genericsmr.WithDecodeWorkers(*decodeWorkers),
+			genericsmr.WithPeerBuffers(*peerReadBuffer, *peerWriteBuffer),
+			genericsmr.WithDirectPeerWrites(*directWrites),
+			genericsmr.WithPiggybackLeases(*piggyback),
+			genericsmr.WithLeaseChecker(leaseChecker),
+			genericsmr.WithAuditLog(auditLog),
+			genericsmr.WithBackups(backups),
+			genericsmr.WithDebugServer(*debugAddr),
+			genericsmr.WithReadStrategy(reads),
+			genericsmr.WithResultCache(*resultCache),
+			genericsmr.WithTopology(topology),
+			genericsmr.WithGroup(mux, uint16(g)),
+			genericsmr.WithStableStorePath(fmt.Sprintf("stable-store-replica%d-group%d", replicaId, g)))
+		if *durable {
+			opts = append(opts, genericsmr.WithDurable(""))
+		}
+		reps[g] = paxos.NewReplicaWithOptions(replicaId, nodeList, leaseRep, *directAcks, opts...).Replica
+	}
+	return reps
+}
+
+// replicaGroups answers the master's RPCs on behalf of every group in the process
+type replicaGroups []*genericsmr.Replica
+
+func (rg replicaGroups) Ping(args *genericsmrproto.PingArgs, reply *genericsmrproto.PingReply) error {
+	for _, r := range rg {
+		if err := r.Ping(args, reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rg replicaGroups) BeTheLeader(args *genericsmrproto.BeTheLeaderArgs, reply *genericsmrproto.BeTheLeaderReply) error {
+	for _, r := range rg {
+		if err := r.BeTheLeader(args, reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rg replicaGroups) SetParam(args *genericsmrproto.SetParamArgs, reply *genericsmrproto.SetParamReply) error {
+	for _, r := range rg {
+		if err := r.SetParam(args, reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rg replicaGroups) PrepareStop(args *genericsmrproto.PrepareStopArgs, reply *genericsmrproto.PrepareStopReply) error {
+	for _, r := range rg {
+		if err := r.PrepareStop(args, reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the groups share one audit log
+func (rg replicaGroups) AuditTail(args *genericsmrproto.AuditTailArgs, reply *genericsmrproto.AuditTailReply) error {
+	return rg[0].AuditTail(args, reply)
+}
+
+func (rg replicaGroups) ExportState(args *genericsmrproto.ExportStateArgs, reply *genericsmrproto.ExportStateReply) error {
+	if int(args.Group) >= len(rg) {
+		return fmt.Errorf("group %d is not hosted here", args.Group)
+	}
+	return rg[args.Group].ExportState(args, reply)
+}
+
+func (rg replicaGroups) Backup(args *genericsmrproto.BackupArgs, reply *genericsmrproto.BackupReply) error {
+	if int(args.Group) >= len(rg) {
+		return fmt.Errorf("group %d is not hosted here", args.Group)
+	}
+	return rg[args.Group].Backup(args, reply)
+}
+
 func registerWithMaster(masterAddr string) (int, []string, []string) {
 	args := &masterproto.RegisterArgs{*myAddr, *portnum, *leaseport}
 	var reply masterproto.RegisterReply
@@ -94,6 +602,115 @@ func registerWithMaster(masterAddr string) (int, []string, []string) {
 	return reply.ReplicaId, reply.NodeList, reply.LeaseNodeList
 }
 
+func peerResolver() genericsmr.PeerResolver {
+	if *srvName != "" {
+		return &genericsmr.SRVPeers{Name: *srvName}
+	}
+	if *seeds != "" {
+		sp := &genericsmr.SeedPeers{
+			Self:     selfAddr(),
+			Seeds:    strings.Split(*seeds, ","),
+			Expected: *numReplicas}
+		l, err := net.Listen("tcp", net.JoinHostPort(*listenHost, strconv.Itoa(*gossipPort)))
+		if err != nil {
+			log.Fatal("gossip listen error:", err)
+		}
+		go sp.ServeGossip(l)
+		return sp
+	}
+	return nil
+}
+
+// the advertised address of this replica, in normal form
+func selfAddr() string {
+	addr, err := genericsmr.NormalizePeerAddr(net.JoinHostPort(*myAddr, strconv.Itoa(*portnum)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return addr
+}
+
+func discoverPeers(resolver genericsmr.PeerResolver) (int, []string, []string) {
+	var nodeList []string
+	var err error
+	for nodeList, err = resolver.ResolvePeers(); err != nil; nodeList, err = resolver.ResolvePeers() {
+		log.Println("Peer discovery failed:", err)
+		time.Sleep(1e9)
+	}
+	if nodeList, err = genericsmr.NormalizePeerAddrList(nodeList); err != nil {
+		log.Fatal(err)
+	}
+	self := selfAddr()
+	replicaId := genericsmr.PeerIndex(nodeList, self)
+	if replicaId < 0 {
+		log.Fatalf("This replica's address %s is not among the discovered peers %v\n", self, nodeList)
+	}
+	return replicaId, nodeList, leaseAddrs(nodeList)
+}
+
+// the lease addresses of peers that all use this replica's -lport
+func leaseAddrs(nodeList []string) []string {
+	leaseNodeList := make([]string, len(nodeList))
+	for i, addr := range nodeList {
+		host, _, _ := net.SplitHostPort(addr)
+		leaseNodeList[i] = net.JoinHostPort(host, fmt.Sprint(*leaseport))
+	}
+	return leaseNodeList
+}
+
+// publish this replica to the -bootstrap provider, and fetch the cluster's
+// configuration from it once it is complete
+func bootstrapPeers() (int, []string, []string) {
+	provider, err := genericsmr.ParseBootstrapProvider(*bootstrap, *bootstrapPrefix, *numReplicas)
+	if err != nil {
+		log.Fatal(err)
+	}
+	self := selfAddr()
+	member := genericsmr.Member{Addr: self, LeaseAddr: net.JoinHostPort(*myAddr, strconv.Itoa(*leaseport))}
+	for err = provider.Publish(member); err != nil; err = provider.Publish(member) {
+		log.Println("Publishing to the bootstrap provider failed:", err)
+		time.Sleep(1e9)
+	}
+	var cfg *genericsmr.ClusterConfig
+	for cfg, err = provider.Bootstrap(); err != nil; cfg, err = provider.Bootstrap() {
+		log.Println("Bootstrap failed:", err)
+		time.Sleep(1e9)
+	}
+	replicaId := cfg.ReplicaId(self)
+	if replicaId < 0 {
+		log.Fatalf("This replica's address %s is not among the bootstrapped peers %v\n", self, cfg.Peers)
+	}
+	if bootstrapParams, err = cfg.ParamValues(); err != nil {
+		log.Fatal(err)
+	}
+	topology = cfg.Topology()
+	leaseNodeList := cfg.LeasePeers
+	if len(leaseNodeList) == 0 {
+		leaseNodeList = leaseAddrs(cfg.Peers)
+	}
+	return replicaId, cfg.Peers, leaseNodeList
+}
+
+// override the bootstrapped lease timing with -leaseguard, -leaseduration,
+// -leaserenewlead and -leaserenewjitter
+func setLeaseTiming() {
+	flags := map[uint8]time.Duration{
+		genericsmr.PARAM_LEASE_GUARD_NS:        *leaseGuard,
+		genericsmr.PARAM_LEASE_DURATION_NS:     *leaseDuration,
+		genericsmr.PARAM_LEASE_RENEW_LEAD_NS:   *leaseRenewLead,
+		genericsmr.PARAM_LEASE_RENEW_JITTER_NS: *leaseRenewJitter,
+	}
+	for p, d := range flags {
+		if d <= 0 {
+			continue
+		}
+		if bootstrapParams == nil {
+			bootstrapParams = make(map[uint8]int64)
+		}
+		bootstrapParams[p] = int64(d)
+	}
+}
+
 func catchKill(interrupt chan os.Signal) {
 	<-interrupt
 	if *cpuprofile != "" {
@@ -0,0 +1,168 @@
+// Package sockopt sets the options of TCP connections that latency-sensitive
+// consensus traffic may need other than the defaults: Nagle's algorithm
+// (which Go turns off), the sizes of the kernel's send and receive buffers,
+// and the DSCP mark of the packets sent, for WAN QoS. Options are given as a
+// comma-separated spec (see Parse), e.g. "nagle=off,sndbuf=4M,rcvbuf=4M,dscp=ef".
+package sockopt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var ErrUnsupported = errors.New("DSCP marking is not supported on this platform")
+
+// Options are the options of a TCP connection. The zero value leaves every
+// option as Go and the system set it.
+type Options struct {
+	Nagle  bool  // delay small writes, to send them together
+	SndBuf int   // SO_SNDBUF, in bytes (0 for the system's default)
+	RcvBuf int   // SO_RCVBUF, in bytes (0 for the system's default)
+	DSCP   uint8 // the DSCP mark of the packets sent (0 for none)
+}
+
+// Apply sets the options on conn, or on the TCP connection it wraps (through
+// a NetConn method, as tls.Conn has). Connections that are not TCP are left
+// alone.
+func (o *Options) Apply(conn net.Conn) error {
+	tc := tcpConn(conn)
+	if tc == nil {
+		return nil
+	}
+	if err := tc.SetNoDelay(!o.Nagle); err != nil {
+		return err
+	}
+	if o.SndBuf > 0 {
+		if err := tc.SetWriteBuffer(o.SndBuf); err != nil {
+			return err
+		}
+	}
+	if o.RcvBuf > 0 {
+		if err := tc.SetReadBuffer(o.RcvBuf); err != nil {
+			return err
+		}
+	}
+	if o.DSCP > 0 {
+		ipv6 := false
+		if addr, ok := tc.LocalAddr().(*net.TCPAddr); ok {
+			ipv6 = addr.IP.To4() == nil
+		}
+		if err := setTOS(tc, int(o.DSCP)<<2, ipv6); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tcpConn(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// String returns the spec of o, as Parse reads it.
+func (o Options) String() string {
+	var opts []string
+	if o.Nagle {
+		opts = append(opts, "nagle=on")
+	}
+	if o.SndBuf > 0 {
+		opts = append(opts, fmt.Sprintf("sndbuf=%d", o.SndBuf))
+	}
+	if o.RcvBuf > 0 {
+		opts = append(opts, fmt.Sprintf("rcvbuf=%d", o.RcvBuf))
+	}
+	if o.DSCP > 0 {
+		opts = append(opts, fmt.Sprintf("dscp=%d", o.DSCP))
+	}
+	return strings.Join(opts, ",")
+}
+
+// Parse reads options from a comma-separated list of name=value pairs:
+// nagle=on|off, sndbuf=<bytes>, rcvbuf=<bytes> (with an optional K or M
+// suffix) and dscp=<codepoint>, as a number from 0 to 63 or by name (ef,
+// cs0 to cs7, af11 to af43). An empty spec leaves every option alone.
+func Parse(spec string) (Options, error) {
+	var o Options
+	for _, opt := range strings.Split(spec, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		name, value, found := strings.Cut(opt, "=")
+		if !found {
+			return o, fmt.Errorf("socket option %q has no value", opt)
+		}
+		var err error
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "nagle":
+			switch strings.ToLower(value) {
+			case "on", "true", "1":
+				o.Nagle = true
+			case "off", "false", "0":
+				o.Nagle = false
+			default:
+				err = fmt.Errorf("nagle must be on or off, not %q", value)
+			}
+		case "sndbuf":
+			o.SndBuf, err = parseSize(value)
+		case "rcvbuf":
+			o.RcvBuf, err = parseSize(value)
+		case "dscp":
+			o.DSCP, err = ParseDSCP(value)
+		default:
+			err = fmt.Errorf("unknown socket option %q (want nagle, sndbuf, rcvbuf or dscp)", name)
+		}
+		if err != nil {
+			return o, err
+		}
+	}
+	return o, nil
+}
+
+func parseSize(s string) (int, error) {
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "K") || strings.HasSuffix(s, "k"):
+		mult, s = 1<<10, s[:len(s)-1]
+	case strings.HasSuffix(s, "M") || strings.HasSuffix(s, "m"):
+		mult, s = 1<<20, s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > (1<<31-1)/mult {
+		return 0, fmt.Errorf("bad buffer size %q", s)
+	}
+	return n * mult, nil
+}
+
+// ParseDSCP returns the DSCP codepoint name stands for: a number from 0 to
+// 63, ef (expedited forwarding), csN (class selector N) or afXY (assured
+// forwarding class X, drop precedence Y).
+func ParseDSCP(name string) (uint8, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < 0 || n > 63 {
+			return 0, fmt.Errorf("DSCP %d out of range 0-63", n)
+		}
+		return uint8(n), nil
+	}
+	switch {
+	case name == "ef":
+		return 46, nil
+	case len(name) == 3 && strings.HasPrefix(name, "cs") && name[2] >= '0' && name[2] <= '7':
+		return (name[2] - '0') << 3, nil
+	case len(name) == 4 && strings.HasPrefix(name, "af") && name[2] >= '1' && name[2] <= '4' && name[3] >= '1' && name[3] <= '3':
+		return (name[2]-'0')<<3 | (name[3]-'0')<<1, nil
+	}
+	return 0, fmt.Errorf("unknown DSCP %q (want 0-63, ef, csN or afXY)", name)
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package sockopt
+
+import "net"
+
+func setTOS(tc *net.TCPConn, tos int, ipv6 bool) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,28 @@
+//go:build linux || darwin || freebsd
+
+package sockopt
+
+import (
+	"net"
+	"syscall"
+)
+
+// set the TOS byte of the packets tc sends, or their traffic class over IPv6
+func setTOS(tc *net.TCPConn, tos int, ipv6 bool) error {
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if ipv6 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
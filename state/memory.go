@@ -0,0 +1,35 @@
+package state
+
+import "sync/atomic"
+
+// The state lives in memory, and grows with every key written, so a replica
+// on a small node keeps an eye on its size (see Stats) to act before the
+// node runs out. Go does not tell how much memory a map takes, so the size is
+// estimated from the number of keys, at ENTRY_BYTES each, which is about
+// what a map of 8-byte keys to 16-byte entries (a value and its version)
+// takes per entry, with its buckets' overhead and the room it keeps to grow. The estimate leaves out the maps
+// that snapshots still hold (see snapshot.go): while a snapshot is being
+// read, the shards written since take up to twice their size.
+
+const (
+    ENTRY_BYTES = 56 // approximate bytes a key takes, with its value and version
+    SHARD_BYTES = 48 // bytes an empty shard takes
+)
+
+// Stats are the approximate memory use of a State.
+type Stats struct {
+    Keys   int64 // keys that have a value
+    Bytes  int64 // approximate bytes the keys and their entries take
+    Copied int64 // entries copied so far from the shards shared with snapshots
+}
+
+// Stats returns the approximate memory use of the state. It may be called
+// from any goroutine, while commands execute.
+func (st *State) Stats() Stats {
+    keys := atomic.LoadInt64(&st.keys)
+    return Stats{
+        Keys:   keys,
+        Bytes:  keys*ENTRY_BYTES + NUM_SHARDS*SHARD_BYTES,
+        Copied: atomic.LoadInt64(&st.copied),
+    }
+}
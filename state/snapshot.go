@@ -0,0 +1,147 @@
+package state
+
+import "sync/atomic"
+
+// The store is split by key into NUM_SHARDS maps, each tagged with the
+// generation that may write it. Snapshot starts a new generation, and keeps
+// the maps of the previous one, which are never written again: the first
+// write to a shard in the new generation copies its map. Taking a snapshot
+// thus costs NUM_SHARDS pointers, however large the state, and the copying
+// it implies is spread over the writes that follow, one shard at a time,
+// while the snapshot is read (e.g., written out for a backup) alongside
+// execution, without locks.
+//
+// Each key holds its value with its version: the number of writes to the
+// key executed so far, 0 for a key never written. Replicas execute the writes
+// to a key in the same order, so they agree on its versions, which a client
+// can thus send back with a conditional write (CPUT) to have it applied only
+// if no write to the key came in between, even one that wrote the same value.
+
+const NUM_SHARDS = 256
+
+// An Entry is the value of a key, with its version.
+type Entry struct {
+    Value   Value
+    Version uint64
+}
+
+type shard struct {
+    m   map[Key]Entry
+    gen uint64 // the generation that may write m
+}
+
+func shardOf(k Key) int {
+    return int(uint64(k) * 0x9E3779B97F4A7C15 >> 56)
+}
+
+// Get returns the value of k, and whether k has one.
+func (st *State) Get(k Key) (Value, bool) {
+    e, present := st.shards[shardOf(k)].m[k]
+    return e.Value, present
+}
+
+// Version returns the version of k (0 if k has no value).
+func (st *State) Version(k Key) uint64 {
+    return st.shards[shardOf(k)].m[k].Version
+}
+
+// write v to k, at the key's next version
+func (st *State) put(k Key, v Value) {
+    st.putEntry(k, Entry{v, st.Version(k) + 1})
+}
+
+func (st *State) putEntry(k Key, e Entry) {
+    sh := &st.shards[shardOf(k)]
+    if sh.gen != st.gen {
+        // shared with a snapshot
+        m := make(map[Key]Entry, len(sh.m)+1)
+        for k, v := range sh.m {
+            m[k] = v
+        }
+        sh.m, sh.gen = m, st.gen
+        atomic.AddInt64(&st.copied, int64(len(m)))
+    }
+    if _, present := sh.m[k]; !present {
+        atomic.AddInt64(&st.keys, 1)
+    }
+    sh.m[k] = e
+}
+
+// Len returns the number of keys that have a value.
+func (st *State) Len() int {
+    return int(atomic.LoadInt64(&st.keys))
+}
+
+// Range calls f with every key and its value, in no particular order, until
+// f returns false.
+func (st *State) Range(f func(k Key, v Value) bool) {
+    for i := range st.shards {
+        for k, e := range st.shards[i].m {
+            if !f(k, e.Value) {
+                return
+            }
+        }
+    }
+}
+
+// Replace makes store the whole state, keys at their versions.
+func (st *State) Replace(store map[Key]Entry) {
+    st.gen++
+    for i := range st.shards {
+        st.shards[i] = shard{make(map[Key]Entry), st.gen}
+    }
+    atomic.StoreInt64(&st.keys, 0)
+    for k, e := range store {
+        st.putEntry(k, e)
+    }
+}
+
+// A Snapshot is the state as it was when it was taken, which stays valid
+// and may be read from any goroutine while the state goes on executing
+// commands.
+type Snapshot struct {
+    shards [NUM_SHARDS]map[Key]Entry
+}
+
+// Snapshot returns the current state, in constant time. Like Execute, it
+// must not run concurrently with the execution of commands.
+func (st *State) Snapshot() *Snapshot {
+    snap := new(Snapshot)
+    for i := range st.shards {
+        snap.shards[i] = st.shards[i].m
+    }
+    st.gen++
+    return snap
+}
+
+// Get returns the value of k in the snapshot, and whether k had one.
+func (s *Snapshot) Get(k Key) (Value, bool) {
+    e, present := s.shards[shardOf(k)][k]
+    return e.Value, present
+}
+
+// Version returns the version of k in the snapshot (0 if k had no value).
+func (s *Snapshot) Version(k Key) uint64 {
+    return s.shards[shardOf(k)][k].Version
+}
+
+// Len returns the number of keys that had a value.
+func (s *Snapshot) Len() int {
+    n := 0
+    for _, m := range s.shards {
+        n += len(m)
+    }
+    return n
+}
+
+// Range calls f with every key of the snapshot and its value, in no
+// particular order, until f returns false.
+func (s *Snapshot) Range(f func(k Key, v Value) bool) {
+    for _, m := range s.shards {
+        for k, e := range m {
+            if !f(k, e.Value) {
+                return
+            }
+        }
+    }
+}
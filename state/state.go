@@ -17,6 +17,7 @@ const (
     DELETE
     RLOCK
     WLOCK
+    CPUT // PUT V if the key is still at Version
 )
 
 type Value int64
@@ -29,11 +30,16 @@ type Command struct {
     Op Operation
     K Key
     V Value
+    Version uint64 // for CPUT only: the version the key must be at (see snapshot.go)
 }
 
 type State struct {
     mutex *sync.Mutex
-    Store map[Key]Value
+    shards [NUM_SHARDS]shard // the store, split by key (see snapshot.go)
+    gen uint64 // the generation of the shards that may be written
+    keys int64 // keys that have a value (accessed atomically; see memory.go)
+    copied int64 // entries copied from snapshots' shards (accessed atomically)
+    CPUTFailed bool // the last CPUT executed found the key at another version, and wrote nothing
     //DB *leveldb.DB
 }
 
@@ -48,12 +54,16 @@ func InitState() *State {
     return &State{d}
     */
 
-    return &State{new(sync.Mutex), make(map[Key]Value)}
+    st := &State{mutex: new(sync.Mutex)}
+    for i := range st.shards {
+        st.shards[i].m = make(map[Key]Entry)
+    }
+    return st
 }
 
 func Conflict(gamma *Command, delta *Command) bool {
     if gamma.K == delta.K {
-        if gamma.Op == PUT || delta.Op == PUT {
+        if IsWrite(gamma) || IsWrite(delta) {
             return true
         }
     }
@@ -75,6 +85,35 @@ func IsRead(command *Command) bool {
     return command.Op == GET
 }
 
+func IsWrite(command *Command) bool {
+    return command.Op == PUT || command.Op == CPUT
+}
+
+// ApplyBatch executes cmds in order, as Apply does one at a time, under a
+// single acquisition of the state's lock, and appends their results to
+// results, whose storage callers can reuse from one batch to the next.
+// CPUTFailed is left as the last CPUT of the batch set it.
+func (st *State) ApplyBatch(cmds []Command, results []Entry) []Entry {
+    if n := len(results) + len(cmds); n > cap(results) {
+        grown := make([]Entry, len(results), n)
+        copy(grown, results)
+        results = grown
+    }
+    st.mutex.Lock()
+    for i := range cmds {
+        results = append(results, cmds[i].Apply(st))
+    }
+    st.mutex.Unlock()
+    return results
+}
+
+// Apply executes c, and returns its result with the version of its key
+// once executed: the version read or written, or the one a failed CPUT found.
+func (c *Command) Apply(st *State) Entry {
+    v := c.Execute(st)
+    return Entry{v, st.Version(c.K)}
+}
+
 func (c *Command) Execute(st *State) Value {
     //fmt.Printf("Executing (%d, %d)\n", c.K, c.V)
 
@@ -91,11 +130,20 @@ func (c *Command) Execute(st *State) Value {
         st.DB.Set(key[:], value[:], nil)
         */
 
-        st.Store[c.K] = c.V
+        st.put(c.K, c.V)
+        return c.V
+
+    case CPUT:
+        st.CPUTFailed = st.Version(c.K) != c.Version
+        if st.CPUTFailed {
+            cur, _ := st.Get(c.K)
+            return cur
+        }
+        st.put(c.K, c.V)
         return c.V
 
     case GET:
-        if val, present := st.Store[c.K]; present {
+        if val, present := st.Get(c.K); present {
             return val
         }
     }
@@ -16,6 +16,10 @@ func (t *Command) Marshal(w io.Writer) {
 	w.Write(bs)
 	binary.LittleEndian.PutUint64(bs, uint64(t.V))
 	w.Write(bs)
+	if t.Op == CPUT {
+		binary.LittleEndian.PutUint64(bs, t.Version)
+		w.Write(bs)
+	}
 }
 
 func (t *Command) Unmarshal(r io.Reader) error {
@@ -35,6 +39,12 @@ func (t *Command) Unmarshal(r io.Reader) error {
 		return err
 	}
 	t.V = Value(binary.LittleEndian.Uint64(bs))
+	if t.Op == CPUT {
+		if _, err := io.ReadFull(r, bs); err != nil {
+			return err
+		}
+		t.Version = binary.LittleEndian.Uint64(bs)
+	}
 	return nil
 }
 
@@ -73,3 +83,39 @@ func (t *Value) Unmarshal(r io.Reader) error {
 	*t = Value(binary.LittleEndian.Uint64(bs))
     return nil
 }
+
+// COMMAND_SIZE is the size of a marshaled command, except a CPUT, which
+// carries the version it expects in CPUT_EXTRA_SIZE more bytes.
+const COMMAND_SIZE = 17
+const CPUT_EXTRA_SIZE = 8
+
+// Size is the number of bytes Marshal writes.
+func (t *Command) Size() int {
+	if t.Op == CPUT {
+		return COMMAND_SIZE + CPUT_EXTRA_SIZE
+	}
+	return COMMAND_SIZE
+}
+
+// MarshalTo writes the same Size() bytes as Marshal into b.
+func (t *Command) MarshalTo(b []byte) int {
+	b[0] = byte(t.Op)
+	binary.LittleEndian.PutUint64(b[1:9], uint64(t.K))
+	binary.LittleEndian.PutUint64(b[9:17], uint64(t.V))
+	if t.Op == CPUT {
+		binary.LittleEndian.PutUint64(b[17:25], t.Version)
+		return COMMAND_SIZE + CPUT_EXTRA_SIZE
+	}
+	return COMMAND_SIZE
+}
+
+// CommandsSize is the total Size of cmds.
+func CommandsSize(cmds []Command) int {
+	n := len(cmds) * COMMAND_SIZE
+	for i := range cmds {
+		if cmds[i].Op == CPUT {
+			n += CPUT_EXTRA_SIZE
+		}
+	}
+	return n
+}